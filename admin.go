@@ -0,0 +1,207 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/getlantern/yaml"
+	"github.com/getlantern/zenodb/common"
+)
+
+// ForceFlush immediately flushes (archives) the given table's memstore to
+// disk.
+func (db *DB) ForceFlush(table string) error {
+	return db.ForceFlushContext(context.Background(), table)
+}
+
+// ForceFlushContext is like ForceFlush but stops waiting for the flush once
+// ctx is done.
+func (db *DB) ForceFlushContext(ctx context.Context, table string) error {
+	t, err := db.storingTable(table)
+	if err != nil {
+		return err
+	}
+	t.log.Debug("Force flushing")
+	return t.rowStore.forceFlush(ctx)
+}
+
+// ApplyRetention immediately truncates data older than the given table's
+// retention period, removes old files for the table and caps the size of the
+// WAL from which it reads.
+func (db *DB) ApplyRetention(table string) error {
+	return db.ApplyRetentionContext(context.Background(), table)
+}
+
+// ApplyRetentionContext is like ApplyRetention but stops waiting for the
+// flush once ctx is done, in which case the WAL is left as is.
+func (db *DB) ApplyRetentionContext(ctx context.Context, table string) error {
+	t, err := db.storingTable(table)
+	if err != nil {
+		return err
+	}
+	t.log.Debug("Applying retention")
+	err = t.rowStore.applyRetention(ctx)
+	if err != nil {
+		return err
+	}
+	db.tablesMutex.RLock()
+	w := db.streams[t.From]
+	db.tablesMutex.RUnlock()
+	if w == nil {
+		return nil
+	}
+	return db.truncateWAL(t.From, w)
+}
+
+// FlushForwardedInserts immediately sends all inserts that are queued for
+// forwarding to the leader.
+func (db *DB) FlushForwardedInserts() error {
+	if db.opts.FlushForwardedInserts == nil {
+		return fmt.Errorf("This node does not forward inserts")
+	}
+	db.opts.FlushForwardedInserts()
+	return nil
+}
+
+// PauseIngestion stops the given table from ingesting new points until
+// ResumeIngestion is called. New points remain in the WAL in the meantime.
+// Pausing does not survive a restart. On followers, pausing one table also
+// holds up other tables that follow the same stream.
+func (db *DB) PauseIngestion(table string) error {
+	t, err := db.storingTable(table)
+	if err != nil {
+		return err
+	}
+	t.log.Debug("Pausing ingestion")
+	t.pause()
+	return nil
+}
+
+// DiscardIngestion is like PauseIngestion, except that new points are dropped
+// instead of being held in the WAL, which keeps the WAL from growing and the
+// table from catching up on a backlog once it's resumed. Dropped points count
+// towards the table's DroppedPoints. It also switches a table that's already
+// paused to dropping points.
+func (db *DB) DiscardIngestion(table string) error {
+	t, err := db.storingTable(table)
+	if err != nil {
+		return err
+	}
+	t.log.Debug("Pausing ingestion and discarding new points")
+	t.pauseDiscarding()
+	return nil
+}
+
+// Drain pauses ingestion into the given table like PauseIngestion (unless it's
+// already paused), waits for any insert that's in flight and then flushes
+// (archives) the table's memstore to disk, which releases the memory that it
+// held. The table stays paused until ResumeIngestion is called. On a cluster,
+// this only affects the partition on which it's called.
+func (db *DB) Drain(table string) error {
+	return db.DrainContext(context.Background(), table)
+}
+
+// DrainContext is like Drain but stops waiting for the flush once ctx is done,
+// in which case the table remains paused.
+func (db *DB) DrainContext(ctx context.Context, table string) error {
+	t, err := db.storingTable(table)
+	if err != nil {
+		return err
+	}
+	t.log.Debug("Draining")
+	t.quiesce()
+	return t.rowStore.forceFlush(ctx)
+}
+
+// ResumeIngestion resumes ingestion into a table paused with PauseIngestion,
+// DiscardIngestion or Drain.
+func (db *DB) ResumeIngestion(table string) error {
+	t, err := db.storingTable(table)
+	if err != nil {
+		return err
+	}
+	t.log.Debug("Resuming ingestion")
+	t.resume()
+	return nil
+}
+
+// storingTable looks up the named table, returning an error if it doesn't
+// exist or doesn't store data on this node, or if the database is read-only.
+func (db *DB) storingTable(table string) (*table, error) {
+	if db.opts.ReadOnly {
+		return nil, fmt.Errorf("Database is read-only")
+	}
+	t := db.getTable(table)
+	if t == nil {
+		return nil, common.Errorf(common.ErrUnknownTable, "Table %v not found", table)
+	}
+	if t.rowStore == nil {
+		return nil, fmt.Errorf("Table %v does not store data on this node", table)
+	}
+	return t, nil
+}
+
+type schemaEntry struct {
+	SQL             string                           `yaml:"sql"`
+	View            bool                             `yaml:"view,omitempty"`
+	Virtual         bool                             `yaml:"virtual,omitempty"`
+	MemoryOnly      bool                             `yaml:"memoryonly,omitempty"`
+	Columnar        bool                             `yaml:"columnar,omitempty"`
+	Compression     string                           `yaml:"compression,omitempty"`
+	TrackLastSeen   bool                             `yaml:"tracklastseen,omitempty"`
+	RetentionPeriod string                           `yaml:"retentionperiod,omitempty"`
+	MaxDiskBytes    int64                            `yaml:"maxdiskbytes,omitempty"`
+	MinFlushLatency string                           `yaml:"minflushlatency,omitempty"`
+	MaxFlushLatency string                           `yaml:"maxflushlatency,omitempty"`
+	FlushJitter     string                           `yaml:"flushjitter,omitempty"`
+	Backfill        string                           `yaml:"backfill,omitempty"`
+	PartitionBy     []string                         `yaml:"partitionby,omitempty"`
+	FieldWidths     map[string]string                `yaml:"fieldwidths,omitempty"`
+	FieldMetadata   map[string]*common.FieldMetadata `yaml:"fieldmetadata,omitempty"`
+}
+
+// DumpSchema returns the schema of all tables currently defined in the
+// database, in the same YAML format as the schema file.
+func (db *DB) DumpSchema() ([]byte, error) {
+	schema := make(map[string]*schemaEntry)
+	for _, t := range db.allTables() {
+		if t.Name == StatsTable {
+			// built-in
+			continue
+		}
+		t.tunablesMx.RLock()
+		opts := *t.TableOpts
+		t.tunablesMx.RUnlock()
+		entry := &schemaEntry{
+			SQL:             opts.SQL,
+			View:            opts.View,
+			Virtual:         opts.Virtual,
+			MemoryOnly:      opts.MemoryOnly,
+			Columnar:        opts.Columnar,
+			Compression:     opts.Compression,
+			TrackLastSeen:   opts.TrackLastSeen,
+			RetentionPeriod: durationString(opts.RetentionPeriod),
+			MaxDiskBytes:    opts.MaxDiskBytes,
+			MinFlushLatency: durationString(opts.MinFlushLatency),
+			FlushJitter:     durationString(opts.FlushJitter),
+			Backfill:        durationString(opts.Backfill),
+			PartitionBy:     opts.PartitionBy,
+			FieldWidths:     opts.FieldWidths,
+			FieldMetadata:   t.getFieldMetadata(),
+		}
+		if opts.MaxFlushLatency != time.Duration(math.MaxInt64) {
+			entry.MaxFlushLatency = durationString(opts.MaxFlushLatency)
+		}
+		schema[t.Name] = entry
+	}
+	return yaml.Marshal(schema)
+}
+
+func durationString(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	return d.String()
+}
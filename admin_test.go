@@ -0,0 +1,131 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/yaml"
+	"github.com/getlantern/zenodb/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdmin(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tmpFile, err := ioutil.TempFile("", "zenodbschema")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.Remove(tmpFile.Name())
+	err = ioutil.WriteFile(tmpFile.Name(), []byte(`
+thetable:
+  maxflushlatency: 1h
+  retentionperiod: 1h
+  partitionby: [x]
+  sql: SELECT SUM(a) AS a FROM inbound GROUP BY x, period(1s)
+`), 0644)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	flushedForwarded := false
+	db, err := NewDB(&DBOpts{
+		Dir:        tmpDir,
+		SchemaFile: tmpFile.Name(),
+		FlushForwardedInserts: func() {
+			flushedForwarded = true
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	now := time.Now()
+	db.Insert("inbound", now, map[string]interface{}{"x": 1}, map[string]float64{"a": 1})
+	db.Insert("inbound", now, map[string]interface{}{"x": 2}, map[string]float64{"a": 1})
+	waitFor(func() bool { return db.TableStats("thetable").ArchiveQueueDepth == 2 })
+
+	if !assert.NoError(t, db.ForceFlush("thetable")) {
+		return
+	}
+	stats := db.TableStats("thetable")
+	assert.EqualValues(t, 2, stats.DiskKeys)
+	assert.EqualValues(t, 0, stats.ArchiveQueueDepth)
+
+	assert.NoError(t, db.ApplyRetention("thetable"))
+	assert.EqualValues(t, 2, db.TableStats("thetable").DiskKeys, "Retention shouldn't remove recent data")
+
+	if !assert.NoError(t, db.PauseIngestion("thetable")) {
+		return
+	}
+	assert.True(t, db.TableStats("thetable").Paused)
+	db.Insert("inbound", now, map[string]interface{}{"x": 3}, map[string]float64{"a": 1})
+	time.Sleep(250 * time.Millisecond)
+	assert.EqualValues(t, 2, db.TableStats("thetable").InsertedPoints, "Paused table shouldn't ingest")
+	assert.NoError(t, db.ResumeIngestion("thetable"))
+	waitFor(func() bool { return db.TableStats("thetable").InsertedPoints == 3 })
+	assert.EqualValues(t, 3, db.TableStats("thetable").InsertedPoints, "Resumed table should ingest points held in WAL")
+	assert.False(t, db.TableStats("thetable").Paused)
+
+	if !assert.NoError(t, db.DiscardIngestion("thetable")) {
+		return
+	}
+	stats = db.TableStats("thetable")
+	assert.True(t, stats.Paused)
+	assert.True(t, stats.Discarding)
+	db.Insert("inbound", now, map[string]interface{}{"x": 4}, map[string]float64{"a": 1})
+	waitFor(func() bool { return db.TableStats("thetable").DroppedPoints == 1 })
+	assert.EqualValues(t, 1, db.TableStats("thetable").DroppedPoints, "Discarding table should drop new points")
+	assert.NoError(t, db.ResumeIngestion("thetable"))
+	stats = db.TableStats("thetable")
+	assert.False(t, stats.Paused)
+	assert.False(t, stats.Discarding)
+	db.Insert("inbound", now, map[string]interface{}{"x": 5}, map[string]float64{"a": 1})
+	waitFor(func() bool { return db.TableStats("thetable").InsertedPoints == 4 })
+	assert.EqualValues(t, 4, db.TableStats("thetable").InsertedPoints, "Dropped points shouldn't be ingested after resuming")
+
+	waitFor(func() bool { return db.TableStats("thetable").ArchiveQueueDepth > 0 })
+	if !assert.NoError(t, db.Drain("thetable")) {
+		return
+	}
+	stats = db.TableStats("thetable")
+	assert.True(t, stats.Paused, "Drained table should stay paused")
+	assert.EqualValues(t, 0, stats.ArchiveQueueDepth, "Drain should flush the memstore")
+	assert.EqualValues(t, 4, stats.DiskKeys)
+	assert.NoError(t, db.ResumeIngestion("thetable"))
+
+	assert.NoError(t, db.FlushForwardedInserts())
+	assert.True(t, flushedForwarded)
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, db.ForceFlushContext(canceled, "thetable"))
+	assert.Equal(t, context.Canceled, db.ApplyRetentionContext(canceled, "thetable"))
+	assert.Equal(t, context.Canceled, db.InsertContext(canceled, "inbound", now, map[string]interface{}{"x": 4}, map[string]float64{"a": 1}))
+	assert.Equal(t, context.Canceled, db.QueryContext(canceled, "SELECT * FROM thetable", true, nil, nil))
+
+	assert.Equal(t, ErrUnknownTable, common.KindOf(db.ForceFlush("unknown")))
+	assert.Error(t, db.PauseIngestion("unknown"))
+
+	b, err := db.DumpSchema()
+	if !assert.NoError(t, err) {
+		return
+	}
+	var schema Schema
+	if assert.NoError(t, yaml.Unmarshal(b, &schema), string(b)) && assert.NotNil(t, schema["thetable"], string(b)) {
+		opts := schema["thetable"]
+		assert.Equal(t, "SELECT SUM(a) AS a FROM inbound GROUP BY x, period(1s)", opts.SQL)
+		assert.Equal(t, time.Hour, opts.RetentionPeriod)
+		assert.Equal(t, time.Hour, opts.MaxFlushLatency)
+		assert.Equal(t, []string{"x"}, opts.PartitionBy)
+		assert.False(t, opts.View)
+	}
+}
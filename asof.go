@@ -0,0 +1,178 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/goexpr"
+	"github.com/getlantern/wal"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+// asOfSpec identifies the point in a stream's WAL as of which a query sees the
+// data. Inserts written to the WAL after offset are excluded. If time is set,
+// inserts of points whose timestamps are after time are excluded too, and the
+// query runs as if it were that time.
+type asOfSpec struct {
+	offset wal.Offset
+	time   time.Time
+}
+
+// QueryAsOf is like Query, but shows the data as it was at the given time,
+// excluding anything written to the WAL afterwards. The query runs as if it
+// were that time, so relative time ranges are relative to asOf. This allows
+// reproducing what a dashboard showed at some point in the past.
+//
+// Inserts are only excluded as precisely as the WAL's segments allow. Within
+// the segment that was being written at asOf, points whose own timestamps are
+// after asOf are excluded instead. See QueryAsOfOffset for details on what
+// data is available.
+func (db *DB) QueryAsOf(sqlString string, asOf time.Time) (core.FlatRowSource, error) {
+	return db.queryAsOf(sqlString, &asOfSpec{offset: wal.NewOffsetForTS(asOf), time: asOf})
+}
+
+// QueryAsOfOffset is like Query, but excludes anything written to the WAL
+// after the given offset. Relative time ranges are relative to the current
+// time.
+//
+// The data is rebuilt by replaying the tables' streams from their WALs, so it
+// only includes data that's still in the WAL (see DBOpts.MaxWALSize). The
+// query metadata's AsOf reflects this, and queries as of a time before the
+// start of the WAL fail. As-of queries are only supported on
+// nodes that write their own WAL, not on passthrough nodes, followers or
+// read-only databases.
+func (db *DB) QueryAsOfOffset(sqlString string, offset wal.Offset) (core.FlatRowSource, error) {
+	return db.queryAsOf(sqlString, &asOfSpec{offset: offset})
+}
+
+func (db *DB) queryAsOf(sqlString string, asOf *asOfSpec) (core.FlatRowSource, error) {
+	if db.opts.Passthrough || db.opts.Follow != nil || db.opts.ReadOnly {
+		return nil, fmt.Errorf("As-of queries are only supported on nodes that write their own WAL")
+	}
+	return db.query(sqlString, false, nil, true, false, nil, asOf)
+}
+
+// now returns the time as of which the query runs.
+func (asOf *asOfSpec) now(clock timeSource) time.Time {
+	if asOf == nil || asOf.time.IsZero() {
+		return clock.Now()
+	}
+	return asOf.time
+}
+
+// walStart returns the time from which the table's stream's WAL holds data,
+// which limits how far back as-of queries can see.
+func (t *table) walStart() (time.Time, error) {
+	oldest, err := t.db.oldestWALOffset(t.From)
+	if err != nil || oldest == nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, oldest.FileSequence()*int64(time.Microsecond)), nil
+}
+
+func (t *table) streamWAL() *wal.WAL {
+	t.db.tablesMutex.RLock()
+	w := t.db.streams[t.From]
+	t.db.tablesMutex.RUnlock()
+	return w
+}
+
+// iterateAsOf iterates over the table's data as of the given point in its
+// stream's WAL, which it rebuilds by replaying the WAL. Keys that don't match
+// filter (which may be nil) are skipped and only periods within window (which
+// may also be nil) are read.
+func (t *table) iterateAsOf(ctx context.Context, outFields core.Fields, asOf *asOfSpec, filter *core.KeyFilter, window *timeWindow, onValue func(bytemap.ByteMap, []encoding.Sequence) (more bool, err error)) error {
+	guard := core.Guard(ctx)
+	ms, err := t.replayWAL(asOf)
+	if err != nil {
+		return err
+	}
+	fs := &fileStore{t: t, fields: ms.fields, opts: t.rowStore.opts}
+	return fs.iterate(outFields, ms, filter, window, false, false, func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+		return guard.ProceedAfter(onValue(key, columns))
+	})
+}
+
+// replayWAL builds a memstore from the inserts in the table's stream's WAL up
+// to the given point, as if the table had only ever seen those inserts.
+func (t *table) replayWAL(asOf *asOfSpec) (*memstore, error) {
+	w := t.streamWAL()
+	if w == nil {
+		return nil, fmt.Errorf("No WAL found for stream %v", t.From)
+	}
+	fields := t.getFields()
+	ms := &memstore{fields: fields, tree: t.rowStore.newMemStore().tree}
+
+	// Only replay what the table itself has read so far, since the reader would
+	// otherwise block waiting for more data at the end of the WAL.
+	readOffset := t.getReadOffset()
+	if readOffset == nil {
+		// nothing to replay
+		return ms, nil
+	}
+
+	// Segments aren't aligned with the retention period, so read the whole WAL
+	// and skip points that are too old by their timestamps.
+	truncateBefore := asOf.now(t.db.clock).Add(-1 * t.retentionPeriod())
+	r, err := w.NewReader(t.Name+".asof", nil)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to obtain WAL reader: %v", err)
+	}
+	defer r.Close()
+
+	where := t.getWhere()
+	// counters are replayed from scratch like everything else
+	counters := counterFields(fields)
+	deltas := newCounterDeltas()
+	for {
+		data, readErr := r.Read()
+		if readErr != nil {
+			return nil, fmt.Errorf("Unable to read from WAL: %v", readErr)
+		}
+		offset := r.Offset()
+		if offset.After(asOf.offset) {
+			// written after asOf
+			break
+		}
+		if data != nil {
+			t.replayInsert(ms, data, where, asOf, truncateBefore, counters, deltas)
+		}
+		if !readOffset.After(offset) {
+			// caught up with the table
+			break
+		}
+	}
+	return ms, nil
+}
+
+func (t *table) replayInsert(ms *memstore, data []byte, where goexpr.Expr, asOf *asOfSpec, truncateBefore time.Time, counters []string, deltas *counterDeltas) {
+	ts, dims, vals, err := decodeInsert(data)
+	if err != nil {
+		t.log.Errorf("%v, skipping entry", err)
+		return
+	}
+	if ts.Before(truncateBefore) || (!asOf.time.IsZero() && ts.After(asOf.time)) {
+		return
+	}
+	// copy, since the WAL read buffer changes on the next read
+	dimsBM := make(bytemap.ByteMap, len(dims))
+	valsBM := make(bytemap.ByteMap, len(vals))
+	copy(dimsBM, dims)
+	copy(valsBM, vals)
+	if len(counters) > 0 {
+		valsBM = deltas.apply(ts, dimsBM, valsBM, counters, truncateBefore)
+	}
+	if where != nil && !where.Eval(dimsBM).(bool) {
+		return
+	}
+	key, pooledKey := t.keyFor(dimsBM)
+	length := ms.tree.Length()
+	ms.tree.Update(key, nil, encoding.NewTSParams(ts, valsBM), dimsBM)
+	if pooledKey && ms.tree.Length() == length {
+		encoding.ReleaseKey(key)
+	}
+	ms.inserts++
+}
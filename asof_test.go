@@ -0,0 +1,81 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryAsOf(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir: tmpDir,
+		Schema: Schema{
+			"thetable": &TableOpts{
+				RetentionPeriod: 24 * time.Hour,
+				SQL:             "SELECT SUM(a) AS a FROM inbound GROUP BY x, period(1s)",
+			},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	sumA := func(source core.FlatRowSource, err error) float64 {
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		total := float64(0)
+		var outFields core.Fields
+		err = source.Iterate(context.Background(), func(fields core.Fields) error {
+			outFields = fields
+			return nil
+		}, func(row *core.FlatRow) (bool, error) {
+			for i, field := range outFields {
+				if field.Name == "a" {
+					total += row.Values[i]
+				}
+			}
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return total
+	}
+
+	now := time.Now()
+	db.Insert("inbound", now, map[string]interface{}{"x": 1}, map[string]float64{"a": 1})
+	waitFor(func() bool { return db.TableStats("thetable").InsertedPoints == 1 })
+	offset := db.getTable("thetable").getReadOffset()
+	db.Insert("inbound", now, map[string]interface{}{"x": 2}, map[string]float64{"a": 2})
+	waitFor(func() bool { return db.TableStats("thetable").InsertedPoints == 2 })
+	db.Insert("inbound", now.Add(2*time.Second), map[string]interface{}{"x": 3}, map[string]float64{"a": 4})
+	waitFor(func() bool { return db.TableStats("thetable").InsertedPoints == 3 })
+	if !assert.NoError(t, db.ForceFlush("thetable")) {
+		return
+	}
+
+	assert.EqualValues(t, 1, sumA(db.QueryAsOfOffset("SELECT a FROM thetable", offset)), "inserts after offset should be excluded")
+	assert.EqualValues(t, 3, sumA(db.QueryAsOf("SELECT a FROM thetable", now.Add(time.Second))), "points after as-of time should be excluded")
+	assert.EqualValues(t, 7, sumA(db.QueryAsOf("SELECT a FROM thetable", now.Add(3*time.Second))), "everything up to as-of time should be included")
+
+	_, err = db.QueryAsOf("SELECT a FROM thetable", now.Add(-1*time.Hour))
+	assert.Equal(t, ErrOutsideHotPeriod, common.KindOf(err), "as-of query from before the WAL should fail")
+
+	source, err := db.QueryAsOf("SELECT a FROM thetable", now)
+	if assert.NoError(t, err) {
+		walStart, _ := db.getTable("thetable").walStart()
+		assert.False(t, source.GetAsOf().Before(walStart.Truncate(time.Second)), "as-of query shouldn't claim data from before the WAL")
+	}
+}
@@ -0,0 +1,89 @@
+package zenodb
+
+import (
+	"sort"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+func (t *table) maxDiskBytes() int64 {
+	t.tunablesMx.RLock()
+	maxDiskBytes := t.MaxDiskBytes
+	t.tunablesMx.RUnlock()
+	return maxDiskBytes
+}
+
+// evictedBefore returns the time up to which data was evicted to keep the table
+// within its MaxDiskBytes, or zero if the table doesn't have a budget.
+func (t *table) evictedBefore() time.Time {
+	if t.maxDiskBytes() <= 0 {
+		return time.Time{}
+	}
+	return t.counters.evictedBefore()
+}
+
+// evictOverBudget checks whether the given fileStore, which has the given size,
+// exceeds the table's MaxDiskBytes. If so, it decides how many of the oldest
+// periods to evict to get back within budget and returns true, in which case
+// the table needs to be flushed again to actually remove them. The newest
+// period is never evicted.
+func (rs *rowStore) evictOverBudget(fs *fileStore, size int64) bool {
+	maxDiskBytes := rs.t.maxDiskBytes()
+	if maxDiskBytes <= 0 || size <= maxDiskBytes {
+		return false
+	}
+
+	// Tally how many bytes each period takes up. This is uncompressed, so it's
+	// only used to estimate what fraction of the data to evict.
+	periodBytes := make(map[int64]int64)
+	totalBytes := int64(0)
+	err := fs.iterate(rs.fields, nil, nil, nil, false, false, func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+		for i, seq := range columns {
+			width := rs.fields[i].Expr.EncodedWidth()
+			until := seq.UntilInt()
+			for p := 0; p < seq.NumPeriods(width); p++ {
+				periodBytes[until-int64(p)*int64(rs.t.Resolution)] += int64(width)
+				totalBytes += int64(width)
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		rs.t.log.Errorf("Unable to determine which periods to evict: %v", err)
+		return false
+	}
+	if len(periodBytes) < 2 {
+		rs.t.log.Debugf("Flushed %v exceeds budget of %v but only the newest period remains", humanize.Bytes(uint64(size)), humanize.Bytes(uint64(maxDiskBytes)))
+		return false
+	}
+
+	periods := make([]int64, 0, len(periodBytes))
+	for period := range periodBytes {
+		periods = append(periods, period)
+	}
+	sort.Slice(periods, func(i, j int) bool { return periods[i] < periods[j] })
+	toEvict := bytesToEvict(totalBytes, size, maxDiskBytes)
+	evictedBytes := int64(0)
+	evictBefore := periods[0]
+	for _, period := range periods[:len(periods)-1] {
+		evictBefore = period
+		evictedBytes += periodBytes[period]
+		if evictedBytes >= toEvict {
+			break
+		}
+	}
+
+	rs.t.counters.recordBudgetEviction(evictBefore)
+	rs.t.log.Debugf("Flushed %v exceeds budget of %v, evicting data up to %v", humanize.Bytes(uint64(size)), humanize.Bytes(uint64(maxDiskBytes)), encoding.TimeFromInt(evictBefore).In(time.UTC))
+	return true
+}
+
+// bytesToEvict estimates how many of the given totalBytes to evict to shrink a
+// file of the given size to maxDiskBytes. The fraction is computed in floating
+// point because multiplying the byte counts can overflow an int64.
+func bytesToEvict(totalBytes int64, size int64, maxDiskBytes int64) int64 {
+	return int64(float64(totalBytes) * (float64(size-maxDiskBytes) / float64(size)))
+}
@@ -0,0 +1,89 @@
+package zenodb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaxDiskBytes(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 0, 0, time.UTC)
+	clock := NewVirtualClock(epoch)
+	clock.Freeze()
+	db, err := NewDB(&DBOpts{
+		Dir:   tmpDir,
+		Clock: clock,
+		Schema: Schema{
+			"thetable": &TableOpts{
+				RetentionPeriod: 24 * time.Hour,
+				SQL:             "SELECT SUM(a) AS a FROM inbound GROUP BY u, period(1m)",
+			},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	inserted := 0
+	insert := func(ts time.Time, u string, a float64) {
+		db.Insert("inbound", ts, map[string]interface{}{"u": u}, map[string]float64{"a": a})
+		inserted++
+		waitFor(func() bool { return db.TableStats("thetable").InsertedPoints == int64(inserted) })
+	}
+	for i := 0; i < 10; i++ {
+		for u := 0; u < 3; u++ {
+			insert(epoch.Add(-time.Duration(i)*time.Minute), fmt.Sprintf("user%d", u), float64(i+1))
+		}
+	}
+	if !assert.NoError(t, db.ForceFlush("thetable")) {
+		return
+	}
+	stats := db.TableStats("thetable")
+	assert.EqualValues(t, 0, stats.BudgetEvictions, "table without budget shouldn't evict")
+	fullSize := stats.DiskBytes
+	if !assert.True(t, fullSize > 0) {
+		return
+	}
+
+	if !assert.NoError(t, db.Set(fmt.Sprintf("SET thetable.maxdiskbytes = %d", fullSize/2))) {
+		return
+	}
+	if !assert.NoError(t, db.ApplyRetention("thetable")) {
+		return
+	}
+	stats = db.TableStats("thetable")
+	assert.True(t, stats.BudgetEvictions > 0, "table over budget should evict")
+	assert.True(t, stats.DiskBytes < fullSize, "eviction should shrink table")
+	assert.True(t, stats.EvictedBefore.After(epoch.Add(-10*time.Minute)), "oldest periods should be evicted")
+	assert.True(t, stats.EvictedBefore.Before(epoch), "newest period should be kept")
+	assert.EqualValues(t, 0, sumFieldAt(t, db, "thetable", "a", epoch.Add(-9*time.Minute)), "oldest period should be gone")
+	assert.EqualValues(t, 3, sumFieldAt(t, db, "thetable", "a", epoch), "newest period should remain")
+
+	db.Insert("inbound", epoch.Add(-9*time.Minute), map[string]interface{}{"u": "user0"}, map[string]float64{"a": 1000})
+	insert(epoch, "user0", 1000)
+	assert.EqualValues(t, 0, sumFieldAt(t, db, "thetable", "a", epoch.Add(-9*time.Minute)), "late data for evicted periods should be dropped")
+
+	info := db.DescribeTables()
+	for _, table := range info {
+		if table.Name == "thetable" {
+			assert.Equal(t, fullSize/2, table.MaxDiskBytes)
+		}
+	}
+}
+
+func TestBytesToEvict(t *testing.T) {
+	assert.EqualValues(t, 250, bytesToEvict(1000, 400, 300))
+	// These would overflow if multiplied as int64s
+	assert.EqualValues(t, int64(1)<<39, bytesToEvict(1<<40, 1<<40, 1<<39))
+}
@@ -4,6 +4,7 @@ package bytetree
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/getlantern/bytemap"
@@ -12,7 +13,14 @@ import (
 )
 
 type Tree struct {
-	outExprs      []expr.Expr
+	// epoch is incremented whenever the Tree is copied, accessed atomically
+	epoch    int64
+	outExprs []expr.Expr
+	// compiledExprs are the outExprs compiled against fieldIndex, for updating
+	// from params
+	compiledExprs []expr.Expr
+	fieldIndex    *expr.FieldIndex
+	params        expr.IndexedParams
 	inExprs       []expr.Expr
 	subMergers    [][]expr.SubMerge
 	outResolution time.Duration
@@ -23,14 +31,21 @@ type Tree struct {
 	root          *node
 	bytes         int
 	length        int
-	mx            sync.RWMutex
+	// dataSlab is preallocated space for the data of new nodes
+	dataSlab []encoding.Sequence
+	mx       sync.RWMutex
 }
 
+// dataSlabNodes is the number of nodes for which to preallocate data at once
+const dataSlabNodes = 128
+
 type node struct {
 	key        []byte
 	edges      edges
 	data       []encoding.Sequence
 	removedFor []int64
+	// epoch is the Tree's epoch as of the last update to this node's data
+	epoch int64
 }
 
 type edge struct {
@@ -49,11 +64,16 @@ func New(
 	strideSlice time.Duration,
 ) *Tree {
 	var subMergers [][]expr.SubMerge
+	fieldIndex := expr.NewFieldIndex()
+	compiledExprs := make([]expr.Expr, 0, len(outExprs))
 	for _, o := range outExprs {
 		subMergers = append(subMergers, o.SubMergers(inExprs))
+		compiledExprs = append(compiledExprs, expr.Compile(o, fieldIndex))
 	}
 	return &Tree{
 		outExprs:      outExprs,
+		compiledExprs: compiledExprs,
+		fieldIndex:    fieldIndex,
 		inExprs:       inExprs,
 		subMergers:    subMergers,
 		outResolution: outResolution,
@@ -148,8 +168,10 @@ nodeLoop:
 	}
 }
 
-// Copy makes a copy of this Tree.
+// Copy makes a copy of this Tree. The copy shares the data of the original's
+// nodes, which stops the original from growing that data in place.
 func (bt *Tree) Copy() *Tree {
+	atomic.AddInt64(&bt.epoch, 1)
 	cp := &Tree{bytes: bt.bytes, length: bt.length, root: &node{}}
 	nodes := make([]*node, 0, bt.Length())
 	nodeCopies := make([]*node, 0, bt.Length())
@@ -224,14 +246,29 @@ nodeLoop:
 
 func (n *node) doUpdate(bt *Tree, fullKey []byte, vals []encoding.Sequence, params encoding.TSParams, metadata bytemap.ByteMap) int {
 	if n.data == nil {
-		n.data = make([]encoding.Sequence, len(bt.outExprs))
+		n.data = bt.newData()
 	}
 	bytesAdded := 0
 	if params != nil {
-		for o, ex := range bt.outExprs {
+		// Look up each field only once, no matter how many expressions use it
+		ts, fieldParams := params.TimeAndParams()
+		bt.params.Load(bt.fieldIndex, fieldParams)
+		epoch := atomic.LoadInt64(&bt.epoch)
+		// If the Tree was copied since this node was last updated, the copy may be
+		// reading its Sequences
+		shared := n.epoch != epoch
+		n.epoch = epoch
+		for o, ex := range bt.compiledExprs {
 			current := n.data[o]
+			if shared {
+				current = current[:len(current):len(current)]
+			}
 			previousSize := cap(current)
-			updated := current.Update(params, metadata, ex, bt.outResolution, bt.asOf)
+			updated := current.UpdateValue(ts, &bt.params, metadata, ex, bt.outResolution, bt.asOf)
+			if shared && sameArray(current, updated) {
+				// keep it from being grown in place on subsequent updates
+				updated = updated[:len(updated):len(updated)]
+			}
 			n.data[o] = updated
 			bytesAdded += cap(updated) - previousSize
 		}
@@ -255,6 +292,27 @@ func (n *node) doUpdate(bt *Tree, fullKey []byte, vals []encoding.Sequence, para
 	return bytesAdded
 }
 
+// newData allocates the data for a new node. Allocating space for many nodes
+// at once saves an allocation per node, which adds up for tables that see
+// lots of new keys.
+func (bt *Tree) newData() []encoding.Sequence {
+	n := len(bt.outExprs)
+	if len(bt.dataSlab) < n {
+		bt.dataSlab = make([]encoding.Sequence, n*dataSlabNodes)
+	}
+	data := bt.dataSlab[:n:n]
+	bt.dataSlab = bt.dataSlab[n:]
+	return data
+}
+
+// sameArray indicates whether a and b are backed by the same array.
+func sameArray(a encoding.Sequence, b encoding.Sequence) bool {
+	if cap(a) == 0 || cap(b) == 0 {
+		return false
+	}
+	return &a[:cap(a)][cap(a)-1] == &b[:cap(b)][cap(b)-1]
+}
+
 func (n *node) wasRemovedFor(bt *Tree, ctx int64) bool {
 	if ctx == 0 {
 		return false
@@ -85,6 +85,32 @@ func TestByteTreeUpdate(t *testing.T) {
 	})
 }
 
+func TestByteTreeCopyNotModifiedInPlace(t *testing.T) {
+	e := SUM(FIELD("a"))
+	resolution := time.Second
+	bt := New([]Expr{e}, nil, resolution, 0, epoch.Add(-1*time.Hour), epoch.Add(time.Hour), 0)
+	key := []byte("key")
+	for i := 0; i < 10; i++ {
+		bt.Update(key, nil, tsParams(epoch.Add(time.Duration(i)*resolution), 1, 0), nil)
+	}
+
+	var copied encoding.Sequence
+	bt.Copy().Walk(ctx, func(key []byte, data []encoding.Sequence) (bool, bool, error) {
+		copied = data[0]
+		return true, false, nil
+	})
+	orig := append(encoding.Sequence(nil), copied...)
+	for i := 10; i < 20; i++ {
+		bt.Update(key, nil, tsParams(epoch.Add(time.Duration(i)*resolution), 1, 0), nil)
+	}
+	assert.Equal(t, orig, copied, "updates after copying shouldn't modify the copied data in place")
+
+	bt.Walk(ctx, func(key []byte, data []encoding.Sequence) (bool, bool, error) {
+		assert.Equal(t, 20, data[0].NumPeriods(e.EncodedWidth()))
+		return true, false, nil
+	})
+}
+
 func doTest(t *testing.T, populate func(bt *Tree, resolutionOut time.Duration, eA Expr, eB Expr)) {
 	resolutionOut := 10 * time.Second
 	resolutionIn := 1 * time.Second
@@ -0,0 +1,139 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/sql"
+)
+
+// CardinalityReport reports how many keys a table holds and how much each
+// dimension contributes to them, for finding dimensions that blow up the key
+// space.
+type CardinalityReport struct {
+	Table string
+	// Keys is the number of keys in the table
+	Keys int64
+	// Bytes is the encoded size of the keys and their data
+	Bytes int64
+	// Dims are ordered by number of distinct values, highest first
+	Dims []*DimensionCardinality
+}
+
+// DimensionCardinality reports the cardinality of one dimension.
+type DimensionCardinality struct {
+	Dim string
+	// Values is the number of distinct values of the dimension
+	Values int64
+	// Keys is the number of keys that have the dimension
+	Keys int64
+	// Bytes is the encoded size of those keys and their data
+	Bytes int64
+	// Top are the values with the most keys, most first
+	Top []*ValueCardinality
+}
+
+// ValueCardinality reports how many keys have a specific value of a dimension.
+type ValueCardinality struct {
+	Value string
+	Keys  int64
+	Bytes int64
+}
+
+// ShowCardinality runs a SHOW CARDINALITY statement, like
+//
+//	SHOW CARDINALITY FOR thetable LIMIT 20
+//
+// see Cardinality.
+func (db *DB) ShowCardinality(sqlString string) (*CardinalityReport, error) {
+	s, err := sql.ParseShowCardinality(sqlString)
+	if err != nil {
+		return nil, err
+	}
+	return db.Cardinality(s.Table, s.Limit)
+}
+
+// Cardinality reports the cardinality of each dimension of the given table,
+// including the limit values of each dimension that have the most keys. It
+// reads every key in the table, including those in the memstore, and keeps
+// track of every distinct value, so it's about as expensive as a full scan.
+func (db *DB) Cardinality(table string, limit int) (*CardinalityReport, error) {
+	t := db.getTable(table)
+	if t == nil {
+		return nil, common.Errorf(common.ErrUnknownTable, "Table %v not found", table)
+	}
+	if t.rowStore == nil {
+		return nil, fmt.Errorf("Table %v does not store data on this node", table)
+	}
+
+	report := &CardinalityReport{Table: t.Name}
+	dims := make(map[string]*DimensionCardinality)
+	values := make(map[string]map[string]*ValueCardinality)
+	err := t.iterate(context.Background(), t.getFields(), true, nil, nil, func(key bytemap.ByteMap, columns []encoding.Sequence) (bool, error) {
+		size := int64(len(key))
+		for _, seq := range columns {
+			size += int64(len(seq))
+		}
+		report.Keys++
+		report.Bytes += size
+		for dim, value := range key.AsMap() {
+			d := dims[dim]
+			if d == nil {
+				d = &DimensionCardinality{Dim: dim}
+				dims[dim] = d
+				values[dim] = make(map[string]*ValueCardinality)
+			}
+			d.Keys++
+			d.Bytes += size
+			valueString := fmt.Sprint(value)
+			v := values[dim][valueString]
+			if v == nil {
+				v = &ValueCardinality{Value: valueString}
+				values[dim][valueString] = v
+			}
+			v.Keys++
+			v.Bytes += size
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for dim, d := range dims {
+		d.Values = int64(len(values[dim]))
+		d.Top = topValues(values[dim], limit)
+		report.Dims = append(report.Dims, d)
+	}
+	sort.Slice(report.Dims, func(i, j int) bool {
+		a, b := report.Dims[i], report.Dims[j]
+		if a.Values != b.Values {
+			return a.Values > b.Values
+		}
+		return a.Dim < b.Dim
+	})
+	return report, nil
+}
+
+// topValues returns up to limit of the given values, ordered by number of keys
+// and then by value.
+func topValues(values map[string]*ValueCardinality, limit int) []*ValueCardinality {
+	top := make([]*ValueCardinality, 0, len(values))
+	for _, v := range values {
+		top = append(top, v)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Keys != top[j].Keys {
+			return top[i].Keys > top[j].Keys
+		}
+		return top[i].Value < top[j].Value
+	})
+	if limit > 0 && len(top) > limit {
+		top = top[:limit]
+	}
+	return top
+}
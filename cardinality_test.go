@@ -0,0 +1,73 @@
+package zenodb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCardinality(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 0, 0, time.UTC)
+	clock := NewVirtualClock(epoch)
+	clock.Freeze()
+	db, err := NewDB(&DBOpts{
+		Dir:   tmpDir,
+		Clock: clock,
+		Schema: Schema{
+			"thetable": &TableOpts{
+				RetentionPeriod: time.Hour,
+				SQL:             "SELECT SUM(a) AS a FROM inbound GROUP BY u, h, period(1m)",
+			},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	db.Insert("inbound", epoch, map[string]interface{}{"u": "bob", "h": "a"}, map[string]float64{"a": 1})
+	db.Insert("inbound", epoch, map[string]interface{}{"u": "bob", "h": "b"}, map[string]float64{"a": 1})
+	db.Insert("inbound", epoch, map[string]interface{}{"u": "bob", "h": "c"}, map[string]float64{"a": 1})
+	db.Insert("inbound", epoch, map[string]interface{}{"u": "alice", "h": "a"}, map[string]float64{"a": 1})
+	waitFor(func() bool { return db.TableStats("thetable").InsertedPoints == 4 })
+
+	report, err := db.ShowCardinality("SHOW CARDINALITY FOR thetable LIMIT 1")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "thetable", report.Table)
+	assert.EqualValues(t, 4, report.Keys)
+	assert.True(t, report.Bytes > 0)
+	if assert.Len(t, report.Dims, 2) {
+		h, u := report.Dims[0], report.Dims[1]
+		assert.Equal(t, "h", h.Dim, "Dimension with most distinct values should come first")
+		assert.EqualValues(t, 3, h.Values)
+		assert.EqualValues(t, 4, h.Keys)
+		assert.Equal(t, report.Bytes, h.Bytes)
+		if assert.Len(t, h.Top, 1) {
+			assert.Equal(t, "a", h.Top[0].Value)
+			assert.EqualValues(t, 2, h.Top[0].Keys)
+		}
+
+		assert.Equal(t, "u", u.Dim)
+		assert.EqualValues(t, 2, u.Values)
+		if assert.Len(t, u.Top, 1) {
+			assert.Equal(t, "bob", u.Top[0].Value)
+			assert.EqualValues(t, 3, u.Top[0].Keys)
+			assert.True(t, u.Top[0].Bytes < report.Bytes)
+		}
+	}
+
+	_, err = db.Cardinality("unknown", 10)
+	assert.Equal(t, ErrUnknownTable, common.KindOf(err))
+}
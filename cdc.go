@@ -0,0 +1,172 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/wal"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+// changeBufferSize is how many archived chunks a change capture can fall
+// behind by before it's dropped.
+const changeBufferSize = 100000
+
+// ErrChangesFellBehind is returned by CaptureChanges when the consumer didn't
+// keep up with the archived chunks. Flushes never wait on consumers, so a
+// consumer that falls behind has missed data and needs to resync its mirror
+// from a query before capturing changes again.
+var ErrChangesFellBehind = fmt.Errorf("Change capture fell behind and was dropped, resync required")
+
+type changeCapture struct {
+	tables map[string]bool
+	chunks chan *common.ArchivedChunk
+	// dropped is closed when the capture falls behind
+	dropped  chan struct{}
+	dropOnce sync.Once
+}
+
+func (cc *changeCapture) drop() {
+	cc.dropOnce.Do(func() {
+		close(cc.dropped)
+	})
+}
+
+func (cc *changeCapture) isDropped() bool {
+	select {
+	case <-cc.dropped:
+		return true
+	default:
+		return false
+	}
+}
+
+func (cc *changeCapture) includes(table string) bool {
+	return len(cc.tables) == 0 || cc.tables[table]
+}
+
+// changeCaptures tracks the active change captures of a DB.
+type changeCaptures struct {
+	captures map[*changeCapture]bool
+	mx       sync.RWMutex
+}
+
+// CaptureChanges calls cb with every chunk of data archived by the requested
+// tables from now on, as each flush is committed to disk. It blocks until the
+// context is done, cb returns an error or the capture falls behind, in which
+// case it returns ErrChangesFellBehind.
+func (db *DB) CaptureChanges(ctx context.Context, req *common.CaptureChanges, cb func(*common.ArchivedChunk) error) error {
+	cc := &changeCapture{
+		tables:  make(map[string]bool, len(req.Tables)),
+		chunks:  make(chan *common.ArchivedChunk, changeBufferSize),
+		dropped: make(chan struct{}),
+	}
+	for _, name := range req.Tables {
+		if db.getTable(name) == nil {
+			return common.Errorf(common.ErrUnknownTable, "Table %v not found", name)
+		}
+		cc.tables[name] = true
+	}
+
+	db.changes.mx.Lock()
+	if db.changes.captures == nil {
+		db.changes.captures = make(map[*changeCapture]bool)
+	}
+	db.changes.captures[cc] = true
+	db.changes.mx.Unlock()
+	defer func() {
+		db.changes.mx.Lock()
+		delete(db.changes.captures, cc)
+		db.changes.mx.Unlock()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case chunk := <-cc.chunks:
+			err := cb(chunk)
+			if err != nil {
+				return err
+			}
+		case <-cc.dropped:
+			// deliver what was buffered before falling behind
+			for {
+				select {
+				case chunk := <-cc.chunks:
+					err := cb(chunk)
+					if err != nil {
+						return err
+					}
+				default:
+					return ErrChangesFellBehind
+				}
+			}
+		}
+	}
+}
+
+// capturingChanges indicates whether any change capture includes the given
+// table.
+func (db *DB) capturingChanges(table string) bool {
+	db.changes.mx.RLock()
+	defer db.changes.mx.RUnlock()
+	for cc := range db.changes.captures {
+		if cc.includes(table) {
+			return true
+		}
+	}
+	return false
+}
+
+// publishArchived sends the contents of a memstore that the given table just
+// archived to all change captures that include the table. It never blocks,
+// captures that fall behind are dropped instead.
+func (db *DB) publishArchived(t *table, ms *memstore, offset wal.Offset) {
+	if ms.tree.Length() == 0 || !db.capturingChanges(t.Name) {
+		return
+	}
+
+	fields := make([]string, 0, len(ms.fields))
+	for _, field := range ms.fields {
+		fields = append(fields, field.String())
+	}
+	archivedAt := db.clock.Now()
+	var chunks []*common.ArchivedChunk
+	ms.tree.Walk(0, func(key []byte, data []encoding.Sequence) (bool, bool, error) {
+		sequences := make([]encoding.Sequence, len(fields))
+		copy(sequences, data)
+		chunks = append(chunks, &common.ArchivedChunk{
+			Table:      t.Name,
+			Offset:     offset,
+			ArchivedAt: archivedAt,
+			Resolution: t.Resolution,
+			Fields:     fields,
+			Key:        bytemap.ByteMap(key),
+			Sequences:  sequences,
+		})
+		return true, true, nil
+	})
+
+	db.changes.mx.RLock()
+	defer db.changes.mx.RUnlock()
+	for cc := range db.changes.captures {
+		if !cc.includes(t.Name) || cc.isDropped() {
+			continue
+		}
+	publish:
+		for _, chunk := range chunks {
+			select {
+			case cc.chunks <- chunk:
+				// queued
+			default:
+				log.Errorf("Change capture fell behind on %v, dropping it", t.Name)
+				cc.drop()
+				break publish
+			}
+		}
+	}
+}
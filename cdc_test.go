@@ -0,0 +1,117 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCaptureChanges(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 0, 0, time.UTC)
+	clock := NewVirtualClock(epoch)
+	clock.Freeze()
+	db, err := NewDB(&DBOpts{
+		Dir:   tmpDir,
+		Clock: clock,
+		Schema: Schema{
+			"thetable": &TableOpts{
+				RetentionPeriod: time.Hour,
+				SQL:             "SELECT SUM(a) AS a FROM inbound GROUP BY u, period(1m)",
+			},
+			"othertable": &TableOpts{
+				RetentionPeriod: time.Hour,
+				SQL:             "SELECT SUM(a) AS a FROM inbound GROUP BY period(1m)",
+			},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	assert.Error(t, db.CaptureChanges(context.Background(), &common.CaptureChanges{Tables: []string{"unknown"}}, nil), "capturing unknown table should fail")
+
+	var mx sync.Mutex
+	var chunks []*common.ArchivedChunk
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan error)
+	go func() {
+		finished <- db.CaptureChanges(ctx, &common.CaptureChanges{Tables: []string{"thetable"}}, func(chunk *common.ArchivedChunk) error {
+			mx.Lock()
+			chunks = append(chunks, chunk)
+			mx.Unlock()
+			return nil
+		})
+	}()
+	numChunks := func() int {
+		mx.Lock()
+		defer mx.Unlock()
+		return len(chunks)
+	}
+	waitFor(func() bool { return db.capturingChanges("thetable") })
+	assert.False(t, db.capturingChanges("othertable"))
+
+	db.Insert("inbound", epoch, map[string]interface{}{"u": "bob"}, map[string]float64{"a": 1})
+	db.Insert("inbound", epoch, map[string]interface{}{"u": "alice"}, map[string]float64{"a": 2})
+	waitFor(func() bool { return db.TableStats("thetable").InsertedPoints == 2 })
+	waitFor(func() bool { return db.TableStats("othertable").InsertedPoints == 2 })
+	assert.NoError(t, db.ForceFlush("othertable"))
+	assert.NoError(t, db.ForceFlush("thetable"))
+	waitFor(func() bool { return numChunks() == 2 })
+
+	fields := db.getTable("thetable").getFields()
+	fieldStrings := make([]string, 0, len(fields))
+	idx := -1
+	for i, field := range fields {
+		fieldStrings = append(fieldStrings, field.String())
+		if field.Name == "a" {
+			idx = i
+		}
+	}
+	if !assert.True(t, idx >= 0, "table should have field a") {
+		return
+	}
+	field := fields[idx]
+	sums := make(map[string]float64)
+	mx.Lock()
+	for _, chunk := range chunks {
+		assert.Equal(t, "thetable", chunk.Table)
+		assert.Equal(t, time.Minute, chunk.Resolution)
+		assert.Equal(t, fieldStrings, chunk.Fields)
+		if assert.Len(t, chunk.Sequences, len(fields)) {
+			val, found := chunk.Sequences[idx].ValueAtTime(epoch, field.Expr, chunk.Resolution)
+			assert.True(t, found)
+			sums[chunk.Key.Get("u").(string)] = val
+		}
+	}
+	mx.Unlock()
+	assert.Equal(t, map[string]float64{"bob": 1, "alice": 2}, sums)
+
+	// Flushing again only publishes what's new
+	db.Insert("inbound", epoch, map[string]interface{}{"u": "bob"}, map[string]float64{"a": 4})
+	waitFor(func() bool { return db.TableStats("thetable").InsertedPoints == 3 })
+	assert.NoError(t, db.ForceFlush("thetable"))
+	waitFor(func() bool { return numChunks() == 3 })
+	mx.Lock()
+	last := chunks[2]
+	mx.Unlock()
+	val, _ := last.Sequences[idx].ValueAtTime(epoch, field.Expr, last.Resolution)
+	assert.Equal(t, "bob", last.Key.Get("u"))
+	assert.EqualValues(t, 4, val)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-finished)
+	assert.False(t, db.capturingChanges("thetable"), "capture should be removed once done")
+}
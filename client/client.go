@@ -0,0 +1,422 @@
+// Package client provides a high-level Go client for zenodb that wraps the
+// gRPC interface in package rpc with connection pooling, retries of transient
+// failures and row-by-row iteration of query results. A Client can also
+// load-balance queries across several servers, for example a leader and its
+// followers.
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/logging"
+	"github.com/getlantern/zenodb/rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+var (
+	log = logging.LoggerFor("zenodb.client")
+)
+
+type Opts struct {
+	rpc.ClientOpts
+
+	// PoolSize is the number of connections to open to the server. Calls are
+	// distributed round-robin across these. Defaults to 1.
+	PoolSize int
+
+	// MaxRetries is how many times to retry calls that fail with a transient
+	// error. Defaults to 3. Set to a negative number to disable retries.
+	MaxRetries int
+
+	// MinBackoff is how long to wait before the first retry. Subsequent retries
+	// back off exponentially up to MaxBackoff. Defaults to 100 milliseconds.
+	MinBackoff time.Duration
+
+	// MaxBackoff caps the time between retries. Defaults to 5 seconds.
+	MaxBackoff time.Duration
+
+	// Timeout is applied as a deadline to calls whose context doesn't already
+	// have one. Defaults to 5 minutes.
+	Timeout time.Duration
+
+	// FailoverPeriod is how long to avoid querying a server after it failed with
+	// a transient error, as long as other servers are available. Defaults to 30
+	// seconds.
+	FailoverPeriod time.Duration
+
+	// MaxStaleness, if specified, causes queries to avoid servers whose data
+	// lags the freshest known server by more than this amount, as long as
+	// fresher servers are available. Freshness is tracked using the Until
+	// reported in query metadata, which reflects the server's clock (and hence
+	// its most recent data when running with virtual time).
+	MaxStaleness time.Duration
+
+	// AckOffsets, if true, has the server report the WAL offset of each batch
+	// of inserts in the Offset of the returned rpc.InsertReport, which
+	// producers can checkpoint to implement at-least-once delivery.
+	AckOffsets bool
+}
+
+// Client is a pooled, retrying zenodb client. It is safe for concurrent use.
+type Client struct {
+	opts  *Opts
+	nodes []*node
+	next  uint64
+}
+
+// node is a single server along with its pool of connections.
+type node struct {
+	addr  string
+	conns []rpc.Client
+	next  uint64
+
+	mx             sync.RWMutex
+	unhealthyUntil time.Time
+	until          time.Time
+}
+
+// Dial opens a Client to the server at the given address. The underlying gRPC
+// connections are established in the background and automatically reconnect
+// whenever they're lost, so Dial only fails on configuration errors.
+func Dial(addr string, opts *Opts) (*Client, error) {
+	return DialAll([]string{addr}, opts)
+}
+
+// DialAll opens a Client to the servers at the given addresses. Queries are
+// load-balanced across all healthy servers, failing over to other servers
+// when one becomes unreachable. Inserts always go to the first server, which
+// should be the leader.
+func DialAll(addrs []string, opts *Opts) (*Client, error) {
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("Please specify at least one address")
+	}
+	// Don't modify the caller's opts when filling in defaults
+	_opts := *opts
+	opts = &_opts
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = 1
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = 3
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 100 * time.Millisecond
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 5 * time.Second
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Minute
+	}
+	if opts.FailoverPeriod <= 0 {
+		opts.FailoverPeriod = 30 * time.Second
+	}
+
+	c := &Client{opts: opts}
+	for _, addr := range addrs {
+		n := &node{addr: addr}
+		c.nodes = append(c.nodes, n)
+		for i := 0; i < opts.PoolSize; i++ {
+			// rpc.Dial modifies its opts, so give each connection its own copy
+			clientOpts := opts.ClientOpts
+			conn, err := rpc.Dial(addr, &clientOpts)
+			if err != nil {
+				c.Close()
+				return nil, fmt.Errorf("Unable to dial %v: %v", addr, err)
+			}
+			n.conns = append(n.conns, conn)
+		}
+	}
+	return c, nil
+}
+
+// Point is a single point to insert.
+type Point struct {
+	// TS is the timestamp of the point. If zero, the server uses the current
+	// time.
+	TS   time.Time
+	Dims map[string]interface{}
+	Vals map[string]float64
+}
+
+// Insert inserts the given points into the named stream. The insert is only
+// retried if it fails before any points were sent, so a failed Insert never
+// results in duplicate points.
+func (c *Client) Insert(ctx context.Context, stream string, points []*Point) (*rpc.InsertReport, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	var inserter rpc.Inserter
+	_, err := c.withRetries(ctx, "insert", c.leader, func(conn rpc.Client) error {
+		var insertErr error
+		inserter, insertErr = conn.NewInserter(ctx, stream)
+		return insertErr
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, point := range points {
+		vals := point.Vals
+		err = inserter.Insert(point.TS, point.Dims, func(cb func(string, interface{})) {
+			for key, value := range vals {
+				cb(key, value)
+			}
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Unable to insert point: %v", err)
+		}
+	}
+	return c.closeInserter(inserter)
+}
+
+// RawPoint is a point whose dimensions and values are already encoded as
+// ByteMaps.
+type RawPoint struct {
+	// TS is the timestamp of the point. If zero, the server uses the current
+	// time.
+	TS   time.Time
+	Dims bytemap.ByteMap
+	Vals bytemap.ByteMap
+}
+
+// InsertRaw is like Insert but for points that are already encoded.
+func (c *Client) InsertRaw(ctx context.Context, stream string, points []*RawPoint) (*rpc.InsertReport, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	var inserter rpc.Inserter
+	_, err := c.withRetries(ctx, "insert", c.leader, func(conn rpc.Client) error {
+		var insertErr error
+		inserter, insertErr = conn.NewInserter(ctx, stream)
+		return insertErr
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, point := range points {
+		err = inserter.InsertRaw(point.TS, point.Dims, point.Vals)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to insert point: %v", err)
+		}
+	}
+	return c.closeInserter(inserter)
+}
+
+func (c *Client) closeInserter(inserter rpc.Inserter) (*rpc.InsertReport, error) {
+	if c.opts.AckOffsets {
+		return inserter.CloseWithOffset()
+	}
+	return inserter.Close()
+}
+
+// QueryRows runs the given SQL query and returns the resulting Rows. The query
+// is retried if it fails with a transient error before results start
+// arriving. Callers must Close the returned Rows once they're done with them.
+func (c *Client) QueryRows(ctx context.Context, sqlString string) (*Rows, error) {
+	ctx, cancel := c.withTimeout(ctx)
+
+	var md *common.QueryMetaData
+	var iterate func(onRow core.OnFlatRow) error
+	queried, err := c.withRetries(ctx, "query", c.pickForQuery, func(conn rpc.Client) error {
+		var queryErr error
+		md, iterate, queryErr = conn.Query(ctx, sqlString, false)
+		return queryErr
+	})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	queried.markUntil(md.Until)
+
+	return newRows(md, iterate, cancel), nil
+}
+
+// queryUnflat runs the given SQL query and returns its results before they're
+// flattened, along with the fields with which to merge them. Like QueryRows,
+// it retries if the query fails with a transient error before results start
+// arriving.
+func (c *Client) queryUnflat(ctx context.Context, sqlString string) (*common.QueryMetaData, func(onFields core.OnFields, onRow core.OnRow) error, error) {
+	var md *common.QueryMetaData
+	var iterate func(onFields core.OnFields, onRow core.OnRow) error
+	queried, err := c.withRetries(ctx, "query", c.pickForQuery, func(conn rpc.Client) error {
+		var queryErr error
+		md, iterate, queryErr = conn.QueryUnflat(ctx, sqlString, false)
+		return queryErr
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	queried.markUntil(md.Until)
+
+	return md, iterate, nil
+}
+
+// QueryDelimited runs the given SQL query and writes its results to out as
+// CSV or TSV (common.FormatCSV or common.FormatTSV), rendered by the server.
+// The query is retried if it fails with a transient error before results start
+// arriving.
+func (c *Client) QueryDelimited(ctx context.Context, sqlString string, format string, header bool, out io.Writer) error {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	var md *common.QueryMetaData
+	var write func(out io.Writer) error
+	queried, err := c.withRetries(ctx, "query", c.pickForQuery, func(conn rpc.Client) error {
+		var queryErr error
+		md, write, queryErr = conn.QueryDelimited(ctx, sqlString, false, format, !header)
+		return queryErr
+	})
+	if err != nil {
+		return err
+	}
+	queried.markUntil(md.Until)
+
+	return write(out)
+}
+
+// Close closes all connections in the pool.
+func (c *Client) Close() error {
+	var firstErr error
+	for _, n := range c.nodes {
+		for _, conn := range n.conns {
+			err := conn.Close()
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// withRetries calls fn with connections from the nodes returned by pick until
+// it succeeds, fails with a non-transient error or runs out of retries. Nodes
+// that fail with transient errors are marked unhealthy so that pick can fail
+// over to other nodes. It returns the node on which fn succeeded.
+func (c *Client) withRetries(ctx context.Context, op string, pick func() *node, fn func(conn rpc.Client) error) (*node, error) {
+	backoff := c.opts.MinBackoff
+	for attempt := 0; ; attempt++ {
+		n := pick()
+		err := fn(n.nextConn())
+		if err == nil {
+			return n, nil
+		}
+		if !IsTransient(err) || attempt >= c.opts.MaxRetries {
+			return nil, err
+		}
+		n.markUnhealthy(c.opts.FailoverPeriod)
+		log.Debugf("Transient error on %v attempt %d against %v, will retry in %v: %v", op, attempt+1, n.addr, backoff, err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+			// continue
+		}
+		backoff *= 2
+		if backoff > c.opts.MaxBackoff {
+			backoff = c.opts.MaxBackoff
+		}
+	}
+}
+
+// leader returns the first node.
+func (c *Client) leader() *node {
+	return c.nodes[0]
+}
+
+// pickForQuery picks the next node round-robin, skipping unhealthy nodes and
+// nodes that are too stale unless no better nodes are available.
+func (c *Client) pickForQuery() *node {
+	now := time.Now()
+	var freshest time.Time
+	for _, n := range c.nodes {
+		until := n.getUntil()
+		if until.After(freshest) {
+			freshest = until
+		}
+	}
+
+	var healthy, fresh []*node
+	for _, n := range c.nodes {
+		if !n.healthy(now) {
+			continue
+		}
+		healthy = append(healthy, n)
+		if c.opts.MaxStaleness <= 0 || freshest.Sub(n.getUntil()) <= c.opts.MaxStaleness {
+			fresh = append(fresh, n)
+		}
+	}
+
+	candidates := fresh
+	if len(candidates) == 0 {
+		// All healthy nodes are stale, use one of them anyway
+		candidates = healthy
+	}
+	if len(candidates) == 0 {
+		// No healthy nodes, just try any of them
+		candidates = c.nodes
+	}
+	next := atomic.AddUint64(&c.next, 1)
+	return candidates[int(next%uint64(len(candidates)))]
+}
+
+func (n *node) nextConn() rpc.Client {
+	next := atomic.AddUint64(&n.next, 1)
+	return n.conns[int(next%uint64(len(n.conns)))]
+}
+
+func (n *node) healthy(now time.Time) bool {
+	n.mx.RLock()
+	defer n.mx.RUnlock()
+	return !now.Before(n.unhealthyUntil)
+}
+
+func (n *node) markUnhealthy(period time.Duration) {
+	n.mx.Lock()
+	n.unhealthyUntil = time.Now().Add(period)
+	n.mx.Unlock()
+}
+
+func (n *node) getUntil() time.Time {
+	n.mx.RLock()
+	defer n.mx.RUnlock()
+	return n.until
+}
+
+func (n *node) markUntil(until time.Time) {
+	n.mx.Lock()
+	if until.After(n.until) {
+		n.until = until
+	}
+	n.unhealthyUntil = time.Time{}
+	n.mx.Unlock()
+}
+
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, hasDeadline := ctx.Deadline(); hasDeadline {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.opts.Timeout)
+}
+
+// IsTransient indicates whether the given error is a transient failure (like
+// the server being temporarily unreachable) after which it makes sense to
+// retry.
+func IsTransient(err error) bool {
+	switch grpc.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.Aborted:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,400 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/wal"
+	"github.com/getlantern/zenodb"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/expr"
+	"github.com/getlantern/zenodb/planner"
+	"github.com/getlantern/zenodb/rpc"
+	"github.com/getlantern/zenodb/rpc/server"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestQueryAndInsert(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	db := &mockDB{}
+	go rpcserver.Serve(db, l, &rpcserver.Opts{Password: "password"})
+
+	client, err := Dial(l.Addr().String(), &Opts{
+		ClientOpts: rpc.ClientOpts{Password: "password"},
+		PoolSize:   2,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	report, err := client.Insert(context.Background(), "stream", []*Point{
+		{Dims: map[string]interface{}{"a": 1}, Vals: map[string]float64{"val": 1}},
+		{Dims: map[string]interface{}{"a": 2}, Vals: map[string]float64{"val": 2}},
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 2, report.Succeeded)
+		assert.Equal(t, 2, db.NumInserts())
+	}
+
+	rows, err := client.QueryRows(context.Background(), "SELECT * FROM thetable")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer rows.Close()
+	assert.Equal(t, []string{"val"}, rows.Fields())
+	var vals []float64
+	var dims []interface{}
+	for rows.Next() {
+		row := rows.Row()
+		val, found := row.Get("val")
+		assert.True(t, found)
+		_, found = row.Get("unknown")
+		assert.False(t, found)
+		vals = append(vals, val)
+		dims = append(dims, row.Dims["dim"])
+	}
+	assert.NoError(t, rows.Err())
+	assert.Equal(t, []float64{1, 2, 3}, vals)
+	assert.Equal(t, []interface{}{"a", "b", "c"}, dims)
+}
+
+func TestCloseRowsEarly(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	go rpcserver.Serve(&mockDB{}, l, &rpcserver.Opts{})
+
+	client, err := Dial(l.Addr().String(), &Opts{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	rows, err := client.QueryRows(context.Background(), "SELECT * FROM thetable")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, rows.Next())
+	assert.NoError(t, rows.Close())
+	assert.False(t, rows.Next())
+}
+
+func TestQueryDelimited(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	go rpcserver.Serve(&mockDB{}, l, &rpcserver.Opts{})
+
+	client, err := Dial(l.Addr().String(), &Opts{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	out := &bytes.Buffer{}
+	if !assert.NoError(t, client.QueryDelimited(context.Background(), "SELECT * FROM thetable", common.FormatTSV, true, out)) {
+		return
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if assert.Len(t, lines, 4) {
+		assert.Equal(t, "time\tval\tdim", lines[0])
+		for i, suffix := range []string{"\t1\ta", "\t2\tb", "\t3\tc"} {
+			assert.True(t, strings.HasSuffix(lines[i+1], suffix), lines[i+1])
+		}
+	}
+
+	out.Reset()
+	assert.Error(t, client.QueryDelimited(context.Background(), "SELECT * FROM thetable", "xlsx", true, out), "unknown format should fail")
+	assert.Empty(t, out.String())
+}
+
+func TestFailover(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	go rpcserver.Serve(&mockDB{}, l, &rpcserver.Opts{})
+
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	opts := &Opts{
+		MinBackoff: 1 * time.Millisecond,
+	}
+	client, err := DialAll([]string{deadAddr, l.Addr().String()}, opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+	assert.Equal(t, &Opts{MinBackoff: 1 * time.Millisecond}, opts, "DialAll shouldn't modify the caller's opts")
+
+	for i := 0; i < 4; i++ {
+		rows, err := client.QueryRows(context.Background(), "SELECT * FROM thetable")
+		if !assert.NoError(t, err, "Query %d should have failed over to live server", i) {
+			return
+		}
+		rows.Close()
+	}
+	assert.False(t, client.nodes[0].healthy(time.Now()))
+	assert.True(t, client.nodes[1].healthy(time.Now()))
+}
+
+func TestPickForQuery(t *testing.T) {
+	now := time.Now()
+	a, b, c := &node{addr: "a"}, &node{addr: "b"}, &node{addr: "c"}
+	client := &Client{
+		opts:  &Opts{MaxStaleness: time.Minute},
+		nodes: []*node{a, b, c},
+	}
+	a.markUntil(now)
+	b.markUntil(now.Add(-30 * time.Second))
+	c.markUntil(now.Add(-5 * time.Minute))
+
+	picked := make(map[string]int)
+	for i := 0; i < 30; i++ {
+		picked[client.pickForQuery().addr]++
+	}
+	assert.Equal(t, map[string]int{"a": 15, "b": 15}, picked, "stale node should be skipped")
+
+	a.markUnhealthy(time.Hour)
+	b.markUnhealthy(time.Hour)
+	assert.Equal(t, "c", client.pickForQuery().addr, "stale node should be used when no fresh nodes are healthy")
+
+	c.markUnhealthy(time.Hour)
+	assert.NotNil(t, client.pickForQuery(), "some node should be picked even when none are healthy")
+}
+
+func TestRetries(t *testing.T) {
+	n := &node{conns: []rpc.Client{nil}}
+	c := &Client{
+		opts: &Opts{
+			MaxRetries:     2,
+			MinBackoff:     1 * time.Millisecond,
+			MaxBackoff:     2 * time.Millisecond,
+			FailoverPeriod: time.Hour,
+		},
+		nodes: []*node{n},
+	}
+
+	attempts := 0
+	succeeded, err := c.withRetries(context.Background(), "test", c.leader, func(conn rpc.Client) error {
+		attempts++
+		if attempts < 3 {
+			return grpc.Errorf(codes.Unavailable, "unavailable")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, n, succeeded)
+	assert.Equal(t, 3, attempts)
+	assert.False(t, n.healthy(time.Now()), "node should have been marked unhealthy")
+
+	attempts = 0
+	_, err = c.withRetries(context.Background(), "test", c.leader, func(conn rpc.Client) error {
+		attempts++
+		return grpc.Errorf(codes.Unavailable, "unavailable")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 3, attempts, "should give up after MaxRetries")
+
+	attempts = 0
+	_, err = c.withRetries(context.Background(), "test", c.leader, func(conn rpc.Client) error {
+		attempts++
+		return errors.New("permanent")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts, "should not retry non-transient errors")
+}
+
+type mockDB struct {
+	numInserts int64
+}
+
+func (db *mockDB) InsertRawContext(ctx context.Context, stream string, ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap) error {
+	atomic.AddInt64(&db.numInserts, 1)
+	return nil
+}
+
+func (db *mockDB) StreamOffset(stream string) (wal.Offset, error) {
+	return nil, nil
+}
+
+func (db *mockDB) NumInserts() int {
+	return int(atomic.LoadInt64(&db.numInserts))
+}
+
+func (db *mockDB) QueryWithACL(sqlString string, isSubQuery bool, subQueryResults [][]interface{}, includeMemStore bool, acl *planner.ACL) (core.FlatRowSource, error) {
+	return &mockSource{}, nil
+}
+
+func (db *mockDB) ExpandSavedQuery(sqlString string) (string, error) {
+	return sqlString, nil
+}
+
+func (db *mockDB) FollowContext(ctx context.Context, f *common.Follow, cb func([]byte, wal.Offset) error) error {
+	return nil
+}
+
+func (db *mockDB) RegisterQueryHandlerWithCapabilities(partition int, caps *common.QueryHandlerCapabilities, query planner.QueryClusterFN) error {
+	return nil
+}
+
+func (db *mockDB) PartitionArchived(partition int, archived time.Time) {
+}
+
+func (db *mockDB) ClusterStatus() *common.ClusterStatus {
+	return &common.ClusterStatus{}
+}
+
+func (db *mockDB) ForceFlushContext(ctx context.Context, table string) error {
+	return nil
+}
+
+func (db *mockDB) ApplyRetentionContext(ctx context.Context, table string) error {
+	return nil
+}
+
+func (db *mockDB) FlushForwardedInserts() error {
+	return nil
+}
+
+func (db *mockDB) PauseIngestion(table string) error {
+	return nil
+}
+
+func (db *mockDB) ResumeIngestion(table string) error {
+	return nil
+}
+
+func (db *mockDB) DiscardIngestion(table string) error {
+	return nil
+}
+
+func (db *mockDB) DrainContext(ctx context.Context, table string) error {
+	return nil
+}
+
+func (db *mockDB) DumpSchema() ([]byte, error) {
+	return nil, nil
+}
+
+func (db *mockDB) Set(sqlString string) error {
+	return nil
+}
+
+func (db *mockDB) Delete(sqlString string) error {
+	return nil
+}
+
+func (db *mockDB) Exec(script string) error {
+	return nil
+}
+
+func (db *mockDB) RemapKeys(table string, dim string, mapping map[string]string) error {
+	return nil
+}
+
+func (db *mockDB) Cardinality(table string, limit int) (*zenodb.CardinalityReport, error) {
+	return nil, nil
+}
+
+func (db *mockDB) LastSeen(table string, olderThan time.Duration) ([]*zenodb.KeyLastSeen, error) {
+	return nil, nil
+}
+
+func (db *mockDB) Now() time.Time {
+	return time.Now()
+}
+
+func (db *mockDB) RemapStatus(table string) (*zenodb.RemapStatus, error) {
+	return nil, nil
+}
+
+func (db *mockDB) CanonicalizeKeys(table string) error {
+	return nil
+}
+
+func (db *mockDB) MigrateTable(table string, sqlString string) error {
+	return nil
+}
+
+func (db *mockDB) MigrationStatus(table string) (*zenodb.MigrationStatus, error) {
+	return nil, nil
+}
+
+func (db *mockDB) BackfillView(view string, from time.Time, until time.Time) error {
+	return nil
+}
+
+func (db *mockDB) CaptureChanges(ctx context.Context, req *common.CaptureChanges, cb func(*common.ArchivedChunk) error) error {
+	return nil
+}
+
+var mockUntil = time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type mockSource struct{}
+
+func (s *mockSource) Iterate(ctx context.Context, onFields core.OnFields, onRow core.OnFlatRow) error {
+	err := onFields(core.Fields{core.NewField("val", expr.SUM("val"))})
+	if err != nil {
+		return err
+	}
+	for i, dim := range []string{"a", "b", "c"} {
+		more, err := onRow(&core.FlatRow{
+			TS:     mockUntil.UnixNano(),
+			Key:    bytemap.New(map[string]interface{}{"dim": dim}),
+			Values: []float64{float64(i + 1)},
+		})
+		if !more || err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *mockSource) GetGroupBy() []core.GroupBy {
+	return nil
+}
+
+func (s *mockSource) GetResolution() time.Duration {
+	return time.Minute
+}
+
+func (s *mockSource) GetAsOf() time.Time {
+	return mockUntil.Add(-1 * time.Hour)
+}
+
+func (s *mockSource) GetUntil() time.Time {
+	return mockUntil
+}
+
+func (s *mockSource) String() string {
+	return "mock"
+}
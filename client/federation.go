@@ -0,0 +1,284 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/goexpr"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/sql"
+)
+
+// Federation queries several independent zenodb servers with the same SQL and
+// merges their results into one global view. Unlike the partitions of a
+// cluster, federated servers don't coordinate at all and may store data for
+// the same keys, so rows with the same dimensions and period are merged using
+// the aggregates of their fields. For example, SUMs are added up and MAXes
+// take the largest value across servers.
+//
+// Servers are queried for their results before ORDER BY, LIMIT and OFFSET are
+// applied, which are then applied to the merged results. Queries with HAVING
+// or CROSSTAB can't be federated. All servers need to return the same fields
+// at the same resolution.
+type Federation struct {
+	names   []string
+	clients []*Client
+}
+
+// NewFederation creates a Federation of the given Clients, which are keyed by
+// a name that identifies them in errors. Each Client may itself be connected
+// to several servers of the same cluster, see DialAll. Closing the Federation
+// closes all of its Clients.
+func NewFederation(clients map[string]*Client) *Federation {
+	f := &Federation{}
+	for name := range clients {
+		f.names = append(f.names, name)
+	}
+	sort.Strings(f.names)
+	for _, name := range f.names {
+		f.clients = append(f.clients, clients[name])
+	}
+	return f
+}
+
+// QueryRows runs the given SQL query on all federated servers and returns the
+// merged Rows. It fails if any of the servers fails. Callers must Close the
+// returned Rows once they're done with them.
+func (f *Federation) QueryRows(ctx context.Context, sqlString string) (*Rows, error) {
+	if len(f.clients) == 0 {
+		return nil, fmt.Errorf("No servers to query")
+	}
+	query, err := sql.Parse(sqlString)
+	if err != nil {
+		return nil, err
+	}
+	if query.HasHaving || query.Crosstab != nil {
+		return nil, fmt.Errorf("HAVING and CROSSTAB are not supported in federated queries")
+	}
+
+	var cancels []context.CancelFunc
+	cancel := func() {
+		for _, serverCancel := range cancels {
+			serverCancel()
+		}
+	}
+	type result struct {
+		md      *common.QueryMetaData
+		iterate func(onFields core.OnFields, onRow core.OnRow) error
+		err     error
+	}
+	results := make([]chan *result, 0, len(f.clients))
+	serverSQL := withoutOrderLimitOffset(query)
+	for _, client := range f.clients {
+		serverCtx, serverCancel := client.withTimeout(ctx)
+		cancels = append(cancels, serverCancel)
+		resultCh := make(chan *result, 1)
+		results = append(results, resultCh)
+		go func(client *Client) {
+			md, iterate, queryErr := client.queryUnflat(serverCtx, serverSQL)
+			resultCh <- &result{md, iterate, queryErr}
+		}(client)
+	}
+
+	fs := &federatedSource{names: f.names}
+	for i, resultCh := range results {
+		r := <-resultCh
+		if r.err == nil && i > 0 {
+			r.err = fs.checkCompatible(r.md)
+		}
+		if r.err != nil {
+			cancel()
+			return nil, fmt.Errorf("Unable to query %v: %v", f.names[i], r.err)
+		}
+		fs.add(r.md, r.iterate)
+	}
+
+	var mergeBy []core.GroupBy
+	if !query.GroupByAll {
+		// Servers already evaluated the group by expressions, so just merge by the
+		// resulting dimensions
+		for _, groupBy := range query.GroupBy {
+			mergeBy = append(mergeBy, core.NewGroupBy(groupBy.Name, goexpr.Param(groupBy.Name)))
+		}
+	}
+	flat := core.Flatten(core.Group(fs, core.GroupOpts{
+		By:       mergeBy,
+		Fields:   core.PassthroughFieldSource,
+		MaxBytes: query.Hints.MaxMemory,
+	}))
+	if len(query.OrderBy) > 0 {
+		flat = core.Sort(flat, query.OrderBy...)
+	}
+	if query.Offset > 0 {
+		flat = core.Offset(flat, query.Offset)
+	}
+	if query.Limit > 0 {
+		flat = core.Limit(flat, query.Limit)
+	}
+
+	md := fs.metaData()
+	iterate := func(onRow core.OnFlatRow) error {
+		err := flat.Iterate(ctx, func(fields core.Fields) error {
+			return nil
+		}, onRow)
+		md.Stats = fs.stats()
+		md.Truncated, md.OmittedRows = fs.truncation()
+		return err
+	}
+	return newRows(md, iterate, cancel), nil
+}
+
+// Close closes the Clients of all federated servers.
+func (f *Federation) Close() error {
+	var firstErr error
+	for _, client := range f.clients {
+		err := client.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// withoutOrderLimitOffset strips the ORDER BY, LIMIT and OFFSET clauses from
+// the given query's SQL, which always come last.
+func withoutOrderLimitOffset(query *sql.Query) string {
+	sqlString := query.SQL
+	lowerSQL := strings.ToLower(sqlString)
+	index := -1
+	if len(query.OrderBy) > 0 {
+		index = strings.LastIndex(lowerSQL, "order by ")
+	} else if query.Limit > 0 {
+		index = strings.LastIndex(lowerSQL, "limit ")
+	} else if query.Offset > 0 {
+		index = strings.LastIndex(lowerSQL, "offset ")
+	}
+	if index > 0 {
+		sqlString = sqlString[:index]
+	}
+	return sqlString
+}
+
+// federatedSource is a core.RowSource that returns the unflattened results of
+// all federated servers one after the other.
+type federatedSource struct {
+	names    []string
+	mds      []*common.QueryMetaData
+	iterates []func(onFields core.OnFields, onRow core.OnRow) error
+}
+
+func (fs *federatedSource) add(md *common.QueryMetaData, iterate func(onFields core.OnFields, onRow core.OnRow) error) {
+	fs.mds = append(fs.mds, md)
+	fs.iterates = append(fs.iterates, iterate)
+}
+
+// checkCompatible checks that the results described by md can be merged with
+// the ones that were already added.
+func (fs *federatedSource) checkCompatible(md *common.QueryMetaData) error {
+	first := fs.mds[0]
+	if strings.Join(md.FieldNames, ",") != strings.Join(first.FieldNames, ",") {
+		return fmt.Errorf("Fields %v don't match fields %v of %v", md.FieldNames, first.FieldNames, fs.names[0])
+	}
+	if md.Resolution != first.Resolution {
+		return fmt.Errorf("Resolution %v doesn't match resolution %v of %v", md.Resolution, first.Resolution, fs.names[0])
+	}
+	return nil
+}
+
+func (fs *federatedSource) Iterate(ctx context.Context, onFields core.OnFields, onRow core.OnRow) error {
+	for i, iterate := range fs.iterates {
+		first := i == 0
+		stopped := false
+		err := iterate(func(fields core.Fields) error {
+			if first {
+				return onFields(fields)
+			}
+			return nil
+		}, func(key bytemap.ByteMap, vals core.Vals) (bool, error) {
+			more, err := onRow(key, vals)
+			stopped = !more
+			return more, err
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to read results from %v: %v", fs.names[i], err)
+		}
+		if stopped {
+			return nil
+		}
+	}
+	return nil
+}
+
+// metaData combines the metadata of all servers.
+func (fs *federatedSource) metaData() *common.QueryMetaData {
+	first := fs.mds[0]
+	return &common.QueryMetaData{
+		FieldNames:    first.FieldNames,
+		FieldMetadata: first.FieldMetadata,
+		Columns:       first.Columns,
+		AsOf:          fs.GetAsOf(),
+		Until:         fs.GetUntil(),
+		Resolution:    fs.GetResolution(),
+		Plan:          fs.String(),
+	}
+}
+
+// stats combines the query stats of all servers, which are only available
+// once their results have been read.
+func (fs *federatedSource) stats() []*common.TableQueryStats {
+	var result []*common.TableQueryStats
+	for _, md := range fs.mds {
+		result = append(result, md.Stats...)
+	}
+	return result
+}
+
+// truncation combines whether any server truncated its results and how many
+// rows they omitted in total, which are only available once their results
+// have been read.
+func (fs *federatedSource) truncation() (bool, int64) {
+	truncated := false
+	omitted := int64(0)
+	for _, md := range fs.mds {
+		truncated = truncated || md.Truncated
+		omitted += md.OmittedRows
+	}
+	return truncated, omitted
+}
+
+func (fs *federatedSource) GetGroupBy() []core.GroupBy {
+	return nil
+}
+
+func (fs *federatedSource) GetResolution() time.Duration {
+	return fs.mds[0].Resolution
+}
+
+func (fs *federatedSource) GetAsOf() time.Time {
+	asOf := fs.mds[0].AsOf
+	for _, md := range fs.mds[1:] {
+		if md.AsOf.Before(asOf) {
+			asOf = md.AsOf
+		}
+	}
+	return asOf
+}
+
+func (fs *federatedSource) GetUntil() time.Time {
+	until := fs.mds[0].Until
+	for _, md := range fs.mds[1:] {
+		if md.Until.After(until) {
+			until = md.Until
+		}
+	}
+	return until
+}
+
+func (fs *federatedSource) String() string {
+	return fmt.Sprintf("federation of %v", strings.Join(fs.names, ", "))
+}
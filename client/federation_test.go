@@ -0,0 +1,81 @@
+package client
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/getlantern/zenodb/rpc/server"
+	"github.com/getlantern/zenodb/sql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFederation(t *testing.T) {
+	clients := make(map[string]*Client)
+	for _, name := range []string{"east", "west"} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer l.Close()
+		go rpcserver.Serve(&mockDB{}, l, &rpcserver.Opts{})
+
+		client, err := Dial(l.Addr().String(), &Opts{})
+		if !assert.NoError(t, err) {
+			return
+		}
+		clients[name] = client
+	}
+	f := NewFederation(clients)
+	defer f.Close()
+
+	query := func(sqlString string) ([]string, []float64) {
+		rows, err := f.QueryRows(context.Background(), sqlString)
+		if !assert.NoError(t, err) {
+			return nil, nil
+		}
+		defer rows.Close()
+		assert.Equal(t, []string{"val"}, rows.Fields())
+		var dims []string
+		var vals []float64
+		for rows.Next() {
+			row := rows.Row()
+			dims = append(dims, row.Dims["dim"].(string))
+			val, _ := row.Get("val")
+			vals = append(vals, val)
+		}
+		assert.NoError(t, rows.Err())
+		return dims, vals
+	}
+
+	dims, vals := query("SELECT * FROM thetable")
+	assert.Equal(t, []string{"a", "b", "c"}, dims)
+	assert.Equal(t, []float64{2, 4, 6}, vals, "rows from both servers should be merged")
+
+	dims, vals = query("SELECT * FROM thetable ORDER BY val DESC LIMIT 2")
+	assert.Equal(t, []string{"c", "b"}, dims, "order and limit should apply to merged rows")
+	assert.Equal(t, []float64{6, 4}, vals)
+
+	_, err := f.QueryRows(context.Background(), "SELECT * FROM thetable HAVING val > 1")
+	assert.Error(t, err, "HAVING should not be supported")
+}
+
+func TestWithoutOrderLimitOffset(t *testing.T) {
+	for _, sqlString := range []string{
+		"SELECT * FROM thetable ORDER BY val LIMIT 5",
+		"SELECT * FROM thetable LIMIT 5 OFFSET 2",
+		"SELECT * FROM thetable GROUP BY dim",
+	} {
+		query, err := sql.Parse(sqlString)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		stripped, err := sql.Parse(withoutOrderLimitOffset(query))
+		if assert.NoError(t, err, sqlString) {
+			assert.Empty(t, stripped.OrderBy, sqlString)
+			assert.Zero(t, stripped.Limit, sqlString)
+			assert.Zero(t, stripped.Offset, sqlString)
+			assert.Equal(t, query.GroupBy, stripped.GroupBy, sqlString)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/rpc"
+)
+
+// ErrForwardQueueFull is returned by Forwarder.Forward when points are arriving
+// faster than they can be shipped to the server.
+var ErrForwardQueueFull = fmt.Errorf("Forwarding queue full, please try again later")
+
+// ErrForwarderClosed is returned by Forwarder.Forward after the Forwarder has
+// been closed.
+var ErrForwarderClosed = fmt.Errorf("Forwarder closed")
+
+type ForwarderOpts struct {
+	// QueueSize limits how many points may be queued for forwarding before
+	// Forward starts rejecting them. Defaults to 100,000.
+	QueueSize int
+
+	// BatchSize is the maximum number of points to send in a single insert.
+	// Defaults to 1,000.
+	BatchSize int
+
+	// FlushInterval is how frequently to send partial batches. Defaults to 1
+	// second.
+	FlushInterval time.Duration
+}
+
+// Forwarder queues points and ships them to the leader in batches. Followers
+// use it to accept inserts on behalf of the leader, so that producers can
+// insert into any node of a cluster.
+//
+// Points are acknowledged as soon as they're queued, before the leader has
+// them. Points that are still queued when the process exits without closing
+// the Forwarder, or that the leader rejects or can't be reached for, are lost
+// and only counted as Dropped.
+type Forwarder struct {
+	client    *Client
+	opts      *ForwarderOpts
+	queue     chan *forwardedPoint
+	flushes   chan chan interface{}
+	forwarded int64
+	dropped   int64
+	closed    bool
+	closeMx   sync.RWMutex
+	finished  chan interface{}
+}
+
+type forwardedPoint struct {
+	stream string
+	ts     time.Time
+	dims   bytemap.ByteMap
+	vals   bytemap.ByteMap
+}
+
+// NewForwarder creates a Forwarder that inserts using this Client.
+func (c *Client) NewForwarder(opts *ForwarderOpts) *Forwarder {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 100000
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 1 * time.Second
+	}
+	f := &Forwarder{
+		client:   c,
+		opts:     opts,
+		queue:    make(chan *forwardedPoint, opts.QueueSize),
+		flushes:  make(chan chan interface{}),
+		finished: make(chan interface{}),
+	}
+	go f.process()
+	return f
+}
+
+// Forward queues the given point for insertion into the named stream. It
+// returns ErrForwardQueueFull if the queue is full and ErrForwarderClosed if
+// the Forwarder has been closed. Failures to insert are logged and counted as
+// dropped, but not reported to the caller.
+func (f *Forwarder) Forward(stream string, ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap) error {
+	f.closeMx.RLock()
+	defer f.closeMx.RUnlock()
+	if f.closed {
+		atomic.AddInt64(&f.dropped, 1)
+		return ErrForwarderClosed
+	}
+	select {
+	case f.queue <- &forwardedPoint{stream, ts, dims, vals}:
+		return nil
+	default:
+		atomic.AddInt64(&f.dropped, 1)
+		return ErrForwardQueueFull
+	}
+}
+
+// Forwarded returns the number of points successfully inserted on the server.
+func (f *Forwarder) Forwarded() int64 {
+	return atomic.LoadInt64(&f.forwarded)
+}
+
+// Dropped returns the number of points that were rejected or failed to insert.
+func (f *Forwarder) Dropped() int64 {
+	return atomic.LoadInt64(&f.dropped)
+}
+
+// Flush immediately sends all queued points, including partial batches, and
+// waits for them to be sent.
+func (f *Forwarder) Flush() {
+	done := make(chan interface{})
+	select {
+	case f.flushes <- done:
+		<-done
+	case <-f.finished:
+		// already closed, nothing to flush
+	}
+}
+
+// Close stops accepting points and waits for queued points to be sent. It
+// doesn't close the underlying Client.
+func (f *Forwarder) Close() {
+	f.closeMx.Lock()
+	if !f.closed {
+		f.closed = true
+		close(f.queue)
+	}
+	f.closeMx.Unlock()
+	<-f.finished
+}
+
+func (f *Forwarder) process() {
+	defer close(f.finished)
+
+	batches := make(map[string][]*forwardedPoint)
+	flush := func(stream string) {
+		batch := batches[stream]
+		if len(batch) > 0 {
+			f.send(stream, batch)
+		}
+		delete(batches, stream)
+	}
+	flushAll := func() {
+		for stream := range batches {
+			flush(stream)
+		}
+	}
+	add := func(point *forwardedPoint) {
+		batch := append(batches[point.stream], point)
+		batches[point.stream] = batch
+		if len(batch) >= f.opts.BatchSize {
+			flush(point.stream)
+		}
+	}
+
+	ticker := time.NewTicker(f.opts.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case point, more := <-f.queue:
+			if !more {
+				flushAll()
+				return
+			}
+			add(point)
+		case done := <-f.flushes:
+			// pick up everything that was queued before the flush was requested
+			for queued := len(f.queue); queued > 0; queued-- {
+				point, more := <-f.queue
+				if !more {
+					break
+				}
+				add(point)
+			}
+			flushAll()
+			close(done)
+		case <-ticker.C:
+			flushAll()
+		}
+	}
+}
+
+func (f *Forwarder) send(stream string, batch []*forwardedPoint) {
+	ctx, cancel := f.client.withTimeout(context.Background())
+	defer cancel()
+
+	var inserter rpc.Inserter
+	_, err := f.client.withRetries(ctx, "forward", f.client.leader, func(conn rpc.Client) error {
+		var insertErr error
+		inserter, insertErr = conn.NewInserter(ctx, stream)
+		return insertErr
+	})
+	if err == nil {
+		for _, point := range batch {
+			err = inserter.InsertRaw(point.ts, point.dims, point.vals)
+			if err != nil {
+				break
+			}
+		}
+	}
+	var report *rpc.InsertReport
+	if err == nil {
+		report, err = inserter.Close()
+	}
+	if err != nil {
+		log.Errorf("Unable to forward %d points to %v: %v", len(batch), stream, err)
+		atomic.AddInt64(&f.dropped, int64(len(batch)))
+		return
+	}
+
+	if len(report.Errors) > 0 {
+		log.Errorf("%d of %d points forwarded to %v were rejected, for example: %v", len(report.Errors), len(batch), stream, firstError(report.Errors))
+	}
+	atomic.AddInt64(&f.forwarded, int64(report.Succeeded))
+	atomic.AddInt64(&f.dropped, int64(len(batch)-report.Succeeded))
+}
+
+func firstError(errors map[int]string) string {
+	first := -1
+	for i := range errors {
+		if first < 0 || i < first {
+			first = i
+		}
+	}
+	return errors[first]
+}
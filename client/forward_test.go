@@ -0,0 +1,97 @@
+package client
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/rpc/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForwarder(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	db := &mockDB{}
+	go rpcserver.Serve(db, l, &rpcserver.Opts{})
+
+	client, err := Dial(l.Addr().String(), &Opts{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	f := client.NewForwarder(&ForwarderOpts{
+		BatchSize:     100,
+		FlushInterval: 50 * time.Millisecond,
+	})
+
+	vals := bytemap.NewFloat(map[string]float64{"val": 1})
+	for i := 0; i < 250; i++ {
+		stream := "streama"
+		if i%2 == 0 {
+			stream = "streamb"
+		}
+		dims := bytemap.New(map[string]interface{}{"i": i})
+		if !assert.NoError(t, f.Forward(stream, time.Now(), dims, vals)) {
+			return
+		}
+	}
+	// Points without dims are rejected by the server
+	assert.NoError(t, f.Forward("streama", time.Now(), nil, vals))
+
+	f.Close()
+	assert.Equal(t, 250, db.NumInserts())
+	assert.EqualValues(t, 250, f.Forwarded())
+	assert.EqualValues(t, 1, f.Dropped())
+
+	assert.Equal(t, ErrForwarderClosed, f.Forward("streama", time.Now(), bytemap.New(map[string]interface{}{"i": 0}), vals))
+	assert.EqualValues(t, 2, f.Dropped())
+	f.Close()
+}
+
+func TestForwarderFlush(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	db := &mockDB{}
+	go rpcserver.Serve(db, l, &rpcserver.Opts{})
+
+	client, err := Dial(l.Addr().String(), &Opts{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	f := client.NewForwarder(&ForwarderOpts{
+		BatchSize:     100,
+		FlushInterval: 1 * time.Hour,
+	})
+	defer f.Close()
+
+	vals := bytemap.NewFloat(map[string]float64{"val": 1})
+	for i := 0; i < 10; i++ {
+		dims := bytemap.New(map[string]interface{}{"i": i})
+		if !assert.NoError(t, f.Forward("stream", time.Now(), dims, vals)) {
+			return
+		}
+	}
+	f.Flush()
+	assert.Equal(t, 10, db.NumInserts(), "Flush should send partial batches")
+	assert.EqualValues(t, 10, f.Forwarded())
+}
+
+func TestForwarderQueueFull(t *testing.T) {
+	f := &Forwarder{queue: make(chan *forwardedPoint, 1)}
+	assert.NoError(t, f.Forward("stream", time.Now(), nil, nil))
+	assert.Equal(t, ErrForwardQueueFull, f.Forward("stream", time.Now(), nil, nil))
+	assert.EqualValues(t, 1, f.Dropped())
+}
@@ -0,0 +1,135 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+// Row is a single row of query results.
+type Row struct {
+	TS     time.Time
+	Dims   map[string]interface{}
+	Values []float64
+
+	fieldIdxs map[string]int
+}
+
+// Get returns the value of the named field, or false if the field isn't
+// included in the results.
+func (r *Row) Get(field string) (float64, bool) {
+	idx, found := r.fieldIdxs[field]
+	if !found || idx >= len(r.Values) {
+		return 0, false
+	}
+	return r.Values[idx], true
+}
+
+// Rows iterates over the results of a query, like this:
+//
+//	rows, err := client.QueryRows(ctx, "SELECT * FROM table")
+//	if err != nil {
+//		return err
+//	}
+//	defer rows.Close()
+//	for rows.Next() {
+//		row := rows.Row()
+//		...
+//	}
+//	return rows.Err()
+type Rows struct {
+	md        *common.QueryMetaData
+	fieldIdxs map[string]int
+	rows      chan *core.FlatRow
+	done      chan struct{}
+	cancel    context.CancelFunc
+	current   *Row
+	err       error
+}
+
+func newRows(md *common.QueryMetaData, iterate func(onRow core.OnFlatRow) error, cancel context.CancelFunc) *Rows {
+	fieldIdxs := make(map[string]int, len(md.FieldNames))
+	for i, name := range md.FieldNames {
+		fieldIdxs[name] = i
+	}
+	r := &Rows{
+		md:        md,
+		fieldIdxs: fieldIdxs,
+		rows:      make(chan *core.FlatRow),
+		done:      make(chan struct{}),
+		cancel:    cancel,
+	}
+	go r.iterate(iterate)
+	return r
+}
+
+func (r *Rows) iterate(iterate func(onRow core.OnFlatRow) error) {
+	err := iterate(func(row *core.FlatRow) (bool, error) {
+		select {
+		case r.rows <- row:
+			return true, nil
+		case <-r.done:
+			return false, nil
+		}
+	})
+	// r.err is read only after r.rows is closed, so no need to synchronize
+	r.err = err
+	close(r.rows)
+}
+
+// MetaData returns the metadata for the query.
+func (r *Rows) MetaData() *common.QueryMetaData {
+	return r.md
+}
+
+// Fields returns the names of the fields in each Row, in the same order as
+// Row.Values.
+func (r *Rows) Fields() []string {
+	return r.md.FieldNames
+}
+
+// Next advances to the next Row, returning false once there are no more rows
+// or an error occurred.
+func (r *Rows) Next() bool {
+	row, ok := <-r.rows
+	if !ok {
+		r.current = nil
+		return false
+	}
+	r.current = &Row{
+		TS:        encoding.TimeFromInt(row.TS),
+		Dims:      row.Key.AsMap(),
+		Values:    row.Values,
+		fieldIdxs: r.fieldIdxs,
+	}
+	return true
+}
+
+// Row returns the current Row.
+func (r *Rows) Row() *Row {
+	return r.current
+}
+
+// Err returns the error, if any, that stopped iteration. It should be called
+// after Next returns false.
+func (r *Rows) Err() error {
+	return r.err
+}
+
+// Close stops iteration and releases the underlying stream.
+func (r *Rows) Close() error {
+	select {
+	case <-r.done:
+		// already closed
+	default:
+		close(r.done)
+	}
+	r.cancel()
+	// Drain remaining rows so that the iterating goroutine can finish
+	for range r.rows {
+	}
+	return nil
+}
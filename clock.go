@@ -0,0 +1,277 @@
+package zenodb
+
+import (
+	"sync"
+	"time"
+)
+
+// timeSource tells a DB what time it is and drives its background work, like
+// flushing memstores, applying retention and recording stats.
+type timeSource interface {
+	Now() time.Time
+
+	// Advance advances virtual time to t. It does nothing in real time.
+	Advance(t time.Time)
+
+	// observe is told the timestamp of every inserted point.
+	observe(ts time.Time)
+
+	newTicker(d time.Duration) ticker
+
+	newTimer(d time.Duration) timer
+}
+
+type ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type timer interface {
+	C() <-chan time.Time
+
+	// Reset stops the timer and makes it fire after d. Unlike time.Timer, a
+	// pending tick that hasn't been received is discarded.
+	Reset(d time.Duration)
+
+	Stop()
+}
+
+var realTime timeSource = &realClock{}
+
+type realClock struct{}
+
+func (c *realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c *realClock) Advance(t time.Time) {}
+
+func (c *realClock) observe(ts time.Time) {}
+
+func (c *realClock) newTicker(d time.Duration) ticker {
+	return &realTicker{time.NewTicker(d)}
+}
+
+func (c *realClock) newTimer(d time.Duration) timer {
+	return &realTimer{time.NewTimer(d)}
+}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (t *realTicker) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t *realTicker) Stop() {
+	t.t.Stop()
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t *realTimer) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t *realTimer) Reset(d time.Duration) {
+	t.Stop()
+	t.t.Reset(d)
+}
+
+func (t *realTimer) Stop() {
+	if !t.t.Stop() {
+		select {
+		case <-t.t.C:
+		default:
+		}
+	}
+}
+
+// VirtualClock is a clock that only advances when told to, either by the
+// timestamps of inserted points or explicitly through Advance and Tick. All
+// of a DB's timers run off of its clock, so with a VirtualClock tests can
+// trigger flushes, retention and stats recording without sleeping.
+//
+// Ticks are delivered to the DB's background goroutines before Advance
+// returns, but the work they trigger happens asynchronously.
+type VirtualClock struct {
+	now    time.Time
+	frozen bool
+	timers map[*virtualTimer]bool
+	mx     sync.Mutex
+}
+
+// NewVirtualClock constructs a VirtualClock starting at the given time. If now
+// is zero, the clock starts at the timestamp of the first point inserted.
+func NewVirtualClock(now time.Time) *VirtualClock {
+	return &VirtualClock{
+		now:    now,
+		timers: make(map[*virtualTimer]bool),
+	}
+}
+
+// Now returns the current virtual time.
+func (c *VirtualClock) Now() time.Time {
+	c.mx.Lock()
+	now := c.now
+	c.mx.Unlock()
+	return now
+}
+
+// Advance advances the clock to t, firing any timers that come due. It does
+// nothing if t is not after the current time. Advance works even when the
+// clock is frozen.
+func (c *VirtualClock) Advance(t time.Time) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if !t.After(c.now) {
+		return
+	}
+	c.now = t
+	for tm := range c.timers {
+		if tm.at.IsZero() {
+			// Clock is getting its first time, start counting from here
+			tm.at = t.Add(tm.d)
+			continue
+		}
+		if t.Before(tm.at) {
+			continue
+		}
+		select {
+		case tm.c <- t:
+			// fired
+		default:
+			// previous tick not yet received, drop this one like time.Ticker
+		}
+		if tm.period > 0 {
+			tm.at = tm.at.Add((t.Sub(tm.at)/tm.period + 1) * tm.period)
+		} else {
+			delete(c.timers, tm)
+		}
+	}
+}
+
+// Tick advances the clock by d.
+func (c *VirtualClock) Tick(d time.Duration) {
+	c.Advance(c.Now().Add(d))
+}
+
+// Freeze stops inserted points from advancing the clock, so that it only
+// moves when Advance or Tick are called.
+func (c *VirtualClock) Freeze() {
+	c.mx.Lock()
+	c.frozen = true
+	c.mx.Unlock()
+}
+
+// Unfreeze lets inserted points advance the clock again.
+func (c *VirtualClock) Unfreeze() {
+	c.mx.Lock()
+	c.frozen = false
+	c.mx.Unlock()
+}
+
+func (c *VirtualClock) observe(ts time.Time) {
+	c.mx.Lock()
+	frozen := c.frozen
+	c.mx.Unlock()
+	if !frozen {
+		c.Advance(ts)
+	}
+}
+
+func (c *VirtualClock) newTicker(d time.Duration) ticker {
+	tm := &virtualTimer{clock: c, period: d, c: make(chan time.Time, 1)}
+	c.mx.Lock()
+	c.schedule(tm, d)
+	c.mx.Unlock()
+	return tm
+}
+
+func (c *VirtualClock) newTimer(d time.Duration) timer {
+	tm := &virtualTimer{clock: c, c: make(chan time.Time, 1)}
+	c.mx.Lock()
+	c.schedule(tm, d)
+	c.mx.Unlock()
+	return tm
+}
+
+// schedule schedules tm to fire after d, must be called with c.mx held.
+func (c *VirtualClock) schedule(tm *virtualTimer, d time.Duration) {
+	tm.d = d
+	if c.now.IsZero() {
+		tm.at = time.Time{}
+	} else {
+		tm.at = c.now.Add(d)
+	}
+	c.timers[tm] = true
+}
+
+type virtualTimer struct {
+	clock *VirtualClock
+	// period is zero for timers and the tick interval for tickers
+	period time.Duration
+	d      time.Duration
+	// at is when the timer next fires, or zero if the clock hasn't started yet
+	at time.Time
+	c  chan time.Time
+}
+
+func (tm *virtualTimer) C() <-chan time.Time {
+	return tm.c
+}
+
+func (tm *virtualTimer) Reset(d time.Duration) {
+	tm.clock.mx.Lock()
+	tm.drain()
+	tm.clock.schedule(tm, d)
+	tm.clock.mx.Unlock()
+}
+
+func (tm *virtualTimer) Stop() {
+	tm.clock.mx.Lock()
+	delete(tm.clock.timers, tm)
+	tm.drain()
+	tm.clock.mx.Unlock()
+}
+
+func (tm *virtualTimer) drain() {
+	select {
+	case <-tm.c:
+	default:
+	}
+}
+
+// maxObserveBatch caps how many inserted points an observeBatch accumulates
+// before the clock observes them, so that a steady stream of inserts doesn't
+// hold back the clock indefinitely.
+const maxObserveBatch = 1000
+
+// observeBatch accumulates the timestamps of inserted points so that the clock
+// only has to observe the latest of them once per batch rather than once per
+// point. It is not safe for concurrent use.
+type observeBatch struct {
+	latest time.Time
+	size   int
+}
+
+func (b *observeBatch) add(ts time.Time) {
+	if ts.After(b.latest) {
+		b.latest = ts
+	}
+	b.size++
+}
+
+// flush has the clock observe the latest timestamp in the batch, if any, and
+// starts a new batch.
+func (b *observeBatch) flush(clock timeSource) {
+	if b.size == 0 {
+		return
+	}
+	clock.observe(b.latest)
+	b.latest = time.Time{}
+	b.size = 0
+}
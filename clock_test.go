@@ -0,0 +1,142 @@
+package zenodb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVirtualClock(t *testing.T) {
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 5, time.UTC)
+	c := NewVirtualClock(epoch)
+	tk := c.newTicker(time.Minute)
+	tm := c.newTimer(30 * time.Second)
+
+	c.Tick(29 * time.Second)
+	assertNotFired(t, tk, "ticker before first interval")
+	assertNotFired(t, tm, "timer before deadline")
+
+	c.Tick(time.Second)
+	assertFired(t, tm, epoch.Add(30*time.Second), "timer at deadline")
+	assertNotFired(t, tk, "ticker before first interval")
+
+	c.Tick(30 * time.Second)
+	assertFired(t, tk, epoch.Add(time.Minute), "ticker at first interval")
+	assertNotFired(t, tm, "timer only fires once")
+
+	tm.Reset(time.Second)
+	c.Tick(150 * time.Second)
+	assertFired(t, tm, epoch.Add(210*time.Second), "reset timer")
+	assertFired(t, tk, epoch.Add(210*time.Second), "ticker after skipping intervals")
+	c.Tick(30 * time.Second)
+	assertFired(t, tk, epoch.Add(240*time.Second), "ticker stays on its interval")
+
+	c.Advance(epoch)
+	assert.Equal(t, epoch.Add(240*time.Second), c.Now(), "clock shouldn't go backwards")
+
+	c.Freeze()
+	c.observe(epoch.Add(time.Hour))
+	assert.Equal(t, epoch.Add(240*time.Second), c.Now(), "frozen clock shouldn't advance on inserts")
+	c.Tick(time.Second)
+	assert.Equal(t, epoch.Add(241*time.Second), c.Now(), "frozen clock should still tick")
+	c.Unfreeze()
+	c.observe(epoch.Add(time.Hour))
+	assert.Equal(t, epoch.Add(time.Hour), c.Now())
+
+	tk.Stop()
+	tk.(*virtualTimer).drain()
+	c.Tick(time.Hour)
+	assertNotFired(t, tk, "stopped ticker")
+}
+
+func TestVirtualClockStartsOnFirstTime(t *testing.T) {
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 5, time.UTC)
+	c := NewVirtualClock(time.Time{})
+	tk := c.newTicker(time.Minute)
+	c.Advance(epoch)
+	assertNotFired(t, tk, "ticker on first time")
+	c.Tick(time.Minute)
+	assertFired(t, tk, epoch.Add(time.Minute), "ticker after first time")
+}
+
+func TestObserveBatch(t *testing.T) {
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 5, time.UTC)
+	c := NewVirtualClock(epoch)
+	b := &observeBatch{}
+
+	b.flush(c)
+	assert.Equal(t, epoch, c.Now(), "empty batch shouldn't advance clock")
+
+	b.add(epoch.Add(2 * time.Minute))
+	b.add(epoch.Add(3 * time.Minute))
+	b.add(epoch.Add(time.Minute))
+	assert.Equal(t, epoch, c.Now(), "clock shouldn't advance until batch is flushed")
+	b.flush(c)
+	assert.Equal(t, epoch.Add(3*time.Minute), c.Now(), "clock should advance to latest time in batch")
+	assert.Equal(t, 0, b.size)
+
+	b.add(epoch.Add(2 * time.Minute))
+	b.flush(c)
+	assert.Equal(t, epoch.Add(3*time.Minute), c.Now(), "clock shouldn't go backwards")
+}
+
+func TestVirtualClockDrivesFlush(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 5, time.UTC)
+	clock := NewVirtualClock(epoch)
+	clock.Freeze()
+	db, err := NewDB(&DBOpts{
+		Dir:   tmpDir,
+		Clock: clock,
+		Schema: Schema{
+			"thetable": &TableOpts{
+				RetentionPeriod: 24 * time.Hour,
+				MinFlushLatency: time.Minute,
+				MaxFlushLatency: time.Minute,
+				SQL:             "SELECT SUM(a) AS a FROM inbound GROUP BY x, period(1s)",
+			},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	assert.Equal(t, clock, db.VirtualClock())
+
+	db.Insert("inbound", epoch.Add(time.Hour), map[string]interface{}{"x": 1}, map[string]float64{"a": 1})
+	waitFor(func() bool { return db.TableStats("thetable").ArchiveQueueDepth == 1 })
+	assert.Equal(t, epoch, clock.Now(), "inserts shouldn't advance frozen clock")
+	assert.EqualValues(t, 0, db.TableStats("thetable").Flushes)
+
+	clock.Tick(time.Minute)
+	waitFor(func() bool { return db.TableStats("thetable").Flushes == 1 })
+	stats := db.TableStats("thetable")
+	assert.EqualValues(t, 1, stats.Flushes, "ticking past max flush latency should flush")
+	assert.EqualValues(t, 1, stats.DiskKeys)
+	assert.EqualValues(t, 0, stats.ArchiveQueueDepth)
+}
+
+func assertFired(t *testing.T, tm interface{ C() <-chan time.Time }, expected time.Time, msg string) {
+	select {
+	case ts := <-tm.C():
+		assert.Equal(t, expected, ts, msg)
+	default:
+		assert.Fail(t, "should have fired", msg)
+	}
+}
+
+func assertNotFired(t *testing.T, tm interface{ C() <-chan time.Time }, msg string) {
+	select {
+	case <-tm.C():
+		assert.Fail(t, "shouldn't have fired", msg)
+	default:
+	}
+}
@@ -0,0 +1,211 @@
+package zenodb
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/sql"
+)
+
+// clusterCache caches the results that followers return for queries that
+// exclude the memstore. Such results only change when the followers archive new
+// data, which they report via QueryHandlerCapabilities.Archived whenever they
+// register to handle queries and via RemoteQueryResult.Archived whenever their
+// idle handlers answer a ping, so a leader that runs the same query over and
+// over (e.g. for a dashboard) only needs to re-query the partitions whose data
+// changed since.
+type clusterCache struct {
+	mx sync.Mutex
+	// entries are keyed by clusterCacheKey.String()
+	entries map[string]*clusterCacheEntry
+	// archived is the latest archive time reported for each partition
+	archived map[int]time.Time
+	rows     int
+	hits     int64
+	misses   int64
+}
+
+// clusterCacheKey identifies the results of a query on a partition for a
+// specific time range.
+type clusterCacheKey struct {
+	fingerprint string
+	partition   int
+	asOf        time.Time
+	until       time.Time
+}
+
+func (key clusterCacheKey) String() string {
+	return fmt.Sprintf("%d|%d|%d|%v", key.partition, key.asOf.UnixNano(), key.until.UnixNano(), key.fingerprint)
+}
+
+type clusterCacheEntry struct {
+	key       string
+	partition int
+	fields    core.Fields
+	// rows holds either unflat rows (key and vals) or flat rows
+	rows []*remoteResult
+	// archived is the latest archive time for the partition as of when the
+	// partition was queried
+	archived time.Time
+	stored   time.Time
+	lastUsed time.Time
+}
+
+func newClusterCache() *clusterCache {
+	return &clusterCache{
+		entries:  make(map[string]*clusterCacheEntry),
+		archived: make(map[int]time.Time),
+	}
+}
+
+// clusterCacheKeyFor returns the key under which to cache the results of the
+// given query, without a partition. The time range is resolved against the
+// current time rounded down to the resolution of the queried table, so that
+// queries with relative time ranges hit the cache until the range moves on to
+// the next period. Queries whose resolution can't be determined aren't cached.
+func (db *DB) clusterCacheKeyFor(sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool) (clusterCacheKey, bool) {
+	key := clusterCacheKey{}
+	query, err := sql.Parse(sqlString)
+	if err != nil {
+		return key, false
+	}
+	for query.FromSubQuery != nil {
+		query = query.FromSubQuery
+	}
+	resolution := query.Resolution
+	if t := db.getTable(query.From); t != nil {
+		resolution = t.Resolution
+	}
+	if resolution <= 0 {
+		return key, false
+	}
+
+	now := encoding.RoundTimeDown(db.clock.Now(), resolution)
+	key.asOf = query.AsOf
+	if query.AsOfOffset != 0 {
+		key.asOf = now.Add(query.AsOfOffset)
+	}
+	key.until = query.Until
+	if query.UntilOffset != 0 {
+		key.until = now.Add(query.UntilOffset)
+	} else if key.until.IsZero() {
+		key.until = now
+	}
+	key.fingerprint = fmt.Sprintf("%v|%v|%v|%v", strings.Join(strings.Fields(sqlString), " "), isSubQuery, unflat, subQueryResults)
+	return key, true
+}
+
+// markArchived records that the followers of the given partition archived new
+// data at the given time, which invalidates the partition's cached results.
+func (c *clusterCache) markArchived(partition int, ts time.Time) {
+	if c == nil || ts.IsZero() {
+		return
+	}
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if !ts.After(c.archived[partition]) {
+		return
+	}
+	c.archived[partition] = ts
+	for _, entry := range c.entries {
+		if entry.partition == partition && entry.archived.Before(ts) {
+			c.remove(entry)
+		}
+	}
+}
+
+// lastArchived returns the latest archive time reported for the given
+// partition, which is zero if its followers don't report archive times.
+func (c *clusterCache) lastArchived(partition int) time.Time {
+	if c == nil {
+		return time.Time{}
+	}
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.archived[partition]
+}
+
+// get returns the cached results for the given key if they're still current,
+// counting a hit or a miss.
+func (c *clusterCache) get(key clusterCacheKey, ttl time.Duration, now time.Time) *clusterCacheEntry {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	entry := c.entries[key.String()]
+	if entry != nil && (entry.archived.Before(c.archived[key.partition]) || now.Sub(entry.stored) > ttl) {
+		c.remove(entry)
+		entry = nil
+	}
+	if entry == nil {
+		c.misses++
+		return nil
+	}
+	c.hits++
+	entry.lastUsed = now
+	return entry
+}
+
+// put caches the given entry, evicting the least recently used entries to stay
+// within maxRows.
+func (c *clusterCache) put(entry *clusterCacheEntry, maxRows int) {
+	if len(entry.rows) > maxRows {
+		return
+	}
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if existing := c.entries[entry.key]; existing != nil {
+		c.remove(existing)
+	}
+	for c.rows+len(entry.rows) > maxRows {
+		var oldest *clusterCacheEntry
+		for _, candidate := range c.entries {
+			if oldest == nil || candidate.lastUsed.Before(oldest.lastUsed) {
+				oldest = candidate
+			}
+		}
+		c.remove(oldest)
+	}
+	c.entries[entry.key] = entry
+	c.rows += len(entry.rows)
+}
+
+func (c *clusterCache) remove(entry *clusterCacheEntry) {
+	delete(c.entries, entry.key)
+	c.rows -= len(entry.rows)
+}
+
+// stats returns the number of hits and misses since the cache was created.
+func (c *clusterCache) stats() (int64, int64) {
+	if c == nil {
+		return 0, 0
+	}
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.hits, c.misses
+}
+
+// copyResult copies the row in the given result, so that neither the cache nor
+// the recipients of cached rows see each other's modifications.
+func copyResult(result *remoteResult) *remoteResult {
+	copied := &remoteResult{partition: result.partition, key: result.key}
+	if result.vals != nil {
+		copied.vals = make(core.Vals, len(result.vals))
+		for i, seq := range result.vals {
+			if seq != nil {
+				copied.vals[i] = append(encoding.Sequence(nil), seq...)
+			}
+		}
+	}
+	if result.flatRow != nil {
+		row := *result.flatRow
+		row.Values = append([]float64(nil), row.Values...)
+		if row.Nulls != nil {
+			row.Nulls = append([]bool(nil), row.Nulls...)
+		}
+		copied.flatRow = &row
+	}
+	return copied
+}
@@ -1,6 +1,7 @@
 package zenodb
 
 import (
+	"context"
 	"fmt"
 	"github.com/dustin/go-humanize"
 	"github.com/getlantern/bytemap"
@@ -11,8 +12,11 @@ import (
 	"github.com/getlantern/zenodb/encoding"
 	"github.com/spaolacci/murmur3"
 	"hash"
+	"io/ioutil"
+	"path/filepath"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -36,20 +40,44 @@ type followSpec struct {
 
 type follower struct {
 	common.Follow
+	id        int
+	joined    time.Time
 	cb        func(data []byte, offset wal.Offset) error
 	entries   chan *walEntry
 	hasFailed int32
+
+	statusMx   sync.RWMutex
+	lastOffset wal.Offset
+	lastTS     time.Time
 }
 
-func (f *follower) read() {
-	for entry := range f.entries {
-		if f.failed() {
-			continue
-		}
-		err := f.cb(entry.data, entry.offset)
-		if err != nil {
-			log.Errorf("Error on following for follower %d: %v", f.PartitionNumber, err)
+// read feeds entries to the follower's callback until the entries are closed
+// or ctx is done, in which case the follower is marked as failed so that it
+// doesn't receive any more entries.
+func (f *follower) read(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			log.Debugf("Stopped following for follower %d: %v", f.PartitionNumber, ctx.Err())
 			f.markFailed()
+			return
+		case entry, more := <-f.entries:
+			if !more {
+				return
+			}
+			if f.failed() {
+				continue
+			}
+			err := f.cb(entry.data, entry.offset)
+			if err != nil {
+				log.Errorf("Error on following for follower %d: %v", f.PartitionNumber, err)
+				f.markFailed()
+				continue
+			}
+			f.statusMx.Lock()
+			f.lastOffset = entry.offset
+			f.lastTS = entryTime(entry.data)
+			f.statusMx.Unlock()
 		}
 	}
 }
@@ -70,11 +98,122 @@ func (f *follower) failed() bool {
 	return atomic.LoadInt32(&f.hasFailed) == 1
 }
 
-func (db *DB) Follow(f *common.Follow, cb func([]byte, wal.Offset) error) {
+// ResyncRequiredError indicates that a follower asked to follow from an offset
+// that precedes the oldest data retained in the leader's WAL, meaning that the
+// follower has missed data and needs to be resynced.
+type ResyncRequiredError struct {
+	Stream    string
+	Partition int
+	Requested wal.Offset
+	Oldest    wal.Offset
+}
+
+func (e *ResyncRequiredError) Error() string {
+	return fmt.Sprintf("resync required: partition %d requested stream %v starting at %v, but the oldest retained WAL segment starts at %v", e.Partition, e.Stream, e.Requested, e.Oldest)
+}
+
+// Follow feeds the given follower with entries from the WAL until it fails. If
+// the follower requests data that's no longer in the WAL, Follow returns a
+// *ResyncRequiredError. If the follower violates the Placement, Follow returns
+// a *PlacementError.
+func (db *DB) Follow(f *common.Follow, cb func([]byte, wal.Offset) error) error {
+	return db.FollowContext(context.Background(), f, cb)
+}
+
+// FollowContext is like Follow but stops following once ctx is done, in which
+// case it returns ctx's error.
+func (db *DB) FollowContext(ctx context.Context, f *common.Follow, cb func([]byte, wal.Offset) error) error {
+	gapErr := db.checkForGap(f)
+	if gapErr != nil {
+		log.Error(gapErr)
+		db.recordGap(gapErr)
+		return gapErr
+	}
+	db.clearGap(f.Stream, f.PartitionNumber)
+
+	fol := &follower{Follow: *f, joined: time.Now(), cb: cb, entries: make(chan *walEntry, 1000000)} // TODO: make this buffer tunable
+	placementErr := db.place(fol)
+	if placementErr != nil {
+		log.Error(placementErr)
+		return placementErr
+	}
+	defer db.unplace(fol)
+
 	go db.processFollowersOnce.Do(db.processFollowers)
-	fol := &follower{Follow: *f, cb: cb, entries: make(chan *walEntry, 1000000)} // TODO: make this buffer tunable
-	db.followerJoined <- fol
-	fol.read()
+	select {
+	case db.followerJoined <- fol:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	fol.read(ctx)
+	db.removeFollower(fol)
+	return ctx.Err()
+}
+
+// checkForGap checks whether any of the tables requested by the follower need
+// data that has already been truncated from the WAL. Tables that have never
+// received data are assumed to be happy with whatever's available.
+func (db *DB) checkForGap(f *common.Follow) *ResyncRequiredError {
+	oldest, err := db.oldestWALOffset(f.Stream)
+	if err != nil {
+		log.Errorf("Unable to determine oldest WAL offset for %v, not checking for gaps: %v", f.Stream, err)
+		return nil
+	}
+	if oldest == nil {
+		return nil
+	}
+
+	for _, partition := range f.Partitions {
+		for _, t := range partition.Tables {
+			if t.Offset.FileSequence() == 0 {
+				// New table
+				continue
+			}
+			requested := t.Offset
+			if f.EarliestOffset.After(requested) {
+				requested = f.EarliestOffset
+			}
+			if oldest.After(requested) {
+				return &ResyncRequiredError{
+					Stream:    f.Stream,
+					Partition: f.PartitionNumber,
+					Requested: requested,
+					Oldest:    oldest,
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// oldestWALOffset returns the offset at which the oldest retained segment of
+// the given stream's WAL starts, or nil if the WAL is empty.
+func (db *DB) oldestWALOffset(stream string) (wal.Offset, error) {
+	files, err := ioutil.ReadDir(db.walDir(stream))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if offset := walSegmentOffset(file.Name()); offset != nil {
+			return offset, nil
+		}
+	}
+	return nil, nil
+}
+
+// walSegmentOffset returns the offset at which the WAL segment with the given
+// file name starts, or nil if the file isn't a segment. The wal package doesn't
+// expose this, so it relies on segments being named by their zero-padded
+// sequence number, which is the timestamp in microseconds at which they were
+// started, optionally followed by an extension if they're compressed.
+// TestWALSegmentOffset fails if that naming changes.
+func walSegmentOffset(filename string) wal.Offset {
+	name := strings.TrimSuffix(filename, filepath.Ext(filename))
+	seq, err := strconv.ParseInt(name, 10, 64)
+	if err != nil || seq <= 0 {
+		return nil
+	}
+	return wal.NewOffsetForTS(time.Unix(0, seq*int64(time.Microsecond)))
 }
 
 type tableSpec struct {
@@ -106,6 +245,8 @@ func (db *DB) processFollowers() {
 		nextFollowerID++
 		log.Debugf("Follower joined: %d -> %d", nextFollowerID, f.PartitionNumber)
 		followers[nextFollowerID] = f
+		f.id = nextFollowerID
+		db.addFollower(f)
 
 		partitions := streams[f.Stream]
 		if partitions == nil {
@@ -389,11 +530,11 @@ func (db *DB) mapPartitionRequests(in chan *partitionRequest, mapped chan *parti
 		}
 
 		data := entry.data
-		// Skip timestamp
-		_, remain := encoding.Read(data, encoding.Width64bits)
-		dimsLen, remain := encoding.ReadInt32(remain)
-		_dims, _ := encoding.Read(remain, dimsLen)
-		dims := bytemap.ByteMap(_dims)
+		dims, err := dimsFor(data)
+		corrupted := err != nil
+		if corrupted {
+			log.Errorf("Unable to decode dimensions for entry in stream %v, not sending to followers: %v", entry.stream, err)
+		}
 
 		whereResults := make(map[string]bool, 50)
 
@@ -403,7 +544,7 @@ func (db *DB) mapPartitionRequests(in chan *partitionRequest, mapped chan *parti
 			result.partitions[partitionKeys] = pr
 			for tableName, table := range partition.tables {
 				specs := table.followers[pid]
-				if len(specs) == 0 {
+				if len(specs) == 0 || corrupted {
 					continue
 				}
 				wherePassed, found := whereResults[table.whereString]
@@ -419,6 +560,21 @@ func (db *DB) mapPartitionRequests(in chan *partitionRequest, mapped chan *parti
 	}
 }
 
+// dimsFor extracts the dimensions from a WAL entry.
+func dimsFor(data []byte) (bytemap.ByteMap, error) {
+	// Skip timestamp
+	_, remain, err := encoding.ReadChecked(data, encoding.Width64bits)
+	if err != nil {
+		return nil, err
+	}
+	dimsLen, remain, err := encoding.ReadInt32Checked(remain)
+	if err != nil {
+		return nil, err
+	}
+	dims, _, err := encoding.ReadByteMapChecked(remain, dimsLen)
+	return dims, err
+}
+
 func (db *DB) reducePartitionRequests(parallelism int, mapped chan *partitionsResult, results chan *partitionsResult, queued chan int, drained chan bool) {
 	buf := make(partitionsResultsByOffset, 0, parallelism)
 	for numQueued := range queued {
@@ -563,10 +719,17 @@ func (db *DB) doFollowLeader(stream string, tables []*table, offsets []wal.Offse
 		offsetMx.RUnlock()
 
 		if db.opts.MaxFollowAge > 0 {
-			earliestAllowedOffset := wal.NewOffsetForTS(db.clock.Now().Add(-1 * db.opts.MaxFollowAge))
+			earliestAllowed := db.clock.Now().Add(-1 * db.opts.MaxFollowAge)
+			earliestAllowedOffset := wal.NewOffsetForTS(earliestAllowed)
 			if earliestAllowedOffset.After(earliestOffset) {
 				log.Debugf("Forcibly limiting following to %v", earliestAllowedOffset)
 				earliestOffset = earliestAllowedOffset
+				// Data before the allowed offset is skipped, so the leader shouldn't
+				// rely on us for it
+				heldSince := earliestAllowed.UnixNano()
+				if heldSince > atomic.LoadInt64(&db.heldSince) {
+					atomic.StoreInt64(&db.heldSince, heldSince)
+				}
 			}
 		}
 
@@ -576,6 +739,8 @@ func (db *DB) doFollowLeader(stream string, tables []*table, offsets []wal.Offse
 			EarliestOffset:  earliestOffset,
 			PartitionNumber: db.opts.Partition,
 			Partitions:      partitions,
+			Version:         Version,
+			Labels:          db.opts.Labels,
 		}
 	}
 
@@ -588,6 +753,7 @@ func (db *DB) doFollowLeader(stream string, tables []*table, offsets []wal.Offse
 			// Okay to continue
 		}
 
+		db.recordFollowLag(stream, data)
 		for i, in := range ins {
 			priorOffset := offsets[i]
 			if newOffset.After(priorOffset) {
@@ -13,33 +13,189 @@ import (
 	"github.com/getlantern/zenodb/common"
 	"github.com/getlantern/zenodb/core"
 	"github.com/getlantern/zenodb/planner"
+	"github.com/getlantern/zenodb/sql"
+	"github.com/getlantern/zenodb/trace"
 )
 
+// queryHandler is a handler for remote queries along with the capabilities
+// that it registered with.
+type queryHandler struct {
+	caps  *common.QueryHandlerCapabilities
+	query planner.QueryClusterFN
+}
+
+// queryRequirements describe what a handler needs to be capable of to answer a
+// query.
+type queryRequirements struct {
+	tables []string
+	asOf   time.Time
+}
+
+// RegisterQueryHandler registers a handler for queries on the given partition
+// that can answer all queries, see RegisterQueryHandlerWithCapabilities.
 func (db *DB) RegisterQueryHandler(partition int, query planner.QueryClusterFN) {
+	err := db.RegisterQueryHandlerWithCapabilities(partition, nil, query)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// RegisterQueryHandlerWithCapabilities registers a handler for a single query
+// on the given partition. Queries are only routed to handlers whose
+// capabilities (which may be nil) say that they serve the queried tables.
+// Handlers that hold the data for the query's time range are preferred, but if
+// none are available, the query goes to one that doesn't. Handlers for
+// partitions that don't exist are rejected.
+func (db *DB) RegisterQueryHandlerWithCapabilities(partition int, caps *common.QueryHandlerCapabilities, query planner.QueryClusterFN) error {
+	if partition < 0 || (db.opts.NumPartitions > 0 && partition >= db.opts.NumPartitions) {
+		return fmt.Errorf("Unknown partition %d", partition)
+	}
 	db.tablesMutex.Lock()
 	handlersCh := db.remoteQueryHandlers[partition]
 	if handlersCh == nil {
 		// TODO: maybe make size based on configuration or something
-		handlersCh = make(chan planner.QueryClusterFN, 100)
+		handlersCh = make(chan *queryHandler, 100)
 	}
 	db.remoteQueryHandlers[partition] = handlersCh
 	db.tablesMutex.Unlock()
-	handlersCh <- query
+	if caps != nil {
+		db.clusterCache.markArchived(partition, caps.Archived)
+	}
+	handlersCh <- &queryHandler{caps, query}
+	return nil
 }
 
-func (db *DB) remoteQueryHandlerForPartition(partition int) planner.QueryClusterFN {
+// PartitionArchived records that the followers of the given partition archived
+// data at the given time, as reported by their query handlers while they wait
+// for queries. This invalidates the partition's cached results even if none of
+// its handlers registered since.
+func (db *DB) PartitionArchived(partition int, archived time.Time) {
+	db.clusterCache.markArchived(partition, archived)
+}
+
+// queryHandlerForPartition returns a handler for querying the given partition
+// that meets the given requirements, or nil if none is available. The
+// LocalPartition is queried directly from this node's tables.
+func (db *DB) queryHandlerForPartition(partition int, reqs *queryRequirements) planner.QueryClusterFN {
+	if db.opts.LocalPartition && partition == db.opts.Partition {
+		return db.queryForRemote
+	}
 	db.tablesMutex.RLock()
-	defer db.tablesMutex.RUnlock()
-	select {
-	case handler := <-db.remoteQueryHandlers[partition]:
-		return handler
-	default:
+	handlersCh := db.remoteQueryHandlers[partition]
+	db.tablesMutex.RUnlock()
+
+	var chosen, fallback *queryHandler
+	var skipped []*queryHandler
+	for i := len(handlersCh); i > 0 && chosen == nil; i-- {
+		var handler *queryHandler
+		select {
+		case handler = <-handlersCh:
+		default:
+		}
+		if handler == nil {
+			break
+		}
+		switch {
+		case !handler.caps.Serves(reqs.tables...):
+			skipped = append(skipped, handler)
+		case handler.caps.Holds(reqs.asOf):
+			chosen = handler
+		case fallback == nil:
+			fallback = handler
+		default:
+			skipped = append(skipped, handler)
+		}
+	}
+	if chosen == nil && fallback != nil {
+		log.Debugf("No query handler for partition %d holds data as of %v, using one that holds data since %v", partition, reqs.asOf, fallback.caps.Since)
+		chosen = fallback
+	} else if fallback != nil {
+		skipped = append(skipped, fallback)
+	}
+	// Return skipped handlers so that they can handle other queries
+	for _, handler := range skipped {
+		select {
+		case handlersCh <- handler:
+		default:
+			go func(handler *queryHandler) {
+				handlersCh <- handler
+			}(handler)
+		}
+	}
+	if chosen == nil {
 		return nil
 	}
+	return chosen.query
 }
 
-func (db *DB) queryForRemote(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) error {
-	source, err := db.Query(sqlString, isSubQuery, subQueryResults, common.ShouldIncludeMemStore(ctx))
+// queryRequirementsFor determines the requirements for handlers of the given
+// query, which are the tables from which it selects and the earliest time for
+// which it needs data.
+func (db *DB) queryRequirementsFor(sqlString string) *queryRequirements {
+	reqs := &queryRequirements{}
+	query, err := sql.Parse(sqlString)
+	if err != nil {
+		// Let the partitions report the error
+		return reqs
+	}
+	for current := query; current != nil; current = current.FromSubQuery {
+		if current.FromSubQuery == nil {
+			reqs.tables = append(reqs.tables, current.From)
+			if current.AsOfOffset != 0 {
+				reqs.asOf = db.clock.Now().Add(current.AsOfOffset)
+			} else {
+				reqs.asOf = current.AsOf
+			}
+		}
+	}
+	return reqs
+}
+
+// queryHandlerCapabilities describes the queries that this follower can
+// answer for its leader, which it advertises every time that it registers via
+// DBOpts.RegisterRemoteQueryHandler.
+func (db *DB) queryHandlerCapabilities() *common.QueryHandlerCapabilities {
+	caps := &common.QueryHandlerCapabilities{Version: Version}
+	db.tablesMutex.RLock()
+	for _, t := range db.orderedTables {
+		if !t.Virtual {
+			caps.Tables = append(caps.Tables, t.Name)
+		}
+	}
+	db.tablesMutex.RUnlock()
+	if heldSince := atomic.LoadInt64(&db.heldSince); heldSince > 0 {
+		caps.Since = time.Unix(0, heldSince)
+	}
+	if lastArchived := atomic.LoadInt64(&db.lastArchived); lastArchived > 0 {
+		caps.Archived = time.Unix(0, lastArchived)
+	}
+	return caps
+}
+
+// recordArchived records that a table archived new data to disk, which changes
+// the results of queries that exclude the memstore.
+func (db *DB) recordArchived() {
+	now := db.clock.Now().UnixNano()
+	for {
+		last := atomic.LoadInt64(&db.lastArchived)
+		if now <= last {
+			// Make sure that every archive advances lastArchived, even if the clock
+			// doesn't
+			now = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&db.lastArchived, last, now) {
+			return
+		}
+	}
+}
+
+func (db *DB) queryForRemote(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) (queryErr error) {
+	ctx, span := trace.Start(ctx, "query.remote", "sql", sqlString, "partition", db.opts.Partition)
+	defer func() {
+		span.Finish(queryErr)
+	}()
+
+	source, err := db.query(sqlString, isSubQuery, subQueryResults, common.ShouldIncludeMemStore(ctx), true, nil, nil)
 	if err != nil {
 		return err
 	}
@@ -62,12 +218,40 @@ type remoteResult struct {
 	totalRows int
 	elapsed   time.Duration
 	err       error
+	// cached indicates that the partition's results came from the cache
+	cached bool
 }
 
-func (db *DB) queryCluster(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, includeMemStore bool, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) error {
+func (db *DB) queryCluster(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, includeMemStore bool, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) (queryErr error) {
+	partitions := db.partitionsFor(sqlString)
+	ctx, span := trace.Start(ctx, "query.cluster", "sql", sqlString, "partitions", len(partitions))
+	defer func() {
+		span.Finish(queryErr)
+	}()
+
 	ctx = common.WithIncludeMemStore(ctx, includeMemStore)
-	numPartitions := db.opts.NumPartitions
-	results := make(chan *remoteResult, numPartitions*100000) // TODO: make this tunable
+	reqs := db.queryRequirementsFor(sqlString)
+	numPartitions := len(partitions)
+	if numPartitions < db.opts.NumPartitions {
+		log.Debugf("Routing query to owning partitions %v: %v", partitions, sqlString)
+	}
+	db.tunablesMx.RLock()
+	bufferSize := db.opts.ClusterQueryBufferSize
+	cacheSize := db.opts.ClusterQueryCacheSize
+	cacheTTL := db.opts.ClusterQueryCacheTTL
+	timeoutMargin := db.opts.ClusterQueryTimeoutMargin
+	db.tunablesMx.RUnlock()
+	// Each partition may have at most bufferSize rows in flight. Partitions wait
+	// for a slot in their buffer before handing off a row and the slot is freed
+	// once the row has been processed, so a slow consumer applies backpressure
+	// all the way to the followers and memory on the leader stays flat no matter
+	// how many rows the followers return.
+	buffers := make([]chan struct{}, db.opts.NumPartitions)
+	for _, i := range partitions {
+		buffers[i] = make(chan struct{}, bufferSize)
+	}
+	// Leave room for fields and final results from each partition
+	results := make(chan *remoteResult, numPartitions*(bufferSize+2))
 	resultsByPartition := make(map[int]*int64)
 	var _finalErr error
 	var finalErrMx sync.RWMutex
@@ -79,7 +263,7 @@ func (db *DB) queryCluster(ctx context.Context, sqlString string, isSubQuery boo
 	}
 	fail := func(err error) {
 		finalErrMx.Lock()
-		if _finalErr != nil {
+		if _finalErr == nil {
 			_finalErr = err
 		}
 		finalErrMx.Unlock()
@@ -92,92 +276,209 @@ func (db *DB) queryCluster(ctx context.Context, sqlString string, isSubQuery boo
 		atomic.StoreInt64(&_stopped, 1)
 	}
 
-	subCtx := ctx
+	// Cancel sub-queries once we're done so that partitions don't block trying
+	// to send results that nobody will read.
+	subCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	ctxDeadline, ctxHasDeadline := subCtx.Deadline()
 	if ctxHasDeadline {
 		// Halve timeout for sub-contexts
 		now := time.Now()
 		timeout := ctxDeadline.Sub(now)
-		var cancel context.CancelFunc
 		ctxDeadline = now.Add(timeout / 2)
 		subCtx, cancel = context.WithDeadline(subCtx, ctxDeadline)
 		defer cancel()
 	}
 
-	for i := 0; i < numPartitions; i++ {
+	// With the PARALLEL hint, only that many partitions are queried at a time.
+	// The query has already been planned, so its hints parse.
+	var slots chan struct{}
+	hints, _, hintsErr := sql.ExtractHints(sqlString)
+	if hintsErr == nil && hints.Parallel > 0 && hints.Parallel < numPartitions {
+		slots = make(chan struct{}, hints.Parallel)
+	}
+
+	// Results that exclude the memstore can be cached until the partition
+	// archives new data, unless the NO_CACHE hint says otherwise.
+	var cacheKey clusterCacheKey
+	cacheable := false
+	if db.clusterCache != nil && cacheSize > 0 && !includeMemStore && (hintsErr != nil || !hints.NoCache) {
+		cacheKey, cacheable = db.clusterCacheKeyFor(sqlString, isSubQuery, subQueryResults, unflat)
+	}
+
+	sendResult := func(result *remoteResult) bool {
+		select {
+		case results <- result:
+			return true
+		case <-subCtx.Done():
+			return false
+		}
+	}
+
+	cancels := make(map[int]context.CancelFunc, numPartitions)
+	for _, i := range partitions {
 		partition := i
 		_resultsForPartition := int64(0)
 		resultsForPartition := &_resultsForPartition
 		resultsByPartition[partition] = resultsForPartition
+		buffer := buffers[partition]
+		// Each partition gets its own context so that a straggler can be given up
+		// on without affecting the others
+		partitionCtx, cancelPartition := context.WithCancel(subCtx)
+		defer cancelPartition()
+		cancels[partition] = cancelPartition
+
+		sendRow := func(result *remoteResult) (bool, error) {
+			err := finalErr()
+			if err != nil {
+				return false, err
+			}
+			if stopped() {
+				return false, nil
+			}
+			select {
+			case buffer <- struct{}{}:
+				// got a slot in buffer
+			case <-partitionCtx.Done():
+				return false, partitionCtx.Err()
+			}
+			if !sendResult(result) {
+				return false, subCtx.Err()
+			}
+			atomic.AddInt64(resultsForPartition, 1)
+			return true, nil
+		}
+
 		go func() {
+			// Only cache results for partitions whose followers report when they
+			// archive, since there's no telling when other results change
+			partitionKey := cacheKey
+			partitionKey.partition = partition
+			archived := db.clusterCache.lastArchived(partition)
+			cachePartition := cacheable && !archived.IsZero() && !(db.opts.LocalPartition && partition == db.opts.Partition)
+			if cachePartition {
+				if entry := db.clusterCache.get(partitionKey, cacheTTL, db.clock.Now()); entry != nil {
+					elapsed := mtime.Stopwatch()
+					if entry.fields != nil {
+						sendResult(&remoteResult{
+							partition: partition,
+							fields:    entry.fields,
+						})
+					}
+					var err error
+					for _, row := range entry.rows {
+						more, sendErr := sendRow(copyResult(row))
+						if !more || sendErr != nil {
+							err = sendErr
+							break
+						}
+					}
+					sendResult(&remoteResult{
+						partition: partition,
+						totalRows: int(atomic.LoadInt64(resultsForPartition)),
+						elapsed:   elapsed(),
+						err:       err,
+						cached:    true,
+					})
+					return
+				}
+			}
+
+			if slots != nil {
+				select {
+				case slots <- struct{}{}:
+					defer func() { <-slots }()
+				case <-subCtx.Done():
+					return
+				}
+			}
 			for {
 				elapsed := mtime.Stopwatch()
-				query := db.remoteQueryHandlerForPartition(partition)
+				query := db.queryHandlerForPartition(partition, reqs)
 				if query == nil {
 					log.Errorf("No query handler for partition %d, ignoring", partition)
-					results <- &remoteResult{
+					sendResult(&remoteResult{
 						partition: partition,
 						totalRows: 0,
 						elapsed:   elapsed(),
 						err:       nil,
-					}
+					})
 					break
 				}
 
+				// Record the partition's results for the cache as long as they fit and
+				// nothing cuts them short
+				recording := cachePartition
+				var recordedFields core.Fields
+				var recorded []*remoteResult
+				sendAndRecord := func(result *remoteResult) (bool, error) {
+					if recording {
+						if len(recorded) < cacheSize {
+							recorded = append(recorded, copyResult(result))
+						} else {
+							recording = false
+							recorded = nil
+						}
+					}
+					more, err := sendRow(result)
+					if !more || err != nil {
+						recording = false
+					}
+					return more, err
+				}
+
 				var partOnRow func(key bytemap.ByteMap, vals core.Vals) (bool, error)
 				var partOnFlatRow func(row *core.FlatRow) (bool, error)
 				if unflat {
 					partOnRow = func(key bytemap.ByteMap, vals core.Vals) (bool, error) {
-						err := finalErr()
-						if err != nil {
-							return false, err
-						}
-						if stopped() {
-							return false, nil
-						}
-						results <- &remoteResult{
+						return sendAndRecord(&remoteResult{
 							partition: partition,
 							key:       key,
 							vals:      vals,
-						}
-						atomic.AddInt64(resultsForPartition, 1)
-						return true, nil
+						})
 					}
 				} else {
 					partOnFlatRow = func(row *core.FlatRow) (bool, error) {
-						err := finalErr()
-						if err != nil {
-							return false, err
-						}
-						if stopped() {
-							return false, nil
-						}
-						results <- &remoteResult{
+						return sendAndRecord(&remoteResult{
 							partition: partition,
 							flatRow:   row,
-						}
-						atomic.AddInt64(resultsForPartition, 1)
-						return true, nil
+						})
 					}
 				}
 
-				err := query(subCtx, sqlString, isSubQuery, subQueryResults, unflat, func(fields core.Fields) error {
-					results <- &remoteResult{
+				partCtx, partSpan := trace.Start(partitionCtx, "query.partition", "partition", partition)
+				err := query(partCtx, sqlString, isSubQuery, subQueryResults, unflat, func(fields core.Fields) error {
+					recordedFields = fields
+					sendResult(&remoteResult{
 						partition: partition,
 						fields:    fields,
-					}
+					})
 					return nil
 				}, partOnRow, partOnFlatRow)
-				if err != nil && atomic.LoadInt64(resultsForPartition) == 0 {
+				partSpan.SetAttribute("rows", atomic.LoadInt64(resultsForPartition))
+				partSpan.Finish(err)
+				if err != nil && atomic.LoadInt64(resultsForPartition) == 0 && partitionCtx.Err() == nil {
 					log.Debugf("Failed on partition %d, haven't read anything, continuing: %v", partition, err)
 					continue
 				}
-				results <- &remoteResult{
+				if recording && err == nil {
+					now := db.clock.Now()
+					db.clusterCache.put(&clusterCacheEntry{
+						key:       partitionKey.String(),
+						partition: partition,
+						fields:    recordedFields,
+						rows:      recorded,
+						archived:  archived,
+						stored:    now,
+						lastUsed:  now,
+					}, cacheSize)
+				}
+				sendResult(&remoteResult{
 					partition: partition,
 					totalRows: int(atomic.LoadInt64(resultsForPartition)),
 					elapsed:   elapsed(),
 					err:       err,
-				}
+				})
 				break
 			}
 		}()
@@ -190,12 +491,104 @@ func (db *DB) queryCluster(ctx context.Context, sqlString string, isSubQuery boo
 	}
 	log.Debugf("Deadline for results from partitions: %v (T - %v)", deadline, deadline.Sub(time.Now()))
 
-	timeout := time.NewTimer(deadline.Sub(time.Now()))
+	// With adaptive timeouts, partitions that take longer than their budget are
+	// given up on so that the query can return the results of the others. Since
+	// partitions queue up for their turn under the PARALLEL hint, budgets don't
+	// apply then.
+	fingerprint := latencyFingerprint(sqlString)
+	var budgets map[int]time.Duration
+	if slots == nil {
+		budgets = db.partitionBudgets(fingerprint, partitions, timeoutMargin)
+	}
+	gaveUp := make(map[int]bool)
+	nextTimeout := func(now time.Time) time.Time {
+		next := deadline
+		for partition, budget := range budgets {
+			if _, pending := resultsByPartition[partition]; pending && start.Add(budget).After(now) && start.Add(budget).Before(next) {
+				next = start.Add(budget)
+			}
+		}
+		return next
+	}
+
+	timeout := time.NewTimer(nextTimeout(start).Sub(time.Now()))
+	defer timeout.Stop()
 	var canonicalFields core.Fields
 	fieldsByPartition := make([]core.Fields, db.opts.NumPartitions)
 	partitionRowMappers := make([]func(core.Vals) core.Vals, db.opts.NumPartitions)
 	resultCount := 0
-	for pendingPartitions := numPartitions; pendingPartitions > 0; {
+	pendingPartitions := numPartitions
+
+	processRow := func(result *remoteResult) error {
+		if !stopped() && finalErr() == nil {
+			if result.key != nil {
+				more, err := onRow(result.key, partitionRowMappers[result.partition](result.vals))
+				if err != nil {
+					fail(err)
+				} else if !more {
+					stop()
+				}
+			} else {
+				flatRow := result.flatRow
+				flatRow.SetFields(fieldsByPartition[result.partition])
+				more, err := onFlatRow(flatRow)
+				if err != nil {
+					fail(err)
+					return err
+				} else if !more {
+					stop()
+				}
+			}
+		}
+		// free up slot in partition's buffer
+		<-buffers[result.partition]
+		return nil
+	}
+
+	// Rows from partitions that may still be given up on are held back until the
+	// partition finishes, so that a straggler never contributes only part of its
+	// results. Once a partition fills its buffer, the leader commits to waiting
+	// for it instead, which keeps the held rows bounded by the buffer size.
+	held := make(map[int][]*remoteResult)
+	processHeld := func(partition int) error {
+		rows := held[partition]
+		delete(held, partition)
+		for _, row := range rows {
+			err := processRow(row)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	dropHeld := func(partition int) {
+		for range held[partition] {
+			<-buffers[partition]
+		}
+		delete(held, partition)
+	}
+
+	giveUpOnStragglers := func(now time.Time) {
+		if resultCount == 0 {
+			// Never give up on all partitions, wait for at least one to report
+			return
+		}
+		for partition, budget := range budgets {
+			if _, pending := resultsByPartition[partition]; pending && !now.Before(start.Add(budget)) {
+				log.Debugf("Partition %d exceeded its budget of %v, giving up on it", partition, budget)
+				gaveUp[partition] = true
+				delete(resultsByPartition, partition)
+				dropHeld(partition)
+				cancels[partition]()
+				pendingPartitions--
+				// Record how long the straggler took so far so that its budget grows
+				// if it's consistently slower than before
+				db.recordQueryLatency(fingerprint, partition, now.Sub(start))
+			}
+		}
+	}
+
+	for pendingPartitions > 0 {
 		select {
 		case result := <-results:
 			// first handle fields
@@ -218,48 +611,72 @@ func (db *DB) queryCluster(ctx context.Context, sqlString string, isSubQuery boo
 				continue
 			}
 
-			// handle unflat rows
-			if result.key != nil {
-				if stopped() || finalErr() != nil {
+			// handle rows
+			if result.key != nil || result.flatRow != nil {
+				if gaveUp[result.partition] {
+					// free up slot in partition's buffer
+					<-buffers[result.partition]
 					continue
 				}
-				more, err := onRow(result.key, partitionRowMappers[result.partition](result.vals))
-				if err != nil {
-					fail(err)
-				} else if !more {
-					stop()
-				}
-				continue
-			}
-
-			// handle flat rows
-			flatRow := result.flatRow
-			if flatRow != nil {
-				if stopped() || finalErr() != nil {
+				if _, budgeted := budgets[result.partition]; budgeted {
+					held[result.partition] = append(held[result.partition], result)
+					if len(held[result.partition]) < bufferSize {
+						continue
+					}
+					log.Debugf("Partition %d filled its buffer, waiting for it to finish", result.partition)
+					delete(budgets, result.partition)
+					err := processHeld(result.partition)
+					if err != nil {
+						return err
+					}
 					continue
 				}
-				flatRow.SetFields(fieldsByPartition[result.partition])
-				more, err := onFlatRow(flatRow)
+				err := processRow(result)
 				if err != nil {
-					fail(err)
 					return err
-				} else if !more {
-					stop()
 				}
 				continue
 			}
 
 			// final results for partition
+			if gaveUp[result.partition] {
+				continue
+			}
 			resultCount++
 			pendingPartitions--
 			if result.err != nil {
 				log.Errorf("Error from partition %d: %v", result.partition, result.err)
+				dropHeld(result.partition)
 				fail(result.err)
+			} else {
+				err := processHeld(result.partition)
+				if err != nil {
+					return err
+				}
+			}
+			if result.cached {
+				log.Debugf("%d/%d got %d cached results for partition %d in %v", resultCount, numPartitions, result.totalRows, result.partition, result.elapsed)
+			} else {
+				log.Debugf("%d/%d got %d results from partition %d in %v", resultCount, numPartitions, result.totalRows, result.partition, result.elapsed)
+				db.recordQueryLatency(fingerprint, result.partition, result.elapsed)
 			}
-			log.Debugf("%d/%d got %d results from partition %d in %v", resultCount, db.opts.NumPartitions, result.totalRows, result.partition, result.elapsed)
 			delete(resultsByPartition, result.partition)
+			// Partitions whose budgets ran out before any partition reported can be
+			// given up on now
+			giveUpOnStragglers(time.Now())
 		case <-timeout.C:
-			fail(core.ErrDeadlineExceeded)
+			now := time.Now()
+			if now.Before(deadline) {
+				// Some partitions exceeded their budgets
+				giveUpOnStragglers(now)
+				timeout.Reset(nextTimeout(now).Sub(now))
+				continue
+			}
+			if resultCount > 0 {
+				fail(core.ErrPartialResults)
+			} else {
+				fail(core.ErrDeadlineExceeded)
+			}
 			log.Errorf("Failed to get results by deadline, %d of %d partitions reporting", resultCount, numPartitions)
 			msg := bytes.NewBuffer([]byte("Missing partitions: "))
 			first := true
@@ -268,13 +685,22 @@ func (db *DB) queryCluster(ctx context.Context, sqlString string, isSubQuery boo
 					msg.WriteString(" | ")
 				}
 				first = false
-				msg.WriteString(fmt.Sprintf("%d (%d)", partition, results))
+				msg.WriteString(fmt.Sprintf("%d (%d)", partition, atomic.LoadInt64(results)))
 			}
 			log.Debug(msg.String())
 			return finalErr()
+		case <-ctx.Done():
+			// Only reached if canceled, since the timeout fires before the deadline
+			fail(ctx.Err())
+			log.Debugf("Query canceled, %d of %d partitions reporting", resultCount, numPartitions)
+			return finalErr()
 		}
 	}
 
+	if len(gaveUp) > 0 {
+		log.Debugf("Gave up on %d of %d partitions that exceeded their budgets", len(gaveUp), numPartitions)
+		fail(core.ErrPartialResults)
+	}
 	return finalErr()
 }
 
@@ -0,0 +1,520 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/expr"
+	"github.com/getlantern/zenodb/planner"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryClusterBoundedBuffering(t *testing.T) {
+	const (
+		numPartitions = 3
+		bufferSize    = 5
+		rowsPerPart   = 200
+	)
+
+	db := &DB{
+		opts: &DBOpts{
+			NumPartitions:          numPartitions,
+			ClusterQueryBufferSize: bufferSize,
+		},
+		remoteQueryHandlers: make(map[int]chan *queryHandler),
+		queryLatencies:      make(map[int]time.Duration),
+	}
+
+	var sent, received, maxInFlight int64
+	fields := core.Fields{core.NewField("val", expr.SUM("val"))}
+	for i := 0; i < numPartitions; i++ {
+		db.RegisterQueryHandler(i, func(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) error {
+			err := onFields(fields)
+			if err != nil {
+				return err
+			}
+			for j := 0; j < rowsPerPart; j++ {
+				inFlight := atomic.AddInt64(&sent, 1) - atomic.LoadInt64(&received)
+				for {
+					max := atomic.LoadInt64(&maxInFlight)
+					if inFlight <= max || atomic.CompareAndSwapInt64(&maxInFlight, max, inFlight) {
+						break
+					}
+				}
+				more, err := onFlatRow(&core.FlatRow{
+					Key:    bytemap.New(map[string]interface{}{"dim": j}),
+					Values: []float64{1},
+				})
+				if !more || err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	var total float64
+	err := db.queryCluster(context.Background(), "SELECT * FROM table", false, nil, false, false, func(fields core.Fields) error {
+		return nil
+	}, nil, func(row *core.FlatRow) (bool, error) {
+		// Consume slowly so that partitions have to wait on their buffers
+		time.Sleep(50 * time.Microsecond)
+		total += row.Values[0]
+		atomic.AddInt64(&received, 1)
+		return true, nil
+	})
+	assert.NoError(t, err)
+	assert.EqualValues(t, numPartitions*rowsPerPart, total)
+	assert.True(t, atomic.LoadInt64(&maxInFlight) <= numPartitions*(bufferSize+1), "in-flight rows (%d) should have been bounded by buffer size", maxInFlight)
+}
+
+func TestQueryClusterStopsEarly(t *testing.T) {
+	db := &DB{
+		opts: &DBOpts{
+			NumPartitions:          2,
+			ClusterQueryBufferSize: 1,
+		},
+		remoteQueryHandlers: make(map[int]chan *queryHandler),
+		queryLatencies:      make(map[int]time.Duration),
+	}
+
+	fields := core.Fields{core.NewField("val", expr.SUM("val"))}
+	for i := 0; i < 2; i++ {
+		db.RegisterQueryHandler(i, func(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) error {
+			onFields(fields)
+			for {
+				more, err := onFlatRow(&core.FlatRow{Key: bytemap.New(nil), Values: []float64{1}})
+				if !more || err != nil {
+					return err
+				}
+			}
+		})
+	}
+
+	rows := 0
+	err := db.queryCluster(context.Background(), "SELECT * FROM table", false, nil, false, false, func(fields core.Fields) error {
+		return nil
+	}, nil, func(row *core.FlatRow) (bool, error) {
+		rows++
+		return rows < 10, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 10, rows)
+}
+
+func TestQueryClusterParallelHint(t *testing.T) {
+	const numPartitions = 4
+	db := &DB{
+		opts: &DBOpts{
+			NumPartitions:          numPartitions,
+			ClusterQueryBufferSize: 10,
+		},
+		remoteQueryHandlers: make(map[int]chan *queryHandler),
+		queryLatencies:      make(map[int]time.Duration),
+	}
+
+	var active, maxActive int64
+	fields := core.Fields{core.NewField("val", expr.SUM("val"))}
+	for i := 0; i < numPartitions; i++ {
+		db.RegisterQueryHandler(i, func(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) error {
+			current := atomic.AddInt64(&active, 1)
+			defer atomic.AddInt64(&active, -1)
+			for {
+				max := atomic.LoadInt64(&maxActive)
+				if current <= max || atomic.CompareAndSwapInt64(&maxActive, max, current) {
+					break
+				}
+			}
+			onFields(fields)
+			time.Sleep(50 * time.Millisecond)
+			_, err := onFlatRow(&core.FlatRow{Key: bytemap.New(nil), Values: []float64{1}})
+			return err
+		})
+	}
+
+	rows := 0
+	err := db.queryCluster(context.Background(), "SELECT /*+ PARALLEL(2) */ * FROM table", false, nil, false, false, func(fields core.Fields) error {
+		return nil
+	}, nil, func(row *core.FlatRow) (bool, error) {
+		rows++
+		return true, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, numPartitions, rows)
+	assert.EqualValues(t, 2, atomic.LoadInt64(&maxActive), "PARALLEL hint should have limited the number of partitions queried at once")
+}
+
+func TestQueryClusterLocalPartition(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 0, 0, time.UTC)
+	clock := NewVirtualClock(epoch)
+	clock.Freeze()
+	db, err := NewDB(&DBOpts{
+		Dir:            tmpDir,
+		Clock:          clock,
+		Passthrough:    true,
+		NumPartitions:  2,
+		Partition:      1,
+		LocalPartition: true,
+		Schema: Schema{
+			"thetable": &TableOpts{
+				RetentionPeriod: time.Hour,
+				PartitionBy:     []string{"u"},
+				SQL:             "SELECT SUM(a) AS a FROM inbound GROUP BY u, period(1m)",
+			},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	h := partitionHash()
+	local := make(map[string]float64)
+	for i := 0; i < 10; i++ {
+		u := fmt.Sprintf("user%d", i)
+		dims := map[string]interface{}{"u": u}
+		if db.inPartition(h, bytemap.New(dims), []string{"u"}, 1) {
+			local[u] = 1
+		}
+		db.Insert("inbound", epoch, dims, map[string]float64{"a": 1})
+	}
+	if !assert.NotEmpty(t, local, "some users should belong to the local partition") {
+		return
+	}
+	waitFor(func() bool { return db.TableStats("thetable").InsertedPoints == int64(len(local)) })
+	assert.EqualValues(t, len(local), db.TableStats("thetable").InsertedPoints, "only points for the local partition should be stored")
+
+	// Follower for the other partition
+	db.RegisterQueryHandler(0, func(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) error {
+		err := onFields(core.Fields{core.NewField("a", expr.SUM("a"))})
+		if err != nil {
+			return err
+		}
+		_, err = onFlatRow(&core.FlatRow{
+			TS:     epoch.UnixNano(),
+			Key:    bytemap.New(map[string]interface{}{"u": "remote"}),
+			Values: []float64{100},
+		})
+		return err
+	})
+
+	source, err := db.Query("SELECT a FROM thetable GROUP BY u", false, nil, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	expected := map[string]float64{"remote": 100}
+	for u, a := range local {
+		expected[u] = a
+	}
+	actual := make(map[string]float64)
+	err = source.Iterate(context.Background(), func(fields core.Fields) error {
+		return nil
+	}, func(row *core.FlatRow) (bool, error) {
+		actual[row.Key.Get("u").(string)] += row.Values[0]
+		return true, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, expected, actual, "query should combine local data with results from followers")
+
+	_, err = NewDB(&DBOpts{Dir: tmpDir, LocalPartition: true})
+	assert.Error(t, err, "LocalPartition should require Passthrough")
+}
+
+func TestQueryClusterRoutesByDimensionOwner(t *testing.T) {
+	owners, err := DimensionOwners{"DC": {"eu": {0, 1}, "us": {2}}}.normalized(4)
+	if !assert.NoError(t, err) {
+		return
+	}
+	db := &DB{
+		opts: &DBOpts{
+			NumPartitions:          4,
+			ClusterQueryBufferSize: 10,
+			DimensionOwners:        owners,
+		},
+		remoteQueryHandlers: make(map[int]chan *queryHandler),
+		queryLatencies:      make(map[int]time.Duration),
+	}
+
+	assert.Equal(t, []int{0, 1}, db.partitionsFor("SELECT * FROM table WHERE dc = 'eu'"))
+	assert.Equal(t, []int{0, 1, 2}, db.partitionsFor("SELECT * FROM table WHERE dc IN ('eu', 'us') AND x > 5"))
+	assert.Equal(t, []int{2}, db.partitionsFor("SELECT * FROM (SELECT * FROM table WHERE dc = 'us') GROUP BY x"))
+	assert.Equal(t, []int{0, 1, 2, 3}, db.partitionsFor("SELECT * FROM table WHERE dc = 'asia'"), "unowned values could be on any partition")
+	assert.Equal(t, []int{0, 1, 2, 3}, db.partitionsFor("SELECT * FROM table WHERE dc = 'eu' OR x = 'y'"))
+	assert.Equal(t, []int{0, 1, 2, 3}, db.partitionsFor("SELECT * FROM table WHERE dc = 'eu' AND dc = 'us'"), "contradictory filters should query everything")
+	assert.Equal(t, []int{0, 1, 2, 3}, db.partitionsFor("SELECT * FROM table"))
+
+	var queried [4]int64
+	fields := core.Fields{core.NewField("val", expr.SUM("val"))}
+	for i := 0; i < 4; i++ {
+		partition := i
+		db.RegisterQueryHandler(i, func(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) error {
+			atomic.AddInt64(&queried[partition], 1)
+			err := onFields(fields)
+			if err != nil {
+				return err
+			}
+			_, err = onFlatRow(&core.FlatRow{Key: bytemap.New(nil), Values: []float64{1}})
+			return err
+		})
+	}
+
+	var total float64
+	err = db.queryCluster(context.Background(), "SELECT * FROM table WHERE dc = 'eu'", false, nil, false, false, func(fields core.Fields) error {
+		return nil
+	}, nil, func(row *core.FlatRow) (bool, error) {
+		total += row.Values[0]
+		return true, nil
+	})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, total)
+	for i := range queried {
+		assert.Equal(t, i < 2, atomic.LoadInt64(&queried[i]) == 1, "partition %d", i)
+	}
+
+	_, err = DimensionOwners{"dc": {"eu": {4}}}.normalized(4)
+	assert.Error(t, err, "owners should be limited to known partitions")
+	_, err = DimensionOwners{"dc": {"eu": nil}}.normalized(4)
+	assert.Error(t, err, "owners should require partitions")
+}
+
+func TestQueryHandlerCapabilities(t *testing.T) {
+	db := &DB{
+		opts:                &DBOpts{NumPartitions: 1},
+		remoteQueryHandlers: make(map[int]chan *queryHandler),
+	}
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var queried []string
+	handler := func(name string) planner.QueryClusterFN {
+		return func(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) error {
+			queried = append(queried, name)
+			return nil
+		}
+	}
+	query := func(sqlString string) {
+		fn := db.queryHandlerForPartition(0, db.queryRequirementsFor(sqlString))
+		if assert.NotNil(t, fn, "should have found handler for %v", sqlString) {
+			fn(context.Background(), sqlString, false, nil, false, nil, nil, nil)
+		}
+	}
+
+	assert.Error(t, db.RegisterQueryHandlerWithCapabilities(1, nil, handler("unknown")), "handler for unknown partition should be rejected")
+	assert.NoError(t, db.RegisterQueryHandlerWithCapabilities(0, &common.QueryHandlerCapabilities{Tables: []string{"a"}}, handler("a")))
+	assert.NoError(t, db.RegisterQueryHandlerWithCapabilities(0, &common.QueryHandlerCapabilities{Tables: []string{"b"}, Since: now}, handler("b since now")))
+	assert.NoError(t, db.RegisterQueryHandlerWithCapabilities(0, &common.QueryHandlerCapabilities{Tables: []string{"b"}}, handler("b")))
+
+	query("SELECT * FROM b ASOF '2016-12-31T00:00:00Z'")
+	query("SELECT * FROM (SELECT * FROM a) GROUP BY x")
+	query("SELECT * FROM b ASOF '2017-01-02T00:00:00Z'")
+	assert.Equal(t, []string{"b", "a", "b since now"}, queried, "queries should go to handlers that are capable of answering them")
+	assert.Nil(t, db.queryHandlerForPartition(0, db.queryRequirementsFor("SELECT * FROM c")), "no handler serves c")
+	assert.Nil(t, db.queryHandlerForPartition(0, db.queryRequirementsFor("SELECT * FROM a")), "handler for a was used up")
+
+	assert.NoError(t, db.RegisterQueryHandlerWithCapabilities(0, &common.QueryHandlerCapabilities{Tables: []string{"a"}, Since: now}, handler("a since now")))
+	queried = nil
+	query("SELECT * FROM a")
+	assert.Equal(t, []string{"a since now"}, queried, "should fall back to handler that doesn't hold all data")
+}
+
+func TestQueryClusterCache(t *testing.T) {
+	db := &DB{
+		opts: &DBOpts{
+			NumPartitions:          2,
+			ClusterQueryBufferSize: 10,
+			ClusterQueryCacheSize:  100,
+			ClusterQueryCacheTTL:   time.Hour,
+		},
+		clock:               NewVirtualClock(time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)),
+		remoteQueryHandlers: make(map[int]chan *queryHandler),
+		queryLatencies:      make(map[int]time.Duration),
+		clusterCache:        newClusterCache(),
+	}
+	archived := time.Date(2016, 12, 31, 0, 0, 0, 0, time.UTC)
+
+	fields := core.Fields{core.NewField("val", expr.SUM("val"))}
+	values := []float64{1, 10}
+	var queried [2]int64
+	register := func(partition int, archived time.Time) {
+		db.RegisterQueryHandlerWithCapabilities(partition, &common.QueryHandlerCapabilities{Archived: archived}, func(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) error {
+			atomic.AddInt64(&queried[partition], 1)
+			err := onFields(fields)
+			if err != nil {
+				return err
+			}
+			_, err = onFlatRow(&core.FlatRow{
+				Key:    bytemap.New(map[string]interface{}{"partition": partition}),
+				Values: []float64{values[partition]},
+			})
+			return err
+		})
+	}
+	query := func(sqlString string, includeMemStore bool) float64 {
+		var total float64
+		err := db.queryCluster(context.Background(), sqlString, false, nil, includeMemStore, false, func(fields core.Fields) error {
+			return nil
+		}, nil, func(row *core.FlatRow) (bool, error) {
+			total += row.Values[0]
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return total
+	}
+	sqlString := "SELECT * FROM table GROUP BY period(1m) ASOF '-1h'"
+
+	register(0, archived)
+	register(1, archived)
+	assert.EqualValues(t, 11, query(sqlString, false))
+	assert.EqualValues(t, 11, query(sqlString, false), "second query should have been answered from cache")
+	assert.EqualValues(t, [2]int64{1, 1}, queried)
+
+	values[0], values[1] = 2, 20
+	register(1, archived.Add(time.Minute))
+	assert.EqualValues(t, 21, query(sqlString, false), "only partition that archived since should have been queried again")
+	assert.EqualValues(t, [2]int64{1, 2}, queried)
+
+	register(0, archived)
+	register(1, archived.Add(time.Minute))
+	assert.EqualValues(t, 22, query(sqlString, true), "queries that include the memstore shouldn't be cached")
+	assert.EqualValues(t, [2]int64{2, 3}, queried)
+
+	register(0, archived)
+	register(1, archived.Add(time.Minute))
+	assert.EqualValues(t, 22, query("SELECT /*+ NO_CACHE */ * FROM table GROUP BY period(1m) ASOF '-1h'", false), "NO_CACHE hint should bypass cache")
+	assert.EqualValues(t, [2]int64{3, 4}, queried)
+
+	register(0, archived)
+	register(1, archived.Add(time.Minute))
+	db.clock.(*VirtualClock).Advance(db.clock.Now().Add(time.Minute))
+	assert.EqualValues(t, 22, query(sqlString, false), "relative time range moved on, so query should have missed cache")
+	assert.EqualValues(t, [2]int64{4, 5}, queried)
+
+	// Handlers that registered before their follower archived report the new
+	// archive time with their pongs
+	register(0, archived)
+	register(1, archived.Add(time.Minute))
+	assert.EqualValues(t, 22, query(sqlString, false))
+	assert.EqualValues(t, [2]int64{4, 5}, queried, "query should have been answered from cache")
+	values[0] = 3
+	db.PartitionArchived(0, archived.Add(2*time.Minute))
+	assert.EqualValues(t, 23, query(sqlString, false), "partition that archived while its handlers were idle should have been queried again")
+	assert.EqualValues(t, [2]int64{5, 5}, queried)
+
+	hits, misses := db.clusterCache.stats()
+	assert.EqualValues(t, 6, hits)
+	assert.EqualValues(t, 6, misses)
+}
+
+func TestQueryClusterAdaptiveTimeout(t *testing.T) {
+	db := &DB{
+		opts: &DBOpts{
+			NumPartitions:             2,
+			ClusterQueryBufferSize:    10,
+			ClusterQueryTimeoutMargin: 50 * time.Millisecond,
+		},
+		remoteQueryHandlers: make(map[int]chan *queryHandler),
+		queryLatencies:      make(map[int]time.Duration),
+	}
+	sqlString := "SELECT * FROM table"
+	assert.Empty(t, db.partitionBudgets(sqlString, []int{0, 1}, 50*time.Millisecond), "partitions without latencies should get no budget")
+	for i := 0; i < minLatencySamples; i++ {
+		db.recordQueryLatency(sqlString, 0, 10*time.Millisecond)
+		db.recordQueryLatency(sqlString, 1, 10*time.Millisecond)
+	}
+	assert.Equal(t, map[int]time.Duration{0: 60 * time.Millisecond, 1: 60 * time.Millisecond}, db.partitionBudgets("SELECT  *\nFROM table", []int{0, 1}, 50*time.Millisecond), "queries that only differ in whitespace should share budgets")
+	assert.Empty(t, db.partitionBudgets("SELECT * FROM table GROUP BY _", []int{0, 1}, 50*time.Millisecond), "other queries shouldn't get the budget of a cheap query")
+
+	fields := core.Fields{core.NewField("val", expr.SUM("val"))}
+	// How long each partition takes to answer, and whether it sends a row before
+	// stalling
+	var delays [2]time.Duration
+	var rowBeforeDelay [2]bool
+	for i := 0; i < 2; i++ {
+		partition := i
+		db.RegisterQueryHandler(partition, func(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) error {
+			err := onFields(fields)
+			if err != nil {
+				return err
+			}
+			sendRow := func() error {
+				_, err := onFlatRow(&core.FlatRow{
+					Key:    bytemap.New(map[string]interface{}{"partition": partition}),
+					Values: []float64{float64(partition + 1)},
+				})
+				return err
+			}
+			if rowBeforeDelay[partition] {
+				err = sendRow()
+				if err != nil {
+					return err
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delays[partition]):
+			}
+			if rowBeforeDelay[partition] {
+				return nil
+			}
+			return sendRow()
+		})
+	}
+
+	query := func() (float64, error) {
+		var total float64
+		err := db.queryCluster(context.Background(), sqlString, false, nil, false, false, func(fields core.Fields) error {
+			return nil
+		}, nil, func(row *core.FlatRow) (bool, error) {
+			total += row.Values[0]
+			return true, nil
+		})
+		return total, err
+	}
+
+	delays = [2]time.Duration{0, 5 * time.Second}
+	start := time.Now()
+	total, err := query()
+	assert.Equal(t, core.ErrPartialResults, err)
+	assert.EqualValues(t, 1, total, "should have gotten results from partition that answered in time")
+	assert.True(t, time.Since(start) < 2*time.Second, "should have given up on straggler once it exceeded its budget")
+	assert.True(t, db.queryLatencyP99(1) >= 60*time.Millisecond, "straggler's latency should have been recorded")
+
+	rowBeforeDelay = [2]bool{false, true}
+	total, err = query()
+	assert.Equal(t, core.ErrPartialResults, err)
+	assert.EqualValues(t, 1, total, "rows that the straggler sent before it was given up on should have been left out")
+
+	rowBeforeDelay = [2]bool{false, false}
+	delays = [2]time.Duration{500 * time.Millisecond, 5 * time.Second}
+	start = time.Now()
+	total, err = query()
+	assert.Equal(t, core.ErrPartialResults, err)
+	assert.EqualValues(t, 1, total, "should have waited for the first partition even though it exceeded its budget")
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 500*time.Millisecond && elapsed < 2*time.Second, "should have given up on straggler once the first partition reported, not %v", elapsed)
+}
+
+func TestLatencyHistory(t *testing.T) {
+	h := &latencyHistory{}
+	assert.EqualValues(t, 0, h.percentile(0.99))
+	for i := 1; i <= latencyHistorySize+50; i++ {
+		h.record(time.Duration(i) * time.Millisecond)
+	}
+	assert.Len(t, h.latencies, latencyHistorySize, "history should only keep most recent latencies")
+	assert.Equal(t, 149*time.Millisecond, h.percentile(0.99))
+	assert.Equal(t, 100*time.Millisecond, h.percentile(0.5))
+}
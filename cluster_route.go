@@ -0,0 +1,143 @@
+package zenodb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/getlantern/yaml"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/sql"
+)
+
+// DimensionOwners records which partitions exclusively own specific values of
+// specific dims, keyed by dim and then by value. For example, in a cluster
+// where each data center feeds its own followers, dc: {eu: [0, 1], us: [2, 3]}
+// says that only partitions 0 and 1 hold data for dc = 'eu'. Queries filtered
+// on owned values are only sent to the owning partitions.
+type DimensionOwners map[string]map[string][]int
+
+// LoadDimensionOwners loads DimensionOwners from the YAML file at the given
+// path.
+func LoadDimensionOwners(filename string) (DimensionOwners, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read dimension owners from %v: %v", filename, err)
+	}
+	owners := make(DimensionOwners)
+	err = yaml.Unmarshal(b, &owners)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse dimension owners from %v: %v", filename, err)
+	}
+	return owners, nil
+}
+
+// normalized validates the owners against the number of partitions and
+// returns a copy with lowercase dim names.
+func (owners DimensionOwners) normalized(numPartitions int) (DimensionOwners, error) {
+	result := make(DimensionOwners, len(owners))
+	for dim, values := range owners {
+		normalizedValues := make(map[string][]int, len(values))
+		for value, partitions := range values {
+			if len(partitions) == 0 {
+				return nil, fmt.Errorf("No partitions specified as owners of %v = %v", dim, value)
+			}
+			for _, partition := range partitions {
+				if partition < 0 || partition >= numPartitions {
+					return nil, fmt.Errorf("Invalid partition %d for owner of %v = %v, must be between 0 and %d", partition, dim, value, numPartitions-1)
+				}
+			}
+			normalizedValues[value] = partitions
+		}
+		result[strings.ToLower(dim)] = normalizedValues
+	}
+	return result, nil
+}
+
+// partitionsFor returns the partitions that need to be queried to answer the
+// given query. Unless the query is filtered on owned dimension values, that's
+// all partitions.
+func (db *DB) partitionsFor(sqlString string) []int {
+	all := make([]int, 0, db.opts.NumPartitions)
+	for i := 0; i < db.opts.NumPartitions; i++ {
+		all = append(all, i)
+	}
+	if len(db.opts.DimensionOwners) == 0 {
+		return all
+	}
+
+	query, err := sql.Parse(sqlString)
+	if err != nil {
+		// Let the partitions report the error
+		return all
+	}
+
+	var allowed map[int]bool
+	for current := query; current != nil; current = current.FromSubQuery {
+		for dim, values := range current.PinnedDims {
+			owners := db.opts.DimensionOwners[dim]
+			if owners == nil {
+				continue
+			}
+			partitions := make(map[int]bool)
+			allOwned := true
+			for _, value := range values {
+				owned, found := owners[value]
+				if !found {
+					// Data for unowned values can be on any partition
+					allOwned = false
+					break
+				}
+				for _, partition := range owned {
+					partitions[partition] = true
+				}
+			}
+			if !allOwned {
+				continue
+			}
+			if allowed == nil {
+				allowed = partitions
+				continue
+			}
+			for partition := range allowed {
+				if !partitions[partition] {
+					delete(allowed, partition)
+				}
+			}
+		}
+	}
+
+	if len(allowed) == 0 {
+		// Either the query isn't restricted to owned values, or the restrictions
+		// contradict each other. Either way, query everything.
+		return all
+	}
+	result := make([]int, 0, len(allowed))
+	for partition := range allowed {
+		result = append(result, partition)
+	}
+	sort.Ints(result)
+	return result
+}
+
+// dimensionOwners lists the DimensionOwners for reporting in the
+// ClusterStatus, ordered by dim and value.
+func (db *DB) dimensionOwners() []*common.DimensionOwner {
+	var result []*common.DimensionOwner
+	for dim, values := range db.opts.DimensionOwners {
+		for value, partitions := range values {
+			sorted := append([]int{}, partitions...)
+			sort.Ints(sorted)
+			result = append(result, &common.DimensionOwner{Dim: dim, Value: value, Partitions: sorted})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Dim != b.Dim {
+			return a.Dim < b.Dim
+		}
+		return a.Value < b.Value
+	})
+	return result
+}
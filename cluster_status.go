@@ -0,0 +1,166 @@
+package zenodb
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+// ClusterStatus returns the status of all followers currently following this
+// node.
+func (db *DB) ClusterStatus() *common.ClusterStatus {
+	status := &common.ClusterStatus{
+		Version:       Version,
+		NumPartitions: db.opts.NumPartitions,
+		Owners:        db.dimensionOwners(),
+	}
+	status.CacheHits, status.CacheMisses = db.clusterCache.stats()
+
+	db.clusterStatusMx.RLock()
+	followers := make([]*follower, 0, len(db.activeFollowers))
+	for _, f := range db.activeFollowers {
+		followers = append(followers, f)
+	}
+	queryLatencies := make(map[int]time.Duration, len(db.queryLatencies))
+	for partition, latency := range db.queryLatencies {
+		queryLatencies[partition] = latency
+	}
+	queryLatencyP99s := make(map[int]time.Duration, len(db.latencyHistories))
+	for partition, history := range db.latencyHistories {
+		queryLatencyP99s[partition] = history.percentile(0.99)
+	}
+	for _, gap := range db.followGaps {
+		status.Gaps = append(status.Gaps, gap)
+	}
+	status.ResyncsRequired = db.resyncsRequired
+	status.PlacementRejections = db.placementRejections
+	db.clusterStatusMx.RUnlock()
+
+	latestByStream := make(map[string]time.Time)
+	for _, f := range followers {
+		latest, found := latestByStream[f.Stream]
+		if !found {
+			latest = db.latestWALTime(f.Stream)
+			latestByStream[f.Stream] = latest
+		}
+
+		f.statusMx.RLock()
+		offset, lastTS := f.lastOffset, f.lastTS
+		f.statusMx.RUnlock()
+
+		fs := &common.FollowerStatus{
+			ID:               f.id,
+			Addr:             f.Addr,
+			Partition:        f.PartitionNumber,
+			Stream:           f.Stream,
+			Version:          f.Version,
+			Joined:           f.joined,
+			Offset:           offset,
+			Queued:           len(f.entries),
+			Failed:           f.failed(),
+			LastQueryLatency: queryLatencies[f.PartitionNumber],
+			QueryLatencyP99:  queryLatencyP99s[f.PartitionNumber],
+			Labels:           f.Labels,
+		}
+		if fs.Queued > 0 && !lastTS.IsZero() && latest.After(lastTS) {
+			fs.Lag = latest.Sub(lastTS)
+		}
+		status.Followers = append(status.Followers, fs)
+	}
+
+	sort.Slice(status.Followers, func(i, j int) bool {
+		a, b := status.Followers[i], status.Followers[j]
+		if a.Partition != b.Partition {
+			return a.Partition < b.Partition
+		}
+		return a.ID < b.ID
+	})
+	sort.Slice(status.Gaps, func(i, j int) bool {
+		return status.Gaps[i].Partition < status.Gaps[j].Partition
+	})
+	return status
+}
+
+func (db *DB) addFollower(f *follower) {
+	db.clusterStatusMx.Lock()
+	db.activeFollowers[f.id] = f
+	db.clusterStatusMx.Unlock()
+}
+
+func (db *DB) removeFollower(f *follower) {
+	db.clusterStatusMx.Lock()
+	delete(db.activeFollowers, f.id)
+	db.clusterStatusMx.Unlock()
+}
+
+func (db *DB) recordGap(err *ResyncRequiredError) {
+	db.clusterStatusMx.Lock()
+	db.followGaps[gapKey(err.Stream, err.Partition)] = &common.FollowGap{
+		Partition: err.Partition,
+		Stream:    err.Stream,
+		Requested: err.Requested,
+		Oldest:    err.Oldest,
+		Time:      time.Now(),
+	}
+	db.resyncsRequired++
+	db.clusterStatusMx.Unlock()
+}
+
+func (db *DB) clearGap(stream string, partition int) {
+	db.clusterStatusMx.Lock()
+	delete(db.followGaps, gapKey(stream, partition))
+	db.clusterStatusMx.Unlock()
+}
+
+func gapKey(stream string, partition int) string {
+	return fmt.Sprintf("%v|%d", stream, partition)
+}
+
+func (db *DB) recordQueryLatency(fingerprint string, partition int, latency time.Duration) {
+	db.clusterStatusMx.Lock()
+	db.recordFingerprintLatency(fingerprint, partition, latency)
+	db.queryLatencies[partition] = latency
+	if db.latencyHistories == nil {
+		db.latencyHistories = make(map[int]*latencyHistory)
+	}
+	history := db.latencyHistories[partition]
+	if history == nil {
+		history = &latencyHistory{}
+		db.latencyHistories[partition] = history
+	}
+	history.record(latency)
+	db.clusterStatusMx.Unlock()
+}
+
+func (db *DB) walDir(stream string) string {
+	return filepath.Join(db.opts.Dir, "_wal", stream)
+}
+
+// latestWALTime returns the timestamp of the most recent entry in the given
+// stream's WAL.
+func (db *DB) latestWALTime(stream string) time.Time {
+	db.tablesMutex.RLock()
+	w := db.streams[stream]
+	db.tablesMutex.RUnlock()
+	if w == nil {
+		return time.Time{}
+	}
+	data, _, err := w.Latest()
+	if err != nil {
+		log.Errorf("Unable to get latest entry for stream %v: %v", stream, err)
+		return time.Time{}
+	}
+	return entryTime(data)
+}
+
+// entryTime extracts the timestamp from a WAL entry.
+func entryTime(data []byte) time.Time {
+	if len(data) < encoding.Width64bits {
+		return time.Time{}
+	}
+	return encoding.TimeFromBytes(data)
+}
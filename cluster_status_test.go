@@ -0,0 +1,189 @@
+package zenodb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/wal"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClusterStatus(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	w, err := wal.Open(tmpDir, 0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer w.Close()
+
+	epoch := time.Date(2017, 5, 1, 10, 0, 0, 0, time.UTC)
+	entry := func(ts time.Time) []byte {
+		data := make([]byte, encoding.Width64bits)
+		encoding.EncodeTime(data, ts)
+		return data
+	}
+	_, err = w.Write(entry(epoch.Add(1 * time.Minute)))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	db := &DB{
+		opts:            &DBOpts{NumPartitions: 2},
+		streams:         map[string]*wal.WAL{"thestream": w},
+		activeFollowers: make(map[int]*follower),
+		queryLatencies:  make(map[int]time.Duration),
+	}
+
+	behind := &follower{
+		Follow:     common.Follow{Stream: "thestream", PartitionNumber: 1, Version: "1.0", Addr: "10.0.0.2:5000"},
+		id:         2,
+		entries:    make(chan *walEntry, 10),
+		lastOffset: wal.NewOffsetForTS(epoch),
+		lastTS:     epoch,
+	}
+	behind.entries <- &walEntry{}
+	caughtUp := &follower{
+		Follow:  common.Follow{Stream: "thestream", PartitionNumber: 0, Version: "1.0"},
+		id:      1,
+		entries: make(chan *walEntry, 10),
+		lastTS:  epoch,
+	}
+	caughtUp.markFailed()
+	db.addFollower(behind)
+	db.addFollower(caughtUp)
+	db.recordQueryLatency("SELECT * FROM table", 1, 5*time.Second)
+
+	status := db.ClusterStatus()
+	assert.Equal(t, Version, status.Version)
+	assert.Equal(t, 2, status.NumPartitions)
+	if !assert.Len(t, status.Followers, 2) {
+		return
+	}
+
+	f := status.Followers[0]
+	assert.Equal(t, 1, f.ID)
+	assert.Equal(t, 0, f.Partition)
+	assert.EqualValues(t, 0, f.Lag, "Follower with nothing queued shouldn't lag")
+	assert.True(t, f.Failed)
+
+	f = status.Followers[1]
+	assert.Equal(t, 2, f.ID)
+	assert.Equal(t, 1, f.Partition)
+	assert.Equal(t, "10.0.0.2:5000", f.Addr)
+	assert.Equal(t, "1.0", f.Version)
+	assert.Equal(t, 1, f.Queued)
+	assert.Equal(t, 1*time.Minute, f.Lag)
+	assert.Equal(t, 5*time.Second, f.LastQueryLatency)
+	assert.False(t, f.Failed)
+
+	db.removeFollower(caughtUp)
+	assert.Len(t, db.ClusterStatus().Followers, 1)
+}
+
+func TestFollowGap(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db := &DB{
+		opts:            &DBOpts{Dir: tmpDir, NumPartitions: 2},
+		activeFollowers: make(map[int]*follower),
+		queryLatencies:  make(map[int]time.Duration),
+		followGaps:      make(map[string]*common.FollowGap),
+	}
+	walDir := db.walDir("thestream")
+	if !assert.NoError(t, os.MkdirAll(walDir, 0755)) {
+		return
+	}
+	w, err := wal.Open(walDir, 0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer w.Close()
+
+	follow := func(offset wal.Offset) *common.Follow {
+		return &common.Follow{
+			Stream:          "thestream",
+			PartitionNumber: 1,
+			Partitions: map[string]*common.Partition{
+				"": &common.Partition{Tables: []*common.PartitionTable{&common.PartitionTable{Name: "thetable", Offset: offset}}},
+			},
+		}
+	}
+
+	now := time.Now()
+	assert.Nil(t, db.checkForGap(follow(nil)), "New table shouldn't have gap")
+	assert.Nil(t, db.checkForGap(follow(wal.NewOffsetForTS(now.Add(1*time.Hour)))), "Recent offset shouldn't have gap")
+
+	old := wal.NewOffsetForTS(now.Add(-1 * time.Hour))
+	err = db.Follow(follow(old), nil)
+	if assert.IsType(t, &ResyncRequiredError{}, err) {
+		gapErr := err.(*ResyncRequiredError)
+		assert.Equal(t, 1, gapErr.Partition)
+		assert.Equal(t, old, gapErr.Requested)
+		assert.True(t, gapErr.Oldest.After(old))
+	}
+
+	status := db.ClusterStatus()
+	assert.EqualValues(t, 1, status.ResyncsRequired)
+	if assert.Len(t, status.Gaps, 1) {
+		assert.Equal(t, "thestream", status.Gaps[0].Stream)
+		assert.Equal(t, 1, status.Gaps[0].Partition)
+	}
+
+	db.clearGap("thestream", 1)
+	status = db.ClusterStatus()
+	assert.Empty(t, status.Gaps)
+	assert.EqualValues(t, 1, status.ResyncsRequired)
+}
+
+func TestWALSegmentOffset(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	start := time.Now()
+	w, err := wal.Open(tmpDir, 0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer w.Close()
+	_, err = w.Write([]byte("data"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, latest, err := w.Latest()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// If this fails, the wal package has changed how it names segments and
+	// walSegmentOffset needs to be updated
+	files, err := ioutil.ReadDir(tmpDir)
+	if !assert.NoError(t, err) || !assert.NotEmpty(t, files) {
+		return
+	}
+	for _, file := range files {
+		offset := walSegmentOffset(file.Name())
+		if assert.NotNil(t, offset, "Unable to parse segment name %v", file.Name()) {
+			assert.False(t, offset.After(latest), "Segment %v should start before its latest entry", file.Name())
+			assert.False(t, wal.NewOffsetForTS(start.Add(-1*time.Minute)).After(offset), "Segment %v should start around when the WAL was opened", file.Name())
+		}
+	}
+
+	assert.Nil(t, walSegmentOffset("notasegment"))
+	assert.Equal(t, wal.NewOffsetForTS(time.Unix(0, 5*int64(time.Microsecond))), walSegmentOffset("00000000000000000005.snappy"))
+}
@@ -0,0 +1,133 @@
+package zenodb
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// latencyHistorySize is how many of the most recent query latencies to keep
+	// for each partition
+	latencyHistorySize = 100
+	// minLatencySamples is how many latencies a partition needs to have recorded
+	// before its queries get an adaptive timeout
+	minLatencySamples = 10
+	// maxLatencyFingerprints is how many distinct queries to keep latencies for.
+	// Beyond that, the queries whose latencies were recorded longest ago are
+	// forgotten.
+	maxLatencyFingerprints = 1000
+)
+
+// latencyHistory is a ring buffer of a partition's most recent query
+// latencies.
+type latencyHistory struct {
+	latencies []time.Duration
+	next      int
+}
+
+func (h *latencyHistory) record(latency time.Duration) {
+	if len(h.latencies) < latencyHistorySize {
+		h.latencies = append(h.latencies, latency)
+		return
+	}
+	h.latencies[h.next] = latency
+	h.next = (h.next + 1) % latencyHistorySize
+}
+
+// percentile returns the given percentile (between 0 and 1) of the recorded
+// latencies, or 0 if none have been recorded.
+func (h *latencyHistory) percentile(p float64) time.Duration {
+	if h == nil || len(h.latencies) == 0 {
+		return 0
+	}
+	sorted := make([]time.Duration, len(h.latencies))
+	copy(sorted, h.latencies)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	idx := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx]
+}
+
+// queryLatencies are the recent latencies of one query, by partition.
+type queryLatencies struct {
+	byPartition  map[int]*latencyHistory
+	lastRecorded time.Time
+}
+
+// latencyFingerprint identifies queries that are expected to cost about the
+// same, which are those with the same SQL up to whitespace.
+func latencyFingerprint(sqlString string) string {
+	return strings.Join(strings.Fields(sqlString), " ")
+}
+
+// recordFingerprintLatency records the latency of the given query on the given
+// partition. db.clusterStatusMx must be locked.
+func (db *DB) recordFingerprintLatency(fingerprint string, partition int, latency time.Duration) {
+	if db.fingerprintLatencies == nil {
+		db.fingerprintLatencies = make(map[string]*queryLatencies)
+	}
+	latencies := db.fingerprintLatencies[fingerprint]
+	if latencies == nil {
+		if len(db.fingerprintLatencies) >= maxLatencyFingerprints {
+			var oldest string
+			var oldestRecorded time.Time
+			for fp, l := range db.fingerprintLatencies {
+				if oldest == "" || l.lastRecorded.Before(oldestRecorded) {
+					oldest, oldestRecorded = fp, l.lastRecorded
+				}
+			}
+			delete(db.fingerprintLatencies, oldest)
+		}
+		latencies = &queryLatencies{byPartition: make(map[int]*latencyHistory)}
+		db.fingerprintLatencies[fingerprint] = latencies
+	}
+	latencies.lastRecorded = time.Now()
+	history := latencies.byPartition[partition]
+	if history == nil {
+		history = &latencyHistory{}
+		latencies.byPartition[partition] = history
+	}
+	history.record(latency)
+}
+
+// queryLatencyP99 returns the 99th percentile of the given partition's recent
+// query latencies, or 0 if none have been recorded.
+func (db *DB) queryLatencyP99(partition int) time.Duration {
+	db.clusterStatusMx.RLock()
+	defer db.clusterStatusMx.RUnlock()
+	return db.latencyHistories[partition].percentile(0.99)
+}
+
+// partitionBudgets determines how long each of the given partitions may take
+// to return the results of the query with the given fingerprint, which is the
+// 99th percentile of the partition's recent latencies for that query plus the
+// given margin. Budgets are per query so that expensive queries aren't held to
+// the latencies of cheap ones. Partitions that haven't answered the query
+// often enough yet get no budget of their own and can take until the query's
+// deadline.
+func (db *DB) partitionBudgets(fingerprint string, partitions []int, margin time.Duration) map[int]time.Duration {
+	budgets := make(map[int]time.Duration, len(partitions))
+	if margin <= 0 {
+		return budgets
+	}
+	db.clusterStatusMx.RLock()
+	defer db.clusterStatusMx.RUnlock()
+	latencies := db.fingerprintLatencies[fingerprint]
+	if latencies == nil {
+		return budgets
+	}
+	for _, partition := range partitions {
+		history := latencies.byPartition[partition]
+		if history == nil || len(history.latencies) < minLatencySamples {
+			continue
+		}
+		budgets[partition] = history.percentile(0.99) + margin
+	}
+	return budgets
+}
@@ -0,0 +1,237 @@
+package zenodb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/golang/snappy"
+)
+
+const (
+	// columnarBlockSize is the maximum number of keys in a columnar block
+	columnarBlockSize = 1024
+)
+
+// Files with layoutColumnar store data in blocks of up to columnarBlockSize
+// keys. Each block holds a key index followed by the data for each column,
+// with the Sequences for all of the block's keys packed together and
+// compressed as a unit. This allows scans to skip decompressing and decoding
+// columns that they don't need and gives the compression similar data to work
+// with. Blocks look like:
+//
+//   block length (64 bits, including itself)
+//   number of keys (uvarint)
+//   for each key: key length (uvarint) and key
+//   number of columns (uvarint)
+//   for each column: compressed length (uvarint)
+//   for each column: snappy compressed Sequences for each key, each one
+//     prefixed with its length as a uvarint (0 for empty Sequences)
+
+// columnarWriter writes rows into columnar blocks.
+type columnarWriter struct {
+	out     io.Writer
+	numKeys int
+	keys    []byte
+	columns [][]byte
+	lenBuf  []byte
+}
+
+func newColumnarWriter(out io.Writer, numColumns int) *columnarWriter {
+	return &columnarWriter{
+		out:     out,
+		columns: make([][]byte, numColumns),
+		lenBuf:  make([]byte, encoding.MaxVarintLen64),
+	}
+}
+
+// add adds a row to the current block, writing the block once it's full. The
+// data is copied, so key and columns can be reused after add returns.
+func (w *columnarWriter) add(key bytemap.ByteMap, columns []encoding.Sequence) error {
+	w.keys = w.appendUvarint(w.keys, uint64(len(key)))
+	w.keys = append(w.keys, key...)
+	for i := range w.columns {
+		var seq encoding.Sequence
+		if i < len(columns) {
+			seq = columns[i]
+		}
+		w.columns[i] = w.appendUvarint(w.columns[i], uint64(len(seq)))
+		w.columns[i] = append(w.columns[i], seq...)
+	}
+	w.numKeys++
+	if w.numKeys >= columnarBlockSize {
+		return w.flush()
+	}
+	return nil
+}
+
+func (w *columnarWriter) appendUvarint(b []byte, x uint64) []byte {
+	n := binary.PutUvarint(w.lenBuf, x)
+	return append(b, w.lenBuf[:n]...)
+}
+
+// flush writes the current block, if it contains any keys.
+func (w *columnarWriter) flush() error {
+	if w.numKeys == 0 {
+		return nil
+	}
+	compressed := make([][]byte, len(w.columns))
+	for i, column := range w.columns {
+		compressed[i] = snappy.Encode(nil, column)
+	}
+
+	block := make([]byte, encoding.Width64bits, encoding.Width64bits+len(w.keys))
+	block = w.appendUvarint(block, uint64(w.numKeys))
+	block = append(block, w.keys...)
+	block = w.appendUvarint(block, uint64(len(compressed)))
+	for _, column := range compressed {
+		block = w.appendUvarint(block, uint64(len(column)))
+	}
+	for _, column := range compressed {
+		block = append(block, column...)
+	}
+	encoding.Binary.PutUint64(block, uint64(len(block)))
+	_, err := w.out.Write(block)
+	if err != nil {
+		return fmt.Errorf("Unable to write columnar block: %v", err)
+	}
+
+	w.numKeys = 0
+	w.keys = w.keys[:0]
+	for i := range w.columns {
+		w.columns[i] = w.columns[i][:0]
+	}
+	return nil
+}
+
+// iterateColumnar reads columnar blocks from r and passes their rows to
+// onFileRow. Columns for which needed is false are left empty without being
+// decompressed.
+func iterateColumnar(r io.Reader, needed []bool, onFileRow func(key bytemap.ByteMap, raw []byte, fileColumns func() ([]encoding.Sequence, error)) (bool, error)) error {
+	for {
+		blockLength := uint64(0)
+		err := binary.Read(r, encoding.Binary, &blockLength)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Unexpected error reading block length: %v", err)
+		}
+		if blockLength < encoding.Width64bits {
+			return fmt.Errorf("Invalid block length %d", blockLength)
+		}
+		block := make([]byte, blockLength-encoding.Width64bits)
+		_, err = io.ReadFull(r, block)
+		if err != nil {
+			return fmt.Errorf("Unexpected error reading block: %v", err)
+		}
+
+		keys, columns, err := decodeColumnarBlock(block, needed)
+		if err != nil {
+			return err
+		}
+		for k, key := range keys {
+			rowColumns := make([]encoding.Sequence, len(columns))
+			for i, column := range columns {
+				if column != nil {
+					rowColumns[i] = column[k]
+				}
+			}
+			more, err := onFileRow(key, nil, func() ([]encoding.Sequence, error) {
+				return rowColumns, nil
+			})
+			if !more || err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// decodeColumnarBlock decodes the keys in the given block (without its leading
+// length) and the Sequences of the needed columns. Columns that aren't needed
+// are nil.
+func decodeColumnarBlock(block []byte, needed []bool) ([]bytemap.ByteMap, [][]encoding.Sequence, error) {
+	numKeys, block, err := encoding.ReadUvarintChecked(block)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to decode number of keys: %v", err)
+	}
+	// every key takes up at least one byte for its length
+	if numKeys > uint64(len(block)) {
+		return nil, nil, fmt.Errorf("Not enough data left to decode %d keys", numKeys)
+	}
+	keys := make([]bytemap.ByteMap, 0, numKeys)
+	for i := uint64(0); i < numKeys; i++ {
+		var keyLength uint64
+		keyLength, block, err = encoding.ReadUvarintChecked(block)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to decode key length: %v", err)
+		}
+		var key bytemap.ByteMap
+		key, block, err = encoding.ReadByteMapChecked(block, int(keyLength))
+		if err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	numColumns, block, err := encoding.ReadUvarintChecked(block)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to decode number of columns: %v", err)
+	}
+	if numColumns > uint64(len(block)) {
+		return nil, nil, fmt.Errorf("Not enough data left to decode %d column lengths", numColumns)
+	}
+	compressedLengths := make([]int, 0, numColumns)
+	for i := uint64(0); i < numColumns; i++ {
+		var compressedLength uint64
+		compressedLength, block, err = encoding.ReadUvarintChecked(block)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to decode column length: %v", err)
+		}
+		compressedLengths = append(compressedLengths, int(compressedLength))
+	}
+
+	columns := make([][]encoding.Sequence, numColumns)
+	for i, compressedLength := range compressedLengths {
+		var compressed []byte
+		compressed, block, err = encoding.ReadChecked(block, compressedLength)
+		if err != nil {
+			return nil, nil, err
+		}
+		if i >= len(needed) || !needed[i] {
+			continue
+		}
+		columns[i], err = decodeColumnarColumn(compressed, len(keys))
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to decode column %d: %v", i, err)
+		}
+	}
+	return keys, columns, nil
+}
+
+// decodeColumnarColumn decompresses a column and splits it into the Sequences
+// for each key.
+func decodeColumnarColumn(compressed []byte, numKeys int) ([]encoding.Sequence, error) {
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, err
+	}
+	column := make([]encoding.Sequence, numKeys)
+	for k := 0; k < numKeys; k++ {
+		var seqLength uint64
+		seqLength, data, err = encoding.ReadUvarintChecked(data)
+		if err != nil {
+			return nil, err
+		}
+		if seqLength == 0 {
+			continue
+		}
+		column[k], data, err = encoding.ReadSequenceChecked(data, int(seqLength))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return column, nil
+}
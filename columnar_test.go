@@ -0,0 +1,173 @@
+package zenodb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+	. "github.com/getlantern/zenodb/expr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestColumnarBlocks(t *testing.T) {
+	e := SUM("a")
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	numKeys := columnarBlockSize + 10
+
+	buf := &bytes.Buffer{}
+	w := newColumnarWriter(buf, 2)
+	for i := 0; i < numKeys; i++ {
+		key := bytemap.New(map[string]interface{}{"x": i})
+		columns := []encoding.Sequence{encoding.NewFloatValue(e, now, float64(i)), nil}
+		if i%2 == 0 {
+			columns[1] = encoding.NewFloatValue(e, now.Add(-time.Duration(i)*time.Second), float64(i*2))
+		}
+		if !assert.NoError(t, w.add(key, columns)) {
+			return
+		}
+	}
+	if !assert.NoError(t, w.flush()) {
+		return
+	}
+	data := buf.Bytes()
+
+	read := func(needed []bool) ([]bytemap.ByteMap, [][]encoding.Sequence, error) {
+		var keys []bytemap.ByteMap
+		var rows [][]encoding.Sequence
+		err := iterateColumnar(bytes.NewReader(data), needed, func(key bytemap.ByteMap, raw []byte, fileColumns func() ([]encoding.Sequence, error)) (bool, error) {
+			assert.Nil(t, raw, "columnar data should never be passed raw")
+			columns, err := fileColumns()
+			if err != nil {
+				return false, err
+			}
+			keys = append(keys, key)
+			rows = append(rows, columns)
+			return true, nil
+		})
+		return keys, rows, err
+	}
+
+	keys, rows, err := read([]bool{true, true})
+	if !assert.NoError(t, err) || !assert.Len(t, keys, numKeys) {
+		return
+	}
+	for i, key := range keys {
+		assert.EqualValues(t, i, key.Get("x"))
+		val, _ := rows[i][0].ValueAt(0, e)
+		assert.EqualValues(t, i, val)
+		if i%2 == 0 {
+			val, _ = rows[i][1].ValueAt(0, e)
+			assert.EqualValues(t, i*2, val)
+			assert.Equal(t, now.Add(-time.Duration(i)*time.Second), rows[i][1].Until().In(time.UTC))
+		} else {
+			assert.Nil(t, rows[i][1])
+		}
+	}
+
+	_, rows, err = read([]bool{false, true})
+	if assert.NoError(t, err) {
+		for _, columns := range rows {
+			assert.Nil(t, columns[0], "column that isn't needed shouldn't be decoded")
+		}
+		assert.NotNil(t, rows[0][1])
+	}
+
+	// Corrupted blocks return errors rather than panicking
+	firstBlock := data[:encoding.Binary.Uint64(data)]
+	for i := encoding.Width64bits; i < len(firstBlock); i++ {
+		_, _, err := decodeColumnarBlock(firstBlock[encoding.Width64bits:i], []bool{true, true})
+		assert.Error(t, err, "truncated to %d", i)
+	}
+}
+
+func TestColumnarTable(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	clock := NewVirtualClock(epoch)
+	clock.Freeze()
+	db, err := NewDB(&DBOpts{
+		Dir:   tmpDir,
+		Clock: clock,
+		Schema: Schema{
+			"coltable": &TableOpts{
+				RetentionPeriod: time.Hour,
+				Columnar:        true,
+				SQL:             "SELECT SUM(a) AS a, SUM(b) AS b FROM inbound GROUP BY x, period(1s)",
+			},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	tbl := db.getTable("coltable")
+	insert := func(x int, a float64, b float64) {
+		db.Insert("inbound", epoch, map[string]interface{}{"x": x}, map[string]float64{"a": a, "b": b})
+	}
+	insert(1, 1, 10)
+	insert(2, 2, 20)
+	waitFor(func() bool { return db.TableStats("coltable").ArchiveQueueDepth == 2 })
+	if !assert.NoError(t, db.ForceFlush("coltable")) {
+		return
+	}
+
+	// data on disk is stored in columnar layout
+	file, err := os.Open(tbl.rowStore.fileStore.filename)
+	if !assert.NoError(t, err) {
+		return
+	}
+	r, err := newDecompressingReader(bufio.NewReader(file), versionFor(file.Name()))
+	if !assert.NoError(t, err) {
+		file.Close()
+		return
+	}
+	header, err := readHeader(r, versionFor(file.Name()))
+	file.Close()
+	if assert.NoError(t, err) {
+		assert.Equal(t, layoutColumnar, header.layout)
+	}
+
+	// merge some data from the memstore
+	insert(2, 3, 30)
+	waitFor(func() bool { return db.TableStats("coltable").ArchiveQueueDepth == 1 })
+	insert(3, 4, 40)
+	waitFor(func() bool { return db.TableStats("coltable").ArchiveQueueDepth == 2 })
+
+	fields := tbl.getFields()
+	var bField core.Field
+	for _, field := range fields {
+		if field.Name == "b" {
+			bField = field
+		}
+	}
+	results := make(map[int]float64)
+	err = tbl.rowStore.iterate(context.Background(), core.Fields{bField}, true, nil, nil, func(key bytemap.ByteMap, columns []encoding.Sequence) (bool, error) {
+		if assert.Len(t, columns, 1) {
+			val, _ := columns[0].ValueAtTime(epoch, bField.Expr, tbl.Resolution)
+			results[key.Get("x").(int)] = val
+		}
+		return true, nil
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[int]float64{1: 10, 2: 50, 3: 40}, results)
+	}
+
+	// flushing again carries over data from the columnar file
+	if !assert.NoError(t, db.ForceFlush("coltable")) {
+		return
+	}
+	assert.EqualValues(t, 3, db.TableStats("coltable").DiskKeys)
+}
@@ -2,6 +2,7 @@ package common
 
 import (
 	"context"
+	"strings"
 	"time"
 
 	"github.com/getlantern/bytemap"
@@ -11,6 +12,7 @@ import (
 
 const (
 	keyIncludeMemStore = "zenodb.includeMemStore"
+	keyQueryStats      = "zenodb.queryStats"
 )
 
 type Partition struct {
@@ -28,16 +30,187 @@ type Follow struct {
 	EarliestOffset  wal.Offset
 	PartitionNumber int
 	Partitions      map[string]*Partition
+	// Version is the version of zenodb that the follower is running
+	Version string
+	// Labels describe where the follower runs, like its rack or zone, for
+	// checking placement constraints on the leader.
+	Labels map[string]string
+	// Addr is the follower's address as seen by the leader. It's filled in by
+	// the leader and never sent over the wire.
+	Addr string `msgpack:"-"`
+}
+
+// QueryHandlerCapabilities describe which queries a follower that handles
+// remote queries can answer. Followers send them to the leader when they
+// register to handle queries, so that the leader only routes queries to
+// handlers that can answer them.
+type QueryHandlerCapabilities struct {
+	// Tables lists the tables that the handler can query. If empty, it can
+	// query all tables.
+	Tables []string
+	// Since is the earliest time for which the handler holds complete data. If
+	// zero, it holds all data within the retention periods of its tables.
+	Since time.Time
+	// Version is the version of zenodb that the handler is running
+	Version string
+	// Archived is the last time at which the handler archived new data to
+	// disk. Results that exclude the memstore don't change until it archives
+	// again, so the leader uses it to invalidate the results that it caches for
+	// the handler's partition. If zero, the handler's results aren't cached.
+	Archived time.Time
+}
+
+// Serves indicates whether the handler can query all of the given tables. A
+// nil QueryHandlerCapabilities serves all tables.
+func (c *QueryHandlerCapabilities) Serves(tables ...string) bool {
+	if c == nil || len(c.Tables) == 0 {
+		return true
+	}
+	for _, table := range tables {
+		served := false
+		for _, candidate := range c.Tables {
+			if strings.EqualFold(candidate, table) {
+				served = true
+				break
+			}
+		}
+		if !served {
+			return false
+		}
+	}
+	return true
+}
+
+// Holds indicates whether the handler holds complete data from asOf onwards.
+// A zero asOf stands for all data within the tables' retention periods. A nil
+// QueryHandlerCapabilities holds all data.
+func (c *QueryHandlerCapabilities) Holds(asOf time.Time) bool {
+	if c == nil || c.Since.IsZero() {
+		return true
+	}
+	return !asOf.IsZero() && !asOf.Before(c.Since)
+}
+
+// CaptureChanges requests a change-data-capture stream of the data that tables
+// archive to disk, see ArchivedChunk.
+type CaptureChanges struct {
+	// Tables limits the stream to these tables. If empty, all tables are
+	// included.
+	Tables []string
+}
+
+// ArchivedChunk holds the data that a table archived for a single key when it
+// flushed its memstore to disk. Chunks for the same key and field from
+// successive flushes can be merged to mirror the table.
+type ArchivedChunk struct {
+	Table string
+	// Offset is the WAL offset up to which the table has archived data
+	Offset wal.Offset
+	// ArchivedAt is when the flush that archived this chunk completed
+	ArchivedAt time.Time
+	Resolution time.Duration
+	// Fields are the table's fields as stored in its files, like "a (SUM(a))"
+	Fields []string
+	Key    bytemap.ByteMap
+	// Sequences holds one sequence per field, nil where the key has no new data
+	// for that field
+	Sequences []encoding.Sequence
 }
 
 type QueryRemote func(sqlString string, includeMemStore bool, isSubQuery bool, subQueryResults [][]interface{}, onValue func(bytemap.ByteMap, []encoding.Sequence)) (hasReadResult bool, err error)
 
 type QueryMetaData struct {
 	FieldNames []string
+	// FieldMetadata holds the metadata of the fields that have any, keyed by
+	// field name
+	FieldMetadata map[string]*FieldMetadata
+	// Columns describes the dims by which results are grouped followed by the
+	// fields in the order of FieldNames. If results are grouped by all dims,
+	// which dims rows have isn't known up front and only fields are described.
+	Columns    []*ColumnMetadata
 	AsOf       time.Time
 	Until      time.Time
 	Resolution time.Duration
 	Plan       string
+	// Stats reports how much data the query read from each table. It's only
+	// available once all results have been read.
+	Stats []*TableQueryStats
+	// Truncated indicates that the server omitted results because they exceeded
+	// its limits on the size of query results, in which case OmittedRows counts
+	// the rows (groups) that it omitted. Like Stats, these are only available
+	// once all results have been read.
+	Truncated   bool
+	OmittedRows int64
+}
+
+// ClusterStatus describes the state of a cluster as seen by its leader.
+type ClusterStatus struct {
+	Version       string
+	NumPartitions int
+	Followers     []*FollowerStatus
+	// Gaps lists followers that were unable to follow because they need data
+	// that's no longer in the leader's WAL.
+	Gaps []*FollowGap
+	// ResyncsRequired counts how many follow requests were rejected because of
+	// gaps since the leader started.
+	ResyncsRequired int64
+	// PlacementRejections counts how many follow requests were rejected because
+	// they violated placement constraints since the leader started.
+	PlacementRejections int64
+	// Owners lists the dimension values that are exclusively owned by specific
+	// partitions. Queries filtered on these values only go to those partitions.
+	Owners []*DimensionOwner
+	// CacheHits counts how many times the leader answered a partition's part of
+	// a query from its cache of follower results since it started.
+	CacheHits int64
+	// CacheMisses counts how many times the leader had to query a partition
+	// for a query whose results it could have cached since it started.
+	CacheMisses int64
+}
+
+// DimensionOwner records that only the given partitions hold data with the
+// given Value for Dim.
+type DimensionOwner struct {
+	Dim        string
+	Value      string
+	Partitions []int
+}
+
+// FollowGap records a follower whose requested offset precedes the oldest
+// retained WAL segment on the leader. It stays in place until the follower
+// successfully follows the stream again.
+type FollowGap struct {
+	Partition int
+	Stream    string
+	Requested wal.Offset
+	Oldest    wal.Offset
+	Time      time.Time
+}
+
+// FollowerStatus describes a single follower of a stream.
+type FollowerStatus struct {
+	ID        int
+	Addr      string
+	Partition int
+	Stream    string
+	Version   string
+	Joined    time.Time
+	// Offset is the offset of the most recent WAL entry sent to the follower
+	Offset wal.Offset
+	// Lag estimates how far behind the follower is, based on the timestamp of
+	// the most recent entry it received relative to the most recent entry in the
+	// leader's WAL. It's zero when nothing is queued for the follower.
+	Lag time.Duration
+	// Queued is the number of WAL entries waiting to be sent to the follower
+	Queued int
+	Failed bool
+	// LastQueryLatency is how long the follower's partition took to respond to
+	// the most recent distributed query.
+	LastQueryLatency time.Duration
+	// QueryLatencyP99 is the 99th percentile of how long the follower's
+	// partition took to respond to recent distributed queries.
+	QueryLatencyP99 time.Duration
+	Labels          map[string]string
 }
 
 func WithIncludeMemStore(ctx context.Context, includeMemStore bool) context.Context {
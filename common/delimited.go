@@ -0,0 +1,150 @@
+package common
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+const (
+	// FormatCSV renders query results as comma-separated values
+	FormatCSV = "csv"
+
+	// FormatTSV renders query results as tab-separated values
+	FormatTSV = "tsv"
+)
+
+// IsDelimitedFormat indicates whether the given format is one that
+// DelimitedWriter can render.
+func IsDelimitedFormat(format string) bool {
+	return format == FormatCSV || format == FormatTSV
+}
+
+type bufferedRow struct {
+	ts   int64
+	key  bytemap.ByteMap
+	vals []float64
+}
+
+// DelimitedWriter renders flat query results as CSV or TSV with one line per
+// row, in the columns time, fields and then dims. Times are RFC3339 in UTC.
+//
+// If the dims are known up front (e.g. from the query's GROUP BY), rows are
+// written as they arrive. Otherwise, rows are buffered until Close so that the
+// header can include every dim that shows up in the results.
+type DelimitedWriter struct {
+	w          *csv.Writer
+	fieldNames []string
+	dims       []string
+	header     bool
+	buffered   []*bufferedRow
+	record     []string
+}
+
+// NewDelimitedWriter constructs a DelimitedWriter that writes rows with the
+// given fieldNames and dims to out in the given format (FormatCSV or
+// FormatTSV). If header is true, a header line with the column names is
+// written first.
+func NewDelimitedWriter(out io.Writer, format string, fieldNames []string, dims []string, header bool) (*DelimitedWriter, error) {
+	if !IsDelimitedFormat(format) {
+		return nil, fmt.Errorf("Unknown format %v, expected %v or %v", format, FormatCSV, FormatTSV)
+	}
+	w := csv.NewWriter(out)
+	if format == FormatTSV {
+		w.Comma = '\t'
+	}
+	dw := &DelimitedWriter{
+		w:          w,
+		fieldNames: fieldNames,
+		dims:       dims,
+		header:     header,
+	}
+	if len(dims) > 0 {
+		err := dw.writeHeader()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dw, nil
+}
+
+// WriteRow writes a single row of results. Dims in key that aren't among the
+// writer's dims are omitted.
+func (dw *DelimitedWriter) WriteRow(ts int64, key bytemap.ByteMap, vals []float64) error {
+	if len(dw.dims) == 0 {
+		dw.buffered = append(dw.buffered, &bufferedRow{ts, key, append([]float64(nil), vals...)})
+		return nil
+	}
+	return dw.writeRow(ts, key, vals)
+}
+
+// Flush flushes any rows that have been written so far to the underlying
+// io.Writer.
+func (dw *DelimitedWriter) Flush() error {
+	dw.w.Flush()
+	return dw.w.Error()
+}
+
+// Close writes out any buffered rows and flushes.
+func (dw *DelimitedWriter) Close() error {
+	if len(dw.dims) == 0 {
+		uniqueDims := make(map[string]bool)
+		for _, row := range dw.buffered {
+			row.key.Iterate(false, false, func(dim string, value interface{}, valueBytes []byte) bool {
+				uniqueDims[dim] = true
+				return true
+			})
+		}
+		for dim := range uniqueDims {
+			dw.dims = append(dw.dims, dim)
+		}
+		sort.Strings(dw.dims)
+		err := dw.writeHeader()
+		if err != nil {
+			return err
+		}
+		for _, row := range dw.buffered {
+			err = dw.writeRow(row.ts, row.key, row.vals)
+			if err != nil {
+				return err
+			}
+		}
+		dw.buffered = nil
+	}
+	return dw.Flush()
+}
+
+func (dw *DelimitedWriter) writeHeader() error {
+	if !dw.header {
+		return nil
+	}
+	record := make([]string, 0, 1+len(dw.fieldNames)+len(dw.dims))
+	record = append(record, "time")
+	record = append(record, dw.fieldNames...)
+	record = append(record, dw.dims...)
+	return dw.w.Write(record)
+}
+
+func (dw *DelimitedWriter) writeRow(ts int64, key bytemap.ByteMap, vals []float64) error {
+	record := dw.record[:0]
+	record = append(record, encoding.TimeFromInt(ts).In(time.UTC).Format(time.RFC3339))
+	for _, val := range vals {
+		record = append(record, strconv.FormatFloat(val, 'f', -1, 64))
+	}
+	for _, dim := range dw.dims {
+		val := key.Get(dim)
+		if val == nil {
+			record = append(record, "")
+		} else {
+			record = append(record, fmt.Sprint(val))
+		}
+	}
+	dw.record = record
+	return dw.w.Write(record)
+}
@@ -0,0 +1,32 @@
+package common
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDelimitedWriter(t *testing.T) {
+	ts := time.Date(2015, time.January, 1, 2, 3, 0, 0, time.UTC).UnixNano()
+	write := func(format string, dims []string, header bool) string {
+		buf := &bytes.Buffer{}
+		dw, err := NewDelimitedWriter(buf, format, []string{"a", "b"}, dims, header)
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		assert.NoError(t, dw.WriteRow(ts, bytemap.New(map[string]interface{}{"u": "bob", "h": "x,y"}), []float64{1.5, 2}))
+		assert.NoError(t, dw.WriteRow(ts, bytemap.New(map[string]interface{}{"u": "alice", "c": 3}), []float64{0, -1}))
+		assert.NoError(t, dw.Close())
+		return buf.String()
+	}
+
+	assert.Equal(t, "time,a,b,u,h\n2015-01-01T02:03:00Z,1.5,2,bob,\"x,y\"\n2015-01-01T02:03:00Z,0,-1,alice,\n", write(FormatCSV, []string{"u", "h"}, true))
+	assert.Equal(t, "2015-01-01T02:03:00Z\t1.5\t2\tbob\n2015-01-01T02:03:00Z\t0\t-1\talice\n", write(FormatTSV, []string{"u"}, false))
+	assert.Equal(t, "time,a,b,c,h,u\n2015-01-01T02:03:00Z,1.5,2,,\"x,y\",bob\n2015-01-01T02:03:00Z,0,-1,3,,alice\n", write(FormatCSV, nil, true), "unknown dims should be discovered from the results")
+
+	_, err := NewDelimitedWriter(&bytes.Buffer{}, "xlsx", nil, nil, true)
+	assert.Error(t, err)
+}
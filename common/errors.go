@@ -0,0 +1,107 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Kinds of errors returned by zenodb's public APIs, including over RPC. Errors
+// of these kinds are either the sentinels themselves or *Errors whose Kind is
+// the sentinel, so callers can branch on them with KindOf rather than by
+// matching error messages.
+var (
+	// ErrUnknownTable indicates that a query or operation referenced a table
+	// that doesn't exist.
+	ErrUnknownTable = errors.New("unknown table")
+
+	// ErrUnknownStream indicates that an insert referenced a stream that no
+	// table reads from.
+	ErrUnknownStream = errors.New("unknown stream")
+
+	// ErrOutsideHotPeriod indicates that a query asked for data from before the
+	// period for which data is available, for example an as-of query from
+	// before the start of the WAL.
+	ErrOutsideHotPeriod = errors.New("outside hot period")
+
+	// ErrBackpressure indicates that an insert was rejected because the
+	// database is not accepting more data right now, for example because a
+	// tenant exceeded its ingest rate. The insert can be retried later.
+	ErrBackpressure = errors.New("backpressure")
+
+	// ErrInvalidSQL indicates that a query or statement couldn't be parsed or
+	// referenced something that doesn't exist. Such errors are usually
+	// *SQLErrors that say where in the SQL the problem is.
+	ErrInvalidSQL = errors.New("invalid SQL")
+)
+
+// Error is an error of a specific Kind with a message that includes details
+// like the name of the table.
+type Error struct {
+	Kind error
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+// Unwrap returns the Kind of error, for use with errors.Is.
+func (e *Error) Unwrap() error {
+	return e.Kind
+}
+
+// Errorf returns an *Error of the given kind with a formatted message.
+func Errorf(kind error, format string, args ...interface{}) error {
+	return &Error{Kind: kind, Msg: fmt.Sprintf(format, args...)}
+}
+
+// SQLError is an error in a SQL statement that identifies where in the
+// statement the problem is and, for misspelled names, what might have been
+// meant instead. Its Kind is usually ErrInvalidSQL, or ErrUnknownTable for
+// tables that don't exist.
+type SQLError struct {
+	Kind error `json:"-"`
+	Msg  string
+	// Line and Column locate the offending token in the SQL, starting at 1. They
+	// are 0 if the location is unknown.
+	Line   int
+	Column int
+	// Token is the offending token, if known
+	Token string
+	// Suggestions are names that Token might have been meant to be
+	Suggestions []string
+}
+
+func (e *SQLError) Error() string {
+	var buf bytes.Buffer
+	buf.WriteString(e.Msg)
+	if e.Line > 0 {
+		fmt.Fprintf(&buf, " at line %d, column %d", e.Line, e.Column)
+		if e.Token != "" {
+			fmt.Fprintf(&buf, " near '%v'", e.Token)
+		}
+	}
+	if len(e.Suggestions) > 0 {
+		fmt.Fprintf(&buf, ", did you mean %v?", strings.Join(e.Suggestions, " or "))
+	}
+	return buf.String()
+}
+
+// Unwrap returns the Kind of error, for use with errors.Is.
+func (e *SQLError) Unwrap() error {
+	return e.Kind
+}
+
+// KindOf returns the kind of the given error, which is the Kind of an *Error
+// or *SQLError or otherwise the error itself.
+func KindOf(err error) error {
+	switch e := err.(type) {
+	case *Error:
+		return e.Kind
+	case *SQLError:
+		return e.Kind
+	}
+	return err
+}
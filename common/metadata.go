@@ -0,0 +1,146 @@
+package common
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Units that values of fields can be measured in. Values in these units can be
+// converted into more readable ones for display, for example bytes into MiB
+// and ratios into percentages.
+const (
+	UnitBytes        = "bytes"
+	UnitSeconds      = "seconds"
+	UnitMilliseconds = "milliseconds"
+	UnitMicroseconds = "microseconds"
+	UnitNanoseconds  = "nanoseconds"
+	UnitRatio        = "ratio"
+	UnitPercent      = "percent"
+	UnitCount        = "count"
+)
+
+// DisplayRaw is a display hint that shows values as plain numbers without
+// converting their units.
+const DisplayRaw = "raw"
+
+// Kinds of columns in query results, see ColumnMetadata.
+const (
+	// ColumnDim is a dimension by which rows are grouped
+	ColumnDim = "dim"
+	// ColumnAggregate is a field that aggregates values, like SUM(x)
+	ColumnAggregate = "aggregate"
+	// ColumnDerived is a field that's calculated from other fields, like
+	// SUM(x) / SUM(y)
+	ColumnDerived = "derived"
+)
+
+// Types of the values of columns in query results, see ColumnMetadata.
+const (
+	TypeNumber = "number"
+	// TypeAny means that values may be strings, numbers, booleans or times,
+	// depending on what was inserted.
+	TypeAny = "any"
+)
+
+// ColumnMetadata describes a column of query results, so that clients can
+// render results without knowing about the tables they came from.
+type ColumnMetadata struct {
+	Name string
+	// Kind is one of ColumnDim, ColumnAggregate or ColumnDerived
+	Kind string
+	// Type is one of TypeNumber or TypeAny
+	Type string
+	// Unit is the unit of the column's values, if known. See FieldMetadata.
+	Unit string
+}
+
+var (
+	durationUnits = map[string]time.Duration{
+		UnitSeconds:      time.Second,
+		UnitMilliseconds: time.Millisecond,
+		UnitMicroseconds: time.Microsecond,
+		UnitNanoseconds:  time.Nanosecond,
+	}
+
+	byteUnits = []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+)
+
+// FieldMetadata describes how to interpret and display the values of a field.
+type FieldMetadata struct {
+	// Unit is the unit in which the field's values are measured, like bytes,
+	// seconds or ratio.
+	Unit string `yaml:"unit,omitempty"`
+	// Display optionally hints at how to display the field's values, either as
+	// a printf style format like %.2f, which is applied to values in Unit, or
+	// as raw to display plain numbers.
+	Display string `yaml:"display,omitempty"`
+}
+
+// Validate checks that the Unit is known and that the Display hint is valid.
+func (md *FieldMetadata) Validate() error {
+	switch md.Unit {
+	case "", UnitBytes, UnitRatio, UnitPercent, UnitCount:
+	default:
+		if _, isDuration := durationUnits[md.Unit]; !isDuration {
+			return fmt.Errorf("Unknown unit %v", md.Unit)
+		}
+	}
+	if md.Display != "" && md.Display != DisplayRaw && !strings.Contains(md.Display, "%") {
+		return fmt.Errorf("Display hint %v should either be %v or a printf style format like %%.2f", md.Display, DisplayRaw)
+	}
+	return nil
+}
+
+// Format formats the given value for display according to the metadata. A nil
+// FieldMetadata formats values as plain numbers.
+func (md *FieldMetadata) Format(val float64) string {
+	if md == nil || md.Display == DisplayRaw || math.IsNaN(val) || math.IsInf(val, 0) {
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	}
+	if md.Display != "" {
+		return fmt.Sprintf(md.Display, val)
+	}
+	switch md.Unit {
+	case UnitBytes:
+		return formatBytes(val)
+	case UnitRatio:
+		return fmt.Sprintf("%.2f%%", val*100)
+	case UnitPercent:
+		return fmt.Sprintf("%.2f%%", val)
+	case UnitCount:
+		return strconv.FormatFloat(math.Round(val), 'f', -1, 64)
+	}
+	if unit, isDuration := durationUnits[md.Unit]; isDuration {
+		d := time.Duration(val * float64(unit))
+		// Keep 4 significant digits
+		return d.Round(roundingFor(d)).String()
+	}
+	return strconv.FormatFloat(val, 'f', -1, 64)
+}
+
+func formatBytes(val float64) string {
+	i := 0
+	for math.Abs(val) >= 1024 && i < len(byteUnits)-1 {
+		val /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %v", val, byteUnits[i])
+	}
+	return fmt.Sprintf("%.2f %v", val, byteUnits[i])
+}
+
+func roundingFor(d time.Duration) time.Duration {
+	if d < 0 {
+		d = -d
+	}
+	rounding := time.Duration(1)
+	for d >= 10000 {
+		d /= 10
+		rounding *= 10
+	}
+	return rounding
+}
@@ -0,0 +1,28 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFieldMetadataFormat(t *testing.T) {
+	var none *FieldMetadata
+	assert.Equal(t, "1.5", none.Format(1.5))
+	assert.Equal(t, "512 B", (&FieldMetadata{Unit: UnitBytes}).Format(512))
+	assert.Equal(t, "1.50 MiB", (&FieldMetadata{Unit: UnitBytes}).Format(1.5*1024*1024))
+	assert.Equal(t, "1572864", (&FieldMetadata{Unit: UnitBytes, Display: DisplayRaw}).Format(1.5*1024*1024))
+	assert.Equal(t, "1.5s", (&FieldMetadata{Unit: UnitSeconds}).Format(1.5))
+	assert.Equal(t, "2m3.5s", (&FieldMetadata{Unit: UnitMilliseconds}).Format(123456.7))
+	assert.Equal(t, "25.00%", (&FieldMetadata{Unit: UnitRatio}).Format(0.25))
+	assert.Equal(t, "25.00%", (&FieldMetadata{Unit: UnitPercent}).Format(25))
+	assert.Equal(t, "3", (&FieldMetadata{Unit: UnitCount}).Format(2.6))
+	assert.Equal(t, "0.3", (&FieldMetadata{Unit: UnitRatio, Display: "%.1f"}).Format(0.26))
+}
+
+func TestFieldMetadataValidate(t *testing.T) {
+	assert.NoError(t, (&FieldMetadata{}).Validate())
+	assert.NoError(t, (&FieldMetadata{Unit: UnitMicroseconds, Display: "%.3f"}).Validate())
+	assert.Error(t, (&FieldMetadata{Unit: "furlongs"}).Validate())
+	assert.Error(t, (&FieldMetadata{Unit: UnitBytes, Display: "pretty"}).Validate())
+}
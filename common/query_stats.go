@@ -0,0 +1,82 @@
+package common
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// TableQueryStats counts the data that a query read from one table.
+type TableQueryStats struct {
+	Table string
+	// KeysScanned is the number of keys read from the table
+	KeysScanned int64
+	// SequencesDecoded is the number of non-empty sequences (one per field per
+	// key) read from the table
+	SequencesDecoded int64
+	// PeriodsRead is the number of periods in those sequences
+	PeriodsRead int64
+	// BytesRead is the encoded size of the keys and sequences
+	BytesRead int64
+}
+
+func (s *TableQueryStats) add(other *TableQueryStats) {
+	s.KeysScanned += other.KeysScanned
+	s.SequencesDecoded += other.SequencesDecoded
+	s.PeriodsRead += other.PeriodsRead
+	s.BytesRead += other.BytesRead
+}
+
+// QueryStats collects the TableQueryStats of a query, including those reported
+// by the partitions of a cluster. It's safe for concurrent use.
+type QueryStats struct {
+	mx     sync.Mutex
+	tables map[string]*TableQueryStats
+}
+
+// NewQueryStats returns an empty QueryStats.
+func NewQueryStats() *QueryStats {
+	return &QueryStats{tables: make(map[string]*TableQueryStats)}
+}
+
+// Add adds the given stats to those of the same table.
+func (s *QueryStats) Add(stats ...*TableQueryStats) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for _, stat := range stats {
+		existing := s.tables[stat.Table]
+		if existing == nil {
+			existing = &TableQueryStats{Table: stat.Table}
+			s.tables[stat.Table] = existing
+		}
+		existing.add(stat)
+	}
+}
+
+// Tables returns a copy of the stats for each table, ordered by table name.
+func (s *QueryStats) Tables() []*TableQueryStats {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	result := make([]*TableQueryStats, 0, len(s.tables))
+	for _, stat := range s.tables {
+		copied := *stat
+		result = append(result, &copied)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Table < result[j].Table
+	})
+	return result
+}
+
+// WithQueryStats returns a context that collects the stats of queries run with
+// it into the given QueryStats.
+func WithQueryStats(ctx context.Context, stats *QueryStats) context.Context {
+	return context.WithValue(ctx, keyQueryStats, stats)
+}
+
+// QueryStatsFrom returns the QueryStats of the given context, or nil if it
+// doesn't collect stats.
+func QueryStatsFrom(ctx context.Context) *QueryStats {
+	stats, _ := ctx.Value(keyQueryStats).(*QueryStats)
+	return stats
+}
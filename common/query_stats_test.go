@@ -0,0 +1,23 @@
+package common
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryStats(t *testing.T) {
+	assert.Nil(t, QueryStatsFrom(context.Background()))
+
+	stats := NewQueryStats()
+	ctx := WithQueryStats(context.Background(), stats)
+	QueryStatsFrom(ctx).Add(&TableQueryStats{Table: "b", KeysScanned: 1, SequencesDecoded: 2, PeriodsRead: 3, BytesRead: 4})
+	QueryStatsFrom(ctx).Add(&TableQueryStats{Table: "a", KeysScanned: 1}, &TableQueryStats{Table: "b", KeysScanned: 10, BytesRead: 40})
+
+	tables := stats.Tables()
+	if assert.Len(t, tables, 2) {
+		assert.Equal(t, &TableQueryStats{Table: "a", KeysScanned: 1}, tables[0])
+		assert.Equal(t, &TableQueryStats{Table: "b", KeysScanned: 11, SequencesDecoded: 2, PeriodsRead: 3, BytesRead: 44}, tables[1])
+	}
+}
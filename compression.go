@@ -0,0 +1,200 @@
+package zenodb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/golang/snappy"
+	"github.com/pierrec/lz4"
+	"github.com/valyala/gozstd"
+)
+
+const (
+	// compressionNone stores data files uncompressed, which costs disk space
+	// but saves CPU when flushing and querying
+	compressionNone = byte(0)
+	// compressionSnappy compresses data files with snappy (the default)
+	compressionSnappy = byte(1)
+	// compressionZstd compresses data files with zstd, using a dictionary
+	// trained on sequences from the table's previous flush. The dictionary is
+	// stored after the compression byte, preceded by its length.
+	compressionZstd = byte(2)
+	// compressionLZ4 compresses data files with lz4, which is about as fast as
+	// snappy
+	compressionLZ4 = byte(3)
+
+	// zstdDictSize is the size of the dictionaries trained for zstd
+	zstdDictSize = 16 * 1024
+	// maxDictSampleBytes limits how much of a flush is sampled to train the
+	// next flush's dictionary, which zstd recommends to be about 100 times the
+	// dictionary size
+	maxDictSampleBytes = 100 * zstdDictSize
+	// minDictSamples is how many samples are needed to train a dictionary
+	minDictSamples = 100
+)
+
+// compressionFor returns the compression identified by the given name (as used
+// for TableOpts.Compression), which defaults to snappy if blank.
+func compressionFor(name string) (byte, error) {
+	switch strings.ToLower(name) {
+	case "", "snappy":
+		return compressionSnappy, nil
+	case "none":
+		return compressionNone, nil
+	case "zstd":
+		return compressionZstd, nil
+	case "lz4":
+		return compressionLZ4, nil
+	default:
+		return 0, fmt.Errorf("Unknown compression %v, use none, snappy, zstd or lz4", name)
+	}
+}
+
+// newCompressedWriter records the given compression at the start of w and
+// returns a writer that compresses what's written to it into w. For zstd, the
+// given dictionary (which may be empty) is recorded too and used to compress.
+// The returned writer must be closed to flush it.
+func newCompressedWriter(w io.Writer, compression byte, dict []byte) (io.WriteCloser, error) {
+	_, err := w.Write([]byte{compression})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to write compression: %v", err)
+	}
+	switch compression {
+	case compressionNone:
+		return &uncompressedWriter{bufio.NewWriter(w)}, nil
+	case compressionSnappy:
+		return snappy.NewBufferedWriter(w), nil
+	case compressionZstd:
+		dictLen := make([]byte, encoding.Width32bits)
+		encoding.Binary.PutUint32(dictLen, uint32(len(dict)))
+		_, err = w.Write(dictLen)
+		if err == nil {
+			_, err = w.Write(dict)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Unable to write zstd dictionary: %v", err)
+		}
+		if len(dict) == 0 {
+			return &zstdWriter{Writer: gozstd.NewWriter(w)}, nil
+		}
+		cd, err := gozstd.NewCDict(dict)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load zstd dictionary: %v", err)
+		}
+		return &zstdWriter{Writer: gozstd.NewWriterDict(w, cd), cd: cd}, nil
+	case compressionLZ4:
+		return lz4.NewWriter(w), nil
+	default:
+		return nil, fmt.Errorf("Unsupported compression %d", compression)
+	}
+}
+
+// newDecompressingReader returns a reader of the decompressed data in r, which
+// is stored in the given file version. Prior to FileVersion_8, data was always
+// compressed with snappy. The reader must be released with releaseReader once
+// it's no longer needed.
+func newDecompressingReader(r io.Reader, fileVersion int) (io.Reader, error) {
+	compression := compressionSnappy
+	if fileVersion >= FileVersion_8 {
+		b := make([]byte, 1)
+		_, err := io.ReadFull(r, b)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read compression: %v", err)
+		}
+		compression = b[0]
+	}
+	switch compression {
+	case compressionNone:
+		return bufio.NewReader(r), nil
+	case compressionSnappy:
+		return snappy.NewReader(r), nil
+	case compressionZstd:
+		dictLen := make([]byte, encoding.Width32bits)
+		_, err := io.ReadFull(r, dictLen)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read zstd dictionary length: %v", err)
+		}
+		dict := make([]byte, encoding.Binary.Uint32(dictLen))
+		_, err = io.ReadFull(r, dict)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read zstd dictionary: %v", err)
+		}
+		if len(dict) == 0 {
+			return &zstdReader{Reader: gozstd.NewReader(r)}, nil
+		}
+		dd, err := gozstd.NewDDict(dict)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load zstd dictionary: %v", err)
+		}
+		return &zstdReader{Reader: gozstd.NewReaderDict(r, dd), dd: dd}, nil
+	case compressionLZ4:
+		return lz4.NewReader(r), nil
+	default:
+		return nil, fmt.Errorf("Unsupported compression %d", compression)
+	}
+}
+
+// releaseReader frees the resources held by a reader from
+// newDecompressingReader, which only zstd readers hold outside of the Go heap.
+func releaseReader(r io.Reader) {
+	if zr, ok := r.(*zstdReader); ok {
+		zr.Reader.Release()
+		if zr.dd != nil {
+			zr.dd.Release()
+		}
+	}
+}
+
+// dictSampler collects samples of the sequences written by a flush, from which
+// it trains a zstd dictionary for the next flush.
+type dictSampler struct {
+	samples [][]byte
+	size    int
+}
+
+func (s *dictSampler) sample(b []byte) {
+	if s == nil || len(b) == 0 || s.size+len(b) > maxDictSampleBytes {
+		return
+	}
+	s.samples = append(s.samples, append([]byte(nil), b...))
+	s.size += len(b)
+}
+
+// train returns a dictionary trained on the collected samples, or nil if there
+// weren't enough samples to train one.
+func (s *dictSampler) train() []byte {
+	if s == nil || len(s.samples) < minDictSamples {
+		return nil
+	}
+	return gozstd.BuildDict(s.samples, zstdDictSize)
+}
+
+type uncompressedWriter struct {
+	*bufio.Writer
+}
+
+func (w *uncompressedWriter) Close() error {
+	return w.Flush()
+}
+
+type zstdWriter struct {
+	*gozstd.Writer
+	cd *gozstd.CDict
+}
+
+func (w *zstdWriter) Close() error {
+	err := w.Writer.Close()
+	w.Writer.Release()
+	if w.cd != nil {
+		w.cd.Release()
+	}
+	return err
+}
+
+type zstdReader struct {
+	*gozstd.Reader
+	dd *gozstd.DDict
+}
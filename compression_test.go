@@ -0,0 +1,138 @@
+package zenodb
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressedWriter(t *testing.T) {
+	data := bytes.Repeat([]byte("some data "), 1000)
+	for _, compression := range []byte{compressionNone, compressionSnappy, compressionZstd, compressionLZ4} {
+		buf := &bytes.Buffer{}
+		w, err := newCompressedWriter(buf, compression, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		w.Write(data)
+		if !assert.NoError(t, w.Close()) {
+			return
+		}
+		assert.Equal(t, compression, buf.Bytes()[0], "compression should precede the data")
+		if compression == compressionNone {
+			assert.Equal(t, data, buf.Bytes()[1:])
+		} else {
+			assert.True(t, buf.Len() < len(data), "data should be compressed")
+		}
+		r, err := newDecompressingReader(bytes.NewReader(buf.Bytes()), CurrentFileVersion)
+		if !assert.NoError(t, err) {
+			return
+		}
+		read, err := ioutil.ReadAll(r)
+		if assert.NoError(t, err) {
+			assert.Equal(t, data, read)
+		}
+		releaseReader(r)
+	}
+
+	_, err := newDecompressingReader(bytes.NewReader([]byte{5}), CurrentFileVersion)
+	assert.Error(t, err, "unknown compression should be rejected")
+	_, err = compressionFor("gzip")
+	assert.Error(t, err, "unknown compression name should be rejected")
+}
+
+func TestZstdDictionary(t *testing.T) {
+	seq := func(i int) []byte {
+		return []byte(fmt.Sprintf("sequence %d with values %d, %d and %d", i%10, i, i*2, i*3))
+	}
+	sampler := &dictSampler{}
+	for i := 0; i < minDictSamples-1; i++ {
+		sampler.sample(seq(i))
+	}
+	assert.Nil(t, sampler.train(), "shouldn't train dictionary on too few samples")
+	for i := minDictSamples - 1; i < 10000; i++ {
+		sampler.sample(seq(i))
+	}
+	assert.True(t, sampler.size <= maxDictSampleBytes, "samples should be limited")
+	dict := sampler.train()
+	if !assert.NotEmpty(t, dict) {
+		return
+	}
+
+	data := &bytes.Buffer{}
+	for i := 10000; i < 10100; i++ {
+		data.Write(seq(i))
+	}
+	compress := func(dict []byte) []byte {
+		buf := &bytes.Buffer{}
+		w, err := newCompressedWriter(buf, compressionZstd, dict)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		w.Write(data.Bytes())
+		assert.NoError(t, w.Close())
+		return buf.Bytes()
+	}
+	withoutDict := compress(nil)
+	withDict := compress(dict)
+	assert.True(t, len(withDict)-len(dict) < len(withoutDict), "dictionary should improve compression")
+
+	r, err := newDecompressingReader(bytes.NewReader(withDict), CurrentFileVersion)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer releaseReader(r)
+	read, err := ioutil.ReadAll(r)
+	if assert.NoError(t, err) {
+		assert.Equal(t, data.Bytes(), read)
+	}
+}
+
+func TestUncompressedTable(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir: tmpDir,
+		Schema: Schema{
+			"rawtable": &TableOpts{
+				RetentionPeriod: time.Hour,
+				Compression:     "none",
+				SQL:             "SELECT SUM(a) AS a FROM inbound GROUP BY x",
+			},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	now := time.Now()
+	db.Insert("inbound", now, map[string]interface{}{"x": 1}, map[string]float64{"a": 1})
+	db.Insert("inbound", now, map[string]interface{}{"x": 2}, map[string]float64{"a": 2})
+	waitFor(func() bool { return db.TableStats("rawtable").ArchiveQueueDepth == 2 })
+	if !assert.NoError(t, db.ForceFlush("rawtable")) {
+		return
+	}
+
+	filename := db.getTable("rawtable").rowStore.fileStore.filename
+	assert.Equal(t, FileVersion_8, versionFor(filename))
+	b, err := ioutil.ReadFile(filename)
+	if assert.NoError(t, err) {
+		assert.Equal(t, compressionNone, b[0])
+	}
+
+	// flushing again reads back the uncompressed file
+	if !assert.NoError(t, db.ForceFlush("rawtable")) {
+		return
+	}
+	assert.EqualValues(t, 2, db.TableStats("rawtable").DiskKeys)
+}
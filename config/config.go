@@ -0,0 +1,579 @@
+// Package config loads the configuration of a zeno server, including its
+// tables, from a single YAML or TOML file with overrides from environment
+// variables. For example:
+//
+//	db:
+//	  dir: /var/lib/zeno
+//	  walsync: 1s
+//	rpc:
+//	  addr: 0.0.0.0:17712
+//	cluster:
+//	  role: follower
+//	  leader: leader.example.com:17712
+//	  partition: 2
+//	  numpartitions: 4
+//	tls:
+//	  certfile: /etc/zeno/cert.pem
+//	  keyfile: /etc/zeno/pk.pem
+//	tables:
+//	  combined:
+//	    retentionperiod: 24h
+//	    sql: SELECT SUM(requests) AS requests FROM inbound GROUP BY *, period(1m)
+//
+// The equivalent TOML file uses a [section] per section and a [tables.name]
+// per table. Every setting except for tables can be overridden by an
+// environment variable named like ZENO_CLUSTER_PARTITION (see EnvName).
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/getlantern/sqlparser"
+	"github.com/getlantern/yaml"
+	"github.com/getlantern/zenodb"
+)
+
+// Cluster roles
+const (
+	// RoleStandalone is a node that stores and queries its own data (the
+	// default).
+	RoleStandalone = "standalone"
+	// RoleLeader is a passthrough node that feeds data to followers and fans
+	// out queries to them.
+	RoleLeader = "leader"
+	// RoleFollower is a node that captures one partition of the data from a
+	// leader.
+	RoleFollower = "follower"
+)
+
+// EnvPrefix is the prefix of environment variables that override settings.
+const EnvPrefix = "ZENO_"
+
+// Config configures a zeno server. Each setting corresponds to one of zeno's
+// command-line flags, identified by its flag tag.
+type Config struct {
+	DB      DB            `yaml:"db"`
+	RPC     RPC           `yaml:"rpc"`
+	HTTP    HTTP          `yaml:"http"`
+	PG      PG            `yaml:"pg"`
+	Ops     Ops           `yaml:"ops"`
+	Cluster Cluster       `yaml:"cluster"`
+	TLS     TLS           `yaml:"tls"`
+	Redis   Redis         `yaml:"redis"`
+	Tables  zenodb.Schema `yaml:"tables"`
+
+	// specified records the settings (like "rpc.addr") that were specified in
+	// the file or environment
+	specified map[string]bool
+}
+
+// DB configures storage.
+type DB struct {
+	Dir                    string        `yaml:"dir" flag:"dbdir"`
+	Schema                 string        `yaml:"schema" flag:"schema"`
+	Aliases                string        `yaml:"aliases" flag:"aliases"`
+	Plugins                string        `yaml:"plugins" flag:"plugins"`
+	Tenants                string        `yaml:"tenants" flag:"tenants"`
+	Schedules              string        `yaml:"schedules" flag:"schedules"`
+	Rules                  string        `yaml:"rules" flag:"rules"`
+	SavedQueries           string        `yaml:"savedqueries" flag:"savedqueries"`
+	WALSync                time.Duration `yaml:"walsync" flag:"walsync"`
+	MaxWALSize             int           `yaml:"maxwalsize" flag:"maxwalsize"`
+	WALCompressionSize     int           `yaml:"walcompressionsize" flag:"walcompressionsize"`
+	MaxWALAge              time.Duration `yaml:"maxwalage" flag:"maxwalage"`
+	WALCompressionAge      time.Duration `yaml:"walcompressionage" flag:"walcompressionage"`
+	MaxMemory              float64       `yaml:"maxmemory" flag:"maxmemory"`
+	VirtualTime            bool          `yaml:"vtime" flag:"vtime"`
+	EnableGeo              bool          `yaml:"enablegeo" flag:"enablegeo"`
+	ISPFormat              string        `yaml:"ispformat" flag:"ispformat"`
+	ISPDB                  string        `yaml:"ispdb" flag:"ispdb"`
+	RecordStats            bool          `yaml:"recordstats" flag:"recordstats"`
+	MaxArchiveQueueDepth   int64         `yaml:"maxarchivequeuedepth" flag:"maxarchivequeuedepth"`
+	MmapReads              bool          `yaml:"mmapreads" flag:"mmapreads"`
+	MaxFlushBytesPerSecond int64         `yaml:"maxflushbytespersecond" flag:"maxflushbytespersecond"`
+	ReadOnly               bool          `yaml:"readonly" flag:"readonly"`
+}
+
+// RPC configures the gRPC server and connections to other zeno servers.
+type RPC struct {
+	Addr             string        `yaml:"addr" flag:"addr"`
+	Password         string        `yaml:"password" flag:"password"`
+	Credentials      string        `yaml:"credentials" flag:"credentials"`
+	Keepalive        time.Duration `yaml:"keepalive" flag:"rpckeepalive"`
+	KeepaliveTimeout time.Duration `yaml:"keepalivetimeout" flag:"rpckeepalivetimeout"`
+	MaxMsgSize       int           `yaml:"maxmsgsize" flag:"rpcmaxmsgsize"`
+	IdleTimeout      time.Duration `yaml:"idletimeout" flag:"rpcidletimeout"`
+	QueryPing        time.Duration `yaml:"queryping" flag:"rpcqueryping"`
+	QueryPingTimeout time.Duration `yaml:"querypingtimeout" flag:"rpcquerypingtimeout"`
+	LogRequests      bool          `yaml:"logrequests" flag:"rpclogrequests"`
+	MaxStreams       int           `yaml:"maxstreams" flag:"rpcmaxstreams"`
+	MaxQPS           float64       `yaml:"maxqps" flag:"rpcmaxqps"`
+	MaxFollowRate    int64         `yaml:"maxfollowrate" flag:"rpcmaxfollowrate"`
+	MaxResultRows    int           `yaml:"maxresultrows" flag:"rpcmaxresultrows"`
+	MaxResultBytes   int           `yaml:"maxresultbytes" flag:"rpcmaxresultbytes"`
+}
+
+// HTTP configures the JSON over HTTPS server.
+type HTTP struct {
+	Addr              string `yaml:"addr" flag:"httpsaddr"`
+	CookieHashKey     string `yaml:"cookiehashkey" flag:"cookiehashkey"`
+	CookieBlockKey    string `yaml:"cookieblockkey" flag:"cookieblockkey"`
+	OAuthClientID     string `yaml:"oauthclientid" flag:"oauthclientid"`
+	OAuthClientSecret string `yaml:"oauthclientsecret" flag:"oauthclientsecret"`
+	GitHubOrg         string `yaml:"githuborg" flag:"githuborg"`
+}
+
+// PG configures the PostgreSQL wire protocol server.
+type PG struct {
+	Addr string `yaml:"addr" flag:"pgaddr"`
+}
+
+// Ops configures operational endpoints and tracing.
+type Ops struct {
+	Addr         string `yaml:"addr" flag:"opsaddr"`
+	OTLPEndpoint string `yaml:"otlpendpoint" flag:"otlpendpoint"`
+}
+
+// Cluster configures this node's role in a cluster.
+type Cluster struct {
+	// Role is one of RoleStandalone, RoleLeader or RoleFollower
+	Role           string   `yaml:"role"`
+	NumPartitions  int      `yaml:"numpartitions" flag:"numpartitions"`
+	Partition      int      `yaml:"partition" flag:"partition"`
+	LocalPartition bool     `yaml:"localpartition" flag:"localpartition"`
+	Leader         string   `yaml:"leader" flag:"capture"`
+	LeaderOverride string   `yaml:"leaderoverride" flag:"captureoverride"`
+	Feed           []string `yaml:"feed" flag:"feed"`
+	FeedOverride   []string `yaml:"feedoverride" flag:"feedoverride"`
+	ForwardInserts bool     `yaml:"forwardinserts" flag:"forwardinserts"`
+	// Placement is the path to a YAML file of placement constraints for
+	// followers
+	Placement string `yaml:"placement" flag:"placement"`
+	// Labels describe where a follower runs, like rack=r1
+	Labels []string `yaml:"labels" flag:"labels"`
+	// DimOwners is the path to a YAML file of dimension values owned by
+	// specific partitions
+	DimOwners string `yaml:"dimowners" flag:"dimowners"`
+	// ReplicateTo is the leader of another cluster to which to replicate
+	// ReplicateStreams
+	ReplicateTo      string        `yaml:"replicateto" flag:"replicateto"`
+	ReplicateStreams []string      `yaml:"replicatestreams" flag:"replicatestreams"`
+	QueryBuffer      int           `yaml:"querybuffer" flag:"clusterquerybuffer"`
+	QueryCache       int           `yaml:"querycache" flag:"clusterquerycache"`
+	QueryCacheTTL    time.Duration `yaml:"querycachettl" flag:"clusterquerycachettl"`
+	QueryTimeout     time.Duration `yaml:"querytimeoutmargin" flag:"clusterquerytimeoutmargin"`
+	MaxFollowAge     time.Duration `yaml:"maxfollowage" flag:"maxfollowage"`
+	MaxFollowLag     time.Duration `yaml:"maxfollowlag" flag:"maxfollowlag"`
+}
+
+// TLS configures TLS for the gRPC and HTTPS servers and for connections to
+// other zeno servers.
+type TLS struct {
+	CertFile string        `yaml:"certfile" flag:"certfile"`
+	KeyFile  string        `yaml:"keyfile" flag:"pkfile"`
+	CAFile   string        `yaml:"cafile" flag:"cafile"`
+	Reload   time.Duration `yaml:"reload" flag:"tlsreload"`
+	Insecure bool          `yaml:"insecure" flag:"insecure"`
+}
+
+// Redis configures the connection to Redis used by redis expressions.
+type Redis struct {
+	Addr       string `yaml:"addr" flag:"redis"`
+	CA         string `yaml:"ca" flag:"redisca"`
+	ClientPK   string `yaml:"clientpk" flag:"redisclientpk"`
+	ClientCert string `yaml:"clientcert" flag:"redisclientcert"`
+	CacheSize  int    `yaml:"cachesize" flag:"rediscachesize"`
+}
+
+// setting is a single setting in a Config
+type setting struct {
+	name  string
+	flag  string
+	value reflect.Value
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Load loads a Config from the YAML or TOML file at the given path (TOML if
+// the file name ends in .toml) and then applies overrides from environment
+// variables. If filename is empty, the Config comes from environment variables
+// alone. The returned error describes every problem found in the
+// configuration.
+func Load(filename string) (*Config, error) {
+	var data []byte
+	if filename != "" {
+		var err error
+		data, err = ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read config from %v: %v", filename, err)
+		}
+	}
+	cfg, err := parse(data, strings.EqualFold(filepath.Ext(filename), ".toml"), os.LookupEnv)
+	if err != nil {
+		if filename == "" {
+			filename = "environment"
+		}
+		return nil, fmt.Errorf("Invalid configuration in %v: %v", filename, err)
+	}
+	return cfg, nil
+}
+
+func parse(data []byte, isTOML bool, lookupEnv func(string) (string, bool)) (*Config, error) {
+	if isTOML {
+		var raw map[string]interface{}
+		_, err := toml.Decode(string(data), &raw)
+		if err != nil {
+			return nil, err
+		}
+		// Convert to YAML so that values like durations are parsed the same way
+		data, err = yaml.Marshal(raw)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cfg := &Config{specified: make(map[string]bool)}
+	err := yaml.Unmarshal(data, cfg)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]interface{}
+	err = yaml.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	problems = append(problems, cfg.recordSpecified(raw)...)
+	problems = append(problems, cfg.applyEnv(lookupEnv)...)
+	problems = append(problems, cfg.validate()...)
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("\n  %v", strings.Join(problems, "\n  "))
+	}
+	return cfg, nil
+}
+
+// EnvName returns the name of the environment variable that overrides the
+// named setting, for example ZENO_RPC_ADDR for rpc.addr.
+func EnvName(setting string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(setting, ".", "_", -1))
+}
+
+// Specified indicates whether the named setting (like "rpc.addr") was
+// specified in the file or environment.
+func (cfg *Config) Specified(setting string) bool {
+	return cfg.specified[setting]
+}
+
+// ApplyFlags sets the flags in fs that correspond to the specified settings,
+// except for flags that have already been set (for example on the command
+// line), which take precedence. A cluster role of RoleLeader sets the
+// passthrough flag.
+func (cfg *Config) ApplyFlags(fs *flag.FlagSet) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	set := func(name string, flagName string, value string) error {
+		if explicit[flagName] {
+			return nil
+		}
+		err := fs.Set(flagName, value)
+		if err != nil {
+			return fmt.Errorf("Unable to apply %v to flag -%v: %v", name, flagName, err)
+		}
+		return nil
+	}
+
+	for _, s := range cfg.settings() {
+		if s.flag == "" || !cfg.specified[s.name] {
+			continue
+		}
+		err := set(s.name, s.flag, s.format())
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.Cluster.Role == RoleLeader {
+		return set("cluster.role", "passthrough", "true")
+	}
+	return nil
+}
+
+func (cfg *Config) settings() []*setting {
+	var settings []*setting
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		section := t.Field(i)
+		if section.Type.Kind() != reflect.Struct {
+			// tables and unexported fields
+			continue
+		}
+		sectionName := yamlName(section)
+		sv := v.Field(i)
+		for j := 0; j < section.Type.NumField(); j++ {
+			field := section.Type.Field(j)
+			settings = append(settings, &setting{
+				name:  sectionName + "." + yamlName(field),
+				flag:  field.Tag.Get("flag"),
+				value: sv.Field(j),
+			})
+		}
+	}
+	return settings
+}
+
+func yamlName(field reflect.StructField) string {
+	return strings.Split(field.Tag.Get("yaml"), ",")[0]
+}
+
+func (cfg *Config) recordSpecified(raw map[string]interface{}) []string {
+	known := make(map[string]bool)
+	sections := map[string]bool{"tables": true}
+	for _, s := range cfg.settings() {
+		known[s.name] = true
+		sections[strings.Split(s.name, ".")[0]] = true
+	}
+
+	var problems []string
+	for _, section := range sortedKeys(raw) {
+		if !sections[section] {
+			problems = append(problems, fmt.Sprintf("%v: unknown section", section))
+			continue
+		}
+		if section == "tables" {
+			continue
+		}
+		values, ok := raw[section].(map[interface{}]interface{})
+		if !ok {
+			if raw[section] != nil {
+				problems = append(problems, fmt.Sprintf("%v: expected a map of settings", section))
+			}
+			continue
+		}
+		for key := range values {
+			name := fmt.Sprintf("%v.%v", section, key)
+			if !known[name] {
+				problems = append(problems, fmt.Sprintf("%v: unknown setting", name))
+				continue
+			}
+			cfg.specified[name] = true
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+func (cfg *Config) applyEnv(lookupEnv func(string) (string, bool)) []string {
+	var problems []string
+	for _, s := range cfg.settings() {
+		envName := EnvName(s.name)
+		value, found := lookupEnv(envName)
+		if !found {
+			continue
+		}
+		err := s.parse(value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%v: invalid value %q in %v: %v", s.name, value, envName, err))
+			continue
+		}
+		cfg.specified[s.name] = true
+	}
+	return problems
+}
+
+func (s *setting) parse(value string) error {
+	if s.value.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		s.value.SetInt(int64(d))
+		return nil
+	}
+
+	switch s.value.Kind() {
+	case reflect.String:
+		s.value.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		s.value.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		s.value.SetInt(i)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		s.value.SetFloat(f)
+	case reflect.Slice:
+		var values []string
+		for _, v := range strings.Split(value, ",") {
+			values = append(values, strings.TrimSpace(v))
+		}
+		s.value.Set(reflect.ValueOf(values))
+	default:
+		return fmt.Errorf("Unsupported type %v", s.value.Type())
+	}
+	return nil
+}
+
+// format formats the setting's value the way that the corresponding flag
+// expects it.
+func (s *setting) format() string {
+	switch v := s.value.Interface().(type) {
+	case time.Duration:
+		return v.String()
+	case []string:
+		return strings.Join(v, ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func (cfg *Config) validate() []string {
+	var problems []string
+	problemf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	for _, s := range cfg.settings() {
+		negative := false
+		switch s.value.Kind() {
+		case reflect.Int, reflect.Int64:
+			negative = s.value.Int() < 0
+		case reflect.Float64:
+			negative = s.value.Float() < 0
+		}
+		if negative {
+			problemf("%v: must not be negative", s.name)
+		}
+	}
+
+	if cfg.DB.MaxMemory > 1 {
+		problemf("db.maxmemory: must be a ratio between 0 and 1, e.g. 0.7 for 70%% of system memory")
+	}
+	if cfg.Specified("db.ispformat") {
+		switch strings.ToLower(strings.TrimSpace(cfg.DB.ISPFormat)) {
+		case "ip2location", "maxmind":
+			// okay
+		default:
+			problemf("db.ispformat: must be ip2location or maxmind, not %q", cfg.DB.ISPFormat)
+		}
+	}
+
+	c := cfg.Cluster
+	switch c.Role {
+	case "", RoleStandalone, RoleLeader:
+		if c.Leader != "" {
+			problemf("cluster.leader: only allowed with cluster.role %v", RoleFollower)
+		}
+		if c.ForwardInserts {
+			problemf("cluster.forwardinserts: only allowed with cluster.role %v", RoleFollower)
+		}
+		if len(c.Feed) > 0 {
+			problemf("cluster.feed: only allowed with cluster.role %v", RoleFollower)
+		}
+	case RoleFollower:
+		if c.Leader == "" {
+			problemf("cluster.leader: required with cluster.role %v", RoleFollower)
+		}
+	default:
+		problemf("cluster.role: must be one of %v, %v or %v, not %q", RoleStandalone, RoleLeader, RoleFollower, c.Role)
+	}
+	if c.ReplicateTo != "" && c.Role == RoleFollower {
+		problemf("cluster.replicateto: not supported with cluster.role %v", c.Role)
+	}
+	if c.ReplicateTo != "" && len(c.ReplicateStreams) == 0 {
+		problemf("cluster.replicatestreams: required with cluster.replicateto")
+	}
+	if c.Placement != "" && c.Role != RoleLeader {
+		problemf("cluster.placement: only allowed with cluster.role %v", RoleLeader)
+	}
+	if len(c.Labels) > 0 && c.Role != RoleFollower {
+		problemf("cluster.labels: only allowed with cluster.role %v", RoleFollower)
+	}
+	for _, label := range c.Labels {
+		if !strings.Contains(label, "=") {
+			problemf("cluster.labels: %q must look like key=value", label)
+		}
+	}
+	if c.DimOwners != "" && c.Role != RoleLeader {
+		problemf("cluster.dimowners: only allowed with cluster.role %v", RoleLeader)
+	}
+	if c.LocalPartition && c.Role != RoleLeader {
+		problemf("cluster.localpartition: only allowed with cluster.role %v", RoleLeader)
+	}
+	if cfg.Specified("cluster.numpartitions") && c.NumPartitions < 1 {
+		problemf("cluster.numpartitions: must be at least 1")
+	}
+	if cfg.Specified("cluster.numpartitions") && c.NumPartitions >= 1 && c.Partition >= c.NumPartitions {
+		problemf("cluster.partition: must be less than cluster.numpartitions (%d)", c.NumPartitions)
+	}
+	if len(c.FeedOverride) > 0 && len(c.FeedOverride) != len(c.Feed) {
+		problemf("cluster.feedoverride: must have one address per address in cluster.feed")
+	}
+	if cfg.DB.RecordStats && (c.Role == RoleLeader || c.Role == RoleFollower) {
+		problemf("db.recordstats: not supported with cluster.role %v", c.Role)
+	}
+	if cfg.DB.Schedules != "" && c.Role == RoleFollower {
+		problemf("db.schedules: not supported with cluster.role %v", c.Role)
+	}
+	if cfg.DB.Rules != "" && c.Role == RoleFollower {
+		problemf("db.rules: not supported with cluster.role %v", c.Role)
+	}
+
+	for _, name := range sortedTableNames(cfg.Tables) {
+		opts := cfg.Tables[name]
+		if opts == nil {
+			problemf("tables.%v: missing definition", name)
+			continue
+		}
+		if strings.TrimSpace(opts.SQL) == "" {
+			problemf("tables.%v.sql: required", name)
+		} else if _, err := sqlparser.Parse(opts.SQL); err != nil {
+			problemf("tables.%v.sql: %v", name, err)
+		}
+		if !opts.Virtual && opts.RetentionPeriod <= 0 {
+			problemf("tables.%v.retentionperiod: required unless the table is virtual", name)
+		}
+	}
+
+	return problems
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedTableNames(schema zenodb.Schema) []string {
+	names := make([]string, 0, len(schema))
+	for name := range schema {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
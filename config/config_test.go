@@ -0,0 +1,214 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const yamlConfig = `
+db:
+  dir: /tmp/zeno
+  walsync: 1s
+  maxmemory: 0.5
+rpc:
+  addr: 0.0.0.0:17712
+cluster:
+  role: follower
+  leader: leader:17712
+  partition: 1
+  numpartitions: 4
+  feed: ["a:17712", "b:17712"]
+tables:
+  combined:
+    retentionperiod: 24h
+    sql: SELECT SUM(requests) AS requests FROM inbound GROUP BY x, period(1m)
+`
+
+const tomlConfig = `
+[db]
+dir = "/tmp/zeno"
+walsync = "1s"
+maxmemory = 0.5
+
+[rpc]
+addr = "0.0.0.0:17712"
+
+[cluster]
+role = "follower"
+leader = "leader:17712"
+partition = 1
+numpartitions = 4
+feed = ["a:17712", "b:17712"]
+
+[tables.combined]
+retentionperiod = "24h"
+sql = """
+SELECT SUM(requests) AS requests FROM inbound GROUP BY x, period(1m)"""
+`
+
+func TestParse(t *testing.T) {
+	env := map[string]string{
+		"ZENO_RPC_PASSWORD":  "secret",
+		"ZENO_TLS_RELOAD":    "30s",
+		"ZENO_CLUSTER_FEED":  "c:17712, d:17712",
+		"ZENO_DB_ENABLEGEO":  "true",
+		"ZENO_UNRELATED_ENV": "ignored",
+	}
+	lookupEnv := func(name string) (string, bool) {
+		value, found := env[name]
+		return value, found
+	}
+
+	for _, isTOML := range []bool{false, true} {
+		data := yamlConfig
+		if isTOML {
+			data = tomlConfig
+		}
+		cfg, err := parse([]byte(data), isTOML, lookupEnv)
+		if !assert.NoError(t, err, "TOML: %v", isTOML) {
+			continue
+		}
+		assert.Equal(t, "/tmp/zeno", cfg.DB.Dir)
+		assert.Equal(t, time.Second, cfg.DB.WALSync)
+		assert.Equal(t, 0.5, cfg.DB.MaxMemory)
+		assert.True(t, cfg.DB.EnableGeo)
+		assert.Equal(t, "0.0.0.0:17712", cfg.RPC.Addr)
+		assert.Equal(t, "secret", cfg.RPC.Password)
+		assert.Equal(t, 30*time.Second, cfg.TLS.Reload)
+		assert.Equal(t, RoleFollower, cfg.Cluster.Role)
+		assert.Equal(t, 1, cfg.Cluster.Partition)
+		assert.Equal(t, 4, cfg.Cluster.NumPartitions)
+		assert.Equal(t, []string{"c:17712", "d:17712"}, cfg.Cluster.Feed, "Environment should override file")
+		if assert.NotNil(t, cfg.Tables["combined"]) {
+			assert.Equal(t, 24*time.Hour, cfg.Tables["combined"].RetentionPeriod)
+			assert.Equal(t, "SELECT SUM(requests) AS requests FROM inbound GROUP BY x, period(1m)", cfg.Tables["combined"].SQL)
+		}
+		assert.True(t, cfg.Specified("db.dir"))
+		assert.True(t, cfg.Specified("rpc.password"))
+		assert.False(t, cfg.Specified("rpc.credentials"))
+	}
+}
+
+func TestValidation(t *testing.T) {
+	noEnv := func(name string) (string, bool) {
+		return "", false
+	}
+	_, err := parse([]byte(`
+db:
+  maxmemory: 2
+  walsync: -1s
+  schedules: schedules.yaml
+  rules: rules.yaml
+rpc:
+  pasword: secret
+cluster:
+  role: follower
+  partition: 4
+  numpartitions: 4
+  feedoverride: [a]
+  localpartition: true
+  replicateto: dr:17712
+  dimowners: owners.yaml
+  placement: placement.yaml
+  labels: [rack]
+things:
+  a: b
+tables:
+  bad:
+    sql: SELECT FROM WHERE
+  noretention:
+    sql: SELECT * FROM inbound
+`), false, noEnv)
+	if assert.Error(t, err) {
+		msg := err.Error()
+		for _, problem := range []string{
+			"db.maxmemory: must be a ratio between 0 and 1",
+			"db.walsync: must not be negative",
+			"rpc.pasword: unknown setting",
+			"things: unknown section",
+			"cluster.leader: required with cluster.role follower",
+			"cluster.partition: must be less than cluster.numpartitions (4)",
+			"cluster.feedoverride: must have one address per address in cluster.feed",
+			"cluster.localpartition: only allowed with cluster.role leader",
+			"cluster.dimowners: only allowed with cluster.role leader",
+			"cluster.placement: only allowed with cluster.role leader",
+			`cluster.labels: "rack" must look like key=value`,
+			"db.schedules: not supported with cluster.role follower",
+			"db.rules: not supported with cluster.role follower",
+			"cluster.replicateto: not supported with cluster.role follower",
+			"cluster.replicatestreams: required with cluster.replicateto",
+			"tables.bad.sql:",
+			"tables.noretention.retentionperiod: required unless the table is virtual",
+		} {
+			assert.Contains(t, msg, problem)
+		}
+	}
+
+	_, err = parse(nil, false, func(name string) (string, bool) {
+		return "notanumber", name == "ZENO_CLUSTER_PARTITION"
+	})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "ZENO_CLUSTER_PARTITION")
+	}
+
+	_, err = parse([]byte("cluster:\n  role: boss\n"), false, noEnv)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `cluster.role: must be one of standalone, leader or follower, not "boss"`)
+	}
+}
+
+func TestLoadAndApplyFlags(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenoconfig")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+	filename := filepath.Join(tmpDir, "zeno.yaml")
+	err = ioutil.WriteFile(filename, []byte(`
+db:
+  dir: /tmp/zeno
+  walsync: 0s
+rpc:
+  addr: 0.0.0.0:17712
+cluster:
+  role: leader
+  numpartitions: 4
+`), 0644)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	cfg, err := Load(filename)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	fs := flag.NewFlagSet("zeno", flag.ContinueOnError)
+	dbdir := fs.String("dbdir", "zenodata", "")
+	walSync := fs.Duration("walsync", 5*time.Second, "")
+	addr := fs.String("addr", "localhost:17712", "")
+	passthrough := fs.Bool("passthrough", false, "")
+	numPartitions := fs.Int("numpartitions", 1, "")
+	password := fs.String("password", "", "")
+	if !assert.NoError(t, fs.Parse([]string{"-addr", "localhost:1234"})) {
+		return
+	}
+	if !assert.NoError(t, cfg.ApplyFlags(fs)) {
+		return
+	}
+	assert.Equal(t, "/tmp/zeno", *dbdir)
+	assert.Equal(t, time.Duration(0), *walSync, "Zero values in the file should still apply")
+	assert.Equal(t, "localhost:1234", *addr, "Command-line flags should take precedence")
+	assert.True(t, *passthrough, "Leader role should make node a passthrough")
+	assert.Equal(t, 4, *numPartitions)
+	assert.Equal(t, "", *password, "Unspecified settings should leave flags alone")
+
+	_, err = Load(filepath.Join(tmpDir, "missing.yaml"))
+	assert.Error(t, err)
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/getlantern/bytemap"
 	"github.com/getlantern/zenodb/encoding"
 	"github.com/getlantern/zenodb/expr"
+	"gopkg.in/vmihailenco/msgpack.v2"
 	"strings"
 	"sync"
 	"time"
@@ -22,6 +23,16 @@ var (
 	// exceeded. Results may be incomplete.
 	ErrDeadlineExceeded = errors.New("deadline exceeded")
 
+	// ErrPartialResults indicates that the deadline for a clustered query was
+	// exceeded, or that some partitions exceeded their adaptive timeouts, after
+	// only some of the partitions had returned their results. Like
+	// ErrDeadlineExceeded, results are incomplete.
+	ErrPartialResults = errors.New("partial results")
+
+	// ErrMaxMemoryExceeded indicates that grouping needed more memory than the
+	// query's MAX_MEMORY hint allows.
+	ErrMaxMemoryExceeded = errors.New("query exceeded its maximum memory")
+
 	// PointsField is the synthetic field that counts number of submitted points.
 	PointsField = NewField("_points", expr.SUM("_point"))
 
@@ -30,6 +41,13 @@ var (
 	mdmx sync.RWMutex
 )
 
+// IsDeadlineExceeded indicates whether the given error means that iterating
+// stopped at a deadline, so that whatever results were obtained so far are
+// still usable.
+func IsDeadlineExceeded(err error) bool {
+	return err == ErrDeadlineExceeded || err == ErrPartialResults
+}
+
 // Field is a named expr.Expr
 type Field struct {
 	Expr expr.Expr
@@ -52,6 +70,46 @@ func (f Field) Equals(o Field) bool {
 	return f.String() == o.String()
 }
 
+// EncodeMsgpack encodes the Field with its Expr serialized by expr.Marshal, so
+// that other versions can read it.
+func (f Field) EncodeMsgpack(enc *msgpack.Encoder) error {
+	var exprBytes []byte
+	if f.Expr != nil {
+		var err error
+		exprBytes, err = expr.Marshal(f.Expr)
+		if err != nil {
+			return err
+		}
+	}
+	return enc.Encode(map[string]interface{}{"Name": f.Name, "Expr": exprBytes})
+}
+
+// DecodeMsgpack decodes a Field encoded with EncodeMsgpack or by older
+// versions, which encoded the Expr directly.
+func (f *Field) DecodeMsgpack(dec *msgpack.Decoder) error {
+	m := make(map[string]interface{})
+	err := dec.Decode(&m)
+	if err != nil {
+		return err
+	}
+	f.Name, _ = m["Name"].(string)
+	switch e := m["Expr"].(type) {
+	case nil:
+		f.Expr = nil
+	case []byte:
+		if len(e) == 0 {
+			f.Expr = nil
+			return nil
+		}
+		f.Expr, err = expr.Unmarshal(e)
+	case expr.Expr:
+		f.Expr = e
+	default:
+		err = fmt.Errorf("Unable to decode expression of type %T for field %v", e, f.Name)
+	}
+	return err
+}
+
 type Fields []Field
 
 func (fields Fields) Names() []string {
@@ -176,6 +234,9 @@ type FlatRow struct {
 	Key bytemap.ByteMap
 	// Values for each field
 	Values []float64
+	// Nulls indicates which fields had no data in this period. Nil if all fields
+	// had data.
+	Nulls  []bool
 	fields Fields
 }
 
@@ -183,6 +244,12 @@ func (row *FlatRow) SetFields(fields Fields) {
 	row.fields = fields
 }
 
+// IsNull indicates whether the field at the given index had no data in this
+// row's period, as opposed to having a value of 0.
+func (row *FlatRow) IsNull(idx int) bool {
+	return idx < len(row.Nulls) && row.Nulls[idx]
+}
+
 type Source interface {
 	GetGroupBy() []GroupBy
 
@@ -278,7 +345,7 @@ type TimeoutGuard interface {
 	TimedOut() bool
 
 	// Proceed returns false, ErrDeadlineExceeded if the context deadline has been
-	// exceeded
+	// exceeded, or false and the context's error if it has been canceled
 	Proceed() (more bool, err error)
 
 	// ProceedAfter returns origMore, origErr if origMore is false or origErr is
@@ -287,7 +354,9 @@ type TimeoutGuard interface {
 }
 
 type timeoutGuard struct {
-	deadline time.Time
+	ctx         context.Context
+	deadline    time.Time
+	hasDeadline bool
 }
 
 type noopTimeoutGuard struct{}
@@ -295,21 +364,30 @@ type noopTimeoutGuard struct{}
 // Guard creates a new TimeoutGuard for the given Context.
 func Guard(ctx context.Context) TimeoutGuard {
 	deadline, hasDeadline := ctx.Deadline()
-	if !hasDeadline {
+	if !hasDeadline && ctx.Done() == nil {
+		// Context can never be done
 		return &noopTimeoutGuard{}
 	}
-	return &timeoutGuard{deadline}
+	return &timeoutGuard{ctx, deadline, hasDeadline}
 }
 
 func (g *timeoutGuard) TimedOut() bool {
-	return time.Now().After(g.deadline)
+	return g.hasDeadline && time.Now().After(g.deadline)
 }
 
 func (g *timeoutGuard) Proceed() (bool, error) {
 	if g.TimedOut() {
 		return false, ErrDeadlineExceeded
 	}
-	return true, nil
+	select {
+	case <-g.ctx.Done():
+		if g.ctx.Err() == context.DeadlineExceeded {
+			return false, ErrDeadlineExceeded
+		}
+		return false, g.ctx.Err()
+	default:
+		return true, nil
+	}
 }
 
 func (g *timeoutGuard) ProceedAfter(origMore bool, origErr error) (more bool, err error) {
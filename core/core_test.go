@@ -9,6 +9,7 @@ import (
 	"github.com/getlantern/zenodb/encoding"
 	. "github.com/getlantern/zenodb/expr"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/vmihailenco/msgpack.v2"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -78,6 +79,20 @@ func TestFlatRowFilter(t *testing.T) {
 	assert.EqualValues(t, 0, atomic.LoadInt64(&totalA), "Filter should have excluded anything with a value for A")
 }
 
+func TestKeyFilter(t *testing.T) {
+	f := NewKeyFilter(map[string][]string{"dc": {"eu", "us"}, "x": {"y"}})
+	assert.True(t, f.Matches(bytemap.New(map[string]interface{}{"dc": "eu", "x": "y"})))
+	assert.True(t, f.Matches(bytemap.New(map[string]interface{}{"dc": "us", "x": "y", "z": 1})))
+	assert.False(t, f.Matches(bytemap.New(map[string]interface{}{"dc": "asia", "x": "y"})))
+	assert.False(t, f.Matches(bytemap.New(map[string]interface{}{"dc": "eu"})), "Missing dim shouldn't match")
+	assert.True(t, f.Matches(bytemap.New(map[string]interface{}{"dc": 5, "x": "y"})), "Non-string values should be left to the WHERE clause")
+	assert.Equal(t, "dc IN (eu, us) AND x IN (y)", f.String())
+
+	var nilFilter *KeyFilter
+	assert.True(t, nilFilter.Matches(bytemap.New(map[string]interface{}{"dc": "asia"})))
+	assert.Nil(t, NewKeyFilter(nil))
+}
+
 func TestDeadlineFilter(t *testing.T) {
 	f := RowFilter(&goodSource{}, "deadline", func(ctx context.Context, key bytemap.ByteMap, fields Fields, vals Vals) (bytemap.ByteMap, Vals, error) {
 		// Slow things down by sleeping for a bit
@@ -126,6 +141,33 @@ func TestDeadlineGroup(t *testing.T) {
 	assert.EqualValues(t, 0, atomic.LoadInt64(&rowsSeen), "Should have gotten 0 rows before deadline exceeded")
 }
 
+func TestCancelGroup(t *testing.T) {
+	g := Group(&infiniteSource{}, GroupOpts{
+		By: []GroupBy{NewGroupBy("x", goexpr.Param("x"))},
+		Fields: StaticFieldSource{
+			Field{
+				Name: "total",
+				Expr: ADD(eA, eB),
+			},
+		},
+		Resolution: resolution * 2,
+		AsOf:       asOf.Add(2 * resolution),
+		Until:      until.Add(-2 * resolution),
+	})
+
+	rowsSeen := int64(0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(25*time.Millisecond, cancel)
+	err := g.Iterate(ctx, FieldsIgnored, func(key bytemap.ByteMap, vals Vals) (bool, error) {
+		atomic.AddInt64(&rowsSeen, 1)
+		return true, nil
+	})
+
+	assert.Equal(t, context.Canceled, err, "Should have gotten canceled error")
+	assert.EqualValues(t, 0, atomic.LoadInt64(&rowsSeen), "Should have gotten 0 rows after cancel")
+}
+
 func TestGroupSingle(t *testing.T) {
 	eTotal := ADD(eA, eB)
 	gx := Group(&goodSource{}, GroupOpts{
@@ -314,6 +356,21 @@ func TestGroupNone(t *testing.T) {
 	assert.Empty(t, expectedValues, "All combinations should have been seen")
 }
 
+func TestGroupMaxBytes(t *testing.T) {
+	gx := Group(&goodSource{}, GroupOpts{
+		Fields:     StaticFieldSource{totalField},
+		Resolution: resolution * 10,
+		MaxBytes:   1,
+	})
+	rows := 0
+	err := gx.Iterate(context.Background(), FieldsIgnored, func(key bytemap.ByteMap, vals Vals) (bool, error) {
+		rows++
+		return true, nil
+	})
+	assert.Equal(t, ErrMaxMemoryExceeded, err)
+	assert.Zero(t, rows, "Shouldn't emit partial groups")
+}
+
 func TestFlattenSortOffsetAndLimit(t *testing.T) {
 	// TODO: add test that tests flattening of rows that contain multiple periods
 	// worth of values
@@ -342,6 +399,10 @@ func TestFlattenSortOffsetAndLimit(t *testing.T) {
 		assert.Equal(t, expectedTS.UnixNano(), row.TS)
 		assert.EqualValues(t, expectedA, row.Values[0])
 		assert.EqualValues(t, expectedB, row.Values[1])
+		// test data never contains 0, so 0 means that the field had no data
+		assert.Equal(t, expectedA == 0, row.IsNull(0))
+		assert.Equal(t, expectedB == 0, row.IsNull(1))
+		assert.False(t, row.IsNull(2), "constants should never be null")
 		return true, nil
 	})
 
@@ -559,3 +620,28 @@ func (s *totalingSource) Iterate(ctx context.Context, onFields OnFields, onRow O
 		return onRow(key, Vals{val})
 	})
 }
+
+func TestFieldMsgpack(t *testing.T) {
+	fields := Fields{NewField("a", SUM("a")), NewField("b", WAVG("b", "c")), Field{Name: "empty"}}
+	b, err := msgpack.Marshal(fields)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var decoded Fields
+	if assert.NoError(t, msgpack.Unmarshal(b, &decoded)) && assert.Len(t, decoded, 3) {
+		assert.True(t, fields[0].Equals(decoded[0]))
+		assert.True(t, fields[1].Equals(decoded[1]))
+		assert.Equal(t, "empty", decoded[2].Name)
+		assert.Nil(t, decoded[2].Expr)
+	}
+
+	// older versions encoded the Expr directly
+	legacy, err := msgpack.Marshal(map[string]interface{}{"Name": "a", "Expr": SUM("a")})
+	if !assert.NoError(t, err) {
+		return
+	}
+	var field Field
+	if assert.NoError(t, msgpack.Unmarshal(legacy, &field)) {
+		assert.True(t, fields[0].Equals(field))
+	}
+}
@@ -54,30 +54,48 @@ func (f *flatten) Iterate(ctx context.Context, onFields OnFields, onRow OnFlatRo
 			}
 		}
 
-		// Iterate
-		ts := asOf
-		for ; !ts.After(until); ts = ts.Add(resolution) {
-			tsNanos := ts.UnixNano()
-			row := &FlatRow{
-				TS:     tsNanos,
-				Key:    key,
-				Values: make([]float64, numFields),
-				fields: fields,
+		// Collect rows for all periods in which any non-constant field has a value
+		rows := make([]*FlatRow, int(until.Sub(asOf)/resolution)+1)
+		for i, field := range fields {
+			if field.Expr.IsConstant() {
+				continue
 			}
-			anyNonConstantValueFound := false
-			for i, field := range fields {
-				val, found := vals[i].ValueAtTime(ts, field.Expr, resolution)
-				if found && !field.Expr.IsConstant() {
-					anyNonConstantValueFound = true
+			vals[i].IterateReverse(field.Expr, resolution, func(ts time.Time, val float64) bool {
+				period := int(ts.Sub(asOf) / resolution)
+				row := rows[period]
+				if row == nil {
+					row = &FlatRow{
+						TS:     ts.UnixNano(),
+						Key:    key,
+						Values: make([]float64, numFields),
+						Nulls:  make([]bool, numFields),
+						fields: fields,
+					}
+					// Non-constant fields are null until we find a value for them
+					for j, f := range fields {
+						row.Nulls[j] = !f.Expr.IsConstant()
+					}
+					rows[period] = row
 				}
 				row.Values[i] = val
+				row.Nulls[i] = false
+				return true
+			})
+		}
+
+		for _, row := range rows {
+			if row == nil {
+				continue
 			}
-			if anyNonConstantValueFound {
-				more, err := onRow(row)
-				if !more || err != nil {
-					return more, err
+			for i, field := range fields {
+				if field.Expr.IsConstant() {
+					row.Values[i], _ = vals[i].ValueAt(0, field.Expr)
 				}
 			}
+			more, err := onRow(row)
+			if !more || err != nil {
+				return more, err
+			}
 		}
 
 		return guard.Proceed()
@@ -34,6 +34,15 @@ func NewGroupBy(name string, ex goexpr.Expr) GroupBy {
 	}
 }
 
+// GroupByNames returns the names of the given GroupBys.
+func GroupByNames(groupBy []GroupBy) []string {
+	names := make([]string, 0, len(groupBy))
+	for _, gb := range groupBy {
+		names = append(names, gb.Name)
+	}
+	return names
+}
+
 type sortedGroupBys []GroupBy
 
 func (gbs sortedGroupBys) Len() int      { return len(gbs) }
@@ -59,6 +68,9 @@ type GroupOpts struct {
 	AsOf        time.Time
 	Until       time.Time
 	StrideSlice time.Duration
+	// MaxBytes, if greater than 0, limits the size of the grouped data. Grouping
+	// fails with ErrMaxMemoryExceeded once it's exceeded.
+	MaxBytes int64
 }
 
 func Group(source RowSource, opts GroupOpts) RowSource {
@@ -152,7 +164,7 @@ func (g *group) Iterate(ctx context.Context, onFields OnFields, onRow OnRow) err
 		g.Fields = PassthroughFieldSource
 	}
 
-	updateTree := func(key bytemap.ByteMap, vals Vals) {
+	updateTree := func(key bytemap.ByteMap, vals Vals) error {
 		// Lazily initialize bytetree
 		if bt == nil {
 			bt = bytetree.New(
@@ -168,6 +180,10 @@ func (g *group) Iterate(ctx context.Context, onFields OnFields, onRow OnRow) err
 		metadata := key
 		key = sliceKey(key)
 		bt.Update(key, vals, nil, metadata)
+		if g.MaxBytes > 0 && int64(bt.Bytes()) > g.MaxBytes {
+			return ErrMaxMemoryExceeded
+		}
+		return nil
 	}
 
 	err := g.source.Iterate(ctx, func(fields Fields) error {
@@ -187,13 +203,16 @@ func (g *group) Iterate(ctx context.Context, onFields OnFields, onRow OnRow) err
 			ctabs[ctab] = nil
 			kvs = append(kvs, &keyedVals{key, vals})
 		} else {
-			updateTree(key, vals)
+			updateErr := updateTree(key, vals)
+			if updateErr != nil {
+				return false, updateErr
+			}
 		}
 		return guard.Proceed()
 	})
 
 	var walkErr error
-	if err != ErrDeadlineExceeded {
+	if !IsDeadlineExceeded(err) && err != context.Canceled && err != ErrMaxMemoryExceeded {
 		if g.Crosstab != nil {
 			origOutFields := outFields
 			sortedCtabs := make([]string, 0, len(ctabs))
@@ -235,7 +254,10 @@ func (g *group) Iterate(ctx context.Context, onFields OnFields, onRow OnRow) err
 				if guard.TimedOut() {
 					return ErrDeadlineExceeded
 				}
-				updateTree(kv.key, kv.vals)
+				updateErr := updateTree(kv.key, kv.vals)
+				if updateErr != nil {
+					return updateErr
+				}
 			}
 		}
 
@@ -287,5 +309,8 @@ func (g *group) String() string {
 	if g.StrideSlice > 0 {
 		result.WriteString(fmt.Sprintf("\n       stride slice: %v", g.StrideSlice))
 	}
+	if g.MaxBytes > 0 {
+		result.WriteString(fmt.Sprintf("\n       max bytes: %d", g.MaxBytes))
+	}
 	return result.String()
 }
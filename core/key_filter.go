@@ -0,0 +1,69 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/getlantern/bytemap"
+)
+
+// KeyFilter restricts dimensions to fixed sets of string values. Tables that
+// support it check keys against the KeyFilter while scanning and skip keys that
+// don't match before decoding the data stored under them.
+type KeyFilter struct {
+	// Values are the allowed values, keyed by dim
+	Values map[string][]string
+}
+
+// NewKeyFilter constructs a KeyFilter that allows only the given values for
+// each dim, or returns nil if values is empty.
+func NewKeyFilter(values map[string][]string) *KeyFilter {
+	if len(values) == 0 {
+		return nil
+	}
+	return &KeyFilter{Values: values}
+}
+
+// Matches indicates whether the given key might match the filter. Only string
+// values are compared, keys with non-string values for a filtered dim always
+// match. A nil KeyFilter matches everything.
+func (f *KeyFilter) Matches(key bytemap.ByteMap) bool {
+	if f == nil {
+		return true
+	}
+	for dim, allowed := range f.Values {
+		value := key.Get(dim)
+		if value == nil {
+			return false
+		}
+		s, isString := value.(string)
+		if !isString {
+			continue
+		}
+		found := false
+		for _, candidate := range allowed {
+			if s == candidate {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *KeyFilter) String() string {
+	dims := make([]string, 0, len(f.Values))
+	for dim := range f.Values {
+		dims = append(dims, dim)
+	}
+	sort.Strings(dims)
+	parts := make([]string, 0, len(dims))
+	for _, dim := range dims {
+		parts = append(parts, fmt.Sprintf("%v IN (%v)", dim, strings.Join(f.Values[dim], ", ")))
+	}
+	return strings.Join(parts, " AND ")
+}
@@ -65,7 +65,7 @@ func (s *sorter) Iterate(ctx context.Context, onFields OnFields, onRow OnFlatRow
 		return guard.Proceed()
 	})
 
-	if err != ErrDeadlineExceeded {
+	if !IsDeadlineExceeded(err) && err != context.Canceled {
 		sort.Sort(rows)
 		for _, row := range rows.rows {
 			if guard.TimedOut() {
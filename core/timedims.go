@@ -0,0 +1,165 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+// Time dims are dimensions that are derived from the timestamps of periods at
+// query time, so that data can be grouped by them (e.g. for seasonal analysis)
+// without storing them.
+const (
+	// DimHourOfDay is the hour of the day in UTC, from 0 to 23.
+	DimHourOfDay = "_hour_of_day"
+	// DimDayOfWeek is the day of the week in UTC, from 0 (Sunday) to 6
+	// (Saturday).
+	DimDayOfWeek = "_day_of_week"
+	// DimMonth is the month in UTC, from 1 (January) to 12 (December).
+	DimMonth = "_month"
+)
+
+var timeDims = map[string]func(ts time.Time) int{
+	DimHourOfDay: func(ts time.Time) int { return ts.Hour() },
+	DimDayOfWeek: func(ts time.Time) int { return int(ts.Weekday()) },
+	DimMonth:     func(ts time.Time) int { return int(ts.Month()) },
+}
+
+// IsTimeDim indicates whether the given dim is one of the time dims.
+func IsTimeDim(dim string) bool {
+	return timeDims[dim] != nil
+}
+
+// TimeDimsIn returns the time dims that the given GroupBys reference.
+func TimeDimsIn(groupBys []GroupBy) []string {
+	var dims []string
+	seen := make(map[string]bool)
+	for _, groupBy := range groupBys {
+		groupBy.Expr.WalkParams(func(param string) {
+			if IsTimeDim(param) && !seen[param] {
+				seen[param] = true
+				dims = append(dims, param)
+			}
+		})
+	}
+	return dims
+}
+
+// DeriveTimeDims splits each row of the given source by the values that the
+// given time dims take for its periods and adds those values to the row's key,
+// so that a subsequent Group can group by them. Rows whose keys already
+// contain a time dim, for example because they come from a cluster partition
+// that already derived it, keep it as is.
+//
+// Time dims are derived from the timestamps of the source's periods, so they
+// need a resolution that's at least as fine as the time dims themselves. To get
+// a single row per time dim value, group with a resolution that covers the
+// whole time range of the query.
+func DeriveTimeDims(source RowSource, dims []string) RowSource {
+	return &timeDimsDeriver{
+		rowTransform{source},
+		dims,
+	}
+}
+
+type timeDimsDeriver struct {
+	rowTransform
+	dims []string
+}
+
+// timeDimsSplit is the part of a row whose periods share the same values for
+// the derived time dims.
+type timeDimsSplit struct {
+	values []int
+	vals   Vals
+}
+
+func (d *timeDimsDeriver) Iterate(ctx context.Context, onFields OnFields, onRow OnRow) error {
+	guard := Guard(ctx)
+	resolution := d.GetResolution()
+
+	var fields Fields
+	return d.source.Iterate(ctx, func(inFields Fields) error {
+		fields = inFields
+		return onFields(inFields)
+	}, func(key bytemap.ByteMap, vals Vals) (bool, error) {
+		var missing []string
+		for _, dim := range d.dims {
+			if key.Get(dim) == nil {
+				missing = append(missing, dim)
+			}
+		}
+		if len(missing) == 0 || resolution <= 0 {
+			return onRow(key, vals)
+		}
+
+		var splits []*timeDimsSplit
+		splitsByID := make(map[int]*timeDimsSplit)
+		for i, field := range fields {
+			if i >= len(vals) {
+				break
+			}
+			seq := vals[i]
+			width := field.Expr.EncodedWidth()
+			if len(seq) == 0 || width == 0 {
+				continue
+			}
+			until := seq.Until()
+			numPeriods := seq.NumPeriods(width)
+			data := seq[encoding.Width64bits:]
+			for period := 0; period < numPeriods; period++ {
+				periodData := data[period*width : (period+1)*width]
+				if _, wasSet, _ := field.Expr.Get(periodData); !wasSet {
+					continue
+				}
+				ts := until.Add(-1 * time.Duration(period) * resolution).In(time.UTC)
+				// None of the time dims has more than 100 values, so they can be
+				// combined into a single id
+				id := 0
+				values := make([]int, 0, len(missing))
+				for _, dim := range missing {
+					value := timeDims[dim](ts)
+					id = id*100 + value
+					values = append(values, value)
+				}
+				split := splitsByID[id]
+				if split == nil {
+					split = &timeDimsSplit{values: values, vals: make(Vals, len(vals))}
+					splitsByID[id] = split
+					splits = append(splits, split)
+				}
+				if split.vals[i] == nil {
+					split.vals[i] = encoding.NewSequence(width, numPeriods)
+					split.vals[i].SetUntil(until)
+				}
+				copy(split.vals[i][encoding.Width64bits+period*width:], periodData)
+			}
+		}
+
+		if len(splits) == 0 {
+			return guard.Proceed()
+		}
+		baseDims := key.AsMap()
+		for _, split := range splits {
+			dims := make(map[string]interface{}, len(baseDims)+len(missing))
+			for dim, value := range baseDims {
+				dims[dim] = value
+			}
+			for j, dim := range missing {
+				dims[dim] = split.values[j]
+			}
+			more, err := onRow(bytemap.New(dims), split.vals)
+			if !more || err != nil {
+				return more, err
+			}
+		}
+		return guard.Proceed()
+	})
+}
+
+func (d *timeDimsDeriver) String() string {
+	return fmt.Sprintf("derive time dims %v", d.dims)
+}
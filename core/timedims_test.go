@@ -0,0 +1,94 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/goexpr"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/expr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeriveTimeDims(t *testing.T) {
+	hourOfDay, _ := goexpr.Binary("+", goexpr.Param(DimHourOfDay), goexpr.Constant(1))
+	dims := TimeDimsIn([]GroupBy{
+		NewGroupBy("x", goexpr.Param("x")),
+		NewGroupBy("hour", hourOfDay),
+		NewGroupBy("weekday", goexpr.Param(DimDayOfWeek)),
+		NewGroupBy("hour_again", goexpr.Param(DimHourOfDay)),
+	})
+	assert.Equal(t, []string{DimHourOfDay, DimDayOfWeek}, dims)
+
+	// epoch is a Thursday
+	source := &hourlySource{rows: []*testRow{
+		hourlyRow(map[string]interface{}{"x": 1}, epoch.Add(3*time.Hour), 1, 2, 3, 4),
+		hourlyRow(map[string]interface{}{"x": 2}, epoch.Add(25*time.Hour), 10, 0, 20),
+		hourlyRow(map[string]interface{}{"x": 3, DimHourOfDay: 12}, epoch.Add(1*time.Hour), 100, 200),
+	}}
+	sums := make(map[string]float64)
+	err := DeriveTimeDims(source, dims).Iterate(context.Background(), FieldsIgnored, func(key bytemap.ByteMap, vals Vals) (bool, error) {
+		vals[0].Iterate(source.e(), time.Hour, func(ts time.Time, val float64) bool {
+			sums[fmt.Sprintf("%v %v %v", key.Get("x"), key.Get(DimHourOfDay), key.Get(DimDayOfWeek))] += val
+			return true
+		})
+		return true, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]float64{
+		"1 3 4":  1,
+		"1 2 4":  2,
+		"1 1 4":  3,
+		"1 0 4":  4,
+		"2 1 5":  10,
+		"2 23 4": 20,
+		"3 12 4": 300,
+	}, sums, "rows should be split by time dims, keeping existing ones")
+}
+
+// hourlySource is a RowSource with a single SUM field at a resolution of 1
+// hour.
+type hourlySource struct {
+	testSource
+	rows []*testRow
+}
+
+func (s *hourlySource) e() expr.Expr {
+	return expr.SUM("a")
+}
+
+func (s *hourlySource) GetResolution() time.Duration {
+	return time.Hour
+}
+
+func (s *hourlySource) Iterate(ctx context.Context, onFields OnFields, onRow OnRow) error {
+	onFields(Fields{NewField("a", s.e())})
+	for _, row := range s.rows {
+		more, err := onRow(row.key, row.vals)
+		if !more || err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *hourlySource) String() string {
+	return "test.hourly"
+}
+
+// hourlyRow makes a row whose values go back in time from until, hour by hour.
+// Zero values are left unset.
+func hourlyRow(dims map[string]interface{}, until time.Time, values ...float64) *testRow {
+	e := expr.SUM("a")
+	seq := encoding.NewSequence(e.EncodedWidth(), len(values))
+	seq.SetUntil(until)
+	for period, value := range values {
+		if value != 0 {
+			seq.UpdateValueAt(period, e, expr.FloatParams(value), nil)
+		}
+	}
+	return &testRow{bytemap.New(dims), Vals{seq}}
+}
@@ -51,6 +51,10 @@ func (f *unflatten) Iterate(ctx context.Context, onFields OnFields, onRow OnRow)
 		outRow := make(Vals, numOut)
 		params := expr.Map(make(map[string]float64, numIn))
 		for i, field := range inFields {
+			if row.IsNull(i) {
+				// Leave out missing values so that they don't get aggregated as 0
+				continue
+			}
 			name := field.Name
 			params[name] = row.Values[i]
 		}
@@ -0,0 +1,102 @@
+package zenodb
+
+import (
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/expr"
+)
+
+// counterPruneInterval is how far the retention window has to move before
+// counterDeltas forgets series that haven't reported within it
+const counterPruneInterval = time.Minute
+
+// counterFields returns the names of the fields counted by COUNTER fields.
+func counterFields(fields core.Fields) []string {
+	var result []string
+	for _, field := range fields {
+		if name, isCounter := expr.IsCounter(field.Expr); isCounter {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+type counterSeries struct {
+	dims  string
+	field string
+}
+
+type counterSample struct {
+	value float64
+	ts    time.Time
+}
+
+// counterDeltas converts the raw values of counter fields into the increase
+// since the previous value reported with the same dimensions. It is not safe
+// for concurrent use, tables only use it from the goroutine that inserts.
+type counterDeltas struct {
+	last         map[counterSeries]counterSample
+	prunedBefore time.Time
+}
+
+func newCounterDeltas() *counterDeltas {
+	return &counterDeltas{last: make(map[counterSeries]counterSample)}
+}
+
+// apply returns vals with the values of the named counter fields replaced by
+// their deltas. A value lower than the previous one means that the counter
+// was reset, in which case the whole value counts as the delta. The first
+// value of a series only establishes a baseline and counts as 0, as do values
+// that arrive out of order.
+func (cd *counterDeltas) apply(ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap, fields []string, truncateBefore time.Time) bytemap.ByteMap {
+	if truncateBefore.Sub(cd.prunedBefore) > counterPruneInterval {
+		cd.prune(truncateBefore)
+	}
+
+	var deltas map[string]float64
+	for _, field := range fields {
+		value, ok := vals.Get(field).(float64)
+		if !ok {
+			continue
+		}
+		if deltas == nil {
+			deltas = make(map[string]float64, len(fields))
+		}
+		series := counterSeries{dims: string(dims), field: field}
+		previous, found := cd.last[series]
+		switch {
+		case !found:
+			deltas[field] = 0
+		case ts.Before(previous.ts):
+			deltas[field] = 0
+			continue
+		case value < previous.value:
+			// counter was reset
+			deltas[field] = value
+		default:
+			deltas[field] = value - previous.value
+		}
+		cd.last[series] = counterSample{value, ts}
+	}
+	if deltas == nil {
+		return vals
+	}
+
+	all := vals.AsMap()
+	for field, delta := range deltas {
+		all[field] = delta
+	}
+	return bytemap.New(all)
+}
+
+// prune forgets the series that haven't reported since before the given time.
+func (cd *counterDeltas) prune(before time.Time) {
+	for series, sample := range cd.last {
+		if sample.ts.Before(before) {
+			delete(cd.last, series)
+		}
+	}
+	cd.prunedBefore = before
+}
@@ -0,0 +1,46 @@
+package zenodb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/expr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounterFields(t *testing.T) {
+	fields := core.Fields{
+		core.NewField("requests", expr.COUNTER("requests")),
+		core.NewField("load_avg", expr.AVG("load_avg")),
+	}
+	assert.Equal(t, []string{"requests"}, counterFields(fields))
+}
+
+func TestCounterDeltas(t *testing.T) {
+	epoch := time.Date(2015, time.January, 1, 2, 3, 0, 0, time.UTC)
+	cd := newCounterDeltas()
+	bob := bytemap.New(map[string]interface{}{"u": "bob"})
+	alice := bytemap.New(map[string]interface{}{"u": "alice"})
+	fields := []string{"requests"}
+
+	delta := func(ts time.Time, dims bytemap.ByteMap, value float64) interface{} {
+		vals := bytemap.NewFloat(map[string]float64{"requests": value, "other": value})
+		result := cd.apply(ts, dims, vals, fields, epoch.Add(-1*time.Hour))
+		assert.EqualValues(t, value, result.Get("other"), "other fields should be left alone")
+		return result.Get("requests")
+	}
+
+	assert.EqualValues(t, 0, delta(epoch, bob, 10), "first value is the baseline")
+	assert.EqualValues(t, 0, delta(epoch, alice, 100), "series are tracked separately")
+	assert.EqualValues(t, 5, delta(epoch.Add(time.Second), bob, 15))
+	assert.EqualValues(t, 3, delta(epoch.Add(2*time.Second), bob, 3), "drop means reset")
+	assert.EqualValues(t, 0, delta(epoch.Add(time.Second), bob, 20), "out of order values are ignored")
+	assert.EqualValues(t, 4, delta(epoch.Add(3*time.Second), bob, 7))
+	assert.EqualValues(t, 1, delta(epoch.Add(time.Second), alice, 101))
+
+	cd.prune(epoch.Add(2 * time.Second))
+	assert.EqualValues(t, 0, delta(epoch.Add(4*time.Second), alice, 105), "alice was pruned")
+	assert.EqualValues(t, 1, delta(epoch.Add(4*time.Second), bob, 8), "bob wasn't pruned")
+}
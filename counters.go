@@ -0,0 +1,131 @@
+package zenodb
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+const (
+	// counterStripes is the number of stripes into which each stripedCounter is
+	// split. It's a power of 2 so that stripes can be picked with a mask.
+	counterStripes = 16
+
+	cacheLineSize = 64
+)
+
+// counterStripe is a single int64 padded out to a full cache line so that
+// neighboring stripes don't share a cache line.
+type counterStripe struct {
+	n int64
+	_ [cacheLineSize - 8]byte
+}
+
+// stripedCounter is an int64 counter that spreads its updates across several
+// stripes to avoid contention between concurrent writers. Reads sum up all of
+// the stripes.
+type stripedCounter struct {
+	stripes [counterStripes]counterStripe
+}
+
+// add adds delta to the stripe selected by hint. Any value will do for hint,
+// but writers that pass different hints are less likely to contend.
+func (c *stripedCounter) add(hint uint64, delta int64) {
+	// Fibonacci hashing spreads out hints that differ only in their high bits
+	stripe := (hint * 11400714819323198485) >> 60
+	atomic.AddInt64(&c.stripes[stripe&(counterStripes-1)].n, delta)
+}
+
+func (c *stripedCounter) get() int64 {
+	var total int64
+	for i := range c.stripes {
+		total += atomic.LoadInt64(&c.stripes[i].n)
+	}
+	return total
+}
+
+// tableCounters holds the cumulative counters from which a table's TableStats
+// are built. The per-point counters are striped since they're updated on
+// every insert; the rest are updated only when flushing.
+type tableCounters struct {
+	// int64s updated with atomic operations come first to keep them aligned on
+	// 32 bit platforms.
+	flushes   int64
+	flushTime int64
+	diskKeys  int64
+	// budgetEvictions and evictedBeforeNanos track evictions due to
+	// MaxDiskBytes
+	budgetEvictions    int64
+	evictedBeforeNanos int64
+	// the query counters are updated once per query of the table
+	queries               int64
+	queryKeysScanned      int64
+	querySequencesDecoded int64
+	queryPeriodsRead      int64
+	queryBytesRead        int64
+
+	filteredPoints stripedCounter
+	queuedPoints   stripedCounter
+	insertedPoints stripedCounter
+	droppedPoints  stripedCounter
+	expiredValues  stripedCounter
+}
+
+func (c *tableCounters) recordFlush(flushDuration time.Duration) {
+	atomic.AddInt64(&c.flushes, 1)
+	atomic.AddInt64(&c.flushTime, int64(flushDuration))
+}
+
+func (c *tableCounters) recordQuery(stats *common.TableQueryStats) {
+	atomic.AddInt64(&c.queries, 1)
+	atomic.AddInt64(&c.queryKeysScanned, stats.KeysScanned)
+	atomic.AddInt64(&c.querySequencesDecoded, stats.SequencesDecoded)
+	atomic.AddInt64(&c.queryPeriodsRead, stats.PeriodsRead)
+	atomic.AddInt64(&c.queryBytesRead, stats.BytesRead)
+}
+
+func (c *tableCounters) recordDiskKeys(numKeys int64) {
+	atomic.StoreInt64(&c.diskKeys, numKeys)
+}
+
+func (c *tableCounters) recordBudgetEviction(evictBefore int64) {
+	atomic.AddInt64(&c.budgetEvictions, 1)
+	for {
+		existing := atomic.LoadInt64(&c.evictedBeforeNanos)
+		if evictBefore <= existing || atomic.CompareAndSwapInt64(&c.evictedBeforeNanos, existing, evictBefore) {
+			return
+		}
+	}
+}
+
+func (c *tableCounters) evictedBefore() time.Time {
+	evictedBefore := atomic.LoadInt64(&c.evictedBeforeNanos)
+	if evictedBefore == 0 {
+		return time.Time{}
+	}
+	return encoding.TimeFromInt(evictedBefore)
+}
+
+// stats aggregates the counters into a TableStats. Since each counter is read
+// independently, the result isn't necessarily a consistent point in time.
+func (c *tableCounters) stats() TableStats {
+	return TableStats{
+		FilteredPoints:        c.filteredPoints.get(),
+		QueuedPoints:          c.queuedPoints.get(),
+		InsertedPoints:        c.insertedPoints.get(),
+		DroppedPoints:         c.droppedPoints.get(),
+		ExpiredValues:         c.expiredValues.get(),
+		Flushes:               atomic.LoadInt64(&c.flushes),
+		FlushTime:             time.Duration(atomic.LoadInt64(&c.flushTime)),
+		DiskKeys:              atomic.LoadInt64(&c.diskKeys),
+		BudgetEvictions:       atomic.LoadInt64(&c.budgetEvictions),
+		EvictedBefore:         c.evictedBefore(),
+		Queries:               atomic.LoadInt64(&c.queries),
+		QueryKeysScanned:      atomic.LoadInt64(&c.queryKeysScanned),
+		QuerySequencesDecoded: atomic.LoadInt64(&c.querySequencesDecoded),
+		QueryPeriodsRead:      atomic.LoadInt64(&c.queryPeriodsRead),
+		QueryBytesRead:        atomic.LoadInt64(&c.queryBytesRead),
+	}
+}
@@ -0,0 +1,75 @@
+package zenodb
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStripedCounter(t *testing.T) {
+	var c stripedCounter
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.add(uint64(i*1000+j), 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.EqualValues(t, 8000, c.get())
+
+	used := 0
+	for i := range c.stripes {
+		if c.stripes[i].n > 0 {
+			used++
+		}
+	}
+	assert.True(t, used > 1, "Adds should be spread across stripes")
+}
+
+func TestTableCounters(t *testing.T) {
+	var c tableCounters
+	c.insertedPoints.add(1, 3)
+	c.filteredPoints.add(2, 2)
+	c.droppedPoints.add(3, 1)
+	c.recordFlush(time.Second)
+	c.recordFlush(2 * time.Second)
+	c.recordDiskKeys(10)
+	c.recordDiskKeys(7)
+
+	stats := c.stats()
+	assert.EqualValues(t, 3, stats.InsertedPoints)
+	assert.EqualValues(t, 2, stats.FilteredPoints)
+	assert.EqualValues(t, 1, stats.DroppedPoints)
+	assert.EqualValues(t, 2, stats.Flushes)
+	assert.Equal(t, 3*time.Second, stats.FlushTime)
+	assert.EqualValues(t, 7, stats.DiskKeys, "DiskKeys should reflect the most recent flush")
+}
+
+func BenchmarkStripedCounter(b *testing.B) {
+	var c stripedCounter
+	b.RunParallel(func(pb *testing.PB) {
+		hint := uint64(time.Now().UnixNano())
+		for pb.Next() {
+			c.add(hint, 1)
+			hint++
+		}
+	})
+}
+
+func BenchmarkMutexCounter(b *testing.B) {
+	var mx sync.Mutex
+	var stats TableStats
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			mx.Lock()
+			stats.InsertedPoints++
+			mx.Unlock()
+		}
+	})
+}
@@ -0,0 +1,172 @@
+package zenodb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schedule determines when a scheduled query runs.
+type schedule interface {
+	// next returns the first time after t at which to run, or zero if there
+	// isn't one.
+	next(t time.Time) time.Time
+}
+
+var cronShortcuts = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseSchedule parses either a cron expression with the five fields minute,
+// hour, day of month, month and day of week (evaluated in UTC), one of the
+// shortcuts like @hourly or @daily, or @every followed by a duration like
+// "@every 10m".
+func parseSchedule(spec string) (schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(spec[len("@every "):]))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid schedule %v: %v", spec, err)
+		}
+		if d < time.Second {
+			return nil, fmt.Errorf("Invalid schedule %v: interval must be at least 1s", spec)
+		}
+		return everySchedule(d), nil
+	}
+	if shortcut, found := cronShortcuts[strings.ToLower(spec)]; found {
+		spec = shortcut
+	}
+
+	parts := strings.Fields(spec)
+	if len(parts) != 5 {
+		return nil, fmt.Errorf("Invalid schedule %v: expected 5 fields (minute hour day-of-month month day-of-week)", spec)
+	}
+	s := &cronSchedule{}
+	var err error
+	if s.minute, _, err = parseCronField(parts[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("Invalid minute in schedule %v: %v", spec, err)
+	}
+	if s.hour, _, err = parseCronField(parts[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("Invalid hour in schedule %v: %v", spec, err)
+	}
+	if s.dom, s.domAny, err = parseCronField(parts[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("Invalid day of month in schedule %v: %v", spec, err)
+	}
+	if s.month, _, err = parseCronField(parts[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("Invalid month in schedule %v: %v", spec, err)
+	}
+	if s.dow, s.dowAny, err = parseCronField(parts[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("Invalid day of week in schedule %v: %v", spec, err)
+	}
+	if s.dow&(1<<7) != 0 {
+		// 7 is also Sunday
+		s.dow |= 1
+	}
+	return s, nil
+}
+
+// everySchedule runs at fixed intervals, aligned to multiples of the interval
+// since the epoch so that e.g. "@every 1h" runs on the hour.
+type everySchedule time.Duration
+
+func (s everySchedule) next(t time.Time) time.Time {
+	d := time.Duration(s)
+	return t.Truncate(d).Add(d)
+}
+
+// cronSchedule holds the allowed values for each field of a cron expression as
+// bitmasks.
+type cronSchedule struct {
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	domAny bool
+	dowAny bool
+}
+
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.In(time.UTC).Truncate(time.Minute).Add(time.Minute)
+	// Give up if nothing matches within 5 years (e.g. February 30th)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// dayMatches follows the cron convention that if both the day of month and
+// day of week are restricted, a day matches if either of them matches.
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	domMatches := s.dom&(1<<uint(t.Day())) != 0
+	dowMatches := s.dow&(1<<uint(t.Weekday())) != 0
+	if !s.domAny && !s.dowAny {
+		return domMatches || dowMatches
+	}
+	return domMatches && dowMatches
+}
+
+// parseCronField parses a comma-separated list of values, ranges like 1-5 and
+// steps like */15 or 0-30/10 into a bitmask. isAny indicates whether the field
+// starts with *, as in * or */2.
+func parseCronField(field string, min int, max int) (mask uint64, isAny bool, err error) {
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			step, err = strconv.Atoi(part[idx+1:])
+			if err != nil || step < 1 {
+				return 0, false, fmt.Errorf("invalid step in %v", part)
+			}
+			part = part[:idx]
+		}
+		from, to := min, max
+		switch {
+		case part == "*":
+			// full range
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			from, err = strconv.Atoi(bounds[0])
+			if err == nil {
+				to, err = strconv.Atoi(bounds[1])
+			}
+			if err != nil {
+				return 0, false, fmt.Errorf("invalid range %v", part)
+			}
+		default:
+			from, err = strconv.Atoi(part)
+			if err != nil {
+				return 0, false, fmt.Errorf("invalid value %v", part)
+			}
+			to = from
+			if step > 1 {
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return 0, false, fmt.Errorf("%v is out of range %d-%d", part, min, max)
+		}
+		for i := from; i <= to; i += step {
+			mask |= 1 << uint(i)
+		}
+	}
+	return mask, strings.HasPrefix(field, "*"), nil
+}
@@ -0,0 +1,38 @@
+package zenodb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSchedule(t *testing.T) {
+	// A Thursday
+	from := time.Date(2015, time.January, 1, 2, 3, 30, 0, time.UTC)
+	check := func(spec string, expected time.Time) {
+		s, err := parseSchedule(spec)
+		if assert.NoError(t, err, spec) {
+			assert.Equal(t, expected, s.next(from), spec)
+		}
+	}
+
+	check("* * * * *", time.Date(2015, time.January, 1, 2, 4, 0, 0, time.UTC))
+	check("*/15 * * * *", time.Date(2015, time.January, 1, 2, 15, 0, 0, time.UTC))
+	check("0,30 1-3 * * *", time.Date(2015, time.January, 1, 2, 30, 0, 0, time.UTC))
+	check("@hourly", time.Date(2015, time.January, 1, 3, 0, 0, 0, time.UTC))
+	check("@daily", time.Date(2015, time.January, 2, 0, 0, 0, 0, time.UTC))
+	check("@weekly", time.Date(2015, time.January, 4, 0, 0, 0, 0, time.UTC))
+	check("@monthly", time.Date(2015, time.February, 1, 0, 0, 0, 0, time.UTC))
+	check("30 6 * * 1-5", time.Date(2015, time.January, 1, 6, 30, 0, 0, time.UTC))
+	check("0 0 * * 7", time.Date(2015, time.January, 4, 0, 0, 0, 0, time.UTC))
+	check("0 0 15 * 1", time.Date(2015, time.January, 5, 0, 0, 0, 0, time.UTC))
+	check("0 0 29 2 *", time.Date(2016, time.February, 29, 0, 0, 0, 0, time.UTC))
+	check("@every 10m", time.Date(2015, time.January, 1, 2, 10, 0, 0, time.UTC))
+	check("0 0 30 2 *", time.Time{})
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "a * * * *", "5-1 * * * *", "@every", "@every 1ms", "@often"} {
+		_, err := parseSchedule(spec)
+		assert.Error(t, err, spec)
+	}
+}
@@ -0,0 +1,218 @@
+package zenodb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/goexpr"
+	"github.com/getlantern/yaml"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/sql"
+)
+
+const (
+	// tombstonesFilename is the file in the db dir to which tombstones are
+	// persisted so that they survive restarts.
+	tombstonesFilename = "_tombstones.yaml"
+)
+
+// tombstone records a DELETE statement. Periods up to and including the one
+// in which the statement ran are removed from the keys that match its WHERE
+// clause. Tombstones are applied when querying and the deleted data is
+// physically removed on the table's next flush. A tombstone is kept until it's
+// older than the table's retention period, so that it also applies to data
+// that's replayed from the WAL or that arrives late.
+type tombstone struct {
+	SQL       string `yaml:"sql"`
+	DeletedAt string `yaml:"deletedat"`
+	// Compacted indicates that the table has been flushed since the tombstone
+	// was created, so files on disk no longer contain data that it deletes.
+	// Only accessed while holding tombstonesMx.
+	Compacted bool `yaml:"compacted,omitempty"`
+
+	table     string
+	where     goexpr.Expr
+	deletedAt time.Time
+}
+
+func (ts *tombstone) parse() error {
+	d, err := sql.ParseDelete(ts.SQL)
+	if err != nil {
+		return err
+	}
+	deletedAt, err := time.Parse(time.RFC3339Nano, ts.DeletedAt)
+	if err != nil {
+		return fmt.Errorf("Invalid deletedat %v: %v", ts.DeletedAt, err)
+	}
+	ts.table = d.Table
+	ts.where = d.Where
+	ts.deletedAt = deletedAt
+	return nil
+}
+
+func (ts *tombstone) matches(key bytemap.ByteMap) bool {
+	match, _ := ts.where.Eval(key).(bool)
+	return match
+}
+
+// Delete applies a DELETE statement, like
+//
+//	DELETE FROM thetable WHERE user = 'bob'
+//
+// which removes everything up to now from the keys that match the WHERE
+// clause, for example to erase all data about a specific user. Data for
+// matching keys that's inserted after the statement runs is kept. Deletes are
+// persisted in the db dir. In a cluster, deletes only apply to the node on
+// which they run.
+func (db *DB) Delete(sqlString string) error {
+	ts, err := db.prepareDelete(sqlString)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("Applying %v", ts.SQL)
+	db.tombstonesMx.Lock()
+	defer db.tombstonesMx.Unlock()
+	db.tombstones = append(db.tombstones, ts)
+	return db.saveTombstones()
+}
+
+// prepareDelete validates the given DELETE statement and returns the
+// tombstone that records it.
+func (db *DB) prepareDelete(sqlString string) (*tombstone, error) {
+	d, err := sql.ParseDelete(sqlString)
+	if err != nil {
+		return nil, err
+	}
+	t, err := db.storingTable(d.Table)
+	if err != nil {
+		return nil, err
+	}
+	deletedAt := db.clock.Now()
+	return &tombstone{
+		SQL:       d.String(),
+		DeletedAt: deletedAt.Format(time.RFC3339Nano),
+		table:     t.Name,
+		where:     d.Where,
+		deletedAt: deletedAt,
+	}, nil
+}
+
+// tombstones returns the tombstones that still apply to the table and whether
+// all of them have been compacted.
+func (t *table) tombstones() ([]*tombstone, bool) {
+	truncateBefore := t.truncateBefore()
+	var result []*tombstone
+	compacted := true
+	t.db.tombstonesMx.RLock()
+	for _, ts := range t.db.tombstones {
+		if ts.table == t.Name && !ts.deletedAt.Before(truncateBefore) {
+			result = append(result, ts)
+			compacted = compacted && ts.Compacted
+		}
+	}
+	t.db.tombstonesMx.RUnlock()
+	return result, compacted
+}
+
+// eraseDeleted truncates the deleted periods from the given columns of the row
+// with the given key. It returns false if no data remains.
+func (t *table) eraseDeleted(tombstones []*tombstone, key bytemap.ByteMap, columns []encoding.Sequence, fields core.Fields) bool {
+	var deletedAt time.Time
+	for _, ts := range tombstones {
+		if ts.deletedAt.After(deletedAt) && ts.matches(key) {
+			deletedAt = ts.deletedAt
+		}
+	}
+	if deletedAt.IsZero() {
+		return true
+	}
+
+	remaining := false
+	for i, seq := range columns {
+		seq = seq.Truncate(fields[i].Expr.EncodedWidth(), t.Resolution, deletedAt, time.Time{})
+		columns[i] = seq
+		if seq != nil {
+			remaining = true
+		}
+	}
+	return remaining
+}
+
+// markCompacted records that the given tombstones have been compacted.
+func (db *DB) markCompacted(tombstones []*tombstone) {
+	db.tombstonesMx.Lock()
+	defer db.tombstonesMx.Unlock()
+	for _, ts := range tombstones {
+		ts.Compacted = true
+	}
+	err := db.saveTombstones()
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// loadTombstones loads previously persisted tombstones.
+func (db *DB) loadTombstones() error {
+	b, err := ioutil.ReadFile(filepath.Join(db.opts.Dir, tombstonesFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("Unable to read tombstones: %v", err)
+	}
+	var tombstones []*tombstone
+	err = yaml.Unmarshal(b, &tombstones)
+	if err != nil {
+		return fmt.Errorf("Unable to parse tombstones: %v", err)
+	}
+	for _, ts := range tombstones {
+		err = ts.parse()
+		if err != nil {
+			log.Errorf("Ignoring persisted tombstone %v: %v", ts.SQL, err)
+			continue
+		}
+		db.tombstones = append(db.tombstones, ts)
+	}
+	return nil
+}
+
+// saveTombstones persists tombstones, dropping ones that have expired. It must
+// be called while holding tombstonesMx.
+func (db *DB) saveTombstones() error {
+	db.tombstones = db.liveTombstones(db.tombstones)
+	err := db.stageTombstones(db.tombstones)
+	if err != nil {
+		return err
+	}
+	return commitFile(filepath.Join(db.opts.Dir, tombstonesFilename), "tombstones")
+}
+
+// liveTombstones returns the given tombstones without the ones whose deleted
+// data has since expired anyway.
+func (db *DB) liveTombstones(tombstones []*tombstone) []*tombstone {
+	live := make([]*tombstone, 0, len(tombstones))
+	for _, ts := range tombstones {
+		t := db.getTable(ts.table)
+		if t != nil && ts.deletedAt.Before(t.truncateBefore()) {
+			continue
+		}
+		live = append(live, ts)
+	}
+	return live
+}
+
+// stageTombstones writes the given tombstones next to the tombstones file, from
+// where commitFile moves them into place.
+func (db *DB) stageTombstones(tombstones []*tombstone) error {
+	b, err := yaml.Marshal(tombstones)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal tombstones: %v", err)
+	}
+	return stageFile(filepath.Join(db.opts.Dir, tombstonesFilename), b, "tombstones")
+}
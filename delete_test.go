@@ -0,0 +1,122 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDelete(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 0, 0, time.UTC)
+	clock := NewVirtualClock(epoch)
+	clock.Freeze()
+	newDB := func() (*DB, error) {
+		return NewDB(&DBOpts{
+			Dir:   tmpDir,
+			Clock: clock,
+			Schema: Schema{
+				"thetable": &TableOpts{
+					RetentionPeriod: time.Hour,
+					SQL:             "SELECT SUM(a) AS a FROM inbound GROUP BY u, period(1m)",
+				},
+			},
+		})
+	}
+	db, err := newDB()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	inserted := 0
+	insert := func(db *DB, ts time.Time, u string, a float64) {
+		db.Insert("inbound", ts, map[string]interface{}{"u": u}, map[string]float64{"a": a})
+		inserted++
+		waitFor(func() bool { return db.TableStats("thetable").InsertedPoints == int64(inserted) })
+	}
+	sumsByUser := func(db *DB) map[string]float64 {
+		return sumsBy(t, db, "thetable", "u", "a")
+	}
+
+	insert(db, epoch.Add(-10*time.Minute), "bob", 1)
+	insert(db, epoch, "bob", 2)
+	insert(db, epoch, "alice", 4)
+	if !assert.NoError(t, db.ForceFlush("thetable")) {
+		return
+	}
+	insert(db, epoch.Add(-5*time.Minute), "bob", 8)
+
+	assert.Error(t, db.Delete("DELETE FROM thetable"), "DELETE without WHERE should fail")
+	assert.Error(t, db.Delete("DELETE FROM othertable WHERE u = 'bob'"), "DELETE from unknown table should fail")
+	if !assert.NoError(t, db.Delete("DELETE FROM thetable WHERE u = 'bob'")) {
+		return
+	}
+	assert.Equal(t, map[string]float64{"alice": 4}, sumsByUser(db), "deleted data shouldn't be returned by queries")
+
+	clock.Advance(epoch.Add(2 * time.Minute))
+	insert(db, epoch.Add(2*time.Minute), "bob", 16)
+	assert.Equal(t, map[string]float64{"alice": 4, "bob": 16}, sumsByUser(db), "data inserted after the delete should be kept")
+
+	if !assert.NoError(t, db.ForceFlush("thetable")) {
+		return
+	}
+	assert.EqualValues(t, 16, sumFieldAt(t, db, "thetable", "a", epoch.Add(2*time.Minute)))
+	assert.EqualValues(t, 0, sumFieldAt(t, db, "thetable", "a", epoch.Add(-10*time.Minute)), "flush should physically remove deleted data")
+	assert.EqualValues(t, 4, sumFieldAt(t, db, "thetable", "a", epoch), "flush should keep data that wasn't deleted")
+	persisted, _ := ioutil.ReadFile(filepath.Join(tmpDir, tombstonesFilename))
+	assert.Contains(t, string(persisted), "compacted: true")
+
+	db.Close()
+	db, err = newDB()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	inserted = 0
+	if assert.Len(t, db.tombstones, 1, "tombstones should survive restart") {
+		assert.Equal(t, epoch, db.tombstones[0].deletedAt.In(time.UTC))
+		assert.True(t, db.tombstones[0].Compacted)
+	}
+	insert(db, epoch.Add(-20*time.Minute), "bob", 32)
+	assert.Equal(t, map[string]float64{"alice": 4, "bob": 16}, sumsByUser(db), "late data from before the delete should be removed too")
+
+	clock.Advance(epoch.Add(2 * time.Hour))
+	db.markCompacted(nil)
+	assert.Empty(t, db.tombstones, "tombstones should expire with the retention period")
+}
+
+// sumsBy queries the given field from the given table and sums it by the
+// values of the given dimension.
+func sumsBy(t *testing.T, db *DB, table string, dim string, name string) map[string]float64 {
+	sums := make(map[string]float64)
+	source, err := db.Query(fmt.Sprintf("SELECT %v FROM %v", name, table), false, nil, true)
+	if !assert.NoError(t, err) {
+		return sums
+	}
+	var fields core.Fields
+	err = source.Iterate(context.Background(), func(f core.Fields) error {
+		fields = f
+		return nil
+	}, func(row *core.FlatRow) (bool, error) {
+		for i, field := range fields {
+			if field.Name == name {
+				sums[row.Key.Get(dim).(string)] += row.Values[i]
+			}
+		}
+		return true, nil
+	})
+	assert.NoError(t, err)
+	return sums
+}
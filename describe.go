@@ -0,0 +1,71 @@
+package zenodb
+
+import (
+	"time"
+)
+
+// TableInfo describes a table for tools like the web console.
+type TableInfo struct {
+	Name            string
+	From            string
+	View            bool
+	Virtual         bool
+	MemoryOnly      bool
+	Columnar        bool
+	Resolution      time.Duration
+	RetentionPeriod time.Duration
+	MaxDiskBytes    int64
+	// Dims are the dimensions by which the table is grouped. It's empty if
+	// GroupByAll is true.
+	Dims       []string
+	GroupByAll bool
+	Fields     []FieldInfo
+	Stats      TableStats
+}
+
+// FieldInfo describes a field in a table.
+type FieldInfo struct {
+	Name string
+	Expr string
+	// Unit and Display come from the field's FieldMetadata, if any
+	Unit    string
+	Display string
+}
+
+// DescribeTables describes all tables in the database, in the order in which
+// they were created.
+func (db *DB) DescribeTables() []*TableInfo {
+	tables := db.allTables()
+	infos := make([]*TableInfo, 0, len(tables))
+	for _, t := range tables {
+		info := &TableInfo{
+			Name:            t.Name,
+			From:            t.From,
+			View:            t.View,
+			Virtual:         t.Virtual,
+			MemoryOnly:      t.MemoryOnly,
+			Columnar:        t.Columnar,
+			Resolution:      t.Resolution,
+			RetentionPeriod: t.retentionPeriod(),
+			MaxDiskBytes:    t.maxDiskBytes(),
+			GroupByAll:      t.GroupByAll,
+			Stats:           t.snapshotStats(),
+		}
+		if !t.GroupByAll {
+			for _, groupBy := range t.GroupBy {
+				info.Dims = append(info.Dims, groupBy.Name)
+			}
+		}
+		metadata := t.getFieldMetadata()
+		for _, field := range t.getFields() {
+			fi := FieldInfo{Name: field.Name, Expr: field.Expr.String()}
+			if md := metadata[field.Name]; md != nil {
+				fi.Unit = md.Unit
+				fi.Display = md.Display
+			}
+			info.Fields = append(info.Fields, fi)
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
@@ -0,0 +1,129 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDescribeTables(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir: tmpDir,
+		Schema: Schema{
+			"thetable": &TableOpts{
+				RetentionPeriod: time.Hour,
+				SQL:             "SELECT SUM(a) AS a FROM inbound GROUP BY x, period(1s)",
+			},
+			"bothdims": &TableOpts{
+				RetentionPeriod: 2 * time.Hour,
+				SQL:             "SELECT AVG(b) AS b FROM inbound GROUP BY y, x, period(1m)",
+				FieldMetadata: map[string]*common.FieldMetadata{
+					"b": {Unit: common.UnitBytes, Display: "%.1f"},
+				},
+			},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	db.Insert("inbound", time.Now(), map[string]interface{}{"x": 1}, map[string]float64{"a": 1})
+	waitFor(func() bool { return db.TableStats("thetable").InsertedPoints == 1 })
+
+	infos := db.DescribeTables()
+	if !assert.Len(t, infos, 2) {
+		return
+	}
+	byName := make(map[string]*TableInfo)
+	for _, info := range infos {
+		byName[info.Name] = info
+	}
+
+	thetable := byName["thetable"]
+	if assert.NotNil(t, thetable) {
+		assert.Equal(t, "inbound", thetable.From)
+		assert.Equal(t, time.Second, thetable.Resolution)
+		assert.Equal(t, time.Hour, thetable.RetentionPeriod)
+		assert.Equal(t, []string{"x"}, thetable.Dims)
+		assert.False(t, thetable.GroupByAll)
+		if assert.Len(t, thetable.Fields, 2) {
+			assert.Equal(t, "_points", thetable.Fields[0].Name)
+			assert.Equal(t, FieldInfo{Name: "a", Expr: "SUM(a)"}, thetable.Fields[1])
+		}
+		assert.EqualValues(t, 1, thetable.Stats.InsertedPoints)
+	}
+
+	bothdims := byName["bothdims"]
+	if assert.NotNil(t, bothdims) {
+		assert.Equal(t, []string{"x", "y"}, bothdims.Dims)
+		assert.Equal(t, time.Minute, bothdims.Resolution)
+		assert.Equal(t, 2*time.Hour, bothdims.RetentionPeriod)
+		if assert.Len(t, bothdims.Fields, 2) {
+			assert.Equal(t, FieldInfo{Name: "b", Expr: "AVG(b)", Unit: common.UnitBytes, Display: "%.1f"}, bothdims.Fields[1])
+		}
+	}
+
+	source, err := db.Query("SELECT b, _points, b * 2 AS double_b FROM bothdims GROUP BY x", false, nil, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var md *common.QueryMetaData
+	err = source.Iterate(context.Background(), func(fields core.Fields) error {
+		md = MetaDataFor(source, fields)
+		return nil
+	}, func(row *core.FlatRow) (bool, error) {
+		return true, nil
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]*common.FieldMetadata{"b": {Unit: common.UnitBytes, Display: "%.1f"}}, md.FieldMetadata)
+		assert.Equal(t, []*common.ColumnMetadata{
+			{Name: "x", Kind: common.ColumnDim, Type: common.TypeAny},
+			{Name: "b", Kind: common.ColumnAggregate, Type: common.TypeNumber, Unit: common.UnitBytes},
+			{Name: "_points", Kind: common.ColumnAggregate, Type: common.TypeNumber},
+			{Name: "double_b", Kind: common.ColumnDerived, Type: common.TypeNumber},
+		}, md.Columns)
+	}
+}
+
+func TestInvalidFieldMetadata(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{Dir: tmpDir})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	err = db.CreateTable(&TableOpts{
+		Name:            "unknownfield",
+		RetentionPeriod: time.Hour,
+		SQL:             "SELECT SUM(a) AS a FROM inbound GROUP BY x, period(1s)",
+		FieldMetadata:   map[string]*common.FieldMetadata{"b": {Unit: common.UnitBytes}},
+	})
+	assert.Error(t, err)
+
+	err = db.CreateTable(&TableOpts{
+		Name:            "unknownunit",
+		RetentionPeriod: time.Hour,
+		SQL:             "SELECT SUM(a) AS a FROM inbound GROUP BY x, period(1s)",
+		FieldMetadata:   map[string]*common.FieldMetadata{"a": {Unit: "furlongs"}},
+	})
+	assert.Error(t, err)
+}
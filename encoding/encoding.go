@@ -3,6 +3,7 @@ package encoding
 
 import (
 	"encoding/binary"
+	"fmt"
 
 	"github.com/getlantern/bytemap"
 )
@@ -18,6 +19,11 @@ var (
 	Binary = binary.BigEndian
 )
 
+// The Read* functions panic if b is too short. Each of them has a *Checked
+// variant that returns an error instead, which should be used when decoding
+// data from disk or the network so that corrupted input can't crash the
+// process.
+
 func ReadInt16(b []byte) (int, []byte) {
 	i := Binary.Uint16(b)
 	return int(i), b[Width16bits:]
@@ -65,3 +71,49 @@ func Write(b []byte, d []byte) []byte {
 	copy(b, d)
 	return b[len(d):]
 }
+
+func ReadInt16Checked(b []byte) (int, []byte, error) {
+	if len(b) < Width16bits {
+		return 0, b, shortBuffer("16 bit int", Width16bits, b)
+	}
+	i, remain := ReadInt16(b)
+	return i, remain, nil
+}
+
+func ReadInt32Checked(b []byte) (int, []byte, error) {
+	if len(b) < Width32bits {
+		return 0, b, shortBuffer("32 bit int", Width32bits, b)
+	}
+	i, remain := ReadInt32(b)
+	return i, remain, nil
+}
+
+func ReadInt64Checked(b []byte) (int, []byte, error) {
+	if len(b) < Width64bits {
+		return 0, b, shortBuffer("64 bit int", Width64bits, b)
+	}
+	i, remain := ReadInt64(b)
+	return i, remain, nil
+}
+
+func ReadByteMapChecked(b []byte, l int) (bytemap.ByteMap, []byte, error) {
+	d, remain, err := ReadChecked(b, l)
+	return bytemap.ByteMap(d), remain, err
+}
+
+func ReadChecked(b []byte, l int) ([]byte, []byte, error) {
+	if l < 0 || len(b) < l {
+		return nil, b, shortBuffer("data", l, b)
+	}
+	d, remain := Read(b, l)
+	return d, remain, nil
+}
+
+func ReadSequenceChecked(b []byte, l int) (Sequence, []byte, error) {
+	s, remain, err := ReadChecked(b, l)
+	return Sequence(s), remain, err
+}
+
+func shortBuffer(what string, wanted int, b []byte) error {
+	return fmt.Errorf("Not enough data left to decode %v, wanted %d have %d", what, wanted, len(b))
+}
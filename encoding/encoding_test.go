@@ -0,0 +1,52 @@
+package encoding
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadChecked(t *testing.T) {
+	b := make([]byte, Width16bits+Width32bits+Width64bits+WidthTime+3)
+	remain := WriteInt16(b, 16)
+	remain = WriteInt32(remain, 32)
+	remain = WriteInt64(remain, 64)
+	ts := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	EncodeTime(remain, ts)
+	remain = remain[WidthTime:]
+	Write(remain, []byte("abc"))
+
+	i16, remain, err := ReadInt16Checked(b)
+	assert.NoError(t, err)
+	assert.Equal(t, 16, i16)
+	i32, remain, err := ReadInt32Checked(remain)
+	assert.NoError(t, err)
+	assert.Equal(t, 32, i32)
+	i64, remain, err := ReadInt64Checked(remain)
+	assert.NoError(t, err)
+	assert.Equal(t, 64, i64)
+	readTS, remain, err := ReadTimeChecked(remain)
+	assert.NoError(t, err)
+	assert.Equal(t, ts, readTS.In(time.UTC))
+	d, remain, err := ReadChecked(remain, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", string(d))
+	assert.Empty(t, remain)
+
+	short := []byte{1}
+	_, _, err = ReadInt16Checked(short)
+	assert.Error(t, err)
+	_, _, err = ReadInt32Checked(short)
+	assert.Error(t, err)
+	_, _, err = ReadInt64Checked(short)
+	assert.Error(t, err)
+	_, _, err = ReadTimeChecked(short)
+	assert.Error(t, err)
+	_, _, err = ReadByteMapChecked(short, 2)
+	assert.Error(t, err)
+	_, _, err = ReadSequenceChecked(short, 2)
+	assert.Error(t, err)
+	_, _, err = ReadChecked(short, -1)
+	assert.Error(t, err, "negative lengths should fail")
+}
@@ -0,0 +1,305 @@
+package encoding
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/getlantern/bytemap"
+)
+
+var (
+	// bytemapEnc is the number encoding used internally by ByteMaps
+	bytemapEnc = binary.LittleEndian
+
+	keyBuilderPool = &sync.Pool{
+		New: func() interface{} {
+			return &KeyBuilder{}
+		},
+	}
+
+	keyPool = &sync.Pool{}
+)
+
+type keyEntry struct {
+	name  string
+	t     byte
+	value []byte
+}
+
+// KeyBuilder builds ByteMap keys one value at a time, reusing its internal
+// buffers between keys. Values copied from an existing ByteMap with AddFrom
+// are copied as raw bytes without being decoded, which avoids allocating for
+// the common case of keys made up of dimensions from an inbound point.
+//
+// Values can be added in any order, Build orders them by name like bytemap.New
+// does, so that the same values always produce the same key. A KeyBuilder is
+// not safe for concurrent use.
+type KeyBuilder struct {
+	entries []keyEntry
+}
+
+// AcquireKeyBuilder gets a reset KeyBuilder from a pool. Return it to the pool
+// with Release once it's no longer needed.
+func AcquireKeyBuilder() *KeyBuilder {
+	return keyBuilderPool.Get().(*KeyBuilder)
+}
+
+// Release resets this KeyBuilder and returns it to the pool. Keys built with
+// it remain valid.
+func (kb *KeyBuilder) Release() {
+	kb.Reset()
+	keyBuilderPool.Put(kb)
+}
+
+// Reset clears all values added to this KeyBuilder.
+func (kb *KeyBuilder) Reset() {
+	for i := range kb.entries {
+		// don't hold on to referenced ByteMaps
+		kb.entries[i] = keyEntry{}
+	}
+	kb.entries = kb.entries[:0]
+}
+
+// AddFrom adds the value stored under fromName in the given ByteMap under the
+// given name, without decoding it. It returns false and doesn't add anything if
+// the ByteMap doesn't contain a non-nil value for fromName.
+func (kb *KeyBuilder) AddFrom(name string, from bytemap.ByteMap, fromName string) bool {
+	t, value := rawValue(from, fromName)
+	if t == bytemap.TypeNil {
+		return false
+	}
+	kb.entries = append(kb.entries, keyEntry{name, t, value})
+	return true
+}
+
+// Add adds the given value. nil values are ignored. Unlike AddFrom, this has to
+// encode the value, which allocates.
+func (kb *KeyBuilder) Add(name string, value interface{}) {
+	if value == nil {
+		return
+	}
+	single := bytemap.FromSortedKeysAndValues([]string{name}, []interface{}{value})
+	// unsupported types are encoded as nil, same as bytemap does
+	t, raw := rawValue(single, name)
+	kb.entries = append(kb.entries, keyEntry{name, t, raw})
+}
+
+// Len returns the number of values added so far.
+func (kb *KeyBuilder) Len() int {
+	return len(kb.entries)
+}
+
+// Build builds a ByteMap from the values added so far. The result is
+// identical to what bytemap.New would have produced for the same values. If a
+// name was added more than once, the value that was added first wins. The
+// key's buffer comes from a pool, and callers who know that the key is no
+// longer referenced anywhere can return it with ReleaseKey.
+func (kb *KeyBuilder) Build() bytemap.ByteMap {
+	kb.sort()
+	keysLen := 0
+	valuesLen := 0
+	for _, entry := range kb.entries {
+		keysLen += bytemap.SizeKeyLen + len(entry.name) + bytemap.SizeValueType
+		if entry.t != bytemap.TypeNil {
+			keysLen += bytemap.SizeValueOffset
+			valuesLen += len(entry.value)
+		}
+	}
+
+	bm := acquireKey(keysLen + valuesLen)
+	keyOffset := 0
+	valueOffset := keysLen
+	for _, entry := range kb.entries {
+		bytemapEnc.PutUint16(bm[keyOffset:], uint16(len(entry.name)))
+		keyOffset += bytemap.SizeKeyLen
+		keyOffset += copy(bm[keyOffset:], entry.name)
+		bm[keyOffset] = entry.t
+		keyOffset += bytemap.SizeValueType
+		if entry.t != bytemap.TypeNil {
+			bytemapEnc.PutUint32(bm[keyOffset:], uint32(valueOffset))
+			keyOffset += bytemap.SizeValueOffset
+			valueOffset += copy(bm[valueOffset:], entry.value)
+		}
+	}
+	return bm
+}
+
+// sort orders the entries by name and removes all but the first entry for each
+// name. Entries are usually added in order already, so this uses an insertion
+// sort, which doesn't allocate and is stable.
+func (kb *KeyBuilder) sort() {
+	for i := 1; i < len(kb.entries); i++ {
+		for j := i; j > 0 && kb.entries[j].name < kb.entries[j-1].name; j-- {
+			kb.entries[j], kb.entries[j-1] = kb.entries[j-1], kb.entries[j]
+		}
+	}
+	deduped := kb.entries[:0]
+	for i, entry := range kb.entries {
+		if i > 0 && entry.name == kb.entries[i-1].name {
+			continue
+		}
+		deduped = append(deduped, entry)
+	}
+	kb.entries = deduped
+}
+
+// CanonicalKey returns the given key with its values ordered by name and
+// without duplicate names, which is how bytemap.New encodes them. ByteMaps
+// built with bytemap.FromSortedKeysAndValues from unsorted keys, for example by
+// clients that order dimensions according to their own schema, encode the same
+// dimensions differently and would be stored under different keys. If the key
+// is already canonical, it's returned as is and rebuilt is false. Otherwise,
+// the result is built with a KeyBuilder and can be returned to the pool with
+// ReleaseKey.
+func CanonicalKey(key bytemap.ByteMap) (canonical bytemap.ByteMap, rebuilt bool) {
+	if isCanonical(key) {
+		return key, false
+	}
+	kb := AcquireKeyBuilder()
+	walkKey(key, func(name []byte, t byte, value []byte) {
+		kb.entries = append(kb.entries, keyEntry{string(name), t, value})
+	})
+	canonical = kb.Build()
+	kb.Release()
+	return canonical, true
+}
+
+// isCanonical checks whether the names in the given key are strictly
+// increasing.
+func isCanonical(key bytemap.ByteMap) bool {
+	canonical := true
+	var previous []byte
+	first := true
+	walkKey(key, func(name []byte, t byte, value []byte) {
+		if !first && string(name) <= string(previous) {
+			canonical = false
+		}
+		previous = name
+		first = false
+	})
+	return canonical
+}
+
+// walkKey calls fn with the name, type and encoded value of each entry in the
+// given ByteMap, in the order in which they're stored. It stops at the first
+// entry that isn't encoded correctly.
+func walkKey(bm bytemap.ByteMap, fn func(name []byte, t byte, value []byte)) {
+	keyOffset := 0
+	endOfKeys := len(bm)
+	for keyOffset+bytemap.SizeKeyLen <= endOfKeys {
+		keyLen := int(bytemapEnc.Uint16(bm[keyOffset:]))
+		keyOffset += bytemap.SizeKeyLen
+		if keyOffset+keyLen+bytemap.SizeValueType > endOfKeys {
+			return
+		}
+		name := bm[keyOffset : keyOffset+keyLen]
+		keyOffset += keyLen
+		t := bm[keyOffset]
+		keyOffset += bytemap.SizeValueType
+		if t == bytemap.TypeNil {
+			fn(name, t, nil)
+			continue
+		}
+		if keyOffset+bytemap.SizeValueOffset > endOfKeys {
+			return
+		}
+		valueOffset := int(bytemapEnc.Uint32(bm[keyOffset:]))
+		keyOffset += bytemap.SizeValueOffset
+		if valueOffset < endOfKeys {
+			endOfKeys = valueOffset
+		}
+		if valueOffset > len(bm) {
+			return
+		}
+		length := valueLength(t, bm[valueOffset:])
+		if length < 0 || valueOffset+length > len(bm) {
+			return
+		}
+		fn(name, t, bm[valueOffset:valueOffset+length])
+	}
+}
+
+func acquireKey(length int) bytemap.ByteMap {
+	pooled := keyPool.Get()
+	if pooled != nil {
+		b := pooled.([]byte)
+		if cap(b) >= length {
+			return bytemap.ByteMap(b[:length])
+		}
+	}
+	return make(bytemap.ByteMap, length)
+}
+
+// ReleaseKey returns the buffer of a key built with KeyBuilder.Build to the
+// pool. The key must not be used anymore afterwards.
+func ReleaseKey(key bytemap.ByteMap) {
+	if cap(key) == 0 {
+		return
+	}
+	keyPool.Put([]byte(key[:0]))
+}
+
+// rawValue finds the type and encoded value bytes for the given name in bm,
+// returning TypeNil if not found. This relies on the layout of ByteMaps, in
+// which all keys come before all values and each key is stored as its length,
+// the key itself, the value type and, for non-nil values, the offset of the
+// value.
+func rawValue(bm bytemap.ByteMap, name string) (byte, []byte) {
+	keyOffset := 0
+	endOfKeys := len(bm)
+	for keyOffset+bytemap.SizeKeyLen <= endOfKeys {
+		keyLen := int(bytemapEnc.Uint16(bm[keyOffset:]))
+		keyOffset += bytemap.SizeKeyLen
+		if keyOffset+keyLen+bytemap.SizeValueType > endOfKeys {
+			break
+		}
+		matches := string(bm[keyOffset:keyOffset+keyLen]) == name
+		keyOffset += keyLen
+		t := bm[keyOffset]
+		keyOffset += bytemap.SizeValueType
+		if t == bytemap.TypeNil {
+			if matches {
+				return t, nil
+			}
+			continue
+		}
+		if keyOffset+bytemap.SizeValueOffset > endOfKeys {
+			break
+		}
+		valueOffset := int(bytemapEnc.Uint32(bm[keyOffset:]))
+		keyOffset += bytemap.SizeValueOffset
+		if valueOffset < endOfKeys {
+			endOfKeys = valueOffset
+		}
+		if matches {
+			if valueOffset > len(bm) {
+				break
+			}
+			length := valueLength(t, bm[valueOffset:])
+			if length < 0 || valueOffset+length > len(bm) {
+				break
+			}
+			return t, bm[valueOffset : valueOffset+length]
+		}
+	}
+	return bytemap.TypeNil, nil
+}
+
+func valueLength(t byte, b []byte) int {
+	switch t {
+	case bytemap.TypeBool, bytemap.TypeByte, bytemap.TypeInt8:
+		return 1
+	case bytemap.TypeUInt16, bytemap.TypeInt16:
+		return 2
+	case bytemap.TypeUInt32, bytemap.TypeInt32, bytemap.TypeFloat32:
+		return 4
+	case bytemap.TypeUInt64, bytemap.TypeUInt, bytemap.TypeInt64, bytemap.TypeInt, bytemap.TypeFloat64, bytemap.TypeTime:
+		return 8
+	case bytemap.TypeString:
+		if len(b) < 2 {
+			return -1
+		}
+		return 2 + int(bytemapEnc.Uint16(b))
+	}
+	return -1
+}
@@ -0,0 +1,118 @@
+package encoding
+
+import (
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyBuilder(t *testing.T) {
+	dims := bytemap.New(map[string]interface{}{
+		"a": "aval",
+		"b": 5,
+		"c": 6.5,
+		"d": true,
+		"e": time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+		"f": nil,
+	})
+
+	kb := AcquireKeyBuilder()
+	assert.True(t, kb.AddFrom("a", dims, "a"))
+	assert.True(t, kb.AddFrom("b", dims, "b"))
+	assert.True(t, kb.AddFrom("bb", dims, "c"), "should be able to rename")
+	assert.True(t, kb.AddFrom("d", dims, "d"))
+	assert.True(t, kb.AddFrom("e", dims, "e"))
+	assert.False(t, kb.AddFrom("f", dims, "f"), "nil values shouldn't be added")
+	assert.False(t, kb.AddFrom("g", dims, "g"), "missing values shouldn't be added")
+	kb.Add("h", "computed")
+	kb.Add("i", nil)
+	assert.Equal(t, 6, kb.Len())
+	key := kb.Build()
+	kb.Release()
+
+	expected := bytemap.FromSortedKeysAndValues(
+		[]string{"a", "b", "bb", "d", "e", "h"},
+		[]interface{}{"aval", 5, 6.5, true, time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC), "computed"})
+	assert.Equal(t, expected, key)
+	assert.Equal(t, "aval", key.Get("a"))
+	assert.Equal(t, 6.5, key.Get("bb"))
+	ReleaseKey(key)
+
+	// Reused builders and key buffers start out empty
+	kb = AcquireKeyBuilder()
+	assert.Equal(t, 0, kb.Len())
+	kb.AddFrom("a", dims, "a")
+	key = kb.Build()
+	kb.Release()
+	assert.Equal(t, bytemap.FromSortedKeysAndValues([]string{"a"}, []interface{}{"aval"}), key)
+
+	kb = AcquireKeyBuilder()
+	assert.Empty(t, kb.Build(), "empty builder should build empty key")
+	kb.Release()
+}
+
+func TestKeyBuilderOrdersByName(t *testing.T) {
+	dims := bytemap.New(map[string]interface{}{"a": "aval", "b": 5})
+	kb := AcquireKeyBuilder()
+	kb.Add("c", "cval")
+	kb.AddFrom("a", dims, "a")
+	kb.AddFrom("b", dims, "b")
+	kb.Add("a", "ignored")
+	key := kb.Build()
+	kb.Release()
+	assert.Equal(t, bytemap.New(map[string]interface{}{"a": "aval", "b": 5, "c": "cval"}), key, "values should be ordered by name, keeping the first value for each name")
+}
+
+func TestCanonicalKey(t *testing.T) {
+	canonical := bytemap.New(map[string]interface{}{"a": "aval", "b": 5, "c": 6.5})
+	key, rebuilt := CanonicalKey(canonical)
+	assert.False(t, rebuilt)
+	assert.Equal(t, canonical, key)
+
+	unsorted := bytemap.FromSortedKeysAndValues([]string{"c", "b", "a"}, []interface{}{6.5, 5, "aval"})
+	assert.NotEqual(t, canonical, unsorted)
+	key, rebuilt = CanonicalKey(unsorted)
+	assert.True(t, rebuilt)
+	assert.Equal(t, canonical, key)
+
+	duplicated := bytemap.FromSortedKeysAndValues([]string{"a", "a", "b", "c"}, []interface{}{"aval", "other", 5, 6.5})
+	key, rebuilt = CanonicalKey(duplicated)
+	assert.True(t, rebuilt)
+	assert.Equal(t, canonical, key)
+
+	key, rebuilt = CanonicalKey(nil)
+	assert.False(t, rebuilt)
+	assert.Empty(t, key)
+}
+
+func BenchmarkKeyBuilder(b *testing.B) {
+	dims := bytemap.New(map[string]interface{}{"a": "aval", "b": "bval", "c": "cval", "d": 5})
+	names := []string{"a", "b", "d"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		kb := AcquireKeyBuilder()
+		for _, name := range names {
+			kb.AddFrom(name, dims, name)
+		}
+		key := kb.Build()
+		kb.Release()
+		ReleaseKey(key)
+	}
+}
+
+func BenchmarkFromSortedKeysAndValues(b *testing.B) {
+	dims := bytemap.New(map[string]interface{}{"a": "aval", "b": "bval", "c": "cval", "d": 5})
+	names := []string{"a", "b", "d"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		values := make([]interface{}, 0, len(names))
+		for _, name := range names {
+			values = append(values, dims.Get(name))
+		}
+		bytemap.FromSortedKeysAndValues(names, values)
+	}
+}
@@ -0,0 +1,169 @@
+package encoding
+
+import (
+	"time"
+
+	"github.com/getlantern/goexpr"
+	"github.com/getlantern/zenodb/expr"
+)
+
+// RowSequence is like a Sequence, but instead of holding the accumulator
+// state of a single Expr, it holds the states of several Exprs inline for each
+// period. The first 8 bytes are the timestamp at which the RowSequence ends,
+// and after that each period holds the states of all Exprs in order, going back
+// in time. This makes reading all fields for a given period a single
+// contiguous read.
+//
+// Constant Exprs take up no space in a RowSequence.
+type RowSequence []byte
+
+// RowWidth returns the number of bytes needed to hold the states of the given
+// Exprs for a single period.
+func RowWidth(exprs []expr.Expr) int {
+	width := 0
+	for _, e := range exprs {
+		width += e.EncodedWidth()
+	}
+	return width
+}
+
+// NewRowSequence allocates a new RowSequence that holds the given number of
+// periods for the given Exprs.
+func NewRowSequence(exprs []expr.Expr, numPeriods int) RowSequence {
+	return make(RowSequence, Width64bits+numPeriods*RowWidth(exprs))
+}
+
+// ToRowSequence combines the given columns, which hold data for the
+// corresponding Exprs, into a single RowSequence spanning from the earliest to
+// the latest period in any column. Returns nil if all columns are empty.
+func ToRowSequence(exprs []expr.Expr, resolution time.Duration, columns []Sequence) RowSequence {
+	var until time.Time
+	var asOf time.Time
+	for i, col := range columns {
+		width := exprs[i].EncodedWidth()
+		if width == 0 || col.NumPeriods(width) == 0 {
+			continue
+		}
+		colUntil := col.Until()
+		colAsOf := col.AsOf(width, resolution)
+		if until.IsZero() || colUntil.After(until) {
+			until = colUntil
+		}
+		if asOf.IsZero() || colAsOf.Before(asOf) {
+			asOf = colAsOf
+		}
+	}
+	if until.IsZero() {
+		return nil
+	}
+
+	numPeriods := int(until.Sub(asOf) / resolution)
+	rowWidth := RowWidth(exprs)
+	rs := NewRowSequence(exprs, numPeriods)
+	rs.SetUntil(until)
+	data := rs[Width64bits:]
+	fieldOffset := 0
+	for i, col := range columns {
+		width := exprs[i].EncodedWidth()
+		if width == 0 || col.NumPeriods(width) == 0 {
+			fieldOffset += width
+			continue
+		}
+		periodOffset := int(until.Sub(col.Until()) / resolution)
+		colData := col[Width64bits:]
+		for p := 0; p < col.NumPeriods(width); p++ {
+			start := (periodOffset+p)*rowWidth + fieldOffset
+			copy(data[start:start+width], colData[p*width:])
+		}
+		fieldOffset += width
+	}
+	return rs
+}
+
+// Until returns the most recent date represented by this RowSequence.
+func (rs RowSequence) Until() time.Time {
+	return Sequence(rs).Until()
+}
+
+// SetUntil sets the until time of this RowSequence.
+func (rs RowSequence) SetUntil(t time.Time) {
+	Sequence(rs).SetUntil(t)
+}
+
+// NumPeriods returns the number of periods in this RowSequence for the given
+// Exprs.
+func (rs RowSequence) NumPeriods(exprs []expr.Expr) int {
+	rowWidth := RowWidth(exprs)
+	if len(rs) == 0 || rowWidth == 0 {
+		return 0
+	}
+	return (len(rs) - Width64bits) / rowWidth
+}
+
+// ValuesAt reads the values of all Exprs at the given period into vals, which
+// must have the same length as exprs, and returns whether any non-constant
+// Expr had a value set. Unset values are 0.
+func (rs RowSequence) ValuesAt(period int, exprs []expr.Expr, vals []float64) (anySet bool) {
+	if period < 0 || period >= rs.NumPeriods(exprs) {
+		for i, e := range exprs {
+			vals[i] = 0
+			if e.IsConstant() {
+				vals[i], _, _ = e.Get(nil)
+			}
+		}
+		return false
+	}
+	b := rs[Width64bits+period*RowWidth(exprs):]
+	for i, e := range exprs {
+		var wasSet bool
+		if e.IsConstant() {
+			vals[i], _, _ = e.Get(nil)
+			continue
+		}
+		vals[i], wasSet, b = e.Get(b)
+		if wasSet {
+			anySet = true
+		}
+	}
+	return
+}
+
+// UpdateValuesAt updates the states of all Exprs at the given period by
+// applying the supplied Params and metadata.
+func (rs RowSequence) UpdateValuesAt(period int, exprs []expr.Expr, params expr.Params, metadata goexpr.Params) {
+	b := rs[Width64bits+period*RowWidth(exprs):]
+	for _, e := range exprs {
+		width := e.EncodedWidth()
+		e.Update(b, params, metadata)
+		b = b[width:]
+	}
+}
+
+// Columns splits this RowSequence back into one Sequence per Expr. Constant
+// Exprs get nil Sequences.
+func (rs RowSequence) Columns(exprs []expr.Expr) []Sequence {
+	columns := make([]Sequence, len(exprs))
+	numPeriods := rs.NumPeriods(exprs)
+	if numPeriods == 0 {
+		return columns
+	}
+	rowWidth := RowWidth(exprs)
+	data := rs[Width64bits:]
+	fieldOffset := 0
+	for i, e := range exprs {
+		width := e.EncodedWidth()
+		if width == 0 {
+			continue
+		}
+		col := NewSequence(width, numPeriods)
+		copy(col, rs[:Width64bits])
+		colData := col[Width64bits:]
+		for p := 0; p < numPeriods; p++ {
+			start := p*rowWidth + fieldOffset
+			copy(colData[p*width:], data[start:start+width])
+		}
+		columns[i] = col
+		fieldOffset += width
+	}
+	return columns
+}
@@ -0,0 +1,52 @@
+package encoding
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/getlantern/zenodb/expr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRowSequence(t *testing.T) {
+	eA := SUM(FIELD("a"))
+	eB := AVG(FIELD("b"))
+	exprs := []Expr{eA, CONST(5), eB}
+	columns := []Sequence{
+		seqWithValues(eA, epoch, 1, 2),
+		nil,
+		seqWithValues(eB, epoch.Add(-1*res), 3, 0, 4),
+	}
+
+	rs := ToRowSequence(exprs, res, columns)
+	assert.Equal(t, epoch, rs.Until().In(time.UTC))
+	if !assert.Equal(t, 4, rs.NumPeriods(exprs)) {
+		return
+	}
+	assert.Len(t, rs, Width64bits+4*(eA.EncodedWidth()+eB.EncodedWidth()), "constant shouldn't take up space")
+
+	vals := make([]float64, len(exprs))
+	checkValues := func(period int, expectedAnySet bool, expected ...float64) {
+		anySet := rs.ValuesAt(period, exprs, vals)
+		assert.Equal(t, expectedAnySet, anySet, "period %d", period)
+		assert.Equal(t, expected, vals, "period %d", period)
+	}
+	checkValues(0, true, 1, 5, 0)
+	checkValues(1, true, 2, 5, 3)
+	checkValues(2, false, 0, 5, 0)
+	checkValues(3, true, 0, 5, 4)
+	checkValues(4, false, 0, 5, 0)
+
+	roundTripped := rs.Columns(exprs)
+	if assert.Len(t, roundTripped, 3) {
+		checkUpdatedValues(t, eA, roundTripped[0], []float64{1, 2, 0, 0})
+		assert.Nil(t, roundTripped[1])
+		checkUpdatedValues(t, eB, roundTripped[2], []float64{0, 3, 0, 4})
+	}
+
+	rs.UpdateValuesAt(2, exprs, FloatParams(6), nil)
+	checkValues(2, true, 6, 5, 6)
+
+	assert.Nil(t, ToRowSequence(exprs, res, make([]Sequence, len(exprs))))
+	assert.Equal(t, make([]Sequence, len(exprs)), RowSequence(nil).Columns(exprs))
+}
@@ -6,12 +6,12 @@ import (
 	"time"
 
 	"github.com/getlantern/goexpr"
-	"github.com/getlantern/golog"
 	"github.com/getlantern/zenodb/expr"
+	"github.com/getlantern/zenodb/logging"
 )
 
 var (
-	log = golog.LoggerFor("zenodb.encoding")
+	log = logging.LoggerFor("zenodb.encoding")
 )
 
 // Sequence represents a time-ordered sequence of accumulator states in
@@ -141,6 +141,42 @@ func (seq Sequence) ValueAtOffset(offset int, e expr.Expr) (val float64, found b
 	return val, wasSet
 }
 
+// Iterate calls fn with the timestamp and value of each period in this
+// Sequence that has a value set, going from newest to oldest, until fn returns
+// false. It's much cheaper than calling ValueAtTime for each period. Constant
+// Exprs don't store any periods, so fn is never called for them.
+func (seq Sequence) Iterate(e expr.Expr, resolution time.Duration, fn func(ts time.Time, val float64) bool) {
+	seq.iterate(e, resolution, false, fn)
+}
+
+// IterateReverse is like Iterate but goes from oldest to newest.
+func (seq Sequence) IterateReverse(e expr.Expr, resolution time.Duration, fn func(ts time.Time, val float64) bool) {
+	seq.iterate(e, resolution, true, fn)
+}
+
+func (seq Sequence) iterate(e expr.Expr, resolution time.Duration, reverse bool, fn func(ts time.Time, val float64) bool) {
+	width := e.EncodedWidth()
+	if len(seq) == 0 || width == 0 {
+		return
+	}
+	numPeriods := seq.NumPeriods(width)
+	until := seq.Until()
+	data := seq[Width64bits:]
+	for i := 0; i < numPeriods; i++ {
+		period := i
+		if reverse {
+			period = numPeriods - 1 - i
+		}
+		val, wasSet, _ := e.Get(data[period*width:])
+		if !wasSet {
+			continue
+		}
+		if !fn(until.Add(-1*time.Duration(period)*resolution), val) {
+			return
+		}
+	}
+}
+
 // UpdateValueAt updates the value at the given period by applying the supplied
 // Params to the given expression. metadata represents metadata about the
 // operation that's used by the Expr as well (e.g. information about the
@@ -220,8 +256,14 @@ func (seq Sequence) UpdateValue(ts time.Time, params expr.Params, metadata goexp
 			numPeriods = maxPeriods
 			origEnd = Width64bits + width*(numPeriods-gapPeriods)
 		}
-		out := NewSequence(width, numPeriods)
+		length := Width64bits + numPeriods*width
+		out := seq.reuse(length)
+		if out == nil {
+			out = make(Sequence, length, grownCapacity(length, Width64bits+maxPeriods*width))
+		}
+		// copy handles overlap when prepending in place
 		copy(out[Width64bits+gapPeriods*width:], seq[Width64bits:origEnd])
+		zero(out[Width64bits : Width64bits+gapPeriods*width])
 		out.SetUntil(ts)
 		out.UpdateValueAt(0, e, params, metadata)
 		return out
@@ -233,13 +275,52 @@ func (seq Sequence) UpdateValue(ts time.Time, params expr.Params, metadata goexp
 	offset := period * width
 	if offset+width >= len(seq) {
 		// Grow seq
-		out = make(Sequence, offset+Width64bits+width)
-		copy(out, seq)
+		length := offset + Width64bits + width
+		out = seq.reuse(length)
+		if out == nil {
+			out = make(Sequence, length, grownCapacity(length, Width64bits+maxPeriods*width))
+			copy(out, seq)
+		} else {
+			zero(out[len(seq):])
+		}
 	}
 	out.UpdateValueAtOffset(offset, e, params, metadata)
 	return out
 }
 
+// reuse returns seq resliced to the given length if it has spare capacity to
+// grow into that was left by grownCapacity, or nil if it doesn't. Callers that
+// share a Sequence and don't want it to be modified in place can prevent this
+// by limiting its capacity to its length. Bytes past len(seq) may hold stale
+// data and need to be zeroed by the caller.
+func (seq Sequence) reuse(length int) Sequence {
+	if cap(seq) <= len(seq) || cap(seq) < length {
+		return nil
+	}
+	return seq[:length]
+}
+
+// grownCapacity determines the capacity with which to allocate a Sequence of
+// the given length that's growing over time. Leaving room to grow into allows
+// subsequent periods to be added in place, which saves allocating a new
+// Sequence every period for keys that are updated frequently.
+func grownCapacity(length int, maxLength int) int {
+	capacity := length * 2
+	if capacity > maxLength {
+		capacity = maxLength
+	}
+	if capacity < length {
+		capacity = length
+	}
+	return capacity
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
 func (seq Sequence) SubMerge(other Sequence, metadata goexpr.Params, resolution time.Duration, otherResolution time.Duration, ex expr.Expr, otherEx expr.Expr, submerge expr.SubMerge, asOf time.Time, until time.Time, strideSlice time.Duration) (result Sequence) {
 	shiftBack := -1 * ex.Shift()
 	result = seq
@@ -307,6 +388,18 @@ func (seq Sequence) SubMerge(other Sequence, metadata goexpr.Params, resolution
 	untilOffset := int(resultUntil.Sub(otherUntil) / otherResolution)
 	resultPeriods := result.NumPeriods(width)
 	strideSlicePeriods := int(strideSlice / otherResolution)
+	if _, vectorizable := ex.(expr.VectorMerger); vectorizable && scale == 1 && strideSlice <= 0 && ex.String() == otherEx.String() {
+		// Periods line up one to one, merge them all at once
+		n := otherPeriods
+		if n > resultPeriods-untilOffset {
+			n = resultPeriods - untilOffset
+		}
+		if n > 0 {
+			data := result[Width64bits+untilOffset*width:]
+			expr.MergeN(ex, data, data, other[Width64bits:], n)
+		}
+		return
+	}
 	for po := 0; po < otherPeriods; po++ {
 		p := int(math.Floor(float64(po+untilOffset) / float64(scale)))
 		if p >= resultPeriods {
@@ -393,8 +486,10 @@ func (seq Sequence) Merge(other Sequence, e expr.Expr, resolution time.Duration,
 			overlapPeriods = int(startA.Sub(endA) / resolution)
 		}
 		overlapPeriods -= leadNoOverlapPeriods
-		for i := 0; i < overlapPeriods; i++ {
-			sout, sa, sb = e.Merge(sout, sa, sb)
+		if overlapPeriods > 0 {
+			expr.MergeN(e, sout, sa, sb, overlapPeriods)
+			l := overlapPeriods * encodedWidth
+			sout, sa, sb = sout[l:], sa[l:], sb[l:]
 		}
 	} else if startB.Before(endA) {
 		// Handle gap
@@ -413,6 +508,103 @@ func (seq Sequence) Merge(other Sequence, e expr.Expr, resolution time.Duration,
 	return out
 }
 
+// MergeStrategy combines the accumulator states x and y for a single period
+// in which both Sequences have data, writing the result to out. x comes from
+// the Sequence being merged into and y from the other Sequence.
+type MergeStrategy func(e expr.Expr, out []byte, x []byte, y []byte)
+
+var (
+	// Accumulate merges both states using the Expr's merge operator, as if all
+	// of the underlying points had been inserted into a single Sequence. Use it
+	// for merging in late-arriving data.
+	Accumulate MergeStrategy = func(e expr.Expr, out []byte, x []byte, y []byte) {
+		e.Merge(out, x, y)
+	}
+
+	// PreferSelf keeps the state from the Sequence being merged into, only
+	// taking the other Sequence's state where it has none.
+	PreferSelf MergeStrategy = func(e expr.Expr, out []byte, x []byte, y []byte) {
+		preferFirst(e, out, x, y)
+	}
+
+	// PreferOther takes the state from the other Sequence, only keeping the
+	// state of the Sequence being merged into where the other has none. Use it
+	// to reconcile with a replica that's known to be authoritative.
+	PreferOther MergeStrategy = func(e expr.Expr, out []byte, x []byte, y []byte) {
+		preferFirst(e, out, y, x)
+	}
+)
+
+func preferFirst(e expr.Expr, out []byte, first []byte, second []byte) {
+	if _, wasSet, _ := e.Get(first); wasSet {
+		copy(out, first)
+	} else {
+		copy(out, second)
+	}
+}
+
+// MergeWith merges the other Sequence into this one using the given strategy
+// for periods in which both Sequences have data. Unlike Merge, the Sequences
+// may cover any time ranges, including overlapping and disjoint ones, and the
+// result spans from the earliest to the latest period in either. Both
+// Sequences must use the given resolution.
+//
+// The returned Sequence may reference the same underlying byte array as one or
+// the other Sequence if either is empty, otherwise it will be a newly
+// allocated byte array. MergeWith will NOT update either of the supplied
+// arrays.
+func (seq Sequence) MergeWith(other Sequence, e expr.Expr, resolution time.Duration, strategy MergeStrategy) Sequence {
+	if len(seq) == 0 {
+		return other
+	}
+	if len(other) == 0 {
+		return seq
+	}
+
+	width := e.EncodedWidth()
+	untilA, untilB := seq.Until(), other.Until()
+	asOfA, asOfB := seq.AsOf(width, resolution), other.AsOf(width, resolution)
+	until := untilA
+	if untilB.After(until) {
+		until = untilB
+	}
+	asOf := asOfA
+	if asOfB.Before(asOf) {
+		asOf = asOfB
+	}
+
+	numPeriods := int(until.Sub(asOf) / resolution)
+	out := NewSequence(width, numPeriods)
+	out.SetUntil(until)
+
+	// Periods in each Sequence are offset from the periods in out by the
+	// difference in their until
+	offsetA := int(until.Sub(untilA) / resolution)
+	offsetB := int(until.Sub(untilB) / resolution)
+	periodsA := seq.NumPeriods(width)
+	periodsB := other.NumPeriods(width)
+	dataOut := out[Width64bits:]
+	dataA := seq[Width64bits:]
+	dataB := other[Width64bits:]
+	for p := 0; p < numPeriods; p++ {
+		o := dataOut[p*width : (p+1)*width]
+		pa := p - offsetA
+		pb := p - offsetB
+		inA := pa >= 0 && pa < periodsA
+		inB := pb >= 0 && pb < periodsB
+		switch {
+		case inA && inB:
+			strategy(e, o, dataA[pa*width:(pa+1)*width], dataB[pb*width:(pb+1)*width])
+		case inA:
+			copy(o, dataA[pa*width:(pa+1)*width])
+		case inB:
+			copy(o, dataB[pb*width:(pb+1)*width])
+		}
+	}
+
+	return out
+}
+
 // Truncate truncates all periods in the Sequence that fall outside of the given
 // asOf and until.
 func (seq Sequence) Truncate(width int, resolution time.Duration, asOf time.Time, until time.Time) (result Sequence) {
@@ -452,6 +644,53 @@ func (seq Sequence) Truncate(width int, resolution time.Duration, asOf time.Time
 	return result
 }
 
+// Window returns the periods in the Sequence that fall within the given asOf
+// and until, like Truncate, but without modifying the Sequence. Periods
+// before asOf are dropped by reslicing. Dropping periods after until requires
+// a new header, so the periods within the window are copied into a new
+// Sequence. Either way, only the periods within the window are touched.
+func (seq Sequence) Window(width int, resolution time.Duration, asOf time.Time, until time.Time) Sequence {
+	if len(seq) == 0 {
+		return nil
+	}
+	oldUntil := seq.Until()
+	asOf = RoundTimeUntilDown(asOf, resolution, oldUntil)
+	until = RoundTimeUntilDown(until, resolution, oldUntil)
+
+	start := Width64bits
+	newUntil := oldUntil
+	if !until.IsZero() {
+		periodsToRemove := int(oldUntil.Sub(until) / resolution)
+		if periodsToRemove > 0 {
+			start += periodsToRemove * width
+			if start >= len(seq) {
+				return nil
+			}
+			newUntil = until
+		}
+	}
+
+	end := len(seq)
+	if !asOf.IsZero() {
+		maxPeriods := int(newUntil.Sub(asOf) / resolution)
+		if maxPeriods <= 0 {
+			// Entire sequence falls outside of window
+			return nil
+		}
+		if maxEnd := start + maxPeriods*width; maxEnd < end {
+			end = maxEnd
+		}
+	}
+
+	if start == Width64bits {
+		return seq[:end]
+	}
+	result := make(Sequence, Width64bits+end-start)
+	result.SetUntil(newUntil)
+	copy(result[Width64bits:], seq[start:end])
+	return result
+}
+
 // String provides a string representation of this Sequence assuming that it
 // holds data for the given Expr.
 func (seq Sequence) String(e expr.Expr, resolution time.Duration) string {
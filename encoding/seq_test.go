@@ -102,6 +102,80 @@ func TestSequenceUpdate(t *testing.T) {
 	}
 }
 
+func TestSequenceUpdateInPlace(t *testing.T) {
+	e := SUM("a")
+	var seq Sequence
+	periods := 100
+	params := make([]Params, 0, periods)
+	for i := 0; i < periods; i++ {
+		params = append(params, FloatParams(i+1))
+	}
+	allocs := testing.AllocsPerRun(1, func() {
+		seq = nil
+		for i := 0; i < periods; i++ {
+			seq = seq.UpdateValue(epoch.Add(time.Duration(i)*res), params[i], nil, e, res, truncateBefore)
+		}
+	})
+	assert.True(t, allocs < float64(periods)/4, "growing sequence should mostly happen in place, but allocated %v times", allocs)
+	expected := make([]float64, 0, periods)
+	for i := periods; i > 0; i-- {
+		expected = append(expected, float64(i))
+	}
+	checkUpdatedValues(t, e, seq, expected)
+
+	// Sequences without spare capacity are never modified in place
+	limited := seq[:len(seq):len(seq)]
+	orig := append(Sequence(nil), limited...)
+	grown := limited.UpdateValue(epoch.Add(time.Duration(periods)*res), FloatParams(1), nil, e, res, truncateBefore)
+	assert.Equal(t, orig, limited)
+	assert.Equal(t, periods+1, grown.NumPeriods(e.EncodedWidth()))
+}
+
+func TestSequenceUpdateOutOfOrder(t *testing.T) {
+	e := SUM("a")
+	periods := 100
+	var inOrder, outOfOrder Sequence
+	for i := 0; i < periods; i++ {
+		inOrder = inOrder.UpdateValue(epoch.Add(time.Duration(i)*res), FloatParams(i+1), nil, e, res, truncateBefore)
+	}
+	for _, i := range rand.Perm(periods) {
+		outOfOrder = outOfOrder.UpdateValue(epoch.Add(time.Duration(i)*res), FloatParams(i+1), nil, e, res, truncateBefore)
+	}
+	assert.Equal(t, []byte(inOrder), []byte(outOfOrder))
+}
+
+// The below benchmarks compare updating periods in order with updating them in
+// random order. Older periods are addressed directly by their offset from the
+// sequence's until, so ordering shouldn't make much of a difference.
+
+func BenchmarkUpdateValueInOrder(b *testing.B) {
+	benchmarkUpdateValue(b, func(periods int) []int {
+		order := make([]int, periods)
+		for i := range order {
+			order[i] = i
+		}
+		return order
+	})
+}
+
+func BenchmarkUpdateValueOutOfOrder(b *testing.B) {
+	benchmarkUpdateValue(b, rand.Perm)
+}
+
+func benchmarkUpdateValue(b *testing.B, orderOf func(periods int) []int) {
+	e := SUM("a")
+	periods := 500
+	order := orderOf(periods)
+	params := FloatParams(1)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		var seq Sequence
+		for _, i := range order {
+			seq = seq.UpdateValue(epoch.Add(time.Duration(i)*res), params, nil, e, res, truncateBefore)
+		}
+	}
+}
+
 func checkUpdatedValues(t *testing.T, e Expr, seq Sequence, expected []float64) {
 	if assert.Equal(t, len(expected), seq.NumPeriods(e.EncodedWidth())) {
 		for i, v := range expected {
@@ -173,6 +247,43 @@ func TestSequenceFull(t *testing.T) {
 	}
 }
 
+func TestSequenceWindow(t *testing.T) {
+	e := SUM(FIELD("a"))
+	width := e.EncodedWidth()
+	length := 10
+	seq := NewSequence(width, length)
+	seq.SetUntil(epoch)
+	for i := 0; i < length; i++ {
+		seq.UpdateValueAt(i, e, Map(map[string]float64{"a": float64(i)}), nil)
+	}
+	original := make(Sequence, len(seq))
+	copy(original, seq)
+
+	check := func(asOf time.Time, until time.Time) {
+		truncatable := make(Sequence, len(seq))
+		copy(truncatable, seq)
+		expected := truncatable.Truncate(width, res, asOf, until)
+		windowed := seq.Window(width, res, asOf, until)
+		if assert.Equal(t, expected.NumPeriods(width), windowed.NumPeriods(width), "Wrong number of periods for %v to %v", asOf, until) && len(expected) > 0 {
+			assert.Equal(t, expected.Until(), windowed.Until())
+			for i := 0; i < expected.NumPeriods(width); i++ {
+				expectedVal, _ := expected.ValueAt(i, e)
+				val, _ := windowed.ValueAt(i, e)
+				assert.Equal(t, expectedVal, val)
+			}
+		}
+		assert.Equal(t, original, seq, "Window shouldn't modify the sequence")
+	}
+
+	check(time.Time{}, time.Time{})
+	check(epoch.Add(-5*res), time.Time{})
+	check(time.Time{}, epoch.Add(-3*res))
+	check(epoch.Add(-7*res), epoch.Add(-2*res))
+	check(epoch.Add(-20*res), epoch.Add(20*res))
+	check(epoch.Add(5*res), time.Time{})
+	check(time.Time{}, epoch.Add(-20*res))
+}
+
 func TestSequenceValue(t *testing.T) {
 	e := SUM(FIELD("a"))
 	v := NewFloatValue(e, epoch, 56.78)
@@ -279,6 +390,75 @@ func doTestSequenceSubMerge(t *testing.T, _strideSlice int) {
 	testSubMergeParts(random)
 }
 
+func TestSequenceMergeWith(t *testing.T) {
+	e := SUM(FIELD("a"))
+	a := seqWithValues(e, epoch, 1, 2, 0, 4)
+	b := seqWithValues(e, epoch.Add(2*res), 5, 0, 6, 7)
+	aCopy := append(Sequence(nil), a...)
+	bCopy := append(Sequence(nil), b...)
+
+	accumulated := a.MergeWith(b, e, res, Accumulate)
+	assert.Equal(t, epoch.Add(2*res), accumulated.Until().In(time.UTC))
+	checkUpdatedValues(t, e, accumulated, []float64{5, 0, 7, 9, 0, 4})
+	checkUpdatedValues(t, e, a.MergeWith(b, e, res, PreferSelf), []float64{5, 0, 1, 2, 0, 4})
+	checkUpdatedValues(t, e, a.MergeWith(b, e, res, PreferOther), []float64{5, 0, 6, 7, 0, 4})
+	checkUpdatedValues(t, e, b.MergeWith(a, e, res, PreferOther), []float64{5, 0, 1, 2, 0, 4})
+	assert.Equal(t, aCopy, a, "MergeWith shouldn't modify sequence")
+	assert.Equal(t, bCopy, b, "MergeWith shouldn't modify other sequence")
+
+	disjoint := a.MergeWith(seqWithValues(e, epoch.Add(-10*res), 3), e, res, Accumulate)
+	assert.Equal(t, epoch, disjoint.Until().In(time.UTC))
+	checkUpdatedValues(t, e, disjoint, []float64{1, 2, 0, 4, 0, 0, 0, 0, 0, 0, 3})
+
+	assert.Equal(t, a, a.MergeWith(nil, e, res, Accumulate))
+	assert.Equal(t, b, Sequence(nil).MergeWith(b, e, res, Accumulate))
+}
+
+// seqWithValues builds a Sequence ending at until with the given values going
+// back in time, leaving periods with a value of 0 unset.
+func seqWithValues(e Expr, until time.Time, vals ...float64) Sequence {
+	seq := NewSequence(e.EncodedWidth(), len(vals))
+	seq.SetUntil(until)
+	for i, val := range vals {
+		if val != 0 {
+			seq.UpdateValueAt(i, e, FloatParams(val), nil)
+		}
+	}
+	return seq
+}
+
 func randBelow(res time.Duration) time.Duration {
 	return time.Duration(-1 * rand.Intn(int(res)))
 }
+
+func TestSequenceIterate(t *testing.T) {
+	e := SUM(FIELD("a"))
+	seq := seqWithValues(e, epoch, 1, 0, 3, 4)
+
+	var timestamps []time.Time
+	var vals []float64
+	seq.Iterate(e, res, func(ts time.Time, val float64) bool {
+		timestamps = append(timestamps, ts.In(time.UTC))
+		vals = append(vals, val)
+		return true
+	})
+	assert.Equal(t, []time.Time{epoch, epoch.Add(-2 * res), epoch.Add(-3 * res)}, timestamps)
+	assert.Equal(t, []float64{1, 3, 4}, vals)
+
+	timestamps = nil
+	vals = nil
+	seq.IterateReverse(e, res, func(ts time.Time, val float64) bool {
+		timestamps = append(timestamps, ts.In(time.UTC))
+		vals = append(vals, val)
+		return len(vals) < 2
+	})
+	assert.Equal(t, []time.Time{epoch.Add(-3 * res), epoch.Add(-2 * res)}, timestamps)
+	assert.Equal(t, []float64{4, 3}, vals, "IterateReverse should stop when fn returns false")
+
+	called := false
+	Sequence(nil).Iterate(e, res, func(ts time.Time, val float64) bool {
+		called = true
+		return true
+	})
+	assert.False(t, called, "Iterating empty sequence shouldn't call fn")
+}
@@ -21,6 +21,15 @@ func TimeFromBytes(b []byte) time.Time {
 	return TimeFromInt(TimeIntFromBytes(b))
 }
 
+// ReadTimeChecked reads a time encoded with EncodeTime from b and returns it
+// along with the remainder of b, or an error if b is too short.
+func ReadTimeChecked(b []byte) (time.Time, []byte, error) {
+	if len(b) < WidthTime {
+		return zeroTime, b, shortBuffer("time", WidthTime, b)
+	}
+	return TimeFromBytes(b), b[WidthTime:], nil
+}
+
 func TimeIntFromBytes(b []byte) int64 {
 	return int64(Binary.Uint64(b))
 }
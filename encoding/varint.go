@@ -0,0 +1,99 @@
+package encoding
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// MaxVarintLen64 is the maximum number of bytes taken up by a varint encoded
+	// 64 bit value.
+	MaxVarintLen64 = binary.MaxVarintLen64
+)
+
+// UvarintSize returns the number of bytes needed to varint encode x.
+func UvarintSize(x uint64) int {
+	size := 1
+	for x >= 0x80 {
+		x >>= 7
+		size++
+	}
+	return size
+}
+
+// WriteUvarint varint encodes x into b, which must be large enough to hold it,
+// and returns the remainder of b.
+func WriteUvarint(b []byte, x uint64) []byte {
+	n := binary.PutUvarint(b, x)
+	return b[n:]
+}
+
+// ReadUvarint reads a varint encoded value from b and returns it along with the
+// remainder of b. It panics if b doesn't hold a valid varint, use
+// ReadUvarintChecked for data that hasn't been validated.
+func ReadUvarint(b []byte) (uint64, []byte) {
+	x, n := binary.Uvarint(b)
+	if n <= 0 {
+		panic(uvarintError(n))
+	}
+	return x, b[n:]
+}
+
+// ReadUvarintChecked is like ReadUvarint but returns an error instead of
+// panicking if b doesn't hold a valid varint.
+func ReadUvarintChecked(b []byte) (uint64, []byte, error) {
+	x, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, b, uvarintError(n)
+	}
+	return x, b[n:], nil
+}
+
+func uvarintError(n int) error {
+	if n == 0 {
+		return fmt.Errorf("Not enough data left to decode varint")
+	}
+	return fmt.Errorf("Varint overflows 64 bits")
+}
+
+// ZigZag maps signed values to unsigned values such that values with a small
+// magnitude, positive or negative, have small varint encodings.
+func ZigZag(x int64) uint64 {
+	return uint64(x<<1) ^ uint64(x>>63)
+}
+
+// UnZigZag reverses ZigZag.
+func UnZigZag(x uint64) int64 {
+	return int64(x>>1) ^ -int64(x&1)
+}
+
+// ZigZagDeltaSize returns the number of bytes needed to encode x as a delta
+// from prev.
+func ZigZagDeltaSize(prev int64, x int64) int {
+	return UvarintSize(ZigZag(x - prev))
+}
+
+// WriteZigZagDelta encodes x as a zigzag varint delta from prev into b, which
+// must be large enough to hold it, and returns the remainder of b. This is
+// useful for compactly encoding series of similar values like timestamps.
+func WriteZigZagDelta(b []byte, prev int64, x int64) []byte {
+	return WriteUvarint(b, ZigZag(x-prev))
+}
+
+// ReadZigZagDelta reads a value encoded with WriteZigZagDelta relative to prev
+// and returns it along with the remainder of b. It panics if b doesn't hold a
+// valid varint, use ReadZigZagDeltaChecked for data that hasn't been validated.
+func ReadZigZagDelta(b []byte, prev int64) (int64, []byte) {
+	delta, b := ReadUvarint(b)
+	return prev + UnZigZag(delta), b
+}
+
+// ReadZigZagDeltaChecked is like ReadZigZagDelta but returns an error instead
+// of panicking if b doesn't hold a valid varint.
+func ReadZigZagDeltaChecked(b []byte, prev int64) (int64, []byte, error) {
+	delta, b, err := ReadUvarintChecked(b)
+	if err != nil {
+		return 0, b, err
+	}
+	return prev + UnZigZag(delta), b, nil
+}
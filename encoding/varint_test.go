@@ -0,0 +1,79 @@
+package encoding
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUvarint(t *testing.T) {
+	vals := []uint64{0, 1, 127, 128, 300, math.MaxUint32, math.MaxUint64}
+	for _, val := range vals {
+		size := UvarintSize(val)
+		b := make([]byte, size+1)
+		remain := WriteUvarint(b, val)
+		assert.Len(t, remain, 1, "wrong size for %d", val)
+
+		read, remain := ReadUvarint(b)
+		assert.Equal(t, val, read)
+		assert.Len(t, remain, 1)
+
+		read, remain, err := ReadUvarintChecked(b)
+		if assert.NoError(t, err) {
+			assert.Equal(t, val, read)
+			assert.Len(t, remain, 1)
+		}
+	}
+
+	_, _, err := ReadUvarintChecked(nil)
+	assert.Error(t, err, "empty input should fail")
+	_, _, err = ReadUvarintChecked([]byte{0x80, 0x80})
+	assert.Error(t, err, "truncated input should fail")
+	_, _, err = ReadUvarintChecked([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01})
+	assert.Error(t, err, "overflowing input should fail")
+	assert.Panics(t, func() { ReadUvarint([]byte{0x80}) })
+}
+
+func TestZigZag(t *testing.T) {
+	assert.EqualValues(t, 0, ZigZag(0))
+	assert.EqualValues(t, 1, ZigZag(-1))
+	assert.EqualValues(t, 2, ZigZag(1))
+	assert.EqualValues(t, 3, ZigZag(-2))
+	for _, val := range []int64{0, 1, -1, 1000, -1000, math.MaxInt64, math.MinInt64} {
+		assert.Equal(t, val, UnZigZag(ZigZag(val)))
+	}
+}
+
+func TestZigZagDelta(t *testing.T) {
+	vals := []int64{1500000000000000000, 1500000000000000000, 1500000001000000000, 1499999999000000000, 0}
+	b := make([]byte, 0)
+	prev := int64(0)
+	for _, val := range vals {
+		size := ZigZagDeltaSize(prev, val)
+		buf := make([]byte, size)
+		assert.Empty(t, WriteZigZagDelta(buf, prev, val))
+		b = append(b, buf...)
+		prev = val
+	}
+	assert.Equal(t, 1, ZigZagDeltaSize(vals[0], vals[1]), "identical values should take one byte")
+
+	prev = 0
+	remain := b
+	for _, expected := range vals {
+		var val int64
+		var err error
+		val, remain, err = ReadZigZagDeltaChecked(remain, prev)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, expected, val)
+		prev = val
+	}
+	assert.Empty(t, remain)
+
+	val, _ := ReadZigZagDelta(b, 0)
+	assert.Equal(t, vals[0], val)
+	_, _, err := ReadZigZagDeltaChecked(nil, 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,92 @@
+package encoding
+
+import (
+	"fmt"
+
+	"github.com/getlantern/bytemap"
+)
+
+const (
+	// EncodingVersion1 is the original encoding of Sequences and keys.
+	EncodingVersion1 = byte(1)
+
+	// CurrentEncodingVersion is the version with which Sequences and keys are
+	// currently encoded.
+	CurrentEncodingVersion = EncodingVersion1
+)
+
+// decoder converts data encoded with a specific version into the current
+// encoding.
+type decoder func(b []byte) ([]byte, error)
+
+func identity(b []byte) ([]byte, error) {
+	return b, nil
+}
+
+var (
+	// sequenceDecoders and keyDecoders hold a decoder for every supported
+	// version. When changing the encoding, bump CurrentEncodingVersion and add
+	// decoders that convert data in the prior versions to the new encoding.
+	sequenceDecoders = map[byte]decoder{
+		EncodingVersion1: identity,
+	}
+	keyDecoders = map[byte]decoder{
+		EncodingVersion1: identity,
+	}
+)
+
+// IsSupportedVersion indicates whether data encoded with the given version
+// can be decoded.
+func IsSupportedVersion(version byte) bool {
+	return sequenceDecoders[version] != nil && keyDecoders[version] != nil
+}
+
+// DecodeSequence decodes a Sequence that was encoded with the given version
+// into the current encoding. If the version is current, the result is the
+// supplied data itself.
+func DecodeSequence(version byte, b []byte) (Sequence, error) {
+	decode := sequenceDecoders[version]
+	if decode == nil {
+		return nil, fmt.Errorf("Unsupported sequence encoding version %d", version)
+	}
+	result, err := decode(b)
+	return Sequence(result), err
+}
+
+// DecodeKey decodes a key that was encoded with the given version into the
+// current encoding. If the version is current, the result is the supplied
+// data itself.
+func DecodeKey(version byte, b []byte) (bytemap.ByteMap, error) {
+	decode := keyDecoders[version]
+	if decode == nil {
+		return nil, fmt.Errorf("Unsupported key encoding version %d", version)
+	}
+	result, err := decode(b)
+	return bytemap.ByteMap(result), err
+}
+
+// Versioned prefixes the given encoded Sequence or key with the current
+// encoding version, for data that's stored or transmitted on its own.
+func Versioned(b []byte) []byte {
+	result := make([]byte, 0, 1+len(b))
+	result = append(result, CurrentEncodingVersion)
+	return append(result, b...)
+}
+
+// SequenceFromVersioned decodes a Sequence that was prefixed with its version
+// using Versioned.
+func SequenceFromVersioned(b []byte) (Sequence, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("Missing sequence encoding version")
+	}
+	return DecodeSequence(b[0], b[1:])
+}
+
+// KeyFromVersioned decodes a key that was prefixed with its version using
+// Versioned.
+func KeyFromVersioned(b []byte) (bytemap.ByteMap, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("Missing key encoding version")
+	}
+	return DecodeKey(b[0], b[1:])
+}
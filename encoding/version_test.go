@@ -0,0 +1,31 @@
+package encoding
+
+import (
+	"testing"
+
+	"github.com/getlantern/bytemap"
+	. "github.com/getlantern/zenodb/expr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersioned(t *testing.T) {
+	e := SUM(FIELD("a"))
+	seq := NewFloatValue(e, epoch, 5)
+	decodedSeq, err := SequenceFromVersioned(Versioned(seq))
+	if assert.NoError(t, err) {
+		assert.Equal(t, seq, decodedSeq)
+	}
+
+	key := bytemap.New(map[string]interface{}{"x": 1})
+	decodedKey, err := KeyFromVersioned(Versioned(key))
+	if assert.NoError(t, err) {
+		assert.Equal(t, key, decodedKey)
+	}
+
+	assert.True(t, IsSupportedVersion(CurrentEncodingVersion))
+	assert.False(t, IsSupportedVersion(0))
+	_, err = SequenceFromVersioned(append([]byte{0}, seq...))
+	assert.Error(t, err, "unknown version should fail")
+	_, err = KeyFromVersioned(nil)
+	assert.Error(t, err, "missing version should fail")
+}
@@ -0,0 +1,101 @@
+package zenodb
+
+import (
+	"context"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/core"
+)
+
+// FieldMeta describes a field in query results.
+type FieldMeta struct {
+	Name string
+	Expr string
+}
+
+// Entry is a single entry of query results, holding the values for all
+// periods of all fields for one key. Values are read straight from the
+// underlying encoded data, so reading them doesn't allocate.
+//
+// An Entry is reused for all entries of a query, so it and anything it returns
+// other than values are only valid until the callback to which it was passed
+// returns.
+type Entry struct {
+	key        bytemap.ByteMap
+	vals       core.Vals
+	fields     core.Fields
+	meta       []FieldMeta
+	until      time.Time
+	resolution time.Duration
+	numPeriods int
+}
+
+// Fields returns the fields of the entry, in the order in which ValueAt
+// indexes them. All entries of a query have the same fields.
+func (e *Entry) Fields() []FieldMeta {
+	return e.meta
+}
+
+// Key returns the dimensions of the entry.
+func (e *Entry) Key() bytemap.ByteMap {
+	return e.key
+}
+
+// Dim returns the value of the named dimension, or nil if the entry doesn't
+// have it.
+func (e *Entry) Dim(name string) interface{} {
+	return e.key.Get(name)
+}
+
+// NumPeriods returns the number of periods covered by the query.
+func (e *Entry) NumPeriods() int {
+	return e.numPeriods
+}
+
+// TimeAt returns the time of the given period. Period 0 is the most recent
+// one, at the until of the query, and earlier periods follow at intervals of
+// the query's resolution.
+func (e *Entry) TimeAt(period int) time.Time {
+	return e.until.Add(-1 * time.Duration(period) * e.resolution)
+}
+
+// ValueAt returns the value of the i'th field at the given period (see
+// TimeAt). If the field has no value at that period, found is false.
+func (e *Entry) ValueAt(i int, period int) (val float64, found bool) {
+	if i < 0 || i >= len(e.vals) || period < 0 || period >= e.numPeriods {
+		return 0, false
+	}
+	return e.vals[i].ValueAtTime(e.TimeAt(period), e.fields[i].Expr, e.resolution)
+}
+
+// QueryEntries runs the given SQL query and calls onEntry with each of the
+// resulting entries until onEntry returns false or an error. Unlike Query,
+// which returns one row per period, each Entry holds all periods for a key.
+func (db *DB) QueryEntries(ctx context.Context, sqlString string, includeMemStore bool, onEntry func(entry *Entry) (more bool, err error)) error {
+	source, err := db.Query(sqlString, false, nil, includeMemStore)
+	if err != nil {
+		return err
+	}
+	until := source.GetUntil()
+	resolution := source.GetResolution()
+	entry := &Entry{
+		until:      until,
+		resolution: resolution,
+	}
+	if resolution > 0 {
+		entry.numPeriods = int(until.Sub(source.GetAsOf()) / resolution)
+	}
+	return core.UnflattenOptimized(source).Iterate(ctx, func(fields core.Fields) error {
+		entry.fields = fields
+		entry.meta = make([]FieldMeta, 0, len(fields))
+		for _, field := range fields {
+			entry.meta = append(entry.meta, FieldMeta{Name: field.Name, Expr: field.Expr.String()})
+		}
+		return nil
+	}, func(key bytemap.ByteMap, vals core.Vals) (bool, error) {
+		entry.key = key
+		entry.vals = vals
+		return onEntry(entry)
+	})
+}
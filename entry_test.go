@@ -0,0 +1,99 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryEntries(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 0, 0, time.UTC)
+	clock := NewVirtualClock(epoch)
+	clock.Freeze()
+	db, err := NewDB(&DBOpts{
+		Dir:   tmpDir,
+		Clock: clock,
+		Schema: Schema{
+			"thetable": &TableOpts{
+				RetentionPeriod: time.Hour,
+				SQL:             "SELECT SUM(a) AS a, MAX(b) AS b FROM inbound GROUP BY u, period(1m)",
+			},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	inserted := 0
+	insert := func(ts time.Time, u string, a float64, b float64) {
+		db.Insert("inbound", ts, map[string]interface{}{"u": u}, map[string]float64{"a": a, "b": b})
+		inserted++
+		waitFor(func() bool { return db.TableStats("thetable").InsertedPoints == int64(inserted) })
+	}
+	insert(epoch, "bob", 1, 10)
+	insert(epoch, "bob", 2, 5)
+	insert(epoch.Add(-2*time.Minute), "bob", 4, 20)
+	insert(epoch.Add(-1*time.Minute), "alice", 8, 30)
+
+	type value struct {
+		ts   time.Time
+		a    float64
+		b    float64
+		hasB bool
+	}
+	var fieldNames []string
+	values := make(map[string][]value)
+	err = db.QueryEntries(context.Background(), "SELECT a, b FROM thetable", true, func(entry *Entry) (bool, error) {
+		if fieldNames == nil {
+			for _, field := range entry.Fields() {
+				fieldNames = append(fieldNames, field.Name)
+			}
+		}
+		u := entry.Dim("u").(string)
+		for period := 0; period < entry.NumPeriods(); period++ {
+			a, found := entry.ValueAt(0, period)
+			if !found {
+				continue
+			}
+			b, hasB := entry.ValueAt(1, period)
+			values[u] = append(values[u], value{entry.TimeAt(period), a, b, hasB})
+		}
+		_, found := entry.ValueAt(2, 0)
+		assert.False(t, found, "out of range field shouldn't be found")
+		_, found = entry.ValueAt(0, entry.NumPeriods())
+		assert.False(t, found, "out of range period shouldn't be found")
+		return true, nil
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"a", "b"}, fieldNames)
+	assert.Equal(t, map[string][]value{
+		"bob": {
+			{epoch, 3, 10, true},
+			{epoch.Add(-2 * time.Minute), 4, 20, true},
+		},
+		"alice": {
+			{epoch.Add(-1 * time.Minute), 8, 30, true},
+		},
+	}, values)
+
+	entries := 0
+	err = db.QueryEntries(context.Background(), "SELECT a FROM thetable", true, func(entry *Entry) (bool, error) {
+		entries++
+		return false, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, entries, "returning false should stop iteration")
+}
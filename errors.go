@@ -0,0 +1,33 @@
+package zenodb
+
+import (
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+)
+
+// Kinds of errors returned by the database, see common.KindOf. The same kinds
+// of errors are returned by the rpc client.
+var (
+	// ErrUnknownTable is returned by queries and operations on tables that don't
+	// exist.
+	ErrUnknownTable = common.ErrUnknownTable
+	// ErrUnknownStream is returned by inserts into streams that no table reads
+	// from.
+	ErrUnknownStream = common.ErrUnknownStream
+	// ErrOutsideHotPeriod is returned by as-of queries from before the start of
+	// the WAL.
+	ErrOutsideHotPeriod = common.ErrOutsideHotPeriod
+	// ErrBackpressure is returned by inserts that were rejected because a
+	// tenant exceeded its ingest rate.
+	ErrBackpressure = common.ErrBackpressure
+	// ErrInvalidSQL is returned by queries and statements with SQL that can't
+	// be parsed. Such errors are usually *common.SQLErrors that locate the
+	// problem in the SQL.
+	ErrInvalidSQL = common.ErrInvalidSQL
+	// ErrQueryTimeout is returned by queries that didn't finish by their
+	// deadline.
+	ErrQueryTimeout = core.ErrDeadlineExceeded
+	// ErrPartialResults is returned by clustered queries that hit their deadline
+	// after only some partitions returned results.
+	ErrPartialResults = core.ErrPartialResults
+)
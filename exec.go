@@ -0,0 +1,124 @@
+package zenodb
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/getlantern/zenodb/sql"
+)
+
+// Exec applies a script of SET and DELETE statements separated by semicolons,
+// optionally wrapped in BEGIN and COMMIT, like
+//
+//	BEGIN;
+//	SET thetable.retentionperiod = '2h';
+//	DELETE FROM thetable WHERE user = 'bob';
+//	COMMIT;
+//
+// All of the statements are validated and persisted before any of them is
+// applied, so if one of them is invalid or can't be persisted, none of them are
+// applied. See Set and Delete for the individual statements. Other statements,
+// including DDL like CREATE VIEW, ALTER or GRANT, aren't supported: tables are
+// defined in the schema, retention periods are changed with SET and access is
+// granted through credentials.
+func (db *DB) Exec(script string) error {
+	if db.opts.ReadOnly {
+		return fmt.Errorf("Database is read-only")
+	}
+	statements, err := sql.ParseScript(script)
+	if err != nil {
+		return err
+	}
+
+	db.settingsMx.Lock()
+	defer db.settingsMx.Unlock()
+
+	var settings []*sql.Setting
+	var changes []func()
+	var tombstones []*tombstone
+	for _, statement := range statements {
+		switch {
+		case sql.IsSet(statement):
+			statementSettings, parseErr := sql.ParseSet(statement)
+			if parseErr != nil {
+				return parseErr
+			}
+			statementChanges, prepareErr := db.prepareSettings(statementSettings)
+			if prepareErr != nil {
+				return prepareErr
+			}
+			settings = append(settings, statementSettings...)
+			changes = append(changes, statementChanges...)
+		case sql.IsDelete(statement):
+			ts, prepareErr := db.prepareDelete(statement)
+			if prepareErr != nil {
+				return prepareErr
+			}
+			tombstones = append(tombstones, ts)
+		default:
+			return fmt.Errorf("Only SET and DELETE statements can be executed, not %v", statement)
+		}
+	}
+
+	// Persist everything before changing anything in memory, so that failing to
+	// persist part of the script leaves the database as it was
+	settingsFile := filepath.Join(db.opts.Dir, settingsFilename)
+	tombstonesFile := filepath.Join(db.opts.Dir, tombstonesFilename)
+	if len(changes) > 0 {
+		newSettings := make(map[string]string, len(db.settings)+len(settings))
+		for key, value := range db.settings {
+			newSettings[key] = value
+		}
+		for _, setting := range settings {
+			newSettings[settingKey(setting.Qualifier, setting.Name)] = setting.Value
+		}
+		err = db.stageSettings(newSettings)
+		if err != nil {
+			return err
+		}
+	}
+	var newTombstones []*tombstone
+	if len(tombstones) > 0 {
+		db.tombstonesMx.Lock()
+		defer db.tombstonesMx.Unlock()
+		newTombstones = db.liveTombstones(append(append([]*tombstone(nil), db.tombstones...), tombstones...))
+		err = db.stageTombstones(newTombstones)
+		if err != nil {
+			unstageFile(settingsFile)
+			return err
+		}
+	}
+	if len(changes) > 0 {
+		err = commitFile(settingsFile, "settings")
+		if err != nil {
+			unstageFile(settingsFile)
+			unstageFile(tombstonesFile)
+			return err
+		}
+	}
+	if len(tombstones) > 0 {
+		err = commitFile(tombstonesFile, "tombstones")
+		if err != nil {
+			unstageFile(tombstonesFile)
+			if len(changes) > 0 {
+				// Put back the previous settings, which are still in memory
+				restoreErr := db.saveSettings()
+				if restoreErr != nil {
+					log.Errorf("Unable to restore settings after failing to save tombstones: %v", restoreErr)
+				}
+			}
+			return err
+		}
+	}
+
+	if len(changes) > 0 {
+		db.applySettings(settings, changes)
+	}
+	if len(tombstones) > 0 {
+		for _, ts := range tombstones {
+			log.Debugf("Applying %v", ts.SQL)
+		}
+		db.tombstones = newTombstones
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package zenodb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExec(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir: tmpDir,
+		Schema: Schema{
+			"thetable": &TableOpts{
+				RetentionPeriod: time.Hour,
+				SQL:             "SELECT SUM(a) AS a FROM inbound GROUP BY u, period(1s)",
+			},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	tbl := db.getTable("thetable")
+
+	err = db.Exec("BEGIN; SET thetable.retentionperiod = '2h'; SET clusterquerybuffersize = 50; DELETE FROM thetable WHERE u = 'alice'; SET nosuchtable.retentionperiod = '3h'; COMMIT")
+	assert.Error(t, err, "Script referencing unknown table should fail")
+	assert.Equal(t, time.Hour, tbl.retentionPeriod(), "Nothing should have been applied")
+	assert.NotEqual(t, 50, db.opts.ClusterQueryBufferSize, "Nothing should have been applied")
+	tombstones, _ := tbl.tombstones()
+	assert.Empty(t, tombstones, "Nothing should have been applied")
+
+	assert.Error(t, db.Exec("SET thetable.retentionperiod = '2h'; SELECT * FROM thetable"), "Queries can't be executed")
+	assert.Equal(t, time.Hour, tbl.retentionPeriod())
+
+	// Make saving tombstones fail
+	tombstonesTmp := filepath.Join(tmpDir, tombstonesFilename+".tmp")
+	if !assert.NoError(t, os.Mkdir(tombstonesTmp, 0755)) {
+		return
+	}
+	err = db.Exec("SET thetable.retentionperiod = '2h'; DELETE FROM thetable WHERE u = 'bob'")
+	assert.Error(t, err, "Script that can't be saved should fail")
+	assert.Equal(t, time.Hour, tbl.retentionPeriod(), "Nothing should have been applied")
+	tombstones, _ = tbl.tombstones()
+	assert.Empty(t, tombstones, "Nothing should have been applied")
+	_, statErr := os.Stat(filepath.Join(tmpDir, settingsFilename))
+	assert.True(t, os.IsNotExist(statErr), "Settings shouldn't have been saved")
+	_, statErr = os.Stat(filepath.Join(tmpDir, settingsFilename+".tmp"))
+	assert.True(t, os.IsNotExist(statErr), "Staged settings should have been removed")
+	if !assert.NoError(t, os.Remove(tombstonesTmp)) {
+		return
+	}
+
+	err = db.Exec("BEGIN; SET thetable.retentionperiod = '2h'; SET clusterquerybuffersize = 50; DELETE FROM thetable WHERE u = 'bob'; COMMIT;")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 2*time.Hour, tbl.retentionPeriod())
+		assert.Equal(t, 50, db.opts.ClusterQueryBufferSize)
+		tombstones, _ = tbl.tombstones()
+		if assert.Len(t, tombstones, 1) {
+			assert.Contains(t, tombstones[0].SQL, "'bob'")
+		}
+	}
+}
@@ -2,8 +2,8 @@ package expr
 
 import (
 	"fmt"
-	"math"
 	"reflect"
+	"strings"
 	"time"
 
 	"github.com/getlantern/goexpr"
@@ -20,6 +20,29 @@ func aggregateFor(name string, wrapped interface{}) *aggregate {
 	return ctor(wrapped)
 }
 
+// RegisterAggregate registers an aggregate under the given name. update folds
+// each new value into the current one and merge combines two aggregated
+// values. wasSet indicates whether current holds a value yet. It's meant to
+// be called at startup, before any queries run.
+func RegisterAggregate(name string, update func(wasSet bool, current float64, next float64) float64, merge func(wasSet bool, current float64, next float64) float64) error {
+	name = strings.ToUpper(name)
+	if _, found := aggregates[name]; found {
+		return fmt.Errorf("Aggregate %v already registered", name)
+	}
+	registerAggregate(name, update, merge)
+	return nil
+}
+
+// Aggregate creates an Expr using the aggregate registered under the given
+// name, or nil if there's no such aggregate.
+func Aggregate(name string, wrapped interface{}) Expr {
+	a := aggregateFor(strings.ToUpper(name), wrapped)
+	if a == nil {
+		return nil
+	}
+	return a
+}
+
 func registerAggregate(name string, update updateFN, merge updateFN) {
 	aggregates[name] = func(wrapped interface{}) *aggregate {
 		return &aggregate{
@@ -36,11 +59,19 @@ type updateFN func(wasSet bool, current float64, next float64) float64
 type aggregate struct {
 	Name    string
 	Wrapped Expr
+	// Storage is the width with which values are stored, defaults to
+	// StorageFloat64
+	Storage string
 	update  updateFN
 	merge   updateFN
 }
 
 func (e *aggregate) Validate() error {
+	if e.Name == "COUNTER" {
+		if _, isField := IsField(e.Wrapped); !isField {
+			return fmt.Errorf("COUNTER can only wrap a field, not %v", e.Wrapped)
+		}
+	}
 	return validateWrappedInAggregate(e.Wrapped)
 }
 
@@ -49,14 +80,14 @@ func validateWrappedInAggregate(wrapped Expr) error {
 		return fmt.Errorf("Aggregate cannot wrap nil expression")
 	}
 	typeOfWrapped := reflect.TypeOf(wrapped)
-	if typeOfWrapped != fieldType && typeOfWrapped != constType && typeOfWrapped != boundedType {
+	if typeOfWrapped != fieldType && typeOfWrapped != constType && typeOfWrapped != boundedType && typeOfWrapped != clampType {
 		return fmt.Errorf("Aggregate can only wrap field and constant expressions, not %v", typeOfWrapped)
 	}
 	return wrapped.Validate()
 }
 
 func (e *aggregate) EncodedWidth() int {
-	return 1 + width64bits + e.Wrapped.EncodedWidth()
+	return 1 + storageWidth(e.Storage) + e.Wrapped.EncodedWidth()
 }
 
 func (e *aggregate) Shift() time.Duration {
@@ -82,7 +113,7 @@ func (e *aggregate) Merge(b []byte, x []byte, y []byte) ([]byte, []byte, []byte)
 			b = e.save(b, valueY)
 		} else {
 			// Nothing to save, just advance
-			b = b[width64bits+1:]
+			b = b[storageWidth(e.Storage)+1:]
 		}
 	} else {
 		if yWasSet {
@@ -99,6 +130,9 @@ func (e *aggregate) SubMergers(subs []Expr) []SubMerge {
 	for i, sub := range subs {
 		if e.String() == sub.String() {
 			result[i] = e.subMerge
+		} else if otherAgg, ok := sub.(*aggregate); ok && e.unstoredString() == otherAgg.unstoredString() {
+			// Same aggregate stored with a different width
+			result[i] = e.subMergerFor(otherAgg)
 		}
 	}
 	return result
@@ -108,24 +142,39 @@ func (e *aggregate) subMerge(data []byte, other []byte, otherRes time.Duration,
 	e.Merge(data, data, other)
 }
 
+func (e *aggregate) subMergerFor(other *aggregate) SubMerge {
+	return func(data []byte, otherData []byte, otherRes time.Duration, metadata goexpr.Params) {
+		valueY, yWasSet, _ := other.load(otherData)
+		if !yWasSet {
+			return
+		}
+		valueX, xWasSet, _ := e.load(data)
+		if xWasSet {
+			valueY = e.merge(true, valueX, valueY)
+		}
+		e.save(data, valueY)
+	}
+}
+
 func (e *aggregate) Get(b []byte) (float64, bool, []byte) {
 	return e.load(b)
 }
 
 func (e *aggregate) load(b []byte) (float64, bool, []byte) {
-	remain := b[width64bits+1:]
+	width := storageWidth(e.Storage)
+	remain := b[width+1:]
 	value := float64(0)
 	wasSet := b[0] == 1
 	if wasSet {
-		value = math.Float64frombits(binaryEncoding.Uint64(b[1:]))
+		value = loadStored(e.Storage, b[1:])
 	}
 	return value, wasSet, remain
 }
 
 func (e *aggregate) save(b []byte, value float64) []byte {
 	b[0] = 1
-	binaryEncoding.PutUint64(b[1:], math.Float64bits(value))
-	return b[width64bits+1:]
+	saveStored(e.Storage, b[1:], value)
+	return b[storageWidth(e.Storage)+1:]
 }
 
 func (e *aggregate) IsConstant() bool {
@@ -133,6 +182,13 @@ func (e *aggregate) IsConstant() bool {
 }
 
 func (e *aggregate) String() string {
+	if e.Storage == "" || e.Storage == StorageFloat64 {
+		return e.unstoredString()
+	}
+	return fmt.Sprintf("%v:%v", e.unstoredString(), e.Storage)
+}
+
+func (e *aggregate) unstoredString() string {
 	return fmt.Sprintf("%v(%v)", e.Name, e.Wrapped)
 }
 
@@ -148,6 +204,8 @@ func (e *aggregate) DecodeMsgpack(dec *msgpack.Decoder) error {
 	}
 	e.Name = e2.Name
 	e.Wrapped = e2.Wrapped
+	storage, _ := m["Storage"].(string)
+	e.Storage = storage
 	e.update = e2.update
 	e.merge = e2.merge
 	return nil
@@ -48,6 +48,14 @@ func init() {
 	}, func(wasSet bool, current float64, next float64) float64 {
 		return current + next
 	})
+
+	// COUNTER sums like SUM, the table converts raw counter values to deltas
+	// before they get here.
+	registerAggregate("COUNTER", func(wasSet bool, current float64, next float64) float64 {
+		return current + next
+	}, func(wasSet bool, current float64, next float64) float64 {
+		return current + next
+	})
 }
 
 // SUM creates an Expr that obtains its value by summing the given expressions
@@ -72,3 +80,33 @@ func MAX(expr interface{}) Expr {
 func COUNT(expr interface{}) Expr {
 	return aggregateFor("COUNT", expr)
 }
+
+// COUNTER creates an Expr that accumulates the increases of a monotonically
+// increasing counter field, like a per-process request count. Tables convert
+// each raw value into the delta from the previous value reported with the
+// same dimensions, treating a value lower than the previous one as a reset of
+// the counter. COUNTER can only wrap a field.
+func COUNTER(expr interface{}) Expr {
+	return aggregateFor("COUNTER", expr)
+}
+
+// IsCounter checks whether the given expression is a COUNTER and if so,
+// returns the name of the field that it counts.
+func IsCounter(e Expr) (string, bool) {
+	a, ok := e.(*aggregate)
+	if !ok || a.Name != "COUNTER" {
+		return "", false
+	}
+	return IsField(a.Wrapped)
+}
+
+// IsAggregate indicates whether the given expression directly aggregates
+// values, like SUM, AVG or EWMA do, rather than calculating its value from
+// other expressions.
+func IsAggregate(e Expr) bool {
+	switch e.(type) {
+	case *aggregate, *avg, *ewma:
+		return true
+	}
+	return false
+}
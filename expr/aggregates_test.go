@@ -23,6 +23,23 @@ func TestCOUNT(t *testing.T) {
 	doTestAggregate(t, COUNT("b"), 3)
 }
 
+func TestCOUNTER(t *testing.T) {
+	doTestAggregate(t, COUNTER("b"), 1.2)
+	name, ok := IsCounter(COUNTER("b"))
+	assert.True(t, ok)
+	assert.Equal(t, "b", name)
+	_, ok = IsCounter(SUM("b"))
+	assert.False(t, ok)
+}
+
+func TestIsAggregate(t *testing.T) {
+	assert.True(t, IsAggregate(SUM("b")))
+	assert.True(t, IsAggregate(AVG("b")))
+	assert.True(t, IsAggregate(EWMA("b", 0.5)))
+	assert.False(t, IsAggregate(DIV(SUM("a"), SUM("b"))))
+	assert.False(t, IsAggregate(FIELD("b")))
+}
+
 func TestAVG(t *testing.T) {
 	doTestAggregate(t, AVG(boundedA()), 5.2)
 }
@@ -31,6 +48,33 @@ func TestWAVG(t *testing.T) {
 	doTestAggregate(t, WAVG(boundedA(), "b"), 7.52)
 }
 
+func TestEWMA(t *testing.T) {
+	// values are 4.4, 8.8 and 2.4
+	e := EWMA(boundedA(), 0.5)
+	doTestAggregate(t, e, (0.125*4.4+0.25*8.8+0.5*2.4)/0.875)
+
+	single := EWMA("a", 0.5)
+	b := make([]byte, single.EncodedWidth())
+	single.Update(b, Map{"a": 3}, nil)
+	val, _, _ := single.Get(b)
+	assertFloatEquals(t, 3, val)
+}
+
+func TestCLAMP(t *testing.T) {
+	e := msgpacked(t, SUM(CLAMP("a", 3, 5)))
+	b := make([]byte, e.EncodedWidth())
+	for _, a := range []float64{4.4, 8.8, -2.4} {
+		e.Update(b, Map{"a": a}, nil)
+	}
+	e.Update(b, Map{"b": 1}, nil)
+	val, wasSet, _ := e.Get(b)
+	if assert.True(t, wasSet) {
+		assertFloatEquals(t, 4.4+5+3, val)
+	}
+	assert.Error(t, CLAMP("a", 5, 3).Validate())
+	assert.NoError(t, SUM(CLAMP("a", 3, 5)).Validate())
+}
+
 func TestSUMConditional(t *testing.T) {
 	ex := IF(goexpr.Param("i"), SUM("b"))
 	doTestAggregate(t, ex, 1)
@@ -43,8 +87,13 @@ func TestValidateAggregate(t *testing.T) {
 	assert.Error(t, avg.Validate())
 	wavg := WAVG(FIELD("b"), SUM(FIELD("c")))
 	assert.Error(t, wavg.Validate())
+	assert.Error(t, EWMA(FIELD("b"), FIELD("c")).Validate())
+	assert.Error(t, EWMA(FIELD("b"), CONST(1.5)).Validate())
+	assert.NoError(t, EWMA(FIELD("b"), CONST(0.3)).Validate())
 	ok := SUM(CONST(1))
 	assert.NoError(t, ok.Validate())
+	counter := COUNTER(CONST(1))
+	assert.Error(t, counter.Validate())
 	ok2 := AVG(FIELD("b"))
 	assert.NoError(t, ok2.Validate())
 }
@@ -0,0 +1,70 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/getlantern/goexpr"
+)
+
+// CLAMP constrains the given expression to min <= val <= max. Unlike BOUNDED,
+// which ignores values outside of the bounds, values below min count as min
+// and values above max count as max.
+func CLAMP(expr interface{}, min float64, max float64) Expr {
+	return &clamp{exprFor(expr), min, max}
+}
+
+type clamp struct {
+	Wrapped Expr
+	Min     float64
+	Max     float64
+}
+
+func (e *clamp) Validate() error {
+	if e.Min > e.Max {
+		return fmt.Errorf("CLAMP min %v is greater than max %v", e.Min, e.Max)
+	}
+	return e.Wrapped.Validate()
+}
+
+func (e *clamp) EncodedWidth() int {
+	return e.Wrapped.EncodedWidth()
+}
+
+func (e *clamp) Shift() time.Duration {
+	return e.Wrapped.Shift()
+}
+
+func (e *clamp) Update(b []byte, params Params, metadata goexpr.Params) ([]byte, float64, bool) {
+	remain, value, updated := e.Wrapped.Update(b, params, metadata)
+	return remain, e.apply(value), updated
+}
+
+func (e *clamp) apply(val float64) float64 {
+	return math.Max(e.Min, math.Min(e.Max, val))
+}
+
+func (e *clamp) Merge(b []byte, x []byte, y []byte) ([]byte, []byte, []byte) {
+	return e.Wrapped.Merge(b, x, y)
+}
+
+func (e *clamp) SubMergers(subs []Expr) []SubMerge {
+	return e.Wrapped.SubMergers(subs)
+}
+
+func (e *clamp) Get(b []byte) (float64, bool, []byte) {
+	val, wasSet, remain := e.Wrapped.Get(b)
+	if !wasSet {
+		return 0, false, remain
+	}
+	return e.apply(val), wasSet, remain
+}
+
+func (e *clamp) IsConstant() bool {
+	return e.Wrapped.IsConstant()
+}
+
+func (e *clamp) String() string {
+	return fmt.Sprintf("CLAMP(%v, %v, %v)", e.Wrapped, e.Min, e.Max)
+}
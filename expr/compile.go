@@ -0,0 +1,126 @@
+package expr
+
+import (
+	"github.com/getlantern/goexpr"
+)
+
+// FieldIndex assigns positions to the fields referenced by compiled Exprs.
+type FieldIndex struct {
+	names     []string
+	positions map[string]int
+}
+
+// NewFieldIndex creates an empty FieldIndex.
+func NewFieldIndex() *FieldIndex {
+	return &FieldIndex{positions: make(map[string]int)}
+}
+
+// Names returns the names of the indexed fields, in order of their positions.
+func (fi *FieldIndex) Names() []string {
+	return fi.names
+}
+
+func (fi *FieldIndex) positionOf(name string) int {
+	pos, found := fi.positions[name]
+	if !found {
+		pos = len(fi.names)
+		fi.names = append(fi.names, name)
+		fi.positions[name] = pos
+	}
+	return pos
+}
+
+// IndexedParams holds the values of all fields in a FieldIndex, which allows
+// Exprs compiled against that index to read them by position instead of
+// looking them up by name. Lookups by name are delegated to the wrapped
+// Params.
+type IndexedParams struct {
+	Params
+	values []float64
+	found  []bool
+}
+
+// Load loads the values of all fields in the given index from params, reusing
+// this IndexedParams' buffers.
+func (p *IndexedParams) Load(index *FieldIndex, params Params) {
+	p.Params = params
+	n := len(index.names)
+	if cap(p.values) < n {
+		p.values = make([]float64, n)
+		p.found = make([]bool, n)
+	}
+	p.values = p.values[:n]
+	p.found = p.found[:n]
+	for i, name := range index.names {
+		p.values[i], p.found[i] = params.Get(name)
+	}
+}
+
+// Compile returns a copy of e in which field references read their values from
+// IndexedParams by position, adding the referenced fields to index. Each field
+// is only looked up once per set of params no matter how often it's
+// referenced, which speeds up updating values on the insert path. The
+// compiled Expr behaves the same as e and still works with other kinds of
+// Params.
+func Compile(e Expr, index *FieldIndex) Expr {
+	switch t := e.(type) {
+	case *field:
+		return &indexedField{t, index.positionOf(t.Name)}
+	case *aggregate:
+		c := *t
+		c.Wrapped = Compile(t.Wrapped, index)
+		return &c
+	case *avg:
+		return &avg{Compile(t.Value, index), Compile(t.Weight, index)}
+	case *ewma:
+		return &ewma{Compile(t.Value, index), t.Alpha}
+	case *binaryExpr:
+		c := *t
+		c.Left = Compile(t.Left, index)
+		c.Right = Compile(t.Right, index)
+		return &c
+	case *bounded:
+		c := *t
+		c.wrapped = Compile(t.wrapped, index)
+		return &c
+	case *clamp:
+		c := *t
+		c.Wrapped = Compile(t.Wrapped, index)
+		return &c
+	case *coalesce:
+		c := *t
+		c.Wrapped = Compile(t.Wrapped, index)
+		return &c
+	case *nullCheck:
+		c := *t
+		c.Wrapped = Compile(t.Wrapped, index)
+		return &c
+	case *ifExpr:
+		c := *t
+		c.Wrapped = Compile(t.Wrapped, index)
+		return &c
+	case *unaryMathExpr:
+		c := *t
+		c.Wrapped = Compile(t.Wrapped, index)
+		return &c
+	case *shift:
+		c := *t
+		c.Wrapped = Compile(t.Wrapped, index)
+		return &c
+	}
+	return e
+}
+
+// indexedField is a field that reads its value by position from
+// IndexedParams.
+type indexedField struct {
+	*field
+	index int
+}
+
+func (e *indexedField) Update(b []byte, params Params, metadata goexpr.Params) ([]byte, float64, bool) {
+	if ip, ok := params.(*IndexedParams); ok {
+		return b, ip.values[e.index], ip.found[e.index]
+	}
+	return e.field.Update(b, params, metadata)
+}
@@ -0,0 +1,80 @@
+package expr
+
+import (
+	"testing"
+
+	"github.com/getlantern/goexpr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompile(t *testing.T) {
+	ln, _ := UnaryMath("LN", FIELD("a"))
+	exprs := []Expr{
+		SUM("a"),
+		COUNT("b"),
+		AVG("a"),
+		WAVG("a", "b"),
+		SUM(BOUNDED("a", 0, 5)),
+		ADD(SUM("a"), MULT(MAX("b"), SUM("a"))),
+		IF(goexpr.Param("i"), SUM("b")),
+		SHIFT(SUM("a"), 0),
+		SUM(ln),
+		SUM("c"),
+	}
+	index := NewFieldIndex()
+	compiled := make([]Expr, 0, len(exprs))
+	for _, e := range exprs {
+		compiled = append(compiled, Compile(e, index))
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, index.Names(), "each field should be indexed once")
+
+	params := []Map{{"a": 4.4, "b": 1}, {"a": 2.2}, {"b": 3}}
+	metadata := goexpr.MapParams{"i": true}
+	indexed := &IndexedParams{}
+	for i, e := range exprs {
+		c := compiled[i]
+		assert.Equal(t, e.String(), c.String())
+		assert.Equal(t, e.EncodedWidth(), c.EncodedWidth())
+		expected := make([]byte, e.EncodedWidth())
+		actual := make([]byte, c.EncodedWidth())
+		viaMap := make([]byte, c.EncodedWidth())
+		for _, p := range params {
+			e.Update(expected, p, metadata)
+			indexed.Load(index, p)
+			c.Update(actual, indexed, metadata)
+			c.Update(viaMap, p, metadata)
+		}
+		assert.Equal(t, expected, actual, "compiled %v should update the same as original", e)
+		assert.Equal(t, expected, viaMap, "compiled %v should still work with other params", e)
+	}
+}
+
+func BenchmarkUpdate(b *testing.B) {
+	exprs := []Expr{SUM("a"), MAX("a"), AVG("a"), WAVG("b", "a"), COUNT("b")}
+	params := Map{"a": 4.4, "b": 1}
+	buf := make([]byte, 100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, e := range exprs {
+			e.Update(buf, params, nil)
+		}
+	}
+}
+
+func BenchmarkUpdateCompiled(b *testing.B) {
+	index := NewFieldIndex()
+	var exprs []Expr
+	for _, e := range []Expr{SUM("a"), MAX("a"), AVG("a"), WAVG("b", "a"), COUNT("b")} {
+		exprs = append(exprs, Compile(e, index))
+	}
+	params := Map{"a": 4.4, "b": 1}
+	indexed := &IndexedParams{}
+	buf := make([]byte, 100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		indexed.Load(index, params)
+		for _, e := range exprs {
+			e.Update(buf, indexed, nil)
+		}
+	}
+}
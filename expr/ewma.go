@@ -0,0 +1,149 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/getlantern/goexpr"
+)
+
+// EWMA creates an Expr that obtains its value as the exponentially weighted
+// moving average of the given value, where alpha (between 0 and 1) is the
+// weight given to each new value. Earlier values decay by a factor of
+// 1 - alpha with each new value. The average is bias corrected, so it isn't
+// skewed towards 0 while only a few values have been seen. When merging,
+// values from the first argument are treated as older than values from the
+// second.
+func EWMA(val interface{}, alpha interface{}) Expr {
+	return &ewma{exprFor(val), exprFor(alpha)}
+}
+
+type ewma struct {
+	Value Expr
+	Alpha Expr
+}
+
+func (e *ewma) Validate() error {
+	err := validateWrappedInAggregate(e.Value)
+	if err != nil {
+		return err
+	}
+	if reflect.TypeOf(e.Alpha) != constType {
+		return fmt.Errorf("Alpha %v must be a constant", e.Alpha)
+	}
+	alpha := e.alpha()
+	if alpha <= 0 || alpha > 1 {
+		return fmt.Errorf("Alpha %v must be greater than 0 and no greater than 1", alpha)
+	}
+	return nil
+}
+
+func (e *ewma) EncodedWidth() int {
+	return width64bits*2 + 1 + e.Value.EncodedWidth()
+}
+
+func (e *ewma) Shift() time.Duration {
+	return e.Value.Shift()
+}
+
+func (e *ewma) Update(b []byte, params Params, metadata goexpr.Params) ([]byte, float64, bool) {
+	count, total, _, remain := e.load(b)
+	remain, value, updated := e.Value.Update(remain, params, metadata)
+	if updated {
+		alpha := e.alpha()
+		count++
+		total = total*(1-alpha) + value*alpha
+		e.save(b, count, total)
+	}
+	return remain, e.calc(count, total), updated
+}
+
+func (e *ewma) Merge(b []byte, x []byte, y []byte) ([]byte, []byte, []byte) {
+	countX, totalX, xWasSet, remainX := e.load(x)
+	countY, totalY, yWasSet, remainY := e.load(y)
+	if !xWasSet {
+		if yWasSet {
+			// Use valueY
+			b = e.save(b, countY, totalY)
+		} else {
+			// Nothing to save, just advance
+			b = b[width64bits*2+1:]
+		}
+	} else {
+		if yWasSet {
+			// x's values are older, so they decay once for every value in y
+			totalX = totalX*math.Pow(1-e.alpha(), countY) + totalY
+			countX += countY
+		}
+		b = e.save(b, countX, totalX)
+	}
+	return b, remainX, remainY
+}
+
+func (e *ewma) SubMergers(subs []Expr) []SubMerge {
+	result := make([]SubMerge, 0, len(subs))
+	for _, sub := range subs {
+		var sm SubMerge
+		if e.String() == sub.String() {
+			sm = e.subMerge
+		}
+		result = append(result, sm)
+	}
+	return result
+}
+
+func (e *ewma) subMerge(data []byte, other []byte, otherRes time.Duration, metadata goexpr.Params) {
+	e.Merge(data, data, other)
+}
+
+func (e *ewma) Get(b []byte) (float64, bool, []byte) {
+	count, total, wasSet, remain := e.load(b)
+	if !wasSet {
+		return 0, wasSet, remain
+	}
+	return e.calc(count, total), wasSet, remain
+}
+
+func (e *ewma) alpha() float64 {
+	alpha, _, _ := e.Alpha.Get(nil)
+	return alpha
+}
+
+// calc divides total by the sum of the weights of count values, which
+// corrects for the weight of the missing values before the first one.
+func (e *ewma) calc(count float64, total float64) float64 {
+	weights := 1 - math.Pow(1-e.alpha(), count)
+	if weights == 0 {
+		return 0
+	}
+	return total / weights
+}
+
+func (e *ewma) load(b []byte) (float64, float64, bool, []byte) {
+	remain := b[width64bits*2+1:]
+	wasSet := b[0] == 1
+	count := float64(0)
+	total := float64(0)
+	if wasSet {
+		count = math.Float64frombits(binaryEncoding.Uint64(b[1:]))
+		total = math.Float64frombits(binaryEncoding.Uint64(b[width64bits+1:]))
+	}
+	return count, total, wasSet, remain
+}
+
+func (e *ewma) save(b []byte, count float64, total float64) []byte {
+	b[0] = 1
+	binaryEncoding.PutUint64(b[1:], math.Float64bits(count))
+	binaryEncoding.PutUint64(b[width64bits+1:], math.Float64bits(total))
+	return b[width64bits*2+1:]
+}
+
+func (e *ewma) IsConstant() bool {
+	return e.Value.IsConstant()
+}
+
+func (e *ewma) String() string {
+	return fmt.Sprintf("EWMA(%v, %v)", e.Value, e.Alpha)
+}
@@ -25,9 +25,13 @@ var (
 	fieldType     = reflect.TypeOf((*field)(nil))
 	constType     = reflect.TypeOf((*constant)(nil))
 	boundedType   = reflect.TypeOf((*bounded)(nil))
+	clampType     = reflect.TypeOf((*clamp)(nil))
+	coalesceType  = reflect.TypeOf((*coalesce)(nil))
+	nullCheckType = reflect.TypeOf((*nullCheck)(nil))
 	aggregateType = reflect.TypeOf((*aggregate)(nil))
 	ifType        = reflect.TypeOf((*ifExpr)(nil))
 	avgType       = reflect.TypeOf((*avg)(nil))
+	ewmaType      = reflect.TypeOf((*ewma)(nil))
 	binaryType    = reflect.TypeOf((*binaryExpr)(nil))
 	shiftType     = reflect.TypeOf((*shift)(nil))
 	unaryMathType = reflect.TypeOf((*unaryMathExpr)(nil))
@@ -43,6 +47,10 @@ func init() {
 	msgpack.RegisterExt(56, &binaryExpr{})
 	msgpack.RegisterExt(57, &shift{})
 	msgpack.RegisterExt(58, &unaryMathExpr{})
+	msgpack.RegisterExt(59, &ewma{})
+	msgpack.RegisterExt(60, &clamp{})
+	msgpack.RegisterExt(61, &coalesce{})
+	msgpack.RegisterExt(62, &nullCheck{})
 }
 
 // Params is an interface for data structures that can contain named values.
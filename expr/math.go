@@ -3,6 +3,7 @@ package expr
 import (
 	"fmt"
 	"math"
+	"strings"
 	"time"
 
 	"github.com/getlantern/goexpr"
@@ -22,6 +23,18 @@ type unaryMathExpr struct {
 	Width   int
 }
 
+// RegisterUnaryMath registers a function of a single value under the given
+// name, for use like the built-in LN. It's meant to be called at startup,
+// before any queries run.
+func RegisterUnaryMath(name string, fn func(float64) float64) error {
+	name = strings.ToUpper(name)
+	if unaryMathFNs[name] != nil {
+		return fmt.Errorf("Math function %v already registered", name)
+	}
+	unaryMathFNs[name] = fn
+	return nil
+}
+
 func UnaryMath(name string, wrapped interface{}) (Expr, error) {
 	fn := unaryMathFNs[name]
 	if fn == nil {
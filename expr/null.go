@@ -0,0 +1,119 @@
+package expr
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/getlantern/goexpr"
+)
+
+// COALESCE creates an Expr that takes the value of the wrapped expression, or
+// the given default in periods where the wrapped expression has no value.
+func COALESCE(wrapped interface{}, dflt float64) Expr {
+	return &coalesce{exprFor(wrapped), dflt}
+}
+
+type coalesce struct {
+	Wrapped Expr
+	Default float64
+}
+
+func (e *coalesce) Validate() error {
+	return e.Wrapped.Validate()
+}
+
+func (e *coalesce) EncodedWidth() int {
+	return e.Wrapped.EncodedWidth()
+}
+
+func (e *coalesce) Shift() time.Duration {
+	return e.Wrapped.Shift()
+}
+
+func (e *coalesce) Update(b []byte, params Params, metadata goexpr.Params) ([]byte, float64, bool) {
+	return e.Wrapped.Update(b, params, metadata)
+}
+
+func (e *coalesce) Merge(b []byte, x []byte, y []byte) ([]byte, []byte, []byte) {
+	return e.Wrapped.Merge(b, x, y)
+}
+
+func (e *coalesce) SubMergers(subs []Expr) []SubMerge {
+	return e.Wrapped.SubMergers(subs)
+}
+
+func (e *coalesce) Get(b []byte) (float64, bool, []byte) {
+	val, wasSet, remain := e.Wrapped.Get(b)
+	if !wasSet {
+		return e.Default, true, remain
+	}
+	return val, true, remain
+}
+
+func (e *coalesce) IsConstant() bool {
+	return e.Wrapped.IsConstant()
+}
+
+func (e *coalesce) String() string {
+	return fmt.Sprintf("COALESCE(%v, %v)", e.Wrapped, e.Default)
+}
+
+// ISNULL creates an Expr that is 1 in periods where the wrapped expression has
+// no value and 0 where it does.
+func ISNULL(wrapped interface{}) Expr {
+	return &nullCheck{exprFor(wrapped), false}
+}
+
+// ISNOTNULL creates an Expr that is 1 in periods where the wrapped expression
+// has a value and 0 where it doesn't.
+func ISNOTNULL(wrapped interface{}) Expr {
+	return &nullCheck{exprFor(wrapped), true}
+}
+
+type nullCheck struct {
+	Wrapped Expr
+	Not     bool
+}
+
+func (e *nullCheck) Validate() error {
+	return e.Wrapped.Validate()
+}
+
+func (e *nullCheck) EncodedWidth() int {
+	return e.Wrapped.EncodedWidth()
+}
+
+func (e *nullCheck) Shift() time.Duration {
+	return e.Wrapped.Shift()
+}
+
+func (e *nullCheck) Update(b []byte, params Params, metadata goexpr.Params) ([]byte, float64, bool) {
+	return e.Wrapped.Update(b, params, metadata)
+}
+
+func (e *nullCheck) Merge(b []byte, x []byte, y []byte) ([]byte, []byte, []byte) {
+	return e.Wrapped.Merge(b, x, y)
+}
+
+func (e *nullCheck) SubMergers(subs []Expr) []SubMerge {
+	return e.Wrapped.SubMergers(subs)
+}
+
+func (e *nullCheck) Get(b []byte) (float64, bool, []byte) {
+	_, wasSet, remain := e.Wrapped.Get(b)
+	if wasSet == e.Not {
+		return 1, true, remain
+	}
+	return 0, true, remain
+}
+
+func (e *nullCheck) IsConstant() bool {
+	return e.Wrapped.IsConstant()
+}
+
+func (e *nullCheck) String() string {
+	if e.Not {
+		return fmt.Sprintf("%v IS NOT NULL", e.Wrapped)
+	}
+	return fmt.Sprintf("%v IS NULL", e.Wrapped)
+}
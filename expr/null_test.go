@@ -0,0 +1,36 @@
+package expr
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNulls(t *testing.T) {
+	avg := AVG("a")
+	b := make([]byte, avg.EncodedWidth())
+	set := make([]byte, avg.EncodedWidth())
+	avg.Update(set, Map{"a": 4}, nil)
+
+	coalesced := msgpacked(t, COALESCE(avg, -1))
+	val, wasSet, _ := coalesced.Get(b)
+	assert.True(t, wasSet)
+	assert.EqualValues(t, -1, val)
+	val, wasSet, _ = coalesced.Get(set)
+	assert.True(t, wasSet)
+	assert.EqualValues(t, 4, val)
+
+	isNull := msgpacked(t, ISNULL(avg))
+	val, _, _ = isNull.Get(b)
+	assert.EqualValues(t, 1, val)
+	val, _, _ = isNull.Get(set)
+	assert.EqualValues(t, 0, val)
+
+	isNotNull := msgpacked(t, ISNOTNULL(avg))
+	val, _, _ = isNotNull.Get(b)
+	assert.EqualValues(t, 0, val)
+	val, _, _ = isNotNull.Get(set)
+	assert.EqualValues(t, 1, val)
+
+	assert.NoError(t, DIV(COALESCE(SUM("a"), 0), ISNOTNULL(COUNT("b"))).Validate())
+}
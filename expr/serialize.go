@@ -0,0 +1,344 @@
+package expr
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/getlantern/goexpr"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// SerializationVersion is the version of the format written by Marshal. It
+// only changes when the format changes in a way that older versions can't read.
+// Adding types or attributes doesn't change it, since readers ignore
+// attributes they don't know and report types they don't know by name.
+const SerializationVersion = 1
+
+// serializedMarker starts every serialized Expr. It is never used by msgpack,
+// which distinguishes serialized Exprs from Exprs encoded directly with
+// msgpack by older versions.
+const serializedMarker = 0xc1
+
+// Serialized is the stable, serializable form of an Expr. Exprs are identified
+// by a type name and their attributes are keyed by name rather than position,
+// so that changes to the structs that implement them don't change how they're
+// serialized.
+type Serialized struct {
+	Type    string             `msgpack:"type"`
+	Strings map[string]string  `msgpack:"strings,omitempty"`
+	Numbers map[string]float64 `msgpack:"numbers,omitempty"`
+	Args    []*Serialized      `msgpack:"args,omitempty"`
+	// Cond holds a dimensional condition, encoded by goexpr
+	Cond []byte `msgpack:"cond,omitempty"`
+}
+
+type serializer struct {
+	name        string
+	serialize   func(Expr) (*Serialized, error)
+	deserialize func(*Serialized) (Expr, error)
+}
+
+var (
+	serializersByType = make(map[reflect.Type]*serializer)
+	serializersByName = make(map[string]*serializer)
+)
+
+// RegisterSerializer registers how to serialize and deserialize Exprs of the
+// same type as example under the given type name. Type names must never change
+// once Exprs have been serialized with them.
+func RegisterSerializer(name string, example Expr, serialize func(Expr) (*Serialized, error), deserialize func(*Serialized) (Expr, error)) error {
+	t := reflect.TypeOf(example)
+	if _, found := serializersByName[name]; found {
+		return fmt.Errorf("Serializer for %v already registered", name)
+	}
+	if _, found := serializersByType[t]; found {
+		return fmt.Errorf("Serializer for %v already registered", t)
+	}
+	s := &serializer{name, serialize, deserialize}
+	serializersByType[t] = s
+	serializersByName[name] = s
+	return nil
+}
+
+// Serialize converts the given Expr into its Serialized form.
+func Serialize(e Expr) (*Serialized, error) {
+	s := serializersByType[reflect.TypeOf(e)]
+	if s == nil {
+		return nil, fmt.Errorf("No serializer registered for %v", reflect.TypeOf(e))
+	}
+	result, err := s.serialize(e)
+	if err != nil {
+		return nil, err
+	}
+	result.Type = s.name
+	return result, nil
+}
+
+// Deserialize converts the given Serialized form back into an Expr.
+func Deserialize(se *Serialized) (Expr, error) {
+	if se == nil {
+		return nil, fmt.Errorf("Missing expression")
+	}
+	s := serializersByName[se.Type]
+	if s == nil {
+		return nil, fmt.Errorf("Unknown expression type %v, it may have been serialized by a newer version", se.Type)
+	}
+	return s.deserialize(se)
+}
+
+// Marshal serializes the given Expr into bytes using the current
+// SerializationVersion.
+func Marshal(e Expr) ([]byte, error) {
+	if e == nil {
+		return msgpack.Marshal(nil)
+	}
+	se, err := Serialize(e)
+	if err != nil {
+		return nil, err
+	}
+	b, err := msgpack.Marshal(se)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{serializedMarker, SerializationVersion}, b...), nil
+}
+
+// Unmarshal deserializes an Expr serialized with Marshal. It also accepts Exprs
+// encoded directly with msgpack, as older versions did.
+func Unmarshal(b []byte) (Expr, error) {
+	if len(b) < 2 || b[0] != serializedMarker {
+		var e Expr
+		err := msgpack.Unmarshal(b, &e)
+		return e, err
+	}
+	version := int(b[1])
+	if version > SerializationVersion {
+		return nil, fmt.Errorf("Expression serialized with version %d, only versions up to %d are supported", version, SerializationVersion)
+	}
+	se := &Serialized{}
+	err := msgpack.Unmarshal(b[2:], se)
+	if err != nil {
+		return nil, err
+	}
+	return Deserialize(se)
+}
+
+func serializeArgs(exprs ...Expr) ([]*Serialized, error) {
+	result := make([]*Serialized, 0, len(exprs))
+	for _, e := range exprs {
+		se, err := Serialize(e)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, se)
+	}
+	return result, nil
+}
+
+func deserializeArgs(se *Serialized, n int) ([]Expr, error) {
+	if len(se.Args) < n {
+		return nil, fmt.Errorf("%v requires %d arguments, not %d", se.Type, n, len(se.Args))
+	}
+	result := make([]Expr, 0, n)
+	for _, arg := range se.Args[:n] {
+		e, err := Deserialize(arg)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, e)
+	}
+	return result, nil
+}
+
+func mustRegisterSerializer(name string, example Expr, serialize func(Expr) (*Serialized, error), deserialize func(*Serialized) (Expr, error)) {
+	err := RegisterSerializer(name, example, serialize, deserialize)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func init() {
+	serializeField := func(e Expr) (*Serialized, error) {
+		name, _ := IsField(e)
+		if f, ok := e.(*indexedField); ok {
+			name = f.Name
+		}
+		return &Serialized{Strings: map[string]string{"name": name}}, nil
+	}
+	deserializeField := func(se *Serialized) (Expr, error) {
+		return FIELD(se.Strings["name"]), nil
+	}
+	mustRegisterSerializer("field", &field{}, serializeField, deserializeField)
+	// compiled fields deserialize as regular fields
+	serializersByType[reflect.TypeOf(&indexedField{})] = serializersByName["field"]
+
+	mustRegisterSerializer("const", &constant{}, func(e Expr) (*Serialized, error) {
+		return &Serialized{Numbers: map[string]float64{"value": e.(*constant).Value}}, nil
+	}, func(se *Serialized) (Expr, error) {
+		return CONST(se.Numbers["value"]), nil
+	})
+
+	mustRegisterSerializer("bounded", &bounded{}, func(e Expr) (*Serialized, error) {
+		b := e.(*bounded)
+		args, err := serializeArgs(b.wrapped)
+		return &Serialized{Args: args, Numbers: map[string]float64{"min": b.min, "max": b.max}}, err
+	}, func(se *Serialized) (Expr, error) {
+		args, err := deserializeArgs(se, 1)
+		if err != nil {
+			return nil, err
+		}
+		return BOUNDED(args[0], se.Numbers["min"], se.Numbers["max"]), nil
+	})
+
+	mustRegisterSerializer("clamp", &clamp{}, func(e Expr) (*Serialized, error) {
+		c := e.(*clamp)
+		args, err := serializeArgs(c.Wrapped)
+		return &Serialized{Args: args, Numbers: map[string]float64{"min": c.Min, "max": c.Max}}, err
+	}, func(se *Serialized) (Expr, error) {
+		args, err := deserializeArgs(se, 1)
+		if err != nil {
+			return nil, err
+		}
+		return CLAMP(args[0], se.Numbers["min"], se.Numbers["max"]), nil
+	})
+
+	mustRegisterSerializer("coalesce", &coalesce{}, func(e Expr) (*Serialized, error) {
+		c := e.(*coalesce)
+		args, err := serializeArgs(c.Wrapped)
+		return &Serialized{Args: args, Numbers: map[string]float64{"default": c.Default}}, err
+	}, func(se *Serialized) (Expr, error) {
+		args, err := deserializeArgs(se, 1)
+		if err != nil {
+			return nil, err
+		}
+		return COALESCE(args[0], se.Numbers["default"]), nil
+	})
+
+	mustRegisterSerializer("isnull", &nullCheck{}, func(e Expr) (*Serialized, error) {
+		c := e.(*nullCheck)
+		args, err := serializeArgs(c.Wrapped)
+		se := &Serialized{Args: args}
+		if c.Not {
+			se.Numbers = map[string]float64{"not": 1}
+		}
+		return se, err
+	}, func(se *Serialized) (Expr, error) {
+		args, err := deserializeArgs(se, 1)
+		if err != nil {
+			return nil, err
+		}
+		if se.Numbers["not"] == 1 {
+			return ISNOTNULL(args[0]), nil
+		}
+		return ISNULL(args[0]), nil
+	})
+
+	mustRegisterSerializer("aggregate", &aggregate{}, func(e Expr) (*Serialized, error) {
+		a := e.(*aggregate)
+		args, err := serializeArgs(a.Wrapped)
+		return &Serialized{Args: args, Strings: map[string]string{"name": a.Name, "storage": a.Storage}}, err
+	}, func(se *Serialized) (Expr, error) {
+		args, err := deserializeArgs(se, 1)
+		if err != nil {
+			return nil, err
+		}
+		a := aggregateFor(se.Strings["name"], args[0])
+		if a == nil {
+			return nil, fmt.Errorf("Unknown aggregate %v", se.Strings["name"])
+		}
+		if storage := se.Strings["storage"]; storage != "" {
+			return WithStorage(a, storage)
+		}
+		return a, nil
+	})
+
+	mustRegisterSerializer("avg", &avg{}, func(e Expr) (*Serialized, error) {
+		a := e.(*avg)
+		args, err := serializeArgs(a.Value, a.Weight)
+		return &Serialized{Args: args}, err
+	}, func(se *Serialized) (Expr, error) {
+		args, err := deserializeArgs(se, 2)
+		if err != nil {
+			return nil, err
+		}
+		return WAVG(args[0], args[1]), nil
+	})
+
+	mustRegisterSerializer("ewma", &ewma{}, func(e Expr) (*Serialized, error) {
+		a := e.(*ewma)
+		args, err := serializeArgs(a.Value, a.Alpha)
+		return &Serialized{Args: args}, err
+	}, func(se *Serialized) (Expr, error) {
+		args, err := deserializeArgs(se, 2)
+		if err != nil {
+			return nil, err
+		}
+		return EWMA(args[0], args[1]), nil
+	})
+
+	mustRegisterSerializer("binary", &binaryExpr{}, func(e Expr) (*Serialized, error) {
+		b := e.(*binaryExpr)
+		args, err := serializeArgs(b.Left, b.Right)
+		return &Serialized{Args: args, Strings: map[string]string{"op": b.Op}}, err
+	}, func(se *Serialized) (Expr, error) {
+		args, err := deserializeArgs(se, 2)
+		if err != nil {
+			return nil, err
+		}
+		b := binaryExprFor(se.Strings["op"], args[0], args[1])
+		if b == nil {
+			return nil, fmt.Errorf("Unknown binary expression %v", se.Strings["op"])
+		}
+		return b, nil
+	})
+
+	mustRegisterSerializer("shift", &shift{}, func(e Expr) (*Serialized, error) {
+		s := e.(*shift)
+		args, err := serializeArgs(s.Wrapped)
+		return &Serialized{Args: args, Strings: map[string]string{"offset": s.Offset.String()}}, err
+	}, func(se *Serialized) (Expr, error) {
+		args, err := deserializeArgs(se, 1)
+		if err != nil {
+			return nil, err
+		}
+		offset, err := time.ParseDuration(se.Strings["offset"])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid shift offset %v: %v", se.Strings["offset"], err)
+		}
+		return SHIFT(args[0], offset), nil
+	})
+
+	mustRegisterSerializer("math", &unaryMathExpr{}, func(e Expr) (*Serialized, error) {
+		m := e.(*unaryMathExpr)
+		args, err := serializeArgs(m.Wrapped)
+		return &Serialized{Args: args, Strings: map[string]string{"name": m.Name}}, err
+	}, func(se *Serialized) (Expr, error) {
+		args, err := deserializeArgs(se, 1)
+		if err != nil {
+			return nil, err
+		}
+		return UnaryMath(se.Strings["name"], args[0])
+	})
+
+	mustRegisterSerializer("if", &ifExpr{}, func(e Expr) (*Serialized, error) {
+		i := e.(*ifExpr)
+		args, err := serializeArgs(i.Wrapped)
+		if err != nil {
+			return nil, err
+		}
+		cond, err := msgpack.Marshal(i.Cond)
+		return &Serialized{Args: args, Cond: cond}, err
+	}, func(se *Serialized) (Expr, error) {
+		args, err := deserializeArgs(se, 1)
+		if err != nil {
+			return nil, err
+		}
+		var cond goexpr.Expr
+		err = msgpack.Unmarshal(se.Cond, &cond)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decode condition: %v", err)
+		}
+		return IF(cond, args[0]), nil
+	})
+}
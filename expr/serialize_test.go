@@ -0,0 +1,75 @@
+package expr
+
+import (
+	"testing"
+	"time"
+
+	"github.com/getlantern/goexpr"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+func TestSerialization(t *testing.T) {
+	ln, _ := UnaryMath("LN", SUM("a"))
+	stored, _ := WithStorage(MAX("b"), StorageInt32)
+	exprs := []Expr{
+		FIELD("a"),
+		CONST(5),
+		SUM(BOUNDED("a", 1, 10)),
+		MAX(CLAMP("a", 0, 1000)),
+		stored,
+		WAVG("a", "b"),
+		EWMA("a", 0.3),
+		DIV(SUM("a"), COUNT("b")),
+		SHIFT(SUM("a"), -1*time.Hour),
+		ln,
+		IF(goexpr.Param("i"), SUM("a")),
+		COUNTER("requests"),
+		COALESCE(AVG("a"), 0),
+		ISNULL(SUM("a")),
+		ISNOTNULL(SUM("a")),
+	}
+	for _, e := range exprs {
+		b, err := Marshal(e)
+		if !assert.NoError(t, err, e.String()) {
+			continue
+		}
+		e2, err := Unmarshal(b)
+		if assert.NoError(t, err, e.String()) {
+			assert.Equal(t, e.String(), e2.String())
+			assert.Equal(t, e.EncodedWidth(), e2.EncodedWidth(), e.String())
+		}
+	}
+
+	compiled := Compile(SUM("a"), NewFieldIndex())
+	b, err := Marshal(compiled)
+	if assert.NoError(t, err) {
+		e2, err := Unmarshal(b)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "SUM(a)", e2.String())
+		}
+	}
+}
+
+func TestSerializationCompatibility(t *testing.T) {
+	legacy, err := msgpack.Marshal(SUM("a"))
+	if assert.NoError(t, err) {
+		e, err := Unmarshal(legacy)
+		if assert.NoError(t, err, "should read exprs encoded by older versions") {
+			assert.Equal(t, "SUM(a)", e.String())
+		}
+	}
+
+	unknownType, _ := msgpack.Marshal(&Serialized{Type: "fancy"})
+	_, err = Unmarshal(append([]byte{serializedMarker, SerializationVersion}, unknownType...))
+	assert.Error(t, err)
+
+	extraAttributes, _ := msgpack.Marshal(&Serialized{Type: "field", Strings: map[string]string{"name": "a", "unit": "bytes"}})
+	e, err := Unmarshal(append([]byte{serializedMarker, SerializationVersion}, extraAttributes...))
+	if assert.NoError(t, err, "unknown attributes should be ignored") {
+		assert.Equal(t, "a", e.String())
+	}
+
+	_, err = Unmarshal(append([]byte{serializedMarker, SerializationVersion + 1}, extraAttributes...))
+	assert.Error(t, err, "newer versions aren't supported")
+}
@@ -0,0 +1,98 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// Storage widths with which aggregates can store their values. Narrower widths
+// take less space at the cost of precision. Integer widths round values to the
+// nearest integer.
+const (
+	StorageFloat64 = "float64"
+	StorageFloat32 = "float32"
+	StorageInt64   = "int64"
+	StorageInt32   = "int32"
+)
+
+const (
+	width32bits = 4
+)
+
+// WithStorage returns a copy of the given Expr that stores its value using the
+// given storage width, which is one of the Storage* constants. Only aggregates
+// like SUM, MIN, MAX and COUNT support storage widths other than
+// StorageFloat64.
+func WithStorage(e Expr, storage string) (Expr, error) {
+	switch storage {
+	case StorageFloat64, StorageFloat32, StorageInt64, StorageInt32:
+		// okay
+	default:
+		return nil, fmt.Errorf("Unknown storage width %v, use one of %v, %v, %v or %v", storage, StorageFloat64, StorageFloat32, StorageInt64, StorageInt32)
+	}
+	agg, ok := e.(*aggregate)
+	if !ok {
+		if storage == StorageFloat64 {
+			return e, nil
+		}
+		return nil, fmt.Errorf("Storage width %v only supported for aggregates, not %v", storage, reflect.TypeOf(e))
+	}
+	result := *agg
+	result.Storage = storage
+	if storage == StorageFloat64 {
+		result.Storage = ""
+	}
+	return &result, nil
+}
+
+func storageWidth(storage string) int {
+	switch storage {
+	case StorageFloat32, StorageInt32:
+		return width32bits
+	default:
+		return width64bits
+	}
+}
+
+func loadStored(storage string, b []byte) float64 {
+	switch storage {
+	case StorageFloat32:
+		return float64(math.Float32frombits(binaryEncoding.Uint32(b)))
+	case StorageInt32:
+		return float64(int32(binaryEncoding.Uint32(b)))
+	case StorageInt64:
+		return float64(int64(binaryEncoding.Uint64(b)))
+	default:
+		return math.Float64frombits(binaryEncoding.Uint64(b))
+	}
+}
+
+func saveStored(storage string, b []byte, value float64) {
+	switch storage {
+	case StorageFloat32:
+		binaryEncoding.PutUint32(b, math.Float32bits(float32(value)))
+	case StorageInt32:
+		binaryEncoding.PutUint32(b, uint32(int32(toInt64(value, math.MinInt32, math.MaxInt32))))
+	case StorageInt64:
+		binaryEncoding.PutUint64(b, uint64(toInt64(value, math.MinInt64, math.MaxInt64)))
+	default:
+		binaryEncoding.PutUint64(b, math.Float64bits(value))
+	}
+}
+
+// toInt64 rounds value to the nearest integer, limited to min <= value <= max
+// so that it doesn't overflow. NaN becomes 0.
+func toInt64(value float64, min int64, max int64) int64 {
+	rounded := math.Round(value)
+	switch {
+	case math.IsNaN(rounded):
+		return 0
+	case rounded <= float64(min):
+		return min
+	case rounded >= float64(max):
+		return max
+	default:
+		return int64(rounded)
+	}
+}
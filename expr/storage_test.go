@@ -0,0 +1,71 @@
+package expr
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/getlantern/goexpr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithStorage(t *testing.T) {
+	md := goexpr.MapParams{}
+	for _, storage := range []string{StorageFloat32, StorageInt32, StorageInt64} {
+		e, err := WithStorage(SUM("a"), storage)
+		if !assert.NoError(t, err) {
+			return
+		}
+		e = msgpacked(t, e)
+		assert.Equal(t, "SUM(a):"+storage, e.String())
+
+		b := make([]byte, e.EncodedWidth())
+		e.Update(b, Map{"a": 2}, md)
+		e.Update(b, Map{"a": 3}, md)
+		val, wasSet, remain := e.Get(b)
+		assert.True(t, wasSet)
+		assert.Empty(t, remain)
+		assert.EqualValues(t, 5, val)
+
+		// Merging from the default float64 storage
+		f64 := SUM("a")
+		other := make([]byte, f64.EncodedWidth())
+		f64.Update(other, Map{"a": 4.4}, md)
+		subMergers := e.SubMergers([]Expr{f64, MIN("a")})
+		if assert.NotNil(t, subMergers[0], "should be able to submerge same aggregate with different storage") {
+			subMergers[0](b, other, time.Second, md)
+		}
+		assert.Nil(t, subMergers[1])
+		val, _, _ = e.Get(b)
+		if storage == StorageFloat32 {
+			assert.InDelta(t, 9.4, val, 0.0001, "float32 should be close")
+		} else {
+			assert.EqualValues(t, 9, val, "integer storage should round")
+		}
+	}
+
+	f32, _ := WithStorage(SUM("a"), StorageFloat32)
+	assert.Equal(t, SUM("a").EncodedWidth()-4, f32.EncodedWidth(), "float32 should take 4 fewer bytes")
+	i64, _ := WithStorage(SUM("a"), StorageInt64)
+	assert.Equal(t, SUM("a").EncodedWidth(), i64.EncodedWidth())
+	f64, err := WithStorage(f32, StorageFloat64)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "SUM(a)", f64.String())
+	}
+
+	_, err = WithStorage(SUM("a"), "float16")
+	assert.Error(t, err, "unknown storage should fail")
+	_, err = WithStorage(AVG("a"), StorageFloat32)
+	assert.Error(t, err, "non-aggregate should fail")
+	_, err = WithStorage(AVG("a"), StorageFloat64)
+	assert.NoError(t, err, "float64 storage should work for everything")
+}
+
+func TestToInt64(t *testing.T) {
+	assert.EqualValues(t, 3, toInt64(2.5, math.MinInt32, math.MaxInt32))
+	assert.EqualValues(t, -3, toInt64(-2.5, math.MinInt32, math.MaxInt32))
+	assert.EqualValues(t, math.MaxInt32, toInt64(1e20, math.MinInt32, math.MaxInt32))
+	assert.EqualValues(t, math.MinInt32, toInt64(-1e20, math.MinInt32, math.MaxInt32))
+	assert.EqualValues(t, int64(math.MaxInt64), toInt64(1e20, math.MinInt64, math.MaxInt64))
+	assert.EqualValues(t, 0, toInt64(math.NaN(), math.MinInt64, math.MaxInt64))
+}
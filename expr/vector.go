@@ -0,0 +1,109 @@
+package expr
+
+import (
+	"math"
+)
+
+// VectorMerger is implemented by Exprs that can merge many consecutive periods
+// in one go. Compared to calling Merge once per period, this avoids an
+// interface call and the decoding overhead for every period and lets the
+// compiler turn the merge into a tight loop.
+type VectorMerger interface {
+	// MergeVector merges n consecutive periods of x and y, writing the results
+	// to b. Each period is EncodedWidth() bytes wide. b may be the same slice
+	// as x or y.
+	MergeVector(b []byte, x []byte, y []byte, n int)
+}
+
+// MergeN merges n consecutive periods of x and y, writing the results to b.
+// It uses MergeVector if e supports it and merges one period at a time
+// otherwise.
+func MergeN(e Expr, b []byte, x []byte, y []byte, n int) {
+	if vm, ok := e.(VectorMerger); ok {
+		vm.MergeVector(b, x, y, n)
+		return
+	}
+	mergeEach(e, b, x, y, n)
+}
+
+func mergeEach(e Expr, b []byte, x []byte, y []byte, n int) {
+	for i := 0; i < n; i++ {
+		b, x, y = e.Merge(b, x, y)
+	}
+}
+
+func (e *aggregate) MergeVector(b []byte, x []byte, y []byte, n int) {
+	width := e.EncodedWidth()
+	if width != 1+width64bits || (e.Storage != "" && e.Storage != StorageFloat64) {
+		// only float64 values are merged in place
+		mergeEach(e, b, x, y, n)
+		return
+	}
+	l := n * width
+	// Reslicing up front lets the compiler drop bounds checks in the loops
+	b, x, y = b[:l], x[:l], y[:l]
+	switch e.Name {
+	case "SUM", "COUNT":
+		for i := 0; i+width <= l; i += width {
+			xWasSet, yWasSet := x[i] == 1, y[i] == 1
+			if !xWasSet && !yWasSet {
+				continue
+			}
+			valueX := math.Float64frombits(binaryEncoding.Uint64(x[i+1 : i+width]))
+			valueY := math.Float64frombits(binaryEncoding.Uint64(y[i+1 : i+width]))
+			if !xWasSet {
+				valueX = 0
+			}
+			if !yWasSet {
+				valueY = 0
+			}
+			b[i] = 1
+			binaryEncoding.PutUint64(b[i+1:i+width], math.Float64bits(valueX+valueY))
+		}
+	default:
+		for i := 0; i+width <= l; i += width {
+			xWasSet, yWasSet := x[i] == 1, y[i] == 1
+			var value float64
+			switch {
+			case xWasSet && yWasSet:
+				value = e.merge(true, math.Float64frombits(binaryEncoding.Uint64(x[i+1:i+width])), math.Float64frombits(binaryEncoding.Uint64(y[i+1:i+width])))
+			case xWasSet:
+				value = math.Float64frombits(binaryEncoding.Uint64(x[i+1 : i+width]))
+			case yWasSet:
+				value = math.Float64frombits(binaryEncoding.Uint64(y[i+1 : i+width]))
+			default:
+				continue
+			}
+			b[i] = 1
+			binaryEncoding.PutUint64(b[i+1:i+width], math.Float64bits(value))
+		}
+	}
+}
+
+func (e *avg) MergeVector(b []byte, x []byte, y []byte, n int) {
+	width := e.EncodedWidth()
+	if width != 1+width64bits*2 {
+		mergeEach(e, b, x, y, n)
+		return
+	}
+	l := n * width
+	b, x, y = b[:l], x[:l], y[:l]
+	for i := 0; i+width <= l; i += width {
+		xWasSet, yWasSet := x[i] == 1, y[i] == 1
+		if !xWasSet && !yWasSet {
+			continue
+		}
+		var countX, totalX, countY, totalY float64
+		if xWasSet {
+			countX = math.Float64frombits(binaryEncoding.Uint64(x[i+1 : i+1+width64bits]))
+			totalX = math.Float64frombits(binaryEncoding.Uint64(x[i+1+width64bits : i+width]))
+		}
+		if yWasSet {
+			countY = math.Float64frombits(binaryEncoding.Uint64(y[i+1 : i+1+width64bits]))
+			totalY = math.Float64frombits(binaryEncoding.Uint64(y[i+1+width64bits : i+width]))
+		}
+		b[i] = 1
+		binaryEncoding.PutUint64(b[i+1:i+1+width64bits], math.Float64bits(countX+countY))
+		binaryEncoding.PutUint64(b[i+1+width64bits:i+width], math.Float64bits(totalX+totalY))
+	}
+}
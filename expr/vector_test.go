@@ -0,0 +1,63 @@
+package expr
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeN(t *testing.T) {
+	float32SUM, _ := WithStorage(SUM("a"), StorageFloat32)
+	exprs := []Expr{SUM("a"), COUNT("a"), MIN("a"), MAX("a"), AVG("a"), WAVG("a", "b"), float32SUM, ADD(SUM("a"), MAX("a"))}
+	for _, e := range exprs {
+		periods := 100
+		x := randomPeriods(e, periods)
+		y := randomPeriods(e, periods)
+
+		expected := make([]byte, len(x))
+		mergeEach(e, expected, x, y, periods)
+
+		actual := make([]byte, len(x))
+		MergeN(e, actual, x, y, periods)
+		assert.Equal(t, expected, actual, "merging %v", e)
+
+		// merging in place
+		MergeN(e, x, x, y, periods)
+		assert.Equal(t, expected, x, "merging %v in place", e)
+	}
+}
+
+// randomPeriods builds the given number of periods for e, leaving about a
+// third of them unset.
+func randomPeriods(e Expr, periods int) []byte {
+	width := e.EncodedWidth()
+	b := make([]byte, periods*width)
+	for i := 0; i < periods; i++ {
+		if rand.Intn(3) == 0 {
+			continue
+		}
+		e.Update(b[i*width:], Map{"a": rand.Float64() * 100, "b": rand.Float64()}, nil)
+	}
+	return b
+}
+
+func BenchmarkMergeEach(b *testing.B) {
+	doBenchmarkMerge(b, mergeEach)
+}
+
+func BenchmarkMergeN(b *testing.B) {
+	doBenchmarkMerge(b, MergeN)
+}
+
+func doBenchmarkMerge(b *testing.B, merge func(e Expr, b []byte, x []byte, y []byte, n int)) {
+	e := SUM("a")
+	periods := 10000
+	x := randomPeriods(e, periods)
+	y := randomPeriods(e, periods)
+	out := make([]byte, len(x))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		merge(e, out, x, y, periods)
+	}
+}
@@ -0,0 +1,260 @@
+// Package geodim provides dimensional expressions for dimensions that hold
+// geographic locations, either as separate latitude and longitude dimensions
+// or as geohashes.
+package geodim
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/getlantern/goexpr"
+)
+
+const (
+	// earthRadiusKm is the mean radius of the earth
+	earthRadiusKm = 6371.0088
+
+	geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+	// maxGeohashPrecision is the longest geohash that fits in 64 bits worth of
+	// interleaved latitude and longitude
+	maxGeohashPrecision = 12
+)
+
+// GEOHASH_PREFIX returns the first precision characters of the geohash of the
+// location in the given dimension, which either holds a geohash or a
+// "lat,lon" string. Locations that share a prefix lie in the same cell of a
+// grid whose cells get smaller with precision, so grouping by the prefix
+// aggregates data coarsely by location.
+func GEOHASH_PREFIX(location goexpr.Expr, precision goexpr.Expr) goexpr.Expr {
+	return &geohashPrefix{location, precision}
+}
+
+type geohashPrefix struct {
+	Location  goexpr.Expr
+	Precision goexpr.Expr
+}
+
+func (e *geohashPrefix) Eval(params goexpr.Params) interface{} {
+	precision, ok := toFloat(e.Precision.Eval(params))
+	if !ok || precision < 1 {
+		return nil
+	}
+	location, ok := e.Location.Eval(params).(string)
+	if !ok {
+		return nil
+	}
+	hash := location
+	if parts := strings.Split(location, ","); len(parts) == 2 {
+		lat, latOK := toFloat(strings.TrimSpace(parts[0]))
+		lon, lonOK := toFloat(strings.TrimSpace(parts[1]))
+		if !latOK || !lonOK {
+			return nil
+		}
+		hash = Geohash(lat, lon, int(precision))
+	}
+	if int(precision) < len(hash) {
+		hash = hash[:int(precision)]
+	}
+	return hash
+}
+
+func (e *geohashPrefix) WalkParams(cb func(string)) {
+	e.Location.WalkParams(cb)
+	e.Precision.WalkParams(cb)
+}
+
+func (e *geohashPrefix) WalkOneToOneParams(cb func(string)) {
+	// truncating loses information, so this isn't one-to-one
+}
+
+func (e *geohashPrefix) WalkLists(cb func(goexpr.List)) {
+	e.Location.WalkLists(cb)
+	e.Precision.WalkLists(cb)
+}
+
+func (e *geohashPrefix) String() string {
+	return fmt.Sprintf("GEOHASH_PREFIX(%v, %v)", e.Location, e.Precision)
+}
+
+// GEO_IN_BBOX checks whether the location given by the lat and lon dimensions
+// lies within the bounding box between the given south, west, north and east
+// edges. Boxes whose west edge is east of their east edge span the
+// antimeridian.
+func GEO_IN_BBOX(lat, lon, south, west, north, east goexpr.Expr) goexpr.Expr {
+	return &inBBox{lat, lon, south, west, north, east}
+}
+
+type inBBox struct {
+	Lat   goexpr.Expr
+	Lon   goexpr.Expr
+	South goexpr.Expr
+	West  goexpr.Expr
+	North goexpr.Expr
+	East  goexpr.Expr
+}
+
+func (e *inBBox) Eval(params goexpr.Params) interface{} {
+	vals, ok := evalFloats(params, e.exprs())
+	if !ok {
+		return false
+	}
+	lat, lon, south, west, north, east := vals[0], vals[1], vals[2], vals[3], vals[4], vals[5]
+	if lat < south || lat > north {
+		return false
+	}
+	if west <= east {
+		return lon >= west && lon <= east
+	}
+	return lon >= west || lon <= east
+}
+
+func (e *inBBox) exprs() []goexpr.Expr {
+	return []goexpr.Expr{e.Lat, e.Lon, e.South, e.West, e.North, e.East}
+}
+
+func (e *inBBox) WalkParams(cb func(string)) {
+	for _, ex := range e.exprs() {
+		ex.WalkParams(cb)
+	}
+}
+
+func (e *inBBox) WalkOneToOneParams(cb func(string)) {
+	// a boolean doesn't preserve its inputs
+}
+
+func (e *inBBox) WalkLists(cb func(goexpr.List)) {
+	for _, ex := range e.exprs() {
+		ex.WalkLists(cb)
+	}
+}
+
+func (e *inBBox) String() string {
+	return fmt.Sprintf("GEO_IN_BBOX(%v, %v, %v, %v, %v, %v)", e.Lat, e.Lon, e.South, e.West, e.North, e.East)
+}
+
+// GEO_DISTANCE returns the great-circle distance in kilometers between the
+// locations given by two pairs of lat and lon dimensions, or nil if any of
+// them is missing.
+func GEO_DISTANCE(lat1, lon1, lat2, lon2 goexpr.Expr) goexpr.Expr {
+	return &distance{lat1, lon1, lat2, lon2}
+}
+
+type distance struct {
+	Lat1 goexpr.Expr
+	Lon1 goexpr.Expr
+	Lat2 goexpr.Expr
+	Lon2 goexpr.Expr
+}
+
+func (e *distance) Eval(params goexpr.Params) interface{} {
+	vals, ok := evalFloats(params, e.exprs())
+	if !ok {
+		return nil
+	}
+	return DistanceKm(vals[0], vals[1], vals[2], vals[3])
+}
+
+func (e *distance) exprs() []goexpr.Expr {
+	return []goexpr.Expr{e.Lat1, e.Lon1, e.Lat2, e.Lon2}
+}
+
+func (e *distance) WalkParams(cb func(string)) {
+	for _, ex := range e.exprs() {
+		ex.WalkParams(cb)
+	}
+}
+
+func (e *distance) WalkOneToOneParams(cb func(string)) {
+	// a distance doesn't preserve its inputs
+}
+
+func (e *distance) WalkLists(cb func(goexpr.List)) {
+	for _, ex := range e.exprs() {
+		ex.WalkLists(cb)
+	}
+}
+
+func (e *distance) String() string {
+	return fmt.Sprintf("GEO_DISTANCE(%v, %v, %v, %v)", e.Lat1, e.Lon1, e.Lat2, e.Lon2)
+}
+
+// Geohash encodes the given location as a geohash with the given number of
+// characters, up to 12.
+func Geohash(lat, lon float64, precision int) string {
+	if precision > maxGeohashPrecision {
+		precision = maxGeohashPrecision
+	}
+	latRange := [2]float64{-90, 90}
+	lonRange := [2]float64{-180, 180}
+	result := make([]byte, 0, precision)
+	even := true
+	bit, ch := 0, 0
+	for len(result) < precision {
+		r, val := &latRange, lat
+		if even {
+			r, val = &lonRange, lon
+		}
+		mid := (r[0] + r[1]) / 2
+		ch <<= 1
+		if val >= mid {
+			ch |= 1
+			r[0] = mid
+		} else {
+			r[1] = mid
+		}
+		even = !even
+		bit++
+		if bit == 5 {
+			result = append(result, geohashAlphabet[ch])
+			bit, ch = 0, 0
+		}
+	}
+	return string(result)
+}
+
+// DistanceKm calculates the great-circle distance in kilometers between two
+// locations using the haversine formula.
+func DistanceKm(lat1, lon1, lat2, lon2 float64) float64 {
+	phi1, phi2 := radians(lat1), radians(lat2)
+	dPhi := radians(lat2 - lat1)
+	dLambda := radians(lon2 - lon1)
+	a := math.Sin(dPhi/2)*math.Sin(dPhi/2) + math.Cos(phi1)*math.Cos(phi2)*math.Sin(dLambda/2)*math.Sin(dLambda/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+func radians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+func evalFloats(params goexpr.Params, exprs []goexpr.Expr) ([]float64, bool) {
+	result := make([]float64, 0, len(exprs))
+	for _, ex := range exprs {
+		val, ok := toFloat(ex.Eval(params))
+		if !ok {
+			return nil, false
+		}
+		result = append(result, val)
+	}
+	return result, true
+}
+
+func toFloat(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
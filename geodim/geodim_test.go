@@ -0,0 +1,59 @@
+package geodim
+
+import (
+	"testing"
+
+	"github.com/getlantern/goexpr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGeohash(t *testing.T) {
+	assert.Equal(t, "u4pruydqqvj", Geohash(57.64911, 10.40744, 11))
+	assert.Equal(t, "u4pruydqqvj8", Geohash(57.64911, 10.40744, 20), "precision should be capped")
+}
+
+func TestGeohashPrefix(t *testing.T) {
+	params := goexpr.MapParams{
+		"hash":     "u4pruydqqvj",
+		"location": "57.64911, 10.40744",
+		"bad":      "57.64911,north",
+	}
+	prefix := func(dim string, precision int) interface{} {
+		return GEOHASH_PREFIX(goexpr.Param(dim), goexpr.Constant(precision)).Eval(params)
+	}
+	assert.Equal(t, "u4p", prefix("hash", 3))
+	assert.Equal(t, "u4pru", prefix("location", 5))
+	assert.Equal(t, "u4pruydqqvj", prefix("hash", 20))
+	assert.Nil(t, prefix("bad", 3))
+	assert.Nil(t, prefix("missing", 3))
+	assert.Nil(t, prefix("hash", 0))
+	assert.Equal(t, "GEOHASH_PREFIX(hash, 3)", GEOHASH_PREFIX(goexpr.Param("hash"), goexpr.Constant(3)).String())
+}
+
+func TestInBBox(t *testing.T) {
+	inBBox := func(lat, lon interface{}, south, west, north, east float64) interface{} {
+		params := goexpr.MapParams{"lat": lat, "lon": lon}
+		return GEO_IN_BBOX(goexpr.Param("lat"), goexpr.Param("lon"), goexpr.Constant(south), goexpr.Constant(west), goexpr.Constant(north), goexpr.Constant(east)).Eval(params)
+	}
+	assert.Equal(t, true, inBBox(51.5, -0.12, 50, -1, 52, 1))
+	assert.Equal(t, true, inBBox("51.5", "-0.12", 50, -1, 52, 1), "strings should be parsed")
+	assert.Equal(t, false, inBBox(53.5, -0.12, 50, -1, 52, 1))
+	assert.Equal(t, false, inBBox(51.5, 2, 50, -1, 52, 1))
+	assert.Equal(t, true, inBBox(0, 179, -10, 170, 10, -170), "box spanning the antimeridian")
+	assert.Equal(t, true, inBBox(0, -175, -10, 170, 10, -170), "box spanning the antimeridian")
+	assert.Equal(t, false, inBBox(0, 0, -10, 170, 10, -170), "box spanning the antimeridian")
+	assert.Equal(t, false, inBBox(nil, 0, -10, -10, 10, 10), "missing lat")
+}
+
+func TestDistance(t *testing.T) {
+	params := goexpr.MapParams{
+		"lat1": 51.5074,
+		"lon1": -0.1278,
+		"lat2": 48.8566,
+		"lon2": 2.3522,
+	}
+	d := GEO_DISTANCE(goexpr.Param("lat1"), goexpr.Param("lon1"), goexpr.Param("lat2"), goexpr.Param("lon2"))
+	assert.InDelta(t, 343.5, d.Eval(params), 1, "London to Paris")
+	assert.Nil(t, GEO_DISTANCE(goexpr.Param("lat1"), goexpr.Param("lon1"), goexpr.Param("lat3"), goexpr.Param("lon2")).Eval(params))
+	assert.InDelta(t, 0, DistanceKm(10, 10, 10, 10), 0.0001)
+}
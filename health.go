@@ -0,0 +1,142 @@
+package zenodb
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/getlantern/zenodb/encoding"
+)
+
+// Healthy checks that the database is able to store data, meaning that its
+// data directory and the directories of its WALs are writable. It returns an
+// error describing every failed check.
+func (db *DB) Healthy() error {
+	return joinErrors(db.healthChecks())
+}
+
+// Ready checks that the database is Healthy and that it's keeping up, meaning
+// that no table has more than DBOpts.MaxArchiveQueueDepth inserts waiting to be
+// flushed to disk and, on followers, that data arrives from the leader within
+// DBOpts.MaxFollowLag. It returns an error describing every failed check.
+func (db *DB) Ready() error {
+	errs := db.healthChecks()
+	db.tunablesMx.RLock()
+	maxArchiveQueueDepth := db.opts.MaxArchiveQueueDepth
+	maxFollowLag := db.opts.MaxFollowLag
+	db.tunablesMx.RUnlock()
+	if maxArchiveQueueDepth > 0 {
+		for _, t := range db.allTables() {
+			if t.rowStore == nil {
+				continue
+			}
+			depth := t.rowStore.archiveQueueDepth()
+			if depth > maxArchiveQueueDepth {
+				errs = append(errs, fmt.Errorf("Table %v has %d inserts waiting to be archived, more than %d", t.Name, depth, maxArchiveQueueDepth))
+			}
+		}
+	}
+	if maxFollowLag > 0 {
+		db.followLagsMx.RLock()
+		for stream, lag := range db.followLags {
+			if lag > maxFollowLag {
+				errs = append(errs, fmt.Errorf("Stream %v is lagging the leader by %v, more than %v", stream, lag, maxFollowLag))
+			}
+		}
+		db.followLagsMx.RUnlock()
+	}
+	return joinErrors(errs)
+}
+
+// ServeHealthz is an http.HandlerFunc that responds with 200 OK if the
+// database is Healthy and 503 Service Unavailable otherwise.
+func (db *DB) ServeHealthz(resp http.ResponseWriter, req *http.Request) {
+	serveCheck(resp, db.Healthy())
+}
+
+// ServeReadyz is an http.HandlerFunc that responds with 200 OK if the
+// database is Ready and 503 Service Unavailable otherwise.
+func (db *DB) ServeReadyz(resp http.ResponseWriter, req *http.Request) {
+	serveCheck(resp, db.Ready())
+}
+
+func serveCheck(resp http.ResponseWriter, err error) {
+	resp.Header().Set("Content-Type", "text/plain")
+	if err != nil {
+		resp.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(resp, err)
+		return
+	}
+	fmt.Fprintln(resp, "ok")
+}
+
+func (db *DB) healthChecks() []error {
+	var errs []error
+	err := checkWritable(db.opts.Dir)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Data directory is not writable: %v", err))
+	}
+
+	db.tablesMutex.RLock()
+	streams := make([]string, 0, len(db.streams))
+	for stream := range db.streams {
+		streams = append(streams, stream)
+	}
+	db.tablesMutex.RUnlock()
+	sort.Strings(streams)
+	for _, stream := range streams {
+		err := checkWritable(db.walDir(stream))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("WAL for stream %v is not writable: %v", stream, err))
+		}
+	}
+	return errs
+}
+
+func (db *DB) allTables() []*table {
+	db.tablesMutex.RLock()
+	tables := make([]*table, len(db.orderedTables))
+	copy(tables, db.orderedTables)
+	db.tablesMutex.RUnlock()
+	return tables
+}
+
+// recordFollowLag records how long after its timestamp a point from the given
+// stream arrived from the leader.
+func (db *DB) recordFollowLag(stream string, data []byte) {
+	if len(data) < encoding.Width64bits {
+		return
+	}
+	ts := encoding.TimeFromBytes(data[:encoding.Width64bits])
+	lag := db.clock.Now().Sub(ts)
+	if lag < 0 {
+		lag = 0
+	}
+	db.followLagsMx.Lock()
+	db.followLags[stream] = lag
+	db.followLagsMx.Unlock()
+}
+
+func checkWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, ".healthcheck")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func joinErrors(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return errors.New(strings.Join(msgs, "\n"))
+}
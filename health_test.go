@@ -0,0 +1,86 @@
+package zenodb
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthAndReadiness(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tmpFile, err := ioutil.TempFile("", "zenodbschema")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.Remove(tmpFile.Name())
+	err = ioutil.WriteFile(tmpFile.Name(), []byte(`
+thetable:
+  maxflushlatency: 1h
+  retentionperiod: 1h
+  sql: >
+    SELECT SUM(a) AS a
+    FROM inbound
+    GROUP BY x, period(1s)
+`), 0644)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	db, err := NewDB(&DBOpts{
+		Dir:                  tmpDir,
+		SchemaFile:           tmpFile.Name(),
+		MaxArchiveQueueDepth: 2,
+		MaxFollowLag:         1 * time.Minute,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	checkStatus := func(handler http.HandlerFunc, expected int) {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Equal(t, expected, rec.Code, rec.Body.String())
+	}
+
+	assert.NoError(t, db.Healthy())
+	assert.NoError(t, db.Ready())
+	checkStatus(db.ServeHealthz, http.StatusOK)
+	checkStatus(db.ServeReadyz, http.StatusOK)
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		db.Insert("inbound", now, map[string]interface{}{"x": i}, map[string]float64{"a": 1})
+	}
+	waitFor(func() bool { return db.TableStats("thetable").ArchiveQueueDepth == 3 })
+	assert.NoError(t, db.Healthy())
+	assert.Error(t, db.Ready(), "Archive queue above threshold should make database not ready")
+	checkStatus(db.ServeHealthz, http.StatusOK)
+	checkStatus(db.ServeReadyz, http.StatusServiceUnavailable)
+
+	db.getTable("thetable").forceFlush()
+	assert.NoError(t, db.Ready(), "Flushing should make database ready again")
+
+	data := make([]byte, encoding.Width64bits)
+	encoding.EncodeTime(data, now.Add(-5*time.Minute))
+	db.recordFollowLag("inbound", data)
+	assert.Error(t, db.Ready(), "Lagging follower should not be ready")
+	encoding.EncodeTime(data, time.Now())
+	db.recordFollowLag("inbound", data)
+	assert.NoError(t, db.Ready())
+
+	os.RemoveAll(db.walDir("inbound"))
+	assert.Error(t, db.Healthy(), "Missing WAL directory should be unhealthy")
+	checkStatus(db.ServeHealthz, http.StatusServiceUnavailable)
+}
@@ -1,33 +1,71 @@
 package zenodb
 
 import (
+	"context"
 	"fmt"
 	"hash"
+	"reflect"
 	"strings"
 	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/getlantern/bytemap"
 	"github.com/getlantern/errors"
+	"github.com/getlantern/goexpr"
 	"github.com/getlantern/wal"
+	"github.com/getlantern/zenodb/common"
 	"github.com/getlantern/zenodb/encoding"
 )
 
+var (
+	// paramType identifies group by expressions that simply reference a
+	// dimension
+	paramType = reflect.TypeOf(goexpr.Param(""))
+)
+
 func (db *DB) Insert(stream string, ts time.Time, dims map[string]interface{}, vals map[string]float64) error {
 	return db.InsertRaw(stream, ts, bytemap.New(dims), bytemap.NewFloat(vals))
 }
 
+// InsertContext is like Insert but declines to insert once ctx is done.
+func (db *DB) InsertContext(ctx context.Context, stream string, ts time.Time, dims map[string]interface{}, vals map[string]float64) error {
+	return db.InsertRawContext(ctx, stream, ts, bytemap.New(dims), bytemap.NewFloat(vals))
+}
+
 func (db *DB) InsertRaw(stream string, ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap) error {
+	return db.InsertRawContext(context.Background(), stream, ts, dims, vals)
+}
+
+// InsertRawContext is like InsertRaw but declines to insert once ctx is done.
+// Points are written to the WAL synchronously, so a point that was accepted
+// before ctx was done is not rolled back.
+func (db *DB) InsertRawContext(ctx context.Context, stream string, ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap) error {
+	ctxErr := ctx.Err()
+	if ctxErr != nil {
+		return ctxErr
+	}
+	stream = strings.TrimSpace(strings.ToLower(stream))
+	if db.opts.ReadOnly {
+		return errors.New("Declining to insert data into read-only database")
+	}
 	if db.opts.Follow != nil {
+		if db.opts.ForwardInsert != nil {
+			return db.opts.ForwardInsert(stream, ts, dims, vals)
+		}
 		return errors.New("Declining to insert data directly to follower")
 	}
+	if t := db.tenantFor(stream); t != nil {
+		err := t.admitInsert(db.clock.Now())
+		if err != nil {
+			return err
+		}
+	}
 
-	stream = strings.TrimSpace(strings.ToLower(stream))
 	db.tablesMutex.Lock()
 	w := db.streams[stream]
 	db.tablesMutex.Unlock()
 	if w == nil {
-		return fmt.Errorf("No wal found for stream %v", stream)
+		return common.Errorf(common.ErrUnknownStream, "No wal found for stream %v", stream)
 	}
 
 	var lastErr error
@@ -47,12 +85,38 @@ func (db *DB) InsertRaw(stream string, ts time.Time, dims bytemap.ByteMap, vals
 	return lastErr
 }
 
+// StreamOffset returns the offset just past the latest entry in the given
+// stream's WAL. Producers can checkpoint it along with their own position to
+// implement at-least-once delivery. With a WALSyncInterval of 0, points are
+// synced to the WAL before Insert returns, so the offset obtained after an
+// Insert returns covers the inserted point. Otherwise, the offset only covers
+// points that have been synced and may trail the latest inserts by up to the
+// WALSyncInterval. It's not available on followers, which don't write the WAL.
+func (db *DB) StreamOffset(stream string) (wal.Offset, error) {
+	stream = strings.TrimSpace(strings.ToLower(stream))
+	if db.opts.Follow != nil {
+		return nil, errors.New("Followers don't write a WAL")
+	}
+	db.tablesMutex.RLock()
+	w := db.streams[stream]
+	db.tablesMutex.RUnlock()
+	if w == nil {
+		return nil, common.Errorf(common.ErrUnknownStream, "No wal found for stream %v", stream)
+	}
+	_, offset, err := w.Latest()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find latest offset of stream %v: %v", stream, err)
+	}
+	return offset, nil
+}
+
 type walRead struct {
 	data   []byte
 	offset wal.Offset
 }
 
 func (t *table) processWALInserts() {
+	t.labelGoroutine()
 	in := make(chan *walRead)
 	go t.processInserts(in)
 
@@ -66,26 +130,59 @@ func (t *table) processWALInserts() {
 }
 
 func (t *table) processInserts(in chan *walRead) {
-	isFollower := t.db.opts.Follow != nil
+	t.labelGoroutine()
+	// A passthrough node with a LocalPartition only keeps the data for its
+	// partition, like a follower
+	isFollower := t.db.opts.Follow != nil || t.db.opts.LocalPartition
 	start := time.Now()
 	inserted := 0
 	skipped := 0
 	bytesRead := 0
 
 	h := partitionHash()
-	for read := range in {
+	batch := &observeBatch{}
+	for {
+		var read *walRead
+		select {
+		case read = <-in:
+		default:
+			// Caught up, let the clock catch up with what we've inserted
+			batch.flush(t.db.clock)
+			read = <-in
+		}
+		if batch.size >= maxObserveBatch {
+			batch.flush(t.db.clock)
+		}
 		if read.data == nil {
 			// Ignore empty data
 			continue
 		}
+		var discarding bool
+		for {
+			t.waitIfPaused()
+			t.insertMx.Lock()
+			var paused bool
+			paused, discarding = t.pauseState()
+			if !paused || discarding {
+				break
+			}
+			// Paused while we were waiting for the lock
+			t.insertMx.Unlock()
+		}
 		bytesRead += len(read.data)
-		if t.insert(read.data, isFollower, h, read.offset) {
+		if discarding {
+			t.discard(read.data)
+			t.skip(read.offset)
+			skipped++
+		} else if t.insert(read.data, isFollower, h, read.offset, batch) {
 			inserted++
 		} else {
 			// Did not insert (probably due to WHERE clause)
 			t.skip(read.offset)
 			skipped++
 		}
+		t.updateReadOffset(read.offset)
+		t.insertMx.Unlock()
 		delta := time.Now().Sub(start)
 		if delta > 1*time.Minute {
 			t.log.Debugf("Read %v at %v per second", humanize.Bytes(uint64(bytesRead)), humanize.Bytes(uint64(float64(bytesRead)/delta.Seconds())))
@@ -99,38 +196,78 @@ func (t *table) processInserts(in chan *walRead) {
 	}
 }
 
-func (t *table) insert(data []byte, isFollower bool, h hash.Hash32, offset wal.Offset) bool {
-	tsd, remain := encoding.Read(data, encoding.Width64bits)
-	ts := encoding.TimeFromBytes(tsd)
-	if ts.Before(t.truncateBefore()) {
+func (t *table) insert(data []byte, isFollower bool, h hash.Hash32, offset wal.Offset, batch *observeBatch) bool {
+	ts, dims, vals, err := decodeInsert(data)
+	if err != nil {
+		t.log.Errorf("%v, skipping entry", err)
+		return false
+	}
+	truncateBefore := t.truncateBefore()
+	if ts.Before(truncateBefore) {
 		// Ignore old data
 		return false
 	}
-	dimsLen, remain := encoding.ReadInt32(remain)
-	dims, remain := encoding.Read(remain, dimsLen)
 	if isFollower && !t.db.inPartition(h, dims, t.PartitionBy, t.db.opts.Partition) {
 		// data not relevant to follower on this table
 		return false
 	}
 
-	valsLen, remain := encoding.ReadInt32(remain)
-	vals, _ := encoding.Read(remain, valsLen)
-	// Split the dims and vals so that holding on to one doesn't force holding on
-	// to the other. Also, we need copies for both because the WAL read buffer
-	// will change on next call to wal.Read().
-	dimsBM := make(bytemap.ByteMap, len(dims))
-	valsBM := make(bytemap.ByteMap, len(vals))
-	copy(dimsBM, dims)
-	copy(valsBM, vals)
-	return t.doInsert(ts, dimsBM, valsBM, offset)
+	// We need copies of the dims and vals because the WAL read buffer will change
+	// on next call to wal.Read(). Dims are interned, so points with the same dims
+	// share a single copy. Vals are copied into the TSParams by doInsert, so
+	// they only need to stay valid until then.
+	interned := t.interner.dims(dims)
+	valsBM := t.interner.vals(vals)
+	if counterFields := t.getCounterFields(); len(counterFields) > 0 {
+		valsBM = t.counterDeltas.apply(ts, interned.dims, valsBM, counterFields, truncateBefore)
+	}
+	return t.doInsert(ts, interned.dims, valsBM, offset, batch, interned)
+}
+
+// discard counts a point that was dropped because the table was paused with
+// DiscardIngestion.
+func (t *table) discard(data []byte) {
+	ts, _, _, err := decodeInsert(data)
+	if err != nil {
+		return
+	}
+	t.counters.droppedPoints.add(uint64(ts.UnixNano()), 1)
 }
 
 // Skip informs the table of a new offset so that we can store it
 func (t *table) skip(offset wal.Offset) {
-	t.rowStore.insert(&insert{nil, nil, nil, offset})
+	t.rowStore.insert(&insert{offset: offset})
+}
+
+// decodeInsert decodes an insert as written to the WAL by InsertRaw. The
+// returned dims and vals reference data.
+func decodeInsert(data []byte) (ts time.Time, dims []byte, vals []byte, err error) {
+	ts, remain, err := encoding.ReadTimeChecked(data)
+	if err != nil {
+		return ts, nil, nil, fmt.Errorf("Unable to decode timestamp: %v", err)
+	}
+	dimsLen, remain, err := encoding.ReadInt32Checked(remain)
+	if err != nil {
+		return ts, nil, nil, fmt.Errorf("Unable to decode dimensions length: %v", err)
+	}
+	dims, remain, err = encoding.ReadChecked(remain, dimsLen)
+	if err != nil {
+		return ts, nil, nil, fmt.Errorf("Unable to decode dimensions: %v", err)
+	}
+	valsLen, remain, err := encoding.ReadInt32Checked(remain)
+	if err != nil {
+		return ts, nil, nil, fmt.Errorf("Unable to decode values length: %v", err)
+	}
+	vals, _, err = encoding.ReadChecked(remain, valsLen)
+	if err != nil {
+		return ts, nil, nil, fmt.Errorf("Unable to decode values: %v", err)
+	}
+	return ts, dims, vals, nil
 }
 
-func (t *table) doInsert(ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap, offset wal.Offset) bool {
+// doInsert inserts a point with the given dims and vals. If the dims are
+// interned, interned reuses the key built for them.
+func (t *table) doInsert(ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap, offset wal.Offset, batch *observeBatch, interned *internedDims) bool {
 	where := t.getWhere()
 
 	if where != nil {
@@ -139,47 +276,68 @@ func (t *table) doInsert(ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMa
 			if t.log.IsTraceEnabled() {
 				t.log.Tracef("Filtering out inbound point at %v due to %v: %v", ts, where, dims.AsMap())
 			}
-			t.statsMutex.Lock()
-			t.stats.FilteredPoints++
-			t.statsMutex.Unlock()
+			t.counters.filteredPoints.add(uint64(ts.UnixNano()), 1)
 			return false
 		}
 	}
-	t.db.clock.Advance(ts)
-
-	if t.log.IsTraceEnabled() {
-		t.log.Tracef("Including inbound point at %v: %v", ts, dims.AsMap())
-	}
 
 	var key bytemap.ByteMap
-	if len(t.GroupBy) == 0 {
-		key = dims
+	var pooledKey bool
+	if interned != nil {
+		key = interned.keyFor(t)
 	} else {
-		// Reslice dimensions
-		names := make([]string, 0, len(t.GroupBy))
-		values := make([]interface{}, 0, len(t.GroupBy))
-		for _, groupBy := range t.GroupBy {
-			val := groupBy.Expr.Eval(dims)
-			if val != nil {
-				names = append(names, groupBy.Name)
-				values = append(values, val)
-			}
+		key, pooledKey = t.keyFor(dims)
+	}
+	if t.tenant != nil && !t.tenant.admitPoint(t.Name, key) {
+		if pooledKey {
+			encoding.ReleaseKey(key)
+		}
+		if t.log.IsTraceEnabled() {
+			t.log.Tracef("Dropping inbound point at %v because tenant %v is over quota: %v", ts, t.tenant.name, dims.AsMap())
 		}
-		key = bytemap.FromSortedKeysAndValues(names, values)
+		t.counters.droppedPoints.add(uint64(ts.UnixNano()), 1)
+		return false
 	}
+	batch.add(ts)
 
+	if t.log.IsTraceEnabled() {
+		t.log.Tracef("Including inbound point at %v: %v", ts, dims.AsMap())
+	}
+	if t.lastSeen != nil {
+		t.lastSeen.update(key, encoding.RoundTimeUp(ts, t.Resolution), t.truncateBefore())
+	}
 	tsparams := encoding.NewTSParams(ts, vals)
 	t.db.capMemStoreSize()
-	t.rowStore.insert(&insert{key, tsparams, dims, offset})
-	t.statsMutex.Lock()
-	t.stats.InsertedPoints++
-	t.statsMutex.Unlock()
+	t.rowStore.insert(&insert{key: key, pooledKey: pooledKey, vals: tsparams, metadata: dims, offset: offset})
+	t.counters.insertedPoints.add(uint64(ts.UnixNano()), 1)
 
 	return true
 }
 
+// keyFor builds the key under which the given dimensions are stored. pooled
+// indicates that the key was built with an encoding.KeyBuilder and can be
+// released once it's no longer needed. Keys are always canonical, so the same
+// dimensions are stored under the same key regardless of how the inserted
+// ByteMap ordered them.
+func (t *table) keyFor(dims bytemap.ByteMap) (key bytemap.ByteMap, pooled bool) {
+	if len(t.GroupBy) == 0 {
+		return encoding.CanonicalKey(dims)
+	}
+	// Reslice dimensions
+	kb := encoding.AcquireKeyBuilder()
+	for _, groupBy := range t.GroupBy {
+		if reflect.TypeOf(groupBy.Expr) == paramType {
+			// Plain dimension, copy it without decoding
+			kb.AddFrom(groupBy.Name, dims, groupBy.Expr.String())
+		} else {
+			kb.Add(groupBy.Name, groupBy.Expr.Eval(dims))
+		}
+	}
+	key = kb.Build()
+	kb.Release()
+	return key, true
+}
+
 func (t *table) recordQueued() {
-	t.statsMutex.Lock()
-	t.stats.QueuedPoints++
-	t.statsMutex.Unlock()
+	t.counters.queuedPoints.add(0, 1)
 }
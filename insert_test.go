@@ -0,0 +1,53 @@
+package zenodb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamOffset(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir: tmpDir,
+		Schema: Schema{
+			"thetable": &TableOpts{
+				RetentionPeriod: time.Hour,
+				SQL:             "SELECT SUM(a) AS a FROM inbound GROUP BY u, period(1m)",
+			},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	now := time.Now()
+	if !assert.NoError(t, db.Insert("inbound", now, map[string]interface{}{"u": "bob"}, map[string]float64{"a": 1})) {
+		return
+	}
+	first, err := db.StreamOffset("inbound")
+	if !assert.NoError(t, err) || !assert.NotNil(t, first) {
+		return
+	}
+
+	if !assert.NoError(t, db.Insert("inbound", now, map[string]interface{}{"u": "alice"}, map[string]float64{"a": 2})) {
+		return
+	}
+	second, err := db.StreamOffset("INBOUND")
+	if assert.NoError(t, err) {
+		assert.True(t, second.After(first), "Offset should advance with each insert")
+	}
+
+	_, err = db.StreamOffset("unknown")
+	assert.Equal(t, common.ErrUnknownStream, common.KindOf(err))
+}
@@ -0,0 +1,63 @@
+package zenodb
+
+import (
+	"github.com/getlantern/bytemap"
+)
+
+// maxInternedDims limits how many distinct dims a table interns. Once it's
+// reached, the table forgets what it interned and starts over, which bounds
+// the memory used for tables with high cardinality.
+const maxInternedDims = 100000
+
+// insertInterner reuses memory across the inserts of a table. It remembers
+// the dims of recent points along with the keys built from them, so that
+// ingesting a stable set of keys neither copies dims nor builds keys for every
+// point. It's only used by the goroutine that processes the table's inserts
+// and isn't safe for concurrent use.
+type insertInterner struct {
+	byDims     map[string]*internedDims
+	valsBuffer bytemap.ByteMap
+}
+
+// internedDims are dims shared by all points that have them, along with the
+// key under which those points are stored.
+type internedDims struct {
+	dims bytemap.ByteMap
+	key  bytemap.ByteMap
+}
+
+func newInsertInterner() *insertInterner {
+	return &insertInterner{byDims: make(map[string]*internedDims)}
+}
+
+// dims returns the interned copy of the given dims, copying them if they
+// aren't interned yet.
+func (ii *insertInterner) dims(dims []byte) *internedDims {
+	// Looking up by a converted []byte doesn't allocate
+	if interned, found := ii.byDims[string(dims)]; found {
+		return interned
+	}
+	if len(ii.byDims) >= maxInternedDims {
+		ii.byDims = make(map[string]*internedDims)
+	}
+	interned := &internedDims{dims: make(bytemap.ByteMap, len(dims))}
+	copy(interned.dims, dims)
+	ii.byDims[string(interned.dims)] = interned
+	return interned
+}
+
+// vals copies the given vals into a buffer that's reused by the next call.
+func (ii *insertInterner) vals(vals []byte) bytemap.ByteMap {
+	ii.valsBuffer = append(ii.valsBuffer[:0], vals...)
+	return ii.valsBuffer
+}
+
+// keyFor returns the key for the interned dims in the given table, building it
+// the first time that it's needed. The key is shared, so it must never be
+// released to the key pool.
+func (id *internedDims) keyFor(t *table) bytemap.ByteMap {
+	if id.key == nil {
+		id.key, _ = t.keyFor(id.dims)
+	}
+	return id.key
+}
@@ -0,0 +1,35 @@
+package zenodb
+
+import (
+	"testing"
+
+	"github.com/getlantern/bytemap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInsertInterner(t *testing.T) {
+	ii := newInsertInterner()
+
+	// Simulate a WAL read buffer that's reused between reads
+	buf := []byte(bytemap.New(map[string]interface{}{"u": "bob"}))
+	bob := ii.dims(buf)
+	assert.Equal(t, "bob", bob.dims.Get("u"))
+	copy(buf, bytemap.New(map[string]interface{}{"u": "amy"}))
+	assert.Equal(t, "bob", bob.dims.Get("u"), "Interned dims shouldn't reference the buffer")
+
+	amy := ii.dims(buf)
+	assert.Equal(t, "amy", amy.dims.Get("u"))
+	assert.True(t, bob == ii.dims(bytemap.New(map[string]interface{}{"u": "bob"})), "Same dims should be interned once")
+	assert.Len(t, ii.byDims, 2)
+
+	vals := ii.vals(bytemap.NewFloat(map[string]float64{"a": 1}))
+	assert.EqualValues(t, 1, vals.Get("a"))
+	vals = ii.vals(bytemap.NewFloat(map[string]float64{"a": 2}))
+	assert.EqualValues(t, 2, vals.Get("a"))
+
+	allocs := testing.AllocsPerRun(100, func() {
+		ii.dims(buf)
+		ii.vals(buf)
+	})
+	assert.EqualValues(t, 0, allocs, "Interning known dims shouldn't allocate")
+}
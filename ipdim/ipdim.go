@@ -0,0 +1,138 @@
+// Package ipdim provides dimensional expressions for dimensions that hold IP
+// addresses.
+package ipdim
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/getlantern/goexpr"
+)
+
+// IN_CIDR checks whether the IP address in the first expression falls within
+// any of the CIDR blocks given by the remaining expressions, like
+// IN_CIDR(ip, '10.0.0.0/8', 'fd00::/8'). Values that aren't valid IP
+// addresses don't match.
+func IN_CIDR(exprs ...goexpr.Expr) goexpr.Expr {
+	if len(exprs) == 0 {
+		return &inCIDR{}
+	}
+	return &inCIDR{exprs[0], exprs[1:]}
+}
+
+type inCIDR struct {
+	IP    goexpr.Expr
+	CIDRs []goexpr.Expr
+}
+
+func (e *inCIDR) Eval(params goexpr.Params) interface{} {
+	if e.IP == nil {
+		return false
+	}
+	ip := toIP(e.IP.Eval(params))
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range e.CIDRs {
+		s, ok := cidr.Eval(params).(string)
+		if !ok {
+			continue
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *inCIDR) WalkParams(cb func(string)) {
+	for _, ex := range e.exprs() {
+		ex.WalkParams(cb)
+	}
+}
+
+func (e *inCIDR) WalkOneToOneParams(cb func(string)) {
+	// a boolean doesn't preserve its inputs
+}
+
+func (e *inCIDR) WalkLists(cb func(goexpr.List)) {
+	for _, ex := range e.exprs() {
+		ex.WalkLists(cb)
+	}
+}
+
+func (e *inCIDR) exprs() []goexpr.Expr {
+	if e.IP == nil {
+		return nil
+	}
+	return append([]goexpr.Expr{e.IP}, e.CIDRs...)
+}
+
+func (e *inCIDR) String() string {
+	strs := make([]string, 0, len(e.CIDRs)+1)
+	for _, ex := range e.exprs() {
+		strs = append(strs, ex.String())
+	}
+	return fmt.Sprintf("IN_CIDR(%v)", strings.Join(strs, ", "))
+}
+
+// IP_PREFIX returns the network that the IP address in the given expression
+// belongs to in CIDR notation, keeping v4Bits of IPv4 addresses and v6Bits of
+// IPv6 addresses, like IP_PREFIX(ip, 24, 64). Grouping by it aggregates data
+// by network. Values that aren't valid IP addresses evaluate to nil.
+func IP_PREFIX(ip goexpr.Expr, v4Bits goexpr.Expr, v6Bits goexpr.Expr) goexpr.Expr {
+	return &ipPrefix{ip, v4Bits, v6Bits}
+}
+
+type ipPrefix struct {
+	IP     goexpr.Expr
+	V4Bits goexpr.Expr
+	V6Bits goexpr.Expr
+}
+
+func (e *ipPrefix) Eval(params goexpr.Params) interface{} {
+	ip := toIP(e.IP.Eval(params))
+	if ip == nil {
+		return nil
+	}
+	bits, size := e.V6Bits, 8*net.IPv6len
+	if v4 := ip.To4(); v4 != nil {
+		ip, bits, size = v4, e.V4Bits, 8*net.IPv4len
+	}
+	ones, ok := bits.Eval(params).(int)
+	if !ok || ones < 0 || ones > size {
+		return nil
+	}
+	mask := net.CIDRMask(ones, size)
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
+
+func (e *ipPrefix) WalkParams(cb func(string)) {
+	e.IP.WalkParams(cb)
+	e.V4Bits.WalkParams(cb)
+	e.V6Bits.WalkParams(cb)
+}
+
+func (e *ipPrefix) WalkOneToOneParams(cb func(string)) {
+	// masking loses information, so this isn't one-to-one
+}
+
+func (e *ipPrefix) WalkLists(cb func(goexpr.List)) {
+	e.IP.WalkLists(cb)
+	e.V4Bits.WalkLists(cb)
+	e.V6Bits.WalkLists(cb)
+}
+
+func (e *ipPrefix) String() string {
+	return fmt.Sprintf("IP_PREFIX(%v, %v, %v)", e.IP, e.V4Bits, e.V6Bits)
+}
+
+func toIP(val interface{}) net.IP {
+	s, ok := val.(string)
+	if !ok {
+		return nil
+	}
+	return net.ParseIP(s)
+}
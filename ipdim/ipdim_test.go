@@ -0,0 +1,33 @@
+package ipdim
+
+import (
+	"testing"
+
+	"github.com/getlantern/goexpr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInCIDR(t *testing.T) {
+	inCIDR := func(ip interface{}) interface{} {
+		return IN_CIDR(goexpr.Param("ip"), goexpr.Constant("10.0.0.0/8"), goexpr.Constant("fd00::/8")).Eval(goexpr.MapParams{"ip": ip})
+	}
+	assert.Equal(t, true, inCIDR("10.1.2.3"))
+	assert.Equal(t, false, inCIDR("11.1.2.3"))
+	assert.Equal(t, true, inCIDR("fd12::1"))
+	assert.Equal(t, false, inCIDR("2001:db8::1"))
+	assert.Equal(t, false, inCIDR("not an ip"))
+	assert.Equal(t, false, inCIDR(nil))
+	assert.Equal(t, false, IN_CIDR().Eval(goexpr.MapParams{}))
+	assert.Equal(t, "IN_CIDR(ip, 10.0.0.0/8)", IN_CIDR(goexpr.Param("ip"), goexpr.Constant("10.0.0.0/8")).String())
+}
+
+func TestIPPrefix(t *testing.T) {
+	prefix := func(ip interface{}) interface{} {
+		return IP_PREFIX(goexpr.Param("ip"), goexpr.Constant(24), goexpr.Constant(64)).Eval(goexpr.MapParams{"ip": ip})
+	}
+	assert.Equal(t, "10.1.2.0/24", prefix("10.1.2.3"))
+	assert.Equal(t, "2001:db8:1:2::/64", prefix("2001:db8:1:2:3:4:5:6"))
+	assert.Equal(t, "10.1.2.0/24", prefix("::ffff:10.1.2.3"), "IPv4 mapped addresses count as IPv4")
+	assert.Nil(t, prefix("not an ip"))
+	assert.Nil(t, IP_PREFIX(goexpr.Param("ip"), goexpr.Constant(33), goexpr.Constant(64)).Eval(goexpr.MapParams{"ip": "10.1.2.3"}))
+}
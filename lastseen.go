@@ -0,0 +1,194 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/sql"
+)
+
+// lastSeenPruneInterval is how far the retention window has to move before
+// the lastSeenIndex forgets keys that have aged out of the table
+const lastSeenPruneInterval = time.Minute
+
+// KeyLastSeen reports the most recent period for which a key received data.
+type KeyLastSeen struct {
+	Key      bytemap.ByteMap
+	LastSeen time.Time
+}
+
+// lastSeenIndex tracks the most recent period for which each key of a table
+// received data, so that liveness queries don't have to read the table's
+// sequences. It's only kept for tables with TrackLastSeen. Keys that were only
+// flushed to disk before the table was opened aren't known until the index is
+// loaded from the row store, which happens the first time it's queried.
+type lastSeenIndex struct {
+	byKey        map[string]int64
+	loaded       bool
+	prunedBefore time.Time
+	mx           sync.RWMutex
+}
+
+func newLastSeenIndex() *lastSeenIndex {
+	return &lastSeenIndex{byKey: make(map[string]int64)}
+}
+
+// update records that key received data for the period stamped ts.
+func (idx *lastSeenIndex) update(key bytemap.ByteMap, ts time.Time, truncateBefore time.Time) {
+	tsInt := ts.UnixNano()
+	idx.mx.Lock()
+	if truncateBefore.Sub(idx.prunedBefore) > lastSeenPruneInterval {
+		idx.prune(truncateBefore)
+	}
+	if existing, found := idx.byKey[string(key)]; !found || tsInt > existing {
+		idx.byKey[string(key)] = tsInt
+	}
+	idx.mx.Unlock()
+}
+
+// prune forgets keys that were last seen before the given time. It must be
+// called with mx held.
+func (idx *lastSeenIndex) prune(before time.Time) {
+	beforeInt := before.UnixNano()
+	for key, ts := range idx.byKey {
+		if ts < beforeInt {
+			delete(idx.byKey, key)
+		}
+	}
+	idx.prunedBefore = before
+}
+
+// reset forgets all keys, so that they're loaded from the row store again when
+// next needed.
+func (idx *lastSeenIndex) reset() {
+	idx.mx.Lock()
+	idx.byKey = make(map[string]int64)
+	idx.loaded = false
+	idx.mx.Unlock()
+}
+
+// load adds the keys stored by the given table to the index, unless that's
+// already been done.
+func (idx *lastSeenIndex) load(t *table) error {
+	idx.mx.RLock()
+	loaded := idx.loaded
+	idx.mx.RUnlock()
+	if loaded {
+		return nil
+	}
+
+	stored := make(map[string]int64)
+	err := t.iterate(context.Background(), t.getFields(), true, nil, nil, func(key bytemap.ByteMap, columns []encoding.Sequence) (bool, error) {
+		var until int64
+		for _, seq := range columns {
+			if len(seq) > 0 && seq.UntilInt() > until {
+				until = seq.UntilInt()
+			}
+		}
+		if until > 0 {
+			stored[string(key)] = until
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	idx.mx.Lock()
+	defer idx.mx.Unlock()
+	for key, ts := range stored {
+		if existing, found := idx.byKey[key]; !found || ts > existing {
+			idx.byKey[key] = ts
+		}
+	}
+	idx.loaded = true
+	return nil
+}
+
+// seenBefore lists the keys that were last seen before the given time, oldest
+// first.
+func (idx *lastSeenIndex) seenBefore(before time.Time, truncateBefore time.Time) []*KeyLastSeen {
+	beforeInt := before.UnixNano()
+	truncateBeforeInt := truncateBefore.UnixNano()
+	idx.mx.RLock()
+	var result []*KeyLastSeen
+	for key, ts := range idx.byKey {
+		if ts < beforeInt && ts >= truncateBeforeInt {
+			result = append(result, &KeyLastSeen{Key: bytemap.ByteMap(key), LastSeen: encoding.TimeFromInt(ts)})
+		}
+	}
+	idx.mx.RUnlock()
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].LastSeen.Before(result[j].LastSeen)
+	})
+	return result
+}
+
+// ShowLastSeen runs a SHOW LAST SEEN statement, like
+//
+//	SHOW LAST SEEN FOR thetable OLDER THAN 10m
+//
+// see LastSeen.
+func (db *DB) ShowLastSeen(sqlString string) ([]*KeyLastSeen, error) {
+	s, err := sql.ParseShowLastSeen(sqlString)
+	if err != nil {
+		return nil, err
+	}
+	return db.LastSeen(s.Table, s.OlderThan)
+}
+
+// LastSeen lists the keys of the given table that haven't received data within
+// the last olderThan, along with the most recent period for which they did,
+// oldest first. With an olderThan of 0, it lists all keys. Only keys that are
+// still within the table's retention period are included. The table must have
+// TrackLastSeen set. This doesn't read the table's data, except for the first
+// time it's called after the table is opened.
+func (db *DB) LastSeen(table string, olderThan time.Duration) ([]*KeyLastSeen, error) {
+	t := db.getTable(table)
+	if t == nil {
+		return nil, common.Errorf(common.ErrUnknownTable, "Table %v not found", table)
+	}
+	if t.rowStore == nil {
+		return nil, fmt.Errorf("Table %v does not store data on this node", table)
+	}
+	if t.lastSeen == nil {
+		return nil, fmt.Errorf("Table %v doesn't track when keys were last seen, set tracklastseen in its schema", table)
+	}
+	err := t.lastSeen.load(t)
+	if err != nil {
+		return nil, err
+	}
+	// Periods are stamped like sequences, rounded up to the resolution
+	before := encoding.RoundTimeUp(db.clock.Now().Add(-1*olderThan), t.Resolution)
+	if olderThan <= 0 {
+		before = time.Unix(0, math.MaxInt64)
+	}
+	result := t.lastSeen.seenBefore(before, t.truncateBefore())
+
+	// Leave out keys whose data has been deleted since they were last seen
+	tombstones, _ := t.tombstones()
+	if len(tombstones) == 0 {
+		return result, nil
+	}
+	remaining := result[:0]
+	for _, kls := range result {
+		deleted := false
+		for _, ts := range tombstones {
+			if !ts.deletedAt.Before(kls.LastSeen) && ts.matches(kls.Key) {
+				deleted = true
+				break
+			}
+		}
+		if !deleted {
+			remaining = append(remaining, kls)
+		}
+	}
+	return remaining, nil
+}
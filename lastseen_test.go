@@ -0,0 +1,86 @@
+package zenodb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLastSeen(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 0, 0, time.UTC)
+	clock := NewVirtualClock(epoch)
+	clock.Freeze()
+	db, err := NewDB(&DBOpts{
+		Dir:   tmpDir,
+		Clock: clock,
+		Schema: Schema{
+			"thetable": &TableOpts{
+				RetentionPeriod: time.Hour,
+				SQL:             "SELECT SUM(a) AS a FROM inbound GROUP BY h, period(1m)",
+				TrackLastSeen:   true,
+			},
+			"untracked": &TableOpts{
+				RetentionPeriod: time.Hour,
+				SQL:             "SELECT SUM(a) AS a FROM inbound GROUP BY h, period(1m)",
+			},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	db.Insert("inbound", epoch.Add(-30*time.Minute), map[string]interface{}{"h": "a"}, map[string]float64{"a": 1})
+	db.Insert("inbound", epoch.Add(-20*time.Minute), map[string]interface{}{"h": "a"}, map[string]float64{"a": 1})
+	db.Insert("inbound", epoch.Add(-5*time.Minute), map[string]interface{}{"h": "b"}, map[string]float64{"a": 1})
+	db.Insert("inbound", epoch, map[string]interface{}{"h": "c"}, map[string]float64{"a": 1})
+	db.Insert("inbound", epoch.Add(-2*time.Hour), map[string]interface{}{"h": "d"}, map[string]float64{"a": 1})
+	waitFor(func() bool { return db.TableStats("thetable").InsertedPoints == 4 })
+
+	hosts := func(keys []*KeyLastSeen) []interface{} {
+		var result []interface{}
+		for _, key := range keys {
+			result = append(result, key.Key.Get("h"))
+		}
+		return result
+	}
+
+	keys, err := db.ShowLastSeen("SHOW LAST SEEN FOR thetable OLDER THAN 10m")
+	if assert.NoError(t, err) && assert.Equal(t, []interface{}{"a"}, hosts(keys)) {
+		assert.Equal(t, epoch.Add(-20*time.Minute), keys[0].LastSeen.In(time.UTC))
+	}
+
+	keys, err = db.LastSeen("thetable", 0)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []interface{}{"a", "b", "c"}, hosts(keys), "All keys within retention period should be included, oldest first")
+	}
+
+	// The index should also be loadable from the row store
+	idx := newLastSeenIndex()
+	if assert.NoError(t, idx.load(db.getTable("thetable"))) {
+		assert.Len(t, idx.byKey, 3)
+	}
+
+	assert.NoError(t, db.Delete("DELETE FROM thetable WHERE h = 'a'"))
+	keys, err = db.LastSeen("thetable", 0)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []interface{}{"b", "c"}, hosts(keys), "Deleted keys should be left out")
+	}
+
+	_, err = db.LastSeen("unknown", 0)
+	assert.Equal(t, ErrUnknownTable, common.KindOf(err))
+
+	_, err = db.LastSeen("untracked", 0)
+	assert.Error(t, err, "Table without TrackLastSeen shouldn't support LastSeen")
+	assert.Nil(t, db.getTable("untracked").lastSeen)
+}
@@ -0,0 +1,144 @@
+// Package logging provides golog Loggers whose trace logging can be toggled at
+// runtime for each subsystem, in addition to the usual TRACE environment
+// variable.
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/getlantern/golog"
+)
+
+var (
+	loggers   = make(map[string][]*logger)
+	traceOn   = make(map[string]bool)
+	loggersMx sync.Mutex
+)
+
+// LoggerFor returns a golog.Logger for the given subsystem whose trace logging
+// can be enabled with SetTrace.
+func LoggerFor(subsystem string) golog.Logger {
+	l := &logger{Logger: golog.LoggerFor(subsystem), subsystem: subsystem}
+	loggersMx.Lock()
+	loggers[subsystem] = append(loggers[subsystem], l)
+	if traceOn[subsystem] {
+		l.traceOn = 1
+	}
+	loggersMx.Unlock()
+	return l
+}
+
+// SetTrace enables or disables trace logging for the given subsystem. The
+// setting also applies to Loggers for the subsystem that are created later.
+func SetTrace(subsystem string, on bool) {
+	value := int32(0)
+	if on {
+		value = 1
+	}
+	loggersMx.Lock()
+	traceOn[subsystem] = on
+	for _, l := range loggers[subsystem] {
+		atomic.StoreInt32(&l.traceOn, value)
+	}
+	loggersMx.Unlock()
+}
+
+// Subsystems returns all known subsystems and whether or not trace logging is
+// enabled for them.
+func Subsystems() map[string]bool {
+	result := make(map[string]bool)
+	loggersMx.Lock()
+	for subsystem, ls := range loggers {
+		result[subsystem] = ls[0].IsTraceEnabled()
+	}
+	loggersMx.Unlock()
+	return result
+}
+
+// ServeTrace is an http.HandlerFunc that lists subsystems along with whether
+// trace logging is enabled for them. POSTing the form values subsystem and
+// enabled (true or false) toggles trace logging for a subsystem.
+func ServeTrace(resp http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPost {
+		subsystem := req.FormValue("subsystem")
+		if subsystem == "" {
+			http.Error(resp, "Please specify a subsystem", http.StatusBadRequest)
+			return
+		}
+		on, err := strconv.ParseBool(req.FormValue("enabled"))
+		if err != nil {
+			http.Error(resp, fmt.Sprintf("Invalid value for enabled: %v", err), http.StatusBadRequest)
+			return
+		}
+		SetTrace(subsystem, on)
+	}
+
+	subsystems := Subsystems()
+	names := make([]string, 0, len(subsystems))
+	for name := range subsystems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	resp.Header().Set("Content-Type", "text/plain")
+	for _, name := range names {
+		fmt.Fprintf(resp, "%v %v\n", name, subsystems[name])
+	}
+}
+
+type logger struct {
+	golog.Logger
+	subsystem string
+	traceOn   int32
+}
+
+func (l *logger) runtimeTraceOn() bool {
+	return atomic.LoadInt32(&l.traceOn) == 1
+}
+
+func (l *logger) IsTraceEnabled() bool {
+	return l.Logger.IsTraceEnabled() || l.runtimeTraceOn()
+}
+
+func (l *logger) Trace(arg interface{}) {
+	if l.Logger.IsTraceEnabled() {
+		l.Logger.Trace(arg)
+	} else if l.runtimeTraceOn() {
+		l.Logger.Debugf("TRACE %v", arg)
+	}
+}
+
+func (l *logger) Tracef(message string, args ...interface{}) {
+	if l.Logger.IsTraceEnabled() {
+		l.Logger.Tracef(message, args...)
+	} else if l.runtimeTraceOn() {
+		l.Logger.Debugf("TRACE "+message, args...)
+	}
+}
+
+func (l *logger) TraceOut() io.Writer {
+	if l.Logger.IsTraceEnabled() {
+		return l.Logger.TraceOut()
+	}
+	if l.runtimeTraceOn() {
+		return &traceWriter{l}
+	}
+	return ioutil.Discard
+}
+
+// traceWriter logs each write as a trace line.
+type traceWriter struct {
+	l *logger
+}
+
+func (w *traceWriter) Write(p []byte) (int, error) {
+	w.l.Trace(string(bytes.TrimRight(p, "\n")))
+	return len(p), nil
+}
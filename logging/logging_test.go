@@ -0,0 +1,45 @@
+package logging
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetTrace(t *testing.T) {
+	a := LoggerFor("logging_test.a")
+	b := LoggerFor("logging_test.b")
+	assert.False(t, a.IsTraceEnabled())
+	assert.False(t, b.IsTraceEnabled())
+
+	SetTrace("logging_test.a", true)
+	assert.True(t, a.IsTraceEnabled())
+	assert.False(t, b.IsTraceEnabled())
+	assert.True(t, LoggerFor("logging_test.a").IsTraceEnabled(), "New loggers should pick up existing setting")
+	assert.True(t, Subsystems()["logging_test.a"])
+
+	SetTrace("logging_test.a", false)
+	assert.False(t, a.IsTraceEnabled())
+	assert.False(t, Subsystems()["logging_test.a"])
+}
+
+func TestServeTrace(t *testing.T) {
+	l := LoggerFor("logging_test.c")
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(url.Values{"subsystem": {"logging_test.c"}, "enabled": {"true"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	ServeTrace(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "logging_test.c true\n")
+	assert.True(t, l.IsTraceEnabled())
+
+	rec = httptest.NewRecorder()
+	ServeTrace(rec, httptest.NewRequest(http.MethodPost, "/?subsystem=logging_test.c&enabled=maybe", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	SetTrace("logging_test.c", false)
+}
@@ -0,0 +1,213 @@
+package zenodb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/getlantern/zenodb/encoding"
+)
+
+// ServeMetrics is an http.HandlerFunc that exposes the database's internal
+// statistics in the Prometheus text format.
+func (db *DB) ServeMetrics(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	err := db.WriteMetrics(resp)
+	if err != nil {
+		log.Errorf("Unable to write metrics: %v", err)
+	}
+}
+
+// WriteMetrics writes the database's internal statistics to the given Writer
+// in the Prometheus text format.
+func (db *DB) WriteMetrics(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	mw := &metricsWriter{w: bw}
+
+	mw.metric("zenodb_memory_bytes", "gauge", "Bytes of heap allocated by the process", atomic.LoadUint64(&db.memory))
+	mw.metric("zenodb_rss_bytes", "gauge", "Resident set size of the process", atomic.LoadUint64(&db.rss))
+
+	db.tablesMutex.RLock()
+	tables := make([]*table, 0, len(db.orderedTables))
+	for _, t := range db.orderedTables {
+		if !t.Virtual {
+			tables = append(tables, t)
+		}
+	}
+	db.tablesMutex.RUnlock()
+
+	stats := make([]TableStats, 0, len(tables))
+	for _, t := range tables {
+		stats = append(stats, t.counters.stats())
+	}
+	perTable := func(name string, typ string, help string, value func(i int, t *table) interface{}) {
+		mw.header(name, typ, help)
+		for i, t := range tables {
+			mw.sample(name, value(i, t), "table", t.Name)
+		}
+	}
+	perTable("zenodb_table_filtered_points_total", "counter", "Points excluded by the table's WHERE clause", func(i int, t *table) interface{} { return stats[i].FilteredPoints })
+	perTable("zenodb_table_queued_points_total", "counter", "Points queued for insertion into the table", func(i int, t *table) interface{} { return stats[i].QueuedPoints })
+	perTable("zenodb_table_inserted_points_total", "counter", "Points inserted into the table", func(i int, t *table) interface{} { return stats[i].InsertedPoints })
+	perTable("zenodb_table_dropped_points_total", "counter", "Points dropped by the table", func(i int, t *table) interface{} { return stats[i].DroppedPoints })
+	perTable("zenodb_table_expired_values_total", "counter", "Values expired from the table", func(i int, t *table) interface{} { return stats[i].ExpiredValues })
+	perTable("zenodb_table_budget_evictions_total", "counter", "Evictions of data within the retention period to stay within the table's MaxDiskBytes", func(i int, t *table) interface{} { return stats[i].BudgetEvictions })
+	perTable("zenodb_table_queries_total", "counter", "Queries of the table", func(i int, t *table) interface{} { return stats[i].Queries })
+	perTable("zenodb_table_query_keys_scanned_total", "counter", "Keys read from the table by queries", func(i int, t *table) interface{} { return stats[i].QueryKeysScanned })
+	perTable("zenodb_table_query_sequences_decoded_total", "counter", "Sequences read from the table by queries", func(i int, t *table) interface{} { return stats[i].QuerySequencesDecoded })
+	perTable("zenodb_table_query_periods_read_total", "counter", "Periods read from the table by queries", func(i int, t *table) interface{} { return stats[i].QueryPeriodsRead })
+	perTable("zenodb_table_query_bytes_read_total", "counter", "Encoded bytes of keys and sequences read from the table by queries", func(i int, t *table) interface{} { return stats[i].QueryBytesRead })
+	perTable("zenodb_table_flushes_total", "counter", "Flushes of the table's memstore to disk", func(i int, t *table) interface{} { return stats[i].Flushes })
+	perTable("zenodb_table_flush_seconds_total", "counter", "Time spent flushing the table's memstore to disk", func(i int, t *table) interface{} { return stats[i].FlushTime.Seconds() })
+	if db.storesData() {
+		perTable("zenodb_table_memstore_bytes", "gauge", "Size of the table's memstore", func(i int, t *table) interface{} { return t.memStoreSize() })
+		mw.header("zenodb_table_high_water_mark_seconds", "gauge", "Timestamp of the newest data in the table")
+		for _, t := range tables {
+			disk, memory := t.highWaterMarks()
+			mw.sample("zenodb_table_high_water_mark_seconds", encoding.TimeFromInt(disk).Unix(), "table", t.Name, "store", "disk")
+			mw.sample("zenodb_table_high_water_mark_seconds", encoding.TimeFromInt(memory).Unix(), "table", t.Name, "store", "memory")
+		}
+	}
+
+	if len(db.tenants) > 0 {
+		names := make([]string, 0, len(db.tenants))
+		for name := range db.tenants {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		tenantStats := make([]TenantStats, 0, len(names))
+		for _, name := range names {
+			tenantStats = append(tenantStats, db.TenantStats(name))
+		}
+		perTenant := func(name string, typ string, help string, value func(stats TenantStats) interface{}) {
+			mw.header(name, typ, help)
+			for i, tenant := range names {
+				mw.sample(name, value(tenantStats[i]), "tenant", tenant)
+			}
+		}
+		perTenant("zenodb_tenant_keys", "gauge", "Keys stored in the tenant's tables", func(stats TenantStats) interface{} { return stats.Keys })
+		perTenant("zenodb_tenant_storage_bytes", "gauge", "Bytes stored on disk for the tenant's tables", func(stats TenantStats) interface{} { return stats.StorageBytes })
+		perTenant("zenodb_tenant_active_queries", "gauge", "Queries currently running against the tenant's tables", func(stats TenantStats) interface{} { return stats.ActiveQueries })
+		perTenant("zenodb_tenant_rejected_inserts_total", "counter", "Inserts rejected for exceeding the tenant's ingest rate", func(stats TenantStats) interface{} { return stats.RejectedInserts })
+		perTenant("zenodb_tenant_rejected_queries_total", "counter", "Queries rejected for exceeding the tenant's concurrency limit", func(stats TenantStats) interface{} { return stats.RejectedQueries })
+		perTenant("zenodb_tenant_dropped_points_total", "counter", "Points dropped for exceeding the tenant's key or storage limits", func(stats TenantStats) interface{} { return stats.DroppedPoints })
+	}
+
+	if db.opts.Follow != nil {
+		db.followLagsMx.RLock()
+		streams := make([]string, 0, len(db.followLags))
+		for stream := range db.followLags {
+			streams = append(streams, stream)
+		}
+		sort.Strings(streams)
+		mw.header("zenodb_follow_lag_seconds", "gauge", "How long after its timestamp the most recent point arrived from the leader")
+		for _, stream := range streams {
+			mw.sample("zenodb_follow_lag_seconds", db.followLags[stream].Seconds(), "stream", stream)
+		}
+		db.followLagsMx.RUnlock()
+	}
+
+	if db.replicator != nil {
+		replication := db.ReplicationStatuses()
+		perStream := func(name string, typ string, help string, value func(status *ReplicationStatus) interface{}) {
+			mw.header(name, typ, help)
+			for _, status := range replication {
+				mw.sample(name, value(status), "stream", status.Stream)
+			}
+		}
+		perStream("zenodb_replication_lag_seconds", "gauge", "How long after its timestamp the most recent point was replicated", func(status *ReplicationStatus) interface{} { return status.Lag.Seconds() })
+		perStream("zenodb_replicated_points_total", "counter", "Points replicated to the other cluster", func(status *ReplicationStatus) interface{} { return status.Replicated })
+		perStream("zenodb_replication_failures_total", "counter", "Failed attempts to replicate a batch of points", func(status *ReplicationStatus) interface{} { return status.Failures })
+	}
+
+	if db.opts.Passthrough {
+		status := db.ClusterStatus()
+		mw.metric("zenodb_cluster_resyncs_required_total", "counter", "Followers rejected because they needed data that's no longer in the WAL", status.ResyncsRequired)
+		perFollower := func(name string, typ string, help string, value func(f int) interface{}) {
+			mw.header(name, typ, help)
+			for i, f := range status.Followers {
+				mw.sample(name, value(i), "partition", strconv.Itoa(f.Partition), "follower", strconv.Itoa(f.ID), "stream", f.Stream)
+			}
+		}
+		perFollower("zenodb_follower_lag_seconds", "gauge", "How far the follower is behind the latest data in the WAL", func(i int) interface{} { return status.Followers[i].Lag.Seconds() })
+		perFollower("zenodb_follower_queued", "gauge", "WAL entries queued for sending to the follower", func(i int) interface{} { return status.Followers[i].Queued })
+
+		db.clusterStatusMx.RLock()
+		partitions := make([]int, 0, len(db.queryLatencies))
+		for partition := range db.queryLatencies {
+			partitions = append(partitions, partition)
+		}
+		sort.Ints(partitions)
+		mw.header("zenodb_partition_query_latency_seconds", "gauge", "How long the partition took to answer the most recent query")
+		for _, partition := range partitions {
+			mw.sample("zenodb_partition_query_latency_seconds", db.queryLatencies[partition].Seconds(), "partition", strconv.Itoa(partition))
+		}
+		db.clusterStatusMx.RUnlock()
+	}
+
+	if mw.err != nil {
+		return mw.err
+	}
+	db.extraMetricsMx.Lock()
+	extraMetrics := db.extraMetrics
+	db.extraMetricsMx.Unlock()
+	for _, write := range extraMetrics {
+		err := write(bw)
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// AddMetrics adds the metrics written by write to the ones exposed by
+// WriteMetrics, for example those of the RPC server.
+func (db *DB) AddMetrics(write func(w io.Writer) error) {
+	db.extraMetricsMx.Lock()
+	db.extraMetrics = append(db.extraMetrics, write)
+	db.extraMetricsMx.Unlock()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsWriter writes metrics in the Prometheus text format, remembering the
+// first error encountered.
+type metricsWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (mw *metricsWriter) metric(name string, typ string, help string, value interface{}) {
+	mw.header(name, typ, help)
+	mw.sample(name, value)
+}
+
+func (mw *metricsWriter) header(name string, typ string, help string) {
+	mw.printf("# HELP %v %v\n# TYPE %v %v\n", name, help, name, typ)
+}
+
+// sample writes a single sample with the given labels, which are specified as
+// alternating names and values.
+func (mw *metricsWriter) sample(name string, value interface{}, labels ...string) {
+	if len(labels) == 0 {
+		mw.printf("%v %v\n", name, value)
+		return
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i < len(labels)-1; i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%v=\"%v\"", labels[i], labelEscaper.Replace(labels[i+1])))
+	}
+	mw.printf("%v{%v} %v\n", name, strings.Join(pairs, ","), value)
+}
+
+func (mw *metricsWriter) printf(format string, args ...interface{}) {
+	if mw.err != nil {
+		return
+	}
+	_, mw.err = fmt.Fprintf(mw.w, format, args...)
+}
@@ -0,0 +1,42 @@
+package zenodb
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	tbl := &table{
+		TableOpts: &TableOpts{Name: "thetable"},
+		rowStore:  &rowStore{},
+	}
+	tbl.counters.insertedPoints.add(1, 2)
+	tbl.counters.insertedPoints.add(2, 3)
+	tbl.recordFlush(500 * time.Millisecond)
+	tbl.recordFlush(1000 * time.Millisecond)
+	virtual := &table{TableOpts: &TableOpts{Name: "virtual", Virtual: true}}
+	db := &DB{
+		opts:          &DBOpts{},
+		orderedTables: []*table{tbl, virtual},
+		tenants: newTenants(map[string]*TenantOpts{
+			"acme": &TenantOpts{MaxConcurrentQueries: 1},
+		}),
+	}
+	db.tenants["acme"].recordFlush("acme.requests", 7, 100, nil)
+
+	buf := &bytes.Buffer{}
+	if !assert.NoError(t, db.WriteMetrics(buf)) {
+		return
+	}
+	metrics := buf.String()
+	assert.Contains(t, metrics, "# TYPE zenodb_table_inserted_points_total counter\nzenodb_table_inserted_points_total{table=\"thetable\"} 5\n")
+	assert.Contains(t, metrics, "zenodb_table_flushes_total{table=\"thetable\"} 2\n")
+	assert.Contains(t, metrics, "zenodb_table_flush_seconds_total{table=\"thetable\"} 1.5\n")
+	assert.Contains(t, metrics, "zenodb_table_memstore_bytes{table=\"thetable\"} 0\n")
+	assert.Contains(t, metrics, "zenodb_tenant_keys{tenant=\"acme\"} 7\n")
+	assert.NotContains(t, metrics, "virtual", "Virtual tables shouldn't be reported")
+	assert.NotContains(t, metrics, "zenodb_follower_lag_seconds", "Only passthrough nodes have followers")
+}
@@ -0,0 +1,169 @@
+package zenodb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/getlantern/zenodb/encoding"
+)
+
+// MigrateFiles migrates the data files of all tables in the given database
+// directory to the current file format and encoding using MigrateFile. It
+// returns the number of files that were migrated. The database must not be
+// running while its files are migrated.
+func MigrateFiles(dir string) (int, error) {
+	tableDirs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to list tables in %v: %v", dir, err)
+	}
+	migrated := 0
+	for _, tableDir := range tableDirs {
+		if !tableDir.IsDir() {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(dir, tableDir.Name()))
+		if err != nil {
+			return migrated, fmt.Errorf("Unable to list files for table %v: %v", tableDir.Name(), err)
+		}
+		for _, file := range files {
+			if !strings.HasPrefix(file.Name(), "filestore_") {
+				continue
+			}
+			filename := filepath.Join(dir, tableDir.Name(), file.Name())
+			newFilename, err := MigrateFile(filename)
+			if err != nil {
+				return migrated, err
+			}
+			if newFilename != filename {
+				log.Debugf("Migrated %v to %v", filename, newFilename)
+				migrated++
+			}
+		}
+	}
+	return migrated, nil
+}
+
+// MigrateFile rewrites the given table data file using the current file format
+// and encoding, replacing the original. It returns the name of the new file,
+// which is the same as filename if the file was already current.
+func MigrateFile(filename string) (string, error) {
+	fileVersion := versionFor(filename)
+	if fileVersion == CurrentFileVersion {
+		return filename, nil
+	}
+	in, err := os.Open(filename)
+	if err != nil {
+		return "", fmt.Errorf("Unable to open %v: %v", filename, err)
+	}
+	defer in.Close()
+	r, err := newDecompressingReader(bufio.NewReader(in), fileVersion)
+	if err != nil {
+		return "", fmt.Errorf("Unable to read %v: %v", filename, err)
+	}
+	defer releaseReader(r)
+
+	header, err := readHeader(r, fileVersion)
+	if err != nil {
+		return "", fmt.Errorf("Unable to read header of %v: %v", filename, err)
+	}
+
+	out, err := ioutil.TempFile(filepath.Dir(filename), "migrating")
+	if err != nil {
+		return "", fmt.Errorf("Unable to create temp file for migrating %v: %v", filename, err)
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	// Migrated files use the default compression, a table's configured
+	// compression applies from its next flush
+	w, err := newCompressedWriter(out, compressionSnappy, nil)
+	if err != nil {
+		return "", fmt.Errorf("Unable to start writing migrated %v: %v", filename, err)
+	}
+
+	err = writeHeader(w, header.offset, layoutRows, header.fields)
+	if err != nil {
+		return "", fmt.Errorf("Unable to write header for %v: %v", filename, err)
+	}
+
+	for {
+		rowLength := uint64(0)
+		err = binary.Read(r, encoding.Binary, &rowLength)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("Unable to read row length from %v: %v", filename, err)
+		}
+		if rowLength < encoding.Width64bits {
+			return "", fmt.Errorf("Invalid row length %d in %v", rowLength, filename)
+		}
+		row := make([]byte, rowLength-encoding.Width64bits)
+		_, err = io.ReadFull(r, row)
+		if err != nil {
+			return "", fmt.Errorf("Unable to read row from %v: %v", filename, err)
+		}
+		err = migrateRow(w, fileVersion, header.encodingVersion, row)
+		if err != nil {
+			return "", fmt.Errorf("Unable to migrate row in %v: %v", filename, err)
+		}
+	}
+
+	err = w.Close()
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		return "", fmt.Errorf("Unable to finish writing migrated %v: %v", filename, err)
+	}
+
+	// Keep the original timestamp so that files still sort chronologically
+	parts := strings.Split(filepath.Base(filename), "_")
+	newFilename := filepath.Join(filepath.Dir(filename), fmt.Sprintf("%v_%v_%d.dat", parts[0], parts[1], CurrentFileVersion))
+	err = os.Rename(out.Name(), newFilename)
+	if err != nil {
+		return "", fmt.Errorf("Unable to move migrated file into place at %v: %v", newFilename, err)
+	}
+	err = os.Remove(filename)
+	if err != nil {
+		return "", fmt.Errorf("Unable to remove original file %v after migrating: %v", filename, err)
+	}
+	return newFilename, nil
+}
+
+// migrateRow decodes a row (without its leading row length) stored with the
+// given file and encoding versions and writes it to w using the current file
+// format and encoding.
+func migrateRow(w io.Writer, fileVersion int, encodingVersion byte, row []byte) error {
+	key, row, err := decodeRowKey(fileVersion, row)
+	if err != nil {
+		return err
+	}
+	key, err = encoding.DecodeKey(encodingVersion, key)
+	if err != nil {
+		return err
+	}
+	columns, err := decodeRowColumns(fileVersion, row)
+	if err != nil {
+		return err
+	}
+	for i, seq := range columns {
+		if len(seq) == 0 {
+			continue
+		}
+		columns[i], err = encoding.DecodeSequence(encodingVersion, seq)
+		if err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, encodedRowLength(key, columns))
+	encodeRow(buf, key, columns)
+	_, err = w.Write(buf)
+	return err
+}
@@ -0,0 +1,162 @@
+package zenodb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/wal"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrateFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	schema := func() Schema {
+		return Schema{
+			"thetable": &TableOpts{
+				RetentionPeriod: 24 * time.Hour,
+				SQL:             "SELECT SUM(a) AS a FROM inbound GROUP BY x, period(1s)",
+			},
+		}
+	}
+	countKeys := func(db *DB) int {
+		keys := 0
+		err := db.getTable("thetable").rowStore.iterate(context.Background(), nil, false, nil, nil, func(key bytemap.ByteMap, columns []encoding.Sequence) (bool, error) {
+			keys++
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return keys
+	}
+
+	// Write some data in the current version
+	db, err := NewDB(&DBOpts{Dir: filepath.Join(tmpDir, "current"), Schema: schema()})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	now := time.Now()
+	db.Insert("inbound", now, map[string]interface{}{"x": 1}, map[string]float64{"a": 1})
+	db.Insert("inbound", now, map[string]interface{}{"x": 2}, map[string]float64{"a": 1})
+	waitFor(func() bool { return db.TableStats("thetable").ArchiveQueueDepth == 2 })
+	if !assert.NoError(t, db.ForceFlush("thetable")) {
+		return
+	}
+	currentFile := db.getTable("thetable").rowStore.fileStore.filename
+	assert.Equal(t, CurrentFileVersion, versionFor(currentFile))
+	current := decompressFile(t, currentFile)
+
+	// Rewrite it as version 4, which doesn't include the encoding version or
+	// layout and uses fixed width lengths
+	headerLength := encoding.Binary.Uint32(current)
+	v4 := make([]byte, 0, len(current))
+	v4 = append(v4, current[:4]...)
+	encoding.Binary.PutUint32(v4, headerLength-2)
+	v4 = append(v4, current[4:4+wal.OffsetSize]...)
+	v4 = append(v4, current[4+wal.OffsetSize+2:4+headerLength]...)
+	for rows := current[4+headerLength:]; len(rows) > 0; {
+		rowLength := int(encoding.Binary.Uint64(rows))
+		key, remain, err := decodeRowKey(CurrentFileVersion, rows[encoding.Width64bits:rowLength])
+		if !assert.NoError(t, err) {
+			return
+		}
+		columns, err := decodeRowColumns(CurrentFileVersion, remain)
+		if !assert.NoError(t, err) {
+			return
+		}
+		v4 = append(v4, encodeFixedWidthRow(key, columns)...)
+		rows = rows[rowLength:]
+	}
+	v4Filename := func(dir string) string {
+		tableDir := filepath.Join(tmpDir, dir, "thetable")
+		if !assert.NoError(t, os.MkdirAll(tableDir, 0755)) {
+			t.FailNow()
+		}
+		filename := filepath.Join(tableDir, fmt.Sprintf("filestore_%020d_%d.dat", now.UnixNano(), FileVersion_4))
+		compressed := &bytes.Buffer{}
+		w := snappy.NewBufferedWriter(compressed)
+		w.Write(v4)
+		w.Close()
+		if !assert.NoError(t, ioutil.WriteFile(filename, compressed.Bytes(), 0644)) {
+			t.FailNow()
+		}
+		return filename
+	}
+
+	// Version 4 files can still be read
+	v4Filename("old")
+	oldDB, err := NewDB(&DBOpts{Dir: filepath.Join(tmpDir, "old"), Schema: schema()})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer oldDB.Close()
+	assert.Equal(t, 2, countKeys(oldDB))
+
+	// Migrating version 4 files yields the current format
+	toMigrate := v4Filename("migrated")
+	migrated, err := MigrateFiles(filepath.Join(tmpDir, "migrated"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 1, migrated)
+	_, err = os.Stat(toMigrate)
+	assert.True(t, os.IsNotExist(err), "original file should have been removed")
+	migratedFile := filepath.Join(tmpDir, "migrated", "thetable", fmt.Sprintf("filestore_%020d_%d.dat", now.UnixNano(), CurrentFileVersion))
+	assert.Equal(t, current, decompressFile(t, migratedFile))
+
+	migrated, err = MigrateFiles(filepath.Join(tmpDir, "migrated"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, 0, migrated, "current files shouldn't be migrated again")
+	}
+}
+
+func decompressFile(t *testing.T, filename string) []byte {
+	f, err := os.Open(filename)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer f.Close()
+	r, err := newDecompressingReader(f, versionFor(filename))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	b, err := ioutil.ReadAll(r)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return b
+}
+
+// encodeFixedWidthRow encodes a row the way it was stored prior to
+// FileVersion_6.
+func encodeFixedWidthRow(key bytemap.ByteMap, columns []encoding.Sequence) []byte {
+	rowLength := encoding.Width64bits + encoding.Width16bits + len(key) + encoding.Width16bits
+	for _, seq := range columns {
+		rowLength += encoding.Width64bits + len(seq)
+	}
+	buf := make([]byte, rowLength)
+	b := encoding.WriteInt64(buf, rowLength)
+	b = encoding.WriteInt16(b, len(key))
+	b = encoding.Write(b, key)
+	b = encoding.WriteInt16(b, len(columns))
+	for _, seq := range columns {
+		b = encoding.WriteInt64(b, len(seq))
+	}
+	for _, seq := range columns {
+		b = encoding.Write(b, seq)
+	}
+	return buf
+}
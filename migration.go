@@ -0,0 +1,500 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/yaml"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/sql"
+)
+
+const (
+	// migrationsFilename is the file in the db dir to which migrations are
+	// persisted so that migrated tables keep using their new data and SQL after
+	// a restart.
+	migrationsFilename = "_migrations.yaml"
+
+	// shadowTablePrefix prefixes the names of the tables into which migrations
+	// write before swapping them in.
+	shadowTablePrefix = "_migrate_"
+)
+
+// States of a migration, see MigrationStatus.
+const (
+	MigrationBackfilling = "backfilling"
+	MigrationDone        = "done"
+	MigrationFailed      = "failed"
+)
+
+// MigrationStatus reports the progress of a migration started with
+// MigrateTable or BackfillView.
+type MigrationStatus struct {
+	Table string
+	// SQL is the table's new SQL
+	SQL string
+	// Shadow is the name of the table into which the migration writes until it
+	// takes over the original table's name
+	Shadow string
+	// Source is the table from which a backfill recomputes the view's periods
+	// between From and Until. It's empty for other migrations.
+	Source string
+	From   time.Time
+	Until  time.Time
+	// State is one of MigrationBackfilling, MigrationDone or MigrationFailed
+	State    string
+	Started  time.Time
+	Finished time.Time
+	Error    string
+	// BackfilledRows is the number of rows copied from the old table, or
+	// replayed from the source table, so far
+	BackfilledRows int64
+}
+
+func (s *MigrationStatus) String() string {
+	result := fmt.Sprintf("migration of %v via %v %v: backfilled %d rows", s.Table, s.Shadow, s.State, s.BackfilledRows)
+	if s.Source != "" {
+		result = fmt.Sprintf("backfill of %v from %v between %v and %v via %v %v: backfilled %d rows", s.Table, s.Source, s.From.Format(time.RFC3339), s.Until.Format(time.RFC3339), s.Shadow, s.State, s.BackfilledRows)
+	}
+	if s.Error != "" {
+		result = fmt.Sprintf("%v, error: %v", result, s.Error)
+	}
+	return result
+}
+
+type migrationJob struct {
+	// BackfilledRows comes first so that it's aligned on 32 bit platforms. It's
+	// accessed atomically.
+	BackfilledRows int64 `yaml:"backfilledrows"`
+
+	Table  string `yaml:"table"`
+	SQL    string `yaml:"sql"`
+	Shadow string `yaml:"shadow"`
+	// Source is set for backfills of views, see BackfillView. It's the table
+	// from whose data the view's periods in [From, Until) are recomputed.
+	Source string `yaml:"source,omitempty"`
+	From   string `yaml:"from,omitempty"`
+	Until  string `yaml:"until,omitempty"`
+	// The below are only accessed while holding migrationsMx
+	State    string `yaml:"state"`
+	Started  string `yaml:"started"`
+	Finished string `yaml:"finished,omitempty"`
+	Error    string `yaml:"error,omitempty"`
+	// SchemaUpdated indicates that the schema has caught up with the migrated
+	// SQL, after which changes to the schema apply to the table as usual
+	SchemaUpdated bool `yaml:"schemaupdated,omitempty"`
+	// Previous is the table's last successful migration, which remains in
+	// effect until this one is done
+	Previous *migrationJob `yaml:"previous,omitempty"`
+}
+
+// applied returns the migration that's currently in effect for the job's
+// table, if any.
+func (job *migrationJob) applied() *migrationJob {
+	if job.State == MigrationDone {
+		return job
+	}
+	return job.Previous
+}
+
+// MigrateTable starts a background job that changes the given table's SQL to
+// sqlString without losing its existing data. It creates a shadow table with
+// the new SQL that ingests new points from the WAL alongside the old table,
+// backfills the shadow table with the data already in the old table and then
+// atomically swaps the shadow table in under the old table's name.
+//
+// Backfilling re-aggregates the old table's rows as if each row was a single
+// point whose values are the old table's fields. That's exact for fields like
+// SUM(x) AS x, MIN(x) AS x and MAX(x) AS x that aggregate a field of the same
+// name, and for _points, but other fields are only approximated. The new
+// table can only group by dimensions that the old table kept.
+//
+// Migrations are only supported on standalone nodes, and the new SQL must
+// read from the same stream as the table. Once the migration is done, the
+// table keeps using the new SQL after restarts even if the schema still has
+// the old SQL, until the schema is updated to match. The old table's data is
+// left on disk. Use MigrationStatus to follow the migration's progress.
+func (db *DB) MigrateTable(table string, sqlString string) error {
+	if db.opts.Follow != nil || db.opts.Passthrough {
+		return fmt.Errorf("Migrations are only supported on standalone nodes")
+	}
+	t, err := db.storingTable(table)
+	if err != nil {
+		return err
+	}
+	if t.View || strings.HasPrefix(t.Name, shadowTablePrefix) {
+		return fmt.Errorf("Table %v can't be migrated", t.Name)
+	}
+	q, err := sql.Parse(sqlString)
+	if err != nil {
+		return fmt.Errorf("Unable to parse SQL: %v", err)
+	}
+	if q.FromSubQuery != nil || !strings.EqualFold(q.From, t.From) {
+		return fmt.Errorf("New SQL for %v must select from the same stream, %v", t.Name, t.From)
+	}
+
+	return db.startMigration(t, &migrationJob{Table: t.Name, SQL: sqlString})
+}
+
+// BackfillView starts a background job that recomputes the given view's data
+// for the periods in the time range [from, until) from the data in its source
+// table, for example after fixing a bug in the view's SQL. It works like
+// MigrateTable with the view's current SQL, except that the shadow view keeps
+// the old view's data outside of the time range and replays the source table's
+// rows within it through the view's WHERE clause, fields and GROUP BY. The
+// range is widened to whole periods of the view.
+//
+// Like with MigrateTable, replaying treats each row of the source table as a
+// single point, so only fields that aggregate a field of the same name with
+// SUM, MIN or MAX, and _points, come out exactly as if the points had been
+// inserted into the fixed view in the first place. Data that has expired from
+// the source table can't be recomputed. Use MigrationStatus to follow the
+// backfill's progress.
+func (db *DB) BackfillView(view string, from time.Time, until time.Time) error {
+	if db.opts.Follow != nil || db.opts.Passthrough {
+		return fmt.Errorf("Backfills are only supported on standalone nodes")
+	}
+	t, err := db.storingTable(view)
+	if err != nil {
+		return err
+	}
+	if !t.View || strings.HasPrefix(t.Name, shadowTablePrefix) {
+		return fmt.Errorf("%v is not a view", t.Name)
+	}
+	if !from.Before(until) {
+		return fmt.Errorf("Backfill of %v needs a time range whose start %v is before its end %v", t.Name, from, until)
+	}
+	t.tunablesMx.RLock()
+	sqlString := t.TableOpts.SQL
+	t.tunablesMx.RUnlock()
+	q, err := sql.Parse(sqlString)
+	if err != nil {
+		return fmt.Errorf("Unable to parse SQL of %v: %v", t.Name, err)
+	}
+	if q.FromSubQuery != nil || db.getTable(q.From) == nil {
+		return fmt.Errorf("Unable to find source table of %v", t.Name)
+	}
+	return db.startMigration(t, &migrationJob{
+		Table:         t.Name,
+		SQL:           sqlString,
+		Source:        strings.ToLower(q.From),
+		From:          encoding.RoundTimeDown(from, t.Resolution).Format(time.RFC3339Nano),
+		Until:         encoding.RoundTimeUp(until, t.Resolution).Format(time.RFC3339Nano),
+		SchemaUpdated: true,
+	})
+}
+
+// startMigration records the given job and starts it in the background.
+func (db *DB) startMigration(t *table, job *migrationJob) error {
+	db.migrationsMx.Lock()
+	defer db.migrationsMx.Unlock()
+	existing := db.migrations[t.Name]
+	if existing != nil && existing.State == MigrationBackfilling {
+		return fmt.Errorf("Table %v is already being migrated", t.Name)
+	}
+	now := db.clock.Now()
+	job.Shadow = fmt.Sprintf("%v%v_%d", shadowTablePrefix, t.Name, now.UnixNano())
+	job.State = MigrationBackfilling
+	job.Started = now.Format(time.RFC3339Nano)
+	if existing != nil {
+		job.Previous = existing.applied()
+		if job.Previous != nil {
+			job.Previous.Previous = nil
+		}
+	}
+	db.migrations[t.Name] = job
+	err := db.saveMigrations()
+	if err != nil {
+		return err
+	}
+	t.log.Debugf("Migrating to %v via %v", job.SQL, job.Shadow)
+	go db.migrate(t, job)
+	return nil
+}
+
+// MigrationStatus returns the status of the most recent migration of the given
+// table.
+func (db *DB) MigrationStatus(table string) (*MigrationStatus, error) {
+	db.migrationsMx.Lock()
+	defer db.migrationsMx.Unlock()
+	job := db.migrations[strings.ToLower(table)]
+	if job == nil {
+		return nil, fmt.Errorf("No migration found for table %v", table)
+	}
+	started, _ := time.Parse(time.RFC3339Nano, job.Started)
+	finished, _ := time.Parse(time.RFC3339Nano, job.Finished)
+	from, _ := time.Parse(time.RFC3339Nano, job.From)
+	until, _ := time.Parse(time.RFC3339Nano, job.Until)
+	return &MigrationStatus{
+		Table:          job.Table,
+		SQL:            job.SQL,
+		Shadow:         job.Shadow,
+		Source:         job.Source,
+		From:           from,
+		Until:          until,
+		State:          job.State,
+		Started:        started,
+		Finished:       finished,
+		Error:          job.Error,
+		BackfilledRows: atomic.LoadInt64(&job.BackfilledRows),
+	}, nil
+}
+
+func (db *DB) migrate(old *table, job *migrationJob) {
+	// Stop the old table at a known offset, from which the shadow table picks
+	// up. Everything before that offset is backfilled from the old table.
+	old.quiesce()
+	old.forceFlush()
+	offset := old.getReadOffset()
+
+	old.tunablesMx.RLock()
+	opts := *old.TableOpts
+	old.tunablesMx.RUnlock()
+	opts.Name = job.Shadow
+	opts.SQL = job.SQL
+	opts.dependencyOf = nil
+	opts.startAt = offset
+	err := db.CreateTable(&opts)
+	if err != nil {
+		old.resume()
+		db.updateMigration(job, MigrationFailed, fmt.Errorf("Unable to create shadow table: %v", err))
+		return
+	}
+	shadow := db.getTable(job.Shadow)
+
+	err = db.backfill(old, shadow, job)
+	if err != nil {
+		old.resume()
+		db.tablesMutex.Lock()
+		delete(db.tables, shadow.Name)
+		db.removeOrderedTable(shadow)
+		db.tablesMutex.Unlock()
+		shadow.pause()
+		db.updateMigration(job, MigrationFailed, fmt.Errorf("Unable to backfill: %v", err))
+		return
+	}
+
+	// Record the migration as done first so that schema changes that happen
+	// after the swap use the new SQL
+	db.updateMigration(job, MigrationDone, nil)
+	db.tablesMutex.Lock()
+	delete(db.tables, shadow.Name)
+	shadow.Name = old.Name
+	db.tables[old.Name] = shadow
+	db.removeOrderedTable(old)
+	db.tablesMutex.Unlock()
+	// The old table stays paused since it no longer receives queries
+	old.log.Debugf("Migrated to %v", job.SQL)
+}
+
+// removeOrderedTable removes the given table from orderedTables. It must be
+// called while holding tablesMutex.
+func (db *DB) removeOrderedTable(t *table) {
+	for i, candidate := range db.orderedTables {
+		if candidate == t {
+			db.orderedTables = append(db.orderedTables[:i], db.orderedTables[i+1:]...)
+			return
+		}
+	}
+}
+
+// backfill inserts the data from the old table into the shadow table. For
+// backfills of views, it only inserts the old table's data outside of the
+// job's time range and replays the source table's data within it.
+func (db *DB) backfill(old *table, shadow *table, job *migrationJob) error {
+	if job.Source == "" {
+		return db.backfillFrom(fmt.Sprintf("SELECT * FROM %v", old.Name), shadow, job, nil)
+	}
+
+	from, err := time.Parse(time.RFC3339Nano, job.From)
+	if err != nil {
+		return fmt.Errorf("Invalid start of time range: %v", err)
+	}
+	until, err := time.Parse(time.RFC3339Nano, job.Until)
+	if err != nil {
+		return fmt.Errorf("Invalid end of time range: %v", err)
+	}
+	inRange := func(ts time.Time) bool {
+		period := encoding.RoundTimeUp(ts, shadow.Resolution)
+		return !period.Before(from) && period.Before(until)
+	}
+	err = db.backfillFrom(fmt.Sprintf("SELECT * FROM %v", old.Name), shadow, job, func(ts time.Time) bool {
+		return !inRange(ts)
+	})
+	if err != nil {
+		return err
+	}
+	// Widen the query by a period on either side to make sure that we see all
+	// rows of the source table that fall into the view's periods
+	return db.backfillFrom(fmt.Sprintf("SELECT * FROM %v ASOF '%v' UNTIL '%v'",
+		job.Source,
+		from.Add(-1*shadow.Resolution).Format(time.RFC3339Nano),
+		until.Add(shadow.Resolution).Format(time.RFC3339Nano)), shadow, job, inRange)
+}
+
+// backfillFrom inserts the rows returned by the given query into the shadow
+// table, skipping rows whose timestamps aren't included if include is given.
+func (db *DB) backfillFrom(sqlString string, shadow *table, job *migrationJob, include func(ts time.Time) bool) error {
+	source, err := db.Query(sqlString, false, nil, true)
+	if err != nil {
+		return err
+	}
+	batch := &observeBatch{}
+	var fields core.Fields
+	return source.Iterate(context.Background(), func(f core.Fields) error {
+		fields = f
+		return nil
+	}, func(row *core.FlatRow) (bool, error) {
+		ts := encoding.TimeFromInt(row.TS)
+		if ts.Before(shadow.truncateBefore()) || (include != nil && !include(ts)) {
+			return true, nil
+		}
+		vals := make(map[string]float64, len(fields))
+		for i, field := range fields {
+			val := row.Values[i]
+			if !math.IsNaN(val) && !math.IsInf(val, 0) {
+				vals[field.Name] = val
+			}
+		}
+		shadow.doInsert(ts, row.Key, bytemap.NewFloat(vals), nil, batch, nil)
+		atomic.AddInt64(&job.BackfilledRows, 1)
+		return true, nil
+	})
+}
+
+// tableDir returns the directory in which the named table stores its data,
+// which for migrated tables is the directory of the shadow table.
+func (db *DB) tableDir(name string) string {
+	db.migrationsMx.Lock()
+	var applied *migrationJob
+	if job := db.migrations[name]; job != nil {
+		applied = job.applied()
+	}
+	db.migrationsMx.Unlock()
+	if applied != nil {
+		return filepath.Join(db.opts.Dir, applied.Shadow)
+	}
+	return filepath.Join(db.opts.Dir, name)
+}
+
+// applyMigratedSQL replaces the SQL in the given opts with the SQL of the
+// table's migration until the schema catches up with the migration.
+func (db *DB) applyMigratedSQL(opts *TableOpts) {
+	db.migrationsMx.Lock()
+	defer db.migrationsMx.Unlock()
+	job := db.migrations[opts.Name]
+	if job != nil {
+		job = job.applied()
+	}
+	if job == nil || job.SchemaUpdated {
+		return
+	}
+	if strings.TrimSpace(opts.SQL) == strings.TrimSpace(job.SQL) {
+		job.SchemaUpdated = true
+		err := db.saveMigrations()
+		if err != nil {
+			log.Error(err)
+		}
+		return
+	}
+	log.Debugf("Schema for %v doesn't match migrated SQL, using migrated SQL. Please update the schema to:\n%v", opts.Name, job.SQL)
+	opts.SQL = job.SQL
+}
+
+// updateMigration changes the state of the given job, recording the error if
+// the job failed.
+func (db *DB) updateMigration(job *migrationJob, state string, err error) {
+	db.migrationsMx.Lock()
+	defer db.migrationsMx.Unlock()
+	job.State = state
+	if err != nil {
+		job.Error = err.Error()
+		log.Errorf("Migration of %v failed: %v", job.Table, err)
+	}
+	job.Finished = db.clock.Now().Format(time.RFC3339Nano)
+	saveErr := db.saveMigrations()
+	if saveErr != nil {
+		log.Error(saveErr)
+	}
+}
+
+// loadMigrations loads previously persisted migrations.
+func (db *DB) loadMigrations() error {
+	db.migrations = make(map[string]*migrationJob)
+	b, err := ioutil.ReadFile(filepath.Join(db.opts.Dir, migrationsFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("Unable to read migrations: %v", err)
+	}
+	var jobs []*migrationJob
+	err = yaml.Unmarshal(b, &jobs)
+	if err != nil {
+		return fmt.Errorf("Unable to parse migrations: %v", err)
+	}
+	for _, job := range jobs {
+		if job.State == MigrationBackfilling {
+			// Interrupted before the swap, the old table is still in use
+			job.State = MigrationFailed
+			job.Error = "interrupted by restart"
+		}
+		db.migrations[job.Table] = job
+	}
+	return nil
+}
+
+// saveMigrations persists migrations. It must be called while holding
+// migrationsMx.
+func (db *DB) saveMigrations() error {
+	tables := make([]string, 0, len(db.migrations))
+	for table := range db.migrations {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	jobs := make([]migrationJob, 0, len(tables))
+	for _, table := range tables {
+		job := db.migrations[table]
+		jobs = append(jobs, migrationJob{
+			BackfilledRows: atomic.LoadInt64(&job.BackfilledRows),
+			Table:          job.Table,
+			SQL:            job.SQL,
+			Shadow:         job.Shadow,
+			Source:         job.Source,
+			From:           job.From,
+			Until:          job.Until,
+			State:          job.State,
+			Started:        job.Started,
+			Finished:       job.Finished,
+			Error:          job.Error,
+			SchemaUpdated:  job.SchemaUpdated,
+			Previous:       job.Previous,
+		})
+	}
+
+	b, err := yaml.Marshal(jobs)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal migrations: %v", err)
+	}
+	filename := filepath.Join(db.opts.Dir, migrationsFilename)
+	tmpFilename := filename + ".tmp"
+	err = ioutil.WriteFile(tmpFilename, b, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to write migrations: %v", err)
+	}
+	err = os.Rename(tmpFilename, filename)
+	if err != nil {
+		return fmt.Errorf("Unable to save migrations: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package zenodb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrateTable(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 0, 0, time.UTC)
+	clock := NewVirtualClock(epoch)
+	clock.Freeze()
+	newDB := func() (*DB, error) {
+		return NewDB(&DBOpts{
+			Dir:   tmpDir,
+			Clock: clock,
+			Schema: Schema{
+				"thetable": &TableOpts{
+					RetentionPeriod: time.Hour,
+					SQL:             "SELECT SUM(a) AS a FROM inbound GROUP BY host, period(1m)",
+				},
+			},
+		})
+	}
+	db, err := newDB()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	inserted := 0
+	insert := func(ts time.Time, host string, a float64) {
+		db.Insert("inbound", ts, map[string]interface{}{"host": host}, map[string]float64{"a": a})
+		inserted++
+		waitFor(func() bool { return db.TableStats("thetable").InsertedPoints == int64(inserted) })
+	}
+	migrationDone := func() bool {
+		status, statusErr := db.MigrationStatus("thetable")
+		// The old table goes away right after the migration is recorded as done
+		return statusErr == nil && status.State == MigrationDone && len(db.allTables()) == 1
+	}
+
+	insert(epoch, "a", 1)
+	insert(epoch, "b", 2)
+	insert(epoch.Add(-1*time.Minute), "a", 4)
+
+	newSQL := "SELECT SUM(a) AS a FROM inbound GROUP BY period(1m)"
+	_, err = db.MigrationStatus("thetable")
+	assert.Error(t, err, "status without migration should fail")
+	assert.Error(t, db.MigrateTable("othertable", newSQL), "migrating unknown table should fail")
+	assert.Error(t, db.MigrateTable("thetable", "SELECT SUM(a) AS a FROM otherstream"), "migrating to different stream should fail")
+	assert.Error(t, db.MigrateTable("thetable", "not sql"), "migrating to invalid SQL should fail")
+
+	if !assert.NoError(t, db.MigrateTable("thetable", newSQL)) {
+		return
+	}
+	waitFor(migrationDone)
+	status, err := db.MigrationStatus("thetable")
+	if assert.NoError(t, err) {
+		assert.Equal(t, MigrationDone, status.State)
+		assert.EqualValues(t, 3, status.BackfilledRows)
+		assert.Empty(t, status.Error)
+	}
+	assert.Empty(t, db.getTable("thetable").GroupBy, "migrated table should use new SQL")
+	assert.Len(t, db.allTables(), 1, "old table should be gone")
+
+	// New points go to the migrated table
+	db.Insert("inbound", epoch, map[string]interface{}{"host": "c"}, map[string]float64{"a": 8})
+	waitFor(func() bool { return sumFieldAt(t, db, "thetable", "a", epoch) == 11 })
+	assert.EqualValues(t, 11, sumFieldAt(t, db, "thetable", "a", epoch))
+	assert.EqualValues(t, 4, sumFieldAt(t, db, "thetable", "a", epoch.Add(-1*time.Minute)))
+	if !assert.NoError(t, db.ForceFlush("thetable")) {
+		return
+	}
+	db.Close()
+
+	// Reopening with the old schema keeps the migrated data and SQL
+	db, err = newDB()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	assert.Empty(t, db.getTable("thetable").GroupBy, "migrated SQL should survive restart")
+	assert.EqualValues(t, 11, sumFieldAt(t, db, "thetable", "a", epoch))
+	assert.EqualValues(t, 4, sumFieldAt(t, db, "thetable", "a", epoch.Add(-1*time.Minute)))
+}
+
+func TestBackfillView(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 0, 0, time.UTC)
+	clock := NewVirtualClock(epoch)
+	clock.Freeze()
+	schema := func(viewSQL string) Schema {
+		return Schema{
+			"thetable": &TableOpts{
+				RetentionPeriod: time.Hour,
+				SQL:             "SELECT SUM(a) AS a FROM inbound GROUP BY host, period(1m)",
+			},
+			"theview": &TableOpts{
+				View:            true,
+				RetentionPeriod: time.Hour,
+				SQL:             viewSQL,
+			},
+		}
+	}
+	db, err := NewDB(&DBOpts{
+		Dir:    tmpDir,
+		Clock:  clock,
+		Schema: schema("SELECT SUM(a) AS a FROM thetable WHERE host = 'a' GROUP BY period(1m)"),
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	inserted := 0
+	insert := func(ts time.Time, host string, a float64) {
+		db.Insert("inbound", ts, map[string]interface{}{"host": host}, map[string]float64{"a": a})
+		inserted++
+		waitFor(func() bool {
+			stats := db.TableStats("theview")
+			return db.TableStats("thetable").InsertedPoints == int64(inserted) && stats.InsertedPoints+stats.FilteredPoints == int64(inserted)
+		})
+	}
+	backfillDone := func() bool {
+		status, statusErr := db.MigrationStatus("theview")
+		return statusErr == nil && status.State == MigrationDone && len(db.allTables()) == 2
+	}
+
+	for i := 0; i < 3; i++ {
+		ts := epoch.Add(time.Duration(-i) * time.Minute)
+		insert(ts, "a", 1)
+		insert(ts, "b", 2)
+	}
+
+	// Fix the view, which only affects new points
+	if !assert.NoError(t, db.ApplySchema(schema("SELECT SUM(a) AS a FROM thetable GROUP BY period(1m)"))) {
+		return
+	}
+	assert.EqualValues(t, 1, sumFieldAt(t, db, "theview", "a", epoch.Add(-1*time.Minute)))
+
+	assert.Error(t, db.BackfillView("thetable", epoch.Add(-1*time.Minute), epoch), "backfilling table should fail")
+	assert.Error(t, db.BackfillView("theview", epoch, epoch.Add(-1*time.Minute)), "backfilling empty time range should fail")
+	if !assert.NoError(t, db.BackfillView("theview", epoch.Add(-1*time.Minute), epoch)) {
+		return
+	}
+	waitFor(backfillDone)
+	status, err := db.MigrationStatus("theview")
+	if assert.NoError(t, err) {
+		assert.Equal(t, MigrationDone, status.State)
+		assert.Equal(t, "thetable", status.Source)
+		assert.Equal(t, epoch.Add(-1*time.Minute), status.From.In(time.UTC))
+		assert.Equal(t, epoch, status.Until.In(time.UTC))
+		assert.EqualValues(t, 4, status.BackfilledRows, "should have copied 2 rows from the view and replayed 2 rows from the table")
+		assert.Empty(t, status.Error)
+	}
+	assert.EqualValues(t, 1, sumFieldAt(t, db, "theview", "a", epoch), "period after time range should be unchanged")
+	assert.EqualValues(t, 3, sumFieldAt(t, db, "theview", "a", epoch.Add(-1*time.Minute)), "period in time range should be recomputed")
+	assert.EqualValues(t, 1, sumFieldAt(t, db, "theview", "a", epoch.Add(-2*time.Minute)), "period before time range should be unchanged")
+
+	// New points go to the backfilled view
+	db.Insert("inbound", epoch, map[string]interface{}{"host": "b"}, map[string]float64{"a": 4})
+	waitFor(func() bool { return sumFieldAt(t, db, "theview", "a", epoch) == 5 })
+	assert.EqualValues(t, 5, sumFieldAt(t, db, "theview", "a", epoch))
+}
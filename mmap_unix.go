@@ -0,0 +1,31 @@
+//go:build !windows
+// +build !windows
+
+package zenodb
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapFile maps the contents of the given file into memory for reading.
+func mmapFile(file *os.File) ([]byte, error) {
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	if size == 0 {
+		// mapping an empty file fails, but there's nothing to map anyway
+		return []byte{}, nil
+	}
+	return syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// munmap releases memory mapped with mmapFile.
+func munmap(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	return syscall.Munmap(b)
+}
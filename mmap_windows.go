@@ -0,0 +1,15 @@
+package zenodb
+
+import (
+	"fmt"
+	"os"
+)
+
+// mmapFile isn't supported on Windows, data files are read normally instead.
+func mmapFile(file *os.File) ([]byte, error) {
+	return nil, fmt.Errorf("Memory mapping data files is not supported on Windows")
+}
+
+func munmap(b []byte) error {
+	return nil
+}
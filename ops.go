@@ -0,0 +1,94 @@
+package zenodb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"text/tabwriter"
+
+	"github.com/dustin/go-humanize"
+	"github.com/getlantern/zenodb/logging"
+)
+
+// RegisterOpsHandlers registers handlers for operational endpoints on the given
+// ServeMux:
+//
+//	/healthz            - 200 if the database is Healthy, 503 otherwise
+//	/readyz             - 200 if the database is Ready, 503 otherwise
+//	/metrics            - internal statistics in the Prometheus text format
+//	/debug/zenodb/dump  - memstore sizes by table followed by a goroutine dump
+//	                      in which table goroutines are labeled with the table
+//	/debug/zenodb/trace - lists subsystems and toggles trace logging for them
+func (db *DB) RegisterOpsHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", db.ServeHealthz)
+	mux.HandleFunc("/readyz", db.ServeReadyz)
+	mux.HandleFunc("/metrics", db.ServeMetrics)
+	mux.HandleFunc("/debug/zenodb/dump", db.ServeDump)
+	mux.HandleFunc("/debug/zenodb/trace", logging.ServeTrace)
+}
+
+// ServeDump is an http.HandlerFunc that writes a dump as described by
+// WriteDump. If the query parameter gc is true, it forces a garbage collection
+// first so that the heap statistics only reflect live memory.
+func (db *DB) ServeDump(resp http.ResponseWriter, req *http.Request) {
+	gc, _ := strconv.ParseBool(req.FormValue("gc"))
+	resp.Header().Set("Content-Type", "text/plain")
+	err := db.WriteDump(resp, gc)
+	if err != nil {
+		log.Errorf("Unable to write dump: %v", err)
+	}
+}
+
+// WriteDump writes a summary of heap usage, the size of each table's memstore
+// (largest first) and a dump of all goroutines to the given Writer.
+func (db *DB) WriteDump(w io.Writer, gc bool) error {
+	if gc {
+		runtime.GC()
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "Heap: %v in use, %v obtained from OS, RSS %v, %d goroutines, %d GC cycles\n\n",
+		humanize.Bytes(ms.HeapAlloc), humanize.Bytes(ms.Sys), humanize.Bytes(atomic.LoadUint64(&db.rss)), runtime.NumGoroutine(), ms.NumGC)
+
+	if db.storesData() {
+		type tableMemory struct {
+			name  string
+			bytes int
+			keys  int
+		}
+		db.tablesMutex.RLock()
+		tables := make([]*tableMemory, 0, len(db.orderedTables))
+		for _, t := range db.orderedTables {
+			if !t.Virtual {
+				tables = append(tables, &tableMemory{name: t.Name, bytes: t.memStoreSize(), keys: t.memStoreLength()})
+			}
+		}
+		db.tablesMutex.RUnlock()
+		sort.Slice(tables, func(i, j int) bool {
+			return tables[i].bytes > tables[j].bytes
+		})
+
+		fmt.Fprintln(bw, "Memstores by size:")
+		tw := tabwriter.NewWriter(bw, 0, 0, 2, ' ', 0)
+		for _, t := range tables {
+			fmt.Fprintf(tw, "  %v\t%v\t%d keys\t\n", t.name, humanize.Bytes(uint64(t.bytes)), t.keys)
+		}
+		tw.Flush()
+		fmt.Fprintln(bw)
+	}
+
+	fmt.Fprintln(bw, "Goroutines (goroutines belonging to a table are labeled with it):")
+	err := pprof.Lookup("goroutine").WriteTo(bw, 1)
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,79 @@
+package zenodb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteDump(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tmpFile, err := ioutil.TempFile("", "zenodbschema")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.Remove(tmpFile.Name())
+	err = ioutil.WriteFile(tmpFile.Name(), []byte(`
+big:
+  maxflushlatency: 1h
+  retentionperiod: 1h
+  sql: >
+    SELECT SUM(val) AS val
+    FROM inbound
+    GROUP BY a, period(1s)
+small:
+  maxflushlatency: 1h
+  retentionperiod: 1h
+  sql: >
+    SELECT SUM(val) AS val
+    FROM inbound
+    WHERE a = 'never'
+    GROUP BY a, period(1s)
+`), 0644)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	db, err := NewDB(&DBOpts{
+		Dir:        tmpDir,
+		SchemaFile: tmpFile.Name(),
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		db.Insert("inbound", time.Now(), map[string]interface{}{"a": i}, map[string]float64{"val": 1})
+	}
+	bigTable := db.getTable("big")
+	for j := 0; j < 50 && bigTable.memStoreLength() == 0; j++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	buf := &bytes.Buffer{}
+	if !assert.NoError(t, db.WriteDump(buf, true)) {
+		return
+	}
+	dump := buf.String()
+	assert.Contains(t, dump, "Heap: ")
+	bigIdx := bytes.Index(buf.Bytes(), []byte("  big "))
+	smallIdx := bytes.Index(buf.Bytes(), []byte("  small "))
+	assert.True(t, bigIdx > 0 && smallIdx > bigIdx, "big table should be listed before small table")
+	for _, line := range strings.Split(dump, "\n") {
+		if strings.HasPrefix(line, "  small ") {
+			assert.True(t, strings.HasSuffix(strings.TrimSpace(line), " 0 keys"), "small table should have an empty memstore")
+		}
+	}
+	assert.Contains(t, dump, `"table":"big"`, "Goroutines should be labeled with table")
+}
@@ -0,0 +1,427 @@
+// Package pgwire provides a read-only frontend for zenodb that speaks the
+// PostgreSQL wire protocol (version 3), allowing tools like psql and BI tools
+// to run SELECT queries against zenodb. Only the simple query protocol is
+// supported.
+package pgwire
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/logging"
+	"github.com/getlantern/zenodb/sql"
+)
+
+var (
+	log = logging.LoggerFor("zenodb.pgwire")
+)
+
+const (
+	protocolVersion3  = 196608
+	sslRequestCode    = 80877103
+	cancelRequestCode = 80877102
+
+	maxMessageSize = 16 * 1024 * 1024
+
+	// flushRows is how many data rows to send between flushes when streaming
+	flushRows = 1000
+
+	oidText        = 25
+	oidFloat8      = 701
+	oidTimestampTZ = 1184
+
+	timestampFormat = "2006-01-02 15:04:05.999999Z07:00"
+
+	// error codes, see https://www.postgresql.org/docs/current/static/errcodes-appendix.html
+	codeInvalidPassword   = "28P01"
+	codeFeatureNotSupport = "0A000"
+	codeSyntaxError       = "42601"
+	codeInternalError     = "XX000"
+	codeProtocolViolation = "08P01"
+)
+
+// DB is an interface for database-like things that can be queried.
+type DB interface {
+	Query(sqlString string, isSubQuery bool, subQueryResults [][]interface{}, includeMemStore bool) (core.FlatRowSource, error)
+}
+
+type Opts struct {
+	// Password, if specified, is the password that clients must present in order
+	// to access the server (using cleartext password authentication, so use this
+	// only on trusted networks).
+	Password string
+
+	// QueryTimeout limits how long queries may run. Defaults to 10 minutes.
+	QueryTimeout time.Duration
+}
+
+// Serve serves the PostgreSQL wire protocol on the given listener.
+func Serve(db DB, l net.Listener, opts *Opts) error {
+	if opts.QueryTimeout <= 0 {
+		opts.QueryTimeout = 10 * time.Minute
+	}
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		c := &conn{
+			Conn: nc,
+			db:   db,
+			opts: opts,
+			r:    bufio.NewReader(nc),
+			w:    bufio.NewWriter(nc),
+		}
+		go c.serve()
+	}
+}
+
+type conn struct {
+	net.Conn
+	db   DB
+	opts *Opts
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+func (c *conn) serve() {
+	defer c.Close()
+	defer func() {
+		// A malformed message shouldn't take down the whole server
+		if p := recover(); p != nil {
+			log.Errorf("Panic serving %v: %v", c.RemoteAddr(), p)
+		}
+	}()
+
+	err := c.startup()
+	if err != nil {
+		log.Debugf("Error starting up connection from %v: %v", c.RemoteAddr(), err)
+		return
+	}
+
+	inFailedExtendedQuery := false
+	for {
+		typ, msg, err := c.readMessage()
+		if err != nil {
+			if err != io.EOF {
+				log.Debugf("Error reading from %v: %v", c.RemoteAddr(), err)
+			}
+			return
+		}
+		switch typ {
+		case 'Q':
+			c.query(cstring(msg))
+		case 'X':
+			// Terminate
+			return
+		case 'S':
+			// Sync, ends an extended query
+			inFailedExtendedQuery = false
+			c.readyForQuery()
+		case 'P', 'B', 'D', 'E', 'C', 'H':
+			// Extended query protocol, report error once and then ignore until Sync
+			if !inFailedExtendedQuery {
+				c.sendError(codeFeatureNotSupport, "Extended query protocol is not supported, please use simple queries")
+				inFailedExtendedQuery = true
+			}
+		default:
+			c.sendError(codeProtocolViolation, fmt.Sprintf("Unsupported message type %q", typ))
+			c.readyForQuery()
+		}
+		err = c.w.Flush()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *conn) startup() error {
+	for {
+		msg, err := c.readStartupMessage()
+		if err != nil {
+			return err
+		}
+		if len(msg) < 4 {
+			c.sendError(codeProtocolViolation, "Invalid startup message length")
+			c.w.Flush()
+			return fmt.Errorf("Startup message too short")
+		}
+		code := binary.BigEndian.Uint32(msg)
+		switch code {
+		case sslRequestCode:
+			// We don't support SSL, tell the client to continue without it
+			_, err = c.Write([]byte{'N'})
+			if err != nil {
+				return err
+			}
+			continue
+		case cancelRequestCode:
+			return fmt.Errorf("Cancel requests not supported")
+		case protocolVersion3:
+			// okay
+		default:
+			return fmt.Errorf("Unsupported protocol version %d", code)
+		}
+		break
+	}
+
+	if c.opts.Password != "" {
+		c.writeMessage('R', uint32Bytes(3))
+		err := c.w.Flush()
+		if err != nil {
+			return err
+		}
+		typ, msg, err := c.readMessage()
+		if err != nil {
+			return err
+		}
+		// Compare in constant time so that timing doesn't reveal how much of the
+		// password matched
+		if typ != 'p' || subtle.ConstantTimeCompare([]byte(cstring(msg)), []byte(c.opts.Password)) != 1 {
+			c.sendError(codeInvalidPassword, "Password authentication failed")
+			c.w.Flush()
+			return fmt.Errorf("Password authentication failed")
+		}
+	}
+
+	c.writeMessage('R', uint32Bytes(0))
+	c.parameterStatus("server_version", "9.6.0")
+	c.parameterStatus("server_encoding", "UTF8")
+	c.parameterStatus("client_encoding", "UTF8")
+	c.parameterStatus("DateStyle", "ISO, MDY")
+	c.parameterStatus("TimeZone", "UTC")
+	c.parameterStatus("integer_datetimes", "on")
+	c.readyForQuery()
+	return c.w.Flush()
+}
+
+func (c *conn) query(sqlString string) {
+	defer c.readyForQuery()
+
+	sqlString = strings.TrimSpace(strings.TrimRight(strings.TrimSpace(sqlString), ";"))
+	if sqlString == "" {
+		c.writeMessage('I', nil)
+		return
+	}
+	if !strings.EqualFold(strings.Fields(sqlString)[0], "SELECT") && !sql.IsExecute(sqlString) {
+		c.sendError(codeFeatureNotSupport, "Only SELECT queries and EXECUTE of saved queries are supported")
+		return
+	}
+
+	rs, err := c.db.Query(sqlString, false, nil, false)
+	if err != nil {
+		c.sendError(codeSyntaxError, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.QueryTimeout)
+	defer cancel()
+
+	// If the dims are known up front from the GROUP BY, rows are sent as they
+	// arrive. Otherwise, rows are buffered so that the row description can
+	// include every dim that shows up in the results.
+	dims := core.GroupByNames(rs.GetGroupBy())
+	sort.Strings(dims)
+	streaming := len(dims) > 0
+	var fields core.Fields
+	var buffered []*core.FlatRow
+	described := false
+	numRows := 0
+	err = rs.Iterate(ctx, func(inFields core.Fields) error {
+		fields = inFields
+		if streaming {
+			c.rowDescription(dims, fields)
+			described = true
+		}
+		return nil
+	}, func(row *core.FlatRow) (bool, error) {
+		if !streaming {
+			buffered = append(buffered, row)
+			return true, nil
+		}
+		c.dataRow(dims, row)
+		numRows++
+		if numRows%flushRows == 0 {
+			return true, c.w.Flush()
+		}
+		return true, nil
+	})
+	if err != nil {
+		c.sendError(codeInternalError, err.Error())
+		return
+	}
+
+	if !streaming {
+		dims = dimsIn(buffered)
+	}
+	if !described {
+		c.rowDescription(dims, fields)
+	}
+	for _, row := range buffered {
+		c.dataRow(dims, row)
+		numRows++
+	}
+
+	c.writeMessage('C', cstringBytes(fmt.Sprintf("SELECT %d", numRows)))
+}
+
+func (c *conn) rowDescription(dims []string, fields core.Fields) {
+	desc := uint16Bytes(1 + len(dims) + len(fields))
+	desc = appendColumn(desc, "_time", oidTimestampTZ, 8)
+	for _, dim := range dims {
+		desc = appendColumn(desc, dim, oidText, -1)
+	}
+	for _, field := range fields {
+		desc = appendColumn(desc, field.Name, oidFloat8, 8)
+	}
+	c.writeMessage('T', desc)
+}
+
+func (c *conn) dataRow(dims []string, row *core.FlatRow) {
+	data := uint16Bytes(1 + len(dims) + len(row.Values))
+	data = appendValue(data, []byte(encoding.TimeFromInt(row.TS).In(time.UTC).Format(timestampFormat)))
+	for _, dim := range dims {
+		val := row.Key.Get(dim)
+		if val == nil {
+			data = appendValue(data, nil)
+		} else {
+			data = appendValue(data, []byte(fmt.Sprint(val)))
+		}
+	}
+	for i, val := range row.Values {
+		if row.IsNull(i) {
+			data = appendValue(data, nil)
+		} else {
+			data = appendValue(data, []byte(strconv.FormatFloat(val, 'g', -1, 64)))
+		}
+	}
+	c.writeMessage('D', data)
+}
+
+// dimsIn returns the sorted names of all dims that appear in the given rows.
+func dimsIn(rows []*core.FlatRow) []string {
+	dimsMap := make(map[string]bool)
+	for _, row := range rows {
+		row.Key.Iterate(false, false, func(dim string, value interface{}, valueBytes []byte) bool {
+			dimsMap[dim] = true
+			return true
+		})
+	}
+	dims := make([]string, 0, len(dimsMap))
+	for dim := range dimsMap {
+		dims = append(dims, dim)
+	}
+	sort.Strings(dims)
+	return dims
+}
+
+func (c *conn) readStartupMessage() ([]byte, error) {
+	lenBytes := make([]byte, 4)
+	_, err := io.ReadFull(c.r, lenBytes)
+	if err != nil {
+		return nil, err
+	}
+	return c.readBody(lenBytes)
+}
+
+func (c *conn) readMessage() (byte, []byte, error) {
+	header := make([]byte, 5)
+	_, err := io.ReadFull(c.r, header)
+	if err != nil {
+		return 0, nil, err
+	}
+	msg, err := c.readBody(header[1:])
+	return header[0], msg, err
+}
+
+func (c *conn) readBody(lenBytes []byte) ([]byte, error) {
+	l := int(binary.BigEndian.Uint32(lenBytes)) - 4
+	if l < 0 || l > maxMessageSize {
+		return nil, fmt.Errorf("Invalid message length %d", l)
+	}
+	msg := make([]byte, l)
+	_, err := io.ReadFull(c.r, msg)
+	return msg, err
+}
+
+func (c *conn) writeMessage(typ byte, msg []byte) {
+	c.w.WriteByte(typ)
+	c.w.Write(uint32Bytes(len(msg) + 4))
+	c.w.Write(msg)
+}
+
+func (c *conn) parameterStatus(name string, value string) {
+	c.writeMessage('S', append(cstringBytes(name), cstringBytes(value)...))
+}
+
+func (c *conn) readyForQuery() {
+	c.writeMessage('Z', []byte{'I'})
+}
+
+func (c *conn) sendError(code string, msg string) {
+	log.Debugf("Sending error to %v: %v", c.RemoteAddr(), msg)
+	var b []byte
+	b = append(b, 'S')
+	b = append(b, cstringBytes("ERROR")...)
+	b = append(b, 'C')
+	b = append(b, cstringBytes(code)...)
+	b = append(b, 'M')
+	b = append(b, cstringBytes(msg)...)
+	b = append(b, 0)
+	c.writeMessage('E', b)
+}
+
+func appendColumn(b []byte, name string, oid int, size int) []byte {
+	b = append(b, cstringBytes(name)...)
+	b = append(b, uint32Bytes(0)...) // table oid
+	b = append(b, uint16Bytes(0)...) // column attribute number
+	b = append(b, uint32Bytes(oid)...)
+	b = append(b, uint16Bytes(size)...)
+	b = append(b, uint32Bytes(-1)...) // type modifier
+	b = append(b, uint16Bytes(0)...)  // text format
+	return b
+}
+
+func appendValue(b []byte, val []byte) []byte {
+	if val == nil {
+		return append(b, uint32Bytes(-1)...)
+	}
+	b = append(b, uint32Bytes(len(val))...)
+	return append(b, val...)
+}
+
+func cstring(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
+
+func cstringBytes(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+func uint32Bytes(i int) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(i))
+	return b
+}
+
+func uint16Bytes(i int) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(i))
+	return b
+}
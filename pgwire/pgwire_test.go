@@ -0,0 +1,233 @@
+package pgwire
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/goexpr"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/expr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuery(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	go Serve(&mockDB{}, l, &Opts{Password: "password"})
+
+	nc, err := net.Dial("tcp", l.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer nc.Close()
+	c := &client{nc, bufio.NewReader(nc)}
+
+	// SSL request should be declined
+	c.send(0, append(uint32Bytes(8), uint32Bytes(sslRequestCode)...)[4:])
+	b := make([]byte, 1)
+	io.ReadFull(c.r, b)
+	assert.Equal(t, byte('N'), b[0])
+
+	startup := uint32Bytes(protocolVersion3)
+	startup = append(startup, cstringBytes("user")...)
+	startup = append(startup, cstringBytes("test")...)
+	startup = append(startup, 0)
+	c.send(0, startup)
+	typ, msg := c.read()
+	if !assert.Equal(t, byte('R'), typ) || !assert.Equal(t, uint32(3), binary.BigEndian.Uint32(msg)) {
+		return
+	}
+	c.send('p', cstringBytes("password"))
+	typ, msg = c.read()
+	assert.Equal(t, byte('R'), typ)
+	assert.Equal(t, uint32(0), binary.BigEndian.Uint32(msg))
+	c.readUntilReady()
+
+	c.send('Q', cstringBytes("DELETE FROM table"))
+	msgs := c.readUntilReady()
+	if assert.Len(t, msgs, 1) {
+		assert.Equal(t, byte('E'), msgs[0][0])
+	}
+
+	c.send('Q', cstringBytes("SELECT * FROM table;"))
+	msgs = c.readUntilReady()
+	if !assert.Len(t, msgs, 4) {
+		return
+	}
+	assert.Equal(t, byte('T'), msgs[0][0])
+	assert.Equal(t, 3, int(binary.BigEndian.Uint16(msgs[0][1:])))
+	assert.Equal(t, byte('D'), msgs[1][0])
+	assert.Equal(t, []string{"2017-04-01 10:00:00Z", "a", "1.5"}, dataRowValues(msgs[1][1:]))
+	assert.Equal(t, []string{"2017-04-01 10:01:00Z", "", "2"}, dataRowValues(msgs[2][1:]))
+	assert.Equal(t, "SELECT 2", cstring(msgs[3][1:]))
+
+	// With dims known from the GROUP BY, rows are streamed
+	c.send('Q', cstringBytes("SELECT * FROM table GROUP BY dim"))
+	msgs = c.readUntilReady()
+	if !assert.Len(t, msgs, 4) {
+		return
+	}
+	assert.Equal(t, byte('T'), msgs[0][0])
+	assert.Equal(t, 3, int(binary.BigEndian.Uint16(msgs[0][1:])))
+	assert.Equal(t, []string{"2017-04-01 10:00:00Z", "a", "1.5"}, dataRowValues(msgs[1][1:]))
+	assert.Equal(t, []string{"2017-04-01 10:01:00Z", "", "2"}, dataRowValues(msgs[2][1:]))
+	assert.Equal(t, "SELECT 2", cstring(msgs[3][1:]))
+}
+
+func TestBadPassword(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	go Serve(&mockDB{}, l, &Opts{Password: "password"})
+
+	nc, err := net.Dial("tcp", l.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer nc.Close()
+	c := &client{nc, bufio.NewReader(nc)}
+	c.send(0, append(uint32Bytes(protocolVersion3), 0))
+	c.read()
+	c.send('p', cstringBytes("wrong"))
+	typ, _ := c.read()
+	assert.Equal(t, byte('E'), typ)
+}
+
+func TestEmptyStartupMessage(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	go Serve(&mockDB{}, l, &Opts{})
+
+	nc, err := net.Dial("tcp", l.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer nc.Close()
+	c := &client{nc, bufio.NewReader(nc)}
+	c.send(0, nil)
+	typ, msg := c.read()
+	if assert.Equal(t, byte('E'), typ) {
+		assert.Contains(t, string(msg), codeProtocolViolation)
+	}
+}
+
+type client struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *client) send(typ byte, msg []byte) {
+	var b []byte
+	if typ != 0 {
+		b = append(b, typ)
+	}
+	b = append(b, uint32Bytes(len(msg)+4)...)
+	c.Write(append(b, msg...))
+}
+
+func (c *client) read() (byte, []byte) {
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, 5)
+	_, err := io.ReadFull(c.r, header)
+	if err != nil {
+		return 0, nil
+	}
+	msg := make([]byte, int(binary.BigEndian.Uint32(header[1:]))-4)
+	io.ReadFull(c.r, msg)
+	return header[0], msg
+}
+
+// readUntilReady reads messages until ReadyForQuery, returning each message
+// prefixed by its type.
+func (c *client) readUntilReady() [][]byte {
+	var msgs [][]byte
+	for {
+		typ, msg := c.read()
+		switch typ {
+		case 'Z', 0:
+			return msgs
+		case 'S':
+			// ignore parameter status
+		default:
+			msgs = append(msgs, append([]byte{typ}, msg...))
+		}
+	}
+}
+
+func dataRowValues(msg []byte) []string {
+	n := int(binary.BigEndian.Uint16(msg))
+	msg = msg[2:]
+	var vals []string
+	for i := 0; i < n; i++ {
+		l := int(int32(binary.BigEndian.Uint32(msg)))
+		msg = msg[4:]
+		if l < 0 {
+			vals = append(vals, "")
+			continue
+		}
+		vals = append(vals, string(msg[:l]))
+		msg = msg[l:]
+	}
+	return vals
+}
+
+type mockDB struct{}
+
+func (db *mockDB) Query(sqlString string, isSubQuery bool, subQueryResults [][]interface{}, includeMemStore bool) (core.FlatRowSource, error) {
+	source := &mockSource{}
+	if strings.HasSuffix(sqlString, "GROUP BY dim") {
+		source.groupBy = []core.GroupBy{core.NewGroupBy("dim", goexpr.Param("dim"))}
+	}
+	return source, nil
+}
+
+type mockSource struct {
+	groupBy []core.GroupBy
+}
+
+func (s *mockSource) Iterate(ctx context.Context, onFields core.OnFields, onRow core.OnFlatRow) error {
+	err := onFields(core.Fields{core.NewField("val", expr.SUM("val"))})
+	if err != nil {
+		return err
+	}
+	ts := time.Date(2017, 4, 1, 10, 0, 0, 0, time.UTC)
+	onRow(&core.FlatRow{TS: ts.UnixNano(), Key: bytemap.New(map[string]interface{}{"dim": "a"}), Values: []float64{1.5}})
+	onRow(&core.FlatRow{TS: ts.Add(time.Minute).UnixNano(), Key: bytemap.New(nil), Values: []float64{2}})
+	return nil
+}
+
+func (s *mockSource) GetGroupBy() []core.GroupBy {
+	return s.groupBy
+}
+
+func (s *mockSource) GetResolution() time.Duration {
+	return time.Minute
+}
+
+func (s *mockSource) GetAsOf() time.Time {
+	return encoding.TimeFromInt(0)
+}
+
+func (s *mockSource) GetUntil() time.Time {
+	return encoding.TimeFromInt(0)
+}
+
+func (s *mockSource) String() string {
+	return "mock"
+}
@@ -0,0 +1,127 @@
+package zenodb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/getlantern/yaml"
+)
+
+// PlacementOpts constrains which followers a leader allows to follow each
+// partition, based on the labels that followers advertise (see DBOpts.Labels).
+// Followers that would violate the constraints are rejected with a
+// *PlacementError and keep retrying until they're allowed to follow.
+type PlacementOpts struct {
+	// Constraints lists labels that followers of specific partitions must have,
+	// keyed by partition. For example {0: {zone: eu-west-1a}} only allows
+	// followers in zone eu-west-1a to follow partition 0.
+	Constraints map[int]map[string]string `yaml:"constraints"`
+	// AntiAffinity lists labels, like rack, that need to differ between the
+	// followers of the same partition and stream, so that a single rack failure
+	// can't take out all copies of a partition. Followers that don't have these
+	// labels are rejected.
+	AntiAffinity []string `yaml:"antiaffinity"`
+}
+
+// LoadPlacement loads PlacementOpts from the YAML file at the given path.
+func LoadPlacement(filename string) (*PlacementOpts, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read placement from %v: %v", filename, err)
+	}
+	placement := &PlacementOpts{}
+	err = yaml.Unmarshal(b, placement)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse placement from %v: %v", filename, err)
+	}
+	return placement, nil
+}
+
+// ParseLabels parses labels like "rack=r1,zone=eu-west-1a".
+func ParseLabels(labels string) (map[string]string, error) {
+	result := make(map[string]string)
+	for _, label := range strings.Split(labels, ",") {
+		label = strings.TrimSpace(label)
+		if label == "" {
+			continue
+		}
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("Invalid label %q, must look like key=value", label)
+		}
+		result[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return result, nil
+}
+
+// PlacementError indicates that a follower was not allowed to follow because
+// doing so would violate the leader's PlacementOpts.
+type PlacementError struct {
+	Stream    string
+	Partition int
+	Reason    string
+}
+
+func (e *PlacementError) Error() string {
+	return fmt.Sprintf("placement rejected: partition %d of stream %v: %v", e.Partition, e.Stream, e.Reason)
+}
+
+func (opts *PlacementOpts) validate(numPartitions int) error {
+	for partition := range opts.Constraints {
+		if partition < 0 || partition >= numPartitions {
+			return fmt.Errorf("Invalid partition %d in placement constraints, must be between 0 and %d", partition, numPartitions-1)
+		}
+	}
+	return nil
+}
+
+// place checks the given follower against the placement constraints and, if
+// it's allowed, records it as placed so that subsequent followers are checked
+// against it. Callers must unplace the follower once it's done following.
+func (db *DB) place(f *follower) *PlacementError {
+	db.clusterStatusMx.Lock()
+	defer db.clusterStatusMx.Unlock()
+
+	placement := db.opts.Placement
+	if placement != nil {
+		reject := func(reason string, args ...interface{}) *PlacementError {
+			db.placementRejections++
+			return &PlacementError{Stream: f.Stream, Partition: f.PartitionNumber, Reason: fmt.Sprintf(reason, args...)}
+		}
+
+		required := placement.Constraints[f.PartitionNumber]
+		keys := make([]string, 0, len(required))
+		for key := range required {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if f.Labels[key] != required[key] {
+				return reject("requires %v=%v but follower has %v=%v", key, required[key], key, f.Labels[key])
+			}
+		}
+
+		for _, key := range placement.AntiAffinity {
+			value, found := f.Labels[key]
+			if !found {
+				return reject("follower is missing label %v", key)
+			}
+			for other := range db.placedFollowers {
+				if other.Stream == f.Stream && other.PartitionNumber == f.PartitionNumber && !other.failed() && other.Labels[key] == value {
+					return reject("already followed by %v with %v=%v", other.Addr, key, value)
+				}
+			}
+		}
+	}
+
+	db.placedFollowers[f] = true
+	return nil
+}
+
+func (db *DB) unplace(f *follower) {
+	db.clusterStatusMx.Lock()
+	delete(db.placedFollowers, f)
+	db.clusterStatusMx.Unlock()
+}
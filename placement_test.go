@@ -0,0 +1,69 @@
+package zenodb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlacement(t *testing.T) {
+	db := &DB{
+		opts: &DBOpts{
+			NumPartitions: 2,
+			Placement: &PlacementOpts{
+				Constraints:  map[int]map[string]string{0: {"zone": "a"}},
+				AntiAffinity: []string{"rack"},
+			},
+		},
+		activeFollowers: make(map[int]*follower),
+		queryLatencies:  make(map[int]time.Duration),
+		placedFollowers: make(map[*follower]bool),
+	}
+
+	newFollower := func(stream string, partition int, labels map[string]string) *follower {
+		return &follower{Follow: common.Follow{Stream: stream, PartitionNumber: partition, Labels: labels}}
+	}
+
+	first := newFollower("thestream", 0, map[string]string{"zone": "a", "rack": "r1"})
+	assert.Nil(t, db.place(first))
+
+	err := db.place(newFollower("thestream", 0, map[string]string{"zone": "b", "rack": "r2"}))
+	if assert.NotNil(t, err, "follower in wrong zone should be rejected") {
+		assert.Equal(t, 0, err.Partition)
+		assert.Contains(t, err.Error(), "requires zone=a")
+	}
+	err = db.place(newFollower("thestream", 0, map[string]string{"zone": "a", "rack": "r1"}))
+	if assert.NotNil(t, err, "second follower in same rack should be rejected") {
+		assert.Contains(t, err.Error(), "rack=r1")
+	}
+	err = db.place(newFollower("thestream", 1, map[string]string{"zone": "b"}))
+	if assert.NotNil(t, err, "follower without rack should be rejected") {
+		assert.Contains(t, err.Error(), "missing label rack")
+	}
+
+	assert.Nil(t, db.place(newFollower("thestream", 0, map[string]string{"zone": "a", "rack": "r2"})), "follower in other rack should be allowed")
+	assert.Nil(t, db.place(newFollower("otherstream", 0, map[string]string{"zone": "a", "rack": "r1"})), "anti-affinity only applies within a stream")
+	assert.Nil(t, db.place(newFollower("thestream", 1, map[string]string{"rack": "r1"})), "anti-affinity only applies within a partition")
+
+	first.markFailed()
+	assert.Nil(t, db.place(newFollower("thestream", 0, map[string]string{"zone": "a", "rack": "r1"})), "failed followers shouldn't count")
+	db.unplace(first)
+	assert.False(t, db.placedFollowers[first])
+
+	assert.EqualValues(t, 3, db.ClusterStatus().PlacementRejections)
+
+	assert.Error(t, (&PlacementOpts{Constraints: map[int]map[string]string{2: {"zone": "a"}}}).validate(2))
+}
+
+func TestParseLabels(t *testing.T) {
+	labels, err := ParseLabels(" rack=r1, zone = eu-west-1a,")
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]string{"rack": "r1", "zone": "eu-west-1a"}, labels)
+	}
+	_, err = ParseLabels("rack")
+	assert.Error(t, err)
+	_, err = ParseLabels("=r1")
+	assert.Error(t, err)
+}
@@ -0,0 +1,61 @@
+package planner
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/sql"
+)
+
+// ACL restricts what a query is allowed to access.
+type ACL struct {
+	// Tables, if specified, restricts queries to the named tables.
+	Tables []string
+	// Dims, if specified, restricts queries to the named dimensions. Queries
+	// that filter or group on other dimensions are rejected and queries that
+	// group by all dimensions only see these.
+	Dims []string
+	// Filter, if specified, is a boolean SQL expression like tenant_id = 5 that
+	// is ANDed with the WHERE clause of every query that reads from a table.
+	Filter string
+}
+
+func (acl *ACL) allowsTable(table string) bool {
+	if len(acl.Tables) == 0 {
+		return true
+	}
+	for _, candidate := range acl.Tables {
+		if strings.EqualFold(candidate, table) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyACL rewrites the given SQL to enforce the ACL from opts and returns
+// Opts that only allow access to the ACL's tables. The returned Opts don't
+// include the ACL, so that subqueries, which have already been rewritten, don't
+// get rewritten again.
+func applyACL(sqlString string, opts *Opts) (string, *Opts, error) {
+	acl := opts.ACL
+	restricted, err := sql.Restrict(sqlString, acl.Dims, acl.Filter)
+	if err != nil {
+		return "", nil, err
+	}
+	if restricted != sqlString {
+		log.Debugf("Restricted query to %v", restricted)
+	}
+
+	restrictedOpts := &Opts{}
+	*restrictedOpts = *opts
+	restrictedOpts.ACL = nil
+	getTable := opts.GetTable
+	restrictedOpts.GetTable = func(table string, includedFields func(tableFields core.Fields) (core.Fields, error)) (Table, error) {
+		if !acl.allowsTable(table) {
+			return nil, fmt.Errorf("Access to table %v is not allowed", table)
+		}
+		return getTable(table, includedFields)
+	}
+	return restricted, restrictedOpts, nil
+}
@@ -0,0 +1,58 @@
+package planner
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestACL(t *testing.T) {
+	acl := &ACL{
+		Tables: []string{"tablea"},
+		Dims:   []string{"x"},
+		Filter: "x = 1",
+	}
+
+	verify := func(plan FlatRowSource) {
+		var rows []*FlatRow
+		err := plan.Iterate(context.Background(), func(fields Fields) error {
+			return nil
+		}, func(row *FlatRow) (bool, error) {
+			rows = append(rows, row)
+			return true, nil
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+		if assert.Len(t, rows, 4) {
+			for _, row := range rows {
+				assert.Equal(t, 1, row.Key.Get("x"), "Only rows matching filter should be included")
+				assert.Nil(t, row.Key.Get("y"), "Disallowed dims should be excluded")
+			}
+		}
+	}
+
+	opts := defaultOpts()
+	opts.ACL = acl
+	plan, err := Plan("SELECT * FROM tablea", opts)
+	if assert.NoError(t, err) {
+		verify(plan)
+	}
+
+	opts.QueryCluster = queryCluster
+	plan, err = Plan("SELECT * FROM tablea", opts)
+	if assert.NoError(t, err) {
+		verify(plan)
+	}
+
+	_, err = Plan("SELECT * FROM tableb", opts)
+	assert.Error(t, err, "Querying disallowed table should fail")
+
+	_, err = Plan("SELECT * FROM tablea WHERE y = 3", opts)
+	assert.Error(t, err, "Filtering on disallowed dim should fail")
+
+	_, err = Plan("SELECT * FROM tablea WHERE x IN (SELECT x FROM tableb)", opts)
+	assert.Error(t, err, "Subquery on disallowed table should fail")
+}
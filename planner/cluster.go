@@ -8,6 +8,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/getlantern/goexpr"
 	"github.com/getlantern/zenodb/core"
 	"github.com/getlantern/zenodb/sql"
 )
@@ -230,7 +231,24 @@ func planClusterNonPushdown(opts *Opts, query *sql.Query) (core.FlatRowSource, e
 			groupByParts = append(groupByParts, "*")
 		}
 	}
-	if hasGroupBy {
+	pushGroupByDown := hasGroupBy && !query.GroupByAll
+	for _, groupBy := range query.GroupBy {
+		if query.GroupBySQL[groupBy.Name] == "" {
+			pushGroupByDown = false
+		}
+	}
+	if pushGroupByDown {
+		// Have partitions group by the actual expressions so that they return
+		// partial aggregates at the same granularity as the final result. The
+		// leader then only has to merge these by name.
+		for _, groupBy := range query.GroupBy {
+			groupBySQL := query.GroupBySQL[groupBy.Name]
+			if groupBySQL != groupBy.Name {
+				groupBySQL = fmt.Sprintf("%v as %v", groupBySQL, groupBy.Name)
+			}
+			groupByParts = append(groupByParts, groupBySQL)
+		}
+	} else if hasGroupBy {
 		groupByParams := make(map[string]bool)
 		for _, groupBy := range query.GroupBy {
 			groupBy.Expr.WalkParams(func(name string) {
@@ -282,6 +300,15 @@ func planClusterNonPushdown(opts *Opts, query *sql.Query) (core.FlatRowSource, e
 	if query.Resolution > pail.GetResolution() {
 		query.Resolution = pail.GetResolution()
 	}
+	if pushGroupByDown {
+		// Partitions already evaluated the group by expressions, so just merge by
+		// the resulting dimensions
+		mergeBy := make([]core.GroupBy, 0, len(query.GroupBy))
+		for _, groupBy := range query.GroupBy {
+			mergeBy = append(mergeBy, core.NewGroupBy(groupBy.Name, goexpr.Param(groupBy.Name)))
+		}
+		query.GroupBy = mergeBy
+	}
 	// Pass through fields since the remote query already has the correct ones
 	query.Fields = core.PassthroughFieldSource
 	// Pass through asOf, until and resolution since the remote query already has
@@ -16,6 +16,7 @@ func planLocal(query *sql.Query, opts *Opts) (core.FlatRowSource, error) {
 	fixupSubQuery(query, opts)
 
 	var source core.RowSource
+	var lookback time.Duration
 	var err error
 	if query.FromSubQuery != nil {
 		source, err = sourceForSubQuery(query, opts)
@@ -23,7 +24,7 @@ func planLocal(query *sql.Query, opts *Opts) (core.FlatRowSource, error) {
 			return nil, err
 		}
 	} else {
-		source, err = sourceForTable(query, opts)
+		source, lookback, err = sourceForTable(query, opts)
 		if err != nil {
 			return nil, err
 		}
@@ -37,6 +38,12 @@ func planLocal(query *sql.Query, opts *Opts) (core.FlatRowSource, error) {
 		return nil, err
 	}
 
+	if tr, ok := source.(TimeRangeable); ok && (asOfChanged || untilChanged) {
+		// Periods outside of the query's time range are dropped by the group by
+		// anyway, so the table doesn't need to decode them
+		source = tr.WithTimeRange(asOf.Add(-1*lookback), until)
+	}
+
 	if query.Where != nil {
 		source, err = applySubQueryFilters(query, opts, source)
 		if err != nil {
@@ -68,8 +75,22 @@ func sourceForSubQuery(query *sql.Query, opts *Opts) (core.RowSource, error) {
 	return core.Unflatten(subSource, query.FieldsNoHaving), nil
 }
 
-func sourceForTable(query *sql.Query, opts *Opts) (core.RowSource, error) {
-	return opts.GetTable(query.From, func(tableFields core.Fields) (core.Fields, error) {
+// sourceForTable returns the table queried by the given query, along with how
+// far before the query's asOf the query needs data from it, which is the case
+// for fields that are SHIFTed back in time.
+func sourceForTable(query *sql.Query, opts *Opts) (core.RowSource, time.Duration, error) {
+	var lookback time.Duration
+	t, err := opts.GetTable(query.From, func(tableFields core.Fields) (core.Fields, error) {
+		fields, err := query.Fields.Get(tableFields)
+		if err != nil {
+			return nil, err
+		}
+		for _, field := range fields {
+			if shiftBack := -1 * field.Expr.Shift(); shiftBack > lookback {
+				lookback = shiftBack
+			}
+		}
+
 		if query.HasSelectAll {
 			// For SELECT *, include all table fields
 			return tableFields, nil
@@ -79,10 +100,6 @@ func sourceForTable(query *sql.Query, opts *Opts) (core.RowSource, error) {
 
 		// Otherwise, figure out minimum set of fields needed by query
 		includedFields := make([]bool, len(tableFields))
-		fields, err := query.Fields.Get(tableFields)
-		if err != nil {
-			return nil, err
-		}
 		for _, field := range fields {
 			sms := field.Expr.SubMergers(tableExprs)
 			for i, sm := range sms {
@@ -101,6 +118,17 @@ func sourceForTable(query *sql.Query, opts *Opts) (core.RowSource, error) {
 
 		return result, nil
 	})
+	if err != nil {
+		return nil, 0, err
+	}
+	// Dims pinned by the WHERE clause can be checked during the table scan. The
+	// WHERE clause is still applied in full afterwards.
+	if kf, ok := t.(KeyFilterable); ok {
+		if filter := core.NewKeyFilter(query.PinnedDims); filter != nil {
+			return kf.WithKeyFilter(filter), lookback, nil
+		}
+	}
+	return t, lookback, nil
 }
 
 func asOfUntilFor(query *sql.Query, opts *Opts, source core.RowSource, now time.Time) (time.Time, bool, time.Time, bool) {
@@ -175,7 +203,7 @@ func applySubQueryFilters(query *sql.Query, opts *Opts, source core.RowSource) (
 	return core.RowFilter(source, query.WhereSQL, func(ctx context.Context, key bytemap.ByteMap, fields core.Fields, vals core.Vals) (bytemap.ByteMap, core.Vals, error) {
 		if atomic.CompareAndSwapInt32(&hasRunSubqueries, 0, 1) {
 			_, err := runSubQueries(ctx)
-			if err != nil && err != core.ErrDeadlineExceeded {
+			if err != nil && !core.IsDeadlineExceeded(err) {
 				return nil, nil, err
 			}
 		}
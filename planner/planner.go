@@ -4,13 +4,13 @@ package planner
 import (
 	"time"
 
-	"github.com/getlantern/golog"
 	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/logging"
 	"github.com/getlantern/zenodb/sql"
 )
 
 var (
-	log = golog.LoggerFor("planner")
+	log = logging.LoggerFor("planner")
 )
 
 type Table interface {
@@ -18,15 +18,44 @@ type Table interface {
 	GetPartitionBy() []string
 }
 
+// KeyFilterable is implemented by Tables that can skip keys that don't match a
+// core.KeyFilter while scanning, which saves decoding the data stored under
+// those keys.
+type KeyFilterable interface {
+	Table
+	// WithKeyFilter returns a copy of the Table that only reads keys matching
+	// the given filter.
+	WithKeyFilter(filter *core.KeyFilter) Table
+}
+
+// TimeRangeable is implemented by Tables that can skip the periods outside of
+// a query's time range while scanning, which saves decoding them.
+type TimeRangeable interface {
+	Table
+	// WithTimeRange returns a copy of the Table that only reads periods between
+	// asOf and until.
+	WithTimeRange(asOf time.Time, until time.Time) Table
+}
+
 type Opts struct {
 	GetTable        func(table string, includedFields func(tableFields core.Fields) (core.Fields, error)) (Table, error)
 	Now             func(table string) time.Time
 	IsSubQuery      bool
 	SubQueryResults [][]interface{}
 	QueryCluster    QueryClusterFN
+	// ACL, if specified, restricts what the query is allowed to access.
+	ACL *ACL
 }
 
 func Plan(sqlString string, opts *Opts) (core.FlatRowSource, error) {
+	if opts.ACL != nil {
+		var err error
+		sqlString, opts, err = applyACL(sqlString, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	query, err := sql.Parse(sqlString)
 	if err != nil {
 		return nil, err
@@ -65,10 +94,14 @@ func addGroupBy(source core.RowSource, query *sql.Query, applyResolution bool, r
 		AsOf:        query.AsOf,
 		Until:       query.Until,
 		StrideSlice: strideSlice,
+		MaxBytes:    query.Hints.MaxMemory,
 	}
 	if applyResolution {
 		opts.Resolution = resolution
 	}
+	if timeDims := core.TimeDimsIn(query.GroupBy); len(timeDims) > 0 {
+		source = core.DeriveTimeDims(source, timeDims)
+	}
 	return core.Group(source, opts)
 }
 
@@ -133,7 +133,7 @@ func TestPlans(t *testing.T) {
 
 	nonPushdownScenario("Unknown dim, pushdown not allowed",
 		"SELECT * FROM TableA GROUP BY CONCAT('_', u, v) AS c",
-		"select * from TableA group by u, v",
+		"select * from TableA group by concat('_', u, v) as c",
 		func(source RowSource) RowSource {
 			return Group(source, GroupOpts{
 				Fields: textFieldSource("*"),
@@ -145,7 +145,7 @@ func TestPlans(t *testing.T) {
 		},
 		GroupOpts{
 			Fields: textFieldSource("passthrough"),
-			By:     []GroupBy{NewGroupBy("c", goexpr.Concat(goexpr.Constant("_"), goexpr.Param("u"), goexpr.Param("v")))},
+			By:     []GroupBy{NewGroupBy("c", goexpr.Param("c"))},
 		})
 
 	nonPushdownScenario("CROSSTAB, pushdown not allowed",
@@ -356,7 +356,7 @@ func TestPlans(t *testing.T) {
 
 	nonPushdownScenario("HAVING clause with group by on non partition key, pushdown not allowed",
 		"SELECT * FROM TableA GROUP BY CONCAT(',', z, 'thing') as zplus HAVING a+b > 0",
-		"select *, a+b > 0 as _having from TableA group by z",
+		"select *, a+b > 0 as _having from TableA group by concat(',', z, 'thing') as zplus",
 		func(source RowSource) RowSource {
 			return Group(source, GroupOpts{
 				Fields: textFieldSource("*, a+b > 0 AS _having"),
@@ -368,7 +368,7 @@ func TestPlans(t *testing.T) {
 		},
 		GroupOpts{
 			Fields: textFieldSource("passthrough"),
-			By:     []GroupBy{NewGroupBy("zplus", goexpr.Concat(goexpr.Constant(","), goexpr.Param("z"), goexpr.Constant("thing")))},
+			By:     []GroupBy{NewGroupBy("zplus", goexpr.Param("zplus"))},
 		})
 
 	pushdownScenario("ASOF",
@@ -63,7 +63,7 @@ func planSubQueries(opts *Opts, query *sql.Query) (func(ctx context.Context) ([]
 				err := sqPlan.Iterate(ctx, core.FieldsIgnored, onRow)
 
 				dims := make([]interface{}, 0, len(uniques))
-				if err == nil || err == core.ErrDeadlineExceeded {
+				if err == nil || core.IsDeadlineExceeded(err) {
 					for dim := range uniques {
 						dims = append(dims, dim)
 					}
@@ -80,7 +80,7 @@ func planSubQueries(opts *Opts, query *sql.Query) (func(ctx context.Context) ([]
 			sqResultCh := <-sqResultChs
 			result := <-sqResultCh
 			err := result.err
-			if err != nil && (finalErr == nil || finalErr == core.ErrDeadlineExceeded) {
+			if err != nil && (finalErr == nil || core.IsDeadlineExceeded(finalErr)) {
 				finalErr = err
 			}
 			subQueryResults = append(subQueryResults, result.dims)
@@ -3,47 +3,130 @@ package zenodb
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/getlantern/bytemap"
 	"github.com/getlantern/zenodb/common"
 	"github.com/getlantern/zenodb/core"
 	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/expr"
 	"github.com/getlantern/zenodb/planner"
+	"github.com/getlantern/zenodb/sql"
 )
 
 func (db *DB) Query(sqlString string, isSubQuery bool, subQueryResults [][]interface{}, includeMemStore bool) (core.FlatRowSource, error) {
+	return db.query(sqlString, isSubQuery, subQueryResults, includeMemStore, false, nil, nil)
+}
+
+// QueryWithACL is like Query but only allows the query to access what the
+// given planner.ACL allows. A nil acl allows everything.
+func (db *DB) QueryWithACL(sqlString string, isSubQuery bool, subQueryResults [][]interface{}, includeMemStore bool, acl *planner.ACL) (core.FlatRowSource, error) {
+	return db.query(sqlString, isSubQuery, subQueryResults, includeMemStore, false, acl, nil)
+}
+
+// QueryContext runs the given SQL query and calls onRow with each of the
+// resulting rows until onRow returns false or an error, or until ctx is done.
+// If ctx has a deadline, the query returns ErrQueryTimeout once it passes.
+func (db *DB) QueryContext(ctx context.Context, sqlString string, includeMemStore bool, onFields core.OnFields, onRow core.OnFlatRow) error {
+	ctxErr := ctx.Err()
+	if ctxErr != nil {
+		return ctxErr
+	}
+	source, err := db.Query(sqlString, false, nil, includeMemStore)
+	if err != nil {
+		return err
+	}
+	return source.Iterate(ctx, onFields, onRow)
+}
+
+// query plans the given query. forLeader indicates that the query runs on
+// behalf of the leader, either on a follower or on the leader's LocalPartition.
+// Such queries only read local tables and don't enforce the
+// MaxConcurrentQueries limit of tenants, since the leader has already admitted
+// them. If asOf is specified, the query sees the data as of that point in the
+// WAL.
+func (db *DB) query(sqlString string, isSubQuery bool, subQueryResults [][]interface{}, includeMemStore bool, forLeader bool, acl *planner.ACL, asOf *asOfSpec) (core.FlatRowSource, error) {
+	sqlString, err := db.ExpandSavedQuery(sqlString)
+	if err != nil {
+		return nil, err
+	}
+	var tenants []*tenant
 	opts := &planner.Opts{
 		GetTable: func(table string, outFields func(tableFields core.Fields) (core.Fields, error)) (planner.Table, error) {
-			return db.getQueryable(table, outFields, includeMemStore)
+			if t := db.tenantFor(table); t != nil && t.limitsQueries() && !containsTenant(tenants, t) {
+				tenants = append(tenants, t)
+			}
+			return db.getQueryable(table, outFields, includeMemStore, asOf)
+		},
+		Now: func(table string) time.Time {
+			return asOf.now(db.clock)
 		},
-		Now:             db.now,
 		IsSubQuery:      isSubQuery,
 		SubQueryResults: subQueryResults,
+		ACL:             acl,
 	}
-	if db.opts.Passthrough {
+	if db.opts.Passthrough && !forLeader {
 		opts.QueryCluster = func(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) error {
 			return db.queryCluster(ctx, sqlString, isSubQuery, subQueryResults, includeMemStore, unflat, onFields, onRow, onFlatRow)
 		}
 	}
 	plan, err := planner.Plan(sqlString, opts)
 	if err != nil {
-		return nil, err
+		return nil, sql.Locate(err, sqlString)
+	}
+	if !forLeader && len(tenants) > 0 {
+		plan = &admittedSource{plan, tenants}
 	}
 	log.Debugf("\n------------ Query Plan ------------\n\n%v\n\n%v\n----------- End Query Plan ----------", sqlString, core.FormatSource(plan))
 	return plan, nil
 }
 
-func (db *DB) getQueryable(table string, outFields func(tableFields core.Fields) (core.Fields, error), includeMemStore bool) (*queryable, error) {
+// tableNames returns the names of the tables that can be queried.
+func (db *DB) tableNames() []string {
+	tables := db.allTables()
+	names := make([]string, 0, len(tables))
+	for _, t := range tables {
+		if !t.Virtual && !strings.HasPrefix(t.Name, shadowTablePrefix) {
+			names = append(names, t.Name)
+		}
+	}
+	return names
+}
+
+func containsTenant(tenants []*tenant, t *tenant) bool {
+	for _, candidate := range tenants {
+		if candidate == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *DB) getQueryable(table string, outFields func(tableFields core.Fields) (core.Fields, error), includeMemStore bool, asOf *asOfSpec) (*queryable, error) {
 	t := db.getTable(table)
 	if t == nil {
-		return nil, fmt.Errorf("Table %v not found", table)
+		return nil, &common.SQLError{Kind: common.ErrUnknownTable, Msg: fmt.Sprintf("Table %v not found", table), Token: table, Suggestions: sql.Suggest(table, db.tableNames())}
 	}
 	if t.Virtual {
 		return nil, fmt.Errorf("Table %v is virtual and cannot be queried", table)
 	}
-	until := encoding.RoundTimeUp(db.clock.Now(), t.Resolution)
-	asOf := encoding.RoundTimeUp(until.Add(-1*t.RetentionPeriod), t.Resolution)
+	until := encoding.RoundTimeUp(asOf.now(db.clock), t.Resolution)
+	from := encoding.RoundTimeUp(until.Add(-1*t.retentionPeriod()), t.Resolution)
+	if asOf != nil {
+		// Data older than the WAL can't be replayed
+		walStart, err := t.walStart()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to determine start of WAL for table %v: %v", table, err)
+		}
+		walStart = encoding.RoundTimeDown(walStart, t.Resolution)
+		if !walStart.Before(until) {
+			return nil, common.Errorf(common.ErrOutsideHotPeriod, "WAL for table %v only goes back to %v", table, walStart)
+		}
+		if walStart.After(from) {
+			from = walStart
+		}
+	}
 	fields := t.getFields()
 	out, err := outFields(fields)
 	if err != nil {
@@ -52,25 +135,120 @@ func (db *DB) getQueryable(table string, outFields func(tableFields core.Fields)
 	if out == nil {
 		out = t.getFields()
 	}
-	return &queryable{t, out, asOf, until, includeMemStore}, nil
+	return &queryable{t: t, fields: out, asOf: from, until: until, includeMemStore: includeMemStore, walAsOf: asOf}, nil
 }
 
 func MetaDataFor(source core.FlatRowSource, fields core.Fields) *common.QueryMetaData {
+	fieldMetadata := FieldMetadataFor(source, fields)
 	return &common.QueryMetaData{
-		FieldNames: fields.Names(),
-		AsOf:       source.GetAsOf(),
-		Until:      source.GetUntil(),
-		Resolution: source.GetResolution(),
-		Plan:       core.FormatSource(source),
+		FieldNames:    fields.Names(),
+		FieldMetadata: fieldMetadata,
+		Columns:       ColumnsFor(source, fields, fieldMetadata),
+		AsOf:          source.GetAsOf(),
+		Until:         source.GetUntil(),
+		Resolution:    source.GetResolution(),
+		Plan:          core.FormatSource(source),
 	}
 }
 
+// ColumnsFor describes the columns of the results of the given source, which
+// are the dims by which it groups followed by the given fields. fieldMetadata
+// supplies the units of fields, see FieldMetadataFor.
+func ColumnsFor(source core.Source, fields core.Fields, fieldMetadata map[string]*common.FieldMetadata) []*common.ColumnMetadata {
+	groupBy := source.GetGroupBy()
+	columns := make([]*common.ColumnMetadata, 0, len(groupBy)+len(fields))
+	for _, gb := range groupBy {
+		column := &common.ColumnMetadata{Name: gb.Name, Kind: common.ColumnDim, Type: common.TypeAny}
+		if core.IsTimeDim(gb.Name) {
+			column.Type = common.TypeNumber
+		}
+		columns = append(columns, column)
+	}
+	for _, field := range fields {
+		column := &common.ColumnMetadata{Name: field.Name, Kind: common.ColumnDerived, Type: common.TypeNumber}
+		if expr.IsAggregate(field.Expr) {
+			column.Kind = common.ColumnAggregate
+		}
+		if md := fieldMetadata[field.Name]; md != nil {
+			column.Unit = md.Unit
+		}
+		columns = append(columns, column)
+	}
+	return columns
+}
+
+// FieldMetadataFor looks up the metadata of the given fields in the table from
+// which source reads. Fields are matched to the table's fields by name.
+func FieldMetadataFor(source core.Source, fields core.Fields) map[string]*common.FieldMetadata {
+	for source != nil {
+		if q, ok := source.(*queryable); ok {
+			tableMetadata := q.t.getFieldMetadata()
+			var result map[string]*common.FieldMetadata
+			for _, field := range fields {
+				if md := tableMetadata[field.Name]; md != nil {
+					if result == nil {
+						result = make(map[string]*common.FieldMetadata)
+					}
+					result[field.Name] = md
+				}
+			}
+			return result
+		}
+		transform, ok := source.(core.Transform)
+		if !ok {
+			return nil
+		}
+		source = transform.GetSource()
+	}
+	return nil
+}
+
 type queryable struct {
 	t               *table
 	fields          core.Fields
 	asOf            time.Time
 	until           time.Time
 	includeMemStore bool
+	// walAsOf, if set, makes the queryable replay the WAL as of this point
+	walAsOf *asOfSpec
+	// keyFilter, if set, skips keys that can't match the query
+	keyFilter *core.KeyFilter
+	// window, if set, skips periods that are outside of the query's time range
+	window *timeWindow
+}
+
+// timeWindow limits reads to the periods between asOf and until. A nil
+// timeWindow reads all periods.
+type timeWindow struct {
+	asOf  time.Time
+	until time.Time
+}
+
+// apply returns the periods of seq, which holds data for e, that fall within
+// the window.
+func (w *timeWindow) apply(seq encoding.Sequence, e expr.Expr, resolution time.Duration) encoding.Sequence {
+	if w == nil || len(seq) == 0 {
+		return seq
+	}
+	return seq.Window(e.EncodedWidth(), resolution, w.asOf, w.until)
+}
+
+func (w *timeWindow) String() string {
+	return fmt.Sprintf("%v to %v", w.asOf.In(time.UTC).Format(time.RFC3339), w.until.In(time.UTC).Format(time.RFC3339))
+}
+
+// WithKeyFilter implements the interface planner.KeyFilterable.
+func (q *queryable) WithKeyFilter(filter *core.KeyFilter) planner.Table {
+	filtered := *q
+	filtered.keyFilter = filter
+	return &filtered
+}
+
+// WithTimeRange implements the interface planner.TimeRangeable.
+func (q *queryable) WithTimeRange(asOf time.Time, until time.Time) planner.Table {
+	windowed := *q
+	windowed.window = &timeWindow{asOf, until}
+	return &windowed
 }
 
 func (q *queryable) GetGroupBy() []core.GroupBy {
@@ -94,7 +272,14 @@ func (q *queryable) GetPartitionBy() []string {
 }
 
 func (q *queryable) String() string {
-	return q.t.Name
+	result := q.t.Name
+	if q.keyFilter != nil {
+		result = fmt.Sprintf("%v (keys where %v)", result, q.keyFilter)
+	}
+	if q.window != nil {
+		result = fmt.Sprintf("%v (periods from %v)", result, q.window)
+	}
+	return result
 }
 
 func (q *queryable) Iterate(ctx context.Context, onFields core.OnFields, onRow core.OnRow) error {
@@ -104,9 +289,42 @@ func (q *queryable) Iterate(ctx context.Context, onFields core.OnFields, onRow c
 		return err
 	}
 
+	stats := &common.TableQueryStats{Table: q.t.Name}
+	defer q.recordStats(ctx, stats)
+
+	tombstones, _ := q.t.tombstones()
+	onValue := func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+		stats.KeysScanned++
+		stats.BytesRead += int64(len(key))
+		for i, seq := range vals {
+			if len(seq) == 0 || i >= len(q.fields) {
+				continue
+			}
+			stats.SequencesDecoded++
+			stats.PeriodsRead += int64(seq.NumPeriods(q.fields[i].Expr.EncodedWidth()))
+			stats.BytesRead += int64(len(seq))
+		}
+		if len(tombstones) > 0 && !q.t.eraseDeleted(tombstones, key, vals, q.fields) {
+			// everything was deleted
+			return true, nil
+		}
+		return onRow(key, vals)
+	}
+
+	if q.walAsOf != nil {
+		return q.t.iterateAsOf(ctx, q.fields, q.walAsOf, q.keyFilter, q.window, onValue)
+	}
+
 	// When iterating, as an optimization, we read only the needed fields (not
 	// all table fields).
-	return q.t.iterate(ctx, q.fields, q.includeMemStore, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
-		return onRow(key, vals)
-	})
+	return q.t.iterate(ctx, q.fields, q.includeMemStore, q.keyFilter, q.window, onValue)
+}
+
+// recordStats adds the stats of one iteration to the table's counters and, if
+// ctx collects them, to the query's stats.
+func (q *queryable) recordStats(ctx context.Context, stats *common.TableQueryStats) {
+	q.t.counters.recordQuery(stats)
+	if queryStats := common.QueryStatsFrom(ctx); queryStats != nil {
+		queryStats.Add(stats)
+	}
 }
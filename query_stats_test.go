@@ -0,0 +1,222 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryStats(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 0, 0, time.UTC)
+	clock := NewVirtualClock(epoch)
+	clock.Freeze()
+	db, err := NewDB(&DBOpts{
+		Dir:   tmpDir,
+		Clock: clock,
+		Schema: Schema{
+			"thetable": &TableOpts{
+				RetentionPeriod: time.Hour,
+				SQL:             "SELECT SUM(a) AS a FROM inbound GROUP BY u, period(1m)",
+			},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	db.Insert("inbound", epoch, map[string]interface{}{"u": "bob"}, map[string]float64{"a": 1})
+	db.Insert("inbound", epoch.Add(-1*time.Minute), map[string]interface{}{"u": "bob"}, map[string]float64{"a": 2})
+	db.Insert("inbound", epoch, map[string]interface{}{"u": "alice"}, map[string]float64{"a": 4})
+	waitFor(func() bool { return db.TableStats("thetable").InsertedPoints == 3 })
+
+	stats := common.NewQueryStats()
+	ctx := common.WithQueryStats(context.Background(), stats)
+	err = db.QueryContext(ctx, "SELECT a FROM thetable", true, func(fields core.Fields) error {
+		return nil
+	}, func(row *core.FlatRow) (bool, error) {
+		return true, nil
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tables := stats.Tables()
+	if assert.Len(t, tables, 1) {
+		s := tables[0]
+		assert.Equal(t, "thetable", s.Table)
+		assert.EqualValues(t, 2, s.KeysScanned)
+		// Depending on the plan, the _points field may be read too
+		assert.True(t, s.SequencesDecoded >= 2, "should have decoded a sequence per key")
+		assert.True(t, s.PeriodsRead >= 3, "bob has 2 periods and alice 1")
+		assert.True(t, s.BytesRead > 0)
+
+		tableStats := db.TableStats("thetable")
+		assert.EqualValues(t, 1, tableStats.Queries)
+		assert.Equal(t, s.KeysScanned, tableStats.QueryKeysScanned)
+		assert.Equal(t, s.BytesRead, tableStats.QueryBytesRead)
+	}
+}
+
+func TestQueryKeyFilter(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 0, 0, time.UTC)
+	clock := NewVirtualClock(epoch)
+	clock.Freeze()
+	db, err := NewDB(&DBOpts{
+		Dir:   tmpDir,
+		Clock: clock,
+		Schema: Schema{
+			"thetable": &TableOpts{
+				RetentionPeriod: time.Hour,
+				MaxFlushLatency: time.Hour,
+				SQL:             "SELECT SUM(a) AS a FROM inbound GROUP BY u, period(1m)",
+			},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	db.Insert("inbound", epoch, map[string]interface{}{"u": "bob"}, map[string]float64{"a": 1})
+	db.Insert("inbound", epoch, map[string]interface{}{"u": "alice"}, map[string]float64{"a": 2})
+	waitFor(func() bool { return db.TableStats("thetable").InsertedPoints == 2 })
+	if !assert.NoError(t, db.ForceFlush("thetable")) {
+		return
+	}
+	// These stay in the memstore
+	db.Insert("inbound", epoch, map[string]interface{}{"u": "bob"}, map[string]float64{"a": 4})
+	db.Insert("inbound", epoch, map[string]interface{}{"u": "carol"}, map[string]float64{"a": 8})
+	waitFor(func() bool { return db.TableStats("thetable").InsertedPoints == 4 })
+
+	stats := common.NewQueryStats()
+	ctx := common.WithQueryStats(context.Background(), stats)
+	source, err := db.Query("SELECT a FROM thetable WHERE u IN ('bob', 'carol') AND u != 'carol'", false, nil, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Contains(t, core.FormatSource(source), "thetable (keys where u IN (bob, carol))")
+	var rows []*core.FlatRow
+	err = source.Iterate(ctx, func(fields core.Fields) error {
+		return nil
+	}, func(row *core.FlatRow) (bool, error) {
+		rows = append(rows, row)
+		return true, nil
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, rows, 1) {
+		assert.Equal(t, "bob", rows[0].Key.Get("u"))
+		assert.EqualValues(t, 5, rows[0].Values[0], "Data from disk and memstore should be merged")
+	}
+	tables := stats.Tables()
+	if assert.Len(t, tables, 1) {
+		assert.EqualValues(t, 2, tables[0].KeysScanned, "alice shouldn't have been read")
+	}
+}
+
+func TestQueryTimeRange(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 0, 0, time.UTC)
+	clock := NewVirtualClock(epoch)
+	clock.Freeze()
+	db, err := NewDB(&DBOpts{
+		Dir:   tmpDir,
+		Clock: clock,
+		Schema: Schema{
+			"thetable": &TableOpts{
+				RetentionPeriod: time.Hour,
+				MaxFlushLatency: time.Hour,
+				SQL:             "SELECT SUM(a) AS a FROM inbound GROUP BY u, period(1m)",
+			},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	// Each period holds how many minutes before the epoch it is
+	insert := func(from int, to int) {
+		for i := from; i < to; i++ {
+			db.Insert("inbound", epoch.Add(time.Duration(-i)*time.Minute), map[string]interface{}{"u": "bob"}, map[string]float64{"a": float64(i)})
+		}
+	}
+	insert(5, 10)
+	waitFor(func() bool { return db.TableStats("thetable").InsertedPoints == 5 })
+	if !assert.NoError(t, db.ForceFlush("thetable")) {
+		return
+	}
+	// These stay in the memstore
+	insert(0, 5)
+	waitFor(func() bool { return db.TableStats("thetable").InsertedPoints == 10 })
+
+	query := func(sqlString string) ([]float64, *common.TableQueryStats) {
+		stats := common.NewQueryStats()
+		ctx := common.WithQueryStats(context.Background(), stats)
+		var vals []float64
+		err := db.QueryContext(ctx, sqlString, true, func(fields core.Fields) error {
+			return nil
+		}, func(row *core.FlatRow) (bool, error) {
+			vals = append(vals, row.Values[0])
+			return true, nil
+		})
+		if !assert.NoError(t, err, sqlString) {
+			return nil, nil
+		}
+		tables := stats.Tables()
+		if !assert.Len(t, tables, 1, sqlString) {
+			return nil, nil
+		}
+		return vals, tables[0]
+	}
+
+	vals, allStats := query("SELECT a FROM thetable")
+	if !assert.NotNil(t, allStats) {
+		return
+	}
+	assert.Len(t, vals, 10)
+	assert.True(t, allStats.PeriodsRead >= 10, "all periods should have been read")
+
+	vals, stats := query("SELECT a FROM thetable ASOF '-3m'")
+	if assert.NotNil(t, stats) {
+		assert.NotEmpty(t, vals)
+		for _, val := range vals {
+			assert.True(t, val <= 3, "periods before asOf shouldn't be included")
+		}
+		assert.True(t, stats.PeriodsRead < allStats.PeriodsRead, "periods before asOf shouldn't have been read")
+	}
+
+	vals, stats = query("SELECT SHIFT(a, '-2m') AS a FROM thetable ASOF '-3m'")
+	if assert.NotNil(t, stats) {
+		assert.NotEmpty(t, vals)
+		for _, val := range vals {
+			assert.True(t, val >= 2 && val <= 5, "shifted periods should have been read")
+		}
+		assert.True(t, stats.PeriodsRead < allStats.PeriodsRead, "periods before the shifted asOf shouldn't have been read")
+	}
+}
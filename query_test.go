@@ -0,0 +1,54 @@
+package zenodb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryErrors(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{
+		Dir: tmpDir,
+		Schema: Schema{
+			"errors_by_host": &TableOpts{
+				RetentionPeriod: time.Hour,
+				SQL:             "SELECT SUM(errors) AS errors, SUM(requests) AS requests FROM inbound GROUP BY host, period(1m)",
+			},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	_, err = db.Query("SELECT errors\nFROM erors_by_host", false, nil, true)
+	assert.Equal(t, ErrUnknownTable, common.KindOf(err))
+	if assert.IsType(t, &common.SQLError{}, err) {
+		sqlErr := err.(*common.SQLError)
+		assert.Equal(t, 2, sqlErr.Line)
+		assert.Equal(t, 6, sqlErr.Column)
+		assert.Equal(t, []string{"errors_by_host"}, sqlErr.Suggestions)
+	}
+
+	_, err = db.Query("SELECT SUM(requets) AS r FROM errors_by_host", false, nil, true)
+	assert.Equal(t, ErrInvalidSQL, common.KindOf(err))
+	if assert.IsType(t, &common.SQLError{}, err) {
+		sqlErr := err.(*common.SQLError)
+		assert.Equal(t, 1, sqlErr.Line)
+		assert.Equal(t, 12, sqlErr.Column)
+		assert.Equal(t, []string{"requests"}, sqlErr.Suggestions)
+	}
+
+	_, err = db.Query("SELECT errors FROM errors_by_host WHERE", false, nil, true)
+	assert.Equal(t, ErrInvalidSQL, common.KindOf(err))
+}
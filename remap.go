@@ -0,0 +1,346 @@
+package zenodb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/yaml"
+	"github.com/getlantern/zenodb/bytetree"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+const (
+	// remapsFilename is the file in the db dir to which remap jobs are
+	// persisted so that they can be resumed after a restart.
+	remapsFilename = "_remaps.yaml"
+)
+
+// States of a remap job, see RemapStatus.
+const (
+	RemapPending = "pending"
+	RemapRunning = "running"
+	RemapDone    = "done"
+	RemapFailed  = "failed"
+)
+
+// RemapStatus reports the progress of a job started with RemapKeys.
+type RemapStatus struct {
+	Table   string
+	Dim     string
+	Mapping map[string]string
+	// Canonicalize indicates that this is a job started with CanonicalizeKeys
+	// rather than a remap of Dim
+	Canonicalize bool
+	// State is one of RemapPending, RemapRunning, RemapDone or RemapFailed
+	State    string
+	Started  time.Time
+	Finished time.Time
+	Error    string
+	// TotalKeys is roughly the number of keys in the table when the job started
+	// running
+	TotalKeys int64
+	// ScannedKeys is the number of keys checked against the mapping so far
+	ScannedKeys int64
+	// RemappedKeys is the number of keys that were remapped so far
+	RemappedKeys int64
+}
+
+func (s *RemapStatus) String() string {
+	result := fmt.Sprintf("remap of %v on %v %v: scanned %d of about %d keys, remapped %d", s.Dim, s.Table, s.State, s.ScannedKeys, s.TotalKeys, s.RemappedKeys)
+	if s.Canonicalize {
+		result = fmt.Sprintf("canonicalization of %v %v: scanned %d of about %d keys, merged %d", s.Table, s.State, s.ScannedKeys, s.TotalKeys, s.RemappedKeys)
+	}
+	if s.Error != "" {
+		result = fmt.Sprintf("%v, error: %v", result, s.Error)
+	}
+	return result
+}
+
+type remapJob struct {
+	// progress comes first so that its int64s are aligned on 32 bit platforms.
+	// It's accessed atomically.
+	TotalKeys    int64 `yaml:"totalkeys"`
+	ScannedKeys  int64 `yaml:"scannedkeys"`
+	RemappedKeys int64 `yaml:"remappedkeys"`
+
+	Table        string            `yaml:"table"`
+	Dim          string            `yaml:"dim,omitempty"`
+	Mapping      map[string]string `yaml:"mapping,omitempty"`
+	Canonicalize bool              `yaml:"canonicalize,omitempty"`
+	// The below are only accessed while holding remapsMx
+	State    string `yaml:"state"`
+	Started  string `yaml:"started"`
+	Finished string `yaml:"finished,omitempty"`
+	Error    string `yaml:"error,omitempty"`
+}
+
+// remap returns the key with the job's mapping applied and whether the key was
+// changed.
+func (job *remapJob) remap(key bytemap.ByteMap) (bytemap.ByteMap, bool) {
+	if job.Canonicalize {
+		return encoding.CanonicalKey(key)
+	}
+	value, ok := key.Get(job.Dim).(string)
+	if !ok {
+		return key, false
+	}
+	newValue, found := job.Mapping[value]
+	if !found {
+		return key, false
+	}
+	dims := key.AsMap()
+	dims[job.Dim] = newValue
+	return bytemap.New(dims), true
+}
+
+// RemapKeys starts a background job that rewrites the keys of the given table,
+// replacing the values of the dimension dim according to mapping. For
+// example, mapping {"a": "b"} renames host=a to host=b, and mapping
+// {"a": "c", "b": "c"} merges hosts a and b into c. Data for keys that end up
+// the same is merged. Only string values are remapped, and values that are
+// remapped can't themselves be the targets of the mapping.
+//
+// The job runs as part of the table's next flush and only affects data that's
+// already been inserted. It's persisted in the db dir and resumed after a
+// restart. Use RemapStatus to follow its progress. In a cluster, remaps only
+// apply to the node on which they run.
+func (db *DB) RemapKeys(table string, dim string, mapping map[string]string) error {
+	t, err := db.storingTable(table)
+	if err != nil {
+		return err
+	}
+	if dim == "" {
+		return fmt.Errorf("Please specify a dimension to remap")
+	}
+	if len(mapping) == 0 {
+		return fmt.Errorf("Please specify at least one value to remap")
+	}
+	if !t.GroupByAll && len(t.GroupBy) > 0 {
+		grouped := false
+		for _, groupBy := range t.GroupBy {
+			if groupBy.Name == dim {
+				grouped = true
+			}
+		}
+		if !grouped {
+			return fmt.Errorf("Table %v is not grouped by %v", t.Name, dim)
+		}
+	}
+	for from, to := range mapping {
+		if _, found := mapping[to]; found {
+			return fmt.Errorf("Value %v can't be both remapped and the target of a remap of %v", to, from)
+		}
+	}
+
+	t.log.Debugf("Remapping %v with %v", dim, mapping)
+	return db.startRemap(t, &remapJob{Dim: dim, Mapping: mapping})
+}
+
+// CanonicalizeKeys starts a background job that rewrites the keys of the given
+// table that weren't stored in canonical form, with their dimensions ordered
+// by name, merging their data into the data of the canonical keys. Keys are
+// always stored canonically now, but older versions stored the dimensions of
+// tables without a GROUP BY the way that clients ordered them, so the same
+// dimensions could end up under several keys.
+//
+// Like RemapKeys, the job runs as part of the table's next flush and its
+// progress is reported by RemapStatus.
+func (db *DB) CanonicalizeKeys(table string) error {
+	t, err := db.storingTable(table)
+	if err != nil {
+		return err
+	}
+	t.log.Debug("Canonicalizing keys")
+	return db.startRemap(t, &remapJob{Canonicalize: true})
+}
+
+// startRemap persists the given job for the given table and starts rewriting
+// the table's keys.
+func (db *DB) startRemap(t *table, job *remapJob) error {
+	db.remapsMx.Lock()
+	defer db.remapsMx.Unlock()
+	existing := db.remaps[t.Name]
+	if existing != nil && (existing.State == RemapPending || existing.State == RemapRunning) {
+		return fmt.Errorf("Table %v is already being remapped", t.Name)
+	}
+	job.Table = t.Name
+	job.State = RemapPending
+	job.Started = db.clock.Now().Format(time.RFC3339Nano)
+	db.remaps[t.Name] = job
+	err := db.saveRemaps()
+	if err != nil {
+		return err
+	}
+	go t.rowStore.rewrite()
+	return nil
+}
+
+// RemapStatus returns the status of the most recent remap job for the given
+// table.
+func (db *DB) RemapStatus(table string) (*RemapStatus, error) {
+	db.remapsMx.Lock()
+	defer db.remapsMx.Unlock()
+	job := db.remaps[strings.ToLower(table)]
+	if job == nil {
+		return nil, fmt.Errorf("No remap found for table %v", table)
+	}
+	started, _ := time.Parse(time.RFC3339Nano, job.Started)
+	finished, _ := time.Parse(time.RFC3339Nano, job.Finished)
+	return &RemapStatus{
+		Table:        job.Table,
+		Dim:          job.Dim,
+		Mapping:      job.Mapping,
+		Canonicalize: job.Canonicalize,
+		State:        job.State,
+		Started:      started,
+		Finished:     finished,
+		Error:        job.Error,
+		TotalKeys:    atomic.LoadInt64(&job.TotalKeys),
+		ScannedKeys:  atomic.LoadInt64(&job.ScannedKeys),
+		RemappedKeys: atomic.LoadInt64(&job.RemappedKeys),
+	}, nil
+}
+
+// resumeRemap resumes a remap job for the table that didn't finish before the
+// database was last closed.
+func (t *table) resumeRemap() {
+	if t.pendingRemap() != nil {
+		t.log.Debug("Resuming remap")
+		go t.rowStore.rewrite()
+	}
+}
+
+// pendingRemap returns the table's remap job if it hasn't finished yet.
+func (t *table) pendingRemap() *remapJob {
+	t.db.remapsMx.Lock()
+	defer t.db.remapsMx.Unlock()
+	job := t.db.remaps[t.Name]
+	if job == nil || (job.State != RemapPending && job.State != RemapRunning) {
+		return nil
+	}
+	return job
+}
+
+// remapKeys collects the rows of the given fileStore and memstore whose keys
+// are changed by the given job into a new tree under their remapped keys,
+// merging rows whose remapped keys are the same.
+func (rs *rowStore) remapKeys(fs *fileStore, ms *memstore, job *remapJob) (*bytetree.Tree, error) {
+	atomic.StoreInt64(&job.TotalKeys, rs.t.counters.stats().DiskKeys+int64(ms.tree.Length()))
+	atomic.StoreInt64(&job.ScannedKeys, 0)
+	atomic.StoreInt64(&job.RemappedKeys, 0)
+	rs.t.db.updateRemap(job, RemapRunning, nil)
+
+	exprs := rs.fields.Exprs()
+	remapped := bytetree.New(exprs, exprs, rs.t.Resolution, rs.t.Resolution, time.Time{}, time.Time{}, 0)
+	err := fs.iterate(rs.fields, ms, nil, nil, false, false, func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+		atomic.AddInt64(&job.ScannedKeys, 1)
+		newKey, changed := job.remap(key)
+		if changed {
+			remapped.Update(newKey, columns, nil, newKey)
+			atomic.AddInt64(&job.RemappedKeys, 1)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read data to remap: %v", err)
+	}
+	return remapped, nil
+}
+
+// updateRemap changes the state of the given job, recording the error if the
+// job failed.
+func (db *DB) updateRemap(job *remapJob, state string, err error) {
+	db.remapsMx.Lock()
+	defer db.remapsMx.Unlock()
+	job.State = state
+	if err != nil {
+		job.Error = err.Error()
+	}
+	if state == RemapDone || state == RemapFailed {
+		job.Finished = db.clock.Now().Format(time.RFC3339Nano)
+	}
+	if state == RemapDone {
+		if t := db.getTable(job.Table); t != nil && t.lastSeen != nil {
+			// keys have changed, reload them from the row store when next needed
+			t.lastSeen.reset()
+		}
+	}
+	saveErr := db.saveRemaps()
+	if saveErr != nil {
+		log.Error(saveErr)
+	}
+}
+
+// loadRemaps loads previously persisted remap jobs.
+func (db *DB) loadRemaps() error {
+	db.remaps = make(map[string]*remapJob)
+	b, err := ioutil.ReadFile(filepath.Join(db.opts.Dir, remapsFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("Unable to read remaps: %v", err)
+	}
+	var jobs []*remapJob
+	err = yaml.Unmarshal(b, &jobs)
+	if err != nil {
+		return fmt.Errorf("Unable to parse remaps: %v", err)
+	}
+	for _, job := range jobs {
+		if job.State == RemapRunning {
+			// Interrupted, start over
+			job.State = RemapPending
+		}
+		db.remaps[job.Table] = job
+	}
+	return nil
+}
+
+// saveRemaps persists remap jobs. It must be called while holding remapsMx.
+func (db *DB) saveRemaps() error {
+	tables := make([]string, 0, len(db.remaps))
+	for table := range db.remaps {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	jobs := make([]remapJob, 0, len(tables))
+	for _, table := range tables {
+		job := db.remaps[table]
+		jobs = append(jobs, remapJob{
+			TotalKeys:    atomic.LoadInt64(&job.TotalKeys),
+			ScannedKeys:  atomic.LoadInt64(&job.ScannedKeys),
+			RemappedKeys: atomic.LoadInt64(&job.RemappedKeys),
+			Table:        job.Table,
+			Dim:          job.Dim,
+			Mapping:      job.Mapping,
+			Canonicalize: job.Canonicalize,
+			State:        job.State,
+			Started:      job.Started,
+			Finished:     job.Finished,
+			Error:        job.Error,
+		})
+	}
+
+	b, err := yaml.Marshal(jobs)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal remaps: %v", err)
+	}
+	filename := filepath.Join(db.opts.Dir, remapsFilename)
+	tmpFilename := filename + ".tmp"
+	err = ioutil.WriteFile(tmpFilename, b, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to write remaps: %v", err)
+	}
+	err = os.Rename(tmpFilename, filename)
+	if err != nil {
+		return fmt.Errorf("Unable to save remaps: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemapKeys(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 0, 0, time.UTC)
+	clock := NewVirtualClock(epoch)
+	clock.Freeze()
+	newDB := func() (*DB, error) {
+		return NewDB(&DBOpts{
+			Dir:   tmpDir,
+			Clock: clock,
+			Schema: Schema{
+				"thetable": &TableOpts{
+					RetentionPeriod: time.Hour,
+					SQL:             "SELECT SUM(a) AS a FROM inbound GROUP BY host, period(1m)",
+				},
+			},
+		})
+	}
+	db, err := newDB()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	inserted := 0
+	insert := func(ts time.Time, host string, a float64) {
+		db.Insert("inbound", ts, map[string]interface{}{"host": host}, map[string]float64{"a": a})
+		inserted++
+		waitFor(func() bool { return db.TableStats("thetable").InsertedPoints == int64(inserted) })
+	}
+	remapDone := func() bool {
+		status, statusErr := db.RemapStatus("thetable")
+		return statusErr == nil && status.State == RemapDone
+	}
+
+	insert(epoch, "a", 1)
+	insert(epoch, "b", 2)
+	insert(epoch.Add(-1*time.Minute), "c", 4)
+	insert(epoch, "e", 16)
+	if !assert.NoError(t, db.ForceFlush("thetable")) {
+		return
+	}
+	insert(epoch, "a", 8)
+
+	_, err = db.RemapStatus("thetable")
+	assert.Error(t, err, "status without remap should fail")
+	assert.Error(t, db.RemapKeys("thetable", "x", map[string]string{"a": "b"}), "remapping dimension that table isn't grouped by should fail")
+	assert.Error(t, db.RemapKeys("thetable", "host", map[string]string{}), "remapping without mapping should fail")
+	assert.Error(t, db.RemapKeys("thetable", "host", map[string]string{"a": "b", "b": "c"}), "chained mapping should fail")
+	assert.Error(t, db.RemapKeys("othertable", "host", map[string]string{"a": "b"}), "remapping unknown table should fail")
+
+	if !assert.NoError(t, db.RemapKeys("thetable", "host", map[string]string{"a": "c", "b": "c"})) {
+		return
+	}
+	waitFor(remapDone)
+	status, err := db.RemapStatus("thetable")
+	if assert.NoError(t, err) {
+		assert.Equal(t, RemapDone, status.State)
+		assert.EqualValues(t, 4, status.ScannedKeys)
+		assert.EqualValues(t, 2, status.RemappedKeys)
+		assert.Equal(t, epoch, status.Finished.In(time.UTC))
+	}
+	assert.Equal(t, map[string]float64{"c": 15, "e": 16}, sumsBy(t, db, "thetable", "host", "a"))
+	assert.EqualValues(t, 11, sumFieldAt(t, db, "thetable", "a", epoch)-16, "remapped data should be merged by period")
+	assert.EqualValues(t, 4, sumFieldAt(t, db, "thetable", "a", epoch.Add(-1*time.Minute)))
+
+	// Simulate a remap that was interrupted by a restart
+	db.Close()
+	err = ioutil.WriteFile(filepath.Join(tmpDir, remapsFilename), []byte("- table: thetable\n  dim: host\n  mapping:\n    e: f\n  state: running\n"), 0644)
+	if !assert.NoError(t, err) {
+		return
+	}
+	db, err = newDB()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	waitFor(remapDone)
+	assert.Equal(t, map[string]float64{"c": 15, "f": 16}, sumsBy(t, db, "thetable", "host", "a"), "interrupted remap should resume on restart")
+}
+
+func TestCanonicalizeKeys(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 0, 0, time.UTC)
+	clock := NewVirtualClock(epoch)
+	clock.Freeze()
+	db, err := NewDB(&DBOpts{
+		Dir:   tmpDir,
+		Clock: clock,
+		Schema: Schema{
+			"thetable": &TableOpts{
+				RetentionPeriod: time.Hour,
+				SQL:             "SELECT SUM(a) AS a FROM inbound",
+			},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	tbl := db.getTable("thetable")
+	numKeys := func() int {
+		keys := 0
+		err := tbl.rowStore.iterate(context.Background(), tbl.getFields(), true, nil, nil, func(key bytemap.ByteMap, columns []encoding.Sequence) (bool, error) {
+			keys++
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return keys
+	}
+
+	// Simulate a key stored by an older version, which didn't order dims
+	unsorted := bytemap.FromSortedKeysAndValues([]string{"path", "host"}, []interface{}{"/", "a"})
+	tbl.rowStore.insert(&insert{key: unsorted, vals: encoding.NewTSParams(epoch, bytemap.NewFloat(map[string]float64{"a": 1})), metadata: unsorted})
+	waitFor(func() bool { return numKeys() == 1 })
+
+	// The same dims are now stored under the canonical key
+	err = db.InsertRaw("inbound", epoch, unsorted, bytemap.NewFloat(map[string]float64{"a": 2}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	waitFor(func() bool { return db.TableStats("thetable").InsertedPoints == 1 })
+	assert.Equal(t, 2, numKeys())
+
+	if !assert.NoError(t, db.CanonicalizeKeys("thetable")) {
+		return
+	}
+	waitFor(func() bool {
+		status, statusErr := db.RemapStatus("thetable")
+		return statusErr == nil && status.State == RemapDone
+	})
+	status, err := db.RemapStatus("thetable")
+	if assert.NoError(t, err) {
+		assert.True(t, status.Canonicalize)
+		assert.EqualValues(t, 1, status.RemappedKeys)
+		assert.Equal(t, "canonicalization of thetable done: scanned 2 of about 2 keys, merged 1", status.String())
+	}
+	assert.Equal(t, 1, numKeys())
+	assert.EqualValues(t, 3, sumFieldAt(t, db, "thetable", "a", epoch), "data of the unsorted key should be merged into the canonical one")
+}
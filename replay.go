@@ -0,0 +1,277 @@
+package zenodb
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/getlantern/wal"
+	"github.com/getlantern/yaml"
+	"github.com/getlantern/zenodb/common"
+)
+
+const (
+	// replaysFilename is the file in the db dir to which the offsets up to
+	// which each replayed WAL has been applied are saved.
+	replaysFilename = "_replays.yaml"
+
+	// replayCheckpointInterval is how many entries to replay between saving
+	// the replay offset.
+	replayCheckpointInterval = 1000
+)
+
+// ReplayStatus reports the progress of a ReplayWAL.
+type ReplayStatus struct {
+	// Path is the absolute path of the replayed WAL
+	Path   string
+	Stream string
+	// Offset is the offset up to which the WAL has been applied
+	Offset wal.Offset
+	// Replayed is the number of entries applied by the most recent replay
+	Replayed int64
+	// Invalid is the number of entries that couldn't be decoded and were
+	// skipped
+	Invalid  int64
+	Running  bool
+	Started  time.Time
+	Finished time.Time
+	Error    string
+}
+
+// ReplayWAL replays the entries of the WAL in the directory at path into the
+// stream of the same name as the directory, for example to rebuild tables from
+// the _wal/<stream> directory copied from a dead node's disk. Replaying starts
+// after fromOffset (or at the start of the WAL if fromOffset is nil) and stops
+// once it reaches the last entry that was in the WAL when the replay started.
+//
+// Replayed entries are appended to the local WAL like new inserts, so tables
+// ingest them as usual and ignore entries older than their retention period.
+// The offset up to which each WAL has been replayed is saved in the db dir,
+// keyed by path, and replaying the same WAL again skips entries that were
+// already applied. Since the offset is saved every 1,000 entries, up to that
+// many entries may be applied twice if the node crashes mid-replay.
+//
+// ReplayWAL blocks until the replay finishes. Use ReplayStatuses to follow
+// its progress. Not supported on followers or in ReadOnly mode.
+func (db *DB) ReplayWAL(path string, fromOffset wal.Offset) error {
+	if db.opts.Follow != nil || db.opts.ReadOnly {
+		return fmt.Errorf("Replaying WALs is not supported on followers or in ReadOnly mode")
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("Unable to determine path of WAL to replay: %v", err)
+	}
+	stream := strings.ToLower(filepath.Base(path))
+	db.tablesMutex.RLock()
+	w := db.streams[stream]
+	db.tablesMutex.RUnlock()
+	if w == nil {
+		return common.Errorf(common.ErrUnknownStream, "No wal found for stream %v", stream)
+	}
+	ownPath, _ := filepath.Abs(db.walDir(stream))
+	if path == ownPath {
+		return fmt.Errorf("Can't replay stream %v's own WAL", stream)
+	}
+
+	status, err := db.startReplay(path, stream, fromOffset)
+	if err != nil {
+		return err
+	}
+	err = db.replay(w, status)
+	db.replaysMx.Lock()
+	status.Running = false
+	status.Finished = db.clock.Now()
+	if err != nil {
+		status.Error = err.Error()
+	}
+	saveErr := db.saveReplays()
+	db.replaysMx.Unlock()
+	if err != nil {
+		return err
+	}
+	return saveErr
+}
+
+// startReplay records a replay of the WAL at path, starting after fromOffset
+// or the offset up to which the WAL was previously replayed, whichever is
+// later.
+func (db *DB) startReplay(path string, stream string, fromOffset wal.Offset) (*ReplayStatus, error) {
+	db.replaysMx.Lock()
+	defer db.replaysMx.Unlock()
+	if db.replays == nil {
+		err := db.loadReplays()
+		if err != nil {
+			return nil, err
+		}
+	}
+	status := db.replays[path]
+	if status == nil {
+		status = &ReplayStatus{Path: path}
+		db.replays[path] = status
+	}
+	if status.Running {
+		return nil, fmt.Errorf("WAL at %v is already being replayed", path)
+	}
+	status.Stream = stream
+	if status.Offset == nil || (fromOffset != nil && fromOffset.After(status.Offset)) {
+		status.Offset = fromOffset
+	}
+	status.Replayed = 0
+	status.Invalid = 0
+	status.Running = true
+	status.Started = db.clock.Now()
+	status.Finished = time.Time{}
+	status.Error = ""
+	return status, nil
+}
+
+func (db *DB) replay(w *wal.WAL, status *ReplayStatus) error {
+	source, err := wal.Open(status.Path, db.opts.WALSyncInterval)
+	if err != nil {
+		return fmt.Errorf("Unable to open WAL at %v: %v", status.Path, err)
+	}
+	defer source.Close()
+	_, latest, err := source.Latest()
+	if err != nil {
+		return fmt.Errorf("Unable to find end of WAL at %v: %v", status.Path, err)
+	}
+	db.replaysMx.Lock()
+	offset := status.Offset
+	db.replaysMx.Unlock()
+	if latest == nil || (offset != nil && !latest.After(offset)) {
+		log.Debugf("Nothing to replay from %v", status.Path)
+		return nil
+	}
+
+	reader, err := source.NewReader("replay", offset)
+	if err != nil {
+		return fmt.Errorf("Unable to open reader for WAL at %v: %v", status.Path, err)
+	}
+	defer reader.Close()
+
+	log.Debugf("Replaying %v into stream %v from offset %v", status.Path, status.Stream, offset)
+	for i := 1; ; i++ {
+		data, readErr := reader.Read()
+		if readErr != nil {
+			return fmt.Errorf("Unable to read from WAL at %v: %v", status.Path, readErr)
+		}
+		offset = reader.Offset()
+		invalid := data == nil
+		if !invalid {
+			_, _, _, decodeErr := decodeInsert(data)
+			if decodeErr != nil {
+				log.Errorf("Skipping invalid entry in %v: %v", status.Path, decodeErr)
+				invalid = true
+			}
+		}
+		if !invalid {
+			_, writeErr := w.Write(data)
+			if writeErr != nil {
+				return fmt.Errorf("Unable to write replayed entry to stream %v: %v", status.Stream, writeErr)
+			}
+		}
+
+		done := !latest.After(offset)
+		db.replaysMx.Lock()
+		status.Offset = offset
+		if invalid {
+			status.Invalid++
+		} else {
+			status.Replayed++
+		}
+		var saveErr error
+		if i%replayCheckpointInterval == 0 && !done {
+			saveErr = db.saveReplays()
+		}
+		db.replaysMx.Unlock()
+		if saveErr != nil {
+			return saveErr
+		}
+		if done {
+			log.Debugf("Replayed %v entries from %v", status.Replayed, status.Path)
+			return nil
+		}
+	}
+}
+
+// ReplayStatuses returns the status of each WAL replayed with ReplayWAL,
+// ordered by path.
+func (db *DB) ReplayStatuses() []*ReplayStatus {
+	db.replaysMx.Lock()
+	defer db.replaysMx.Unlock()
+	if db.replays == nil {
+		err := db.loadReplays()
+		if err != nil {
+			log.Error(err)
+			return nil
+		}
+	}
+	statuses := make([]*ReplayStatus, 0, len(db.replays))
+	for _, status := range db.replays {
+		copied := *status
+		statuses = append(statuses, &copied)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Path < statuses[j].Path
+	})
+	return statuses
+}
+
+// loadReplays loads the offsets up to which WALs were previously replayed. It
+// must be called while holding replaysMx.
+func (db *DB) loadReplays() error {
+	replays := make(map[string]*ReplayStatus)
+	b, err := ioutil.ReadFile(filepath.Join(db.opts.Dir, replaysFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			db.replays = replays
+			return nil
+		}
+		return fmt.Errorf("Unable to read replays: %v", err)
+	}
+	encoded := make(map[string]string)
+	err = yaml.Unmarshal(b, &encoded)
+	if err != nil {
+		return fmt.Errorf("Unable to parse replays: %v", err)
+	}
+	for path, offset := range encoded {
+		decoded, decodeErr := hex.DecodeString(offset)
+		if decodeErr != nil {
+			return fmt.Errorf("Unable to parse replay offset for %v: %v", path, decodeErr)
+		}
+		replays[path] = &ReplayStatus{Path: path, Stream: strings.ToLower(filepath.Base(path)), Offset: wal.Offset(decoded)}
+	}
+	db.replays = replays
+	return nil
+}
+
+// saveReplays persists the offsets up to which WALs have been replayed, hex
+// encoded. It must be called while holding replaysMx.
+func (db *DB) saveReplays() error {
+	encoded := make(map[string]string, len(db.replays))
+	for path, status := range db.replays {
+		if status.Offset != nil {
+			encoded[path] = hex.EncodeToString(status.Offset)
+		}
+	}
+	b, err := yaml.Marshal(encoded)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal replays: %v", err)
+	}
+	filename := filepath.Join(db.opts.Dir, replaysFilename)
+	tmpFilename := filename + ".tmp"
+	err = ioutil.WriteFile(tmpFilename, b, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to write replays: %v", err)
+	}
+	err = os.Rename(tmpFilename, filename)
+	if err != nil {
+		return fmt.Errorf("Unable to save replays: %v", err)
+	}
+	return nil
+}
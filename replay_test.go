@@ -0,0 +1,95 @@
+package zenodb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayWAL(t *testing.T) {
+	deadDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(deadDir)
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 0, 0, time.UTC)
+	clock := NewVirtualClock(epoch)
+	clock.Freeze()
+	newDB := func(dir string) (*DB, error) {
+		return NewDB(&DBOpts{
+			Dir:   dir,
+			Clock: clock,
+			Schema: Schema{
+				"thetable": &TableOpts{
+					RetentionPeriod: time.Hour,
+					SQL:             "SELECT SUM(a) AS a FROM inbound GROUP BY host, period(1m)",
+				},
+			},
+		})
+	}
+	insertDead := func(points ...float64) bool {
+		dead, deadErr := newDB(deadDir)
+		if !assert.NoError(t, deadErr) {
+			return false
+		}
+		for _, a := range points {
+			dead.Insert("inbound", epoch, map[string]interface{}{"host": "a"}, map[string]float64{"a": a})
+		}
+		dead.Close()
+		return true
+	}
+	if !insertDead(1, 2) {
+		return
+	}
+
+	db, err := newDB(tmpDir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	deadWAL := filepath.Join(deadDir, "_wal", "inbound")
+	assert.Equal(t, ErrUnknownStream, common.KindOf(db.ReplayWAL(filepath.Join(deadDir, "_wal", "unknown"), nil)), "replaying unknown stream should fail")
+	assert.Error(t, db.ReplayWAL(db.walDir("inbound"), nil), "replaying own WAL should fail")
+
+	if !assert.NoError(t, db.ReplayWAL(deadWAL, nil)) {
+		return
+	}
+	waitFor(func() bool { return db.TableStats("thetable").InsertedPoints == 2 })
+	assert.EqualValues(t, 3, sumFieldAt(t, db, "thetable", "a", epoch))
+	statuses := db.ReplayStatuses()
+	if assert.Len(t, statuses, 1) {
+		assert.Equal(t, "inbound", statuses[0].Stream)
+		assert.EqualValues(t, 2, statuses[0].Replayed)
+		assert.False(t, statuses[0].Running)
+		assert.NotNil(t, statuses[0].Offset)
+	}
+
+	// Replaying again only applies what's new
+	if !assert.NoError(t, db.ReplayWAL(deadWAL, nil)) {
+		return
+	}
+	assert.EqualValues(t, 0, db.ReplayStatuses()[0].Replayed)
+	if !insertDead(4) {
+		return
+	}
+	if !assert.NoError(t, db.ReplayWAL(deadWAL, nil)) {
+		return
+	}
+	assert.EqualValues(t, 1, db.ReplayStatuses()[0].Replayed)
+	waitFor(func() bool { return db.TableStats("thetable").InsertedPoints == 3 })
+	time.Sleep(50 * time.Millisecond)
+	assert.EqualValues(t, 3, db.TableStats("thetable").InsertedPoints)
+	assert.EqualValues(t, 7, sumFieldAt(t, db, "thetable", "a", epoch))
+}
@@ -0,0 +1,374 @@
+package zenodb
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/wal"
+	"github.com/getlantern/yaml"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+const (
+	// replicationFilename is the file in the db dir to which the offsets up to
+	// which each stream has been replicated are saved.
+	replicationFilename = "_replication.yaml"
+
+	defaultReplicateBatchSize     = 1000
+	defaultReplicateFlushInterval = 1 * time.Second
+	defaultReplicateRetryInterval = 5 * time.Second
+)
+
+// ReplicateOpts configures asynchronous replication of streams to another
+// cluster, for example in a different region for disaster recovery.
+//
+// Replication follows the local WAL of each stream and replays its points into
+// the other cluster, which applies them like any other insert. Since zenodb
+// only ever aggregates points, replicated data never conflicts with what the
+// other cluster already holds or receives from elsewhere. The offset up to
+// which each stream has been replicated is saved in the db dir, so replication
+// resumes where it left off after a restart. A batch that fails is retried
+// until it succeeds, so points are replicated at least once, and points from a
+// batch that was interrupted by a crash may be replicated twice.
+type ReplicateOpts struct {
+	// Streams are the streams to replicate.
+	Streams []string
+	// Insert inserts a batch of points into the given stream of the other
+	// cluster. If it returns an error, the batch is retried.
+	Insert func(stream string, points []*ReplicatedPoint) error
+	// BatchSize is the maximum number of points to send per Insert. Defaults
+	// to 1,000.
+	BatchSize int
+	// FlushInterval is how frequently to send partial batches. Defaults to 1
+	// second.
+	FlushInterval time.Duration
+	// RetryInterval is how long to wait before retrying a failed batch.
+	// Defaults to 5 seconds.
+	RetryInterval time.Duration
+}
+
+// ReplicatedPoint is a point read from the WAL for replication.
+type ReplicatedPoint struct {
+	TS   time.Time
+	Dims bytemap.ByteMap
+	Vals bytemap.ByteMap
+}
+
+// ReplicationStatus reports on the replication of a stream.
+type ReplicationStatus struct {
+	Stream string
+	// Offset is the WAL offset up to which the stream has been replicated
+	Offset wal.Offset
+	// Lag is how long after its timestamp the most recently replicated point
+	// was replicated
+	Lag        time.Duration
+	Replicated int64
+	Failures   int64
+	// LastError is the error of the last batch, if it failed
+	LastError string
+}
+
+type replicator struct {
+	db      *DB
+	opts    *ReplicateOpts
+	streams []*streamReplicator
+	// saveMx serializes saving offsets
+	saveMx    sync.Mutex
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+type streamReplicator struct {
+	r      *replicator
+	stream string
+	mx     sync.Mutex
+	status ReplicationStatus
+}
+
+// startReplication starts replicating the configured streams from the offsets
+// at which replication previously left off.
+func (db *DB) startReplication(opts *ReplicateOpts) (*replicator, error) {
+	if opts.Insert == nil {
+		return nil, fmt.Errorf("Replicate requires an Insert function")
+	}
+	if len(opts.Streams) == 0 {
+		return nil, fmt.Errorf("Replicate requires at least one stream")
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultReplicateBatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaultReplicateFlushInterval
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = defaultReplicateRetryInterval
+	}
+
+	offsets, err := db.loadReplicationOffsets()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &replicator{db: db, opts: opts, stopped: make(chan struct{})}
+	streams := make([]string, 0, len(opts.Streams))
+	for _, stream := range opts.Streams {
+		streams = append(streams, strings.TrimSpace(strings.ToLower(stream)))
+	}
+	sort.Strings(streams)
+	for _, stream := range streams {
+		db.tablesMutex.RLock()
+		w := db.streams[stream]
+		db.tablesMutex.RUnlock()
+		if w == nil {
+			r.stop()
+			return nil, fmt.Errorf("Unable to replicate stream %v: stream not found", stream)
+		}
+		offset := offsets[stream]
+		reader, readerErr := w.NewReader(fmt.Sprintf("replicator.%v", stream), offset)
+		if readerErr != nil {
+			r.stop()
+			return nil, fmt.Errorf("Unable to open wal reader to replicate %v: %v", stream, readerErr)
+		}
+		sr := &streamReplicator{r: r, stream: stream, status: ReplicationStatus{Stream: stream, Offset: offset}}
+		r.streams = append(r.streams, sr)
+		go sr.run(reader)
+	}
+	return r, nil
+}
+
+type replicatedEntry struct {
+	point  *ReplicatedPoint
+	offset wal.Offset
+}
+
+func (sr *streamReplicator) run(reader *wal.Reader) {
+	entries := make(chan *replicatedEntry, sr.r.opts.BatchSize)
+	go sr.read(reader, entries)
+	defer reader.Close()
+
+	batch := make([]*ReplicatedPoint, 0, sr.r.opts.BatchSize)
+	var offset wal.Offset
+	flush := func() {
+		if len(batch) > 0 {
+			sr.send(batch, offset)
+			batch = batch[:0]
+		}
+	}
+
+	ticker := time.NewTicker(sr.r.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case entry := <-entries:
+			batch = append(batch, entry.point)
+			offset = entry.offset
+			if len(batch) >= sr.r.opts.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-sr.r.stopped:
+			return
+		}
+	}
+}
+
+func (sr *streamReplicator) read(reader *wal.Reader, entries chan *replicatedEntry) {
+	for {
+		data, err := reader.Read()
+		if sr.r.isStopped() {
+			return
+		}
+		if err != nil {
+			log.Debugf("Unable to read from stream '%v' for replication: %v", sr.stream, err)
+			continue
+		}
+		if data == nil {
+			// Ignore empty data
+			continue
+		}
+		point, err := replicatedPointFor(data)
+		if err != nil {
+			log.Errorf("Unable to decode entry in stream %v, not replicating: %v", sr.stream, err)
+			continue
+		}
+		select {
+		case entries <- &replicatedEntry{point, reader.Offset()}:
+		case <-sr.r.stopped:
+			return
+		}
+	}
+}
+
+// send inserts the batch into the other cluster, retrying until it succeeds
+// or replication stops, and then saves the offset up to which the stream has
+// been replicated.
+func (sr *streamReplicator) send(batch []*ReplicatedPoint, offset wal.Offset) {
+	for {
+		if sr.r.isStopped() {
+			return
+		}
+		err := sr.r.opts.Insert(sr.stream, batch)
+		if err == nil {
+			break
+		}
+		log.Errorf("Unable to replicate %d points to %v, will retry: %v", len(batch), sr.stream, err)
+		sr.mx.Lock()
+		sr.status.Failures++
+		sr.status.LastError = err.Error()
+		sr.mx.Unlock()
+		select {
+		case <-time.After(sr.r.opts.RetryInterval):
+		case <-sr.r.stopped:
+			return
+		}
+	}
+
+	lag := sr.r.db.clock.Now().Sub(batch[len(batch)-1].TS)
+	if lag < 0 {
+		lag = 0
+	}
+	sr.mx.Lock()
+	sr.status.Offset = offset
+	sr.status.Lag = lag
+	sr.status.Replicated += int64(len(batch))
+	sr.status.LastError = ""
+	sr.mx.Unlock()
+
+	err := sr.r.saveOffsets()
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// stop stops replication. Batches that haven't been sent yet are replicated
+// again once replication restarts.
+func (r *replicator) stop() {
+	r.closeOnce.Do(func() {
+		close(r.stopped)
+	})
+}
+
+func (r *replicator) isStopped() bool {
+	select {
+	case <-r.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// replicatedPointFor decodes a WAL entry as written by InsertRaw.
+func replicatedPointFor(data []byte) (*ReplicatedPoint, error) {
+	tsd, remain, err := encoding.ReadChecked(data, encoding.Width64bits)
+	if err != nil {
+		return nil, err
+	}
+	dimsLen, remain, err := encoding.ReadInt32Checked(remain)
+	if err != nil {
+		return nil, err
+	}
+	dims, remain, err := encoding.ReadByteMapChecked(remain, dimsLen)
+	if err != nil {
+		return nil, err
+	}
+	valsLen, remain, err := encoding.ReadInt32Checked(remain)
+	if err != nil {
+		return nil, err
+	}
+	vals, _, err := encoding.ReadByteMapChecked(remain, valsLen)
+	if err != nil {
+		return nil, err
+	}
+	return &ReplicatedPoint{
+		TS:   encoding.TimeFromBytes(tsd),
+		Dims: copyBytes(dims),
+		Vals: copyBytes(vals),
+	}, nil
+}
+
+func copyBytes(b []byte) []byte {
+	result := make([]byte, len(b))
+	copy(result, b)
+	return result
+}
+
+// ReplicationStatuses returns the status of the replication of each stream,
+// ordered by stream.
+func (db *DB) ReplicationStatuses() []*ReplicationStatus {
+	if db.replicator == nil {
+		return nil
+	}
+	statuses := make([]*ReplicationStatus, 0, len(db.replicator.streams))
+	for _, sr := range db.replicator.streams {
+		sr.mx.Lock()
+		status := sr.status
+		sr.mx.Unlock()
+		statuses = append(statuses, &status)
+	}
+	return statuses
+}
+
+func (db *DB) loadReplicationOffsets() (map[string]wal.Offset, error) {
+	offsets := make(map[string]wal.Offset)
+	b, err := ioutil.ReadFile(filepath.Join(db.opts.Dir, replicationFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return offsets, nil
+		}
+		return nil, fmt.Errorf("Unable to read replication offsets: %v", err)
+	}
+	encoded := make(map[string]string)
+	err = yaml.Unmarshal(b, &encoded)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse replication offsets: %v", err)
+	}
+	for stream, offset := range encoded {
+		decoded, decodeErr := hex.DecodeString(offset)
+		if decodeErr != nil {
+			return nil, fmt.Errorf("Unable to parse replication offset for %v: %v", stream, decodeErr)
+		}
+		offsets[stream] = wal.Offset(decoded)
+	}
+	return offsets, nil
+}
+
+// saveOffsets persists the offsets up to which each stream has been
+// replicated, hex encoded.
+func (r *replicator) saveOffsets() error {
+	r.saveMx.Lock()
+	defer r.saveMx.Unlock()
+
+	encoded := make(map[string]string, len(r.streams))
+	for _, sr := range r.streams {
+		sr.mx.Lock()
+		offset := sr.status.Offset
+		sr.mx.Unlock()
+		if offset != nil {
+			encoded[sr.stream] = hex.EncodeToString(offset)
+		}
+	}
+	b, err := yaml.Marshal(encoded)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal replication offsets: %v", err)
+	}
+	filename := filepath.Join(r.db.opts.Dir, replicationFilename)
+	tmpFilename := filename + ".tmp"
+	err = ioutil.WriteFile(tmpFilename, b, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to write replication offsets: %v", err)
+	}
+	err = os.Rename(tmpFilename, filename)
+	if err != nil {
+		return fmt.Errorf("Unable to save replication offsets: %v", err)
+	}
+	return nil
+}
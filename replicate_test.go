@@ -0,0 +1,119 @@
+package zenodb
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplication(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 0, 0, time.UTC)
+	schema := Schema{
+		"thetable": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT SUM(a) AS a FROM inbound GROUP BY u, period(1m)",
+		},
+	}
+
+	var mx sync.Mutex
+	var replicated []*ReplicatedPoint
+	failNext := true
+	insert := func(stream string, points []*ReplicatedPoint) error {
+		mx.Lock()
+		defer mx.Unlock()
+		assert.Equal(t, "inbound", stream)
+		if failNext {
+			failNext = false
+			return errors.New("unavailable")
+		}
+		replicated = append(replicated, points...)
+		return nil
+	}
+	numReplicated := func() int {
+		mx.Lock()
+		defer mx.Unlock()
+		return len(replicated)
+	}
+	open := func() (*DB, error) {
+		clock := NewVirtualClock(epoch)
+		clock.Freeze()
+		return NewDB(&DBOpts{
+			Dir:    tmpDir,
+			Clock:  clock,
+			Schema: schema,
+			Replicate: &ReplicateOpts{
+				Streams:       []string{"Inbound"},
+				Insert:        insert,
+				FlushInterval: 10 * time.Millisecond,
+				RetryInterval: 10 * time.Millisecond,
+			},
+		})
+	}
+
+	db, err := open()
+	if !assert.NoError(t, err) {
+		return
+	}
+	db.Insert("inbound", epoch, map[string]interface{}{"u": "bob"}, map[string]float64{"a": 1})
+	db.Insert("inbound", epoch, map[string]interface{}{"u": "alice"}, map[string]float64{"a": 2})
+	waitFor(func() bool { return numReplicated() == 2 })
+
+	mx.Lock()
+	assert.Equal(t, epoch, replicated[0].TS.In(time.UTC))
+	assert.Equal(t, "bob", replicated[0].Dims.Get("u"))
+	assert.EqualValues(t, 1, replicated[0].Vals.Get("a"))
+	assert.Equal(t, "alice", replicated[1].Dims.Get("u"))
+	mx.Unlock()
+
+	statuses := db.ReplicationStatuses()
+	if assert.Len(t, statuses, 1) {
+		assert.Equal(t, "inbound", statuses[0].Stream)
+		assert.EqualValues(t, 2, statuses[0].Replicated)
+		assert.EqualValues(t, 1, statuses[0].Failures)
+		assert.Empty(t, statuses[0].LastError)
+		assert.NotNil(t, statuses[0].Offset)
+	}
+	db.Close()
+
+	// Reopening resumes from the saved offset without replicating again
+	db, err = open()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	db.Insert("inbound", epoch, map[string]interface{}{"u": "carl"}, map[string]float64{"a": 3})
+	waitFor(func() bool { return numReplicated() == 3 })
+	time.Sleep(50 * time.Millisecond)
+	mx.Lock()
+	assert.Len(t, replicated, 3)
+	assert.Equal(t, "carl", replicated[2].Dims.Get("u"))
+	mx.Unlock()
+}
+
+func TestReplicationRequiresKnownStream(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	_, err = NewDB(&DBOpts{
+		Dir: tmpDir,
+		Replicate: &ReplicateOpts{
+			Streams: []string{"unknown"},
+			Insert:  func(stream string, points []*ReplicatedPoint) error { return nil },
+		},
+	})
+	assert.Error(t, err)
+}
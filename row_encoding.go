@@ -0,0 +1,164 @@
+package zenodb
+
+import (
+	"fmt"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+// Rows in data files start with their total length (including the length
+// itself) as a fixed 64 bit value so that they can be read and sorted as
+// opaque chunks. As of FileVersion_6, the remainder of the row looks like:
+//
+//   key length (uvarint)
+//   key
+//   number of columns (uvarint)
+//   length of each column's Sequence (uvarint, 0 for empty columns)
+//   for each non-empty column:
+//     until of the Sequence as a zigzag delta from the prior column's until
+//     the Sequence's data without its until
+//
+// Prior versions used fixed width 16 bit key lengths and column counts and
+// 64 bit column lengths and stored Sequences including their until.
+
+// encodedRowLength returns the number of bytes needed to encode the given row
+// in the current file format.
+func encodedRowLength(key bytemap.ByteMap, columns []encoding.Sequence) int {
+	length := encoding.Width64bits + encoding.UvarintSize(uint64(len(key))) + len(key) + encoding.UvarintSize(uint64(len(columns)))
+	prevUntil := int64(0)
+	for _, seq := range columns {
+		if len(seq) < encoding.WidthTime {
+			length++
+			continue
+		}
+		until := seq.UntilInt()
+		length += encoding.UvarintSize(uint64(len(seq))) + encoding.ZigZagDeltaSize(prevUntil, until) + seq.DataLength()
+		prevUntil = until
+	}
+	return length
+}
+
+// encodeRow encodes the given row in the current file format into b, which
+// must be exactly encodedRowLength long.
+func encodeRow(b []byte, key bytemap.ByteMap, columns []encoding.Sequence) {
+	b = encoding.WriteInt64(b, len(b))
+	b = encoding.WriteUvarint(b, uint64(len(key)))
+	b = encoding.Write(b, key)
+	b = encoding.WriteUvarint(b, uint64(len(columns)))
+	for _, seq := range columns {
+		if len(seq) < encoding.WidthTime {
+			b = encoding.WriteUvarint(b, 0)
+			continue
+		}
+		b = encoding.WriteUvarint(b, uint64(len(seq)))
+	}
+	prevUntil := int64(0)
+	for _, seq := range columns {
+		if len(seq) < encoding.WidthTime {
+			continue
+		}
+		until := seq.UntilInt()
+		b = encoding.WriteZigZagDelta(b, prevUntil, until)
+		b = encoding.Write(b, seq[encoding.WidthTime:])
+		prevUntil = until
+	}
+}
+
+// decodeRowKey decodes the key from a row (without its leading row length)
+// stored with the given file version and returns the remainder of the row.
+func decodeRowKey(fileVersion int, row []byte) (bytemap.ByteMap, []byte, error) {
+	var keyLength int
+	if fileVersion >= FileVersion_6 {
+		_keyLength, remain, err := encoding.ReadUvarintChecked(row)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to decode key length: %v", err)
+		}
+		keyLength, row = int(_keyLength), remain
+	} else {
+		var err error
+		keyLength, row, err = encoding.ReadInt16Checked(row)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return encoding.ReadByteMapChecked(row, keyLength)
+}
+
+// decodeRowColumns decodes the columns that follow the key in a row stored
+// with the given file version. As of FileVersion_6, empty columns are nil.
+func decodeRowColumns(fileVersion int, row []byte) ([]encoding.Sequence, error) {
+	if fileVersion < FileVersion_6 {
+		return decodeRowColumnsFixed(row)
+	}
+
+	_numColumns, row, err := encoding.ReadUvarintChecked(row)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode number of columns: %v", err)
+	}
+	// every column takes up at least one byte for its length
+	if _numColumns > uint64(len(row)) {
+		return nil, fmt.Errorf("Not enough data left to decode %d column lengths", _numColumns)
+	}
+	numColumns := int(_numColumns)
+	colLengths := make([]int, 0, numColumns)
+	for i := 0; i < numColumns; i++ {
+		var colLength uint64
+		colLength, row, err = encoding.ReadUvarintChecked(row)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decode column length: %v", err)
+		}
+		colLengths = append(colLengths, int(colLength))
+	}
+
+	columns := make([]encoding.Sequence, numColumns)
+	prevUntil := int64(0)
+	for i, colLength := range colLengths {
+		if colLength == 0 {
+			continue
+		}
+		var until int64
+		until, row, err = encoding.ReadZigZagDeltaChecked(row, prevUntil)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decode column until: %v", err)
+		}
+		dataLength := colLength - encoding.WidthTime
+		if dataLength < 0 || dataLength > len(row) {
+			return nil, fmt.Errorf("Not enough data left to decode column, wanted %d have %d", dataLength, len(row))
+		}
+		seq := make(encoding.Sequence, colLength)
+		encoding.Binary.PutUint64(seq, uint64(until))
+		copy(seq[encoding.WidthTime:], row[:dataLength])
+		row = row[dataLength:]
+		columns[i] = seq
+		prevUntil = until
+	}
+	return columns, nil
+}
+
+// decodeRowColumnsFixed decodes columns stored with fixed width lengths, as
+// used prior to FileVersion_6. The resulting Sequences point into row.
+func decodeRowColumnsFixed(row []byte) ([]encoding.Sequence, error) {
+	numColumns, row, err := encoding.ReadInt16Checked(row)
+	if err != nil {
+		return nil, err
+	}
+	colLengths := make([]int, 0, numColumns)
+	for i := 0; i < numColumns; i++ {
+		var colLength int
+		colLength, row, err = encoding.ReadInt64Checked(row)
+		if err != nil {
+			return nil, err
+		}
+		colLengths = append(colLengths, colLength)
+	}
+
+	columns := make([]encoding.Sequence, numColumns)
+	for i, colLength := range colLengths {
+		columns[i], row, err = encoding.ReadSequenceChecked(row, colLength)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return columns, nil
+}
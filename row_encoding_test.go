@@ -0,0 +1,75 @@
+package zenodb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/encoding"
+	. "github.com/getlantern/zenodb/expr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRowEncoding(t *testing.T) {
+	e := SUM("a")
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	key := bytemap.New(map[string]interface{}{"x": 1})
+	columns := []encoding.Sequence{
+		encoding.NewFloatValue(e, now, 1),
+		nil,
+		encoding.NewFloatValue(e, now.Add(-1*time.Second), 2),
+	}
+
+	row := make([]byte, encodedRowLength(key, columns))
+	encodeRow(row, key, columns)
+	assert.Equal(t, len(row), int(encoding.Binary.Uint64(row)), "row should start with its length")
+	assert.True(t, len(row) < len(encodeFixedWidthRow(key, columns)), "varint encoding should be smaller than fixed width encoding")
+
+	decodedKey, remain, err := decodeRowKey(CurrentFileVersion, row[encoding.Width64bits:])
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, key, decodedKey)
+	decodedColumns, err := decodeRowColumns(CurrentFileVersion, remain)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, columns, decodedColumns)
+
+	_, err = decodeRowColumns(CurrentFileVersion, remain[:len(remain)-1])
+	assert.Error(t, err, "truncated row should fail to decode")
+
+	// Rows in older versions can still be decoded
+	fixed := encodeFixedWidthRow(key, columns)
+	decodedKey, remain, err = decodeRowKey(FileVersion_5, fixed[encoding.Width64bits:])
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, key, decodedKey)
+	decodedColumns, err = decodeRowColumns(FileVersion_5, remain)
+	if assert.NoError(t, err) && assert.Len(t, decodedColumns, 3) {
+		assert.Equal(t, columns[0], decodedColumns[0])
+		assert.Empty(t, decodedColumns[1])
+		assert.Equal(t, columns[2], decodedColumns[2])
+	}
+
+	// Corrupted rows return errors rather than panicking
+	for _, fileVersion := range []int{FileVersion_5, CurrentFileVersion} {
+		var full []byte
+		if fileVersion == CurrentFileVersion {
+			full = row[encoding.Width64bits:]
+		} else {
+			full = fixed[encoding.Width64bits:]
+		}
+		for i := 0; i < len(full); i++ {
+			truncated := full[:i]
+			assert.NotPanics(t, func() {
+				_, remain, err := decodeRowKey(fileVersion, truncated)
+				if err == nil {
+					_, err = decodeRowColumns(fileVersion, remain)
+				}
+				assert.Error(t, err, "truncated to %d in version %d", i, fileVersion)
+			})
+		}
+	}
+}
@@ -7,11 +7,14 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dustin/go-humanize"
@@ -20,21 +23,43 @@ import (
 	"github.com/getlantern/zenodb/bytetree"
 	"github.com/getlantern/zenodb/core"
 	"github.com/getlantern/zenodb/encoding"
-	"github.com/golang/snappy"
+	"github.com/getlantern/zenodb/trace"
 	"github.com/oxtoacart/emsort"
+	"github.com/spaolacci/murmur3"
 )
 
 const (
 	// File format versions
-	FileVersion_4      = 4
-	CurrentFileVersion = FileVersion_4
+	FileVersion_4 = 4
+	// FileVersion_5 adds the encoding version of keys and sequences to the
+	// header
+	FileVersion_5 = 5
+	// FileVersion_6 uses varints for lengths and delta encodes the until of
+	// Sequences within rows, see row_encoding.go
+	FileVersion_6 = 6
+	// FileVersion_7 adds the layout of the data to the header, which allows
+	// storing it in columnar blocks, see columnar.go
+	FileVersion_7 = 7
+	// FileVersion_8 stores the compression of the data in a byte that precedes
+	// the (possibly) compressed stream, followed by the dictionary for zstd, see
+	// newCompressedWriter
+	FileVersion_8      = 8
+	CurrentFileVersion = FileVersion_8
 
 	offsetFilename = "offset"
 )
 
 var (
+	// errFileStoreRemoved indicates that a read-only row store's file was
+	// removed by the writing process before it could be opened
+	errFileStoreRemoved = fmt.Errorf("File store removed")
+
 	fieldsDelims = map[int]string{
 		FileVersion_4: "|",
+		FileVersion_5: "|",
+		FileVersion_6: "|",
+		FileVersion_7: "|",
+		FileVersion_8: "|",
 	}
 )
 
@@ -42,27 +67,59 @@ type rowStoreOptions struct {
 	dir             string
 	minFlushLatency time.Duration
 	maxFlushLatency time.Duration
+	// flushJitter randomly lengthens each flush interval by up to this much
+	flushJitter time.Duration
+	// clock drives flushing and removal of old files, defaults to real time
+	clock timeSource
+	// memoryOnly keeps flushed data in memory instead of writing it to dir
+	memoryOnly bool
+	// columnar stores flushed data in columnar blocks instead of rows
+	columnar bool
+	// compression is how flushed data is compressed, see compressionFor
+	compression byte
+	// mmap reads data files through memory mappings instead of file reads
+	mmap bool
+	// readOnly reads the files that another process writes to dir without
+	// inserting, flushing or removing anything
+	readOnly bool
+	// initialOffset, if set, is recorded as the WAL offset of the first
+	// memstore so that flushes save it even before anything is read from the
+	// WAL
+	initialOffset wal.Offset
 }
 
 type insert struct {
-	key      bytemap.ByteMap
-	vals     encoding.TSParams
-	metadata bytemap.ByteMap
-	offset   wal.Offset
+	key bytemap.ByteMap
+	// pooledKey indicates that key was built with an encoding.KeyBuilder and
+	// can be released once it's no longer needed
+	pooledKey bool
+	vals      encoding.TSParams
+	metadata  bytemap.ByteMap
+	offset    wal.Offset
 }
 
 type rowStore struct {
-	t                   *table
-	fields              core.Fields
-	fieldUpdates        chan core.Fields
-	opts                *rowStoreOptions
-	memStore            *memstore
-	fileStore           *fileStore
-	inserts             chan *insert
-	forceFlushes        chan bool
-	forceFlushCompletes chan bool
-	flushCount          int
-	mx                  sync.RWMutex
+	t              *table
+	fields         core.Fields
+	fieldUpdates   chan core.Fields
+	opts           *rowStoreOptions
+	memStore       *memstore
+	fileStore      *fileStore
+	inserts        chan *insert
+	forceFlushes   chan *flushRequest
+	latencyUpdates chan *rowStoreOptions
+	flushCount     int
+	// dict is the zstd dictionary trained on the previous flush, only used by
+	// the flush goroutine
+	dict []byte
+	mx             sync.RWMutex
+}
+
+// flushRequest asks the rowStore to flush immediately. The rowStore closes done
+// once the flush has finished.
+type flushRequest struct {
+	truncate bool
+	done     chan struct{}
 }
 
 type memstore struct {
@@ -70,6 +127,8 @@ type memstore struct {
 	tree          *bytetree.Tree
 	offset        wal.Offset
 	offsetChanged bool
+	// inserts counts the inserts applied to this memstore
+	inserts int64
 }
 
 func (ms *memstore) copy() *memstore {
@@ -78,19 +137,69 @@ func (ms *memstore) copy() *memstore {
 		tree:          ms.tree.Copy(),
 		offset:        ms.offset,
 		offsetChanged: ms.offsetChanged,
+		inserts:       ms.inserts,
 	}
 }
 
 func (t *table) openRowStore(opts *rowStoreOptions) (*rowStore, wal.Offset, error) {
-	err := os.MkdirAll(opts.dir, 0755)
-	if err != nil && !os.IsExist(err) {
-		return nil, nil, fmt.Errorf("Unable to create folder for row store: %v", err)
+	if opts.clock == nil {
+		opts.clock = realTime
+	}
+	var existingFileName string
+	var walOffset wal.Offset
+	if !opts.memoryOnly {
+		var err error
+		existingFileName, walOffset, err = t.findExistingFile(opts)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	fields := t.getFields()
+	rs := &rowStore{
+		opts:           opts,
+		t:              t,
+		fields:         fields,
+		fieldUpdates:   make(chan core.Fields),
+		inserts:        make(chan *insert),
+		forceFlushes:   make(chan *flushRequest),
+		latencyUpdates: make(chan *rowStoreOptions),
+		fileStore: &fileStore{
+			t:        t,
+			fields:   fields,
+			opts:     opts,
+			filename: existingFileName,
+		},
+	}
+
+	if !opts.readOnly {
+		go rs.processInserts()
+		if !opts.memoryOnly {
+			go rs.removeOldFiles()
+		}
+	}
+
+	return rs, walOffset, nil
+}
+
+// findExistingFile finds the most recent file in the row store's directory
+// and the WAL offset from which to resume reading.
+func (t *table) findExistingFile(opts *rowStoreOptions) (string, wal.Offset, error) {
+	if !opts.readOnly {
+		err := os.MkdirAll(opts.dir, 0755)
+		if err != nil && !os.IsExist(err) {
+			return "", nil, fmt.Errorf("Unable to create folder for row store: %v", err)
+		}
 	}
 
 	existingFileName := ""
 	files, err := ioutil.ReadDir(opts.dir)
+	if opts.readOnly && os.IsNotExist(err) {
+		// Nothing flushed for this table yet
+		return "", nil, nil
+	}
 	if err != nil {
-		return nil, nil, fmt.Errorf("Unable to read contents of directory: %v", err)
+		return "", nil, fmt.Errorf("Unable to read contents of directory: %v", err)
 	}
 	var walOffset wal.Offset
 	if len(files) > 0 {
@@ -112,23 +221,33 @@ func (t *table) openRowStore(opts *rowStoreOptions) (*rowStore, wal.Offset, erro
 				continue
 			}
 
-			// Version is currently unused, just read it to advance through file
-			versionFor(existingFileName)
+			fileVersion := versionFor(existingFileName)
 			// Get WAL offset
 			file, err := os.Open(existingFileName)
+			if opts.readOnly && os.IsNotExist(err) {
+				return "", nil, errFileStoreRemoved
+			}
 			if err != nil {
-				return nil, nil, fmt.Errorf("Unable to open existing file %v: %v", existingFileName, err)
+				return "", nil, fmt.Errorf("Unable to open existing file %v: %v", existingFileName, err)
 			}
 			defer file.Close()
-			r := snappy.NewReader(file)
-			// Skip header length
 			newWALOffset := make(wal.Offset, wal.OffsetSize+4)
-			_, err = io.ReadFull(r, newWALOffset)
+			r, err := newDecompressingReader(file, fileVersion)
+			if err == nil {
+				// Skip header length
+				_, err = io.ReadFull(r, newWALOffset)
+				releaseReader(r)
+			}
+			if err != nil && opts.readOnly {
+				log.Errorf("Unable to read offset from existing file %v, assuming corrupted and skipping: %v", existingFileName, err)
+				existingFileName = ""
+				continue
+			}
 			if err != nil {
 				log.Errorf("Unable to read offset from existing file %v, assuming corrupted and will remove: %v", existingFileName, err)
 				rmErr := os.Remove(existingFileName)
 				if rmErr != nil {
-					return nil, nil, fmt.Errorf("Unable to remove corrupted file %v: %v", existingFileName, err)
+					return "", nil, fmt.Errorf("Unable to remove corrupted file %v: %v", existingFileName, err)
 				}
 				continue
 			}
@@ -141,28 +260,7 @@ func (t *table) openRowStore(opts *rowStoreOptions) (*rowStore, wal.Offset, erro
 			break
 		}
 	}
-
-	fields := t.getFields()
-	rs := &rowStore{
-		opts:                opts,
-		t:                   t,
-		fields:              fields,
-		fieldUpdates:        make(chan core.Fields),
-		inserts:             make(chan *insert),
-		forceFlushes:        make(chan bool),
-		forceFlushCompletes: make(chan bool),
-		fileStore: &fileStore{
-			t:        t,
-			fields:   fields,
-			opts:     opts,
-			filename: existingFileName,
-		},
-	}
-
-	go rs.processInserts()
-	go rs.removeOldFiles()
-
-	return rs, walOffset, nil
+	return existingFileName, walOffset, nil
 }
 
 func (rs *rowStore) memStoreSize() int {
@@ -175,13 +273,131 @@ func (rs *rowStore) memStoreSize() int {
 	return size
 }
 
+// memStoreStats returns the number of keys, sequences and inserts in the
+// current memstore.
+func (rs *rowStore) memStoreStats() (keys int64, sequences int64, inserts int64) {
+	rs.mx.RLock()
+	defer rs.mx.RUnlock()
+	if rs.memStore == nil {
+		return
+	}
+	keys = int64(rs.memStore.tree.Length())
+	inserts = rs.memStore.inserts
+	rs.memStore.tree.Walk(0, func(key []byte, data []encoding.Sequence) (bool, bool, error) {
+		for _, seq := range data {
+			if seq != nil {
+				sequences++
+			}
+		}
+		return true, true, nil
+	})
+	return
+}
+
+func (rs *rowStore) archiveQueueDepth() int64 {
+	depth := int64(0)
+	rs.mx.RLock()
+	if rs.memStore != nil {
+		depth = rs.memStore.inserts
+	}
+	rs.mx.RUnlock()
+	return depth
+}
+
+func (rs *rowStore) fileStoreSize() int64 {
+	rs.mx.RLock()
+	filename := rs.fileStore.filename
+	data := rs.fileStore.data
+	rs.mx.RUnlock()
+	if rs.opts.memoryOnly {
+		return int64(len(data))
+	}
+	if filename == "" {
+		return 0
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+func (rs *rowStore) memStoreLength() int {
+	length := 0
+	rs.mx.RLock()
+	if rs.memStore != nil {
+		length = rs.memStore.tree.Length()
+	}
+	rs.mx.RUnlock()
+	return length
+}
+
 func (rs *rowStore) insert(insert *insert) {
 	rs.inserts <- insert
 }
 
-func (rs *rowStore) forceFlush() {
-	rs.forceFlushes <- true
-	<-rs.forceFlushCompletes
+// updateFields changes the row store's fields. Unless it's read-only, this
+// flushes the memstore before processing any more inserts.
+func (rs *rowStore) updateFields(fields core.Fields) {
+	if rs.opts.readOnly {
+		rs.mx.Lock()
+		rs.fields = fields
+		rs.mx.Unlock()
+		return
+	}
+	rs.fieldUpdates <- fields
+}
+
+func (rs *rowStore) forceFlush(ctx context.Context) error {
+	return rs.requestFlush(ctx, false)
+}
+
+// applyRetention immediately flushes the memstore, truncating data older than
+// the retention period, and then removes old files.
+func (rs *rowStore) applyRetention(ctx context.Context) error {
+	err := rs.requestFlush(ctx, true)
+	if err != nil {
+		return err
+	}
+	if !rs.opts.memoryOnly {
+		rs.removeOldFilesOnce()
+	}
+	return nil
+}
+
+// rewrite immediately flushes the memstore, rewriting all data on disk rather
+// than passing through unchanged rows.
+func (rs *rowStore) rewrite() {
+	rs.requestFlush(context.Background(), true)
+}
+
+// requestFlush asks for an immediate flush and waits for it to finish. If ctx
+// is done first, it stops waiting and returns ctx's error. A flush that was
+// already requested still happens.
+func (rs *rowStore) requestFlush(ctx context.Context, truncate bool) error {
+	ctxErr := ctx.Err()
+	if ctxErr != nil {
+		return ctxErr
+	}
+	req := &flushRequest{truncate: truncate, done: make(chan struct{})}
+	select {
+	case rs.forceFlushes <- req:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-req.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// updateFlushLatencies changes the min and max flush latencies and the flush
+// jitter, taking effect with the next flush or immediately if the new max is
+// shorter than the current flush interval.
+func (rs *rowStore) updateFlushLatencies(minFlushLatency time.Duration, maxFlushLatency time.Duration, flushJitter time.Duration) {
+	rs.latencyUpdates <- &rowStoreOptions{minFlushLatency: minFlushLatency, maxFlushLatency: maxFlushLatency, flushJitter: flushJitter}
 }
 
 func (rs *rowStore) newMemStore() *memstore {
@@ -191,20 +407,39 @@ func (rs *rowStore) newMemStore() *memstore {
 }
 
 func (rs *rowStore) processInserts() {
+	rs.t.labelGoroutine()
 	ms := rs.newMemStore()
+	ms.offset = rs.opts.initialOffset
 	rs.mx.Lock()
 	rs.memStore = ms
 	rs.mx.Unlock()
 
-	flushInterval := rs.opts.maxFlushLatency
-	flushTimer := time.NewTimer(flushInterval)
+	minFlushLatency := rs.opts.minFlushLatency
+	maxFlushLatency := rs.opts.maxFlushLatency
+	flushJitter := rs.opts.flushJitter
+	// Seed by time so that partitions and restarted processes don't share the
+	// same jitter
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	// jittered adds the flush jitter to the given interval so that tables with
+	// the same flush latencies don't all flush at the same time
+	jittered := func(interval time.Duration) time.Duration {
+		if flushJitter <= 0 || interval > time.Duration(math.MaxInt64)-flushJitter {
+			return interval
+		}
+		return interval + time.Duration(rnd.Int63n(int64(flushJitter)))
+	}
+
+	flushInterval := maxFlushLatency
+	flushTimer := rs.opts.clock.newTimer(jittered(flushInterval))
 	rs.t.log.Debugf("Will flush after %v", flushInterval)
 
-	flush := func(allowSort bool) *memstore {
-		if ms.tree.Length() == 0 {
+	// Forced flushes are allowed to sort and aren't throttled since something is
+	// waiting for them to finish.
+	flush := func(forced bool, forceTruncate bool) *memstore {
+		if ms.tree.Length() == 0 && !forceTruncate {
 			rs.t.log.Trace("No data to flush")
 
-			if ms.offsetChanged {
+			if ms.offsetChanged && !rs.opts.memoryOnly {
 				rs.t.log.Debug("No new data, but we've advanced through the WAL, record the change")
 				err := rs.writeOffset(ms.offset)
 				if err != nil {
@@ -214,21 +449,22 @@ func (rs *rowStore) processInserts() {
 			}
 
 			// Immediately reset flushTimer
-			flushTimer.Reset(flushInterval)
+			flushTimer.Reset(jittered(flushInterval))
 			return nil
 		}
 		if rs.t.log.IsTraceEnabled() {
 			rs.t.log.Tracef("Requesting flush at memstore size: %v", humanize.Bytes(uint64(ms.tree.Bytes())))
 		}
-		newMS, flushDuration := rs.processFlush(ms, allowSort)
+		newMS, flushDuration := rs.processFlush(ms, forced, !forced, forceTruncate)
+		rs.t.recordFlush(flushDuration)
 		ms = newMS
 		flushInterval = flushDuration * 10
-		if flushInterval > rs.opts.maxFlushLatency {
-			flushInterval = rs.opts.maxFlushLatency
-		} else if flushInterval < rs.opts.minFlushLatency {
-			flushInterval = rs.opts.minFlushLatency
+		if flushInterval > maxFlushLatency {
+			flushInterval = maxFlushLatency
+		} else if flushInterval < minFlushLatency {
+			flushInterval = minFlushLatency
 		}
-		flushTimer.Reset(flushInterval)
+		flushTimer.Reset(jittered(flushInterval))
 		return newMS
 	}
 
@@ -236,27 +472,47 @@ func (rs *rowStore) processInserts() {
 		select {
 		case insert := <-rs.inserts:
 			rs.mx.Lock()
-			ms.offset = insert.offset
-			ms.offsetChanged = true
+			if insert.offset != nil {
+				// Inserts without an offset, like backfilled data, don't come from
+				// the WAL
+				ms.offset = insert.offset
+				ms.offsetChanged = true
+			}
 			if insert.key != nil {
+				ms.inserts++
+				length := ms.tree.Length()
 				ms.tree.Update(insert.key, nil, insert.vals, insert.metadata)
+				if insert.pooledKey && ms.tree.Length() == length {
+					// The key was already in the tree, which means that the tree didn't
+					// hold on to this copy of it
+					encoding.ReleaseKey(insert.key)
+				}
 				rs.t.updateHighWaterMarkMemory(insert.vals.TimeInt())
 			}
 			rs.mx.Unlock()
-		case <-flushTimer.C:
+		case <-flushTimer.C():
 			rs.t.log.Trace("Requesting flush due to flush interval")
-			flush(false)
-		case <-rs.forceFlushes:
+			flush(false, false)
+		case req := <-rs.forceFlushes:
 			rs.t.log.Debug("Forcing flush")
-			flush(true)
-			rs.forceFlushCompletes <- true
+			flush(true, req.truncate)
+			close(req.done)
+		case latencies := <-rs.latencyUpdates:
+			rs.t.log.Debugf("Updating flush latencies to min %v, max %v, jitter %v", latencies.minFlushLatency, latencies.maxFlushLatency, latencies.flushJitter)
+			minFlushLatency = latencies.minFlushLatency
+			maxFlushLatency = latencies.maxFlushLatency
+			flushJitter = latencies.flushJitter
+			if flushInterval > maxFlushLatency {
+				flushInterval = maxFlushLatency
+				flushTimer.Reset(jittered(flushInterval))
+			}
 		case fields := <-rs.fieldUpdates:
 			rs.t.log.Debugf("Updating fields to %v", fields)
 			// update fields immediately
 			rs.fields = fields
 
 			// force flush before processing any more inserts
-			ms = flush(false)
+			ms = flush(false, false)
 
 			if ms == nil {
 				// nothing flushed, create a new memstore to pick up new fields
@@ -269,9 +525,15 @@ func (rs *rowStore) processInserts() {
 	}
 }
 
-func (rs *rowStore) iterate(ctx context.Context, outFields core.Fields, includeMemStore bool, onValue func(bytemap.ByteMap, []encoding.Sequence) (more bool, err error)) error {
+func (rs *rowStore) iterate(ctx context.Context, outFields core.Fields, includeMemStore bool, filter *core.KeyFilter, window *timeWindow, onValue func(bytemap.ByteMap, []encoding.Sequence) (more bool, err error)) error {
 	guard := core.Guard(ctx)
 
+	if rs.opts.readOnly {
+		return rs.iterateReadOnly(outFields, filter, window, func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+			return guard.ProceedAfter(onValue(key, columns))
+		})
+	}
+
 	rs.mx.RLock()
 	fs := rs.fileStore
 	var ms *memstore
@@ -279,13 +541,34 @@ func (rs *rowStore) iterate(ctx context.Context, outFields core.Fields, includeM
 		ms = rs.memStore.copy()
 	}
 	rs.mx.RUnlock()
-	return fs.iterate(outFields, ms, false, false, func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+	return fs.iterate(outFields, ms, filter, window, false, false, func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
 		return guard.ProceedAfter(onValue(key, columns))
 	})
 }
 
-func (rs *rowStore) processFlush(ms *memstore, allowSort bool) (*memstore, time.Duration) {
-	shouldSort := allowSort && rs.t.shouldSort()
+// maxEvictionFlushes limits how many times a flush is repeated to evict data
+// when the table exceeds its MaxDiskBytes, so that a table that can't get back
+// within budget doesn't keep flushing.
+const maxEvictionFlushes = 3
+
+func (rs *rowStore) processFlush(ms *memstore, allowSort bool, throttle bool, forceTruncate bool) (*memstore, time.Duration) {
+	ms, flushDuration, overBudget := rs.flushOnce(ms, allowSort, throttle, forceTruncate)
+	for i := 0; overBudget && i < maxEvictionFlushes; i++ {
+		// Flush again to remove the evicted periods
+		var evictDuration time.Duration
+		ms, evictDuration, overBudget = rs.flushOnce(ms, false, throttle, true)
+		flushDuration += evictDuration
+	}
+	return ms, flushDuration
+}
+
+// flushOnce flushes the given memstore to a new file and returns true if the
+// result exceeded the table's MaxDiskBytes and needs to be flushed again to
+// evict old data.
+func (rs *rowStore) flushOnce(ms *memstore, allowSort bool, throttle bool, forceTruncate bool) (*memstore, time.Duration, bool) {
+	// Memory-only tables don't sort because sorting spills to temporary files.
+	// Columnar tables don't sort because sorting works on individual rows.
+	shouldSort := allowSort && !rs.opts.memoryOnly && !rs.opts.columnar && rs.t.shouldSort()
 	willSort := "not sorted"
 	if shouldSort {
 		defer rs.t.stopSorting()
@@ -294,30 +577,42 @@ func (rs *rowStore) processFlush(ms *memstore, allowSort bool) (*memstore, time.
 
 	rs.t.log.Debugf("Starting flush, %v", willSort)
 	start := time.Now()
-	out, err := ioutil.TempFile("", "nextrowstore")
+	_, span := trace.Start(context.Background(), "flush", "table", rs.t.Name, "sorted", shouldSort)
+	var out *os.File
+	var memOut *bytes.Buffer
+	var sout io.WriteCloser
+	var err error
+	if rs.opts.memoryOnly {
+		memOut = &bytes.Buffer{}
+		sout, err = newCompressedWriter(memOut, rs.opts.compression, rs.dict)
+	} else {
+		out, err = ioutil.TempFile("", "nextrowstore")
+		if err != nil {
+			panic(err)
+		}
+		defer out.Close()
+		var fout io.Writer = out
+		if throttle {
+			fout = rs.t.db.flushThrottle.writer(out)
+		}
+		sout, err = newCompressedWriter(fout, rs.opts.compression, rs.dict)
+	}
 	if err != nil {
 		panic(err)
 	}
-	defer out.Close()
-	sout := snappy.NewBufferedWriter(out)
 
 	fieldStrings := make([]string, 0, len(rs.fields))
 	for _, field := range rs.fields {
 		fieldStrings = append(fieldStrings, field.String())
 	}
-	fieldsBytes := []byte(strings.Join(fieldStrings, fieldsDelims[CurrentFileVersion]))
-	headerLength := uint32(len(ms.offset) + len(fieldsBytes))
-	err = binary.Write(sout, encoding.Binary, headerLength)
-	if err != nil {
-		panic(fmt.Errorf("Unable to write header length: %v", err))
-	}
-	_, err = sout.Write(ms.offset)
-	if err != nil {
-		panic(fmt.Errorf("Unable to write header: %v", err))
+	offset := ms.offset
+	layout := layoutRows
+	if rs.opts.columnar {
+		layout = layoutColumnar
 	}
-	_, err = sout.Write(fieldsBytes)
+	err = writeHeader(sout, offset, layout, fieldStrings)
 	if err != nil {
-		panic(fmt.Errorf("Unable to write header: %v", err))
+		panic(err)
 	}
 
 	var cout io.WriteCloser
@@ -350,15 +645,54 @@ func (rs *rowStore) processFlush(ms *memstore, allowSort bool) (*memstore, time.
 	}
 
 	highWaterMark := int64(0)
+	numKeys := int64(0)
+	var flushedKeys map[uint64]bool
+	if rs.t.tenant != nil && rs.t.tenant.tracksKeys() {
+		flushedKeys = make(map[uint64]bool)
+	}
+	// Sample what's flushed to train the dictionary for the next flush
+	var sampler *dictSampler
+	if rs.opts.compression == compressionZstd {
+		sampler = &dictSampler{}
+	}
+	recordKey := func(key bytemap.ByteMap) {
+		numKeys++
+		if flushedKeys != nil {
+			flushedKeys[murmur3.Sum64(key)] = true
+		}
+	}
 	truncateBefore := rs.t.truncateBefore()
+	tombstones, compacted := rs.t.tombstones()
+	remap := rs.t.pendingRemap()
+	var remapped *bytetree.Tree
+	remapCtx := time.Now().UnixNano()
+	var rowBuffer []byte
+	var blocks *columnarWriter
+	if rs.opts.columnar {
+		blocks = newColumnarWriter(cout, len(rs.fields))
+	}
 	write := func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
 		if !shouldSort && raw != nil {
 			// This is an optimization that allows us to skip other processing by just
 			// passing through the raw data
+			recordKey(key)
+			sampler.sample(raw)
 			_, writeErr := cout.Write(raw)
 			return true, writeErr
 		}
 
+		if remapped != nil {
+			if _, changed := remap.remap(key); changed {
+				// the row's data is written under its remapped key
+				return true, nil
+			}
+			for i, seq := range remapped.Remove(remapCtx, key) {
+				columns[i] = columns[i].Merge(seq, rs.fields[i].Expr, rs.t.Resolution, truncateBefore)
+			}
+		}
+		if len(tombstones) > 0 {
+			rs.t.eraseDeleted(tombstones, key, columns, rs.fields)
+		}
 		hasActiveSequence := false
 		for i, seq := range columns {
 			seq = seq.Truncate(rs.fields[i].Expr.EncodedWidth(), rs.t.Resolution, truncateBefore, time.Time{})
@@ -372,65 +706,35 @@ func (rs *rowStore) processFlush(ms *memstore, allowSort bool) (*memstore, time.
 			// all encoding.Sequences expired, remove key
 			return true, nil
 		}
+		recordKey(key)
 
-		rowLength := encoding.Width64bits + encoding.Width16bits + len(key) + encoding.Width16bits
 		for _, seq := range columns {
-			rowLength += encoding.Width64bits + len(seq)
+			sampler.sample(seq)
 			ts := seq.UntilInt()
 			if ts > highWaterMark {
 				highWaterMark = ts
 			}
 		}
 
-		var o io.Writer = cout
-		var buf *bytes.Buffer
-		if shouldSort {
-			// When sorting, we need to write the entire row as a single byte array,
-			// so use a ByteBuffer. We don't do this otherwise because we're already
-			// using a buffered writer, so we can avoid the copying
-			b := make([]byte, 0, rowLength)
-			buf = bytes.NewBuffer(b)
-			o = buf
-		}
-
-		err = binary.Write(o, encoding.Binary, uint64(rowLength))
-		if err != nil {
-			panic(err)
-		}
-
-		err = binary.Write(o, encoding.Binary, uint16(len(key)))
-		if err != nil {
-			panic(err)
-		}
-		_, err = o.Write(key)
-		if err != nil {
-			panic(err)
+		if blocks != nil {
+			return true, blocks.add(key, columns)
 		}
 
-		err = binary.Write(o, encoding.Binary, uint16(len(columns)))
-		if err != nil {
-			panic(err)
-		}
-		for _, seq := range columns {
-			err = binary.Write(o, encoding.Binary, uint64(len(seq)))
-			if err != nil {
-				panic(err)
-			}
-		}
-		for _, seq := range columns {
-			_, err = o.Write(seq)
-			if err != nil {
-				panic(err)
+		rowLength := encodedRowLength(key, columns)
+		var row []byte
+		if shouldSort || rowLength > cap(rowBuffer) {
+			// When sorting, the sorter holds on to rows, so they can't share a buffer
+			row = make([]byte, rowLength)
+			if !shouldSort {
+				rowBuffer = row
 			}
+		} else {
+			row = rowBuffer[:rowLength]
 		}
-
-		if shouldSort {
-			// flush buffer
-			_b := buf.Bytes()
-			_, writeErr := cout.Write(_b)
-			if writeErr != nil {
-				panic(writeErr)
-			}
+		encodeRow(row, key, columns)
+		_, writeErr := cout.Write(row)
+		if writeErr != nil {
+			panic(writeErr)
 		}
 
 		return true, nil
@@ -440,46 +744,109 @@ func (rs *rowStore) processFlush(ms *memstore, allowSort bool) (*memstore, time.
 	rs.mx.RUnlock()
 	// We allow raw most of the time for efficiency purposes, but every 10 flushes
 	// we don't so that we have an opportunity to truncate old data.
-	disallowRaw := rs.flushCount%10 == 9
+	// Memory-only tables always truncate to keep memory bounded by the retention
+	// period. Columnar tables never pass through raw rows. Neither do flushes
+	// that need to remove deleted data from disk or remap keys.
+	disallowRaw := forceTruncate || rs.opts.memoryOnly || rs.opts.columnar || !compacted || remap != nil || rs.flushCount%10 == 9
 	rs.flushCount++
 	if disallowRaw {
 		rs.t.log.Debug("Disallowing raw on flush to force truncation")
 	}
-	fs.iterate(rs.fields, ms, !shouldSort, !disallowRaw, write)
-	err = cout.Close()
-	if err != nil {
-		panic(err)
+	if remap != nil {
+		remapped, err = rs.remapKeys(fs, ms, remap)
+		if err != nil {
+			rs.t.log.Error(err)
+			rs.t.db.updateRemap(remap, RemapFailed, err)
+			remap = nil
+		}
 	}
-
-	fi, err := out.Stat()
-	if err != nil {
-		rs.t.log.Errorf("Unable to stat output file to get size: %v", err)
+	fs.iterate(rs.fields, ms, nil, nil, !shouldSort, !disallowRaw, write)
+	if remapped != nil {
+		// Write remapped rows that weren't merged into existing ones
+		remaining := remapped
+		remapped = nil
+		remaining.Walk(remapCtx, func(key []byte, columns []encoding.Sequence) (bool, bool, error) {
+			more, writeErr := write(bytemap.ByteMap(key), columns, nil)
+			return more, false, writeErr
+		})
+	}
+	if blocks != nil {
+		err = blocks.flush()
+		if err != nil {
+			panic(err)
+		}
 	}
-	// Note - we left-pad the unix nano value to the widest possible length to
-	// ensure lexicographical sort matches time-based sort (e.g. on directory
-	// listing).
-	newFileStoreName := filepath.Join(rs.opts.dir, fmt.Sprintf("filestore_%020d_%d.dat", time.Now().UnixNano(), CurrentFileVersion))
-	err = os.Rename(out.Name(), newFileStoreName)
+	err = cout.Close()
 	if err != nil {
 		panic(err)
 	}
+	if sampler != nil {
+		rs.dict = sampler.train()
+	}
 
-	fs = &fileStore{rs.t, rs.fields, rs.opts, newFileStoreName}
+	// size is -1 if unknown
+	size := int64(-1)
+	var newFileStoreName string
+	if rs.opts.memoryOnly {
+		newFileStoreName = "memory"
+		size = int64(memOut.Len())
+		fs = &fileStore{t: rs.t, fields: rs.fields, opts: rs.opts, data: memOut.Bytes()}
+	} else {
+		fi, statErr := out.Stat()
+		if statErr != nil {
+			rs.t.log.Errorf("Unable to stat output file to get size: %v", statErr)
+		} else {
+			size = fi.Size()
+		}
+		// Note - we left-pad the unix nano value to the widest possible length to
+		// ensure lexicographical sort matches time-based sort (e.g. on directory
+		// listing).
+		newFileStoreName = filepath.Join(rs.opts.dir, fmt.Sprintf("filestore_%020d_%d.dat", time.Now().UnixNano(), CurrentFileVersion))
+		err = os.Rename(out.Name(), newFileStoreName)
+		if err != nil {
+			panic(err)
+		}
+		fs = &fileStore{t: rs.t, fields: rs.fields, opts: rs.opts, filename: newFileStoreName}
+	}
+	archived := ms
 	ms = rs.newMemStore()
+	// Carry over the offset so that it's recorded even if the next flush
+	// happens before anything new is inserted
+	ms.offset = offset
 	rs.mx.Lock()
 	rs.fileStore = fs
 	rs.memStore = ms
 	rs.mx.Unlock()
 
 	flushDuration := time.Now().Sub(start)
-	if fi != nil {
-		rs.t.log.Debugf("Flushed to %v in %v, size %v. %v.", newFileStoreName, flushDuration, humanize.Bytes(uint64(fi.Size())), willSort)
+	if size >= 0 {
+		rs.t.log.Debugf("Flushed to %v in %v, size %v. %v.", newFileStoreName, flushDuration, humanize.Bytes(uint64(size)), willSort)
 	} else {
 		rs.t.log.Debugf("Flushed to %v in %v. %v.", newFileStoreName, flushDuration, willSort)
 	}
 
 	rs.t.updateHighWaterMarkDisk(highWaterMark)
-	return ms, flushDuration
+	if archived.tree.Length() > 0 || len(tombstones) > 0 {
+		rs.t.db.recordArchived()
+	}
+	rs.t.db.publishArchived(rs.t, archived, offset)
+	if !compacted {
+		rs.t.db.markCompacted(tombstones)
+	}
+	if remap != nil {
+		rs.t.log.Debugf("Remapped %d keys", atomic.LoadInt64(&remap.RemappedKeys))
+		rs.t.db.updateRemap(remap, RemapDone, nil)
+	}
+	if rs.t.tenant != nil {
+		rs.t.tenant.recordFlush(rs.t.Name, numKeys, size, flushedKeys)
+	}
+	rs.t.counters.recordDiskKeys(numKeys)
+	span.SetAttribute("keys", numKeys)
+	if size >= 0 {
+		span.SetAttribute("bytes", size)
+	}
+	span.Finish(nil)
+	return ms, flushDuration, rs.evictOverBudget(fs, size)
 }
 
 func (rs *rowStore) writeOffset(offset wal.Offset) error {
@@ -503,54 +870,102 @@ func (rs *rowStore) writeOffset(offset wal.Offset) error {
 }
 
 func (rs *rowStore) removeOldFiles() {
-	for {
-		time.Sleep(10 * time.Second)
-		files, err := ioutil.ReadDir(rs.opts.dir)
-		if err != nil {
-			log.Errorf("Unable to list data files in %v: %v", rs.opts.dir, err)
+	rs.t.labelGoroutine()
+	tk := rs.opts.clock.newTicker(10 * time.Second)
+	defer tk.Stop()
+	for range tk.C() {
+		rs.removeOldFilesOnce()
+	}
+}
+
+func (rs *rowStore) removeOldFilesOnce() {
+	files, err := ioutil.ReadDir(rs.opts.dir)
+	if err != nil {
+		log.Errorf("Unable to list data files in %v: %v", rs.opts.dir, err)
+	}
+	// Note - the list of files is sorted by name, which in our case is the
+	// timestamp, so that means they're sorted chronologically. We don't want
+	// to delete the last file in the list because that's the current one.
+	foundLatest := false
+	var span *trace.Span
+	removed := 0
+	for i := len(files) - 1; i >= 0; i-- {
+		filename := files[i].Name()
+		if filename == offsetFilename {
+			// Ignore offset file
+			continue
 		}
-		// Note - the list of files is sorted by name, which in our case is the
-		// timestamp, so that means they're sorted chronologically. We don't want
-		// to delete the last file in the list because that's the current one.
-		foundLatest := false
-		for i := len(files) - 1; i >= 0; i-- {
-			filename := files[i].Name()
-			if filename == offsetFilename {
-				// Ignore offset file
-				continue
-			}
-			if !foundLatest {
-				foundLatest = true
-				continue
-			}
-			rs.t.db.waitForBackupToFinish()
-			// Okay to delete now
-			name := filepath.Join(rs.opts.dir, filename)
-			rs.t.log.Debugf("Removing old file %v", name)
-			err := os.Remove(name)
-			if err != nil {
+		if !foundLatest {
+			foundLatest = true
+			continue
+		}
+		if span == nil {
+			_, span = trace.Start(context.Background(), "table.retention", "table", rs.t.Name)
+		}
+		rs.t.db.waitForBackupToFinish()
+		// Okay to delete now
+		name := filepath.Join(rs.opts.dir, filename)
+		rs.t.log.Debugf("Removing old file %v", name)
+		err := os.Remove(name)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				// Not an error if retention was applied concurrently
 				rs.t.log.Errorf("Unable to delete old file store %v, still consuming disk space unnecessarily: %v", name, err)
 			}
+			continue
+		}
+		removed++
+	}
+	span.SetAttribute("removed", removed)
+	span.Finish(nil)
+}
+
+// iterateReadOnly iterates over the most recent file flushed by the process
+// that writes to a read-only row store's directory. That process may remove
+// the file between finding and opening it, in which case this looks again.
+func (rs *rowStore) iterateReadOnly(outFields core.Fields, filter *core.KeyFilter, window *timeWindow, onRow func(bytemap.ByteMap, []encoding.Sequence, []byte) (more bool, err error)) error {
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		var filename string
+		filename, _, err = rs.t.findExistingFile(rs.opts)
+		if err == errFileStoreRemoved {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		rs.mx.Lock()
+		fs := &fileStore{t: rs.t, fields: rs.fields, opts: rs.opts, filename: filename}
+		rs.fileStore = fs
+		rs.mx.Unlock()
+		err = fs.iterate(outFields, nil, filter, window, false, false, onRow)
+		if err != errFileStoreRemoved {
+			return err
 		}
 	}
+	return err
 }
 
 // fileStore stores rows on disk, encoding them as:
 //   rowLength|keylength|key|numcolumns|col1len|col2len|...|lastcollen|col1|col2|...|lastcol
 //
-// rowLength is 64 bits and includes itself
-// keylength is 16 bits and does not include itself
-// key can be up to 64KB
-// numcolumns is 16 bits (i.e. 65,536 columns allowed)
-// col*len is 64 bits
+// rowLength is 64 bits and includes itself. As of FileVersion_6, keylength,
+// numcolumns and col*len are varints and each col holds its until as a delta,
+// see row_encoding.go. Before that, keylength and numcolumns were 16 bits and
+// col*len was 64 bits.
 type fileStore struct {
 	t        *table
 	fields   core.Fields
 	opts     *rowStoreOptions
 	filename string
+	// data holds the encoded rows for memory-only tables
+	data []byte
 }
 
-func (fs *fileStore) iterate(outFields []core.Field, ms *memstore, okayToReuseBuffer bool, rawOkay bool, onRow func(bytemap.ByteMap, []encoding.Sequence, []byte) (more bool, err error)) error {
+// iterate iterates over the rows in the file merged with those in ms, if
+// given, skipping keys that don't match filter, if given. If window is given,
+// only the periods within it are read.
+func (fs *fileStore) iterate(outFields []core.Field, ms *memstore, filter *core.KeyFilter, window *timeWindow, okayToReuseBuffer bool, rawOkay bool, onRow func(bytemap.ByteMap, []encoding.Sequence, []byte) (more bool, err error)) error {
 	ctx := time.Now().UnixNano()
 
 	if fs.t.log.IsTraceEnabled() {
@@ -570,31 +985,21 @@ func (fs *fileStore) iterate(outFields []core.Field, ms *memstore, okayToReuseBu
 		memToOut = rowMerger(outFields, ms.fields, fs.t.Resolution, truncateBefore)
 	}
 
-	file, err := os.OpenFile(fs.filename, os.O_RDONLY, 0)
-	if !os.IsNotExist(err) {
-		if err != nil {
-			return fmt.Errorf("Unable to open file %v: %v", fs.filename, err)
-		}
-		r := snappy.NewReader(file)
-
-		fileVersion := versionFor(fs.filename)
+	r, fileVersion, closeFile, err := fs.open()
+	if err != nil {
+		return err
+	}
+	defer closeFile()
+	if r != nil {
 		// File contains header with field info, use it
-		headerLength := uint32(0)
-		lengthErr := binary.Read(r, encoding.Binary, &headerLength)
-		if lengthErr != nil {
-			return fmt.Errorf("Unexpected error reading header length: %v", lengthErr)
-		}
-		fieldsBytes := make([]byte, headerLength)
-		_, err = io.ReadFull(r, fieldsBytes)
-		if err != nil {
-			return err
+		header, headerErr := readHeader(r, fileVersion)
+		if headerErr != nil {
+			return fmt.Errorf("Unable to read header of %v: %v", fs.filename, headerErr)
 		}
-		// Strip offset
-		fieldsBytes = fieldsBytes[wal.OffsetSize:]
-		delim := fieldsDelims[fileVersion]
-		fieldStrings := strings.Split(string(fieldsBytes), delim)
-		fileFields := make(core.Fields, 0, len(fieldStrings))
-		for _, fieldString := range fieldStrings {
+		// data in older encodings needs to be decoded into the current one
+		decode := header.encodingVersion != encoding.CurrentEncodingVersion
+		fileFields := make(core.Fields, 0, len(header.fields))
+		for _, fieldString := range header.fields {
 			foundField := false
 			for _, field := range fs.fields {
 				if fieldString == field.String() {
@@ -609,101 +1014,93 @@ func (fs *fileStore) iterate(outFields []core.Field, ms *memstore, okayToReuseBu
 			}
 		}
 
-		// raw is only okay if the file fields match the out fields
-		rawOkay = rawOkay && fileFields.Equals(outFields)
+		// raw is only okay if the file fields match the out fields and the data
+		// is in the current file format, layout and encoding
+		rawOkay = rawOkay && window == nil && fileVersion == CurrentFileVersion && header.layout == layoutRows && !decode && fileFields.Equals(outFields)
 
 		// this function will map fields from the file into the right positions on
 		// the outbound row
 		fileToOut := rowMapper(outFields, fileFields)
 
-		var rowBuffer []byte
-		var row []byte
-
-		// Read from file
-		for {
-			rowLength := uint64(0)
-			err := binary.Read(r, encoding.Binary, &rowLength)
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				return fmt.Errorf("Unexpected error reading row length: %v", err)
+		// onFileRow merges a row from the file with the memstore and passes it to
+		// onRow. fileColumns is only called if the raw row can't be used as is.
+		onFileRow := func(key bytemap.ByteMap, raw []byte, fileColumns func() ([]encoding.Sequence, error)) (bool, error) {
+			var err error
+			if decode {
+				key, err = encoding.DecodeKey(header.encodingVersion, key)
+				if err != nil {
+					return false, err
+				}
 			}
 
-			useBuffer := okayToReuseBuffer && int(rowLength) <= cap(rowBuffer)
-			if useBuffer {
-				// Reslice
-				row = rowBuffer[:rowLength]
-			} else {
-				row = make([]byte, rowLength)
-			}
-			rowBuffer = row
-			raw := row
-			encoding.Binary.PutUint64(row, rowLength)
-			row = row[encoding.Width64bits:]
-			_, err = io.ReadFull(r, row)
-			if err != nil {
-				return fmt.Errorf("Unexpected error while reading row: %v", err)
+			if !filter.Matches(key) {
+				// Leave any memstore data for the key to the walk below, which
+				// skips it too
+				return true, nil
 			}
 
-			keyLength, row := encoding.ReadInt16(row)
-			key, row := encoding.ReadByteMap(row, keyLength)
-
 			var msColumns []encoding.Sequence
 			if ms != nil {
 				msColumns = ms.tree.Remove(ctx, key)
 			}
-			if msColumns == nil && rawOkay {
+			if msColumns == nil && rawOkay && raw != nil {
 				// There's nothing to merge in, just pass through the raw data
-				more, err := onRow(key, nil, raw)
-				if !more || err != nil {
-					return err
-				}
-				continue
+				return onRow(key, nil, raw)
 			}
-			// At this point, we should never pass the raw data
-			raw = nil
 
-			numColumns, row := encoding.ReadInt16(row)
-			colLengths := make([]int, 0, numColumns)
-			for i := 0; i < numColumns; i++ {
-				if len(row) < 8 {
-					return fmt.Errorf("Not enough data left to decode column length!")
-				}
-				var colLength int
-				colLength, row = encoding.ReadInt64(row)
-				colLengths = append(colLengths, int(colLength))
+			columnsFromFile, err := fileColumns()
+			if err != nil {
+				return false, err
 			}
 
 			includesAtLeastOneColumn := false
 			columns := make([]encoding.Sequence, len(outFields))
-			for i, colLength := range colLengths {
-				var seq encoding.Sequence
-				if colLength > len(row) {
-					return fmt.Errorf("Not enough data left to decode column, wanted %d have %d", colLength, len(row))
+			for i, seq := range columnsFromFile {
+				if decode && seq != nil {
+					seq, err = encoding.DecodeSequence(header.encodingVersion, seq)
+					if err != nil {
+						return false, err
+					}
+				}
+				if seq != nil && i < len(fileFields) && fileFields[i].Expr != nil {
+					seq = window.apply(seq, fileFields[i].Expr, fs.t.Resolution)
 				}
-				seq, row = encoding.ReadSequence(row, colLength)
 				if seq != nil && fileToOut(columns, i, seq) {
 					includesAtLeastOneColumn = true
 				}
-				if fs.t.log.IsTraceEnabled() {
+				if fs.t.log.IsTraceEnabled() && i < len(fileFields) {
 					fs.t.log.Tracef("File Read: %v", seq.String(fileFields[i].Expr, fs.t.Resolution))
 				}
 			}
 
 			// Merge memStore columns into fileStore columns
 			for i, msColumn := range msColumns {
+				msColumn = window.apply(msColumn, ms.fields[i].Expr, fs.t.Resolution)
 				if memToOut(columns, i, msColumn) {
 					includesAtLeastOneColumn = true
 				}
 			}
 
-			var more bool
-			if includesAtLeastOneColumn {
-				more, err = onRow(key, columns, raw)
+			if !includesAtLeastOneColumn {
+				return true, nil
 			}
+			// At this point, we should never pass the raw data
+			return onRow(key, columns, nil)
+		}
 
-			if !more || err != nil {
+		if header.layout == layoutColumnar {
+			// only decompress the columns that are actually needed
+			needed := make([]bool, len(fileFields))
+			for i, o := range outIdxsFor(outFields, fileFields) {
+				needed[i] = o >= 0
+			}
+			err = iterateColumnar(r, needed, onFileRow)
+			if err != nil {
+				return fmt.Errorf("Unable to read columnar data from %v: %v", fs.filename, err)
+			}
+		} else {
+			err = fs.iterateRows(r, fileVersion, okayToReuseBuffer, onFileRow)
+			if err != nil {
 				return err
 			}
 		}
@@ -712,9 +1109,12 @@ func (fs *fileStore) iterate(outFields []core.Field, ms *memstore, okayToReuseBu
 	// Read remaining stuff from memstore
 	if ms != nil {
 		ms.tree.Walk(ctx, func(key []byte, msColumns []encoding.Sequence) (bool, bool, error) {
+			if !filter.Matches(key) {
+				return true, false, nil
+			}
 			columns := make([]encoding.Sequence, len(outFields))
 			for i, msColumn := range msColumns {
-				memToOut(columns, i, msColumn)
+				memToOut(columns, i, window.apply(msColumn, ms.fields[i].Expr, fs.t.Resolution))
 			}
 			more, err := onRow(bytemap.ByteMap(key), columns, nil)
 			return more, false, err
@@ -724,6 +1124,204 @@ func (fs *fileStore) iterate(outFields []core.Field, ms *memstore, okayToReuseBu
 	return nil
 }
 
+// iterateRows reads rows stored in the row layout from r and passes them to
+// onFileRow.
+func (fs *fileStore) iterateRows(r io.Reader, fileVersion int, okayToReuseBuffer bool, onFileRow func(key bytemap.ByteMap, raw []byte, fileColumns func() ([]encoding.Sequence, error)) (bool, error)) error {
+	var rowBuffer []byte
+	var row []byte
+
+	for {
+		rowLength := uint64(0)
+		err := binary.Read(r, encoding.Binary, &rowLength)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Unexpected error reading row length: %v", err)
+		}
+		if rowLength < encoding.Width64bits {
+			return fmt.Errorf("Invalid row length %d", rowLength)
+		}
+
+		useBuffer := okayToReuseBuffer && int(rowLength) <= cap(rowBuffer)
+		if useBuffer {
+			// Reslice
+			row = rowBuffer[:rowLength]
+		} else {
+			row = make([]byte, rowLength)
+		}
+		rowBuffer = row
+		raw := row
+		encoding.Binary.PutUint64(row, rowLength)
+		row = row[encoding.Width64bits:]
+		_, err = io.ReadFull(r, row)
+		if err != nil {
+			return fmt.Errorf("Unexpected error while reading row: %v", err)
+		}
+
+		key, remain, err := decodeRowKey(fileVersion, row)
+		if err != nil {
+			return err
+		}
+		more, err := onFileRow(key, raw, func() ([]encoding.Sequence, error) {
+			return decodeRowColumns(fileVersion, remain)
+		})
+		if !more || err != nil {
+			return err
+		}
+	}
+}
+
+// Layouts of data following the header
+const (
+	// layoutRows stores one row per key, see row_encoding.go
+	layoutRows = byte(0)
+	// layoutColumnar stores blocks of keys with their columns packed
+	// together, see columnar.go
+	layoutColumnar = byte(1)
+)
+
+type fileHeader struct {
+	offset          wal.Offset
+	encodingVersion byte
+	layout          byte
+	fields          []string
+}
+
+// writeHeader writes a header in the current file version to w.
+func writeHeader(w io.Writer, offset wal.Offset, layout byte, fieldStrings []string) error {
+	if len(offset) != wal.OffsetSize {
+		// Nothing has been inserted yet, readers still expect a full offset
+		offset = make(wal.Offset, wal.OffsetSize)
+	}
+	fieldsBytes := []byte(strings.Join(fieldStrings, fieldsDelims[CurrentFileVersion]))
+	header := make([]byte, 0, len(offset)+2+len(fieldsBytes))
+	header = append(header, offset...)
+	header = append(header, encoding.CurrentEncodingVersion, layout)
+	header = append(header, fieldsBytes...)
+	err := binary.Write(w, encoding.Binary, uint32(len(header)))
+	if err != nil {
+		return fmt.Errorf("Unable to write header length: %v", err)
+	}
+	_, err = w.Write(header)
+	if err != nil {
+		return fmt.Errorf("Unable to write header: %v", err)
+	}
+	return nil
+}
+
+// readHeader reads the header of a file with the given version.
+func readHeader(r io.Reader, fileVersion int) (*fileHeader, error) {
+	headerLength := uint32(0)
+	err := binary.Read(r, encoding.Binary, &headerLength)
+	if err != nil {
+		return nil, fmt.Errorf("Unexpected error reading header length: %v", err)
+	}
+	minHeaderLength := uint32(wal.OffsetSize)
+	if fileVersion >= FileVersion_5 {
+		minHeaderLength++
+	}
+	if fileVersion >= FileVersion_7 {
+		minHeaderLength++
+	}
+	if headerLength < minHeaderLength {
+		return nil, fmt.Errorf("Header length %d is shorter than the minimum of %d", headerLength, minHeaderLength)
+	}
+	b := make([]byte, headerLength)
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return nil, fmt.Errorf("Unexpected error reading header: %v", err)
+	}
+	header := &fileHeader{
+		offset:          wal.Offset(b[:wal.OffsetSize]),
+		encodingVersion: encoding.EncodingVersion1,
+		layout:          layoutRows,
+	}
+	fieldsBytes := b[wal.OffsetSize:]
+	if fileVersion >= FileVersion_5 {
+		header.encodingVersion = fieldsBytes[0]
+		fieldsBytes = fieldsBytes[1:]
+	}
+	if fileVersion >= FileVersion_7 {
+		header.layout = fieldsBytes[0]
+		fieldsBytes = fieldsBytes[1:]
+	}
+	if !encoding.IsSupportedVersion(header.encodingVersion) {
+		return nil, fmt.Errorf("Unsupported encoding version %d", header.encodingVersion)
+	}
+	if header.layout != layoutRows && header.layout != layoutColumnar {
+		return nil, fmt.Errorf("Unsupported layout %d", header.layout)
+	}
+	delim, supported := fieldsDelims[fileVersion]
+	if !supported {
+		return nil, fmt.Errorf("Unsupported file version %d", fileVersion)
+	}
+	header.fields = strings.Split(string(fieldsBytes), delim)
+	return header, nil
+}
+
+// open opens the stored rows for reading, returning a nil reader if nothing has
+// been stored yet. The returned function must be called once the reader is no
+// longer needed.
+func (fs *fileStore) open() (io.Reader, int, func(), error) {
+	noop := func() {}
+	if fs.opts.memoryOnly {
+		if fs.data == nil {
+			return nil, 0, noop, nil
+		}
+		r, err := newDecompressingReader(bytes.NewReader(fs.data), CurrentFileVersion)
+		return r, CurrentFileVersion, func() { releaseReader(r) }, err
+	}
+	if fs.filename == "" {
+		return nil, 0, noop, nil
+	}
+	file, err := os.OpenFile(fs.filename, os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		if fs.opts.readOnly {
+			return nil, 0, noop, errFileStoreRemoved
+		}
+		return nil, 0, noop, nil
+	}
+	if err != nil {
+		return nil, 0, noop, fmt.Errorf("Unable to open file %v: %v", fs.filename, err)
+	}
+	fileVersion := versionFor(fs.filename)
+	if fs.opts.mmap {
+		// Read the compressed data straight out of the page cache rather than
+		// copying it through read buffers on the heap. The mapping stays valid
+		// even if the file is removed by a concurrent flush.
+		mapped, mmapErr := mmapFile(file)
+		if mmapErr == nil {
+			// the mapping remains valid after closing the file
+			file.Close()
+			unmap := func() {
+				if err := munmap(mapped); err != nil {
+					fs.t.log.Errorf("Unable to unmap %v: %v", fs.filename, err)
+				}
+			}
+			r, err := newDecompressingReader(bytes.NewReader(mapped), fileVersion)
+			if err != nil {
+				unmap()
+				return nil, 0, noop, fmt.Errorf("Unable to read %v: %v", fs.filename, err)
+			}
+			return r, fileVersion, func() {
+				releaseReader(r)
+				unmap()
+			}, nil
+		}
+		fs.t.log.Debugf("Unable to memory map %v, reading it normally: %v", fs.filename, mmapErr)
+	}
+	r, err := newDecompressingReader(file, fileVersion)
+	if err != nil {
+		file.Close()
+		return nil, 0, noop, fmt.Errorf("Unable to read %v: %v", fs.filename, err)
+	}
+	return r, fileVersion, func() {
+		releaseReader(r)
+		file.Close()
+	}, nil
+}
+
 func versionFor(filename string) int {
 	fileVersion := 0
 	parts := strings.Split(filepath.Base(filename), "_")
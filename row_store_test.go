@@ -1,11 +1,17 @@
 package zenodb
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/getlantern/bytemap"
 	"github.com/getlantern/golog"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -17,7 +23,8 @@ func TestStorage(t *testing.T) {
 	defer os.RemoveAll(tmpDir)
 
 	tb := &table{
-		log: golog.LoggerFor("storagetest"),
+		TableOpts: &TableOpts{Name: "storagetest"},
+		log:       golog.LoggerFor("storagetest"),
 	}
 	cs, _, err := tb.openRowStore(&rowStoreOptions{
 		dir: tmpDir,
@@ -30,3 +37,202 @@ func TestStorage(t *testing.T) {
 		cs.insert(&insert{})
 	}
 }
+
+func TestMemoryOnly(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 5, time.UTC)
+	clock := NewVirtualClock(epoch)
+	clock.Freeze()
+	db, err := NewDB(&DBOpts{
+		Dir:   tmpDir,
+		Clock: clock,
+		Schema: Schema{
+			"memtable": &TableOpts{
+				RetentionPeriod: time.Hour,
+				MemoryOnly:      true,
+				SQL:             "SELECT SUM(a) AS a FROM inbound GROUP BY x, period(1s)",
+			},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	countKeys := func() int {
+		keys := 0
+		err := db.getTable("memtable").rowStore.iterate(context.Background(), nil, false, nil, nil, func(key bytemap.ByteMap, columns []encoding.Sequence) (bool, error) {
+			keys++
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return keys
+	}
+
+	db.Insert("inbound", epoch, map[string]interface{}{"x": 1}, map[string]float64{"a": 1})
+	db.Insert("inbound", epoch, map[string]interface{}{"x": 2}, map[string]float64{"a": 1})
+	waitFor(func() bool { return db.TableStats("memtable").ArchiveQueueDepth == 2 })
+	if !assert.NoError(t, db.ForceFlush("memtable")) {
+		return
+	}
+
+	stats := db.TableStats("memtable")
+	assert.EqualValues(t, 2, stats.DiskKeys)
+	assert.True(t, stats.DiskBytes > 0, "flushed data should be held in memory")
+	assert.Equal(t, 2, countKeys(), "flushed data should be queryable")
+	_, statErr := os.Stat(filepath.Join(tmpDir, "memtable"))
+	assert.True(t, os.IsNotExist(statErr), "memory-only table shouldn't write to disk")
+
+	clock.Tick(2 * time.Hour)
+	if !assert.NoError(t, db.ApplyRetention("memtable")) {
+		return
+	}
+	assert.Equal(t, 0, countKeys(), "data older than retention period should be removed from memory")
+	assert.EqualValues(t, 0, db.TableStats("memtable").DiskKeys)
+}
+
+func TestMmapReads(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 5, time.UTC)
+	clock := NewVirtualClock(epoch)
+	clock.Freeze()
+	db, err := NewDB(&DBOpts{
+		Dir:       tmpDir,
+		Clock:     clock,
+		MmapReads: true,
+		Schema: Schema{
+			"thetable": &TableOpts{
+				RetentionPeriod: time.Hour,
+				SQL:             "SELECT SUM(a) AS a FROM inbound GROUP BY x, period(1s)",
+			},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	sumA := func() float64 {
+		return sumFieldAt(t, db, "thetable", "a", epoch)
+	}
+
+	db.Insert("inbound", epoch, map[string]interface{}{"x": 1}, map[string]float64{"a": 1})
+	db.Insert("inbound", epoch, map[string]interface{}{"x": 2}, map[string]float64{"a": 2})
+	waitFor(func() bool { return db.TableStats("thetable").ArchiveQueueDepth == 2 })
+	if !assert.NoError(t, db.ForceFlush("thetable")) {
+		return
+	}
+	assert.EqualValues(t, 3, sumA(), "flushed data should be readable through memory mapping")
+
+	db.Insert("inbound", epoch, map[string]interface{}{"x": 3}, map[string]float64{"a": 3})
+	waitFor(func() bool { return db.TableStats("thetable").ArchiveQueueDepth == 1 })
+	if !assert.NoError(t, db.ForceFlush("thetable")) {
+		return
+	}
+	assert.EqualValues(t, 3, db.TableStats("thetable").DiskKeys, "flush should carry over data read through memory mapping")
+	assert.EqualValues(t, 6, sumA())
+}
+
+func TestReadOnly(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 5, time.UTC)
+	schema := Schema{
+		"thetable": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT SUM(a) AS a FROM inbound GROUP BY x, period(1s)",
+		},
+		"unflushed": &TableOpts{
+			RetentionPeriod: time.Hour,
+			SQL:             "SELECT SUM(a) AS a FROM other GROUP BY x, period(1s)",
+		},
+	}
+	newDB := func(readOnly bool) (*DB, error) {
+		clock := NewVirtualClock(epoch)
+		clock.Freeze()
+		tableSchema := make(Schema, len(schema))
+		for name, opts := range schema {
+			optsCopy := *opts
+			tableSchema[name] = &optsCopy
+		}
+		return NewDB(&DBOpts{
+			Dir:      tmpDir,
+			Clock:    clock,
+			ReadOnly: readOnly,
+			Schema:   tableSchema,
+		})
+	}
+
+	writer, err := newDB(false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer writer.Close()
+
+	writer.Insert("inbound", epoch, map[string]interface{}{"x": 1}, map[string]float64{"a": 1})
+	waitFor(func() bool { return writer.TableStats("thetable").ArchiveQueueDepth == 1 })
+	if !assert.NoError(t, writer.ForceFlush("thetable")) {
+		return
+	}
+
+	filesBefore, _ := ioutil.ReadDir(tmpDir)
+	reader, err := newDB(true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer reader.Close()
+	filesAfter, _ := ioutil.ReadDir(tmpDir)
+	assert.Equal(t, len(filesBefore), len(filesAfter), "opening read-only shouldn't create anything in the db dir")
+
+	assert.EqualValues(t, 1, sumFieldAt(t, reader, "thetable", "a", epoch))
+	assert.EqualValues(t, 0, sumFieldAt(t, reader, "unflushed", "a", epoch), "table without flushed data should be empty")
+
+	writer.Insert("inbound", epoch, map[string]interface{}{"x": 2}, map[string]float64{"a": 2})
+	waitFor(func() bool { return writer.TableStats("thetable").ArchiveQueueDepth == 1 })
+	assert.EqualValues(t, 1, sumFieldAt(t, reader, "thetable", "a", epoch), "unflushed data shouldn't be visible")
+	if !assert.NoError(t, writer.ForceFlush("thetable")) {
+		return
+	}
+	assert.EqualValues(t, 3, sumFieldAt(t, reader, "thetable", "a", epoch), "read-only db should pick up new flush")
+
+	assert.Error(t, reader.Insert("inbound", epoch, map[string]interface{}{"x": 3}, map[string]float64{"a": 3}))
+	assert.Error(t, reader.ForceFlush("thetable"))
+	assert.Error(t, reader.Set("maxfollowlag = '1m'"))
+
+	_, err = NewDB(&DBOpts{Dir: filepath.Join(tmpDir, "missing"), ReadOnly: true})
+	assert.Error(t, err, "read-only db dir has to exist")
+}
+
+// sumFieldAt sums the values of the named field at the given time across all
+// keys in the given table.
+func sumFieldAt(t *testing.T, db *DB, table string, name string, at time.Time) float64 {
+	total := float64(0)
+	tbl := db.getTable(table)
+	var field core.Field
+	for _, candidate := range tbl.getFields() {
+		if candidate.Name == name {
+			field = candidate
+		}
+	}
+	err := tbl.rowStore.iterate(context.Background(), core.Fields{field}, true, nil, nil, func(key bytemap.ByteMap, columns []encoding.Sequence) (bool, error) {
+		val, _ := columns[0].ValueAtTime(at, field.Expr, tbl.Resolution)
+		total += val
+		return true, nil
+	})
+	assert.NoError(t, err)
+	return total
+}
@@ -0,0 +1,143 @@
+package rpc
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// protobufPreamble is sent by clients immediately after connecting to
+	// indicate that they want to use the ProtobufCodec. It can't be confused
+	// with the start of a snappy stream, which always begins with 0xff.
+	protobufPreamble = 0x01
+
+	preambleTimeout = 30 * time.Second
+)
+
+// CodecListeners splits the given listener into one listener for clients that
+// use the default MsgPack codec and one for clients that requested the
+// ProtobufCodec.
+func CodecListeners(l net.Listener) (msgpackListener net.Listener, protobufListener net.Listener) {
+	d := &codecDemux{
+		l:        l,
+		msgpack:  make(chan net.Conn),
+		protobuf: make(chan net.Conn),
+		closed:   make(chan struct{}),
+	}
+	go d.acceptLoop()
+	return &demuxedListener{d, d.msgpack}, &demuxedListener{d, d.protobuf}
+}
+
+type codecDemux struct {
+	l         net.Listener
+	msgpack   chan net.Conn
+	protobuf  chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+func (d *codecDemux) acceptLoop() {
+	for {
+		conn, err := d.l.Accept()
+		if err != nil {
+			d.err = err
+			d.close()
+			return
+		}
+		go d.dispatch(conn)
+	}
+}
+
+func (d *codecDemux) dispatch(conn net.Conn) {
+	b := make([]byte, 1)
+	conn.SetReadDeadline(time.Now().Add(preambleTimeout))
+	_, err := io.ReadFull(conn, b)
+	if err != nil {
+		log.Debugf("Unable to read first byte from %v: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	ch := d.msgpack
+	if b[0] == protobufPreamble {
+		ch = d.protobuf
+	} else {
+		conn = &prefixedConn{Conn: conn, prefix: b}
+	}
+	select {
+	case ch <- conn:
+		// okay
+	case <-d.closed:
+		conn.Close()
+	}
+}
+
+func (d *codecDemux) close() error {
+	var err error
+	d.closeOnce.Do(func() {
+		close(d.closed)
+		err = d.l.Close()
+	})
+	return err
+}
+
+type demuxedListener struct {
+	d  *codecDemux
+	ch chan net.Conn
+}
+
+func (l *demuxedListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.ch:
+		return conn, nil
+	case <-l.d.closed:
+		err := l.d.err
+		if err == nil {
+			err = io.EOF
+		}
+		return nil, err
+	}
+}
+
+func (l *demuxedListener) Close() error {
+	return l.d.close()
+}
+
+func (l *demuxedListener) Addr() net.Addr {
+	return l.d.l.Addr()
+}
+
+// prefixedConn is a net.Conn that replays an already consumed prefix before
+// reading from the underlying connection.
+type prefixedConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (pc *prefixedConn) Read(p []byte) (int, error) {
+	if len(pc.prefix) > 0 {
+		n := copy(p, pc.prefix)
+		pc.prefix = pc.prefix[n:]
+		return n, nil
+	}
+	return pc.Conn.Read(p)
+}
+
+func protobufDialer(d func(string, time.Duration) (net.Conn, error)) func(string, time.Duration) (net.Conn, error) {
+	return func(addr string, timeout time.Duration) (net.Conn, error) {
+		conn, err := d(addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+		_, err = conn.Write([]byte{protobufPreamble})
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
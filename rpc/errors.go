@@ -0,0 +1,92 @@
+package rpc
+
+import (
+	"encoding/json"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+// SQLErrorTrailer is the trailer in which the query stream sends the details
+// of a *common.SQLError as JSON, so that clients can tell where in their SQL
+// the problem is.
+const SQLErrorTrailer = "zenodb-sql-error-bin"
+
+// errorCodes are the status codes with which the query and admin streams fail
+// for each kind of error, so that clients can recover the kind with ErrorFrom.
+var errorCodes = map[error]codes.Code{
+	common.ErrUnknownTable:     codes.NotFound,
+	common.ErrOutsideHotPeriod: codes.OutOfRange,
+	common.ErrBackpressure:     codes.ResourceExhausted,
+	common.ErrInvalidSQL:       codes.InvalidArgument,
+	core.ErrDeadlineExceeded:   codes.DeadlineExceeded,
+	core.ErrPartialResults:     codes.Aborted,
+}
+
+// StatusFor converts errors of the kinds in errorCodes into errors with the
+// corresponding status code. Other errors are returned unchanged.
+func StatusFor(err error) error {
+	if err == nil {
+		return nil
+	}
+	code, found := errorCodes[common.KindOf(err)]
+	if !found {
+		return err
+	}
+	return grpc.Errorf(code, "%v", err)
+}
+
+// ErrorFrom converts an error received from the query or admin streams back
+// into an error of the kind that corresponds to its status code. Other errors
+// are returned unchanged.
+func ErrorFrom(err error) error {
+	if err == nil {
+		return nil
+	}
+	code := grpc.Code(err)
+	for kind, kindCode := range errorCodes {
+		if code == kindCode {
+			return &common.Error{Kind: kind, Msg: grpc.ErrorDesc(err)}
+		}
+	}
+	return err
+}
+
+// SetErrorTrailer sends the details of the given error in the trailer of the
+// given stream if it's a *common.SQLError. Clients recover them with
+// ErrorFromStream.
+func SetErrorTrailer(stream grpc.ServerStream, err error) {
+	sqlErr, ok := err.(*common.SQLError)
+	if !ok {
+		return
+	}
+	b, marshalErr := json.Marshal(sqlErr)
+	if marshalErr != nil {
+		log.Errorf("Unable to marshal SQL error: %v", marshalErr)
+		return
+	}
+	stream.SetTrailer(metadata.Pairs(SQLErrorTrailer, string(b)))
+}
+
+// ErrorFromStream is like ErrorFrom, but turns errors whose details were sent
+// in the trailer of the given stream back into *common.SQLErrors.
+func ErrorFromStream(stream grpc.ClientStream, err error) error {
+	err = ErrorFrom(err)
+	kindErr, ok := err.(*common.Error)
+	if !ok {
+		return err
+	}
+	values := stream.Trailer()[SQLErrorTrailer]
+	if len(values) == 0 {
+		return err
+	}
+	sqlErr := &common.SQLError{}
+	if json.Unmarshal([]byte(values[0]), sqlErr) != nil {
+		return err
+	}
+	sqlErr.Kind = kindErr.Kind
+	return sqlErr
+}
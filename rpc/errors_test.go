@@ -0,0 +1,63 @@
+package rpc
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestErrorRoundTrip(t *testing.T) {
+	err := ErrorFrom(StatusFor(common.Errorf(common.ErrUnknownTable, "Table %v not found", "thetable")))
+	assert.Equal(t, common.ErrUnknownTable, common.KindOf(err))
+	assert.Equal(t, "Table thetable not found", err.Error())
+
+	assert.Equal(t, core.ErrDeadlineExceeded, common.KindOf(ErrorFrom(StatusFor(core.ErrDeadlineExceeded))))
+	assert.Equal(t, core.ErrPartialResults, common.KindOf(ErrorFrom(StatusFor(core.ErrPartialResults))))
+
+	other := errors.New("something else")
+	assert.Equal(t, other, StatusFor(other), "other errors should pass through")
+	assert.Nil(t, StatusFor(nil))
+	assert.Nil(t, ErrorFrom(nil))
+}
+
+func TestSQLErrorRoundTrip(t *testing.T) {
+	sqlErr := &common.SQLError{Kind: common.ErrUnknownTable, Msg: "Table erors not found", Line: 1, Column: 15, Token: "erors", Suggestions: []string{"errors"}}
+	server := &errorServerStream{}
+	SetErrorTrailer(server, sqlErr)
+	err := ErrorFromStream(&errorClientStream{trailer: server.trailer}, StatusFor(sqlErr))
+	assert.Equal(t, sqlErr, err)
+	assert.Equal(t, "Table erors not found at line 1, column 15 near 'erors', did you mean errors?", err.Error())
+
+	other := common.Errorf(common.ErrInvalidSQL, "not a SQLError")
+	server = &errorServerStream{}
+	SetErrorTrailer(server, other)
+	assert.Nil(t, server.trailer, "other errors shouldn't set trailer")
+	err = ErrorFromStream(&errorClientStream{trailer: server.trailer}, StatusFor(other))
+	assert.Equal(t, common.ErrInvalidSQL, common.KindOf(err))
+	assert.Equal(t, "not a SQLError", err.Error())
+}
+
+// errorServerStream is a grpc.ServerStream that remembers its trailer.
+type errorServerStream struct {
+	grpc.ServerStream
+	trailer metadata.MD
+}
+
+func (s *errorServerStream) SetTrailer(md metadata.MD) {
+	s.trailer = md
+}
+
+// errorClientStream is a grpc.ClientStream that received the given trailer.
+type errorClientStream struct {
+	grpc.ClientStream
+	trailer metadata.MD
+}
+
+func (s *errorClientStream) Trailer() metadata.MD {
+	return s.trailer
+}
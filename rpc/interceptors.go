@@ -0,0 +1,236 @@
+package rpc
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+)
+
+// ChainStreamInterceptors combines the given interceptors into a single one,
+// since a grpc.Server only accepts one. The first interceptor is the outermost
+// one, so it sees each stream first and its result last.
+func ChainStreamInterceptors(interceptors ...grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		chained := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, next := interceptors[i], chained
+			chained = func(srv interface{}, ss grpc.ServerStream) error {
+				return interceptor(srv, ss, info, next)
+			}
+		}
+		return chained(srv, ss)
+	}
+}
+
+// ChainUnaryInterceptors is like ChainStreamInterceptors for unary methods.
+func ChainUnaryInterceptors(interceptors ...grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		chained := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, next := interceptors[i], chained
+			chained = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return interceptor(ctx, req, info, next)
+			}
+		}
+		return chained(ctx, req)
+	}
+}
+
+// RecoveryStreamInterceptor turns panics in stream handlers into Internal
+// errors, logging the panic along with its stack, so that a bug in handling
+// a single request doesn't take down the whole server.
+func RecoveryStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		defer recoverInto(info.FullMethod, &err)
+		return handler(srv, ss)
+	}
+}
+
+// RecoveryUnaryInterceptor is like RecoveryStreamInterceptor for unary methods.
+func RecoveryUnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		defer recoverInto(info.FullMethod, &err)
+		return handler(ctx, req)
+	}
+}
+
+func recoverInto(method string, err *error) {
+	if p := recover(); p != nil {
+		log.Errorf("Panic handling %v: %v\n%s", method, p, debug.Stack())
+		*err = grpc.Errorf(codes.Internal, "panic handling %v: %v", method, p)
+	}
+}
+
+// LoggingStreamInterceptor logs every stream once it finishes as key=value
+// pairs, including the method, the peer's address, the duration and the
+// resulting status code.
+func LoggingStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, ss)
+		logRequest(ss.Context(), info.FullMethod, time.Since(start), err)
+		return err
+	}
+}
+
+// LoggingUnaryInterceptor is like LoggingStreamInterceptor for unary methods.
+func LoggingUnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		logRequest(ctx, info.FullMethod, time.Since(start), err)
+		return resp, err
+	}
+}
+
+func logRequest(ctx context.Context, method string, elapsed time.Duration, err error) {
+	addr := "unknown"
+	if p, ok := peer.FromContext(ctx); ok {
+		addr = p.Addr.String()
+	}
+	if err != nil {
+		log.Debugf("method=%v peer=%v duration=%v code=%v error=%q", method, addr, elapsed, grpc.Code(err), err.Error())
+		return
+	}
+	log.Debugf("method=%v peer=%v duration=%v code=%v", method, addr, elapsed, codes.OK)
+}
+
+// AuthStreamInterceptor rejects streams for which authorize fails with a
+// PermissionDenied error before they reach their handler. authorize is called
+// with the stream's context, from which it can obtain metadata and the peer,
+// and the full method name like /zenodb/query. This is in addition to the
+// authorization that the zenodb server itself performs.
+func AuthStreamInterceptor(authorize func(ctx context.Context, method string) error) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := authorize(ss.Context(), info.FullMethod); err != nil {
+			return grpc.Errorf(codes.PermissionDenied, "%v", err)
+		}
+		return handler(srv, ss)
+	}
+}
+
+// AuthUnaryInterceptor is like AuthStreamInterceptor for unary methods.
+func AuthUnaryInterceptor(authorize func(ctx context.Context, method string) error) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := authorize(ctx, info.FullMethod); err != nil {
+			return nil, grpc.Errorf(codes.PermissionDenied, "%v", err)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// MethodMetrics tracks how many requests each method handled, how long they
+// took and with which status codes they finished. Note that follow and remote
+// query streams are long-lived, so their durations mostly reflect how long
+// followers stay connected.
+type MethodMetrics struct {
+	byMethod map[string]*methodStats
+	mx       sync.Mutex
+}
+
+type methodStats struct {
+	active   int64
+	count    int64
+	duration time.Duration
+	byCode   map[codes.Code]int64
+}
+
+// NewMethodMetrics creates an empty MethodMetrics.
+func NewMethodMetrics() *MethodMetrics {
+	return &MethodMetrics{byMethod: make(map[string]*methodStats)}
+}
+
+// StreamInterceptor returns an interceptor that records metrics for streams.
+func (mm *MethodMetrics) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := mm.started(info.FullMethod)
+		err := handler(srv, ss)
+		mm.finished(info.FullMethod, start, err)
+		return err
+	}
+}
+
+// UnaryInterceptor returns an interceptor that records metrics for unary
+// methods.
+func (mm *MethodMetrics) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := mm.started(info.FullMethod)
+		resp, err := handler(ctx, req)
+		mm.finished(info.FullMethod, start, err)
+		return resp, err
+	}
+}
+
+func (mm *MethodMetrics) started(method string) time.Time {
+	mm.mx.Lock()
+	stats := mm.byMethod[method]
+	if stats == nil {
+		stats = &methodStats{byCode: make(map[codes.Code]int64)}
+		mm.byMethod[method] = stats
+	}
+	stats.active++
+	mm.mx.Unlock()
+	return time.Now()
+}
+
+func (mm *MethodMetrics) finished(method string, start time.Time, err error) {
+	elapsed := time.Since(start)
+	mm.mx.Lock()
+	stats := mm.byMethod[method]
+	stats.active--
+	stats.count++
+	stats.duration += elapsed
+	stats.byCode[grpc.Code(err)]++
+	mm.mx.Unlock()
+}
+
+// WriteMetrics writes the metrics to the given Writer in the Prometheus text
+// format.
+func (mm *MethodMetrics) WriteMetrics(w io.Writer) error {
+	mm.mx.Lock()
+	methods := make([]string, 0, len(mm.byMethod))
+	for method := range mm.byMethod {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	bw := bufio.NewWriter(w)
+	header := func(name string, typ string, help string) {
+		fmt.Fprintf(bw, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, typ)
+	}
+	header("zenodb_rpc_active_requests", "gauge", "RPC requests currently being handled")
+	for _, method := range methods {
+		fmt.Fprintf(bw, "zenodb_rpc_active_requests{method=\"%v\"} %d\n", method, mm.byMethod[method].active)
+	}
+	header("zenodb_rpc_request_duration_seconds", "summary", "Time spent handling RPC requests")
+	for _, method := range methods {
+		stats := mm.byMethod[method]
+		fmt.Fprintf(bw, "zenodb_rpc_request_duration_seconds_sum{method=\"%v\"} %v\n", method, stats.duration.Seconds())
+		fmt.Fprintf(bw, "zenodb_rpc_request_duration_seconds_count{method=\"%v\"} %d\n", method, stats.count)
+	}
+	header("zenodb_rpc_requests_total", "counter", "RPC requests handled, by status code")
+	for _, method := range methods {
+		stats := mm.byMethod[method]
+		codesHandled := make([]string, 0, len(stats.byCode))
+		counts := make(map[string]int64, len(stats.byCode))
+		for code, count := range stats.byCode {
+			codesHandled = append(codesHandled, code.String())
+			counts[code.String()] = count
+		}
+		sort.Strings(codesHandled)
+		for _, code := range codesHandled {
+			fmt.Fprintf(bw, "zenodb_rpc_requests_total{method=\"%v\",code=\"%v\"} %d\n", method, code, counts[code])
+		}
+	}
+	mm.mx.Unlock()
+	return bw.Flush()
+}
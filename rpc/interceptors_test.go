@@ -0,0 +1,95 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestInterceptors(t *testing.T) {
+	var order []string
+	tracking := func(name string) grpc.StreamServerInterceptor {
+		return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			order = append(order, name)
+			return handler(srv, ss)
+		}
+	}
+	mm := NewMethodMetrics()
+	allowed := true
+	interceptor := ChainStreamInterceptors(
+		mm.StreamInterceptor(),
+		tracking("a"),
+		AuthStreamInterceptor(func(ctx context.Context, method string) error {
+			if !allowed {
+				return errors.New("not allowed")
+			}
+			return nil
+		}),
+		tracking("b"),
+		RecoveryStreamInterceptor(),
+	)
+
+	stream := &contextStream{ctx: context.Background()}
+	query := &grpc.StreamServerInfo{FullMethod: "/zenodb/query"}
+	err := interceptor(nil, stream, query, func(srv interface{}, ss grpc.ServerStream) error {
+		order = append(order, "handler")
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "handler"}, order, "interceptors should run in order")
+
+	err = interceptor(nil, stream, query, func(srv interface{}, ss grpc.ServerStream) error {
+		panic("boom")
+	})
+	assert.Equal(t, codes.Internal, grpc.Code(err), "panic should be recovered")
+
+	allowed = false
+	order = nil
+	err = interceptor(nil, stream, &grpc.StreamServerInfo{FullMethod: "/zenodb/insert"}, func(srv interface{}, ss grpc.ServerStream) error {
+		order = append(order, "handler")
+		return nil
+	})
+	assert.Equal(t, codes.PermissionDenied, grpc.Code(err))
+	assert.Equal(t, []string{"a"}, order, "unauthorized stream shouldn't reach handler")
+
+	var buf bytes.Buffer
+	if !assert.NoError(t, mm.WriteMetrics(&buf)) {
+		return
+	}
+	metrics := buf.String()
+	assert.Contains(t, metrics, `zenodb_rpc_active_requests{method="/zenodb/query"} 0`)
+	assert.Contains(t, metrics, `zenodb_rpc_request_duration_seconds_count{method="/zenodb/query"} 2`)
+	assert.Contains(t, metrics, `zenodb_rpc_requests_total{method="/zenodb/query",code="OK"} 1`)
+	assert.Contains(t, metrics, `zenodb_rpc_requests_total{method="/zenodb/query",code="Internal"} 1`)
+	assert.Contains(t, metrics, `zenodb_rpc_requests_total{method="/zenodb/insert",code="PermissionDenied"} 1`)
+}
+
+func TestUnaryInterceptors(t *testing.T) {
+	interceptor := ChainUnaryInterceptors(LoggingUnaryInterceptor(), RecoveryUnaryInterceptor())
+	info := &grpc.UnaryServerInfo{FullMethod: "/zenodb/unary"}
+	resp, err := interceptor(context.Background(), "req", info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return req, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "req", resp)
+
+	_, err = interceptor(context.Background(), "req", info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		panic("boom")
+	})
+	assert.Equal(t, codes.Internal, grpc.Code(err), "panic should be recovered")
+}
+
+// contextStream is a grpc.ServerStream that only has a context.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
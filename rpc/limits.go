@@ -0,0 +1,35 @@
+package rpc
+
+import (
+	"fmt"
+
+	"google.golang.org/grpc"
+)
+
+// LimitSendSize wraps the given codec to refuse to marshal messages larger
+// than maxSize bytes. The version of gRPC that we use only limits the size of
+// received messages, so this lets senders fail fast with a clear error rather
+// than having the peer reject the message. If maxSize <= 0, the codec is
+// returned unchanged.
+func LimitSendSize(codec grpc.Codec, maxSize int) grpc.Codec {
+	if maxSize <= 0 {
+		return codec
+	}
+	return &sizeLimitedCodec{codec, maxSize}
+}
+
+type sizeLimitedCodec struct {
+	grpc.Codec
+	maxSize int
+}
+
+func (c *sizeLimitedCodec) Marshal(v interface{}) ([]byte, error) {
+	b, err := c.Codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > c.maxSize {
+		return nil, fmt.Errorf("Message of %d bytes exceeds the max send size of %d", len(b), c.maxSize)
+	}
+	return b, nil
+}
@@ -0,0 +1,1105 @@
+package rpc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/getlantern/wal"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/expr"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// ProtobufCodec encodes messages using the protocol buffer wire format as
+// defined in zenodb.proto. Unknown fields are ignored when decoding, so
+// messages can gain new fields without breaking older peers.
+type ProtobufCodec struct {
+}
+
+func (c *ProtobufCodec) Marshal(v interface{}) ([]byte, error) {
+	e := &pbEncoder{}
+	var err error
+	switch m := v.(type) {
+	case *Insert:
+		e.string(1, m.Stream)
+		e.int(2, m.TS)
+		e.bytes(3, m.Dims)
+		e.bytes(4, m.Vals)
+		e.bool(5, m.EndOfInserts)
+		e.bool(6, m.AckOffset)
+	case *InsertReport:
+		e.int(1, int64(m.Received))
+		e.int(2, int64(m.Succeeded))
+		for idx, msg := range m.Errors {
+			e.message(3, func(e *pbEncoder) {
+				e.int(1, int64(idx))
+				e.string(2, msg)
+			})
+		}
+		e.bytes(4, m.Offset)
+	case *Query:
+		e.string(1, m.SQLString)
+		e.bool(2, m.IsSubQuery)
+		for _, result := range m.SubQueryResults {
+			e.message(12, func(e *pbEncoder) {
+				for _, value := range result {
+					e.message(1, func(e *pbEncoder) {
+						if valueErr := e.value(value); valueErr != nil && err == nil {
+							err = valueErr
+						}
+					})
+				}
+			})
+		}
+		e.bool(4, m.IncludeMemStore)
+		e.bool(5, m.Unflat)
+		e.time(6, m.Deadline)
+		e.bool(7, m.HasDeadline)
+		e.string(8, m.TraceParent)
+		e.string(9, m.Format)
+		e.bool(10, m.OmitHeader)
+		e.bool(11, m.Ping)
+	case *Point:
+		e.bytes(1, m.Data)
+		e.bytes(2, m.Offset)
+	case *common.Follow:
+		e.string(1, m.Stream)
+		e.bytes(2, m.EarliestOffset)
+		e.int(3, int64(m.PartitionNumber))
+		for key, partition := range m.Partitions {
+			e.message(4, func(e *pbEncoder) {
+				e.string(1, key)
+				e.message(2, func(e *pbEncoder) {
+					for _, k := range partition.Keys {
+						e.repeatedString(1, k)
+					}
+					for _, table := range partition.Tables {
+						e.message(2, func(e *pbEncoder) {
+							e.string(1, table.Name)
+							e.bytes(2, table.Offset)
+						})
+					}
+				})
+			})
+		}
+		e.string(5, m.Version)
+		e.labels(6, m.Labels)
+	case *common.QueryMetaData:
+		for _, name := range m.FieldNames {
+			e.repeatedString(1, name)
+		}
+		e.time(2, m.AsOf)
+		e.time(3, m.Until)
+		e.int(4, int64(m.Resolution))
+		e.string(5, m.Plan)
+		for name, fmd := range m.FieldMetadata {
+			e.message(6, func(e *pbEncoder) {
+				e.string(1, name)
+				e.string(2, fmd.Unit)
+				e.string(3, fmd.Display)
+			})
+		}
+		for _, column := range m.Columns {
+			e.message(7, func(e *pbEncoder) {
+				e.string(1, column.Name)
+				e.string(2, column.Kind)
+				e.string(3, column.Type)
+				e.string(4, column.Unit)
+			})
+		}
+	case *RemoteQueryResult:
+		for _, field := range m.Fields {
+			var se *expr.Serialized
+			if field.Expr != nil {
+				se, err = expr.Serialize(field.Expr)
+				if err != nil {
+					break
+				}
+			}
+			e.message(1, func(e *pbEncoder) {
+				e.string(1, field.Name)
+				if se != nil {
+					e.message(3, func(e *pbEncoder) {
+						e.expr(se)
+					})
+				}
+			})
+		}
+		e.bytes(2, m.Key)
+		for _, val := range m.Vals {
+			e.repeatedBytes(3, val)
+		}
+		if m.Row != nil {
+			e.message(4, func(e *pbEncoder) {
+				e.int(1, m.Row.TS)
+				e.bytes(2, m.Row.Key)
+				e.doubles(3, m.Row.Values)
+				e.bytes(4, encodeNulls(m.Row.Nulls))
+			})
+		}
+		e.string(5, m.Error)
+		e.bool(6, m.EndOfResults)
+		e.bytes(7, m.Data)
+		for _, stats := range m.Stats {
+			e.message(8, func(e *pbEncoder) {
+				e.string(1, stats.Table)
+				e.int(2, stats.KeysScanned)
+				e.int(3, stats.SequencesDecoded)
+				e.int(4, stats.PeriodsRead)
+				e.int(5, stats.BytesRead)
+			})
+		}
+		e.bool(9, m.Pong)
+		e.bool(10, m.Truncated)
+		e.int(11, m.OmittedRows)
+		e.time(12, m.Archived)
+	case *RegisterQueryHandler:
+		e.int(1, int64(m.Partition))
+		if c := m.Capabilities; c != nil {
+			e.message(2, func(e *pbEncoder) {
+				for _, table := range c.Tables {
+					e.repeatedString(1, table)
+				}
+				e.time(2, c.Since)
+				e.string(3, c.Version)
+				e.time(4, c.Archived)
+			})
+		}
+	case *ClusterStatusRequest:
+		// no fields
+	case *common.ClusterStatus:
+		e.string(1, m.Version)
+		e.int(2, int64(m.NumPartitions))
+		for _, f := range m.Followers {
+			e.message(3, func(e *pbEncoder) {
+				e.int(1, int64(f.ID))
+				e.string(2, f.Addr)
+				e.int(3, int64(f.Partition))
+				e.string(4, f.Stream)
+				e.string(5, f.Version)
+				e.time(6, f.Joined)
+				e.bytes(7, f.Offset)
+				e.int(8, int64(f.Lag))
+				e.int(9, int64(f.Queued))
+				e.bool(10, f.Failed)
+				e.int(11, int64(f.LastQueryLatency))
+				e.labels(12, f.Labels)
+				e.int(13, int64(f.QueryLatencyP99))
+			})
+		}
+		for _, gap := range m.Gaps {
+			e.message(4, func(e *pbEncoder) {
+				e.int(1, int64(gap.Partition))
+				e.string(2, gap.Stream)
+				e.bytes(3, gap.Requested)
+				e.bytes(4, gap.Oldest)
+				e.time(5, gap.Time)
+			})
+		}
+		e.int(5, m.ResyncsRequired)
+		e.int(7, m.PlacementRejections)
+		e.int(8, m.CacheHits)
+		e.int(9, m.CacheMisses)
+		for _, owner := range m.Owners {
+			e.message(6, func(e *pbEncoder) {
+				e.string(1, owner.Dim)
+				e.string(2, owner.Value)
+				for _, partition := range owner.Partitions {
+					e.int(3, int64(partition))
+				}
+			})
+		}
+	case *AdminRequest:
+		e.string(1, m.Op)
+		e.string(2, m.Table)
+		for _, arg := range m.Args {
+			e.repeatedString(3, arg)
+		}
+	case *AdminResponse:
+		e.string(1, m.Result)
+	case *common.CaptureChanges:
+		for _, table := range m.Tables {
+			e.repeatedString(1, table)
+		}
+	case *common.ArchivedChunk:
+		e.string(1, m.Table)
+		e.bytes(2, m.Offset)
+		e.time(3, m.ArchivedAt)
+		e.int(4, int64(m.Resolution))
+		for _, field := range m.Fields {
+			e.repeatedString(5, field)
+		}
+		e.bytes(6, m.Key)
+		for _, seq := range m.Sequences {
+			e.repeatedBytes(7, seq)
+		}
+	default:
+		return nil, fmt.Errorf("ProtobufCodec unable to marshal %v", reflect.TypeOf(v))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ProtobufCodec unable to marshal %v: %v", reflect.TypeOf(v), err)
+	}
+	return e.buf, nil
+}
+
+func (c *ProtobufCodec) Unmarshal(data []byte, v interface{}) error {
+	var err error
+	switch m := v.(type) {
+	case **InsertReport:
+		if *m == nil {
+			*m = &InsertReport{}
+		}
+		return c.Unmarshal(data, *m)
+	case *Insert:
+		err = pbDecode(data, func(field int, val *pbValue) error {
+			switch field {
+			case 1:
+				m.Stream = val.string()
+			case 2:
+				m.TS = val.int()
+			case 3:
+				m.Dims = val.copyBytes()
+			case 4:
+				m.Vals = val.copyBytes()
+			case 5:
+				m.EndOfInserts = val.bool()
+			case 6:
+				m.AckOffset = val.bool()
+			}
+			return nil
+		})
+	case *InsertReport:
+		m.Errors = make(map[int]string)
+		err = pbDecode(data, func(field int, val *pbValue) error {
+			switch field {
+			case 1:
+				m.Received = int(val.int())
+			case 2:
+				m.Succeeded = int(val.int())
+			case 3:
+				var idx int
+				var msg string
+				entryErr := pbDecode(val.bytes, func(field int, val *pbValue) error {
+					switch field {
+					case 1:
+						idx = int(val.int())
+					case 2:
+						msg = val.string()
+					}
+					return nil
+				})
+				m.Errors[idx] = msg
+				return entryErr
+			case 4:
+				m.Offset = wal.Offset(val.copyBytes())
+			}
+			return nil
+		})
+	case *Query:
+		err = pbDecode(data, func(field int, val *pbValue) error {
+			switch field {
+			case 1:
+				m.SQLString = val.string()
+			case 2:
+				m.IsSubQuery = val.bool()
+			case 3:
+				// MsgPack encoded results sent by older versions
+				return msgpack.Unmarshal(val.bytes, &m.SubQueryResults)
+			case 12:
+				result := make([]interface{}, 0)
+				resultErr := pbDecode(val.bytes, func(field int, val *pbValue) error {
+					if field == 1 {
+						value, valueErr := decodeValue(val.bytes)
+						result = append(result, value)
+						return valueErr
+					}
+					return nil
+				})
+				m.SubQueryResults = append(m.SubQueryResults, result)
+				return resultErr
+			case 4:
+				m.IncludeMemStore = val.bool()
+			case 5:
+				m.Unflat = val.bool()
+			case 6:
+				m.Deadline = val.time()
+			case 7:
+				m.HasDeadline = val.bool()
+			case 8:
+				m.TraceParent = val.string()
+			case 9:
+				m.Format = val.string()
+			case 10:
+				m.OmitHeader = val.bool()
+			case 11:
+				m.Ping = val.bool()
+			}
+			return nil
+		})
+	case *Point:
+		err = pbDecode(data, func(field int, val *pbValue) error {
+			switch field {
+			case 1:
+				m.Data = val.copyBytes()
+			case 2:
+				m.Offset = wal.Offset(val.copyBytes())
+			}
+			return nil
+		})
+	case *common.Follow:
+		err = pbDecode(data, func(field int, val *pbValue) error {
+			switch field {
+			case 1:
+				m.Stream = val.string()
+			case 2:
+				m.EarliestOffset = wal.Offset(val.copyBytes())
+			case 3:
+				m.PartitionNumber = int(val.int())
+			case 4:
+				if m.Partitions == nil {
+					m.Partitions = make(map[string]*common.Partition)
+				}
+				var key string
+				partition := &common.Partition{}
+				entryErr := pbDecode(val.bytes, func(field int, val *pbValue) error {
+					switch field {
+					case 1:
+						key = val.string()
+					case 2:
+						return pbDecode(val.bytes, func(field int, val *pbValue) error {
+							switch field {
+							case 1:
+								partition.Keys = append(partition.Keys, val.string())
+							case 2:
+								table := &common.PartitionTable{}
+								partition.Tables = append(partition.Tables, table)
+								return pbDecode(val.bytes, func(field int, val *pbValue) error {
+									switch field {
+									case 1:
+										table.Name = val.string()
+									case 2:
+										table.Offset = wal.Offset(val.copyBytes())
+									}
+									return nil
+								})
+							}
+							return nil
+						})
+					}
+					return nil
+				})
+				m.Partitions[key] = partition
+				return entryErr
+			case 5:
+				m.Version = val.string()
+			case 6:
+				if m.Labels == nil {
+					m.Labels = make(map[string]string)
+				}
+				return val.label(m.Labels)
+			}
+			return nil
+		})
+	case *common.QueryMetaData:
+		err = pbDecode(data, func(field int, val *pbValue) error {
+			switch field {
+			case 1:
+				m.FieldNames = append(m.FieldNames, val.string())
+			case 2:
+				m.AsOf = val.time()
+			case 3:
+				m.Until = val.time()
+			case 4:
+				m.Resolution = time.Duration(val.int())
+			case 5:
+				m.Plan = val.string()
+			case 6:
+				var name string
+				fmd := &common.FieldMetadata{}
+				fieldErr := pbDecode(val.bytes, func(field int, val *pbValue) error {
+					switch field {
+					case 1:
+						name = val.string()
+					case 2:
+						fmd.Unit = val.string()
+					case 3:
+						fmd.Display = val.string()
+					}
+					return nil
+				})
+				if m.FieldMetadata == nil {
+					m.FieldMetadata = make(map[string]*common.FieldMetadata)
+				}
+				m.FieldMetadata[name] = fmd
+				return fieldErr
+			case 7:
+				column := &common.ColumnMetadata{}
+				m.Columns = append(m.Columns, column)
+				return pbDecode(val.bytes, func(field int, val *pbValue) error {
+					switch field {
+					case 1:
+						column.Name = val.string()
+					case 2:
+						column.Kind = val.string()
+					case 3:
+						column.Type = val.string()
+					case 4:
+						column.Unit = val.string()
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+	case *RemoteQueryResult:
+		err = pbDecode(data, func(field int, val *pbValue) error {
+			switch field {
+			case 1:
+				var f core.Field
+				fieldErr := pbDecode(val.bytes, func(field int, val *pbValue) error {
+					switch field {
+					case 1:
+						f.Name = val.string()
+					case 2:
+						// MsgPack encoded expression sent by older versions
+						ex, exErr := expr.Unmarshal(val.bytes)
+						f.Expr = ex
+						return exErr
+					case 3:
+						se, seErr := decodeExpr(val.bytes)
+						if seErr != nil {
+							return seErr
+						}
+						ex, exErr := expr.Deserialize(se)
+						f.Expr = ex
+						return exErr
+					}
+					return nil
+				})
+				m.Fields = append(m.Fields, f)
+				return fieldErr
+			case 2:
+				m.Key = val.copyBytes()
+			case 3:
+				m.Vals = append(m.Vals, encoding.Sequence(val.copyBytes()))
+			case 4:
+				row := &core.FlatRow{}
+				m.Row = row
+				return pbDecode(val.bytes, func(field int, val *pbValue) error {
+					switch field {
+					case 1:
+						row.TS = val.int()
+					case 2:
+						row.Key = val.copyBytes()
+					case 3:
+						row.Values = val.appendDoubles(row.Values)
+					case 4:
+						row.Nulls = decodeNulls(val.bytes)
+					}
+					return nil
+				})
+			case 5:
+				m.Error = val.string()
+			case 6:
+				m.EndOfResults = val.bool()
+			case 7:
+				m.Data = val.copyBytes()
+			case 8:
+				stats := &common.TableQueryStats{}
+				m.Stats = append(m.Stats, stats)
+				return pbDecode(val.bytes, func(field int, val *pbValue) error {
+					switch field {
+					case 1:
+						stats.Table = val.string()
+					case 2:
+						stats.KeysScanned = val.int()
+					case 3:
+						stats.SequencesDecoded = val.int()
+					case 4:
+						stats.PeriodsRead = val.int()
+					case 5:
+						stats.BytesRead = val.int()
+					}
+					return nil
+				})
+			case 9:
+				m.Pong = val.bool()
+			case 10:
+				m.Truncated = val.bool()
+			case 11:
+				m.OmittedRows = val.int()
+			case 12:
+				m.Archived = val.time()
+			}
+			return nil
+		})
+	case *RegisterQueryHandler:
+		err = pbDecode(data, func(field int, val *pbValue) error {
+			switch field {
+			case 1:
+				m.Partition = int(val.int())
+			case 2:
+				c := &common.QueryHandlerCapabilities{}
+				m.Capabilities = c
+				return pbDecode(val.bytes, func(field int, val *pbValue) error {
+					switch field {
+					case 1:
+						c.Tables = append(c.Tables, val.string())
+					case 2:
+						c.Since = val.time()
+					case 3:
+						c.Version = val.string()
+					case 4:
+						c.Archived = val.time()
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+	case *ClusterStatusRequest:
+		// no fields
+	case *common.ClusterStatus:
+		err = pbDecode(data, func(field int, val *pbValue) error {
+			switch field {
+			case 1:
+				m.Version = val.string()
+			case 2:
+				m.NumPartitions = int(val.int())
+			case 3:
+				f := &common.FollowerStatus{}
+				m.Followers = append(m.Followers, f)
+				return pbDecode(val.bytes, func(field int, val *pbValue) error {
+					switch field {
+					case 1:
+						f.ID = int(val.int())
+					case 2:
+						f.Addr = val.string()
+					case 3:
+						f.Partition = int(val.int())
+					case 4:
+						f.Stream = val.string()
+					case 5:
+						f.Version = val.string()
+					case 6:
+						f.Joined = val.time()
+					case 7:
+						f.Offset = wal.Offset(val.copyBytes())
+					case 8:
+						f.Lag = time.Duration(val.int())
+					case 9:
+						f.Queued = int(val.int())
+					case 10:
+						f.Failed = val.bool()
+					case 11:
+						f.LastQueryLatency = time.Duration(val.int())
+					case 12:
+						if f.Labels == nil {
+							f.Labels = make(map[string]string)
+						}
+						return val.label(f.Labels)
+					case 13:
+						f.QueryLatencyP99 = time.Duration(val.int())
+					}
+					return nil
+				})
+			case 4:
+				gap := &common.FollowGap{}
+				m.Gaps = append(m.Gaps, gap)
+				return pbDecode(val.bytes, func(field int, val *pbValue) error {
+					switch field {
+					case 1:
+						gap.Partition = int(val.int())
+					case 2:
+						gap.Stream = val.string()
+					case 3:
+						gap.Requested = wal.Offset(val.copyBytes())
+					case 4:
+						gap.Oldest = wal.Offset(val.copyBytes())
+					case 5:
+						gap.Time = val.time()
+					}
+					return nil
+				})
+			case 5:
+				m.ResyncsRequired = val.int()
+			case 7:
+				m.PlacementRejections = val.int()
+			case 8:
+				m.CacheHits = val.int()
+			case 9:
+				m.CacheMisses = val.int()
+			case 6:
+				owner := &common.DimensionOwner{}
+				m.Owners = append(m.Owners, owner)
+				return pbDecode(val.bytes, func(field int, val *pbValue) error {
+					switch field {
+					case 1:
+						owner.Dim = val.string()
+					case 2:
+						owner.Value = val.string()
+					case 3:
+						owner.Partitions = append(owner.Partitions, int(val.int()))
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+	case *AdminRequest:
+		err = pbDecode(data, func(field int, val *pbValue) error {
+			switch field {
+			case 1:
+				m.Op = val.string()
+			case 2:
+				m.Table = val.string()
+			case 3:
+				m.Args = append(m.Args, val.string())
+			}
+			return nil
+		})
+	case *AdminResponse:
+		err = pbDecode(data, func(field int, val *pbValue) error {
+			if field == 1 {
+				m.Result = val.string()
+			}
+			return nil
+		})
+	case *common.CaptureChanges:
+		err = pbDecode(data, func(field int, val *pbValue) error {
+			if field == 1 {
+				m.Tables = append(m.Tables, val.string())
+			}
+			return nil
+		})
+	case *common.ArchivedChunk:
+		err = pbDecode(data, func(field int, val *pbValue) error {
+			switch field {
+			case 1:
+				m.Table = val.string()
+			case 2:
+				m.Offset = wal.Offset(val.copyBytes())
+			case 3:
+				m.ArchivedAt = val.time()
+			case 4:
+				m.Resolution = time.Duration(val.int())
+			case 5:
+				m.Fields = append(m.Fields, val.string())
+			case 6:
+				m.Key = val.copyBytes()
+			case 7:
+				m.Sequences = append(m.Sequences, encoding.Sequence(val.copyBytes()))
+			}
+			return nil
+		})
+	default:
+		return fmt.Errorf("ProtobufCodec unable to unmarshal %v", reflect.TypeOf(v))
+	}
+	if err != nil {
+		return fmt.Errorf("ProtobufCodec unable to unmarshal %v: %v", reflect.TypeOf(v), err)
+	}
+	return nil
+}
+
+func (c *ProtobufCodec) String() string {
+	return "ProtobufCodec"
+}
+
+// pbEncoder writes protocol buffer fields. Like proto3, it omits scalar fields
+// that have their default value.
+type pbEncoder struct {
+	buf []byte
+}
+
+func (e *pbEncoder) tag(field int, wireType int) {
+	e.uvarint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (e *pbEncoder) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	e.buf = append(e.buf, b[:n]...)
+}
+
+func (e *pbEncoder) int(field int, v int64) {
+	if v != 0 {
+		e.tag(field, wireVarint)
+		e.uvarint(uint64(v))
+	}
+}
+
+// varint writes v even if it's zero, as is required for fields in a oneof.
+func (e *pbEncoder) varint(field int, v uint64) {
+	e.tag(field, wireVarint)
+	e.uvarint(v)
+}
+
+func (e *pbEncoder) fixed64(field int, v uint64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	e.tag(field, wireFixed64)
+	e.buf = append(e.buf, b[:]...)
+}
+
+func (e *pbEncoder) double(field int, v float64) {
+	if v != 0 {
+		e.fixed64(field, math.Float64bits(v))
+	}
+}
+
+func (e *pbEncoder) bool(field int, v bool) {
+	if v {
+		e.int(field, 1)
+	}
+}
+
+func (e *pbEncoder) time(field int, t time.Time) {
+	if !t.IsZero() {
+		e.int(field, t.UnixNano())
+	}
+}
+
+// encodeNulls encodes nulls as one byte per value, or nothing if there are no
+// nulls.
+func encodeNulls(nulls []bool) []byte {
+	var b []byte
+	for i, null := range nulls {
+		if null {
+			if b == nil {
+				b = make([]byte, len(nulls))
+			}
+			b[i] = 1
+		}
+	}
+	return b
+}
+
+func decodeNulls(b []byte) []bool {
+	nulls := make([]bool, len(b))
+	for i, null := range b {
+		nulls[i] = null == 1
+	}
+	return nulls
+}
+
+func (e *pbEncoder) bytes(field int, b []byte) {
+	if len(b) > 0 {
+		e.repeatedBytes(field, b)
+	}
+}
+
+func (e *pbEncoder) string(field int, s string) {
+	if s != "" {
+		e.repeatedString(field, s)
+	}
+}
+
+// repeatedBytes writes b even if it's empty, as is required for elements of
+// repeated fields.
+func (e *pbEncoder) repeatedBytes(field int, b []byte) {
+	e.tag(field, wireBytes)
+	e.uvarint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *pbEncoder) repeatedString(field int, s string) {
+	e.tag(field, wireBytes)
+	e.uvarint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *pbEncoder) doubles(field int, vs []float64) {
+	if len(vs) == 0 {
+		return
+	}
+	e.tag(field, wireBytes)
+	e.uvarint(uint64(len(vs) * 8))
+	for _, v := range vs {
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+		e.buf = append(e.buf, b[:]...)
+	}
+}
+
+func (e *pbEncoder) message(field int, write func(e *pbEncoder)) {
+	nested := &pbEncoder{}
+	write(nested)
+	e.repeatedBytes(field, nested.buf)
+}
+
+// labels writes a map<string, string> field, one entry message per label in
+// key order.
+func (e *pbEncoder) labels(field int, labels map[string]string) {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := labels[key]
+		e.message(field, func(e *pbEncoder) {
+			e.string(1, key)
+			e.string(2, value)
+		})
+	}
+}
+
+// expr writes the fields of an Expr message.
+func (e *pbEncoder) expr(se *expr.Serialized) {
+	e.string(1, se.Type)
+	e.labels(2, se.Strings)
+	names := make([]string, 0, len(se.Numbers))
+	for name := range se.Numbers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		number := se.Numbers[name]
+		e.message(3, func(e *pbEncoder) {
+			e.string(1, name)
+			e.double(2, number)
+		})
+	}
+	for _, arg := range se.Args {
+		e.message(4, func(e *pbEncoder) {
+			e.expr(arg)
+		})
+	}
+	e.bytes(5, se.Cond)
+}
+
+// value writes the fields of a Value message, which sets exactly one of its
+// fields unless v is nil.
+func (e *pbEncoder) value(v interface{}) error {
+	switch tv := v.(type) {
+	case nil:
+		// null
+	case string:
+		e.repeatedString(1, tv)
+	case int:
+		e.varint(2, uint64(tv))
+	case int8:
+		e.varint(2, uint64(tv))
+	case int16:
+		e.varint(2, uint64(tv))
+	case int32:
+		e.varint(2, uint64(tv))
+	case int64:
+		e.varint(2, uint64(tv))
+	case uint:
+		e.varint(3, uint64(tv))
+	case uint8:
+		e.varint(3, uint64(tv))
+	case uint16:
+		e.varint(3, uint64(tv))
+	case uint32:
+		e.varint(3, uint64(tv))
+	case uint64:
+		e.varint(3, tv)
+	case float32:
+		e.fixed64(4, math.Float64bits(float64(tv)))
+	case float64:
+		e.fixed64(4, math.Float64bits(tv))
+	case bool:
+		if tv {
+			e.varint(5, 1)
+		} else {
+			e.varint(5, 0)
+		}
+	case time.Time:
+		e.varint(6, uint64(tv.UnixNano()))
+	default:
+		return fmt.Errorf("Unsupported value of type %v", reflect.TypeOf(v))
+	}
+	return nil
+}
+
+// decodeExpr decodes an Expr message.
+func decodeExpr(b []byte) (*expr.Serialized, error) {
+	se := &expr.Serialized{}
+	err := pbDecode(b, func(field int, val *pbValue) error {
+		switch field {
+		case 1:
+			se.Type = val.string()
+		case 2:
+			if se.Strings == nil {
+				se.Strings = make(map[string]string)
+			}
+			return val.label(se.Strings)
+		case 3:
+			var name string
+			var number float64
+			entryErr := pbDecode(val.bytes, func(field int, val *pbValue) error {
+				switch field {
+				case 1:
+					name = val.string()
+				case 2:
+					number = val.double()
+				}
+				return nil
+			})
+			if se.Numbers == nil {
+				se.Numbers = make(map[string]float64)
+			}
+			se.Numbers[name] = number
+			return entryErr
+		case 4:
+			arg, argErr := decodeExpr(val.bytes)
+			se.Args = append(se.Args, arg)
+			return argErr
+		case 5:
+			se.Cond = val.copyBytes()
+		}
+		return nil
+	})
+	return se, err
+}
+
+// decodeValue decodes a Value message, returning nil if none of its fields are
+// set.
+func decodeValue(b []byte) (interface{}, error) {
+	var value interface{}
+	err := pbDecode(b, func(field int, val *pbValue) error {
+		switch field {
+		case 1:
+			value = val.string()
+		case 2:
+			value = val.int()
+		case 3:
+			value = val.num
+		case 4:
+			value = val.double()
+		case 5:
+			value = val.bool()
+		case 6:
+			value = encoding.TimeFromInt(val.int())
+		}
+		return nil
+	})
+	return value, err
+}
+
+// pbValue is a single decoded protocol buffer field value.
+type pbValue struct {
+	wireType int
+	num      uint64
+	bytes    []byte
+}
+
+func (v *pbValue) int() int64 {
+	return int64(v.num)
+}
+
+func (v *pbValue) double() float64 {
+	return math.Float64frombits(v.num)
+}
+
+func (v *pbValue) bool() bool {
+	return v.num != 0
+}
+
+func (v *pbValue) time() time.Time {
+	if v.num == 0 {
+		return time.Time{}
+	}
+	return encoding.TimeFromInt(int64(v.num))
+}
+
+// label decodes a map<string, string> entry into labels.
+func (v *pbValue) label(labels map[string]string) error {
+	var key, value string
+	err := pbDecode(v.bytes, func(field int, val *pbValue) error {
+		switch field {
+		case 1:
+			key = val.string()
+		case 2:
+			value = val.string()
+		}
+		return nil
+	})
+	labels[key] = value
+	return err
+}
+
+func (v *pbValue) string() string {
+	return string(v.bytes)
+}
+
+func (v *pbValue) copyBytes() []byte {
+	if len(v.bytes) == 0 {
+		return nil
+	}
+	b := make([]byte, len(v.bytes))
+	copy(b, v.bytes)
+	return b
+}
+
+// appendDoubles appends doubles in either packed or unpacked encoding.
+func (v *pbValue) appendDoubles(vs []float64) []float64 {
+	if v.wireType == wireFixed64 {
+		return append(vs, math.Float64frombits(v.num))
+	}
+	for b := v.bytes; len(b) >= 8; b = b[8:] {
+		vs = append(vs, math.Float64frombits(binary.LittleEndian.Uint64(b)))
+	}
+	return vs
+}
+
+// pbDecode decodes the fields in b, calling onField for each one.
+func pbDecode(b []byte, onField func(field int, val *pbValue) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return fmt.Errorf("Invalid tag")
+		}
+		b = b[n:]
+		val := &pbValue{wireType: int(tag & 7)}
+		switch val.wireType {
+		case wireVarint:
+			val.num, n = binary.Uvarint(b)
+			if n <= 0 {
+				return fmt.Errorf("Invalid varint")
+			}
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return fmt.Errorf("Truncated fixed64")
+			}
+			val.num = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case wireFixed32:
+			if len(b) < 4 {
+				return fmt.Errorf("Truncated fixed32")
+			}
+			val.num = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return fmt.Errorf("Truncated length delimited field")
+			}
+			val.bytes = b[n : n+int(l)]
+			b = b[n+int(l):]
+		default:
+			return fmt.Errorf("Unsupported wire type %d", val.wireType)
+		}
+		err := onField(int(tag>>3), val)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
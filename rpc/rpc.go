@@ -2,25 +2,85 @@ package rpc
 
 import (
 	"context"
+	"io"
 	"time"
 
 	"github.com/getlantern/bytemap"
-	"github.com/getlantern/golog"
 	"github.com/getlantern/wal"
 	"github.com/getlantern/zenodb/common"
 	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/logging"
 	"github.com/getlantern/zenodb/planner"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 )
 
 const (
 	PasswordKey = "pwd"
+
+	// TruncatedTrailer and OmittedRowsTrailer are the keys of the trailers with
+	// which the query stream reports that the server truncated its results and
+	// how many rows it omitted.
+	TruncatedTrailer   = "zenodb-truncated"
+	OmittedRowsTrailer = "zenodb-omitted-rows"
+
+	// CodeResyncRequired is the status code with which the follow stream fails
+	// when the follower needs data that the leader no longer has in its WAL, and
+	// with which the changes stream fails when the consumer falls behind.
+	CodeResyncRequired = codes.OutOfRange
+
+	// CodePlacementRejected is the status code with which the follow stream
+	// fails when the follower violates the leader's placement constraints.
+	CodePlacementRejected = codes.FailedPrecondition
+)
+
+// Administrative operations, see AdminRequest.
+const (
+	// AdminFlush flushes (archives) a table's memstore to disk
+	AdminFlush = "flush"
+	// AdminRetention truncates expired data from a table and its WAL
+	AdminRetention = "retention"
+	// AdminFlushForwarded sends any inserts queued for forwarding to the leader
+	AdminFlushForwarded = "flushforwarded"
+	// AdminPause pauses ingestion into a table
+	AdminPause = "pause"
+	// AdminResume resumes ingestion into a table
+	AdminResume = "resume"
+	// AdminDiscard pauses ingestion into a table and drops new points
+	AdminDiscard = "discard"
+	// AdminDrain pauses ingestion into a table and flushes (archives) its
+	// memstore to disk
+	AdminDrain = "drain"
+	// AdminSchema dumps the schema of all tables as YAML
+	AdminSchema = "schema"
+	// AdminRemap starts remapping the values of a dimension in a table's keys.
+	// Its args are the dimension followed by mappings like old=new.
+	AdminRemap = "remap"
+	// AdminRemapStatus reports the progress of the last remap of a table
+	AdminRemapStatus = "remapstatus"
+	// AdminCanonicalize starts merging keys of a table that weren't stored in
+	// canonical form into their canonical keys. Its progress is reported by
+	// AdminRemapStatus.
+	AdminCanonicalize = "canonicalize"
+	// AdminMigrate starts migrating a table to new SQL, which is given by its
+	// args.
+	AdminMigrate = "migrate"
+	// AdminMigrateStatus reports the progress of the last migration of a table
+	AdminMigrateStatus = "migratestatus"
+	// AdminBackfill starts recomputing a view from its source table. Its args
+	// are the start and end of the time range to recompute in RFC3339 format.
+	// Its progress is reported by AdminMigrateStatus.
+	AdminBackfill = "backfill"
 )
 
 var (
-	log = golog.LoggerFor("zenodb.rpc")
+	log = logging.LoggerFor("zenodb.rpc")
 
 	Codec = &MsgPackCodec{}
+
+	// ProtoCodec is used by clients that request protobuf encoding, see
+	// zenodb.proto.
+	ProtoCodec = &ProtobufCodec{}
 )
 
 type Insert struct {
@@ -29,12 +89,19 @@ type Insert struct {
 	Dims         []byte
 	Vals         []byte
 	EndOfInserts bool
+	// AckOffset, if set on the Insert that ends the batch, asks the server to
+	// report the WAL offset of the batch in the InsertReport.
+	AckOffset bool
 }
 
 type InsertReport struct {
 	Received  int
 	Succeeded int
 	Errors    map[int]string
+	// Offset, if requested with AckOffset, is the offset just past the latest
+	// entry in the stream's WAL once the batch was inserted, which covers all
+	// of the batch's accepted points.
+	Offset wal.Offset
 }
 
 type Query struct {
@@ -45,6 +112,14 @@ type Query struct {
 	Unflat          bool
 	Deadline        time.Time
 	HasDeadline     bool
+	TraceParent     string
+	// Format, if set to common.FormatCSV or common.FormatTSV, asks the server to
+	// render the results itself and send them as Data.
+	Format     string
+	OmitHeader bool
+	// Ping is sent by the leader to check that a registered remote query
+	// handler is still alive, which answers with a Pong. It carries no query.
+	Ping bool
 }
 
 type Point struct {
@@ -59,10 +134,47 @@ type RemoteQueryResult struct {
 	Row          *core.FlatRow
 	Error        string
 	EndOfResults bool
+	// Data holds a chunk of results rendered in the Query's Format
+	Data []byte
+	// Stats reports how much data the query read from each table. It's sent
+	// with EndOfResults.
+	Stats []*common.TableQueryStats
+	// Pong answers a Query that's a Ping.
+	Pong bool
+	// Archived is sent with a Pong and reports when the handler's node last
+	// archived data, see common.QueryHandlerCapabilities.Archived. It lets the
+	// leader invalidate cached results for handlers that have been idle since
+	// they registered.
+	Archived time.Time
+	// Truncated and OmittedRows report whether the server truncated the results
+	// and how many rows it omitted. They're sent with EndOfResults.
+	Truncated   bool
+	OmittedRows int64
 }
 
 type RegisterQueryHandler struct {
 	Partition int
+	// Capabilities describe which queries the handler can answer. If nil, it
+	// can answer all queries for its partition.
+	Capabilities *common.QueryHandlerCapabilities
+}
+
+// ClusterStatusRequest requests the status of a cluster from its leader.
+type ClusterStatusRequest struct {
+}
+
+// AdminRequest requests an administrative operation (one of the Admin*
+// constants), on the given Table if the operation applies to a table. Args
+// holds additional arguments for operations that need them.
+type AdminRequest struct {
+	Op    string
+	Table string
+	Args  []string
+}
+
+// AdminResponse reports the result of an AdminRequest.
+type AdminResponse struct {
+	Result string
 }
 
 type Client interface {
@@ -70,9 +182,30 @@ type Client interface {
 
 	Query(ctx context.Context, sqlString string, includeMemStore bool, opts ...grpc.CallOption) (*common.QueryMetaData, func(onRow core.OnFlatRow) error, error)
 
+	// QueryUnflat is like Query but returns the rows before they're flattened,
+	// along with the fields with which to merge them, which allows merging the
+	// results of several servers.
+	QueryUnflat(ctx context.Context, sqlString string, includeMemStore bool, opts ...grpc.CallOption) (*common.QueryMetaData, func(onFields core.OnFields, onRow core.OnRow) error, error)
+
+	// QueryDelimited is like Query but has the server render the results in the
+	// given format (common.FormatCSV or common.FormatTSV), which are then copied
+	// as-is to the io.Writer passed to the returned function.
+	QueryDelimited(ctx context.Context, sqlString string, includeMemStore bool, format string, omitHeader bool, opts ...grpc.CallOption) (*common.QueryMetaData, func(out io.Writer) error, error)
+
 	Follow(ctx context.Context, in *common.Follow, opts ...grpc.CallOption) (func() (data []byte, newOffset wal.Offset, err error), error)
 
-	ProcessRemoteQuery(ctx context.Context, partition int, query planner.QueryClusterFN, opts ...grpc.CallOption) error
+	ProcessRemoteQuery(ctx context.Context, partition int, caps func() *common.QueryHandlerCapabilities, query planner.QueryClusterFN, opts ...grpc.CallOption) error
+
+	ClusterStatus(ctx context.Context, opts ...grpc.CallOption) (*common.ClusterStatus, error)
+
+	Admin(ctx context.Context, op string, table string, opts ...grpc.CallOption) (string, error)
+
+	AdminWithArgs(ctx context.Context, op string, table string, args []string, opts ...grpc.CallOption) (string, error)
+
+	// CaptureChanges streams the chunks of data that the requested tables
+	// archive from now on. The returned function blocks until the next chunk
+	// is available.
+	CaptureChanges(ctx context.Context, req *common.CaptureChanges, opts ...grpc.CallOption) (func() (*common.ArchivedChunk, error), error)
 
 	Close() error
 }
@@ -85,6 +218,12 @@ type Server interface {
 	Follow(*common.Follow, grpc.ServerStream) error
 
 	HandleRemoteQueries(r *RegisterQueryHandler, stream grpc.ServerStream) error
+
+	ClusterStatus(*ClusterStatusRequest, grpc.ServerStream) error
+
+	Admin(*AdminRequest, grpc.ServerStream) error
+
+	CaptureChanges(*common.CaptureChanges, grpc.ServerStream) error
 }
 
 var ServiceDesc = grpc.ServiceDesc{
@@ -113,9 +252,38 @@ var ServiceDesc = grpc.ServiceDesc{
 			Handler:       insertHandler,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "clusterStatus",
+			Handler:       clusterStatusHandler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "admin",
+			Handler:       adminHandler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "changes",
+			Handler:       changesHandler,
+			ServerStreams: true,
+		},
 	},
 }
 
+// IsResyncRequired indicates whether the given error from following a stream
+// means that the follower has fallen too far behind the leader and needs to be
+// resynced.
+func IsResyncRequired(err error) bool {
+	return grpc.Code(err) == CodeResyncRequired
+}
+
+// IsPlacementRejected indicates whether the given error from following a
+// stream means that the leader rejected the follower because of its placement
+// constraints.
+func IsPlacementRejected(err error) bool {
+	return grpc.Code(err) == CodePlacementRejected
+}
+
 func insertHandler(srv interface{}, stream grpc.ServerStream) error {
 	return srv.(Server).Insert(stream)
 }
@@ -143,3 +311,27 @@ func remoteQueryHandler(srv interface{}, stream grpc.ServerStream) error {
 	}
 	return srv.(Server).HandleRemoteQueries(r, stream)
 }
+
+func clusterStatusHandler(srv interface{}, stream grpc.ServerStream) error {
+	r := new(ClusterStatusRequest)
+	if err := stream.RecvMsg(r); err != nil {
+		return err
+	}
+	return srv.(Server).ClusterStatus(r, stream)
+}
+
+func adminHandler(srv interface{}, stream grpc.ServerStream) error {
+	r := new(AdminRequest)
+	if err := stream.RecvMsg(r); err != nil {
+		return err
+	}
+	return srv.(Server).Admin(r, stream)
+}
+
+func changesHandler(srv interface{}, stream grpc.ServerStream) error {
+	r := new(common.CaptureChanges)
+	if err := stream.RecvMsg(r); err != nil {
+		return err
+	}
+	return srv.(Server).CaptureChanges(r, stream)
+}
@@ -14,7 +14,9 @@ import (
 	"github.com/getlantern/zenodb/common"
 	"github.com/getlantern/zenodb/core"
 	"github.com/getlantern/zenodb/planner"
+	"github.com/getlantern/zenodb/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/metadata"
 )
 
@@ -23,13 +25,47 @@ type ClientOpts struct {
 	// in order to gain access.
 	Password string
 
+	// TLS, if specified, secures the connection to the server with TLS. Set
+	// CertFile and KeyFile to authenticate to servers that require client
+	// certificates.
+	TLS *TLSOpts
+
+	// Protobuf, if true, causes the client to use the ProtobufCodec instead of
+	// the default MsgPackCodec.
+	Protobuf bool
+
+	// KeepaliveInterval, if specified, causes the client to ping the server
+	// after this much inactivity in order to detect broken connections. The
+	// server's MinClientKeepaliveInterval must not be larger than this.
+	KeepaliveInterval time.Duration
+
+	// KeepaliveTimeout is how long to wait for a response to a keepalive ping
+	// before closing the connection. Defaults to 20 seconds.
+	KeepaliveTimeout time.Duration
+
+	// MaxRecvMsgSize, if specified, limits the size of messages received from
+	// the server. Defaults to unlimited.
+	MaxRecvMsgSize int
+
+	// MaxSendMsgSize, if specified, limits the size of messages sent to the
+	// server. This should not exceed the server's MaxRecvMsgSize. Defaults to
+	// unlimited.
+	MaxSendMsgSize int
+
 	Dialer func(string, time.Duration) (net.Conn, error)
 }
 
 type Inserter interface {
 	Insert(ts time.Time, dims map[string]interface{}, vals func(func(string, interface{}))) error
 
+	// InsertRaw is like Insert but takes already encoded dims and vals.
+	InsertRaw(ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap) error
+
 	Close() (*InsertReport, error)
+
+	// CloseWithOffset is like Close but also has the server report the WAL
+	// offset of the batch in the InsertReport's Offset.
+	CloseWithOffset() (*InsertReport, error)
 }
 
 func Dial(addr string, opts *ClientOpts) (Client, error) {
@@ -40,22 +76,56 @@ func Dial(addr string, opts *ClientOpts) (Client, error) {
 		}
 	}
 
+	var tf *tlsFiles
+	if opts.TLS != nil {
+		dialer, _tf, err := tlsDialer(opts.Dialer, opts.TLS)
+		if err != nil {
+			return nil, err
+		}
+		opts.Dialer = dialer
+		tf = _tf
+	}
+
+	var codec grpc.Codec = Codec
+	if opts.Protobuf {
+		opts.Dialer = protobufDialer(opts.Dialer)
+		codec = ProtoCodec
+	}
+
 	opts.Dialer = snappyDialer(opts.Dialer)
 
-	conn, err := grpc.Dial(addr,
+	dialOpts := []grpc.DialOption{
 		grpc.WithInsecure(),
 		grpc.WithDialer(opts.Dialer),
-		grpc.WithCodec(Codec),
-		grpc.WithBackoffMaxDelay(1*time.Minute))
+		grpc.WithCodec(LimitSendSize(codec, opts.MaxSendMsgSize)),
+		grpc.WithBackoffMaxDelay(1 * time.Minute),
+	}
+	if opts.KeepaliveInterval > 0 {
+		dialOpts = append(dialOpts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                opts.KeepaliveInterval,
+			Timeout:             opts.KeepaliveTimeout,
+			PermitWithoutStream: true,
+		}))
+	}
+	if opts.MaxRecvMsgSize > 0 {
+		dialOpts = append(dialOpts, grpc.WithMaxMsgSize(opts.MaxRecvMsgSize))
+	}
+
+	conn, err := grpc.Dial(addr, dialOpts...)
 	if err != nil {
+		if tf != nil {
+			tf.close()
+		}
 		return nil, err
 	}
-	return &client{conn, opts.Password}, nil
+	return &client{conn, opts.Password, tf}, nil
 }
 
 type client struct {
 	cc       *grpc.ClientConn
 	password string
+	// tf is the TLS files used for dialing, if any
+	tf *tlsFiles
 }
 
 type inserter struct {
@@ -64,7 +134,7 @@ type inserter struct {
 }
 
 func (c *client) NewInserter(ctx context.Context, streamName string, opts ...grpc.CallOption) (Inserter, error) {
-	clientStream, err := grpc.NewClientStream(ctx, &ServiceDesc.Streams[3], c.cc, "/zenodb/insert", opts...)
+	clientStream, err := grpc.NewClientStream(c.authenticated(ctx), &ServiceDesc.Streams[3], c.cc, "/zenodb/insert", opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -76,11 +146,19 @@ func (c *client) NewInserter(ctx context.Context, streamName string, opts ...grp
 }
 
 func (i *inserter) Insert(ts time.Time, dims map[string]interface{}, vals func(func(string, interface{}))) error {
+	return i.InsertRaw(ts, bytemap.New(dims), bytemap.Build(vals, nil, true))
+}
+
+func (i *inserter) InsertRaw(ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap) error {
+	var tsInt int64
+	if !ts.IsZero() {
+		tsInt = ts.UnixNano()
+	}
 	insert := &Insert{
 		Stream: i.streamName,
-		TS:     ts.UnixNano(),
-		Dims:   bytemap.New(dims),
-		Vals:   bytemap.Build(vals, nil, true),
+		TS:     tsInt,
+		Dims:   dims,
+		Vals:   vals,
 	}
 	// Set streamName to "" to prevent sending it unnecessarily in subsequent inserts
 	i.streamName = ""
@@ -88,7 +166,15 @@ func (i *inserter) Insert(ts time.Time, dims map[string]interface{}, vals func(f
 }
 
 func (i *inserter) Close() (*InsertReport, error) {
-	err := i.clientStream.SendMsg(&Insert{EndOfInserts: true})
+	return i.close(false)
+}
+
+func (i *inserter) CloseWithOffset() (*InsertReport, error) {
+	return i.close(true)
+}
+
+func (i *inserter) close(ackOffset bool) (*InsertReport, error) {
+	err := i.clientStream.SendMsg(&Insert{EndOfInserts: true, AckOffset: ackOffset})
 	if err != nil {
 		return nil, fmt.Errorf("Unable to send closing message: %v", err)
 	}
@@ -105,34 +191,61 @@ func (i *inserter) Close() (*InsertReport, error) {
 }
 
 func (c *client) Query(ctx context.Context, sqlString string, includeMemStore bool, opts ...grpc.CallOption) (*common.QueryMetaData, func(onRow core.OnFlatRow) error, error) {
-	stream, err := grpc.NewClientStream(c.authenticated(ctx), &ServiceDesc.Streams[0], c.cc, "/zenodb/query", opts...)
+	stream, md, err := c.startQuery(ctx, &Query{SQLString: sqlString, IncludeMemStore: includeMemStore}, opts...)
 	if err != nil {
 		return nil, nil, err
 	}
-	if err = stream.SendMsg(&Query{SQLString: sqlString, IncludeMemStore: includeMemStore}); err != nil {
-		return nil, nil, err
-	}
-	if err = stream.CloseSend(); err != nil {
-		return nil, nil, err
+
+	iterate := func(onRow core.OnFlatRow) error {
+		for {
+			result := &RemoteQueryResult{}
+			rowErr := stream.RecvMsg(result)
+			if rowErr != nil {
+				return ErrorFromStream(stream, rowErr)
+			}
+			if result.EndOfResults {
+				md.Stats = result.Stats
+				md.Truncated = result.Truncated
+				md.OmittedRows = result.OmittedRows
+				return nil
+			}
+			more, rowErr := onRow(result.Row)
+			if !more || rowErr != nil {
+				return rowErr
+			}
+		}
 	}
 
-	md := &common.QueryMetaData{}
-	err = stream.RecvMsg(md)
+	return md, iterate, nil
+}
+
+func (c *client) QueryUnflat(ctx context.Context, sqlString string, includeMemStore bool, opts ...grpc.CallOption) (*common.QueryMetaData, func(onFields core.OnFields, onRow core.OnRow) error, error) {
+	stream, md, err := c.startQuery(ctx, &Query{SQLString: sqlString, IncludeMemStore: includeMemStore, Unflat: true}, opts...)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	iterate := func(onRow core.OnFlatRow) error {
+	iterate := func(onFields core.OnFields, onRow core.OnRow) error {
 		for {
 			result := &RemoteQueryResult{}
-			rowErr := stream.RecvMsg(result)
-			if rowErr != nil {
-				return rowErr
+			recvErr := stream.RecvMsg(result)
+			if recvErr != nil {
+				return ErrorFromStream(stream, recvErr)
 			}
 			if result.EndOfResults {
+				md.Stats = result.Stats
+				md.Truncated = result.Truncated
+				md.OmittedRows = result.OmittedRows
 				return nil
 			}
-			more, rowErr := onRow(result.Row)
+			if result.Fields != nil {
+				fieldsErr := onFields(result.Fields)
+				if fieldsErr != nil {
+					return fieldsErr
+				}
+				continue
+			}
+			more, rowErr := onRow(result.Key, result.Vals)
 			if !more || rowErr != nil {
 				return rowErr
 			}
@@ -142,6 +255,55 @@ func (c *client) Query(ctx context.Context, sqlString string, includeMemStore bo
 	return md, iterate, nil
 }
 
+func (c *client) QueryDelimited(ctx context.Context, sqlString string, includeMemStore bool, format string, omitHeader bool, opts ...grpc.CallOption) (*common.QueryMetaData, func(out io.Writer) error, error) {
+	stream, md, err := c.startQuery(ctx, &Query{SQLString: sqlString, IncludeMemStore: includeMemStore, Format: format, OmitHeader: omitHeader}, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	write := func(out io.Writer) error {
+		for {
+			result := &RemoteQueryResult{}
+			recvErr := stream.RecvMsg(result)
+			if recvErr != nil {
+				return ErrorFromStream(stream, recvErr)
+			}
+			if result.EndOfResults {
+				md.Stats = result.Stats
+				md.Truncated = result.Truncated
+				md.OmittedRows = result.OmittedRows
+				return nil
+			}
+			_, writeErr := out.Write(result.Data)
+			if writeErr != nil {
+				return writeErr
+			}
+		}
+	}
+
+	return md, write, nil
+}
+
+func (c *client) startQuery(ctx context.Context, q *Query, opts ...grpc.CallOption) (grpc.ClientStream, *common.QueryMetaData, error) {
+	stream, err := grpc.NewClientStream(c.authenticated(ctx), &ServiceDesc.Streams[0], c.cc, "/zenodb/query", opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = stream.SendMsg(q); err != nil {
+		return nil, nil, err
+	}
+	if err = stream.CloseSend(); err != nil {
+		return nil, nil, err
+	}
+
+	md := &common.QueryMetaData{}
+	err = stream.RecvMsg(md)
+	if err != nil {
+		return nil, nil, ErrorFromStream(stream, err)
+	}
+	return stream, md, nil
+}
+
 func (c *client) Follow(ctx context.Context, f *common.Follow, opts ...grpc.CallOption) (func() (data []byte, newOffset wal.Offset, err error), error) {
 	stream, err := grpc.NewClientStream(c.authenticated(ctx), &ServiceDesc.Streams[1], c.cc, "/zenodb/follow", opts...)
 	if err != nil {
@@ -166,7 +328,7 @@ func (c *client) Follow(ctx context.Context, f *common.Follow, opts ...grpc.Call
 	return next, nil
 }
 
-func (c *client) ProcessRemoteQuery(ctx context.Context, partition int, query planner.QueryClusterFN, opts ...grpc.CallOption) error {
+func (c *client) ProcessRemoteQuery(ctx context.Context, partition int, caps func() *common.QueryHandlerCapabilities, query planner.QueryClusterFN, opts ...grpc.CallOption) error {
 	elapsed := mtime.Stopwatch()
 	defer func() {
 		log.Debugf("Finished processing query in %v", elapsed())
@@ -178,14 +340,29 @@ func (c *client) ProcessRemoteQuery(ctx context.Context, partition int, query pl
 	}
 	defer stream.CloseSend()
 
-	if err := stream.SendMsg(&RegisterQueryHandler{partition}); err != nil {
+	if err := stream.SendMsg(&RegisterQueryHandler{Partition: partition, Capabilities: caps()}); err != nil {
 		return errors.New("Unable to send registration message: %v", err)
 	}
 
 	q := &Query{}
-	recvErr := stream.RecvMsg(q)
-	if recvErr != nil {
-		return errors.New("Unable to read query: %v", recvErr)
+	for {
+		recvErr := stream.RecvMsg(q)
+		if recvErr != nil {
+			return errors.New("Unable to read query: %v", recvErr)
+		}
+		if !q.Ping {
+			break
+		}
+		// Let the leader know that we're still alive and whether we've archived
+		// anything since registering, and keep waiting for a query
+		pong := &RemoteQueryResult{Pong: true}
+		if current := caps(); current != nil {
+			pong.Archived = current.Archived
+		}
+		if err := stream.SendMsg(pong); err != nil {
+			return errors.New("Unable to send pong: %v", err)
+		}
+		q = &Query{}
 	}
 	if q.SQLString == "" {
 		// It's a noop query, ignore
@@ -217,9 +394,13 @@ func (c *client) ProcessRemoteQuery(ctx context.Context, partition int, query pl
 		defer cancel()
 	}
 	streamCtx = common.WithIncludeMemStore(streamCtx, q.IncludeMemStore)
+	streamCtx = trace.WithTraceParent(streamCtx, q.TraceParent)
+
+	stats := common.NewQueryStats()
+	streamCtx = common.WithQueryStats(streamCtx, stats)
 
 	queryErr := query(streamCtx, q.SQLString, q.IsSubQuery, q.SubQueryResults, q.Unflat, onFields, onRow, onFlatRow)
-	result := &RemoteQueryResult{EndOfResults: true}
+	result := &RemoteQueryResult{EndOfResults: true, Stats: stats.Tables()}
 	if queryErr != nil && queryErr != io.EOF {
 		result.Error = queryErr.Error()
 	}
@@ -228,14 +409,91 @@ func (c *client) ProcessRemoteQuery(ctx context.Context, partition int, query pl
 	return nil
 }
 
+func (c *client) ClusterStatus(ctx context.Context, opts ...grpc.CallOption) (*common.ClusterStatus, error) {
+	stream, err := grpc.NewClientStream(c.authenticated(ctx), &ServiceDesc.Streams[4], c.cc, "/zenodb/clusterStatus", opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err = stream.SendMsg(&ClusterStatusRequest{}); err != nil {
+		return nil, err
+	}
+	if err = stream.CloseSend(); err != nil {
+		return nil, err
+	}
+
+	status := &common.ClusterStatus{}
+	err = stream.RecvMsg(status)
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func (c *client) Admin(ctx context.Context, op string, table string, opts ...grpc.CallOption) (string, error) {
+	return c.AdminWithArgs(ctx, op, table, nil, opts...)
+}
+
+func (c *client) AdminWithArgs(ctx context.Context, op string, table string, args []string, opts ...grpc.CallOption) (string, error) {
+	stream, err := grpc.NewClientStream(c.authenticated(ctx), &ServiceDesc.Streams[5], c.cc, "/zenodb/admin", opts...)
+	if err != nil {
+		return "", err
+	}
+	if err = stream.SendMsg(&AdminRequest{Op: op, Table: table, Args: args}); err != nil {
+		return "", err
+	}
+	if err = stream.CloseSend(); err != nil {
+		return "", err
+	}
+
+	resp := &AdminResponse{}
+	err = stream.RecvMsg(resp)
+	if err != nil {
+		return "", ErrorFrom(err)
+	}
+	return resp.Result, nil
+}
+
+func (c *client) CaptureChanges(ctx context.Context, req *common.CaptureChanges, opts ...grpc.CallOption) (func() (*common.ArchivedChunk, error), error) {
+	stream, err := grpc.NewClientStream(c.authenticated(ctx), &ServiceDesc.Streams[6], c.cc, "/zenodb/changes", opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err = stream.SendMsg(req); err != nil {
+		return nil, err
+	}
+	if err = stream.CloseSend(); err != nil {
+		return nil, err
+	}
+
+	next := func() (*common.ArchivedChunk, error) {
+		chunk := &common.ArchivedChunk{}
+		err := stream.RecvMsg(chunk)
+		if err != nil {
+			return nil, err
+		}
+		return chunk, nil
+	}
+
+	return next, nil
+}
+
 func (c *client) Close() error {
+	if c.tf != nil {
+		c.tf.close()
+	}
 	return c.cc.Close()
 }
 
 func (c *client) authenticated(ctx context.Context) context.Context {
-	if c.password == "" {
+	md := metadata.MD{}
+	if c.password != "" {
+		md[PasswordKey] = []string{c.password}
+	}
+	if traceParent := trace.TraceParent(ctx); traceParent != "" {
+		md[trace.TraceParentKey] = []string{traceParent}
+	}
+	if len(md) == 0 {
 		return ctx
 	}
-	md := metadata.New(map[string]string{PasswordKey: c.password})
 	return metadata.NewContext(ctx, md)
 }
@@ -0,0 +1,301 @@
+package rpcserver
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/getlantern/goexpr"
+	"github.com/getlantern/yaml"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/planner"
+	"github.com/getlantern/zenodb/rpc"
+	"github.com/getlantern/zenodb/sql"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Role identifies a class of RPC operations that a Credential may perform.
+type Role string
+
+const (
+	// RoleRead allows running queries.
+	RoleRead Role = "read"
+
+	// RoleInsert allows inserting into streams.
+	RoleInsert Role = "insert"
+
+	// RoleFollow allows following streams and handling remote queries, which is
+	// what cluster followers do.
+	RoleFollow Role = "follow"
+
+	// RoleAdmin allows everything, including administrative operations.
+	RoleAdmin Role = "admin"
+)
+
+// Credential describes what the bearer of a given token is allowed to do.
+type Credential struct {
+	// Roles are the roles granted to this credential.
+	Roles []Role
+
+	// Tables, if specified, restricts this credential to the named tables (for
+	// queries) and streams (for inserts and follows). If empty, all tables and
+	// streams are allowed.
+	Tables []string
+
+	// Dims, if specified, restricts the queries of this credential to the named
+	// dimensions.
+	Dims []string
+
+	// Filter, if specified, is a boolean SQL expression like tenant_id = 5 that's
+	// ANDed with the WHERE clause of every query run by this credential.
+	Filter string
+
+	// Limits, if specified, override the server's default Limits for this
+	// credential.
+	Limits *Limits
+}
+
+// acl returns the planner.ACL that enforces this credential's restrictions on
+// queries, or nil if there aren't any.
+func (c *Credential) acl() *planner.ACL {
+	if c == nil || (len(c.Tables) == 0 && len(c.Dims) == 0 && c.Filter == "") {
+		return nil
+	}
+	return &planner.ACL{
+		Tables: c.Tables,
+		Dims:   c.Dims,
+		Filter: c.Filter,
+	}
+}
+
+// restrictsRows indicates whether this credential limits which dimensions or
+// rows it can see, which statements that report on whole tables without going
+// through the query planner can't enforce.
+func (c *Credential) restrictsRows() bool {
+	return c != nil && (len(c.Dims) > 0 || c.Filter != "")
+}
+
+func (c *Credential) hasRole(role Role) bool {
+	for _, candidate := range c.Roles {
+		if candidate == role || candidate == RoleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Credential) allowsTable(table string) bool {
+	if len(c.Tables) == 0 {
+		return true
+	}
+	for _, candidate := range c.Tables {
+		if strings.EqualFold(candidate, table) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadCredentials loads Credentials keyed by token from the YAML file at the
+// given path, for example:
+//
+//	reporting-token:
+//	  roles: [read]
+//	  tables: [combined]
+//	acme-token:
+//	  roles: [read]
+//	  dims: [country, device]
+//	  filter: tenant_id = 5
+//	follower-token:
+//	  roles: [follow]
+//	  limits:
+//	    maxconcurrentstreams: 50
+//	    maxfollowbytespersecond: 10485760
+func LoadCredentials(filename string) (map[string]*Credential, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read credentials from %v: %v", filename, err)
+	}
+	credentials := make(map[string]*Credential)
+	err = yaml.Unmarshal(b, &credentials)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse credentials from %v: %v", filename, err)
+	}
+	for token, credential := range credentials {
+		for _, role := range credential.Roles {
+			switch role {
+			case RoleRead, RoleInsert, RoleFollow, RoleAdmin:
+				// okay
+			default:
+				return nil, fmt.Errorf("Unknown role %v for token ending in %v", role, tokenSuffix(token))
+			}
+		}
+		if credential.Filter != "" {
+			err = sql.ValidateFilter(credential.Filter)
+			if err != nil {
+				return nil, fmt.Errorf("Bad filter for token ending in %v: %v", tokenSuffix(token), err)
+			}
+		}
+	}
+	return credentials, nil
+}
+
+// restrictCapabilities limits the tables served by a query handler to the
+// ones that its credential allows. It fails if that leaves no tables.
+func restrictCapabilities(caps *common.QueryHandlerCapabilities, c *Credential) (*common.QueryHandlerCapabilities, error) {
+	if c == nil || len(c.Tables) == 0 {
+		return caps, nil
+	}
+	restricted := &common.QueryHandlerCapabilities{}
+	if caps != nil {
+		*restricted = *caps
+	}
+	if len(restricted.Tables) == 0 {
+		restricted.Tables = c.Tables
+		return restricted, nil
+	}
+	restricted.Tables = nil
+	for _, table := range caps.Tables {
+		if c.allowsTable(table) {
+			restricted.Tables = append(restricted.Tables, table)
+		}
+	}
+	if len(restricted.Tables) == 0 {
+		return nil, fmt.Errorf("Not allowed to serve any of tables %v", strings.Join(caps.Tables, ", "))
+	}
+	return restricted, nil
+}
+
+func (s *server) authorize(stream grpc.ServerStream, role Role, tables ...string) error {
+	_, err := s.authorizeCredential(stream, role, tables...)
+	return err
+}
+
+// authorizeCredential is like authorize but also returns the matching
+// Credential, which is nil if credentials aren't configured.
+func (s *server) authorizeCredential(stream grpc.ServerStream, role Role, tables ...string) (*Credential, error) {
+	credential, err := s.authenticate(stream, role)
+	if err != nil {
+		return nil, err
+	}
+	return credential, credential.authorizeTables(tables...)
+}
+
+// authenticate checks that the stream presents a valid password or a token
+// with the given role, returning the matching Credential, which is nil if
+// credentials aren't configured. It doesn't need to know which tables are
+// accessed, so requests can be authenticated before their SQL is parsed, after
+// which authorizeTables checks the tables.
+func (s *server) authenticate(stream grpc.ServerStream, role Role) (*Credential, error) {
+	if len(s.credentials) == 0 {
+		if role == RoleInsert {
+			// No credentials configured, anyone can insert
+			return nil, nil
+		}
+		return nil, s.authorizePassword(stream)
+	}
+
+	md, ok := metadata.FromContext(stream.Context())
+	if !ok {
+		return nil, log.Error("No metadata provided, unable to authenticate")
+	}
+	token, credential := s.credentialFor(md[rpc.PasswordKey])
+	if credential == nil {
+		return nil, log.Error("None of the provided tokens matched, not authorized!")
+	}
+	if !credential.hasRole(role) {
+		return nil, log.Errorf("Token ending in %v does not have role %v", tokenSuffix(token), role)
+	}
+	// authenticated
+	return credential, nil
+}
+
+// credentialFor returns the first of the given tokens that matches a configured
+// Credential along with that Credential. Tokens are compared in constant time
+// so that how long this takes doesn't reveal how much of a token matched.
+func (s *server) credentialFor(tokens []string) (string, *Credential) {
+	for _, token := range tokens {
+		var match *Credential
+		for candidate, credential := range s.credentials {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(candidate)) == 1 {
+				match = credential
+			}
+		}
+		if match != nil {
+			return token, match
+		}
+	}
+	return "", nil
+}
+
+// authorizeTables checks that this Credential allows access to all of the
+// given tables. A nil Credential (credentials not configured) allows all
+// tables.
+func (c *Credential) authorizeTables(tables ...string) error {
+	if c == nil {
+		return nil
+	}
+	for _, table := range tables {
+		if !c.allowsTable(table) {
+			return log.Errorf("Token is not allowed to access %v", table)
+		}
+	}
+	return nil
+}
+
+func (s *server) authorizePassword(stream grpc.ServerStream) error {
+	if s.password == "" {
+		log.Debug("No password specified, allowing access to world")
+		return nil
+	}
+	md, ok := metadata.FromContext(stream.Context())
+	if !ok {
+		return log.Error("No metadata provided, unable to authenticate")
+	}
+	passwords := md[rpc.PasswordKey]
+	for _, password := range passwords {
+		if subtle.ConstantTimeCompare([]byte(password), []byte(s.password)) == 1 {
+			// authorized
+			return nil
+		}
+	}
+	return log.Error("None of the provided passwords matched, not authorized!")
+}
+
+// tablesFor returns the names of all tables referenced by the given SQL,
+// including ones referenced from subqueries.
+func tablesFor(sqlString string) ([]string, error) {
+	query, err := sql.Parse(sqlString)
+	if err != nil {
+		return nil, err
+	}
+	var tables []string
+	var walkErr error
+	for current := query; current != nil; current = current.FromSubQuery {
+		if current.From != "" {
+			tables = append(tables, current.From)
+		}
+		if current.Where != nil {
+			current.Where.WalkLists(func(list goexpr.List) {
+				sq, ok := list.(*sql.SubQuery)
+				if ok && walkErr == nil {
+					var subTables []string
+					subTables, walkErr = tablesFor(sq.SQL)
+					tables = append(tables, subTables...)
+				}
+			})
+		}
+	}
+	return tables, walkErr
+}
+
+// tokenSuffix returns the last few characters of a token for use in log
+// messages without revealing the whole token.
+func tokenSuffix(token string) string {
+	if len(token) <= 4 {
+		return token
+	}
+	return token[len(token)-4:]
+}
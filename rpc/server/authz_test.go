@@ -0,0 +1,191 @@
+package rpcserver
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/rpc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadCredentials(t *testing.T) {
+	f, err := ioutil.TempFile("", "credentials")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(`
+reader:
+  roles: [read]
+  tables: [combined]
+tenant:
+  roles: [read]
+  dims: [country]
+  filter: tenant_id = 5
+admin:
+  roles: [admin]
+  limits:
+    maxconcurrentstreams: 10
+    maxqueriespersecond: 2.5
+`)
+	f.Close()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	credentials, err := LoadCredentials(f.Name())
+	if !assert.NoError(t, err) {
+		return
+	}
+	reader := credentials["reader"]
+	if assert.NotNil(t, reader) {
+		assert.True(t, reader.hasRole(RoleRead))
+		assert.False(t, reader.hasRole(RoleInsert))
+		assert.True(t, reader.allowsTable("COMBINED"))
+		assert.False(t, reader.allowsTable("other"))
+		assert.Equal(t, []string{"combined"}, reader.acl().Tables)
+	}
+	tenant := credentials["tenant"]
+	if assert.NotNil(t, tenant) {
+		acl := tenant.acl()
+		if assert.NotNil(t, acl) {
+			assert.Equal(t, []string{"country"}, acl.Dims)
+			assert.Equal(t, "tenant_id = 5", acl.Filter)
+		}
+	}
+	admin := credentials["admin"]
+	if assert.NotNil(t, admin) {
+		assert.True(t, admin.hasRole(RoleFollow))
+		assert.True(t, admin.allowsTable("other"))
+		assert.Nil(t, admin.acl(), "Unrestricted credential shouldn't need an ACL")
+		assert.Equal(t, &Limits{MaxConcurrentStreams: 10, MaxQueriesPerSecond: 2.5}, admin.Limits)
+	}
+
+	ioutil.WriteFile(f.Name(), []byte("bad:\n  roles: [superuser]\n"), 0644)
+	_, err = LoadCredentials(f.Name())
+	assert.Error(t, err, "Unknown role should fail")
+
+	ioutil.WriteFile(f.Name(), []byte("bad:\n  roles: [read]\n  filter: tenant_id =\n"), 0644)
+	_, err = LoadCredentials(f.Name())
+	assert.Error(t, err, "Bad filter should fail")
+}
+
+func TestTablesFor(t *testing.T) {
+	tables, err := tablesFor("SELECT * FROM (SELECT * FROM inner_table) GROUP BY period(1h)")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"inner_table"}, tables)
+	}
+}
+
+func TestRestrictCapabilities(t *testing.T) {
+	unrestricted := &Credential{Roles: []Role{RoleFollow}}
+	restricted := &Credential{Roles: []Role{RoleFollow}, Tables: []string{"a", "b"}}
+	since := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	caps, err := restrictCapabilities(nil, unrestricted)
+	if assert.NoError(t, err) {
+		assert.Nil(t, caps)
+	}
+	caps, err = restrictCapabilities(nil, restricted)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"a", "b"}, caps.Tables, "handler without capabilities should serve tables allowed by credential")
+	}
+	caps, err = restrictCapabilities(&common.QueryHandlerCapabilities{Tables: []string{"A", "c"}, Since: since, Version: "1.0"}, restricted)
+	if assert.NoError(t, err) {
+		assert.Equal(t, &common.QueryHandlerCapabilities{Tables: []string{"A"}, Since: since, Version: "1.0"}, caps)
+	}
+	_, err = restrictCapabilities(&common.QueryHandlerCapabilities{Tables: []string{"c"}}, restricted)
+	assert.Error(t, err, "handler that serves no allowed tables should be rejected")
+}
+
+func TestInsertAuthorization(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	db := &mockDB{}
+	go func() {
+		Serve(db, l, &Opts{
+			Credentials: map[string]*Credential{
+				"inserter": &Credential{Roles: []Role{RoleInsert}, Tables: []string{"allowed"}},
+				"reader":   &Credential{Roles: []Role{RoleRead}},
+			},
+		})
+	}()
+	time.Sleep(1 * time.Second)
+
+	insert := func(token string, streamName string) error {
+		client, err := rpc.Dial(l.Addr().String(), &rpc.ClientOpts{Password: token})
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		inserter, err := client.NewInserter(context.Background(), streamName)
+		if err != nil {
+			return err
+		}
+		err = inserter.Insert(time.Time{}, map[string]interface{}{"dim": "dimval"}, func(cb func(key string, value interface{})) {
+			cb("val", float64(1))
+		})
+		if err != nil {
+			return err
+		}
+		_, err = inserter.Close()
+		return err
+	}
+
+	assert.NoError(t, insert("inserter", "allowed"))
+	assert.Error(t, insert("inserter", "forbidden"), "Stream not in credential's tables should be rejected")
+	assert.Error(t, insert("reader", "allowed"), "Credential without insert role should be rejected")
+	assert.Error(t, insert("unknown", "allowed"), "Unknown token should be rejected")
+	assert.Equal(t, 1, db.NumInserts())
+}
+
+func TestTableReportAuthorization(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	go Serve(&mockDB{}, l, &Opts{
+		Credentials: map[string]*Credential{
+			"reader":   &Credential{Roles: []Role{RoleRead}, Tables: []string{"thetable"}},
+			"dims":     &Credential{Roles: []Role{RoleRead}, Dims: []string{"country"}},
+			"filtered": &Credential{Roles: []Role{RoleRead}, Filter: "tenant_id = 5"},
+		},
+	})
+	time.Sleep(1 * time.Second)
+
+	query := func(token string, sqlString string) error {
+		client, err := rpc.Dial(l.Addr().String(), &rpc.ClientOpts{Password: token})
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		_, iterate, err := client.Query(context.Background(), sqlString, false)
+		if err != nil {
+			return err
+		}
+		return iterate(func(row *core.FlatRow) (bool, error) {
+			return true, nil
+		})
+	}
+
+	for _, sqlString := range []string{"SHOW CARDINALITY FOR thetable", "SHOW LAST SEEN FOR thetable OLDER THAN 1m"} {
+		assert.NoError(t, query("reader", sqlString), sqlString)
+		assert.Error(t, query("dims", sqlString), "Credential restricted to dims should be rejected: %v", sqlString)
+		assert.Error(t, query("filtered", sqlString), "Credential restricted by filter should be rejected: %v", sqlString)
+	}
+}
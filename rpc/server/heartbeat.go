@@ -0,0 +1,60 @@
+package rpcserver
+
+import (
+	"sync"
+	"time"
+
+	"github.com/getlantern/zenodb/rpc"
+	"google.golang.org/grpc"
+)
+
+const (
+	defaultRemoteQueryPingInterval = 30 * time.Second
+	defaultRemoteQueryPingTimeout  = 10 * time.Second
+)
+
+// heartbeat tracks the liveness of a registered remote query handler while it
+// waits for a query. Until a query claims the handler, the leader pings it
+// periodically, and if it doesn't answer in time, it's evicted so that no
+// query gets sent to it. Once claimed, a handler can't be evicted anymore and
+// the query's deadline takes over.
+type heartbeat struct {
+	claimed bool
+	evicted bool
+	mx      sync.Mutex
+}
+
+// claim claims the handler for a query, unless it's already been evicted.
+func (hb *heartbeat) claim() bool {
+	hb.mx.Lock()
+	defer hb.mx.Unlock()
+	if hb.evicted {
+		return false
+	}
+	hb.claimed = true
+	return true
+}
+
+// evict evicts the handler, unless it's already been claimed. It returns true
+// if the handler is evicted.
+func (hb *heartbeat) evict() bool {
+	hb.mx.Lock()
+	defer hb.mx.Unlock()
+	if hb.claimed {
+		return false
+	}
+	hb.evicted = true
+	return true
+}
+
+// ping pings the handler on the given stream, unless it's already been claimed
+// or evicted, and returns true if it sent a ping. Pings are sent while holding
+// the lock so that they never race with sending a query.
+func (hb *heartbeat) ping(stream grpc.ServerStream) (bool, error) {
+	hb.mx.Lock()
+	defer hb.mx.Unlock()
+	if hb.claimed || hb.evicted {
+		return false, nil
+	}
+	return true, stream.SendMsg(&rpc.Query{Ping: true})
+}
@@ -0,0 +1,107 @@
+package rpcserver
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/rpc"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+func TestRemoteQueryHeartbeat(t *testing.T) {
+	db := &mockDB{}
+	s := &server{db: db, pingInterval: 25 * time.Millisecond, pingTimeout: 100 * time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	archived := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	live := newHandlerStream(ctx)
+	liveErr := make(chan error, 1)
+	go func() {
+		liveErr <- s.HandleRemoteQueries(&rpc.RegisterQueryHandler{}, live)
+	}()
+	var pings int64
+	go func() {
+		for q := range live.sent {
+			if q.Ping {
+				atomic.AddInt64(&pings, 1)
+				live.received <- &rpc.RemoteQueryResult{Pong: true, Archived: archived}
+				continue
+			}
+			live.received <- &rpc.RemoteQueryResult{}
+			live.received <- &rpc.RemoteQueryResult{EndOfResults: true}
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	hung := newHandlerStream(ctx)
+	hungErr := make(chan error, 1)
+	go func() {
+		hungErr <- s.HandleRemoteQueries(&rpc.RegisterQueryHandler{}, hung)
+	}()
+
+	select {
+	case err := <-hungErr:
+		assert.Error(t, err, "handler that doesn't answer pings should be evicted")
+	case <-time.After(1 * time.Second):
+		assert.Fail(t, "handler that doesn't answer pings should have been evicted")
+	}
+
+	handlers := db.QueryHandlers()
+	if !assert.Len(t, handlers, 2) {
+		return
+	}
+	onFields := func(fields core.Fields) error {
+		return nil
+	}
+	assert.Error(t, handlers[1](ctx, "SELECT * FROM thetable", false, nil, false, onFields, nil, nil), "evicted handler should fail without being queried")
+	assert.NoError(t, handlers[0](ctx, "SELECT * FROM thetable", false, nil, false, onFields, nil, nil), "live handler should still answer queries")
+	select {
+	case err := <-liveErr:
+		assert.NoError(t, err)
+	case <-time.After(1 * time.Second):
+		assert.Fail(t, "live handler should have finished")
+	}
+	assert.True(t, atomic.LoadInt64(&pings) > 1, "live handler should have been pinged repeatedly")
+	assert.Equal(t, archived, db.Archived(), "archive time reported with pongs should have been passed to the database")
+}
+
+// handlerStream is a grpc.ServerStream for a remote query handler whose
+// messages are exchanged via channels.
+type handlerStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	sent     chan *rpc.Query
+	received chan *rpc.RemoteQueryResult
+}
+
+func newHandlerStream(ctx context.Context) *handlerStream {
+	return &handlerStream{
+		ctx:      ctx,
+		sent:     make(chan *rpc.Query, 10),
+		received: make(chan *rpc.RemoteQueryResult, 10),
+	}
+}
+
+func (s *handlerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *handlerStream) SendMsg(m interface{}) error {
+	s.sent <- m.(*rpc.Query)
+	return nil
+}
+
+func (s *handlerStream) RecvMsg(m interface{}) error {
+	select {
+	case r := <-s.received:
+		*m.(*rpc.RemoteQueryResult) = *r
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
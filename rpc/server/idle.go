@@ -0,0 +1,102 @@
+package rpcserver
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// idleTimeoutInterceptor aborts query and insert streams that haven't seen any
+// activity for longer than timeout.
+func idleTimeoutInterceptor(timeout time.Duration) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		switch info.FullMethod {
+		case "/zenodb/query", "/zenodb/insert":
+			// subject to idle timeout
+		default:
+			return handler(srv, ss)
+		}
+
+		ctx, cancel := context.WithCancel(ss.Context())
+		defer cancel()
+		is := &idleStream{
+			ServerStream: ss,
+			ctx:          ctx,
+			activity:     make(chan struct{}, 1),
+		}
+
+		result := make(chan error, 1)
+		go func() {
+			result <- handler(srv, is)
+		}()
+
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		for {
+			select {
+			case err := <-result:
+				return err
+			case <-is.activity:
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(timeout)
+			case <-timer.C:
+				// Canceling ctx stops any running query and makes any further sends
+				// and receives by the handler fail immediately. Returning ends the
+				// stream, which unblocks a send or receive that's already pending.
+				log.Debugf("Aborting %v stream that was idle for more than %v", info.FullMethod, timeout)
+				cancel()
+				return grpc.Errorf(codes.DeadlineExceeded, "stream idle for more than %v", timeout)
+			}
+		}
+	}
+}
+
+// idleStream is a grpc.ServerStream that reports activity whenever a message
+// is sent or received.
+type idleStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	activity chan struct{}
+}
+
+func (is *idleStream) Context() context.Context {
+	return is.ctx
+}
+
+func (is *idleStream) SendMsg(m interface{}) error {
+	return is.do(func() error {
+		return is.ServerStream.SendMsg(m)
+	})
+}
+
+func (is *idleStream) RecvMsg(m interface{}) error {
+	return is.do(func() error {
+		return is.ServerStream.RecvMsg(m)
+	})
+}
+
+// do runs the given send or receive, reporting activity both before and after
+// so that the idle timer measures time spent waiting between messages. Once the
+// stream has been aborted, do fails with the context's error without touching
+// the underlying stream.
+func (is *idleStream) do(fn func() error) error {
+	if err := is.ctx.Err(); err != nil {
+		return err
+	}
+	is.active()
+	err := fn()
+	is.active()
+	return err
+}
+
+func (is *idleStream) active() {
+	select {
+	case is.activity <- struct{}{}:
+	default:
+		// activity already pending
+	}
+}
@@ -0,0 +1,78 @@
+package rpcserver
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/rpc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdleTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	db := &mockDB{}
+	go Serve(db, l, &Opts{
+		IdleTimeout: 250 * time.Millisecond,
+	})
+
+	client, err := rpc.Dial(l.Addr().String(), &rpc.ClientOpts{
+		KeepaliveInterval: 1 * time.Minute,
+		MaxSendMsgSize:    1024,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	inserter, err := client.NewInserter(context.Background(), "thestream")
+	if !assert.NoError(t, err) {
+		return
+	}
+	// Keep the stream active for longer than the idle timeout
+	for i := 0; i < 5; i++ {
+		err = inserter.Insert(time.Time{}, map[string]interface{}{"dim": "dimval"}, func(cb func(key string, value interface{})) {
+			cb("val", float64(i))
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	report, err := inserter.Close()
+	if assert.NoError(t, err, "active stream should not have timed out") {
+		assert.Equal(t, 5, report.Succeeded)
+	}
+
+	inserter, err = client.NewInserter(context.Background(), "thestream")
+	if !assert.NoError(t, err) {
+		return
+	}
+	// Send one insert to open the stream on the server, then go idle
+	err = inserter.Insert(time.Time{}, map[string]interface{}{"dim": "dimval"}, func(cb func(key string, value interface{})) {
+		cb("val", float64(1))
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	time.Sleep(500 * time.Millisecond)
+	_, err = inserter.Close()
+	assert.Error(t, err, "idle stream should have timed out")
+
+	inserter, err = client.NewInserter(context.Background(), "thestream")
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = inserter.Insert(time.Time{}, map[string]interface{}{"dim": string(make([]byte, 2048))}, func(cb func(key string, value interface{})) {
+		cb("val", float64(1))
+	})
+	if assert.Error(t, err, "message exceeding max send size should have been rejected") {
+		assert.Contains(t, err.Error(), "exceeds the max send size")
+	}
+}
@@ -0,0 +1,234 @@
+package rpcserver
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/getlantern/zenodb/rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// principalIdleTime is how long a principal has to be idle before the limiter
+// forgets about it. By then, its rate limits have fully recovered anyway.
+const principalIdleTime = 1 * time.Minute
+
+// Limits protect the server from clients that use too much of it, for example
+// misconfigured clients that spam queries. They apply per principal, which is
+// the Credential if credentials are configured and otherwise the connection.
+// A zero value for any limit means that it's unlimited.
+type Limits struct {
+	// MaxConcurrentStreams limits how many streams may be open at the same
+	// time. This includes the long-lived follow and remote query streams of
+	// followers, which keep several remote query streams open at once.
+	MaxConcurrentStreams int
+
+	// MaxQueriesPerSecond limits how many queries may be started per second,
+	// allowing bursts of up to one second's worth of queries.
+	MaxQueriesPerSecond float64
+
+	// MaxFollowBytesPerSecond limits how fast WAL data is sent to followers.
+	// Followers that exceed it are slowed down rather than rejected.
+	MaxFollowBytesPerSecond int64
+}
+
+// limiter enforces Limits per principal.
+type limiter struct {
+	defaults    *Limits
+	credentials map[string]*Credential
+	principals  map[string]*principal
+	lastPruned  time.Time
+	mx          sync.Mutex
+}
+
+// principal tracks the usage of a single principal. Its fields are protected
+// by the limiter's mutex.
+type principal struct {
+	name         string
+	limits       *Limits
+	streams      int
+	queryTokens  *tokenBucket
+	followTokens *tokenBucket
+	lastActive   time.Time
+}
+
+func newLimiter(defaults *Limits, credentials map[string]*Credential) *limiter {
+	return &limiter{
+		defaults:    defaults,
+		credentials: credentials,
+		principals:  make(map[string]*principal),
+		lastPruned:  time.Now(),
+	}
+}
+
+// limits indicates whether any limits are configured.
+func (l *limiter) limits() bool {
+	if l.defaults != nil {
+		return true
+	}
+	for _, credential := range l.credentials {
+		if credential.Limits != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// interceptor enforces the limits on every stream.
+func (l *limiter) interceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		p, err := l.admit(ss, info.FullMethod)
+		if err != nil {
+			return err
+		}
+		if p == nil {
+			return handler(srv, ss)
+		}
+		defer l.finished(p)
+		if info.FullMethod == "/zenodb/follow" && p.limits.MaxFollowBytesPerSecond > 0 {
+			ss = &throttledStream{ss, l, p}
+		}
+		return handler(srv, ss)
+	}
+}
+
+// admit admits a new stream for the given method, returning the principal
+// that opened it or nil if the principal has no limits.
+func (l *limiter) admit(ss grpc.ServerStream, method string) (*principal, error) {
+	name, limits := l.principalFor(ss)
+	if limits == nil {
+		return nil, nil
+	}
+
+	now := time.Now()
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	l.prune(now)
+	p := l.principals[name]
+	if p == nil {
+		p = &principal{
+			name:         name,
+			limits:       limits,
+			queryTokens:  &tokenBucket{},
+			followTokens: &tokenBucket{},
+		}
+		l.principals[name] = p
+	}
+	p.lastActive = now
+	if limits.MaxConcurrentStreams > 0 && p.streams >= limits.MaxConcurrentStreams {
+		return nil, grpc.Errorf(codes.ResourceExhausted, "%v already has the maximum of %d concurrent streams open", name, limits.MaxConcurrentStreams)
+	}
+	if method == "/zenodb/query" && limits.MaxQueriesPerSecond > 0 {
+		p.queryTokens.refill(now, limits.MaxQueriesPerSecond)
+		if p.queryTokens.tokens < 1 {
+			return nil, grpc.Errorf(codes.ResourceExhausted, "%v exceeded its rate of %v queries per second, please try again later", name, limits.MaxQueriesPerSecond)
+		}
+		p.queryTokens.tokens--
+	}
+	p.streams++
+	return p, nil
+}
+
+func (l *limiter) finished(p *principal) {
+	l.mx.Lock()
+	p.streams--
+	p.lastActive = time.Now()
+	l.mx.Unlock()
+}
+
+// prune forgets principals that have been idle for a while. It must be called
+// with mx held.
+func (l *limiter) prune(now time.Time) {
+	if now.Sub(l.lastPruned) < principalIdleTime {
+		return
+	}
+	for name, p := range l.principals {
+		if p.streams == 0 && now.Sub(p.lastActive) > principalIdleTime {
+			delete(l.principals, name)
+		}
+	}
+	l.lastPruned = now
+}
+
+// principalFor identifies the principal that opened the given stream along
+// with its limits. Streams that present the token of a Credential belong to
+// that Credential, all others to their connection.
+func (l *limiter) principalFor(ss grpc.ServerStream) (string, *Limits) {
+	ctx := ss.Context()
+	if md, ok := metadata.FromContext(ctx); ok {
+		for _, token := range md[rpc.PasswordKey] {
+			credential := l.credentials[token]
+			if credential == nil {
+				continue
+			}
+			limits := l.defaults
+			if credential.Limits != nil {
+				limits = credential.Limits
+			}
+			return fmt.Sprintf("Token ending in %v", tokenSuffix(token)), limits
+		}
+	}
+	addr := "unknown"
+	if p, ok := peer.FromContext(ctx); ok {
+		addr = p.Addr.String()
+	}
+	return fmt.Sprintf("Connection from %v", addr), l.defaults
+}
+
+// throttle blocks until n more bytes may be sent to the given principal's
+// followers.
+func (l *limiter) throttle(p *principal, n int) {
+	rate := float64(p.limits.MaxFollowBytesPerSecond)
+	l.mx.Lock()
+	p.followTokens.refill(time.Now(), rate)
+	// Reserve the bytes even if that leaves us in debt, which the principal's
+	// other follow streams then have to wait for too.
+	p.followTokens.tokens -= float64(n)
+	debt := -p.followTokens.tokens
+	l.mx.Unlock()
+
+	if debt > 0 {
+		time.Sleep(time.Duration(debt / rate * float64(time.Second)))
+	}
+}
+
+// tokenBucket is a token bucket that holds up to one second's worth of tokens,
+// or at least one token.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (tb *tokenBucket) refill(now time.Time, rate float64) {
+	max := rate
+	if max < 1 {
+		max = 1
+	}
+	if tb.last.IsZero() {
+		tb.tokens = max
+	} else {
+		tb.tokens += now.Sub(tb.last).Seconds() * rate
+		if tb.tokens > max {
+			tb.tokens = max
+		}
+	}
+	tb.last = now
+}
+
+// throttledStream is a grpc.ServerStream whose sends of WAL data are throttled
+// to its principal's MaxFollowBytesPerSecond.
+type throttledStream struct {
+	grpc.ServerStream
+	l *limiter
+	p *principal
+}
+
+func (ts *throttledStream) SendMsg(m interface{}) error {
+	if point, ok := m.(*rpc.Point); ok {
+		ts.l.throttle(ts.p, len(point.Data)+len(point.Offset))
+	}
+	return ts.ServerStream.SendMsg(m)
+}
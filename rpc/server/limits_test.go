@@ -0,0 +1,117 @@
+package rpcserver
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/rpc"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+func TestLimits(t *testing.T) {
+	lim := newLimiter(&Limits{MaxConcurrentStreams: 1}, map[string]*Credential{
+		"limited":   &Credential{Roles: []Role{RoleRead}, Limits: &Limits{MaxConcurrentStreams: 2, MaxQueriesPerSecond: 2}},
+		"unlimited": &Credential{Roles: []Role{RoleRead}},
+	})
+	assert.True(t, lim.limits())
+	interceptor := lim.interceptor()
+	query := &grpc.StreamServerInfo{FullMethod: "/zenodb/query"}
+
+	ctxFor := func(token string, addr string) context.Context {
+		ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(addr), Port: 5000}})
+		if token != "" {
+			ctx = metadata.NewContext(ctx, metadata.MD{rpc.PasswordKey: []string{token}})
+		}
+		return ctx
+	}
+	run := func(ctx context.Context, info *grpc.StreamServerInfo) error {
+		return interceptor(nil, &limitsStream{ctx: ctx}, info, func(srv interface{}, ss grpc.ServerStream) error {
+			return nil
+		})
+	}
+	// hold opens a stream that stays open until the returned function is called
+	hold := func(ctx context.Context) (func(), error) {
+		release := make(chan struct{})
+		admitted := make(chan error, 1)
+		go func() {
+			admitted <- interceptor(nil, &limitsStream{ctx: ctx}, &grpc.StreamServerInfo{FullMethod: "/zenodb/follow"}, func(srv interface{}, ss grpc.ServerStream) error {
+				admitted <- nil
+				<-release
+				return nil
+			})
+		}()
+		err := <-admitted
+		return func() { close(release) }, err
+	}
+
+	limited := ctxFor("limited", "10.0.0.1")
+	assert.NoError(t, run(limited, query))
+	assert.NoError(t, run(limited, query))
+	err := run(limited, query)
+	assert.Equal(t, codes.ResourceExhausted, grpc.Code(err), "queries beyond rate should be rejected")
+	time.Sleep(600 * time.Millisecond)
+	assert.NoError(t, run(limited, query), "rate should have recovered")
+
+	release1, err := hold(limited)
+	assert.NoError(t, err)
+	release2, err := hold(ctxFor("limited", "10.0.0.2"))
+	assert.NoError(t, err, "streams from other connections should count towards the same credential")
+	_, err = hold(limited)
+	assert.Equal(t, codes.ResourceExhausted, grpc.Code(err), "streams beyond limit should be rejected")
+	release1()
+	release2()
+
+	connection := ctxFor("", "10.0.0.3")
+	releaseConnection, err := hold(connection)
+	assert.NoError(t, err)
+	_, err = hold(connection)
+	assert.Equal(t, codes.ResourceExhausted, grpc.Code(err), "default limits should apply per connection")
+	_, err = hold(ctxFor("", "10.0.0.4"))
+	assert.NoError(t, err, "other connections should have their own limits")
+	releaseConnection()
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, run(ctxFor("unlimited", "10.0.0.5"), query), "credential without limits should get default limits, which don't limit queries")
+	}
+}
+
+func TestFollowThrottling(t *testing.T) {
+	lim := newLimiter(&Limits{MaxFollowBytesPerSecond: 1000}, nil)
+	stream := &limitsStream{ctx: context.Background()}
+	start := time.Now()
+	err := lim.interceptor()(nil, stream, &grpc.StreamServerInfo{FullMethod: "/zenodb/follow"}, func(srv interface{}, ss grpc.ServerStream) error {
+		for i := 0; i < 3; i++ {
+			err := ss.SendMsg(&rpc.Point{Data: make([]byte, 500)})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, stream.sent)
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 400*time.Millisecond, "sending 1500 bytes at 1000 bytes per second with a burst of 1000 should take about 500ms, not %v", elapsed)
+}
+
+// limitsStream is a grpc.ServerStream that counts the messages sent on it.
+type limitsStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	sent int
+}
+
+func (s *limitsStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *limitsStream) SendMsg(m interface{}) error {
+	s.sent++
+	return nil
+}
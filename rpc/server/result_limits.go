@@ -0,0 +1,69 @@
+package rpcserver
+
+import (
+	"strconv"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// resultLimits enforces MaxResultRows and MaxResultBytes on the results of a
+// single query. Once the results exceed either limit, all further rows are
+// omitted, but they're still counted so that the client can tell how much it's
+// missing.
+type resultLimits struct {
+	maxRows  int
+	maxBytes int
+	rows     int
+	bytes    int
+	omitted  int64
+}
+
+func (s *server) resultLimits() *resultLimits {
+	return &resultLimits{maxRows: s.maxResultRows, maxBytes: s.maxResultBytes}
+}
+
+// admit indicates whether a row of roughly the given size in bytes may still be
+// sent.
+func (rl *resultLimits) admit(size int) bool {
+	if rl.omitted > 0 ||
+		rl.maxRows > 0 && rl.rows >= rl.maxRows ||
+		rl.maxBytes > 0 && rl.bytes+size > rl.maxBytes {
+		rl.omitted++
+		return false
+	}
+	rl.rows++
+	rl.bytes += size
+	return true
+}
+
+// finish marks the given end of results as truncated if any rows were omitted
+// and reports the same in the stream's trailer, for clients that don't look at
+// the end of results.
+func (rl *resultLimits) finish(stream grpc.ServerStream, rr *rpc.RemoteQueryResult) {
+	if rl.omitted == 0 {
+		return
+	}
+	rr.Truncated = true
+	rr.OmittedRows = rl.omitted
+	stream.SetTrailer(metadata.Pairs(
+		rpc.TruncatedTrailer, "true",
+		rpc.OmittedRowsTrailer, strconv.FormatInt(rl.omitted, 10)))
+}
+
+// flatRowSize estimates the encoded size of a flat row.
+func flatRowSize(row *core.FlatRow) int {
+	return len(row.Key) + 8*len(row.Values) + 8
+}
+
+// unflatRowSize estimates the encoded size of an unflat row.
+func unflatRowSize(key bytemap.ByteMap, vals core.Vals) int {
+	size := len(key)
+	for _, val := range vals {
+		size += len(val)
+	}
+	return size
+}
@@ -0,0 +1,50 @@
+package rpcserver
+
+import (
+	"testing"
+
+	"github.com/getlantern/zenodb/rpc"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestResultLimits(t *testing.T) {
+	rl := (&server{maxResultRows: 3, maxResultBytes: 100}).resultLimits()
+	assert.True(t, rl.admit(40))
+	assert.True(t, rl.admit(40))
+	assert.False(t, rl.admit(40), "row exceeding bytes should be omitted")
+	assert.False(t, rl.admit(10), "rows after the first omitted row should be omitted too")
+	stream := &trailerStream{}
+	rr := &rpc.RemoteQueryResult{EndOfResults: true}
+	rl.finish(stream, rr)
+	assert.True(t, rr.Truncated)
+	assert.EqualValues(t, 2, rr.OmittedRows)
+	assert.Equal(t, []string{"true"}, stream.trailer[rpc.TruncatedTrailer])
+	assert.Equal(t, []string{"2"}, stream.trailer[rpc.OmittedRowsTrailer])
+
+	rl = (&server{maxResultRows: 2}).resultLimits()
+	assert.True(t, rl.admit(1000))
+	assert.True(t, rl.admit(1000))
+	assert.False(t, rl.admit(1), "rows beyond limit should be omitted")
+
+	rl = (&server{}).resultLimits()
+	for i := 0; i < 100; i++ {
+		assert.True(t, rl.admit(1000), "results shouldn't be limited by default")
+	}
+	stream = &trailerStream{}
+	rr = &rpc.RemoteQueryResult{EndOfResults: true}
+	rl.finish(stream, rr)
+	assert.False(t, rr.Truncated)
+	assert.Nil(t, stream.trailer, "complete results shouldn't have trailers")
+}
+
+// trailerStream is a grpc.ServerStream that remembers its trailer.
+type trailerStream struct {
+	grpc.ServerStream
+	trailer metadata.MD
+}
+
+func (s *trailerStream) SetTrailer(md metadata.MD) {
+	s.trailer = md
+}
@@ -1,60 +1,253 @@
 package rpcserver
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"github.com/getlantern/bytemap"
 	"github.com/getlantern/errors"
-	"github.com/getlantern/golog"
 	"github.com/getlantern/wal"
 	"github.com/getlantern/zenodb"
 	"github.com/getlantern/zenodb/common"
 	"github.com/getlantern/zenodb/core"
 	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/logging"
 	"github.com/getlantern/zenodb/planner"
 	"github.com/getlantern/zenodb/rpc"
+	"github.com/getlantern/zenodb/sql"
+	"github.com/getlantern/zenodb/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"net"
+	"strings"
 	"time"
 )
 
+const (
+	// dataChunkSize is roughly how much rendered data to send per message when
+	// a query asks for a Format.
+	dataChunkSize = 64 * 1024
+)
+
 var (
-	log = golog.LoggerFor("zenodb.rpc")
+	log = logging.LoggerFor("zenodb.rpc")
 )
 
 type Opts struct {
 	// Password, if specified, is the password that clients must present in order
 	// to access the server.
 	Password string
+
+	// Credentials, if specified, are the tokens (keyed by token) that clients may
+	// present in place of a password, each granting a specific set of Roles. When
+	// Credentials are specified, inserts also require authorization.
+	Credentials map[string]*Credential
+
+	// TLS, if specified, causes the server to accept only TLS connections. Set
+	// RequireClientCert to authenticate clients by their certificates.
+	TLS *rpc.TLSOpts
+
+	// KeepaliveInterval, if specified, causes the server to ping clients after
+	// this much inactivity in order to detect broken connections. Defaults to 2
+	// hours.
+	KeepaliveInterval time.Duration
+
+	// KeepaliveTimeout is how long to wait for a response to a keepalive ping
+	// before closing the connection. Defaults to 20 seconds.
+	KeepaliveTimeout time.Duration
+
+	// MinClientKeepaliveInterval is the most frequently that clients are allowed
+	// to send keepalive pings. Clients that ping more frequently are
+	// disconnected. Defaults to 5 minutes.
+	MinClientKeepaliveInterval time.Duration
+
+	// MaxRecvMsgSize limits the size of messages received from clients, like
+	// large batches of inserts. Defaults to 4 MB.
+	MaxRecvMsgSize int
+
+	// MaxSendMsgSize, if specified, limits the size of messages sent to clients.
+	// Defaults to unlimited.
+	MaxSendMsgSize int
+
+	// IdleTimeout, if specified, aborts query and insert streams on which no
+	// messages were sent or received for this long. Follow and remote query
+	// streams are long-lived and often idle, so they're not subject to this
+	// timeout and rely on keepalives instead.
+	IdleTimeout time.Duration
+
+	// RemoteQueryPingInterval is how often to ping followers that registered to
+	// handle remote queries while they wait for a query. Defaults to 30 seconds.
+	RemoteQueryPingInterval time.Duration
+
+	// RemoteQueryPingTimeout is how long to wait for a follower to answer a ping
+	// before evicting its query handler, so that no queries get sent to
+	// followers that hung. Defaults to 10 seconds.
+	RemoteQueryPingTimeout time.Duration
+
+	// StreamInterceptors, if specified, intercept every stream, with the first
+	// one being the outermost, see for example rpc.RecoveryStreamInterceptor.
+	// They run within the IdleTimeout.
+	StreamInterceptors []grpc.StreamServerInterceptor
+
+	// UnaryInterceptors, if specified, intercept every unary call, with the
+	// first one being the outermost.
+	UnaryInterceptors []grpc.UnaryServerInterceptor
+
+	// Limits, if specified, are the default Limits for each client. Credentials
+	// can override them with their own Limits.
+	Limits *Limits
+
+	// MaxResultRows, if specified, limits how many rows a single query may
+	// return. Queries with more rows are truncated and report how many rows they
+	// omitted, so that large results can't exhaust the memory of clients.
+	MaxResultRows int
+
+	// MaxResultBytes, if specified, limits roughly how many bytes of rows a
+	// single query may return, truncating queries like MaxResultRows does.
+	MaxResultBytes int
 }
 
 // DB is an interface for database-like things (implemented by common.DB).
 type DB interface {
-	InsertRaw(stream string, ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap) error
+	InsertRawContext(ctx context.Context, stream string, ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap) error
+
+	QueryWithACL(sqlString string, isSubQuery bool, subQueryResults [][]interface{}, includeMemStore bool, acl *planner.ACL) (core.FlatRowSource, error)
+
+	ExpandSavedQuery(sqlString string) (string, error)
+
+	FollowContext(ctx context.Context, f *common.Follow, cb func([]byte, wal.Offset) error) error
+
+	StreamOffset(stream string) (wal.Offset, error)
+
+	RegisterQueryHandlerWithCapabilities(partition int, caps *common.QueryHandlerCapabilities, query planner.QueryClusterFN) error
+
+	PartitionArchived(partition int, archived time.Time)
+
+	ClusterStatus() *common.ClusterStatus
+
+	ForceFlushContext(ctx context.Context, table string) error
+
+	ApplyRetentionContext(ctx context.Context, table string) error
+
+	FlushForwardedInserts() error
+
+	PauseIngestion(table string) error
+
+	ResumeIngestion(table string) error
+
+	DiscardIngestion(table string) error
+
+	DrainContext(ctx context.Context, table string) error
+
+	DumpSchema() ([]byte, error)
+
+	Set(sqlString string) error
+
+	Delete(sqlString string) error
+
+	Exec(script string) error
+
+	RemapKeys(table string, dim string, mapping map[string]string) error
 
-	Query(sqlString string, isSubQuery bool, subQueryResults [][]interface{}, includeMemStore bool) (core.FlatRowSource, error)
+	Cardinality(table string, limit int) (*zenodb.CardinalityReport, error)
 
-	Follow(f *common.Follow, cb func([]byte, wal.Offset) error)
+	LastSeen(table string, olderThan time.Duration) ([]*zenodb.KeyLastSeen, error)
 
-	RegisterQueryHandler(partition int, query planner.QueryClusterFN)
+	Now() time.Time
+
+	RemapStatus(table string) (*zenodb.RemapStatus, error)
+
+	CanonicalizeKeys(table string) error
+
+	MigrateTable(table string, sqlString string) error
+
+	MigrationStatus(table string) (*zenodb.MigrationStatus, error)
+
+	BackfillView(view string, from time.Time, until time.Time) error
+
+	CaptureChanges(ctx context.Context, req *common.CaptureChanges, cb func(*common.ArchivedChunk) error) error
 }
 
 func Serve(db DB, l net.Listener, opts *Opts) error {
-	l = &rpc.SnappyListener{l}
-	gs := grpc.NewServer(grpc.CustomCodec(rpc.Codec))
-	gs.RegisterService(&rpc.ServiceDesc, &server{db, opts.Password})
-	return gs.Serve(l)
+	if opts.TLS != nil {
+		var err error
+		l, err = rpc.TLSListener(l, opts.TLS)
+		if err != nil {
+			return err
+		}
+	}
+	srv := &server{
+		db:             db,
+		password:       opts.Password,
+		credentials:    opts.Credentials,
+		pingInterval:   opts.RemoteQueryPingInterval,
+		pingTimeout:    opts.RemoteQueryPingTimeout,
+		maxResultRows:  opts.MaxResultRows,
+		maxResultBytes: opts.MaxResultBytes,
+	}
+	if srv.pingInterval <= 0 {
+		srv.pingInterval = defaultRemoteQueryPingInterval
+	}
+	if srv.pingTimeout <= 0 {
+		srv.pingTimeout = defaultRemoteQueryPingTimeout
+	}
+	lim := newLimiter(opts.Limits, opts.Credentials)
+	msgpackL, protobufL := rpc.CodecListeners(l)
+
+	pgs := grpc.NewServer(serverOptions(opts, rpc.ProtoCodec, lim)...)
+	pgs.RegisterService(&rpc.ServiceDesc, srv)
+	go pgs.Serve(&rpc.SnappyListener{protobufL})
+
+	gs := grpc.NewServer(serverOptions(opts, rpc.Codec, lim)...)
+	gs.RegisterService(&rpc.ServiceDesc, srv)
+	return gs.Serve(&rpc.SnappyListener{msgpackL})
 }
 
-type server struct {
-	db       DB
-	password string
+func serverOptions(opts *Opts, codec grpc.Codec, lim *limiter) []grpc.ServerOption {
+	serverOpts := []grpc.ServerOption{
+		grpc.CustomCodec(rpc.LimitSendSize(codec, opts.MaxSendMsgSize)),
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    opts.KeepaliveInterval,
+			Timeout: opts.KeepaliveTimeout,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             opts.MinClientKeepaliveInterval,
+			PermitWithoutStream: true,
+		}),
+	}
+	if opts.MaxRecvMsgSize > 0 {
+		serverOpts = append(serverOpts, grpc.MaxMsgSize(opts.MaxRecvMsgSize))
+	}
+	var streamInterceptors []grpc.StreamServerInterceptor
+	if opts.IdleTimeout > 0 {
+		streamInterceptors = append(streamInterceptors, idleTimeoutInterceptor(opts.IdleTimeout))
+	}
+	streamInterceptors = append(streamInterceptors, opts.StreamInterceptors...)
+	if lim.limits() {
+		streamInterceptors = append(streamInterceptors, lim.interceptor())
+	}
+	if len(streamInterceptors) > 0 {
+		serverOpts = append(serverOpts, grpc.StreamInterceptor(rpc.ChainStreamInterceptors(streamInterceptors...)))
+	}
+	if len(opts.UnaryInterceptors) > 0 {
+		serverOpts = append(serverOpts, grpc.UnaryInterceptor(rpc.ChainUnaryInterceptors(opts.UnaryInterceptors...)))
+	}
+	return serverOpts
 }
 
-func (s *server) Insert(stream grpc.ServerStream) error {
-	// No need to authorize, anyone can insert
+type server struct {
+	db             DB
+	password       string
+	credentials    map[string]*Credential
+	pingInterval   time.Duration
+	pingTimeout    time.Duration
+	maxResultRows  int
+	maxResultBytes int
+}
 
+func (s *server) Insert(stream grpc.ServerStream) (finalErr error) {
 	now := time.Now()
 	streamName := ""
 
@@ -62,6 +255,14 @@ func (s *server) Insert(stream grpc.ServerStream) error {
 		Errors: make(map[int]string),
 	}
 
+	_, span := trace.Start(tracedContext(stream), "insert")
+	defer func() {
+		span.SetAttribute("stream", streamName)
+		span.SetAttribute("received", report.Received)
+		span.SetAttribute("succeeded", report.Succeeded)
+		span.Finish(finalErr)
+	}()
+
 	i := -1
 	for {
 		i++
@@ -72,6 +273,13 @@ func (s *server) Insert(stream grpc.ServerStream) error {
 		}
 		if insert.EndOfInserts {
 			// We're done inserting
+			if insert.AckOffset && streamName != "" {
+				offset, offsetErr := s.db.StreamOffset(streamName)
+				if offsetErr != nil {
+					return fmt.Errorf("Unable to determine offset of inserts: %v", offsetErr)
+				}
+				report.Offset = offset
+			}
 			return stream.SendMsg(report)
 		}
 		report.Received++
@@ -81,6 +289,10 @@ func (s *server) Insert(stream grpc.ServerStream) error {
 			if streamName == "" {
 				return fmt.Errorf("Please specify a stream")
 			}
+			authorizeErr := s.authorize(stream, RoleInsert, streamName)
+			if authorizeErr != nil {
+				return authorizeErr
+			}
 		}
 
 		if len(insert.Dims) == 0 {
@@ -99,7 +311,7 @@ func (s *server) Insert(stream grpc.ServerStream) error {
 		}
 
 		// TODO: make sure we don't barf on invalid bytemaps here
-		insertErr := s.db.InsertRaw(streamName, ts, bytemap.ByteMap(insert.Dims), bytemap.ByteMap(insert.Vals))
+		insertErr := s.db.InsertRawContext(stream.Context(), streamName, ts, bytemap.ByteMap(insert.Dims), bytemap.ByteMap(insert.Vals))
 		if insertErr != nil {
 			report.Errors[i] = fmt.Sprintf("Unable to insert: %v", insertErr)
 			continue
@@ -108,23 +320,74 @@ func (s *server) Insert(stream grpc.ServerStream) error {
 	}
 }
 
-func (s *server) Query(q *rpc.Query, stream grpc.ServerStream) error {
-	authorizeErr := s.authorize(stream)
+func (s *server) Query(q *rpc.Query, stream grpc.ServerStream) (finalErr error) {
+	ctx, span := trace.Start(tracedContext(stream), "query", "sql", q.SQLString)
+	defer func() {
+		span.Finish(finalErr)
+		rpc.SetErrorTrailer(stream, finalErr)
+		finalErr = rpc.StatusFor(finalErr)
+	}()
+
+	if sql.IsScript(q.SQLString) {
+		return s.exec(q, stream)
+	}
+	if sql.IsSet(q.SQLString) {
+		return s.set(q, stream)
+	}
+	if sql.IsDelete(q.SQLString) {
+		return s.delete(q, stream)
+	}
+	if sql.IsShowCardinality(q.SQLString) {
+		return s.showCardinality(q, stream)
+	}
+	if sql.IsShowLastSeen(q.SQLString) {
+		return s.showLastSeen(q, stream)
+	}
+
+	// Authenticate before parsing anything that the client sent
+	credential, authenticateErr := s.authenticate(stream, RoleRead)
+	if authenticateErr != nil {
+		return authenticateErr
+	}
+	// Expand saved queries first so that authorization sees the tables they
+	// actually read
+	expanded, expandErr := s.db.ExpandSavedQuery(q.SQLString)
+	if expandErr != nil {
+		return expandErr
+	}
+	q.SQLString = expanded
+	tables, parseErr := tablesFor(q.SQLString)
+	if parseErr != nil {
+		return parseErr
+	}
+	authorizeErr := credential.authorizeTables(tables...)
 	if authorizeErr != nil {
 		return authorizeErr
 	}
 
-	source, err := s.db.Query(q.SQLString, q.IsSubQuery, q.SubQueryResults, q.IncludeMemStore)
+	source, err := s.db.QueryWithACL(q.SQLString, q.IsSubQuery, q.SubQueryResults, q.IncludeMemStore, credential.acl())
 	if err != nil {
 		return err
 	}
+	stats := common.NewQueryStats()
+	ctx = common.WithQueryStats(ctx, stats)
+	if q.Format != "" {
+		return s.queryDelimited(ctx, q, source, stream, stats)
+	}
+	if q.Unflat {
+		return s.queryUnflat(ctx, source, stream, stats)
+	}
 
 	rr := &rpc.RemoteQueryResult{}
-	err = source.Iterate(stream.Context(), func(fields core.Fields) error {
+	limits := s.resultLimits()
+	err = source.Iterate(ctx, func(fields core.Fields) error {
 		// Send query metadata
 		md := zenodb.MetaDataFor(source, fields)
 		return stream.SendMsg(md)
 	}, func(row *core.FlatRow) (bool, error) {
+		if !limits.admit(flatRowSize(row)) {
+			return true, nil
+		}
 		rr.Row = row
 		return true, stream.SendMsg(rr)
 	})
@@ -135,27 +398,401 @@ func (s *server) Query(q *rpc.Query, stream grpc.ServerStream) error {
 	// Send end of results
 	rr.Row = nil
 	rr.EndOfResults = true
+	rr.Stats = stats.Tables()
+	limits.finish(stream, rr)
+	return stream.SendMsg(rr)
+}
+
+// queryUnflat streams the results of the given source before they're
+// flattened, preceded by the fields with which to merge them, so that clients
+// can merge the results of several servers.
+func (s *server) queryUnflat(ctx context.Context, source core.FlatRowSource, stream grpc.ServerStream, stats *common.QueryStats) error {
+	rr := &rpc.RemoteQueryResult{}
+	limits := s.resultLimits()
+	err := core.UnflattenOptimized(source).Iterate(ctx, func(fields core.Fields) error {
+		err := stream.SendMsg(zenodb.MetaDataFor(source, fields))
+		if err != nil {
+			return err
+		}
+		return stream.SendMsg(&rpc.RemoteQueryResult{Fields: fields})
+	}, func(key bytemap.ByteMap, vals core.Vals) (bool, error) {
+		if !limits.admit(unflatRowSize(key, vals)) {
+			return true, nil
+		}
+		rr.Key = key
+		rr.Vals = vals
+		return true, stream.SendMsg(rr)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Send end of results
+	rr.Key = nil
+	rr.Vals = nil
+	rr.EndOfResults = true
+	rr.Stats = stats.Tables()
+	limits.finish(stream, rr)
+	return stream.SendMsg(rr)
+}
+
+// queryDelimited renders the results of the given source in the query's Format
+// and streams them in chunks of roughly dataChunkSize as Data.
+func (s *server) queryDelimited(ctx context.Context, q *rpc.Query, source core.FlatRowSource, stream grpc.ServerStream, stats *common.QueryStats) error {
+	if !common.IsDelimitedFormat(q.Format) {
+		return fmt.Errorf("Unknown format %v, expected %v or %v", q.Format, common.FormatCSV, common.FormatTSV)
+	}
+
+	rr := &rpc.RemoteQueryResult{}
+	limits := s.resultLimits()
+	buf := &bytes.Buffer{}
+	sendData := func() error {
+		if buf.Len() == 0 {
+			return nil
+		}
+		rr.Data = buf.Bytes()
+		err := stream.SendMsg(rr)
+		buf.Reset()
+		return err
+	}
+
+	var dw *common.DelimitedWriter
+	err := source.Iterate(ctx, func(fields core.Fields) error {
+		var writerErr error
+		dw, writerErr = common.NewDelimitedWriter(buf, q.Format, fields.Names(), core.GroupByNames(source.GetGroupBy()), !q.OmitHeader)
+		if writerErr != nil {
+			return writerErr
+		}
+		return stream.SendMsg(zenodb.MetaDataFor(source, fields))
+	}, func(row *core.FlatRow) (bool, error) {
+		if !limits.admit(flatRowSize(row)) {
+			return true, nil
+		}
+		writeErr := dw.WriteRow(row.TS, row.Key, row.Values)
+		if writeErr != nil {
+			return false, writeErr
+		}
+		if buf.Len() >= dataChunkSize {
+			return true, sendData()
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	if dw != nil {
+		err = dw.Close()
+		if err != nil {
+			return err
+		}
+		err = sendData()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Send end of results
+	rr.Data = nil
+	rr.EndOfResults = true
+	rr.Stats = stats.Tables()
+	limits.finish(stream, rr)
+	return stream.SendMsg(rr)
+}
+
+// set applies a SET statement, which requires the admin role, and responds as
+// though it were a query that returned no rows.
+func (s *server) set(q *rpc.Query, stream grpc.ServerStream) error {
+	authorizeErr := s.authorize(stream, RoleAdmin)
+	if authorizeErr != nil {
+		return authorizeErr
+	}
+
+	log.Debugf("Applying %v", q.SQLString)
+	err := s.db.Set(q.SQLString)
+	if err != nil {
+		return err
+	}
+	return sendNoRows(stream)
+}
+
+// delete applies a DELETE statement, which requires the admin role for the
+// table, and responds as though it were a query that returned no rows.
+func (s *server) delete(q *rpc.Query, stream grpc.ServerStream) error {
+	credential, authenticateErr := s.authenticate(stream, RoleAdmin)
+	if authenticateErr != nil {
+		return authenticateErr
+	}
+	d, parseErr := sql.ParseDelete(q.SQLString)
+	if parseErr != nil {
+		return parseErr
+	}
+	authorizeErr := credential.authorizeTables(d.Table)
+	if authorizeErr != nil {
+		return authorizeErr
+	}
+
+	log.Debugf("Applying %v", q.SQLString)
+	err := s.db.Delete(q.SQLString)
+	if err != nil {
+		return err
+	}
+	return sendNoRows(stream)
+}
+
+// exec applies a script of SET and DELETE statements, which requires the admin
+// role for every table that the script deletes from, and responds as though it
+// were a query that returned no rows.
+func (s *server) exec(q *rpc.Query, stream grpc.ServerStream) error {
+	credential, authenticateErr := s.authenticate(stream, RoleAdmin)
+	if authenticateErr != nil {
+		return authenticateErr
+	}
+	statements, parseErr := sql.ParseScript(q.SQLString)
+	if parseErr != nil {
+		return parseErr
+	}
+	var tables []string
+	for _, statement := range statements {
+		if sql.IsDelete(statement) {
+			d, deleteErr := sql.ParseDelete(statement)
+			if deleteErr != nil {
+				return deleteErr
+			}
+			tables = append(tables, d.Table)
+		}
+	}
+	authorizeErr := credential.authorizeTables(tables...)
+	if authorizeErr != nil {
+		return authorizeErr
+	}
+
+	log.Debugf("Executing %v", q.SQLString)
+	err := s.db.Exec(q.SQLString)
+	if err != nil {
+		return err
+	}
+	return sendNoRows(stream)
+}
+
+// showLastSeen answers a SHOW LAST SEEN statement, which requires the read role
+// for the table and isn't allowed for credentials restricted by dims or filter.
+// Each key is returned as a row stamped with the period in which it was last
+// seen, with the number of seconds since then as its only value.
+func (s *server) showLastSeen(q *rpc.Query, stream grpc.ServerStream) error {
+	credential, authenticateErr := s.authenticate(stream, RoleRead)
+	if authenticateErr != nil {
+		return authenticateErr
+	}
+	sls, parseErr := sql.ParseShowLastSeen(q.SQLString)
+	if parseErr != nil {
+		return parseErr
+	}
+	authorizeErr := credential.authorizeTables(sls.Table)
+	if authorizeErr != nil {
+		return authorizeErr
+	}
+	if credential.restrictsRows() {
+		// The returned keys include all of their dims and aren't filtered
+		return log.Errorf("Token is restricted to certain dimensions or rows, not allowed to SHOW LAST SEEN")
+	}
+
+	keys, err := s.db.LastSeen(sls.Table, sls.OlderThan)
+	if err != nil {
+		return err
+	}
+	err = stream.SendMsg(&common.QueryMetaData{
+		FieldNames:    []string{"age"},
+		FieldMetadata: map[string]*common.FieldMetadata{"age": {Unit: common.UnitSeconds}},
+	})
+	if err != nil {
+		return err
+	}
+	// Use the database's clock, which is what OlderThan is relative to
+	now := s.db.Now()
+	rr := &rpc.RemoteQueryResult{}
+	for _, key := range keys {
+		age := now.Sub(key.LastSeen)
+		if age < 0 {
+			// the current period is stamped with when it ends
+			age = 0
+		}
+		rr.Row = &core.FlatRow{
+			TS:     key.LastSeen.UnixNano(),
+			Key:    key.Key,
+			Values: []float64{age.Seconds()},
+		}
+		err = stream.SendMsg(rr)
+		if err != nil {
+			return err
+		}
+	}
+	rr.Row = nil
+	rr.EndOfResults = true
+	return stream.SendMsg(rr)
+}
+
+// showCardinality answers a SHOW CARDINALITY statement, which requires the read
+// role for the table and isn't allowed for credentials restricted by dims or
+// filter. Each dimension is returned as a row keyed by dim, followed by a row
+// keyed by dim and value for each of its top values.
+func (s *server) showCardinality(q *rpc.Query, stream grpc.ServerStream) error {
+	credential, authenticateErr := s.authenticate(stream, RoleRead)
+	if authenticateErr != nil {
+		return authenticateErr
+	}
+	sc, parseErr := sql.ParseShowCardinality(q.SQLString)
+	if parseErr != nil {
+		return parseErr
+	}
+	authorizeErr := credential.authorizeTables(sc.Table)
+	if authorizeErr != nil {
+		return authorizeErr
+	}
+	if credential.restrictsRows() {
+		// The report covers every key in the table, so it would reveal dimensions
+		// and rows that the credential's ACL hides
+		return log.Errorf("Token is restricted to certain dimensions or rows, not allowed to SHOW CARDINALITY")
+	}
+
+	report, err := s.db.Cardinality(sc.Table, sc.Limit)
+	if err != nil {
+		return err
+	}
+	err = stream.SendMsg(&common.QueryMetaData{FieldNames: []string{"values", "keys", "bytes"}})
+	if err != nil {
+		return err
+	}
+	ts := time.Now().UnixNano()
+	rr := &rpc.RemoteQueryResult{}
+	for _, d := range report.Dims {
+		rr.Row = &core.FlatRow{
+			TS:     ts,
+			Key:    bytemap.New(map[string]interface{}{"dim": d.Dim}),
+			Values: []float64{float64(d.Values), float64(d.Keys), float64(d.Bytes)},
+		}
+		err = stream.SendMsg(rr)
+		if err != nil {
+			return err
+		}
+		for _, v := range d.Top {
+			rr.Row = &core.FlatRow{
+				TS:     ts,
+				Key:    bytemap.New(map[string]interface{}{"dim": d.Dim, "value": v.Value}),
+				Values: []float64{1, float64(v.Keys), float64(v.Bytes)},
+			}
+			err = stream.SendMsg(rr)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	rr.Row = nil
+	rr.EndOfResults = true
 	return stream.SendMsg(rr)
 }
 
+// remapArgs parses the args of a remap operation, which are the dimension to
+// remap followed by mappings like old=new.
+func remapArgs(args []string) (string, map[string]string, error) {
+	if len(args) < 2 {
+		return "", nil, fmt.Errorf("Remap requires a dimension and at least one mapping like old=new")
+	}
+	mapping := make(map[string]string, len(args)-1)
+	for _, arg := range args[1:] {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return "", nil, fmt.Errorf("Invalid mapping %v, expected old=new", arg)
+		}
+		mapping[parts[0]] = parts[1]
+	}
+	return args[0], mapping, nil
+}
+
+func backfillArgs(args []string) (time.Time, time.Time, error) {
+	if len(args) != 2 {
+		return time.Time{}, time.Time{}, fmt.Errorf("Backfill requires the start and end of the time range to recompute")
+	}
+	from, err := time.Parse(time.RFC3339, args[0])
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("Invalid start %v, expected a time like 2006-01-02T15:04:05Z: %v", args[0], err)
+	}
+	until, err := time.Parse(time.RFC3339, args[1])
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("Invalid end %v, expected a time like 2006-01-02T15:04:05Z: %v", args[1], err)
+	}
+	return from, until, nil
+}
+
+func sendNoRows(stream grpc.ServerStream) error {
+	err := stream.SendMsg(&common.QueryMetaData{})
+	if err != nil {
+		return err
+	}
+	return stream.SendMsg(&rpc.RemoteQueryResult{EndOfResults: true})
+}
+
 func (s *server) Follow(f *common.Follow, stream grpc.ServerStream) error {
-	authorizeErr := s.authorize(stream)
+	authorizeErr := s.authorize(stream, RoleFollow, f.Stream)
 	if authorizeErr != nil {
 		return authorizeErr
 	}
 
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		f.Addr = p.Addr.String()
+	}
 	log.Debugf("Follower %d joined", f.PartitionNumber)
 	defer log.Debugf("Follower %d left", f.PartitionNumber)
-	s.db.Follow(f, func(data []byte, newOffset wal.Offset) error {
+	err := s.db.FollowContext(stream.Context(), f, func(data []byte, newOffset wal.Offset) error {
 		return stream.SendMsg(&rpc.Point{data, newOffset})
 	})
-	return nil
+	if _, resyncRequired := err.(*zenodb.ResyncRequiredError); resyncRequired {
+		return grpc.Errorf(rpc.CodeResyncRequired, "%v", err)
+	}
+	if _, placementRejected := err.(*zenodb.PlacementError); placementRejected {
+		return grpc.Errorf(rpc.CodePlacementRejected, "%v", err)
+	}
+	return err
+}
+
+// CaptureChanges streams archived chunks, which requires the follow role. If
+// the credential is restricted to certain tables and none were requested, the
+// stream is limited to those tables.
+func (s *server) CaptureChanges(req *common.CaptureChanges, stream grpc.ServerStream) error {
+	credential, authorizeErr := s.authorizeCredential(stream, RoleFollow, req.Tables...)
+	if authorizeErr != nil {
+		return authorizeErr
+	}
+	if len(req.Tables) == 0 && credential != nil {
+		req.Tables = credential.Tables
+	}
+
+	log.Debugf("Change capture of %v started", req.Tables)
+	defer log.Debugf("Change capture of %v stopped", req.Tables)
+	err := s.db.CaptureChanges(stream.Context(), req, func(chunk *common.ArchivedChunk) error {
+		return stream.SendMsg(chunk)
+	})
+	if err == zenodb.ErrChangesFellBehind {
+		return grpc.Errorf(rpc.CodeResyncRequired, "%v", err)
+	}
+	return err
 }
 
 func (s *server) HandleRemoteQueries(r *rpc.RegisterQueryHandler, stream grpc.ServerStream) error {
+	credential, authorizeErr := s.authorizeCredential(stream, RoleFollow)
+	if authorizeErr != nil {
+		return authorizeErr
+	}
+	caps, restrictErr := restrictCapabilities(r.Capabilities, credential)
+	if restrictErr != nil {
+		return log.Errorf("Unable to register query handler: %v", restrictErr)
+	}
+
 	initialResultCh := make(chan *rpc.RemoteQueryResult)
 	initialErrCh := make(chan error)
-	finalErrCh := make(chan error)
+	finalErrCh := make(chan error, 1)
+	idleErrCh := make(chan error, 1)
+	pongs := make(chan struct{}, 1)
+	hb := &heartbeat{}
 
 	finish := func(err error) {
 		select {
@@ -166,7 +803,10 @@ func (s *server) HandleRemoteQueries(r *rpc.RegisterQueryHandler, stream grpc.Se
 		}
 	}
 
-	s.db.RegisterQueryHandler(r.Partition, func(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) error {
+	registerErr := s.db.RegisterQueryHandlerWithCapabilities(r.Partition, caps, func(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) error {
+		if !hb.claim() {
+			return errors.New("Query handler for partition %d was evicted", r.Partition)
+		}
 		q := &rpc.Query{
 			SQLString:       sqlString,
 			IsSubQuery:      isSubQuery,
@@ -175,6 +815,7 @@ func (s *server) HandleRemoteQueries(r *rpc.RegisterQueryHandler, stream grpc.Se
 			IncludeMemStore: common.ShouldIncludeMemStore(ctx),
 		}
 		q.Deadline, q.HasDeadline = ctx.Deadline()
+		q.TraceParent = trace.TraceParent(ctx)
 		sendErr := stream.SendMsg(q)
 
 		m, recvErr := <-initialResultCh, <-initialErrCh
@@ -206,6 +847,9 @@ func (s *server) HandleRemoteQueries(r *rpc.RegisterQueryHandler, stream grpc.Se
 			} else {
 				// Subsequent messages contain data
 				if m.EndOfResults {
+					if stats := common.QueryStatsFrom(ctx); stats != nil {
+						stats.Add(m.Stats...)
+					}
 					break
 				}
 				var more bool
@@ -229,35 +873,187 @@ func (s *server) HandleRemoteQueries(r *rpc.RegisterQueryHandler, stream grpc.Se
 		finish(finalErr)
 		return finalErr
 	})
+	if registerErr != nil {
+		return log.Errorf("Unable to register query handler: %v", registerErr)
+	}
+
+	// Read pongs until a query claims the handler, after which the next message
+	// is the query's initial result
+	go func() {
+		for {
+			m := &rpc.RemoteQueryResult{}
+			err := stream.RecvMsg(m)
+			if err == nil && m.Pong {
+				if !m.Archived.IsZero() {
+					s.db.PartitionArchived(r.Partition, m.Archived)
+				}
+				select {
+				case pongs <- struct{}{}:
+				default:
+				}
+				continue
+			}
+			if hb.evict() {
+				if err == nil {
+					err = errors.New("Unexpected result from idle query handler")
+				}
+				idleErrCh <- err
+				return
+			}
+			initialResultCh <- m
+			initialErrCh <- err
+			return
+		}
+	}()
 
-	// Block on reading initial result to keep connection open
-	m := &rpc.RemoteQueryResult{}
-	err := stream.RecvMsg(m)
-	initialResultCh <- m
-	initialErrCh <- err
+	// Ping the handler while it's idle and wait for the final error of its query
+	// so we don't close the connection prematurely
+	ticker := time.NewTicker(s.pingInterval)
+	defer ticker.Stop()
+	var pongTimeout <-chan time.Time
+	for {
+		select {
+		case err := <-finalErrCh:
+			return err
+		case err := <-idleErrCh:
+			return err
+		case <-pongs:
+			pongTimeout = nil
+		case <-pongTimeout:
+			pongTimeout = nil
+			if hb.evict() {
+				return log.Errorf("Evicting query handler for partition %d that didn't answer ping within %v", r.Partition, s.pingTimeout)
+			}
+		case <-ticker.C:
+			if pongTimeout != nil {
+				// Still waiting for pong
+				continue
+			}
+			pinged, err := hb.ping(stream)
+			if err != nil && hb.evict() {
+				return log.Errorf("Evicting query handler for partition %d that couldn't be pinged: %v", r.Partition, err)
+			}
+			if pinged {
+				pongTimeout = time.After(s.pingTimeout)
+			}
+		}
+	}
+}
 
-	if err == nil {
-		// Wait for final error so we don't close the connection prematurely
-		return <-finalErrCh
+// tracedContext returns the stream's context, continuing any trace that the
+// client propagated in its metadata.
+func tracedContext(stream grpc.ServerStream) context.Context {
+	ctx := stream.Context()
+	md, ok := metadata.FromContext(ctx)
+	if ok && len(md[trace.TraceParentKey]) > 0 {
+		return trace.WithTraceParent(ctx, md[trace.TraceParentKey][0])
 	}
-	return err
+	return ctx
+}
+
+func (s *server) ClusterStatus(r *rpc.ClusterStatusRequest, stream grpc.ServerStream) error {
+	authorizeErr := s.authorize(stream, RoleRead)
+	if authorizeErr != nil {
+		return authorizeErr
+	}
+
+	return stream.SendMsg(s.db.ClusterStatus())
 }
 
-func (s *server) authorize(stream grpc.ServerStream) error {
-	if s.password == "" {
-		log.Debug("No password specified, allowing access to world")
-		return nil
+func (s *server) Admin(r *rpc.AdminRequest, stream grpc.ServerStream) error {
+	var tables []string
+	if r.Table != "" {
+		tables = append(tables, r.Table)
 	}
-	md, ok := metadata.FromContext(stream.Context())
-	if !ok {
-		return log.Error("No metadata provided, unable to authenticate")
+	authorizeErr := s.authorize(stream, RoleAdmin, tables...)
+	if authorizeErr != nil {
+		return authorizeErr
 	}
-	passwords := md[rpc.PasswordKey]
-	for _, password := range passwords {
-		if password == s.password {
-			// authorized
-			return nil
+
+	requireTable := func(op func(table string) error) error {
+		if r.Table == "" {
+			return fmt.Errorf("Operation %v requires a table", r.Op)
 		}
+		return op(r.Table)
+	}
+
+	log.Debugf("Performing admin operation %v on '%v'", r.Op, r.Table)
+	result := "ok"
+	var err error
+	switch r.Op {
+	case rpc.AdminFlush:
+		err = requireTable(func(table string) error {
+			return s.db.ForceFlushContext(stream.Context(), table)
+		})
+	case rpc.AdminRetention:
+		err = requireTable(func(table string) error {
+			return s.db.ApplyRetentionContext(stream.Context(), table)
+		})
+	case rpc.AdminFlushForwarded:
+		err = s.db.FlushForwardedInserts()
+	case rpc.AdminPause:
+		err = requireTable(s.db.PauseIngestion)
+	case rpc.AdminResume:
+		err = requireTable(s.db.ResumeIngestion)
+	case rpc.AdminDiscard:
+		err = requireTable(s.db.DiscardIngestion)
+	case rpc.AdminDrain:
+		err = requireTable(func(table string) error {
+			return s.db.DrainContext(stream.Context(), table)
+		})
+	case rpc.AdminSchema:
+		var schema []byte
+		schema, err = s.db.DumpSchema()
+		result = string(schema)
+	case rpc.AdminRemap:
+		err = requireTable(func(table string) error {
+			dim, mapping, parseErr := remapArgs(r.Args)
+			if parseErr != nil {
+				return parseErr
+			}
+			return s.db.RemapKeys(table, dim, mapping)
+		})
+	case rpc.AdminRemapStatus:
+		err = requireTable(func(table string) error {
+			status, statusErr := s.db.RemapStatus(table)
+			if statusErr == nil {
+				result = status.String()
+			}
+			return statusErr
+		})
+	case rpc.AdminCanonicalize:
+		err = requireTable(s.db.CanonicalizeKeys)
+	case rpc.AdminMigrate:
+		err = requireTable(func(table string) error {
+			sqlString := strings.TrimSpace(strings.Join(r.Args, " "))
+			if sqlString == "" {
+				return fmt.Errorf("Migrate requires the table's new SQL")
+			}
+			return s.db.MigrateTable(table, sqlString)
+		})
+	case rpc.AdminBackfill:
+		err = requireTable(func(view string) error {
+			from, until, parseErr := backfillArgs(r.Args)
+			if parseErr != nil {
+				return parseErr
+			}
+			return s.db.BackfillView(view, from, until)
+		})
+	case rpc.AdminMigrateStatus:
+		err = requireTable(func(table string) error {
+			status, statusErr := s.db.MigrationStatus(table)
+			if statusErr == nil {
+				result = status.String()
+			}
+			return statusErr
+		})
+	default:
+		err = fmt.Errorf("Unknown admin operation %v", r.Op)
+	}
+	if err != nil {
+		log.Errorf("Unable to perform admin operation %v: %v", r.Op, err)
+		return rpc.StatusFor(common.Errorf(common.KindOf(err), "Unable to perform admin operation %v: %v", r.Op, err))
 	}
-	return log.Error("None of the provided passwords matched, not authorized!")
+
+	return stream.SendMsg(&rpc.AdminResponse{Result: result})
 }
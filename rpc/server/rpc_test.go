@@ -2,21 +2,33 @@ package rpcserver
 
 import (
 	"context"
+	"fmt"
 	"net"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/getlantern/bytemap"
 	"github.com/getlantern/wal"
+	"github.com/getlantern/zenodb"
 	"github.com/getlantern/zenodb/common"
 	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
 	"github.com/getlantern/zenodb/planner"
 	"github.com/getlantern/zenodb/rpc"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestInsert(t *testing.T) {
+	doTestInsert(t, false)
+}
+
+func TestInsertProtobuf(t *testing.T) {
+	doTestInsert(t, true)
+}
+
+func doTestInsert(t *testing.T, protobuf bool) {
 	l, err := net.Listen("tcp", ":0")
 	if !assert.NoError(t, err) {
 		return
@@ -33,6 +45,7 @@ func TestInsert(t *testing.T) {
 
 	client, err := rpc.Dial(l.Addr().String(), &rpc.ClientOpts{
 		Password: "password",
+		Protobuf: protobuf,
 		Dialer: func(addr string, timeout time.Duration) (net.Conn, error) {
 			return net.DialTimeout("tcp", addr, timeout)
 		},
@@ -66,6 +79,7 @@ func TestInsert(t *testing.T) {
 	if !assert.NoError(t, err) {
 		return
 	}
+	assert.Nil(t, report.Offset, "Offset should only be reported when requested")
 
 	assert.Equal(t, 10, report.Received)
 	assert.Equal(t, 2, report.Succeeded)
@@ -77,28 +91,459 @@ func TestInsert(t *testing.T) {
 			assert.Equal(t, "Need at least one val", report.Errors[i])
 		}
 	}
+
+	inserter, err = client.NewInserter(context.Background(), "thestream")
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = inserter.Insert(time.Time{}, map[string]interface{}{"dim": "dimval"}, func(cb func(key string, value interface{})) {
+		cb("val", 1)
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	report, err = inserter.CloseWithOffset()
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, report.Succeeded)
+		assert.Equal(t, wal.Offset("offset of thestream"), report.Offset)
+	}
+}
+
+func TestClusterStatus(t *testing.T) {
+	doTestClusterStatus(t, false)
+}
+
+func TestClusterStatusProtobuf(t *testing.T) {
+	doTestClusterStatus(t, true)
+}
+
+func doTestClusterStatus(t *testing.T, protobuf bool) {
+	l, err := net.Listen("tcp", ":0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	db := &mockDB{}
+	go Serve(db, l, &Opts{
+		Password: "password",
+	})
+	time.Sleep(1 * time.Second)
+
+	client, err := rpc.Dial(l.Addr().String(), &rpc.ClientOpts{
+		Password: "password",
+		Protobuf: protobuf,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	status, err := client.ClusterStatus(context.Background())
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, f := range status.Followers {
+		// Times decode in the local time zone
+		f.Joined = f.Joined.In(time.UTC)
+	}
+	assert.Equal(t, db.ClusterStatus(), status)
+}
+
+func TestCaptureChanges(t *testing.T) {
+	doTestCaptureChanges(t, false)
+}
+
+func TestCaptureChangesProtobuf(t *testing.T) {
+	doTestCaptureChanges(t, true)
+}
+
+func doTestCaptureChanges(t *testing.T, protobuf bool) {
+	l, err := net.Listen("tcp", ":0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	db := &mockDB{}
+	go Serve(db, l, &Opts{
+		Password: "password",
+	})
+	time.Sleep(1 * time.Second)
+
+	client, err := rpc.Dial(l.Addr().String(), &rpc.ClientOpts{
+		Password: "password",
+		Protobuf: protobuf,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	tables := []string{"a", "b"}
+	next, err := client.CaptureChanges(context.Background(), &common.CaptureChanges{Tables: tables})
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, expected := range mockChunks(tables) {
+		chunk, nextErr := next()
+		if !assert.NoError(t, nextErr) {
+			return
+		}
+		// Times decode in the local time zone
+		chunk.ArchivedAt = chunk.ArchivedAt.In(time.UTC)
+		assert.Equal(t, expected, chunk)
+	}
+	_, err = next()
+	assert.True(t, rpc.IsResyncRequired(err), "falling behind should require a resync")
+}
+
+func TestAdmin(t *testing.T) {
+	doTestAdmin(t, false)
+}
+
+func TestAdminProtobuf(t *testing.T) {
+	doTestAdmin(t, true)
+}
+
+func doTestAdmin(t *testing.T, protobuf bool) {
+	l, err := net.Listen("tcp", ":0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	db := &mockDB{}
+	go Serve(db, l, &Opts{
+		Credentials: map[string]*Credential{
+			"reader": &Credential{Roles: []Role{RoleRead}},
+			"admin":  &Credential{Roles: []Role{RoleAdmin}},
+		},
+	})
+	time.Sleep(1 * time.Second)
+
+	dial := func(password string) rpc.Client {
+		client, dialErr := rpc.Dial(l.Addr().String(), &rpc.ClientOpts{
+			Password: password,
+			Protobuf: protobuf,
+		})
+		if !assert.NoError(t, dialErr) {
+			t.FailNow()
+		}
+		return client
+	}
+
+	reader := dial("reader")
+	defer reader.Close()
+	_, err = reader.Admin(context.Background(), rpc.AdminFlush, "thetable")
+	assert.Error(t, err, "Admin operations should require admin role")
+
+	client := dial("admin")
+	defer client.Close()
+	for _, op := range []string{rpc.AdminFlush, rpc.AdminRetention, rpc.AdminPause, rpc.AdminResume, rpc.AdminDiscard, rpc.AdminDrain, rpc.AdminCanonicalize} {
+		result, opErr := client.Admin(context.Background(), op, "thetable")
+		if assert.NoError(t, opErr, op) {
+			assert.Equal(t, "ok", result)
+		}
+	}
+	_, err = client.Admin(context.Background(), rpc.AdminFlushForwarded, "")
+	assert.NoError(t, err)
+	_, err = client.Admin(context.Background(), rpc.AdminFlush, "")
+	assert.Error(t, err, "Flush should require a table")
+	_, err = client.Admin(context.Background(), "unknown", "thetable")
+	assert.Error(t, err, "Unknown operation should fail")
+	schema, err := client.Admin(context.Background(), rpc.AdminSchema, "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "thetable:\n  sql: SELECT * FROM thestream\n", schema)
+	}
+	_, err = client.AdminWithArgs(context.Background(), rpc.AdminRemap, "thetable", []string{"host", "a=b", "c=b"})
+	assert.NoError(t, err)
+	_, err = client.AdminWithArgs(context.Background(), rpc.AdminRemap, "thetable", []string{"host", "a"})
+	assert.Error(t, err, "Remap should require mappings like old=new")
+	status, err := client.Admin(context.Background(), rpc.AdminRemapStatus, "thetable")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "remap of host on thetable running: scanned 5 of about 10 keys, remapped 1", status)
+	}
+	_, err = client.AdminWithArgs(context.Background(), rpc.AdminMigrate, "thetable", []string{"SELECT", "SUM(a)", "AS", "a", "FROM", "thestream"})
+	assert.NoError(t, err)
+	_, err = client.Admin(context.Background(), rpc.AdminMigrate, "thetable")
+	assert.Error(t, err, "Migrate should require SQL")
+	_, err = client.AdminWithArgs(context.Background(), rpc.AdminBackfill, "thetable", []string{"2015-01-01T00:00:00Z", "2015-01-02T00:00:00Z"})
+	assert.NoError(t, err)
+	_, err = client.AdminWithArgs(context.Background(), rpc.AdminBackfill, "thetable", []string{"-1h", "2015-01-02T00:00:00Z"})
+	assert.Error(t, err, "Backfill should require RFC3339 times")
+	status, err = client.Admin(context.Background(), rpc.AdminMigrateStatus, "thetable")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "migration of thetable via _migrate_thetable_1 backfilling: backfilled 3 rows", status)
+	}
+
+	unknown := dial("unknown")
+	defer unknown.Close()
+	_, _, err = unknown.Query(context.Background(), "SELECT * FROM", false)
+	if assert.Error(t, err, "unauthenticated query should be rejected") {
+		assert.Contains(t, err.Error(), "not authorized", "query should be authenticated before it's parsed")
+	}
+
+	_, _, err = reader.Query(context.Background(), "SET thetable.retentionperiod = '2h'", false)
+	assert.Error(t, err, "SET should require admin role")
+	md, iterate, err := client.Query(context.Background(), "SET thetable.retentionperiod = '2h'", false)
+	if assert.NoError(t, err) {
+		assert.Empty(t, md.FieldNames)
+		assert.NoError(t, iterate(func(row *core.FlatRow) (bool, error) {
+			t.Error("SET should not return rows")
+			return false, nil
+		}))
+	}
+
+	_, _, err = reader.Query(context.Background(), "DELETE FROM thetable WHERE user = 'bob'", false)
+	assert.Error(t, err, "DELETE should require admin role")
+	md, iterate, err = client.Query(context.Background(), "DELETE FROM thetable WHERE user = 'bob'", false)
+	if assert.NoError(t, err) {
+		assert.Empty(t, md.FieldNames)
+		assert.NoError(t, iterate(func(row *core.FlatRow) (bool, error) {
+			t.Error("DELETE should not return rows")
+			return false, nil
+		}))
+	}
+
+	script := "BEGIN; SET thetable.retentionperiod = '3h'; DELETE FROM thetable WHERE user = 'alice'; COMMIT"
+	_, _, err = reader.Query(context.Background(), script, false)
+	assert.Error(t, err, "Scripts should require admin role")
+	md, iterate, err = client.Query(context.Background(), script, false)
+	if assert.NoError(t, err) {
+		assert.Empty(t, md.FieldNames)
+		assert.NoError(t, iterate(func(row *core.FlatRow) (bool, error) {
+			t.Error("Scripts should not return rows")
+			return false, nil
+		}))
+	}
+
+	md, iterate, err = reader.Query(context.Background(), "SHOW CARDINALITY FOR thetable", false)
+	if assert.NoError(t, err, "SHOW CARDINALITY should only require read role") {
+		assert.Equal(t, []string{"values", "keys", "bytes"}, md.FieldNames)
+		var rows []*core.FlatRow
+		assert.NoError(t, iterate(func(row *core.FlatRow) (bool, error) {
+			rows = append(rows, row)
+			return true, nil
+		}))
+		if assert.Len(t, rows, 2) {
+			assert.Equal(t, map[string]interface{}{"dim": "host"}, rows[0].Key.AsMap())
+			assert.Equal(t, []float64{2, 2, 100}, rows[0].Values)
+			assert.Equal(t, map[string]interface{}{"dim": "host", "value": "a"}, rows[1].Key.AsMap())
+			assert.Equal(t, []float64{1, 1, 50}, rows[1].Values)
+		}
+	}
+
+	md, iterate, err = reader.Query(context.Background(), "SHOW LAST SEEN FOR thetable OLDER THAN 1m", false)
+	if assert.NoError(t, err, "SHOW LAST SEEN should only require read role") {
+		assert.Equal(t, []string{"age"}, md.FieldNames)
+		var rows []*core.FlatRow
+		assert.NoError(t, iterate(func(row *core.FlatRow) (bool, error) {
+			rows = append(rows, row)
+			return true, nil
+		}))
+		if assert.Len(t, rows, 1) {
+			assert.Equal(t, map[string]interface{}{"u": "bob"}, rows[0].Key.AsMap())
+			assert.Equal(t, []float64{90}, rows[0].Values, "age should be relative to the database's clock")
+		}
+	}
+
+	assert.Equal(t, []string{"flush thetable", "retention thetable", "pause thetable", "resume thetable", "discard thetable", "drain thetable", "canonicalize thetable", "flushforwarded", "remap thetable host map[a:b c:b]", "migrate thetable SELECT SUM(a) AS a FROM thestream", "backfill thetable 2015-01-01T00:00:00Z 2015-01-02T00:00:00Z", "set SET thetable.retentionperiod = '2h'", "delete DELETE FROM thetable WHERE user = 'bob'", "exec " + script}, db.AdminOps())
 }
 
+var mockNow = time.Date(2017, 5, 1, 10, 0, 0, 0, time.UTC)
+
 type mockDB struct {
-	numInserts int64
+	numInserts      int64
+	adminOps        []string
+	adminMx         sync.Mutex
+	queryHandlers   []planner.QueryClusterFN
+	archived        time.Time
+	queryHandlersMx sync.Mutex
 }
 
-func (db *mockDB) InsertRaw(stream string, ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap) error {
+func (db *mockDB) InsertRawContext(ctx context.Context, stream string, ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap) error {
 	atomic.AddInt64(&db.numInserts, 1)
 	return nil
 }
 
+func (db *mockDB) StreamOffset(stream string) (wal.Offset, error) {
+	return wal.Offset("offset of " + stream), nil
+}
+
 func (db *mockDB) NumInserts() int {
 	return int(atomic.LoadInt64(&db.numInserts))
 }
 
-func (db *mockDB) Query(sqlString string, isSubQuery bool, subQueryResults [][]interface{}, includeMemStore bool) (core.FlatRowSource, error) {
+func (db *mockDB) QueryWithACL(sqlString string, isSubQuery bool, subQueryResults [][]interface{}, includeMemStore bool, acl *planner.ACL) (core.FlatRowSource, error) {
 	return nil, nil
 }
 
-func (db *mockDB) Follow(f *common.Follow, cb func([]byte, wal.Offset) error) {
+func (db *mockDB) ExpandSavedQuery(sqlString string) (string, error) {
+	return sqlString, nil
+}
+
+func (db *mockDB) FollowContext(ctx context.Context, f *common.Follow, cb func([]byte, wal.Offset) error) error {
+	return nil
+}
+
+func (db *mockDB) RegisterQueryHandlerWithCapabilities(partition int, caps *common.QueryHandlerCapabilities, query planner.QueryClusterFN) error {
+	db.queryHandlersMx.Lock()
+	db.queryHandlers = append(db.queryHandlers, query)
+	db.queryHandlersMx.Unlock()
+	return nil
+}
+
+func (db *mockDB) PartitionArchived(partition int, archived time.Time) {
+	db.queryHandlersMx.Lock()
+	db.archived = archived
+	db.queryHandlersMx.Unlock()
 }
 
-func (db *mockDB) RegisterQueryHandler(partition int, query planner.QueryClusterFN) {
+func (db *mockDB) Archived() time.Time {
+	db.queryHandlersMx.Lock()
+	defer db.queryHandlersMx.Unlock()
+	return db.archived
+}
 
+func (db *mockDB) QueryHandlers() []planner.QueryClusterFN {
+	db.queryHandlersMx.Lock()
+	defer db.queryHandlersMx.Unlock()
+	return db.queryHandlers
+}
+
+func (db *mockDB) recordAdminOp(op string, table string) error {
+	db.adminMx.Lock()
+	db.adminOps = append(db.adminOps, fmt.Sprintf("%v %v", op, table))
+	db.adminMx.Unlock()
+	return nil
+}
+
+func (db *mockDB) AdminOps() []string {
+	db.adminMx.Lock()
+	defer db.adminMx.Unlock()
+	return db.adminOps
+}
+
+func (db *mockDB) ForceFlushContext(ctx context.Context, table string) error {
+	return db.recordAdminOp("flush", table)
+}
+
+func (db *mockDB) ApplyRetentionContext(ctx context.Context, table string) error {
+	return db.recordAdminOp("retention", table)
+}
+
+func (db *mockDB) FlushForwardedInserts() error {
+	db.adminMx.Lock()
+	db.adminOps = append(db.adminOps, "flushforwarded")
+	db.adminMx.Unlock()
+	return nil
+}
+
+func (db *mockDB) PauseIngestion(table string) error {
+	return db.recordAdminOp("pause", table)
+}
+
+func (db *mockDB) ResumeIngestion(table string) error {
+	return db.recordAdminOp("resume", table)
+}
+
+func (db *mockDB) DiscardIngestion(table string) error {
+	return db.recordAdminOp("discard", table)
+}
+
+func (db *mockDB) DrainContext(ctx context.Context, table string) error {
+	return db.recordAdminOp("drain", table)
+}
+
+func (db *mockDB) DumpSchema() ([]byte, error) {
+	return []byte("thetable:\n  sql: SELECT * FROM thestream\n"), nil
+}
+
+func (db *mockDB) Set(sqlString string) error {
+	return db.recordAdminOp("set", sqlString)
+}
+
+func (db *mockDB) Delete(sqlString string) error {
+	return db.recordAdminOp("delete", sqlString)
+}
+
+func (db *mockDB) Exec(script string) error {
+	return db.recordAdminOp("exec", script)
+}
+
+func (db *mockDB) RemapKeys(table string, dim string, mapping map[string]string) error {
+	return db.recordAdminOp("remap", fmt.Sprintf("%v %v %v", table, dim, mapping))
+}
+
+func (db *mockDB) Cardinality(table string, limit int) (*zenodb.CardinalityReport, error) {
+	return &zenodb.CardinalityReport{Table: table, Keys: 2, Bytes: 100, Dims: []*zenodb.DimensionCardinality{
+		{Dim: "host", Values: 2, Keys: 2, Bytes: 100, Top: []*zenodb.ValueCardinality{{Value: "a", Keys: 1, Bytes: 50}}},
+	}}, nil
+}
+
+func (db *mockDB) LastSeen(table string, olderThan time.Duration) ([]*zenodb.KeyLastSeen, error) {
+	return []*zenodb.KeyLastSeen{
+		&zenodb.KeyLastSeen{Key: bytemap.New(map[string]interface{}{"u": "bob"}), LastSeen: mockNow.Add(-90 * time.Second)},
+	}, nil
+}
+
+func (db *mockDB) Now() time.Time {
+	return mockNow
+}
+
+func (db *mockDB) RemapStatus(table string) (*zenodb.RemapStatus, error) {
+	return &zenodb.RemapStatus{Table: table, Dim: "host", State: zenodb.RemapRunning, TotalKeys: 10, ScannedKeys: 5, RemappedKeys: 1}, nil
+}
+
+func (db *mockDB) CanonicalizeKeys(table string) error {
+	return db.recordAdminOp("canonicalize", table)
+}
+
+func (db *mockDB) MigrateTable(table string, sqlString string) error {
+	return db.recordAdminOp("migrate", fmt.Sprintf("%v %v", table, sqlString))
+}
+
+func (db *mockDB) MigrationStatus(table string) (*zenodb.MigrationStatus, error) {
+	return &zenodb.MigrationStatus{Table: table, Shadow: "_migrate_" + table + "_1", State: zenodb.MigrationBackfilling, BackfilledRows: 3}, nil
+}
+
+func (db *mockDB) BackfillView(view string, from time.Time, until time.Time) error {
+	return db.recordAdminOp("backfill", fmt.Sprintf("%v %v %v", view, from.Format(time.RFC3339), until.Format(time.RFC3339)))
+}
+
+func (db *mockDB) CaptureChanges(ctx context.Context, req *common.CaptureChanges, cb func(*common.ArchivedChunk) error) error {
+	for _, chunk := range mockChunks(req.Tables) {
+		err := cb(chunk)
+		if err != nil {
+			return err
+		}
+	}
+	return zenodb.ErrChangesFellBehind
+}
+
+func mockChunks(tables []string) []*common.ArchivedChunk {
+	chunks := make([]*common.ArchivedChunk, 0, len(tables))
+	for _, table := range tables {
+		chunks = append(chunks, &common.ArchivedChunk{
+			Table:      table,
+			ArchivedAt: time.Date(2017, 5, 1, 10, 0, 0, 0, time.UTC),
+			Resolution: time.Minute,
+			Fields:     []string{"a (SUM(a))"},
+			Key:        bytemap.New(map[string]interface{}{"u": "bob"}),
+			Sequences:  []encoding.Sequence{encoding.NewSequence(8, 1)},
+		})
+	}
+	return chunks
+}
+
+func (db *mockDB) ClusterStatus() *common.ClusterStatus {
+	return &common.ClusterStatus{
+		Version:       "1.0",
+		NumPartitions: 2,
+		Followers: []*common.FollowerStatus{
+			&common.FollowerStatus{ID: 1, Partition: 0, Stream: "thestream", Version: "1.0", Joined: time.Date(2017, 5, 1, 10, 0, 0, 0, time.UTC), Lag: time.Second, Queued: 10},
+			&common.FollowerStatus{ID: 2, Partition: 1, Stream: "thestream", Version: "0.9", Joined: time.Date(2017, 5, 2, 10, 0, 0, 0, time.UTC), Failed: true},
+		},
+	}
 }
@@ -0,0 +1,143 @@
+package rpcserver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/rpc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMutualTLS(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rpctls")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	caFile := filepath.Join(tmpDir, "ca.pem")
+	ca, caKey, err := writeCert(caFile, "", nil, nil, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	serverCertFile := filepath.Join(tmpDir, "server.pem")
+	serverKeyFile := filepath.Join(tmpDir, "server.key")
+	_, _, err = writeCert(serverCertFile, serverKeyFile, ca, caKey, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	clientCertFile := filepath.Join(tmpDir, "client.pem")
+	clientKeyFile := filepath.Join(tmpDir, "client.key")
+	_, _, err = writeCert(clientCertFile, clientKeyFile, ca, caKey, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	db := &mockDB{}
+	go func() {
+		Serve(db, l, &Opts{
+			TLS: &rpc.TLSOpts{
+				CertFile:          serverCertFile,
+				KeyFile:           serverKeyFile,
+				CAFile:            caFile,
+				RequireClientCert: true,
+			},
+		})
+	}()
+	time.Sleep(1 * time.Second)
+
+	insert := func(opts *rpc.TLSOpts) error {
+		client, err := rpc.Dial(l.Addr().String(), &rpc.ClientOpts{TLS: opts})
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		inserter, err := client.NewInserter(ctx, "thestream")
+		if err != nil {
+			return err
+		}
+		err = inserter.Insert(time.Time{}, map[string]interface{}{"dim": "dimval"}, func(cb func(key string, value interface{})) {
+			cb("val", float64(1))
+		})
+		if err != nil {
+			return err
+		}
+		_, err = inserter.Close()
+		return err
+	}
+
+	assert.Error(t, insert(&rpc.TLSOpts{CAFile: caFile}), "Client without certificate should be rejected")
+	assert.Error(t, insert(&rpc.TLSOpts{CertFile: clientCertFile, KeyFile: clientKeyFile}), "Client not pinned to CA should reject server")
+	assert.NoError(t, insert(&rpc.TLSOpts{CertFile: clientCertFile, KeyFile: clientKeyFile, CAFile: caFile}))
+	assert.Equal(t, 1, db.NumInserts())
+}
+
+func writeCert(certFile string, keyFile string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, isCA bool) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-1 * time.Hour),
+		NotAfter:     time.Now().Add(1 * time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if isCA {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	if keyFile != "" {
+		keyBytes, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), 0600)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return cert, key, nil
+}
@@ -0,0 +1,279 @@
+package rpc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTLSReloadInterval = 1 * time.Minute
+)
+
+// TLSOpts configures TLS for rpc servers and clients. Certificates, keys and
+// CAs are read from PEM files which are periodically checked for changes so
+// that they can be rotated without restarting the process.
+type TLSOpts struct {
+	// CertFile and KeyFile are the PEM encoded certificate and private key that
+	// we present to our peer. These are required for servers and for clients
+	// connecting to servers that require client certificates.
+	CertFile string
+	KeyFile  string
+
+	// CAFile, if specified, is a PEM encoded bundle of CA certificates. Servers
+	// use it to verify client certificates. Clients use it in place of the system
+	// roots to verify servers, effectively pinning the server's CA.
+	CAFile string
+
+	// RequireClientCert, if true, requires clients to present a certificate
+	// signed by one of the CAs in CAFile. Only applies to servers.
+	RequireClientCert bool
+
+	// ServerName is the name against which clients verify the server's
+	// certificate. Defaults to the host portion of the dialed address.
+	ServerName string
+
+	// InsecureSkipVerify disables verification of the server's certificate by
+	// clients (don't use this in production!)
+	InsecureSkipVerify bool
+
+	// ReloadInterval controls how frequently to check the certificate, key and CA
+	// files for changes. Defaults to 1 minute.
+	ReloadInterval time.Duration
+}
+
+// tlsFiles holds the most recently loaded certificate and CA pool for a
+// TLSOpts.
+type tlsFiles struct {
+	opts         *TLSOpts
+	sessionCache tls.ClientSessionCache
+	cert         *tls.Certificate
+	pool         *x509.CertPool
+	mx           sync.RWMutex
+	stop         chan struct{}
+	stopOnce     sync.Once
+}
+
+// loadTLSFiles loads the files configured in opts and polls them for changes
+// until close is called.
+func loadTLSFiles(opts *TLSOpts) (*tlsFiles, error) {
+	// Copy opts so that applying defaults doesn't modify the caller's
+	_opts := *opts
+	opts = &_opts
+	if opts.ReloadInterval <= 0 {
+		opts.ReloadInterval = defaultTLSReloadInterval
+	}
+	tf := &tlsFiles{
+		opts:         opts,
+		sessionCache: tls.NewLRUClientSessionCache(1000),
+		stop:         make(chan struct{}),
+	}
+	stats, err := tf.stat()
+	if err != nil {
+		return nil, err
+	}
+	err = tf.load()
+	if err != nil {
+		return nil, err
+	}
+	go tf.poll(stats)
+	return tf, nil
+}
+
+func (tf *tlsFiles) files() []string {
+	var files []string
+	for _, file := range []string{tf.opts.CertFile, tf.opts.KeyFile, tf.opts.CAFile} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+func (tf *tlsFiles) stat() ([]os.FileInfo, error) {
+	files := tf.files()
+	stats := make([]os.FileInfo, 0, len(files))
+	for _, file := range files {
+		stat, err := os.Stat(file)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to stat %v: %v", file, err)
+		}
+		stats = append(stats, stat)
+	}
+	return stats, nil
+}
+
+func (tf *tlsFiles) load() error {
+	var cert *tls.Certificate
+	if tf.opts.CertFile != "" || tf.opts.KeyFile != "" {
+		_cert, err := tls.LoadX509KeyPair(tf.opts.CertFile, tf.opts.KeyFile)
+		if err != nil {
+			return fmt.Errorf("Unable to load certificate from %v and %v: %v", tf.opts.CertFile, tf.opts.KeyFile, err)
+		}
+		cert = &_cert
+	}
+
+	var pool *x509.CertPool
+	if tf.opts.CAFile != "" {
+		pemBytes, err := ioutil.ReadFile(tf.opts.CAFile)
+		if err != nil {
+			return fmt.Errorf("Unable to read CA file %v: %v", tf.opts.CAFile, err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemBytes) {
+			return fmt.Errorf("No valid certificates found in CA file %v", tf.opts.CAFile)
+		}
+	}
+
+	tf.mx.Lock()
+	tf.cert = cert
+	tf.pool = pool
+	tf.mx.Unlock()
+	return nil
+}
+
+func (tf *tlsFiles) poll(stats []os.FileInfo) {
+	ticker := time.NewTicker(tf.opts.ReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-tf.stop:
+			return
+		case <-ticker.C:
+		}
+		newStats, err := tf.stat()
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		changed := false
+		for i, newStat := range newStats {
+			stat := stats[i]
+			if newStat.ModTime().After(stat.ModTime()) || newStat.Size() != stat.Size() {
+				changed = true
+				break
+			}
+		}
+		if changed {
+			log.Debug("TLS files changed, reloading")
+			loadErr := tf.load()
+			if loadErr != nil {
+				log.Errorf("Unable to reload TLS files, continuing to use previous ones: %v", loadErr)
+			}
+			stats = newStats
+		}
+	}
+}
+
+// close stops polling for changes. It's safe to call more than once.
+func (tf *tlsFiles) close() {
+	tf.stopOnce.Do(func() {
+		close(tf.stop)
+	})
+}
+
+func (tf *tlsFiles) current() (*tls.Certificate, *x509.CertPool) {
+	tf.mx.RLock()
+	defer tf.mx.RUnlock()
+	return tf.cert, tf.pool
+}
+
+func (tf *tlsFiles) serverConfig() *tls.Config {
+	cert, pool := tf.current()
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if cert != nil {
+		cfg.Certificates = []tls.Certificate{*cert}
+	}
+	if tf.opts.RequireClientCert {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		cfg.ClientCAs = pool
+	}
+	return cfg
+}
+
+func (tf *tlsFiles) clientConfig(addr string) *tls.Config {
+	cert, pool := tf.current()
+	serverName := tf.opts.ServerName
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(addr)
+	}
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         serverName,
+		RootCAs:            pool,
+		InsecureSkipVerify: tf.opts.InsecureSkipVerify,
+		ClientSessionCache: tf.sessionCache,
+	}
+	if cert != nil {
+		cfg.Certificates = []tls.Certificate{*cert}
+	}
+	return cfg
+}
+
+// TLSListener wraps the given listener with TLS using the given opts. The
+// certificate and CA files are reloaded whenever they change on disk, with new
+// connections picking up the latest versions.
+func TLSListener(l net.Listener, opts *TLSOpts) (net.Listener, error) {
+	if opts.CertFile == "" || opts.KeyFile == "" {
+		return nil, fmt.Errorf("Server TLS requires both CertFile and KeyFile")
+	}
+	if opts.RequireClientCert && opts.CAFile == "" {
+		return nil, fmt.Errorf("Requiring client certificates requires a CAFile")
+	}
+	tf, err := loadTLSFiles(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &tlsListener{
+		Listener: tls.NewListener(l, &tls.Config{
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return tf.serverConfig(), nil
+			},
+		}),
+		tf: tf,
+	}, nil
+}
+
+// tlsListener stops polling the TLS files once it's closed.
+type tlsListener struct {
+	net.Listener
+	tf *tlsFiles
+}
+
+func (l *tlsListener) Close() error {
+	l.tf.close()
+	return l.Listener.Close()
+}
+
+// tlsDialer wraps the given dialer with TLS using the given opts. The returned
+// tlsFiles must be closed once the dialer is no longer needed.
+func tlsDialer(d func(string, time.Duration) (net.Conn, error), opts *TLSOpts) (func(string, time.Duration) (net.Conn, error), *tlsFiles, error) {
+	tf, err := loadTLSFiles(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return func(addr string, timeout time.Duration) (net.Conn, error) {
+		conn, err := d(addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, tf.clientConfig(addr))
+		if timeout > 0 {
+			tlsConn.SetDeadline(time.Now().Add(timeout))
+		}
+		err = tlsConn.Handshake()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		return tlsConn, nil
+	}, tf, nil
+}
@@ -0,0 +1,25 @@
+package rpc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadTLSFilesDoesntModifyOpts(t *testing.T) {
+	opts := &TLSOpts{}
+	tf, err := loadTLSFiles(opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Zero(t, opts.ReloadInterval, "caller's opts shouldn't be modified")
+	assert.Equal(t, defaultTLSReloadInterval, tf.opts.ReloadInterval)
+	tf.close()
+	tf.close()
+	select {
+	case <-tf.stop:
+		// stopped
+	default:
+		t.Error("closing should stop polling")
+	}
+}
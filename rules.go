@@ -0,0 +1,378 @@
+package zenodb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/yaml"
+)
+
+// States of an alerting rule, see RuleStatus.
+const (
+	RuleInactive = "inactive"
+	RulePending  = "pending"
+	RuleFiring   = "firing"
+	RuleResolved = "resolved"
+)
+
+const (
+	defaultRuleInterval = 1 * time.Minute
+	defaultRuleSeverity = "error"
+)
+
+// pagerDutyEventsURL is the PagerDuty Events API v2 endpoint to which alerts
+// are sent.
+var pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+var ruleOps = map[string]func(val float64, threshold float64) bool{
+	">":  func(val float64, threshold float64) bool { return val > threshold },
+	">=": func(val float64, threshold float64) bool { return val >= threshold },
+	"<":  func(val float64, threshold float64) bool { return val < threshold },
+	"<=": func(val float64, threshold float64) bool { return val <= threshold },
+	"==": func(val float64, threshold float64) bool { return val == threshold },
+	"!=": func(val float64, threshold float64) bool { return val != threshold },
+}
+
+// RuleOpts configures an alerting rule. The rule's query is evaluated
+// periodically and every row whose Field compares to Threshold according to Op
+// triggers the rule. Once the rule has been triggered for the For duration it
+// fires, and alerts are posted with the triggering rows. When a later
+// evaluation returns no triggering rows, the alert is resolved.
+type RuleOpts struct {
+	// SQL is the query to evaluate. It includes data that hasn't been flushed
+	// yet.
+	SQL string
+	// Field is the field compared to Threshold. Defaults to the first field
+	// returned by the query.
+	Field string
+	// Op is one of >, >=, <, <=, == or !=. Defaults to >.
+	Op string
+	// Threshold is the value to which Field is compared.
+	Threshold float64
+	// For is how long the rule has to be triggered before it fires. If zero,
+	// it fires as soon as it's triggered.
+	For time.Duration
+	// Interval is how often to evaluate the rule. Defaults to 1 minute.
+	Interval time.Duration
+	// Timeout limits how long the query may take. Defaults to 5 minutes.
+	Timeout time.Duration
+	// Severity is included in alerts. For PagerDuty, it must be one of
+	// critical, error, warning or info. Defaults to error.
+	Severity string
+	// Webhooks are URLs to which alerts are POSTed as JSON, see Alert.
+	Webhooks []string
+	// PagerDutyRoutingKey, if set, sends alerts to PagerDuty using this
+	// integration key, resolving the PagerDuty incident along with the alert.
+	PagerDutyRoutingKey string
+}
+
+// Alert is posted to webhooks whenever a rule fires or is resolved.
+type Alert struct {
+	Rule      string `json:"rule"`
+	Status    string `json:"status"`
+	Severity  string `json:"severity"`
+	Condition string `json:"condition"`
+	// ActiveSince is when the rule was first triggered
+	ActiveSince time.Time `json:"activeSince"`
+	At          time.Time `json:"at"`
+	Fields      []string  `json:"fields"`
+	// Rows are the rows that triggered the rule, empty once it's resolved
+	Rows []*ScheduledRow `json:"rows"`
+}
+
+// RuleStatus reports on the evaluations of an alerting rule.
+type RuleStatus struct {
+	Name      string
+	Condition string
+	// State is one of RuleInactive, RulePending or RuleFiring
+	State       string
+	ActiveSince time.Time
+	LastEval    time.Time
+	// TriggeringRows is the number of rows that triggered the rule in the last
+	// successful evaluation
+	TriggeringRows int
+	Evaluations    int64
+	Fired          int64
+	// LastError is the error of the last evaluation or notification, if it
+	// failed
+	LastError string
+}
+
+// LoadRules loads RuleOpts keyed by name from the YAML file at the given path,
+// for example:
+//
+//	high_error_rate:
+//	  sql: SELECT errors / requests AS error_rate FROM combined WHERE period(5m) GROUP BY server
+//	  op: ">"
+//	  threshold: 0.05
+//	  for: 10m
+//	  interval: 1m
+//	  webhooks:
+//	    - https://alerts.example.com/zenodb
+//	  pagerdutyroutingkey: 0123456789abcdef0123456789abcdef
+func LoadRules(filename string) (map[string]*RuleOpts, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read rules from %v: %v", filename, err)
+	}
+	rules := make(map[string]*RuleOpts)
+	err = yaml.Unmarshal(b, &rules)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse rules from %v: %v", filename, err)
+	}
+	return rules, nil
+}
+
+type rule struct {
+	name      string
+	opts      *RuleOpts
+	compare   func(val float64, threshold float64) bool
+	condition string
+	mx        sync.Mutex
+	status    RuleStatus
+}
+
+// newRules validates the given RuleOpts.
+func newRules(opts map[string]*RuleOpts) ([]*rule, error) {
+	names := make([]string, 0, len(opts))
+	for name := range opts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rules := make([]*rule, 0, len(opts))
+	for _, name := range names {
+		o := opts[name]
+		if o == nil {
+			return nil, fmt.Errorf("Rule %v has no definition", name)
+		}
+		if strings.TrimSpace(o.SQL) == "" {
+			return nil, fmt.Errorf("Rule %v has no SQL", name)
+		}
+		op := strings.TrimSpace(o.Op)
+		if op == "" {
+			op = ">"
+		}
+		compare, found := ruleOps[op]
+		if !found {
+			return nil, fmt.Errorf("Rule %v has unknown op %q, expected one of >, >=, <, <=, == or !=", name, o.Op)
+		}
+		if o.For < 0 || o.Interval < 0 {
+			return nil, fmt.Errorf("Rule %v: for and interval must not be negative", name)
+		}
+		if len(o.Webhooks) == 0 && o.PagerDutyRoutingKey == "" {
+			return nil, fmt.Errorf("Rule %v has no webhooks and no pagerdutyroutingkey", name)
+		}
+		field := o.Field
+		if field == "" {
+			field = "<first field>"
+		}
+		condition := fmt.Sprintf("%v %v %v", field, op, o.Threshold)
+		rules = append(rules, &rule{
+			name:      name,
+			opts:      o,
+			compare:   compare,
+			condition: condition,
+			status:    RuleStatus{Name: name, Condition: condition, State: RuleInactive},
+		})
+	}
+	return rules, nil
+}
+
+// startRules evaluates each of the rules at its interval.
+func (db *DB) startRules() {
+	for _, r := range db.rules {
+		go db.runRule(r)
+	}
+}
+
+func (db *DB) runRule(r *rule) {
+	interval := r.opts.Interval
+	if interval <= 0 {
+		interval = defaultRuleInterval
+	}
+	ticker := db.clock.newTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C() {
+		err := db.evaluateRule(r, db.clock.Now())
+		if err != nil {
+			log.Errorf("Unable to evaluate rule %v: %v", r.name, err)
+		}
+	}
+}
+
+// evaluateRule runs the rule's query, updates its state and sends alerts if
+// it fired or was resolved.
+func (db *DB) evaluateRule(r *rule, now time.Time) error {
+	result, err := db.queryForSink(r.name, r.opts.SQL, r.opts.Timeout, now)
+	if err == nil {
+		result, err = r.triggering(result)
+	}
+
+	r.mx.Lock()
+	r.status.LastEval = now
+	r.status.Evaluations++
+	if err != nil {
+		r.status.LastError = err.Error()
+		r.mx.Unlock()
+		return err
+	}
+	r.status.LastError = ""
+	r.status.TriggeringRows = len(result.Rows)
+	var alert *Alert
+	if len(result.Rows) == 0 {
+		if r.status.State == RuleFiring {
+			alert = r.alert(RuleResolved, now, result)
+		}
+		r.status.State = RuleInactive
+		r.status.ActiveSince = time.Time{}
+	} else {
+		if r.status.State == RuleInactive {
+			r.status.State = RulePending
+			r.status.ActiveSince = now
+		}
+		if r.status.State == RulePending && now.Sub(r.status.ActiveSince) >= r.opts.For {
+			r.status.State = RuleFiring
+			r.status.Fired++
+			alert = r.alert(RuleFiring, now, result)
+		}
+	}
+	r.mx.Unlock()
+
+	if alert == nil {
+		return nil
+	}
+	err = r.notify(alert)
+	if err != nil {
+		r.mx.Lock()
+		r.status.LastError = err.Error()
+		r.mx.Unlock()
+	}
+	return err
+}
+
+// triggering filters the given result down to the rows that trigger the rule.
+func (r *rule) triggering(result *ScheduledResult) (*ScheduledResult, error) {
+	idx := 0
+	if r.opts.Field != "" {
+		idx = -1
+		for i, name := range result.Fields {
+			if name == r.opts.Field {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			return nil, fmt.Errorf("Query for rule %v has no field %v", r.name, r.opts.Field)
+		}
+	} else if len(result.Fields) == 0 {
+		return nil, fmt.Errorf("Query for rule %v has no fields", r.name)
+	}
+
+	rows := result.Rows[:0]
+	for _, row := range result.Rows {
+		val := row.row.Values[idx]
+		if !math.IsNaN(val) && r.compare(val, r.opts.Threshold) {
+			rows = append(rows, row)
+		}
+	}
+	result.Rows = rows
+	return result, nil
+}
+
+// alert builds an Alert, must be called with r.mx held.
+func (r *rule) alert(status string, now time.Time, result *ScheduledResult) *Alert {
+	severity := r.opts.Severity
+	if severity == "" {
+		severity = defaultRuleSeverity
+	}
+	return &Alert{
+		Rule:        r.name,
+		Status:      status,
+		Severity:    severity,
+		Condition:   r.condition,
+		ActiveSince: r.status.ActiveSince,
+		At:          now,
+		Fields:      result.Fields,
+		Rows:        result.Rows,
+	}
+}
+
+// notify sends the alert to all of the rule's webhooks and PagerDuty, returning
+// the first error encountered.
+func (r *rule) notify(alert *Alert) error {
+	var firstErr error
+	b, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	for _, url := range r.opts.Webhooks {
+		err = postSink(url, "application/json", b)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if r.opts.PagerDutyRoutingKey != "" {
+		err = r.notifyPagerDuty(alert)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string      `json:"summary"`
+	Source        string      `json:"source"`
+	Severity      string      `json:"severity"`
+	Timestamp     time.Time   `json:"timestamp"`
+	CustomDetails interface{} `json:"custom_details"`
+}
+
+func (r *rule) notifyPagerDuty(alert *Alert) error {
+	event := &pagerDutyEvent{
+		RoutingKey:  r.opts.PagerDutyRoutingKey,
+		EventAction: "resolve",
+		DedupKey:    "zenodb-" + r.name,
+	}
+	if alert.Status == RuleFiring {
+		event.EventAction = "trigger"
+		event.Payload = &pagerDutyPayload{
+			Summary:       fmt.Sprintf("%v: %v for %d rows", r.name, alert.Condition, len(alert.Rows)),
+			Source:        "zenodb",
+			Severity:      alert.Severity,
+			Timestamp:     alert.At,
+			CustomDetails: alert,
+		}
+	}
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return postSink(pagerDutyEventsURL, "application/json", b)
+}
+
+// RuleStatuses returns the status of every alerting rule, ordered by name.
+func (db *DB) RuleStatuses() []*RuleStatus {
+	statuses := make([]*RuleStatus, 0, len(db.rules))
+	for _, r := range db.rules {
+		r.mx.Lock()
+		status := r.status
+		r.mx.Unlock()
+		statuses = append(statuses, &status)
+	}
+	return statuses
+}
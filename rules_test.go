@@ -0,0 +1,146 @@
+package zenodb
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRules(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var mx sync.Mutex
+	var alerts []*Alert
+	var events []*pagerDutyEvent
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		mx.Lock()
+		defer mx.Unlock()
+		if req.URL.Path == "/pagerduty" {
+			event := &pagerDutyEvent{}
+			json.Unmarshal(b, event)
+			events = append(events, event)
+			return
+		}
+		alert := &Alert{}
+		json.Unmarshal(b, alert)
+		alerts = append(alerts, alert)
+	}))
+	defer server.Close()
+	oldPagerDutyEventsURL := pagerDutyEventsURL
+	pagerDutyEventsURL = server.URL + "/pagerduty"
+	defer func() {
+		pagerDutyEventsURL = oldPagerDutyEventsURL
+	}()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 0, 0, time.UTC)
+	clock := NewVirtualClock(epoch)
+	clock.Freeze()
+	db, err := NewDB(&DBOpts{
+		Dir:   tmpDir,
+		Clock: clock,
+		Schema: Schema{
+			"thetable": &TableOpts{
+				RetentionPeriod: time.Hour,
+				SQL:             "SELECT SUM(a) AS a FROM inbound GROUP BY u, period(1m)",
+			},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	for _, opts := range []*RuleOpts{
+		&RuleOpts{Webhooks: []string{server.URL}},
+		&RuleOpts{SQL: "SELECT a FROM thetable", Op: "=~", Webhooks: []string{server.URL}},
+		&RuleOpts{SQL: "SELECT a FROM thetable"},
+	} {
+		_, err = newRules(map[string]*RuleOpts{"bad": opts})
+		assert.Error(t, err)
+	}
+
+	rules, err := newRules(map[string]*RuleOpts{
+		"toohigh": &RuleOpts{
+			SQL:                 "SELECT a FROM thetable",
+			Field:               "a",
+			Op:                  ">=",
+			Threshold:           2,
+			For:                 time.Minute,
+			Severity:            "warning",
+			Webhooks:            []string{server.URL + "/hook"},
+			PagerDutyRoutingKey: "thekey",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	r := rules[0]
+	state := func() string {
+		assert.NoError(t, db.evaluateRule(r, clock.Now()))
+		return r.status.State
+	}
+
+	db.Insert("inbound", epoch, map[string]interface{}{"u": "bob"}, map[string]float64{"a": 1})
+	waitFor(func() bool { return db.TableStats("thetable").InsertedPoints == 1 })
+	assert.Equal(t, RuleInactive, state(), "nothing should trigger below threshold")
+
+	db.Insert("inbound", epoch, map[string]interface{}{"u": "alice"}, map[string]float64{"a": 2})
+	waitFor(func() bool { return db.TableStats("thetable").InsertedPoints == 2 })
+	assert.Equal(t, RulePending, state(), "rule shouldn't fire before For has elapsed")
+	clock.Tick(30 * time.Second)
+	assert.Equal(t, RulePending, state())
+	clock.Tick(30 * time.Second)
+	assert.Equal(t, RuleFiring, state(), "rule should fire once For has elapsed")
+	clock.Tick(time.Minute)
+	assert.Equal(t, RuleFiring, state())
+
+	mx.Lock()
+	if assert.Len(t, alerts, 1, "firing rule should only alert once") {
+		alert := alerts[0]
+		assert.Equal(t, "toohigh", alert.Rule)
+		assert.Equal(t, RuleFiring, alert.Status)
+		assert.Equal(t, "warning", alert.Severity)
+		assert.Equal(t, "a >= 2", alert.Condition)
+		assert.Equal(t, epoch, alert.ActiveSince.In(time.UTC))
+		if assert.Len(t, alert.Rows, 1) {
+			assert.Equal(t, "alice", alert.Rows[0].Dims["u"])
+			assert.EqualValues(t, 2, alert.Rows[0].Vals["a"])
+		}
+	}
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, "thekey", events[0].RoutingKey)
+		assert.Equal(t, "trigger", events[0].EventAction)
+		assert.Equal(t, "zenodb-toohigh", events[0].DedupKey)
+	}
+	mx.Unlock()
+
+	r.opts.Threshold = 3
+	assert.Equal(t, RuleInactive, state(), "rule should resolve once nothing triggers it")
+	mx.Lock()
+	if assert.Len(t, alerts, 2) {
+		assert.Equal(t, RuleResolved, alerts[1].Status)
+		assert.Empty(t, alerts[1].Rows)
+	}
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, "resolve", events[1].EventAction)
+		assert.Equal(t, "zenodb-toohigh", events[1].DedupKey)
+	}
+	mx.Unlock()
+
+	status := r.status
+	assert.EqualValues(t, 6, status.Evaluations)
+	assert.EqualValues(t, 1, status.Fired)
+	assert.Empty(t, status.LastError)
+}
@@ -0,0 +1,186 @@
+package zenodb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/getlantern/yaml"
+	"github.com/getlantern/zenodb/sql"
+)
+
+// SavedQueryOpts configures a named query that's stored on the server, so that
+// clients like dashboards can run it by name with EXECUTE instead of sending
+// their own SQL. That way, the SQL they run can be reviewed and optimized in
+// one place.
+type SavedQueryOpts struct {
+	// SQL is the query to run. It may contain placeholders like :server, which
+	// are replaced with the values of the corresponding parameters, numbers as
+	// numbers and everything else as quoted strings.
+	SQL string
+	// Defaults are default values for parameters, keyed by name. Parameters
+	// without a default must be specified in every EXECUTE.
+	Defaults map[string]string
+	// Description optionally describes what the query is for.
+	Description string
+}
+
+// LoadSavedQueries loads SavedQueryOpts keyed by name from the YAML file at
+// the given path, for example:
+//
+//	errors_by_server:
+//	  description: Errors per server over the past day
+//	  sql: SELECT errors FROM requests WHERE errors > :minerrors GROUP BY server, period(1h) ASOF '-24h'
+//	  defaults:
+//	    minerrors: 0
+func LoadSavedQueries(filename string) (map[string]*SavedQueryOpts, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read saved queries from %v: %v", filename, err)
+	}
+	queries := make(map[string]*SavedQueryOpts)
+	err = yaml.Unmarshal(b, &queries)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse saved queries from %v: %v", filename, err)
+	}
+	return queries, nil
+}
+
+// ApplySavedQueries replaces the saved queries with the given ones, keyed by
+// name. If any of them is invalid, the saved queries are left unchanged.
+func (db *DB) ApplySavedQueries(queries map[string]*SavedQueryOpts) error {
+	saved := make(map[string]*SavedQueryOpts, len(queries))
+	for name, opts := range queries {
+		if opts == nil {
+			return fmt.Errorf("Saved query %v has no definition", name)
+		}
+		if strings.TrimSpace(opts.SQL) == "" {
+			return fmt.Errorf("Saved query %v has no SQL", name)
+		}
+		normalized := &SavedQueryOpts{
+			SQL:         opts.SQL,
+			Defaults:    make(map[string]string, len(opts.Defaults)),
+			Description: opts.Description,
+		}
+		for param, value := range opts.Defaults {
+			normalized.Defaults[strings.ToLower(param)] = value
+		}
+
+		// Make sure that the query parses, using placeholder values for
+		// parameters that have no default
+		params := make(map[string]string)
+		for _, param := range sql.Placeholders(opts.SQL) {
+			params[param] = "0"
+		}
+		for param, value := range normalized.Defaults {
+			params[param] = value
+		}
+		bound, err := sql.BindPlaceholders(opts.SQL, params)
+		if err == nil {
+			_, err = sql.Parse(bound)
+		}
+		if err != nil {
+			return fmt.Errorf("Saved query %v: %v", name, err)
+		}
+		saved[strings.ToLower(name)] = normalized
+	}
+
+	db.savedQueriesMx.Lock()
+	db.savedQueries = saved
+	db.savedQueriesMx.Unlock()
+	return nil
+}
+
+// SavedQueries returns the saved queries keyed by name.
+func (db *DB) SavedQueries() map[string]*SavedQueryOpts {
+	db.savedQueriesMx.RLock()
+	defer db.savedQueriesMx.RUnlock()
+	result := make(map[string]*SavedQueryOpts, len(db.savedQueries))
+	for name, opts := range db.savedQueries {
+		result[name] = opts
+	}
+	return result
+}
+
+// ExpandSavedQuery turns the given EXECUTE statement into the SQL of the saved
+// query that it executes, with its parameters bound. Other SQL is returned
+// unchanged.
+func (db *DB) ExpandSavedQuery(sqlString string) (string, error) {
+	if !sql.IsExecute(sqlString) {
+		return sqlString, nil
+	}
+	execute, err := sql.ParseExecute(sqlString)
+	if err != nil {
+		return "", err
+	}
+	db.savedQueriesMx.RLock()
+	opts := db.savedQueries[execute.Name]
+	db.savedQueriesMx.RUnlock()
+	if opts == nil {
+		return "", fmt.Errorf("Unknown saved query %v", execute.Name)
+	}
+
+	placeholders := make(map[string]bool)
+	for _, param := range sql.Placeholders(opts.SQL) {
+		placeholders[param] = true
+	}
+	params := make(map[string]string, len(placeholders))
+	for param, value := range opts.Defaults {
+		params[param] = value
+	}
+	for param, value := range execute.Params {
+		if !placeholders[param] {
+			return "", fmt.Errorf("Saved query %v has no parameter %v", execute.Name, param)
+		}
+		params[param] = value
+	}
+	expanded, err := sql.BindPlaceholders(opts.SQL, params)
+	if err != nil {
+		return "", fmt.Errorf("Unable to execute saved query %v: %v", execute.Name, err)
+	}
+	return expanded, nil
+}
+
+// pollForSavedQueries applies the saved queries from the given file and
+// reapplies them whenever the file changes.
+func (db *DB) pollForSavedQueries(filename string) error {
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	err = db.applySavedQueriesFromFile(filename)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			time.Sleep(1 * time.Second)
+			newStat, err := os.Stat(filename)
+			if err != nil {
+				log.Errorf("Unable to stat saved queries: %v", err)
+				continue
+			}
+			if newStat.ModTime().After(stat.ModTime()) || newStat.Size() != stat.Size() {
+				log.Debug("Saved queries file changed, applying")
+				applyErr := db.applySavedQueriesFromFile(filename)
+				if applyErr != nil {
+					log.Error(applyErr)
+				}
+				stat = newStat
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (db *DB) applySavedQueriesFromFile(filename string) error {
+	queries, err := LoadSavedQueries(filename)
+	if err != nil {
+		return err
+	}
+	return db.ApplySavedQueries(queries)
+}
@@ -0,0 +1,104 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSavedQueries(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 0, 0, time.UTC)
+	clock := NewVirtualClock(epoch)
+	clock.Freeze()
+	db, err := NewDB(&DBOpts{
+		Dir:   tmpDir,
+		Clock: clock,
+		Schema: Schema{
+			"thetable": &TableOpts{
+				RetentionPeriod: time.Hour,
+				SQL:             "SELECT SUM(a) AS a FROM inbound GROUP BY u, period(1m)",
+			},
+		},
+		SavedQueries: map[string]*SavedQueryOpts{
+			"By_User": &SavedQueryOpts{
+				SQL:      "SELECT a FROM thetable WHERE u = :user OR u = :Other",
+				Defaults: map[string]string{"other": "nobody"},
+			},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	inserted := 0
+	insert := func(u string, a float64) {
+		db.Insert("inbound", epoch, map[string]interface{}{"u": u}, map[string]float64{"a": a})
+		inserted++
+		waitFor(func() bool { return db.TableStats("thetable").InsertedPoints == int64(inserted) })
+	}
+	insert("bob", 1)
+	insert("alice", 4)
+	insert("carol", 8)
+
+	execute := func(sqlString string) (map[string]float64, error) {
+		sums := make(map[string]float64)
+		source, err := db.Query(sqlString, false, nil, true)
+		if err != nil {
+			return nil, err
+		}
+		err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			sums[row.Key.Get("u").(string)] += row.Values[0]
+			return true, nil
+		})
+		return sums, err
+	}
+
+	sums, err := execute("EXECUTE by_user WITH user = 'bob'")
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]float64{"bob": 1}, sums)
+	}
+	sums, err = execute("EXECUTE BY_USER WITH user = 'bob', other = 'alice'")
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]float64{"bob": 1, "alice": 4}, sums, "specified params should override defaults")
+	}
+	sums, err = execute(`EXECUTE by_user WITH user = 'bob\' OR u = \'carol'`)
+	if assert.NoError(t, err) {
+		assert.Empty(t, sums, "params should be bound as literals")
+	}
+	_, err = execute("EXECUTE by_user")
+	assert.Error(t, err, "missing param without default should fail")
+	_, err = execute("EXECUTE by_user WITH user = 'bob', other = 'alice', third = 'carol'")
+	assert.Error(t, err, "unknown param should fail")
+	_, err = execute("EXECUTE unknown")
+	assert.Error(t, err, "unknown saved query should fail")
+
+	assert.Error(t, db.ApplySavedQueries(map[string]*SavedQueryOpts{
+		"broken": &SavedQueryOpts{SQL: "SELECT FROM WHERE :x"},
+	}), "invalid SQL should be rejected")
+	assert.Contains(t, db.SavedQueries(), "by_user", "saved queries should remain after failed update")
+
+	savedQueriesFile := tmpDir + "/saved.yaml"
+	if !assert.NoError(t, ioutil.WriteFile(savedQueriesFile, []byte("everyone:\n  sql: SELECT a FROM thetable\n"), 0644)) {
+		return
+	}
+	if !assert.NoError(t, db.applySavedQueriesFromFile(savedQueriesFile)) {
+		return
+	}
+	assert.NotContains(t, db.SavedQueries(), "by_user", "applying saved queries should replace existing ones")
+	sums, err = execute("EXECUTE everyone")
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]float64{"bob": 1, "alice": 4, "carol": 8}, sums)
+	}
+}
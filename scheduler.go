@@ -0,0 +1,470 @@
+package zenodb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/yaml"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+// Types of sinks for scheduled queries, see SinkOpts.
+const (
+	SinkTable   = "table"
+	SinkWebhook = "webhook"
+	SinkFile    = "file"
+	SinkKafka   = "kafka"
+)
+
+const (
+	defaultScheduleTimeout = 5 * time.Minute
+	sinkHTTPTimeout        = 30 * time.Second
+	formatNDJSON           = "ndjson"
+	contentTypeKafkaJSON   = "application/vnd.kafka.json.v2+json"
+)
+
+// ScheduleOpts configures a named query that runs on a schedule and writes its
+// results to a sink.
+type ScheduleOpts struct {
+	// Schedule is either a cron expression with the five fields minute, hour,
+	// day of month, month and day of week (in UTC) like "*/15 * * * *", a
+	// shortcut like @hourly, @daily, @weekly or @monthly, or @every followed by
+	// a duration like "@every 10m". @every runs at multiples of the duration,
+	// so "@every 1h" runs on the hour.
+	Schedule string
+	// SQL is the query to run. It includes data that hasn't been flushed yet.
+	SQL string
+	// Timeout limits how long the query may take. Defaults to 5 minutes.
+	Timeout time.Duration
+	// Sink configures where to write the results.
+	Sink SinkOpts
+}
+
+// SinkOpts configures where a scheduled query writes its results. Rows are
+// written as JSON objects like {"time": ..., "dims": {...}, "vals": {...}},
+// except where noted.
+type SinkOpts struct {
+	// Type is one of SinkTable, SinkWebhook, SinkFile or SinkKafka.
+	Type string
+	// Stream is the stream into which a SinkTable inserts the results, using
+	// the time of each row as its timestamp, its dims as dims and its fields as
+	// vals. Define a table that selects from this stream to derive a table
+	// from the results.
+	Stream string
+	// URL is where a SinkWebhook POSTs each run's results as a single
+	// ScheduledResult, or the base URL of the Kafka REST proxy through which a
+	// SinkKafka produces one record per row.
+	URL string
+	// Path is the file to which a SinkFile appends the results.
+	Path string
+	// Format is the format in which a SinkFile writes rows, one of ndjson (the
+	// default), csv or tsv. CSV and TSV files get a header when they're
+	// created.
+	Format string
+	// Topic is the Kafka topic to which a SinkKafka produces records, keyed by
+	// the name of the scheduled query.
+	Topic string
+}
+
+// ScheduledResult holds the results of one run of a scheduled query.
+type ScheduledResult struct {
+	Name   string          `json:"name"`
+	RunAt  time.Time       `json:"runAt"`
+	Fields []string        `json:"fields"`
+	Rows   []*ScheduledRow `json:"rows"`
+}
+
+// ScheduledRow is a single row of the results of a scheduled query. Values
+// that can't be represented in JSON (NaN and infinities) are null.
+type ScheduledRow struct {
+	Time time.Time              `json:"time"`
+	Dims map[string]interface{} `json:"dims"`
+	Vals map[string]interface{} `json:"vals"`
+
+	row *core.FlatRow
+}
+
+// ScheduleStatus reports on the runs of a scheduled query.
+type ScheduleStatus struct {
+	Name     string
+	Schedule string
+	LastRun  time.Time
+	NextRun  time.Time
+	// LastRows is the number of rows written by the last successful run
+	LastRows int
+	Runs     int64
+	Failures int64
+	// LastError is the error of the last run, if it failed
+	LastError string
+}
+
+// LoadSchedules loads ScheduleOpts keyed by name from the YAML file at the
+// given path, for example:
+//
+//	hourly_errors:
+//	  schedule: "@hourly"
+//	  sql: SELECT errors FROM requests GROUP BY server, period(1h)
+//	  sink:
+//	    type: webhook
+//	    url: https://reports.example.com/errors
+func LoadSchedules(filename string) (map[string]*ScheduleOpts, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read schedules from %v: %v", filename, err)
+	}
+	schedules := make(map[string]*ScheduleOpts)
+	err = yaml.Unmarshal(b, &schedules)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse schedules from %v: %v", filename, err)
+	}
+	return schedules, nil
+}
+
+type scheduledQuery struct {
+	name     string
+	opts     *ScheduleOpts
+	schedule schedule
+	sink     sink
+	mx       sync.Mutex
+	status   ScheduleStatus
+}
+
+// sink writes the results of a scheduled query somewhere.
+type sink interface {
+	write(result *ScheduledResult) error
+}
+
+// newScheduledQueries validates the given ScheduleOpts and sets up their
+// sinks.
+func (db *DB) newScheduledQueries(opts map[string]*ScheduleOpts) ([]*scheduledQuery, error) {
+	names := make([]string, 0, len(opts))
+	for name := range opts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	queries := make([]*scheduledQuery, 0, len(opts))
+	for _, name := range names {
+		o := opts[name]
+		if o == nil {
+			return nil, fmt.Errorf("Schedule %v has no definition", name)
+		}
+		if strings.TrimSpace(o.SQL) == "" {
+			return nil, fmt.Errorf("Schedule %v has no SQL", name)
+		}
+		sched, err := parseSchedule(o.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("Schedule %v: %v", name, err)
+		}
+		s, err := db.newSink(&o.Sink)
+		if err != nil {
+			return nil, fmt.Errorf("Schedule %v: %v", name, err)
+		}
+		queries = append(queries, &scheduledQuery{
+			name:     name,
+			opts:     o,
+			schedule: sched,
+			sink:     s,
+			status:   ScheduleStatus{Name: name, Schedule: o.Schedule},
+		})
+	}
+	return queries, nil
+}
+
+func (db *DB) newSink(opts *SinkOpts) (sink, error) {
+	switch strings.ToLower(opts.Type) {
+	case SinkTable:
+		if opts.Stream == "" {
+			return nil, fmt.Errorf("Table sink requires a stream")
+		}
+		if db.opts.ReadOnly {
+			return nil, fmt.Errorf("Table sink is not supported in ReadOnly mode")
+		}
+		return &tableSink{db, opts.Stream}, nil
+	case SinkWebhook:
+		if opts.URL == "" {
+			return nil, fmt.Errorf("Webhook sink requires a url")
+		}
+		return &webhookSink{opts.URL}, nil
+	case SinkFile:
+		if opts.Path == "" {
+			return nil, fmt.Errorf("File sink requires a path")
+		}
+		format := strings.ToLower(opts.Format)
+		if format == "" {
+			format = formatNDJSON
+		}
+		if format != formatNDJSON && !common.IsDelimitedFormat(format) {
+			return nil, fmt.Errorf("Unknown format %v for file sink, expected one of %v, %v or %v", opts.Format, formatNDJSON, common.FormatCSV, common.FormatTSV)
+		}
+		return &fileSink{opts.Path, format}, nil
+	case SinkKafka:
+		if opts.URL == "" || opts.Topic == "" {
+			return nil, fmt.Errorf("Kafka sink requires the url of a Kafka REST proxy and a topic")
+		}
+		return &kafkaSink{opts.URL, opts.Topic}, nil
+	default:
+		return nil, fmt.Errorf("Unknown sink type %q, expected one of %v, %v, %v or %v", opts.Type, SinkTable, SinkWebhook, SinkFile, SinkKafka)
+	}
+}
+
+// startScheduler runs each of the scheduled queries whenever it's due.
+func (db *DB) startScheduler() {
+	for _, sq := range db.scheduledQueries {
+		go db.runScheduled(sq)
+	}
+}
+
+func (db *DB) runScheduled(sq *scheduledQuery) {
+	now := db.clock.Now()
+	next := sq.setNextRun(now)
+	if next.IsZero() {
+		log.Errorf("Schedule %v never runs", sq.name)
+		return
+	}
+	timer := db.clock.newTimer(next.Sub(now))
+	defer timer.Stop()
+	for range timer.C() {
+		runAt := db.clock.Now()
+		err := db.runScheduledOnce(sq, runAt)
+		if err != nil {
+			log.Errorf("Unable to run schedule %v: %v", sq.name, err)
+		}
+		now = db.clock.Now()
+		next = sq.setNextRun(now)
+		if next.IsZero() {
+			return
+		}
+		timer.Reset(next.Sub(now))
+	}
+}
+
+// runScheduledOnce runs the given scheduled query and writes its results to
+// its sink.
+func (db *DB) runScheduledOnce(sq *scheduledQuery, runAt time.Time) error {
+	result, err := db.queryForSink(sq.name, sq.opts.SQL, sq.opts.Timeout, runAt)
+	if err == nil {
+		err = sq.sink.write(result)
+	}
+
+	sq.mx.Lock()
+	defer sq.mx.Unlock()
+	sq.status.LastRun = runAt
+	sq.status.Runs++
+	if err != nil {
+		sq.status.Failures++
+		sq.status.LastError = err.Error()
+		return err
+	}
+	sq.status.LastError = ""
+	sq.status.LastRows = len(result.Rows)
+	return nil
+}
+
+// queryForSink runs the given query, including data that hasn't been flushed
+// yet, and collects its results for writing to a sink.
+func (db *DB) queryForSink(name string, sqlString string, timeout time.Duration, runAt time.Time) (*ScheduledResult, error) {
+	if timeout <= 0 {
+		timeout = defaultScheduleTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	source, err := db.Query(sqlString, false, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	result := &ScheduledResult{Name: name, RunAt: runAt}
+	err = source.Iterate(ctx, func(fields core.Fields) error {
+		result.Fields = fields.Names()
+		return nil
+	}, func(row *core.FlatRow) (bool, error) {
+		vals := make(map[string]interface{}, len(result.Fields))
+		for i, name := range result.Fields {
+			val := row.Values[i]
+			if math.IsNaN(val) || math.IsInf(val, 0) {
+				vals[name] = nil
+			} else {
+				vals[name] = val
+			}
+		}
+		result.Rows = append(result.Rows, &ScheduledRow{
+			Time: encoding.TimeFromInt(row.TS).In(time.UTC),
+			Dims: row.Key.AsMap(),
+			Vals: vals,
+			row:  row,
+		})
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (sq *scheduledQuery) setNextRun(now time.Time) time.Time {
+	next := sq.schedule.next(now)
+	sq.mx.Lock()
+	sq.status.NextRun = next
+	sq.mx.Unlock()
+	return next
+}
+
+// ScheduleStatuses returns the status of every scheduled query, ordered by
+// name.
+func (db *DB) ScheduleStatuses() []*ScheduleStatus {
+	statuses := make([]*ScheduleStatus, 0, len(db.scheduledQueries))
+	for _, sq := range db.scheduledQueries {
+		sq.mx.Lock()
+		status := sq.status
+		sq.mx.Unlock()
+		statuses = append(statuses, &status)
+	}
+	return statuses
+}
+
+// tableSink inserts results into a stream.
+type tableSink struct {
+	db     *DB
+	stream string
+}
+
+func (s *tableSink) write(result *ScheduledResult) error {
+	for _, r := range result.Rows {
+		vals := make(map[string]float64, len(result.Fields))
+		for i, name := range result.Fields {
+			val := r.row.Values[i]
+			if !math.IsNaN(val) && !math.IsInf(val, 0) {
+				vals[name] = val
+			}
+		}
+		err := s.db.InsertRaw(s.stream, r.Time, r.row.Key, bytemap.NewFloat(vals))
+		if err != nil {
+			return fmt.Errorf("Unable to insert into %v: %v", s.stream, err)
+		}
+	}
+	return nil
+}
+
+// webhookSink POSTs the results as JSON.
+type webhookSink struct {
+	url string
+}
+
+func (s *webhookSink) write(result *ScheduledResult) error {
+	b, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return postSink(s.url, "application/json", b)
+}
+
+// kafkaSink produces one record per row to a Kafka topic through a Kafka REST
+// proxy.
+type kafkaSink struct {
+	url   string
+	topic string
+}
+
+type kafkaRecord struct {
+	Key   string        `json:"key"`
+	Value *ScheduledRow `json:"value"`
+}
+
+func (s *kafkaSink) write(result *ScheduledResult) error {
+	if len(result.Rows) == 0 {
+		return nil
+	}
+	records := make([]*kafkaRecord, 0, len(result.Rows))
+	for _, row := range result.Rows {
+		records = append(records, &kafkaRecord{result.Name, row})
+	}
+	b, err := json.Marshal(map[string]interface{}{"records": records})
+	if err != nil {
+		return err
+	}
+	return postSink(fmt.Sprintf("%v/topics/%v", strings.TrimRight(s.url, "/"), s.topic), contentTypeKafkaJSON, b)
+}
+
+func postSink(url string, contentType string, body []byte) error {
+	client := &http.Client{Timeout: sinkHTTPTimeout}
+	resp, err := client.Post(url, contentType, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Unable to post to %v: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Unexpected response status %d posting to %v: %v", resp.StatusCode, url, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// fileSink appends results to a file.
+type fileSink struct {
+	path   string
+	format string
+}
+
+func (s *fileSink) write(result *ScheduledResult) error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to open %v: %v", s.path, err)
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("Unable to stat %v: %v", s.path, err)
+	}
+
+	if s.format == formatNDJSON {
+		enc := json.NewEncoder(file)
+		for _, row := range result.Rows {
+			err = enc.Encode(row)
+			if err != nil {
+				return fmt.Errorf("Unable to write to %v: %v", s.path, err)
+			}
+		}
+		return nil
+	}
+
+	dims := make(map[string]bool)
+	for _, row := range result.Rows {
+		for dim := range row.Dims {
+			dims[dim] = true
+		}
+	}
+	dimNames := make([]string, 0, len(dims))
+	for dim := range dims {
+		dimNames = append(dimNames, dim)
+	}
+	sort.Strings(dimNames)
+	dw, err := common.NewDelimitedWriter(file, s.format, result.Fields, dimNames, fi.Size() == 0)
+	if err != nil {
+		return err
+	}
+	for _, row := range result.Rows {
+		err = dw.WriteRow(row.row.TS, row.row.Key, row.row.Values)
+		if err != nil {
+			return fmt.Errorf("Unable to write to %v: %v", s.path, err)
+		}
+	}
+	err = dw.Close()
+	if err != nil {
+		return fmt.Errorf("Unable to write to %v: %v", s.path, err)
+	}
+	return nil
+}
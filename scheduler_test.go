@@ -0,0 +1,165 @@
+package zenodb
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchedules(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var posted sync.Map
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/fail" {
+			http.Error(resp, "nope", http.StatusInternalServerError)
+			return
+		}
+		b, _ := ioutil.ReadAll(req.Body)
+		posted.Store(req.URL.Path, req.Header.Get("Content-Type")+" "+string(b))
+	}))
+	defer server.Close()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 0, 0, time.UTC)
+	clock := NewVirtualClock(epoch)
+	clock.Freeze()
+	ndjsonFile := filepath.Join(tmpDir, "results.ndjson")
+	csvFile := filepath.Join(tmpDir, "results.csv")
+	every := func(sink SinkOpts) *ScheduleOpts {
+		return &ScheduleOpts{Schedule: "@every 1m", SQL: "SELECT a FROM thetable", Sink: sink}
+	}
+	db, err := NewDB(&DBOpts{
+		Dir:   tmpDir,
+		Clock: clock,
+		Schema: Schema{
+			"thetable": &TableOpts{
+				RetentionPeriod: time.Hour,
+				SQL:             "SELECT SUM(a) AS a FROM inbound GROUP BY u, period(1m)",
+			},
+			"derived": &TableOpts{
+				RetentionPeriod: time.Hour,
+				SQL:             "SELECT SUM(a) AS a FROM rollup GROUP BY u, period(1m)",
+			},
+		},
+		Schedules: map[string]*ScheduleOpts{
+			"totable":   every(SinkOpts{Type: SinkTable, Stream: "rollup"}),
+			"towebhook": every(SinkOpts{Type: SinkWebhook, URL: server.URL + "/hook"}),
+			"tokafka":   every(SinkOpts{Type: SinkKafka, URL: server.URL, Topic: "reports"}),
+			"tondjson":  every(SinkOpts{Type: SinkFile, Path: ndjsonFile}),
+			"tocsv":     every(SinkOpts{Type: SinkFile, Path: csvFile, Format: "csv"}),
+			"failing":   every(SinkOpts{Type: SinkWebhook, URL: server.URL + "/fail"}),
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	_, err = db.newScheduledQueries(map[string]*ScheduleOpts{"bad": &ScheduleOpts{Schedule: "* * *", SQL: "SELECT a FROM thetable"}})
+	assert.Error(t, err, "invalid schedule should be rejected")
+	_, err = db.newScheduledQueries(map[string]*ScheduleOpts{"bad": every(SinkOpts{Type: "s3"})})
+	assert.Error(t, err, "unknown sink should be rejected")
+	_, err = db.newScheduledQueries(map[string]*ScheduleOpts{"bad": every(SinkOpts{Type: SinkFile, Path: csvFile, Format: "xlsx"})})
+	assert.Error(t, err, "unknown file format should be rejected")
+
+	db.Insert("inbound", epoch, map[string]interface{}{"u": "bob"}, map[string]float64{"a": 1})
+	waitFor(func() bool { return db.TableStats("thetable").InsertedPoints == 1 })
+	db.Insert("inbound", epoch, map[string]interface{}{"u": "alice"}, map[string]float64{"a": 2})
+	waitFor(func() bool { return db.TableStats("thetable").InsertedPoints == 2 })
+
+	// Make sure all schedules are waiting to run before advancing the clock
+	waitFor(func() bool {
+		for _, status := range db.ScheduleStatuses() {
+			if status.NextRun.IsZero() {
+				return false
+			}
+		}
+		return true
+	})
+	clock.Advance(epoch.Add(time.Minute))
+	waitFor(func() bool {
+		for _, status := range db.ScheduleStatuses() {
+			if status.Runs == 0 {
+				return false
+			}
+		}
+		return true
+	})
+
+	statuses := db.ScheduleStatuses()
+	if assert.Len(t, statuses, 6) {
+		assert.Equal(t, "failing", statuses[0].Name)
+		assert.EqualValues(t, 1, statuses[0].Failures)
+		assert.Contains(t, statuses[0].LastError, "500")
+		for _, status := range statuses[1:] {
+			assert.Empty(t, status.LastError, status.Name)
+			assert.Equal(t, 2, status.LastRows, status.Name)
+			assert.Equal(t, epoch.Add(2*time.Minute), status.NextRun.In(time.UTC), status.Name)
+		}
+	}
+
+	waitFor(func() bool { return db.TableStats("derived").InsertedPoints == 2 })
+	assert.Equal(t, map[string]float64{"bob": 1, "alice": 2}, sumsBy(t, db, "derived", "u", "a"), "table sink should insert results into stream")
+
+	hook, _ := posted.Load("/hook")
+	if assert.NotNil(t, hook) {
+		parts := strings.SplitN(hook.(string), " ", 2)
+		assert.Equal(t, "application/json", parts[0])
+		result := &ScheduledResult{}
+		if assert.NoError(t, json.Unmarshal([]byte(parts[1]), result)) {
+			assert.Equal(t, "towebhook", result.Name)
+			assert.Equal(t, []string{"a"}, result.Fields)
+			assert.Len(t, result.Rows, 2)
+		}
+	}
+
+	kafka, _ := posted.Load("/topics/reports")
+	if assert.NotNil(t, kafka) {
+		parts := strings.SplitN(kafka.(string), " ", 2)
+		assert.Equal(t, contentTypeKafkaJSON, parts[0])
+		var records struct {
+			Records []struct {
+				Key   string
+				Value *ScheduledRow
+			}
+		}
+		if assert.NoError(t, json.Unmarshal([]byte(parts[1]), &records)) && assert.Len(t, records.Records, 2) {
+			assert.Equal(t, "tokafka", records.Records[0].Key)
+			assert.Equal(t, epoch, records.Records[0].Value.Time)
+		}
+	}
+
+	b, err := ioutil.ReadFile(ndjsonFile)
+	if assert.NoError(t, err) {
+		lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+		if assert.Len(t, lines, 2) {
+			row := &ScheduledRow{}
+			if assert.NoError(t, json.Unmarshal([]byte(lines[0]), row)) {
+				assert.Contains(t, []interface{}{"bob", "alice"}, row.Dims["u"])
+				assert.NotNil(t, row.Vals["a"])
+			}
+		}
+	}
+
+	b, err = ioutil.ReadFile(csvFile)
+	if assert.NoError(t, err) {
+		lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+		if assert.Len(t, lines, 3) {
+			assert.Equal(t, "time,a,u", lines[0])
+			assert.True(t, strings.HasPrefix(lines[1], "2015-01-01T02:03:00Z,"), lines[1])
+		}
+	}
+}
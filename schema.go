@@ -95,6 +95,7 @@ func (db *DB) ApplySchema(_schema Schema) error {
 	log.Debugf("Applying tables in order: %v", strings.Join(bd.names, ", "))
 	for _, opts := range bd.opts {
 		name := opts.Name
+		db.applyMigratedSQL(opts)
 		t := db.getTable(name)
 		tableType := "table"
 		if opts.View {
@@ -0,0 +1,380 @@
+package zenodb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/yaml"
+	"github.com/getlantern/zenodb/sql"
+)
+
+const (
+	// settingsFilename is the file in the db dir to which runtime settings are
+	// persisted so that they survive restarts.
+	settingsFilename = "_settings.yaml"
+)
+
+// tunable is a setting that's safe to change while the database is running.
+// Exactly one of applyDB, applyTable and applyTenant is set, depending on
+// what the setting applies to.
+type tunable struct {
+	parse       func(value string) (interface{}, error)
+	applyDB     func(opts *DBOpts, value interface{})
+	applyTable  func(opts *TableOpts, value interface{})
+	applyTenant func(opts *TenantOpts, value interface{})
+}
+
+var tunables = map[string]*tunable{
+	"clusterquerybuffersize": {
+		parse:   parsePositiveInt,
+		applyDB: func(opts *DBOpts, value interface{}) { opts.ClusterQueryBufferSize = value.(int) },
+	},
+	"clusterquerycachesize": {
+		parse:   parseCount,
+		applyDB: func(opts *DBOpts, value interface{}) { opts.ClusterQueryCacheSize = value.(int) },
+	},
+	"clusterquerytimeoutmargin": {
+		parse:   parseDuration,
+		applyDB: func(opts *DBOpts, value interface{}) { opts.ClusterQueryTimeoutMargin = value.(time.Duration) },
+	},
+	"maxarchivequeuedepth": {
+		parse:   parseCount,
+		applyDB: func(opts *DBOpts, value interface{}) { opts.MaxArchiveQueueDepth = int64(value.(int)) },
+	},
+	"maxflushbytespersecond": {
+		parse:   parseCount,
+		applyDB: func(opts *DBOpts, value interface{}) { opts.MaxFlushBytesPerSecond = int64(value.(int)) },
+	},
+	"maxfollowlag": {
+		parse:   parseDuration,
+		applyDB: func(opts *DBOpts, value interface{}) { opts.MaxFollowLag = value.(time.Duration) },
+	},
+	"retentionperiod": {
+		parse: func(value string) (interface{}, error) {
+			d, err := parseDuration(value)
+			if err == nil && d.(time.Duration) == 0 {
+				err = fmt.Errorf("must be positive")
+			}
+			return d, err
+		},
+		applyTable: func(opts *TableOpts, value interface{}) { opts.RetentionPeriod = value.(time.Duration) },
+	},
+	"maxdiskbytes": {
+		parse:      parseCount,
+		applyTable: func(opts *TableOpts, value interface{}) { opts.MaxDiskBytes = int64(value.(int)) },
+	},
+	"minflushlatency": {
+		parse:      parseDuration,
+		applyTable: func(opts *TableOpts, value interface{}) { opts.MinFlushLatency = value.(time.Duration) },
+	},
+	"maxflushlatency": {
+		parse: parseDuration,
+		applyTable: func(opts *TableOpts, value interface{}) {
+			opts.MaxFlushLatency = value.(time.Duration)
+			if opts.MaxFlushLatency == 0 {
+				opts.MaxFlushLatency = time.Duration(math.MaxInt64)
+			}
+		},
+	},
+	"flushjitter": {
+		parse:      parseDuration,
+		applyTable: func(opts *TableOpts, value interface{}) { opts.FlushJitter = value.(time.Duration) },
+	},
+	"maxconcurrentqueries": {
+		parse:       parseCount,
+		applyTenant: func(opts *TenantOpts, value interface{}) { opts.MaxConcurrentQueries = value.(int) },
+	},
+}
+
+// Set applies the settings from a SET statement, like
+//
+//	SET thetable.retentionperiod = '2h', clusterquerybuffersize = 500
+//
+// Database-wide settings are unqualified, table settings are qualified by the
+// table name and tenant settings by the tenant name. Settings take effect
+// immediately and are persisted in the db dir, taking precedence over the
+// DBOpts, schema and tenants on subsequent restarts. Either all of the
+// statement's settings are applied or none are.
+//
+// The following settings are supported:
+//
+//	clusterquerybuffersize  - DBOpts.ClusterQueryBufferSize
+//	clusterquerycachesize   - DBOpts.ClusterQueryCacheSize
+//	clusterquerytimeoutmargin - DBOpts.ClusterQueryTimeoutMargin
+//	maxarchivequeuedepth    - DBOpts.MaxArchiveQueueDepth
+//	maxflushbytespersecond  - DBOpts.MaxFlushBytesPerSecond
+//	maxfollowlag            - DBOpts.MaxFollowLag
+//	<table>.retentionperiod - TableOpts.RetentionPeriod
+//	<table>.maxdiskbytes    - TableOpts.MaxDiskBytes
+//	<table>.minflushlatency - TableOpts.MinFlushLatency
+//	<table>.maxflushlatency - TableOpts.MaxFlushLatency
+//	<table>.flushjitter     - TableOpts.FlushJitter
+//	<tenant>.maxconcurrentqueries - TenantOpts.MaxConcurrentQueries
+func (db *DB) Set(sqlString string) error {
+	if db.opts.ReadOnly {
+		return fmt.Errorf("Database is read-only")
+	}
+	settings, err := sql.ParseSet(sqlString)
+	if err != nil {
+		return err
+	}
+
+	db.settingsMx.Lock()
+	defer db.settingsMx.Unlock()
+
+	changes, err := db.prepareSettings(settings)
+	if err != nil {
+		return err
+	}
+	db.applySettings(settings, changes)
+	return db.saveSettings()
+}
+
+// prepareSettings validates the given settings and returns functions that
+// apply them.
+func (db *DB) prepareSettings(settings []*sql.Setting) ([]func(), error) {
+	changes := make([]func(), 0, len(settings))
+	for _, setting := range settings {
+		change, err := db.prepareSetting(setting.Qualifier, setting.Name, setting.Value)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// applySettings applies the changes returned by prepareSettings and records
+// the settings for saving. It must be called while holding settingsMx.
+func (db *DB) applySettings(settings []*sql.Setting, changes []func()) {
+	for i, change := range changes {
+		log.Debugf("Setting %v", settings[i])
+		change()
+		db.settings[settingKey(settings[i].Qualifier, settings[i].Name)] = settings[i].Value
+	}
+}
+
+// prepareSetting validates the given setting and returns a function that
+// applies it.
+func (db *DB) prepareSetting(qualifier string, name string, value string) (func(), error) {
+	tun, parsed, err := parseSetting(qualifier, name, value)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case tun.applyDB != nil:
+		return func() {
+			db.tunablesMx.Lock()
+			tun.applyDB(db.opts, parsed)
+			db.tunablesMx.Unlock()
+		}, nil
+	case tun.applyTenant != nil:
+		t := db.tenants[qualifier]
+		if t == nil {
+			return nil, fmt.Errorf("Tenant %v not found", qualifier)
+		}
+		return func() {
+			t.mx.Lock()
+			tun.applyTenant(t.opts, parsed)
+			t.mx.Unlock()
+		}, nil
+	default:
+		t, err := db.storingTable(qualifier)
+		if err != nil {
+			return nil, err
+		}
+		return func() {
+			t.tunablesMx.Lock()
+			tun.applyTable(t.TableOpts, parsed)
+			minFlushLatency, maxFlushLatency, flushJitter := t.MinFlushLatency, t.MaxFlushLatency, t.FlushJitter
+			t.tunablesMx.Unlock()
+			t.rowStore.updateFlushLatencies(minFlushLatency, maxFlushLatency, flushJitter)
+		}, nil
+	}
+}
+
+// parseSetting looks up the tunable for the given setting and parses its
+// value.
+func parseSetting(qualifier string, name string, value string) (*tunable, interface{}, error) {
+	key := settingKey(qualifier, name)
+	tun := tunables[name]
+	if tun == nil {
+		return nil, nil, fmt.Errorf("Unknown setting %v, supported settings are %v", key, strings.Join(supportedSettings(), ", "))
+	}
+	if tun.applyDB != nil && qualifier != "" {
+		return nil, nil, fmt.Errorf("Setting %v applies to the whole database and must not be qualified", key)
+	}
+	if tun.applyDB == nil && qualifier == "" {
+		return nil, nil, fmt.Errorf("Setting %v must be qualified by a table or tenant", key)
+	}
+	parsed, err := tun.parse(value)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid value for %v: %v", key, err)
+	}
+	return tun, parsed, nil
+}
+
+// loadSettings loads previously persisted settings, applying database and
+// tenant settings immediately. Table settings are applied as tables are
+// created.
+func (db *DB) loadSettings() error {
+	db.settings = make(map[string]string)
+	b, err := ioutil.ReadFile(filepath.Join(db.opts.Dir, settingsFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("Unable to read settings: %v", err)
+	}
+	err = yaml.Unmarshal(b, &db.settings)
+	if err != nil {
+		return fmt.Errorf("Unable to parse settings: %v", err)
+	}
+	for key, value := range db.settings {
+		qualifier, name := splitSettingKey(key)
+		tun, parsed, err := parseSetting(qualifier, name, value)
+		if err != nil {
+			log.Errorf("Ignoring persisted setting: %v", err)
+			delete(db.settings, key)
+			continue
+		}
+		switch {
+		case tun.applyDB != nil:
+			tun.applyDB(db.opts, parsed)
+		case tun.applyTenant != nil:
+			t := db.tenants[qualifier]
+			if t == nil {
+				log.Errorf("Ignoring persisted setting %v for unknown tenant", key)
+				continue
+			}
+			tun.applyTenant(t.opts, parsed)
+		}
+	}
+	return nil
+}
+
+// applyTableSettings applies persisted settings to the opts of a table that's
+// being created.
+func (db *DB) applyTableSettings(opts *TableOpts) {
+	db.settingsMx.Lock()
+	defer db.settingsMx.Unlock()
+	for key, value := range db.settings {
+		qualifier, name := splitSettingKey(key)
+		if qualifier != strings.ToLower(opts.Name) {
+			continue
+		}
+		tun, parsed, err := parseSetting(qualifier, name, value)
+		if err != nil || tun.applyTable == nil {
+			continue
+		}
+		log.Debugf("Applying persisted setting %v = %v", key, value)
+		tun.applyTable(opts, parsed)
+	}
+}
+
+func (db *DB) saveSettings() error {
+	err := db.stageSettings(db.settings)
+	if err != nil {
+		return err
+	}
+	return commitFile(filepath.Join(db.opts.Dir, settingsFilename), "settings")
+}
+
+// stageSettings writes the given settings next to the settings file, from
+// where commitFile moves them into place.
+func (db *DB) stageSettings(settings map[string]string) error {
+	b, err := yaml.Marshal(settings)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal settings: %v", err)
+	}
+	return stageFile(filepath.Join(db.opts.Dir, settingsFilename), b, "settings")
+}
+
+// stageFile writes b to a temporary file next to filename, which commitFile
+// then atomically renames to filename.
+func stageFile(filename string, b []byte, what string) error {
+	err := ioutil.WriteFile(filename+".tmp", b, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to write %v: %v", what, err)
+	}
+	return nil
+}
+
+// commitFile replaces filename with what was staged for it by stageFile.
+func commitFile(filename string, what string) error {
+	err := os.Rename(filename+".tmp", filename)
+	if err != nil {
+		return fmt.Errorf("Unable to save %v: %v", what, err)
+	}
+	return nil
+}
+
+// unstageFile removes what was staged for filename by stageFile.
+func unstageFile(filename string) {
+	os.Remove(filename + ".tmp")
+}
+
+func settingKey(qualifier string, name string) string {
+	if qualifier == "" {
+		return name
+	}
+	return qualifier + "." + name
+}
+
+// splitSettingKey splits a key into its qualifier and name. Table names may
+// themselves contain dots, so the name is whatever follows the last dot.
+func splitSettingKey(key string) (string, string) {
+	idx := strings.LastIndex(key, ".")
+	if idx < 0 {
+		return "", key
+	}
+	return key[:idx], key[idx+1:]
+}
+
+func parseDuration(value string) (interface{}, error) {
+	d, err := sql.ParseDuration(value)
+	if err != nil {
+		return nil, err
+	}
+	if d < 0 {
+		return nil, fmt.Errorf("must not be negative")
+	}
+	return d, nil
+}
+
+func parseCount(value string) (interface{}, error) {
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, err
+	}
+	if i < 0 {
+		return nil, fmt.Errorf("must not be negative")
+	}
+	return i, nil
+}
+
+func parsePositiveInt(value string) (interface{}, error) {
+	i, err := parseCount(value)
+	if err == nil && i.(int) == 0 {
+		err = fmt.Errorf("must be positive")
+	}
+	return i, err
+}
+
+// supportedSettings lists the names of all supported settings.
+func supportedSettings() []string {
+	names := make([]string, 0, len(tunables))
+	for name := range tunables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,100 @@
+package zenodb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSettings(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	schema := func() Schema {
+		return Schema{
+			"thetable": &TableOpts{
+				MaxFlushLatency: time.Hour,
+				RetentionPeriod: time.Hour,
+				SQL:             "SELECT SUM(a) AS a FROM inbound GROUP BY x, period(1s)",
+			},
+		}
+	}
+	newDB := func(dir string) (*DB, error) {
+		return NewDB(&DBOpts{
+			Dir:    dir,
+			Schema: schema(),
+			Tenants: map[string]*TenantOpts{
+				"acme": &TenantOpts{MaxConcurrentQueries: 2},
+			},
+		})
+	}
+
+	db, err := newDB(tmpDir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	tbl := db.getTable("thetable")
+
+	assert.NoError(t, db.Set("SET thetable.retention_period = '2h', clusterquerybuffersize = 50, maxfollowlag = '1m', acme.maxconcurrentqueries = 4"))
+	assert.Equal(t, 2*time.Hour, tbl.retentionPeriod())
+	assert.Equal(t, 50, db.opts.ClusterQueryBufferSize)
+	assert.Equal(t, time.Minute, db.opts.MaxFollowLag)
+	assert.Equal(t, 4, db.tenants["acme"].opts.MaxConcurrentQueries)
+
+	db.Insert("inbound", time.Now(), map[string]interface{}{"x": 1}, map[string]float64{"a": 1})
+	waitFor(func() bool { return db.TableStats("thetable").ArchiveQueueDepth == 1 })
+	assert.NoError(t, db.Set("SET thetable.maxflushlatency = '50ms', thetable.flushjitter = '10ms'"))
+	assert.Equal(t, 10*time.Millisecond, tbl.FlushJitter)
+	waitFor(func() bool { return db.TableStats("thetable").DiskKeys == 1 })
+	assert.EqualValues(t, 1, db.TableStats("thetable").DiskKeys, "Shortening maxflushlatency should flush promptly")
+
+	for _, invalid := range []string{
+		"SET thetable.retentionperiod = '0s'",
+		"SET thetable.maxflushlatency = '-1s'",
+		"SET thetable.flushjitter = 'soon'",
+		"SET clusterquerybuffersize = 0",
+		"SET thetable.clusterquerybuffersize = 10",
+		"SET retentionperiod = '1h'",
+		"SET unknown.retentionperiod = '1h'",
+		"SET nobody.maxconcurrentqueries = 1",
+		"SET thetable.batchsize = 10",
+		"SET maxarchivequeuedepth = 'lots'",
+	} {
+		assert.Error(t, db.Set(invalid), invalid)
+	}
+	assert.Error(t, db.Set("SET maxarchivequeuedepth = 10, thetable.retentionperiod = '0s'"))
+	assert.EqualValues(t, 0, db.opts.MaxArchiveQueueDepth, "Failed statement should not apply any settings")
+
+	// Start a new database with the persisted settings
+	restartDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(restartDir)
+	b, err := ioutil.ReadFile(filepath.Join(tmpDir, settingsFilename))
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, ioutil.WriteFile(filepath.Join(restartDir, settingsFilename), b, 0644)) {
+		return
+	}
+	restarted, err := newDB(restartDir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer restarted.Close()
+	assert.Equal(t, 2*time.Hour, restarted.getTable("thetable").retentionPeriod(), "Settings should survive restart")
+	assert.Equal(t, 50*time.Millisecond, restarted.getTable("thetable").MaxFlushLatency, "Settings should take precedence over schema")
+	assert.Equal(t, 10*time.Millisecond, restarted.getTable("thetable").FlushJitter)
+	assert.Equal(t, 50, restarted.opts.ClusterQueryBufferSize)
+	assert.Equal(t, time.Minute, restarted.opts.MaxFollowLag)
+	assert.Equal(t, 4, restarted.tenants["acme"].opts.MaxConcurrentQueries)
+}
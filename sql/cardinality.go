@@ -0,0 +1,57 @@
+package sql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultCardinalityLimit is how many values per dimension SHOW CARDINALITY
+	// reports if it has no LIMIT.
+	DefaultCardinalityLimit = 10
+)
+
+// ShowCardinality is a SHOW CARDINALITY statement, like
+// SHOW CARDINALITY FOR thetable LIMIT 20.
+type ShowCardinality struct {
+	// Table is the table to report on, lowercased.
+	Table string
+	// Limit is how many of the values with the most keys to report per
+	// dimension.
+	Limit int
+}
+
+func (s *ShowCardinality) String() string {
+	return fmt.Sprintf("SHOW CARDINALITY FOR %v LIMIT %d", s.Table, s.Limit)
+}
+
+// IsShowCardinality indicates whether the given SQL is a SHOW CARDINALITY
+// statement rather than a query.
+func IsShowCardinality(sql string) bool {
+	fields := strings.Fields(sql)
+	return len(fields) > 1 && strings.EqualFold(fields[0], "show") && strings.EqualFold(fields[1], "cardinality")
+}
+
+// ParseShowCardinality parses a SHOW CARDINALITY statement.
+func ParseShowCardinality(sql string) (*ShowCardinality, error) {
+	fields := strings.Fields(strings.TrimRight(strings.TrimSpace(sql), ";"))
+	if (len(fields) != 4 && len(fields) != 6) || !IsShowCardinality(sql) || !strings.EqualFold(fields[2], "for") {
+		return nil, fmt.Errorf("Expected SHOW CARDINALITY FOR <table> [LIMIT <n>], not %v", sql)
+	}
+	s := &ShowCardinality{
+		Table: strings.ToLower(fields[3]),
+		Limit: DefaultCardinalityLimit,
+	}
+	if len(fields) == 6 {
+		if !strings.EqualFold(fields[4], "limit") {
+			return nil, fmt.Errorf("Expected LIMIT, not %v", fields[4])
+		}
+		limit, err := strconv.Atoi(fields[5])
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("Invalid LIMIT %v, expected a positive number", fields[5])
+		}
+		s.Limit = limit
+	}
+	return s, nil
+}
@@ -0,0 +1,30 @@
+package sql
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseShowCardinality(t *testing.T) {
+	assert.True(t, IsShowCardinality("  show CARDINALITY FOR thetable"))
+	assert.False(t, IsShowCardinality("SELECT * FROM cardinality"))
+	assert.False(t, IsShowCardinality("SHOW"))
+
+	s, err := ParseShowCardinality("SHOW CARDINALITY FOR Acme.TheTable;")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "acme.thetable", s.Table)
+		assert.Equal(t, DefaultCardinalityLimit, s.Limit)
+	}
+	s, err = ParseShowCardinality("show cardinality for thetable limit 3")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "SHOW CARDINALITY FOR thetable LIMIT 3", s.String())
+	}
+
+	_, err = ParseShowCardinality("SHOW CARDINALITY thetable")
+	assert.Error(t, err, "missing FOR should fail")
+	_, err = ParseShowCardinality("SHOW CARDINALITY FOR thetable LIMIT 0")
+	assert.Error(t, err, "non-positive LIMIT should fail")
+	_, err = ParseShowCardinality("SHOW CARDINALITY FOR thetable TOP 3")
+	assert.Error(t, err, "unknown clause should fail")
+}
@@ -0,0 +1,65 @@
+package sql
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/getlantern/goexpr"
+	"github.com/getlantern/sqlparser"
+)
+
+// Delete is a DELETE statement, like
+// DELETE FROM thetable WHERE user = 'bob'.
+type Delete struct {
+	// Table is the table from which to delete, lowercased and qualified with its
+	// tenant if it belongs to one.
+	Table string
+	// Where identifies the keys to delete by their dimensions.
+	Where goexpr.Expr
+	// WhereSQL is the WHERE clause as SQL.
+	WhereSQL string
+}
+
+func (d *Delete) String() string {
+	return fmt.Sprintf("DELETE FROM %v %v", d.Table, d.WhereSQL)
+}
+
+// IsDelete indicates whether the given SQL is a DELETE statement rather than a
+// query.
+func IsDelete(sql string) bool {
+	fields := strings.Fields(sql)
+	return len(fields) > 0 && strings.EqualFold(fields[0], "delete")
+}
+
+// ParseDelete parses a DELETE statement. The statement must have a WHERE
+// clause, since deleting everything from a table is almost certainly a
+// mistake, and may not use ORDER BY or LIMIT.
+func ParseDelete(sql string) (*Delete, error) {
+	parsed, err := sqlparser.Parse(sql)
+	if err != nil {
+		return nil, syntaxError(sql, sql, err)
+	}
+	stmt, ok := parsed.(*sqlparser.Delete)
+	if !ok {
+		return nil, fmt.Errorf("%v is not a DELETE statement", sql)
+	}
+	if stmt.Where == nil {
+		return nil, fmt.Errorf("DELETE requires a WHERE clause")
+	}
+	if len(stmt.OrderBy) > 0 || stmt.Limit != nil {
+		return nil, fmt.Errorf("DELETE does not support ORDER BY or LIMIT")
+	}
+	where, err := goExprFor(stmt.Where.Expr)
+	if err != nil {
+		return nil, err
+	}
+	table := strings.ToLower(string(stmt.Table.Name))
+	if len(stmt.Table.Qualifier) > 0 {
+		table = strings.ToLower(string(stmt.Table.Qualifier)) + "." + table
+	}
+	return &Delete{
+		Table:    table,
+		Where:    where,
+		WhereSQL: strings.TrimSpace(nodeToString(stmt.Where)),
+	}, nil
+}
@@ -0,0 +1,32 @@
+package sql
+
+import (
+	"testing"
+
+	"github.com/getlantern/bytemap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDelete(t *testing.T) {
+	assert.True(t, IsDelete("  delete FROM thetable WHERE user = 'bob'"))
+	assert.False(t, IsDelete("SELECT * FROM deleted"))
+	assert.False(t, IsDelete(""))
+
+	d, err := ParseDelete("DELETE FROM Acme.TheTable WHERE user = 'bob' AND country = 'es'")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "acme.thetable", d.Table)
+		assert.Equal(t, "where user = 'bob' and country = 'es'", d.WhereSQL)
+		assert.Equal(t, "DELETE FROM acme.thetable where user = 'bob' and country = 'es'", d.String())
+		assert.Equal(t, true, d.Where.Eval(bytemap.New(map[string]interface{}{"user": "bob", "country": "es"})))
+		assert.Equal(t, false, d.Where.Eval(bytemap.New(map[string]interface{}{"user": "bob", "country": "de"})))
+	}
+
+	_, err = ParseDelete("DELETE FROM thetable")
+	assert.Error(t, err, "DELETE without WHERE should fail")
+	_, err = ParseDelete("DELETE FROM thetable WHERE user = 'bob' LIMIT 5")
+	assert.Error(t, err, "DELETE with LIMIT should fail")
+	_, err = ParseDelete("SELECT * FROM thetable")
+	assert.Error(t, err, "Non-DELETE statement should fail")
+	_, err = Parse("DELETE FROM thetable WHERE user = 'bob'")
+	assert.Error(t, err, "Parsing DELETE as a query should fail")
+}
@@ -0,0 +1,175 @@
+package sql
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/getlantern/zenodb/common"
+)
+
+var (
+	// parserErrorRegex matches the errors of sqlparser, which look like
+	// "syntax error at position 13 near 'form'"
+	parserErrorRegex = regexp.MustCompile(`^(.*?) at position (\d+)(?: near '?(.*?)'?)?$`)
+)
+
+// syntaxError converts an error returned by sqlparser for withoutHints, which
+// is sql minus its hint comments, into a *common.SQLError that locates the
+// problem in sql.
+func syntaxError(sql string, withoutHints string, err error) error {
+	msg := err.Error()
+	sqlErr := &common.SQLError{Kind: common.ErrInvalidSQL, Msg: fmt.Sprintf("Error parsing %v: %v", sql, msg)}
+	match := parserErrorRegex.FindStringSubmatch(msg)
+	if match == nil {
+		return sqlErr
+	}
+	sqlErr.Msg = fmt.Sprintf("Error parsing %v: %v", sql, match[1])
+	position, _ := strconv.Atoi(match[2])
+	token := match[3]
+	// The position is where the tokenizer stopped, which is usually just past
+	// the offending token
+	offset := position - 1
+	if token != "" {
+		sqlErr.Token = token
+		end := position
+		if end > len(withoutHints) {
+			end = len(withoutHints)
+		}
+		if idx := strings.LastIndex(strings.ToLower(withoutHints[:end]), strings.ToLower(token)); idx >= 0 {
+			offset = idx
+		}
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	sqlErr.Line, sqlErr.Column = lineAndColumn(sql, originalOffset(sql, offset))
+	return sqlErr
+}
+
+// originalOffset maps an offset into the SQL returned by ExtractHints back to
+// the corresponding offset in the original sql, from which ExtractHints
+// replaced each hint comment with a single space.
+func originalOffset(sql string, offset int) int {
+	shift := 0
+	for _, loc := range hintCommentRegex.FindAllStringIndex(sql, -1) {
+		start := loc[0] - shift
+		if start >= offset {
+			break
+		}
+		shift += loc[1] - loc[0] - 1
+	}
+	return offset + shift
+}
+
+// lineAndColumn converts a byte offset into sql into a line and column, both
+// starting at 1.
+func lineAndColumn(sql string, offset int) (int, int) {
+	if offset > len(sql) {
+		offset = len(sql)
+	}
+	before := sql[:offset]
+	line := strings.Count(before, "\n") + 1
+	column := offset - strings.LastIndex(before, "\n")
+	return line, column
+}
+
+// Locate fills in the location of the Token of the given *common.SQLError
+// within sql if its location isn't known yet, for example for errors about
+// unknown tables that only come up while planning a query. Other errors are
+// returned unchanged.
+func Locate(err error, sql string) error {
+	sqlErr, ok := err.(*common.SQLError)
+	if !ok || sqlErr.Line > 0 || sqlErr.Token == "" {
+		return err
+	}
+	token := strings.ToLower(sqlErr.Token)
+	lowered := strings.ToLower(sql)
+	for from := 0; from < len(lowered); {
+		idx := strings.Index(lowered[from:], token)
+		if idx < 0 {
+			break
+		}
+		idx += from
+		end := idx + len(token)
+		if (idx == 0 || !isPlaceholderChar(lowered[idx-1])) && (end == len(lowered) || !isPlaceholderChar(lowered[end])) {
+			located := *sqlErr
+			located.Line, located.Column = lineAndColumn(sql, idx)
+			return &located
+		}
+		from = idx + 1
+	}
+	return err
+}
+
+// Suggest returns the candidates that name might be a misspelling of, closest
+// first. Names that are too short to tell whether they're misspelled get no
+// suggestions.
+func Suggest(name string, candidates []string) []string {
+	name = strings.ToLower(name)
+	maxDistance := len(name) / 3
+	if maxDistance > 3 {
+		maxDistance = 3
+	}
+	if maxDistance == 0 {
+		return nil
+	}
+	type suggestion struct {
+		name     string
+		distance int
+	}
+	var suggestions []suggestion
+	for _, candidate := range candidates {
+		candidate = strings.ToLower(candidate)
+		if candidate == name {
+			continue
+		}
+		if distance := editDistance(name, candidate); distance <= maxDistance {
+			suggestions = append(suggestions, suggestion{candidate, distance})
+		}
+	}
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].distance != suggestions[j].distance {
+			return suggestions[i].distance < suggestions[j].distance
+		}
+		return suggestions[i].name < suggestions[j].name
+	})
+	result := make([]string, 0, len(suggestions))
+	for _, s := range suggestions {
+		result = append(result, s.name)
+	}
+	return result
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func min3(a int, b int, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,77 @@
+package sql
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	. "github.com/getlantern/zenodb/expr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyntaxError(t *testing.T) {
+	sql := "SELECT *\nFORM thetable"
+	err := syntaxError(sql, sql, errors.New("syntax error at position 22 near 'thetable'"))
+	if assert.IsType(t, &common.SQLError{}, err) {
+		sqlErr := err.(*common.SQLError)
+		assert.Equal(t, common.ErrInvalidSQL, sqlErr.Kind)
+		assert.Equal(t, 2, sqlErr.Line)
+		assert.Equal(t, 6, sqlErr.Column)
+		assert.Equal(t, "thetable", sqlErr.Token)
+		assert.Equal(t, "Error parsing SELECT *\nFORM thetable: syntax error at line 2, column 6 near 'thetable'", sqlErr.Error())
+	}
+
+	hinted := "SELECT /*+ NO_CACHE */ * FORM thetable"
+	_, withoutHints, _ := ExtractHints(hinted)
+	err = syntaxError(hinted, withoutHints, errors.New("syntax error at position 24 near 'thetable'"))
+	assert.Equal(t, 31, err.(*common.SQLError).Column, "column should account for hints")
+
+	err = syntaxError(sql, sql, errors.New("something unexpected"))
+	assert.Equal(t, 0, err.(*common.SQLError).Line)
+	assert.Equal(t, "Error parsing SELECT *\nFORM thetable: something unexpected", err.Error())
+
+	_, err = Parse("SELECT * FROM thetable WHERE")
+	assert.Equal(t, common.ErrInvalidSQL, common.KindOf(err))
+}
+
+func TestSuggest(t *testing.T) {
+	candidates := []string{"errors", "requests", "error_rate", "bytes"}
+	assert.Equal(t, []string{"errors"}, Suggest("erors", candidates))
+	assert.Equal(t, []string{"requests"}, Suggest("REQUETSS", candidates))
+	assert.Empty(t, Suggest("latency", candidates))
+	assert.Empty(t, Suggest("b", []string{"a"}), "short names should get no suggestions")
+	assert.Empty(t, Suggest("errors", candidates), "exact matches aren't suggestions")
+}
+
+func TestLocate(t *testing.T) {
+	sql := "SELECT errors\nFROM errors_by_host, erors"
+	err := Locate(&common.SQLError{Kind: common.ErrUnknownTable, Msg: "Table erors not found", Token: "erors", Suggestions: []string{"errors"}}, sql)
+	assert.Equal(t, "Table erors not found at line 2, column 22 near 'erors', did you mean errors?", err.Error())
+
+	other := errors.New("other")
+	assert.Equal(t, other, Locate(other, sql))
+	notFound := &common.SQLError{Msg: "Unknown", Token: "missing"}
+	assert.Equal(t, notFound, Locate(notFound, sql))
+}
+
+func TestMisspelledField(t *testing.T) {
+	tableFields := core.Fields{core.NewField("errors", SUM("errors")), core.NewField("requests", SUM("requests"))}
+	q, err := Parse("SELECT SUM(erors) AS total, total / requests AS ratio FROM thetable")
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = q.Fields.Get(tableFields)
+	if assert.IsType(t, &common.SQLError{}, err) {
+		assert.Equal(t, []string{"errors"}, err.(*common.SQLError).Suggestions)
+	}
+
+	q, err = Parse("SELECT errors, latency AS l FROM thetable")
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = q.Fields.Get(tableFields)
+	assert.NoError(t, err, "fields that don't look like misspellings should be allowed")
+	_, err = q.Fields.Get(nil)
+	assert.NoError(t, err, "fields shouldn't be checked without known fields")
+}
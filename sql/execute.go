@@ -0,0 +1,174 @@
+package sql
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/getlantern/sqlparser"
+)
+
+// Execute is an EXECUTE statement that runs a saved query by name, like
+// EXECUTE errors_by_server WITH server = 'a', minerrors = 5.
+type Execute struct {
+	// Name is the name of the saved query, lowercased.
+	Name string
+	// Params are the values of the query's parameters keyed by their
+	// lowercased names, without quotes.
+	Params map[string]string
+}
+
+func (e *Execute) String() string {
+	if len(e.Params) == 0 {
+		return fmt.Sprintf("EXECUTE %v", e.Name)
+	}
+	names := make([]string, 0, len(e.Params))
+	for name := range e.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	assignments := make([]string, 0, len(names))
+	for _, name := range names {
+		assignments = append(assignments, fmt.Sprintf("%v = %v", name, Literal(e.Params[name])))
+	}
+	return fmt.Sprintf("EXECUTE %v WITH %v", e.Name, strings.Join(assignments, ", "))
+}
+
+// IsExecute indicates whether the given SQL is an EXECUTE statement rather
+// than a query.
+func IsExecute(sql string) bool {
+	fields := strings.Fields(sql)
+	return len(fields) > 0 && strings.EqualFold(fields[0], "execute")
+}
+
+// ParseExecute parses an EXECUTE statement.
+func ParseExecute(sql string) (*Execute, error) {
+	trimmed := strings.TrimRight(strings.TrimSpace(sql), ";")
+	fields := strings.Fields(trimmed)
+	if len(fields) < 2 || !IsExecute(sql) || (len(fields) > 2 && !strings.EqualFold(fields[2], "with")) || len(fields) == 3 {
+		return nil, fmt.Errorf("Expected EXECUTE <name> [WITH <param> = <value>, ...], not %v", sql)
+	}
+	e := &Execute{
+		Name:   strings.ToLower(fields[1]),
+		Params: make(map[string]string),
+	}
+	if len(fields) == 2 {
+		return e, nil
+	}
+
+	// The parameter assignments look just like the ones of a SET statement.
+	// Take them from the original SQL to preserve whitespace in their values.
+	assignments := trimmed
+	for _, field := range fields[:3] {
+		assignments = strings.TrimSpace(assignments)[len(field):]
+	}
+	parsed, err := sqlparser.Parse("SET " + assignments)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing parameters of %v: %v", sql, err)
+	}
+	stmt, ok := parsed.(*sqlparser.Set)
+	if !ok {
+		return nil, fmt.Errorf("Unable to parse parameters of %v", sql)
+	}
+	for _, assignment := range stmt.Exprs {
+		name := strings.ToLower(string(assignment.Name.Name))
+		if len(assignment.Name.Qualifier) > 0 {
+			return nil, fmt.Errorf("Parameter %v must not be qualified", nodeToString(assignment.Name))
+		}
+		switch v := assignment.Expr.(type) {
+		case sqlparser.StrVal:
+			e.Params[name] = string(v)
+		case sqlparser.NumVal:
+			e.Params[name] = string(v)
+		default:
+			return nil, fmt.Errorf("Value for %v must be a string or number, not %v", name, nodeToString(assignment.Expr))
+		}
+	}
+	return e, nil
+}
+
+// Literal renders the given value as a SQL literal, which is the value itself
+// for numbers and a quoted string for everything else.
+func Literal(value string) string {
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return value
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
+
+// Placeholders returns the lowercased names of the :name placeholders in the
+// given SQL, in the order in which they first appear.
+func Placeholders(sql string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	scanPlaceholders(sql, func(name string) string {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+		return ""
+	})
+	return names
+}
+
+// BindPlaceholders replaces the :name placeholders in the given SQL with the
+// values of the corresponding params, rendered as literals (see Literal).
+// Params are keyed by lowercased name. Placeholders within quoted strings are
+// left alone.
+func BindPlaceholders(sql string, params map[string]string) (string, error) {
+	var missing []string
+	bound := scanPlaceholders(sql, func(name string) string {
+		value, found := params[name]
+		if !found {
+			missing = append(missing, name)
+			return ""
+		}
+		return Literal(value)
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("Missing values for parameters %v", strings.Join(missing, ", "))
+	}
+	return bound, nil
+}
+
+// scanPlaceholders calls replace for every :name placeholder in sql outside of
+// quotes and returns sql with the placeholders replaced by the results.
+func scanPlaceholders(sql string, replace func(name string) string) string {
+	var result bytes.Buffer
+	var quote byte
+	for i := 0; i < len(sql); i++ {
+		c := sql[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && i+1 < len(sql) {
+				result.WriteByte(c)
+				i++
+				c = sql[i]
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == ':' && i+1 < len(sql) && isPlaceholderStart(sql[i+1]):
+			end := i + 1
+			for end < len(sql) && isPlaceholderChar(sql[end]) {
+				end++
+			}
+			result.WriteString(replace(strings.ToLower(sql[i+1 : end])))
+			i = end - 1
+			continue
+		}
+		result.WriteByte(c)
+	}
+	return result.String()
+}
+
+func isPlaceholderStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isPlaceholderChar(c byte) bool {
+	return isPlaceholderStart(c) || (c >= '0' && c <= '9')
+}
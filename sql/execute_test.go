@@ -0,0 +1,51 @@
+package sql
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseExecute(t *testing.T) {
+	assert.True(t, IsExecute("  execute errors_by_server"))
+	assert.False(t, IsExecute("SELECT * FROM execute"))
+
+	e, err := ParseExecute("EXECUTE Errors_By_Server;")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "errors_by_server", e.Name)
+		assert.Empty(t, e.Params)
+		assert.Equal(t, "EXECUTE errors_by_server", e.String())
+	}
+	e, err = ParseExecute(`execute errors_by_server with Server = 'it\'s', minerrors = 5`)
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]string{"server": "it's", "minerrors": "5"}, e.Params)
+		assert.Equal(t, `EXECUTE errors_by_server WITH minerrors = 5, server = 'it\'s'`, e.String())
+	}
+	e, err = ParseExecute("EXECUTE errors_by_path  WITH  path = '/a  b'")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "/a  b", e.Params["path"], "whitespace in values should be preserved")
+	}
+
+	_, err = ParseExecute("EXECUTE")
+	assert.Error(t, err, "missing name should fail")
+	_, err = ParseExecute("EXECUTE errors_by_server WITH")
+	assert.Error(t, err, "missing params should fail")
+	_, err = ParseExecute("EXECUTE errors_by_server USING server = 'a'")
+	assert.Error(t, err, "unknown clause should fail")
+	_, err = ParseExecute("EXECUTE errors_by_server WITH server = other")
+	assert.Error(t, err, "non-literal value should fail")
+}
+
+func TestBindPlaceholders(t *testing.T) {
+	sqlString := "SELECT errors FROM requests WHERE server = :server AND errors > :MinErrors AND path = ':notaparam' AND other = :server"
+	assert.Equal(t, []string{"server", "minerrors"}, Placeholders(sqlString))
+
+	bound, err := BindPlaceholders(sqlString, map[string]string{"server": "it's", "minerrors": "5"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, `SELECT errors FROM requests WHERE server = 'it\'s' AND errors > 5 AND path = ':notaparam' AND other = 'it\'s'`, bound)
+		_, err = Parse(bound)
+		assert.NoError(t, err, "bound query should parse")
+	}
+	_, err = BindPlaceholders(sqlString, map[string]string{"server": "a"})
+	assert.Error(t, err, "missing param should fail")
+}
@@ -0,0 +1,95 @@
+package sql
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+var (
+	hintCommentRegex = regexp.MustCompile(`(?s)/\*\+(.*?)\*/`)
+	hintRegex        = regexp.MustCompile(`([A-Za-z_]+)(?:\s*\(\s*([^)]*?)\s*\))?`)
+)
+
+// Hints override the planner's decisions for a single query. They're given in
+// a comment starting with /*+, like
+//
+//	SELECT /*+ NO_CACHE, PARALLEL(8), MAX_MEMORY(512MB) */ * FROM thetable
+type Hints struct {
+	// NoCache makes the web API run the query even if it has cached results and
+	// makes a clustered query bypass the leader's cache of follower results.
+	NoCache bool
+	// Parallel limits how many partitions a clustered query reads at once. 0
+	// means all of them.
+	Parallel int
+	// MaxMemory limits how many bytes the query may use for grouping rows. 0
+	// means unlimited.
+	MaxMemory int64
+}
+
+// ExtractHints finds the Hints in the given SQL and returns them along with
+// the SQL minus the hint comments. Unknown hints are an error.
+func ExtractHints(sql string) (*Hints, string, error) {
+	hints := &Hints{}
+	var parseErr error
+	stripped := hintCommentRegex.ReplaceAllStringFunc(sql, func(comment string) string {
+		if parseErr == nil {
+			parseErr = hints.parse(hintCommentRegex.FindStringSubmatch(comment)[1])
+		}
+		return " "
+	})
+	if parseErr != nil {
+		return nil, sql, parseErr
+	}
+	return hints, stripped, nil
+}
+
+func (h *Hints) parse(comment string) error {
+	remaining := hintRegex.ReplaceAllString(comment, "")
+	if strings.Trim(remaining, ", \t\r\n") != "" {
+		return fmt.Errorf("Unable to parse hints %v", strings.TrimSpace(comment))
+	}
+	for _, match := range hintRegex.FindAllStringSubmatch(comment, -1) {
+		name, arg := strings.ToUpper(match[1]), match[2]
+		switch name {
+		case "NO_CACHE":
+			h.NoCache = true
+		case "PARALLEL":
+			parallel, err := strconv.Atoi(arg)
+			if err != nil || parallel <= 0 {
+				return fmt.Errorf("PARALLEL requires a positive number of partitions, like PARALLEL(8), not %v", match[0])
+			}
+			h.Parallel = parallel
+		case "MAX_MEMORY":
+			maxMemory, err := humanize.ParseBytes(arg)
+			if err != nil || maxMemory == 0 {
+				return fmt.Errorf("MAX_MEMORY requires a size, like MAX_MEMORY(512MB), not %v", match[0])
+			}
+			h.MaxMemory = int64(maxMemory)
+		default:
+			return fmt.Errorf("Unknown hint %v", match[1])
+		}
+	}
+	return nil
+}
+
+// String renders the Hints as a hint comment, or "" if there aren't any.
+func (h *Hints) String() string {
+	var parts []string
+	if h.NoCache {
+		parts = append(parts, "NO_CACHE")
+	}
+	if h.Parallel > 0 {
+		parts = append(parts, fmt.Sprintf("PARALLEL(%d)", h.Parallel))
+	}
+	if h.MaxMemory > 0 {
+		parts = append(parts, fmt.Sprintf("MAX_MEMORY(%d)", h.MaxMemory))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("/*+ %v */", strings.Join(parts, ", "))
+}
@@ -0,0 +1,56 @@
+package sql
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractHints(t *testing.T) {
+	hints, stripped, err := ExtractHints("SELECT /*+ NO_CACHE, parallel( 8 ) MAX_MEMORY(512MB) */ * FROM thetable")
+	if assert.NoError(t, err) {
+		assert.Equal(t, &Hints{NoCache: true, Parallel: 8, MaxMemory: 512000000}, hints)
+		assert.Equal(t, "SELECT   * FROM thetable", stripped)
+		assert.Equal(t, "/*+ NO_CACHE, PARALLEL(8), MAX_MEMORY(512000000) */", hints.String())
+	}
+
+	hints, stripped, err = ExtractHints("SELECT * FROM thetable")
+	if assert.NoError(t, err) {
+		assert.Equal(t, &Hints{}, hints)
+		assert.Equal(t, "SELECT * FROM thetable", stripped)
+		assert.Empty(t, hints.String())
+	}
+
+	for _, bad := range []string{
+		"SELECT /*+ NO_SUCH_HINT */ * FROM thetable",
+		"SELECT /*+ PARALLEL(0) */ * FROM thetable",
+		"SELECT /*+ PARALLEL(x) */ * FROM thetable",
+		"SELECT /*+ MAX_MEMORY(lots) */ * FROM thetable",
+		"SELECT /*+ NO_CACHE; */ * FROM thetable",
+	} {
+		_, _, err = ExtractHints(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestParseHints(t *testing.T) {
+	q, err := Parse("SELECT /*+ MAX_MEMORY(1KB) */ * FROM thetable")
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 1000, q.Hints.MaxMemory)
+		assert.Contains(t, q.SQL, "/*+ MAX_MEMORY(1000) */ ", "Hints should be kept in the query's SQL")
+		reparsed, reparseErr := Parse(q.SQL)
+		if assert.NoError(t, reparseErr) {
+			assert.Equal(t, q.Hints, reparsed.Hints)
+		}
+	}
+
+	q, err = Parse("SELECT * FROM (SELECT /*+ PARALLEL(2) */ * FROM thetable)")
+	if assert.NoError(t, err) {
+		assert.Equal(t, &Hints{}, q.FromSubQuery.Hints, "Subqueries shouldn't have hints")
+	}
+
+	restricted, err := Restrict("SELECT /*+ NO_CACHE */ * FROM thetable", nil, "dc = 'eu'")
+	if assert.NoError(t, err) {
+		assert.Contains(t, restricted, "/*+ NO_CACHE */")
+	}
+}
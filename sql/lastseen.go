@@ -0,0 +1,53 @@
+package sql
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ShowLastSeen is a SHOW LAST SEEN statement, like
+// SHOW LAST SEEN FOR thetable OLDER THAN 10m.
+type ShowLastSeen struct {
+	// Table is the table to report on, lowercased.
+	Table string
+	// OlderThan limits the report to keys that haven't been seen for at least
+	// this long. 0 means all keys.
+	OlderThan time.Duration
+}
+
+func (s *ShowLastSeen) String() string {
+	if s.OlderThan <= 0 {
+		return fmt.Sprintf("SHOW LAST SEEN FOR %v", s.Table)
+	}
+	return fmt.Sprintf("SHOW LAST SEEN FOR %v OLDER THAN %v", s.Table, s.OlderThan)
+}
+
+// IsShowLastSeen indicates whether the given SQL is a SHOW LAST SEEN statement
+// rather than a query.
+func IsShowLastSeen(sql string) bool {
+	fields := strings.Fields(sql)
+	return len(fields) > 2 && strings.EqualFold(fields[0], "show") && strings.EqualFold(fields[1], "last") && strings.EqualFold(fields[2], "seen")
+}
+
+// ParseShowLastSeen parses a SHOW LAST SEEN statement.
+func ParseShowLastSeen(sql string) (*ShowLastSeen, error) {
+	fields := strings.Fields(strings.TrimRight(strings.TrimSpace(sql), ";"))
+	if (len(fields) != 5 && len(fields) != 8) || !IsShowLastSeen(sql) || !strings.EqualFold(fields[3], "for") {
+		return nil, fmt.Errorf("Expected SHOW LAST SEEN FOR <table> [OLDER THAN <duration>], not %v", sql)
+	}
+	s := &ShowLastSeen{
+		Table: strings.ToLower(fields[4]),
+	}
+	if len(fields) == 8 {
+		if !strings.EqualFold(fields[5], "older") || !strings.EqualFold(fields[6], "than") {
+			return nil, fmt.Errorf("Expected OLDER THAN, not %v %v", fields[5], fields[6])
+		}
+		olderThan, err := time.ParseDuration(strings.Trim(fields[7], "'"))
+		if err != nil || olderThan <= 0 {
+			return nil, fmt.Errorf("Invalid duration %v, expected a positive duration like 10m", fields[7])
+		}
+		s.OlderThan = olderThan
+	}
+	return s, nil
+}
@@ -0,0 +1,32 @@
+package sql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseShowLastSeen(t *testing.T) {
+	assert.True(t, IsShowLastSeen("  show LAST seen FOR thetable"))
+	assert.False(t, IsShowLastSeen("SHOW CARDINALITY FOR thetable"))
+	assert.False(t, IsShowLastSeen("SHOW LAST"))
+
+	s, err := ParseShowLastSeen("SHOW LAST SEEN FOR Acme.TheTable;")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "acme.thetable", s.Table)
+		assert.Zero(t, s.OlderThan)
+	}
+	s, err = ParseShowLastSeen("show last seen for thetable older than 10m")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 10*time.Minute, s.OlderThan)
+		assert.Equal(t, "SHOW LAST SEEN FOR thetable OLDER THAN 10m0s", s.String())
+	}
+
+	_, err = ParseShowLastSeen("SHOW LAST SEEN thetable")
+	assert.Error(t, err, "missing FOR should fail")
+	_, err = ParseShowLastSeen("SHOW LAST SEEN FOR thetable OLDER THAN ages")
+	assert.Error(t, err, "invalid duration should fail")
+	_, err = ParseShowLastSeen("SHOW LAST SEEN FOR thetable NEWER THAN 10m")
+	assert.Error(t, err, "unknown clause should fail")
+}
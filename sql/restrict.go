@@ -0,0 +1,294 @@
+package sql
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/getlantern/sqlparser"
+	"github.com/getlantern/zenodb/core"
+)
+
+// Restrict rewrites the given SQL so that every query in it that reads
+// directly from a table, including subqueries, only sees rows matching filter
+// and only sees the given dims. Queries that group by all dimensions are
+// changed to group by just the given dims. It returns an error if any of those
+// queries filters or groups on other dims. If dims is empty, all dims are
+// allowed. If filter is empty, rows aren't filtered.
+func Restrict(sql string, dims []string, filter string) (string, error) {
+	hints, withoutHints, err := ExtractHints(sql)
+	if err != nil {
+		return "", err
+	}
+	parsed, err := sqlparser.Parse(withoutHints)
+	if err != nil {
+		return "", syntaxError(sql, withoutHints, err)
+	}
+	stmt, ok := parsed.(*sqlparser.Select)
+	if !ok {
+		return "", fmt.Errorf("Only SELECT statements are supported")
+	}
+
+	r := &restriction{dims: dims}
+	if len(dims) > 0 {
+		r.allowedDims = make(map[string]bool, len(dims))
+		for _, dim := range dims {
+			r.allowedDims[strings.ToLower(dim)] = true
+		}
+	}
+	if filter != "" {
+		r.filter, err = parseFilter(filter)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = r.apply(stmt)
+	if err != nil {
+		return "", err
+	}
+	if hintsSQL := hints.String(); hintsSQL != "" {
+		return fmt.Sprintf("%v %v", hintsSQL, nodeToString(stmt)), nil
+	}
+	return nodeToString(stmt), nil
+}
+
+// ValidateFilter checks that the given filter is a valid boolean expression for
+// use with Restrict.
+func ValidateFilter(filter string) error {
+	_, err := parseFilter(filter)
+	return err
+}
+
+func parseFilter(filter string) (sqlparser.BoolExpr, error) {
+	parsed, err := sqlparser.Parse(fmt.Sprintf("SELECT * FROM whatever WHERE %v", filter))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse filter %v: %v", filter, err)
+	}
+	where := parsed.(*sqlparser.Select).Where.Expr
+	_, err = goExprFor(where)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid filter %v: %v", filter, err)
+	}
+	return where, nil
+}
+
+type restriction struct {
+	dims        []string
+	allowedDims map[string]bool
+	filter      sqlparser.BoolExpr
+}
+
+func (r *restriction) apply(stmt *sqlparser.Select) error {
+	if stmt.Where != nil {
+		err := r.applyToSubQueries(stmt.Where.Expr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if aliased, ok := stmt.From[0].(*sqlparser.AliasedTableExpr); ok {
+		if sq, ok := aliased.Expr.(*sqlparser.Subquery); ok {
+			// Only the innermost query reads from the table
+			sel, ok := sq.Select.(*sqlparser.Select)
+			if !ok {
+				return fmt.Errorf("Subquery requires a SELECT statement")
+			}
+			return r.apply(sel)
+		}
+	}
+
+	if r.allowedDims != nil {
+		err := r.checkDims(stmt)
+		if err != nil {
+			return err
+		}
+		r.restrictGroupByAll(stmt)
+	}
+
+	if r.filter != nil {
+		filter := &sqlparser.ParenBoolExpr{Expr: r.filter}
+		if stmt.Where == nil {
+			stmt.Where = sqlparser.NewWhere(sqlparser.AST_WHERE, filter)
+		} else {
+			stmt.Where.Expr = &sqlparser.AndExpr{Left: &sqlparser.ParenBoolExpr{Expr: stmt.Where.Expr}, Right: filter}
+		}
+	}
+
+	return nil
+}
+
+// applyToSubQueries restricts subqueries like the one in
+// dim IN (SELECT dim FROM table).
+func (r *restriction) applyToSubQueries(_e sqlparser.BoolExpr) error {
+	switch e := _e.(type) {
+	case *sqlparser.AndExpr:
+		err := r.applyToSubQueries(e.Left)
+		if err != nil {
+			return err
+		}
+		return r.applyToSubQueries(e.Right)
+	case *sqlparser.OrExpr:
+		err := r.applyToSubQueries(e.Left)
+		if err != nil {
+			return err
+		}
+		return r.applyToSubQueries(e.Right)
+	case *sqlparser.ParenBoolExpr:
+		return r.applyToSubQueries(e.Expr)
+	case *sqlparser.NotExpr:
+		return r.applyToSubQueries(e.Expr)
+	case *sqlparser.ComparisonExpr:
+		sq, ok := e.Right.(*sqlparser.Subquery)
+		if !ok {
+			return nil
+		}
+		sel, ok := sq.Select.(*sqlparser.Select)
+		if !ok {
+			return fmt.Errorf("Subquery requires a SELECT statement")
+		}
+		return r.apply(sel)
+	}
+	return nil
+}
+
+func (r *restriction) checkDims(stmt *sqlparser.Select) error {
+	var params []string
+	if stmt.Where != nil {
+		where, err := goExprFor(stmt.Where.Expr)
+		if err != nil {
+			return err
+		}
+		where.WalkParams(func(param string) {
+			params = append(params, param)
+		})
+	}
+
+	for _, e := range stmt.GroupBy {
+		nse, ok := e.(*sqlparser.NonStarExpr)
+		if !ok {
+			continue
+		}
+		fn, ok := nse.Expr.(*sqlparser.FuncExpr)
+		if ok && (strings.EqualFold("PERIOD", string(fn.Name)) || strings.EqualFold("STRIDE", string(fn.Name))) {
+			continue
+		}
+		groupBy, err := goExprFor(nse.Expr)
+		if err != nil {
+			return err
+		}
+		groupBy.WalkParams(func(param string) {
+			params = append(params, param)
+		})
+	}
+
+	// IF conditions in fields are evaluated against dims too
+	for _, e := range stmt.SelectExprs {
+		nse, ok := e.(*sqlparser.NonStarExpr)
+		if ok {
+			err := walkIfConditions(nse.Expr, &params)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if stmt.Having != nil {
+		err := walkIfConditions(stmt.Having.Expr, &params)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, param := range params {
+		// Time dims are derived from timestamps, so they don't reveal anything
+		if !r.allowedDims[strings.ToLower(param)] && !core.IsTimeDim(param) {
+			return fmt.Errorf("Access to dimension %v is not allowed", param)
+		}
+	}
+	return nil
+}
+
+func walkIfConditions(_e sqlparser.Expr, params *[]string) error {
+	switch e := _e.(type) {
+	case *sqlparser.FuncExpr:
+		for i, arg := range e.Exprs {
+			nse, ok := arg.(*sqlparser.NonStarExpr)
+			if !ok {
+				continue
+			}
+			if i == 0 && strings.EqualFold("IF", string(e.Name)) {
+				cond, err := goExprFor(nse.Expr)
+				if err != nil {
+					return err
+				}
+				cond.WalkParams(func(param string) {
+					*params = append(*params, param)
+				})
+				continue
+			}
+			err := walkIfConditions(nse.Expr, params)
+			if err != nil {
+				return err
+			}
+		}
+	case *sqlparser.BinaryExpr:
+		err := walkIfConditions(e.Left, params)
+		if err != nil {
+			return err
+		}
+		return walkIfConditions(e.Right, params)
+	case *sqlparser.ComparisonExpr:
+		err := walkIfConditions(e.Left, params)
+		if err != nil {
+			return err
+		}
+		return walkIfConditions(e.Right, params)
+	case *sqlparser.AndExpr:
+		err := walkIfConditions(e.Left, params)
+		if err != nil {
+			return err
+		}
+		return walkIfConditions(e.Right, params)
+	case *sqlparser.OrExpr:
+		err := walkIfConditions(e.Left, params)
+		if err != nil {
+			return err
+		}
+		return walkIfConditions(e.Right, params)
+	case *sqlparser.ParenBoolExpr:
+		return walkIfConditions(e.Expr, params)
+	case *sqlparser.NotExpr:
+		return walkIfConditions(e.Expr, params)
+	case sqlparser.ValTuple:
+		for _, ve := range e {
+			err := walkIfConditions(ve, params)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// restrictGroupByAll replaces an implicit or explicit GROUP BY * with a GROUP
+// BY on the allowed dims.
+func (r *restriction) restrictGroupByAll(stmt *sqlparser.Select) {
+	groupByDims := make(sqlparser.GroupBy, 0, len(r.dims))
+	for _, dim := range r.dims {
+		groupByDims = append(groupByDims, &sqlparser.NonStarExpr{Expr: &sqlparser.ColName{Name: []byte(strings.ToLower(dim))}})
+	}
+
+	if len(stmt.GroupBy) == 0 {
+		stmt.GroupBy = groupByDims
+		return
+	}
+
+	groupBy := make(sqlparser.GroupBy, 0, len(stmt.GroupBy)+len(groupByDims))
+	for _, e := range stmt.GroupBy {
+		if _, ok := e.(*sqlparser.StarExpr); ok {
+			groupBy = append(groupBy, groupByDims...)
+			continue
+		}
+		groupBy = append(groupBy, e)
+	}
+	stmt.GroupBy = groupBy
+}
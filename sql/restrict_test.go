@@ -0,0 +1,50 @@
+package sql
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRestrict(t *testing.T) {
+	dims := []string{"a", "b"}
+	filter := "tenant_id = 5"
+
+	restricted, err := Restrict("SELECT * FROM thetable", dims, filter)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "select * from thetable where (tenant_id = 5) group by a, b", restricted)
+	}
+
+	restricted, err = Restrict("SELECT * FROM thetable WHERE a = 'x' OR b = 'y'", dims, filter)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "select * from thetable where (a = 'x' or b = 'y') and (tenant_id = 5) group by a, b", restricted)
+	}
+
+	restricted, err = Restrict("SELECT * FROM (SELECT * FROM thetable GROUP BY a) WHERE a IN (SELECT a FROM othertable)", nil, filter)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "select * from (select * from thetable where (tenant_id = 5) group by a) where a in (select a from othertable where (tenant_id = 5))", restricted)
+	}
+
+	restricted, err = Restrict("SELECT * FROM thetable GROUP BY b", dims, "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "select * from thetable group by b", restricted)
+	}
+
+	_, err = Restrict("SELECT * FROM thetable WHERE c = 1", dims, filter)
+	assert.Error(t, err, "Filtering on disallowed dim should fail")
+
+	_, err = Restrict("SELECT * FROM thetable GROUP BY a, c", dims, filter)
+	assert.Error(t, err, "Grouping on disallowed dim should fail")
+
+	_, err = Restrict("SELECT * FROM thetable GROUP BY a, _hour_of_day", dims, filter)
+	assert.NoError(t, err, "Grouping on time dims should be allowed")
+
+	_, err = Restrict("SELECT SUM(IF(c = 1, val)) AS val FROM thetable", dims, filter)
+	assert.Error(t, err, "Conditional field on disallowed dim should fail")
+
+	_, err = Restrict("SELECT * FROM (SELECT * FROM thetable WHERE c = 1)", dims, filter)
+	assert.Error(t, err, "Subquery on disallowed dim should fail")
+
+	assert.NoError(t, ValidateFilter(filter))
+	assert.Error(t, ValidateFilter("tenant_id = "))
+}
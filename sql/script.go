@@ -0,0 +1,74 @@
+package sql
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SplitStatements splits a script into its statements, which are separated by
+// semicolons. Semicolons in quoted strings don't separate statements and empty
+// statements are dropped.
+func SplitStatements(script string) []string {
+	var statements []string
+	var quote rune
+	escaped := false
+	start := 0
+	addStatement := func(end int) {
+		statement := strings.TrimSpace(script[start:end])
+		if statement != "" {
+			statements = append(statements, statement)
+		}
+	}
+	for i, r := range script {
+		switch {
+		case escaped:
+			escaped = false
+		case quote != 0 && r == '\\':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"' || r == '`':
+			quote = r
+		case r == ';':
+			addStatement(i)
+			start = i + 1
+		}
+	}
+	addStatement(len(script))
+	return statements
+}
+
+// IsScript indicates whether the given SQL consists of more than one
+// statement.
+func IsScript(sql string) bool {
+	return len(SplitStatements(sql)) > 1
+}
+
+// ParseScript splits a script into its statements, like SplitStatements. The
+// script may be wrapped in BEGIN (or START TRANSACTION) and COMMIT, which are
+// dropped since scripts are always applied as a whole.
+func ParseScript(script string) ([]string, error) {
+	statements := SplitStatements(script)
+	if len(statements) > 0 && IsBegin(statements[0]) {
+		if !strings.EqualFold(statements[len(statements)-1], "commit") {
+			return nil, fmt.Errorf("A script that begins a transaction must end with COMMIT")
+		}
+		statements = statements[1 : len(statements)-1]
+	}
+	for _, statement := range statements {
+		if IsBegin(statement) || strings.EqualFold(statement, "commit") || strings.EqualFold(statement, "rollback") {
+			return nil, fmt.Errorf("%v is only allowed to wrap a whole script", strings.ToUpper(statement))
+		}
+	}
+	if len(statements) == 0 {
+		return nil, fmt.Errorf("Script contains no statements")
+	}
+	return statements, nil
+}
+
+// IsBegin indicates whether the given statement is BEGIN or START TRANSACTION.
+func IsBegin(statement string) bool {
+	return strings.EqualFold(statement, "begin") || strings.EqualFold(strings.Join(strings.Fields(statement), " "), "start transaction")
+}
@@ -0,0 +1,40 @@
+package sql
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitStatements(t *testing.T) {
+	assert.Equal(t, []string{
+		"SET a = 'x;y'",
+		"DELETE FROM thetable WHERE u = 'it\\'s;'",
+		`SET b = "c;"`,
+	}, SplitStatements("SET a = 'x;y'; DELETE FROM thetable WHERE u = 'it\\'s;';\n\n SET b = \"c;\";;"))
+	assert.Empty(t, SplitStatements(" ; "))
+	assert.True(t, IsScript("SET a = 1; SET b = 2"))
+	assert.False(t, IsScript("SELECT * FROM thetable;"))
+}
+
+func TestParseScript(t *testing.T) {
+	statements, err := ParseScript("BEGIN; SET a = 1; SET b = 2; COMMIT;")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"SET a = 1", "SET b = 2"}, statements)
+	}
+	statements, err = ParseScript("start  transaction; SET a = 1; commit")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"SET a = 1"}, statements)
+	}
+
+	for _, bad := range []string{
+		"BEGIN; SET a = 1",
+		"SET a = 1; COMMIT",
+		"SET a = 1; ROLLBACK",
+		"BEGIN; COMMIT",
+		"",
+	} {
+		_, err = ParseScript(bad)
+		assert.Error(t, err, bad)
+	}
+}
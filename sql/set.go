@@ -0,0 +1,65 @@
+package sql
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/getlantern/sqlparser"
+)
+
+// Setting is a single assignment from a SET statement, like
+// SET thetable.retentionperiod = '2h'.
+type Setting struct {
+	// Qualifier is the table or tenant to which the setting applies, or "" for
+	// database-wide settings.
+	Qualifier string
+	// Name is the name of the setting, lowercased and with underscores removed,
+	// so that hot_period and hotPeriod are both read as hotperiod.
+	Name string
+	// Value is the assigned value as a string, without quotes.
+	Value string
+}
+
+func (s *Setting) String() string {
+	if s.Qualifier == "" {
+		return fmt.Sprintf("%v = %v", s.Name, s.Value)
+	}
+	return fmt.Sprintf("%v.%v = %v", s.Qualifier, s.Name, s.Value)
+}
+
+// IsSet indicates whether the given SQL is a SET statement rather than a
+// query.
+func IsSet(sql string) bool {
+	fields := strings.Fields(sql)
+	return len(fields) > 0 && strings.EqualFold(fields[0], "set")
+}
+
+// ParseSet parses a SET statement into its individual Settings.
+func ParseSet(sql string) ([]*Setting, error) {
+	parsed, err := sqlparser.Parse(sql)
+	if err != nil {
+		return nil, syntaxError(sql, sql, err)
+	}
+	stmt, ok := parsed.(*sqlparser.Set)
+	if !ok {
+		return nil, fmt.Errorf("%v is not a SET statement", sql)
+	}
+	settings := make([]*Setting, 0, len(stmt.Exprs))
+	for _, e := range stmt.Exprs {
+		var value string
+		switch v := e.Expr.(type) {
+		case sqlparser.StrVal:
+			value = string(v)
+		case sqlparser.NumVal:
+			value = string(v)
+		default:
+			return nil, fmt.Errorf("Value for %v must be a string or number, not %v", nodeToString(e.Name), nodeToString(e.Expr))
+		}
+		settings = append(settings, &Setting{
+			Qualifier: strings.ToLower(string(e.Name.Qualifier)),
+			Name:      strings.Replace(strings.ToLower(string(e.Name.Name)), "_", "", -1),
+			Value:     value,
+		})
+	}
+	return settings, nil
+}
@@ -0,0 +1,29 @@
+package sql
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSet(t *testing.T) {
+	assert.True(t, IsSet("  set thetable.retentionperiod = '2h'"))
+	assert.False(t, IsSet("SELECT * FROM settings"))
+	assert.False(t, IsSet(""))
+
+	settings, err := ParseSet("SET thetable.Retention_Period = '2h', clusterquerybuffersize = 500, acme.maxconcurrentqueries = 4")
+	if assert.NoError(t, err) && assert.Len(t, settings, 3) {
+		assert.Equal(t, &Setting{"thetable", "retentionperiod", "2h"}, settings[0])
+		assert.Equal(t, &Setting{"", "clusterquerybuffersize", "500"}, settings[1])
+		assert.Equal(t, &Setting{"acme", "maxconcurrentqueries", "4"}, settings[2])
+		assert.Equal(t, "thetable.retentionperiod = 2h", settings[0].String())
+		assert.Equal(t, "clusterquerybuffersize = 500", settings[1].String())
+	}
+
+	_, err = ParseSet("SELECT * FROM thetable")
+	assert.Error(t, err, "Non-SET statement should fail")
+	_, err = ParseSet("SET thetable.retentionperiod = otherthing")
+	assert.Error(t, err, "Non-literal value should fail")
+	_, err = Parse("SET thetable.retentionperiod = '2h'")
+	assert.Error(t, err, "Parsing SET as a query should fail")
+}
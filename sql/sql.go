@@ -16,20 +16,25 @@ import (
 	"github.com/getlantern/goexpr/geo"
 	"github.com/getlantern/goexpr/isp"
 	"github.com/getlantern/goexpr/redis"
-	"github.com/getlantern/golog"
 	"github.com/getlantern/sqlparser"
+	"github.com/getlantern/zenodb/common"
 	"github.com/getlantern/zenodb/core"
 	"github.com/getlantern/zenodb/expr"
+	"github.com/getlantern/zenodb/geodim"
+	"github.com/getlantern/zenodb/ipdim"
+	"github.com/getlantern/zenodb/logging"
 )
 
 var (
-	log = golog.LoggerFor("zenodb.sql")
+	log = logging.LoggerFor("zenodb.sql")
 )
 
 var (
 	ErrSelectNoName                  = errors.New("All expressions in SELECT must either reference a column name or include an AS alias")
 	ErrIfArity                       = errors.New("IF requires two parameters, like IF(dim = 1, SUM(b))")
 	ErrBoundedArity                  = errors.New("BOUNDED requires three parameters, like BOUNDED(b, 0, 100)")
+	ErrClampArity                    = errors.New("CLAMP requires three parameters, like CLAMP(b, 0, 100)")
+	ErrCoalesceArity                 = errors.New("COALESCE requires two parameters, like COALESCE(AVG(b), 0)")
 	ErrShiftArity                    = errors.New("SHIFT requires two parameters, like SHIFT(SUM(b), '-1h')")
 	ErrCrosshiftArity                = errors.New("CROSSHIFT requires three parameters, like CROSSHIFT(SUM(b), '1h', '-1d')")
 	ErrCrosshiftZeroCutoffOrInterval = errors.New("CROSSHIFT cutoff and interval must be non-zero")
@@ -43,15 +48,17 @@ var (
 )
 
 var aggregateFuncs = map[string]func(interface{}) expr.Expr{
-	"SUM":   expr.SUM,
-	"MIN":   expr.MIN,
-	"MAX":   expr.MAX,
-	"COUNT": expr.COUNT,
-	"AVG":   expr.AVG,
+	"SUM":     expr.SUM,
+	"MIN":     expr.MIN,
+	"MAX":     expr.MAX,
+	"COUNT":   expr.COUNT,
+	"COUNTER": expr.COUNTER,
+	"AVG":     expr.AVG,
 }
 
 var binaryAggregateFuncs = map[string]func(interface{}, interface{}) expr.Expr{
 	"WAVG": expr.WAVG,
+	"EWMA": expr.EWMA,
 }
 
 var operators = map[string]func(interface{}, interface{}) expr.Expr{
@@ -88,13 +95,15 @@ var unaryGoExpr = map[string]func(goexpr.Expr) goexpr.Expr{
 }
 
 var binaryGoExpr = map[string]func(goexpr.Expr, goexpr.Expr) goexpr.Expr{
-	"HGET":      redis.HGet,
-	"SISMEMBER": redis.SIsMember,
+	"HGET":           redis.HGet,
+	"SISMEMBER":      redis.SIsMember,
+	"GEOHASH_PREFIX": geodim.GEOHASH_PREFIX,
 }
 
 var ternaryGoExpr = map[string]func(goexpr.Expr, goexpr.Expr, goexpr.Expr) goexpr.Expr{
-	"SPLIT":  goexpr.Split,
-	"SUBSTR": goexpr.Substr,
+	"SPLIT":     goexpr.Split,
+	"SUBSTR":    goexpr.Substr,
+	"IP_PREFIX": ipdim.IP_PREFIX,
 }
 
 var varGoExpr = map[string]func(...goexpr.Expr) goexpr.Expr{
@@ -106,7 +115,24 @@ var varGoExpr = map[string]func(...goexpr.Expr) goexpr.Expr{
 		allExprs = append(allExprs, exprs...)
 		return goexpr.Concat(allExprs...)
 	},
-	"ANY": goexpr.Any,
+	"ANY":     goexpr.Any,
+	"IN_CIDR": ipdim.IN_CIDR,
+}
+
+// naryFunc is a function that takes a fixed number of parameters, for
+// functions with more parameters than fit the maps above
+type naryFunc struct {
+	params int
+	fn     func(...goexpr.Expr) goexpr.Expr
+}
+
+var naryGoExpr = map[string]naryFunc{
+	"GEO_DISTANCE": {4, func(p ...goexpr.Expr) goexpr.Expr {
+		return geodim.GEO_DISTANCE(p[0], p[1], p[2], p[3])
+	}},
+	"GEO_IN_BBOX": {6, func(p ...goexpr.Expr) goexpr.Expr {
+		return geodim.GEO_IN_BBOX(p[0], p[1], p[2], p[3], p[4], p[5])
+	}},
 }
 
 func RegisterUnaryDIMFunction(name string, fn func(goexpr.Expr) goexpr.Expr) error {
@@ -119,6 +145,20 @@ func RegisterUnaryDIMFunction(name string, fn func(goexpr.Expr) goexpr.Expr) err
 	return nil
 }
 
+// RegisterAggregateFunction makes the aggregate registered with
+// expr.RegisterAggregate under the given name available in SELECTs.
+func RegisterAggregateFunction(name string) error {
+	name = strings.ToUpper(name)
+	_, found := aggregateFuncs[name]
+	if found {
+		return fmt.Errorf("Aggregate %v already registered", name)
+	}
+	aggregateFuncs[name] = func(wrapped interface{}) expr.Expr {
+		return expr.Aggregate(name, wrapped)
+	}
+	return nil
+}
+
 var aliases = make(map[string]string)
 
 func RegisterAlias(alias string, template string) {
@@ -162,13 +202,18 @@ type Query struct {
 	Resolution   time.Duration
 	Where        goexpr.Expr
 	WhereSQL     string
-	AsOf         time.Time
-	AsOfOffset   time.Duration
-	Until        time.Time
-	UntilOffset  time.Duration
-	Stride       time.Duration
+	// PinnedDims are the dims that the WHERE clause restricts to a fixed set of
+	// values, like dc = 'eu' or dc IN ('eu', 'us'), keyed by dim.
+	PinnedDims  map[string][]string
+	AsOf        time.Time
+	AsOfOffset  time.Duration
+	Until       time.Time
+	UntilOffset time.Duration
+	Stride      time.Duration
 	// GroupBy are the GroupBy expressions ordered alphabetically by name.
-	GroupBy    []core.GroupBy
+	GroupBy []core.GroupBy
+	// GroupBySQL contains the SQL for each GroupBy expression, keyed by name.
+	GroupBySQL map[string]string
 	GroupByAll bool
 	// Crosstab is the goexpr.Expr used for crosstabs (goes into columns rather than rows)
 	Crosstab  goexpr.Expr
@@ -177,30 +222,56 @@ type Query struct {
 	OrderBy   []core.OrderBy
 	Offset    int
 	Limit     int
+	// Hints are the query's hints. Hints only apply to the top-level query, so
+	// they're empty for subqueries.
+	Hints *Hints
 }
 
 // TableFor returns the table in the FROM clause of this query
 func TableFor(sql string) (string, error) {
-	parsed, err := sqlparser.Parse(sql)
+	_, withoutHints, err := ExtractHints(sql)
 	if err != nil {
 		return "", err
 	}
+	parsed, err := sqlparser.Parse(withoutHints)
+	if err != nil {
+		return "", syntaxError(sql, withoutHints, err)
+	}
 	stmt := parsed.(*sqlparser.Select)
 	return strings.ToLower(nodeToString(stmt.From[0])), nil
 }
 
 // Parse parses a SQL statement and returns a corresponding *Query object.
 func Parse(sql string) (*Query, error) {
-	parsed, err := sqlparser.Parse(sql)
+	hints, withoutHints, err := ExtractHints(sql)
 	if err != nil {
-		return nil, fmt.Errorf("Error parsing %v: %v", sql, err)
+		return nil, err
+	}
+	parsed, err := sqlparser.Parse(withoutHints)
+	if err != nil {
+		return nil, syntaxError(sql, withoutHints, err)
 	}
-	return parse(parsed.(*sqlparser.Select))
+	stmt, ok := parsed.(*sqlparser.Select)
+	if !ok {
+		return nil, fmt.Errorf("%v is not a SELECT statement", sql)
+	}
+	q, err := parse(stmt)
+	if err != nil {
+		return nil, err
+	}
+	q.Hints = hints
+	if hintsSQL := hints.String(); hintsSQL != "" {
+		// Keep the hints so that they apply when the query is run elsewhere, like
+		// on followers
+		q.SQL = fmt.Sprintf("%v %v", hintsSQL, q.SQL)
+	}
+	return q, nil
 }
 
 func parse(stmt *sqlparser.Select) (*Query, error) {
 	q := &Query{
-		SQL: nodeToString(stmt),
+		SQL:   nodeToString(stmt),
+		Hints: &Hints{},
 	}
 	err := q.applyFrom(stmt)
 	if err != nil {
@@ -282,6 +353,9 @@ func (q *Query) checkForFields(stmt *sqlparser.Select) {
 type fielded struct {
 	fieldsMap map[string]core.Field
 	sql       string
+	// aliases are the names of the fields being defined. If set, references to
+	// unknown fields that look like misspellings of known fields are errors.
+	aliases map[string]bool
 }
 
 func (f *fielded) init(known core.Fields) {
@@ -291,6 +365,27 @@ func (f *fielded) init(known core.Fields) {
 	}
 }
 
+// checkKnown returns an error that suggests known fields if the named field is
+// unknown but looks like a misspelling of a known one. Other unknown fields are
+// allowed, since they've always been treated as fields of the stream.
+func (f *fielded) checkKnown(name string) error {
+	if f.aliases == nil || len(f.fieldsMap) == 0 || f.aliases[name] {
+		return nil
+	}
+	if _, found := f.fieldsMap[name]; found {
+		return nil
+	}
+	names := make([]string, 0, len(f.fieldsMap))
+	for known := range f.fieldsMap {
+		names = append(names, known)
+	}
+	suggestions := Suggest(name, names)
+	if len(suggestions) == 0 {
+		return nil
+	}
+	return &common.SQLError{Kind: common.ErrInvalidSQL, Msg: fmt.Sprintf("Unknown field %v", name), Token: name, Suggestions: suggestions}
+}
+
 func (f *fielded) String() string {
 	return f.sql
 }
@@ -302,6 +397,12 @@ type selectClause struct {
 
 func (s *selectClause) Get(known core.Fields) (core.Fields, error) {
 	s.init(known)
+	s.aliases = make(map[string]bool)
+	for _, _e := range s.stmt.SelectExprs {
+		if e, ok := _e.(*sqlparser.NonStarExpr); ok && len(e.As) > 0 {
+			s.aliases[strings.ToLower(string(e.As))] = true
+		}
+	}
 
 	var fields core.Fields
 	for _, _e := range s.stmt.SelectExprs {
@@ -461,6 +562,11 @@ func (q *Query) applyFrom(stmt *sqlparser.Select) error {
 			return nil
 		case *sqlparser.TableName:
 			q.From = strings.ToLower(string(e.Name))
+			if len(e.Qualifier) > 0 {
+				// Qualified names like tenant.table identify tables belonging to a
+				// tenant
+				q.From = strings.ToLower(string(e.Qualifier)) + "." + q.From
+			}
 			return nil
 		}
 	}
@@ -475,9 +581,104 @@ func (q *Query) applyWhere(stmt *sqlparser.Select) error {
 	log.Tracef("Applying where: %v", where)
 	q.Where = where
 	q.WhereSQL = strings.TrimSpace(nodeToString(stmt.Where))
+	q.PinnedDims = pinnedDims(stmt.Where.Expr)
 	return err
 }
 
+// pinnedDims finds the dims that the given boolean expression only allows to
+// take on specific string values. Rows with any other value for these dims
+// can't match the expression.
+func pinnedDims(_e sqlparser.Expr) map[string][]string {
+	switch e := _e.(type) {
+	case *sqlparser.AndExpr:
+		// Both sides have to match, so each side's pins apply
+		left := pinnedDims(e.Left)
+		right := pinnedDims(e.Right)
+		if left == nil {
+			return right
+		}
+		for dim, values := range right {
+			existing, found := left[dim]
+			if !found {
+				left[dim] = values
+				continue
+			}
+			var both []string
+			for _, value := range existing {
+				for _, other := range values {
+					if value == other {
+						both = append(both, value)
+						break
+					}
+				}
+			}
+			left[dim] = both
+		}
+		return left
+	case *sqlparser.OrExpr:
+		// Either side may match, so only dims pinned on both sides stay pinned
+		left := pinnedDims(e.Left)
+		right := pinnedDims(e.Right)
+		var result map[string][]string
+		for dim, values := range left {
+			others, found := right[dim]
+			if !found {
+				continue
+			}
+			if result == nil {
+				result = make(map[string][]string)
+			}
+			result[dim] = append(append([]string{}, values...), others...)
+		}
+		return result
+	case *sqlparser.ParenBoolExpr:
+		return pinnedDims(e.Expr)
+	case *sqlparser.ComparisonExpr:
+		switch strings.ToUpper(e.Operator) {
+		case "=":
+			dim, value, ok := pinnedDimAndValue(e.Left, e.Right)
+			if !ok {
+				dim, value, ok = pinnedDimAndValue(e.Right, e.Left)
+			}
+			if !ok {
+				return nil
+			}
+			return map[string][]string{dim: {value}}
+		case "IN":
+			col, ok := e.Left.(*sqlparser.ColName)
+			if !ok {
+				return nil
+			}
+			tuple, ok := e.Right.(sqlparser.ValTuple)
+			if !ok {
+				return nil
+			}
+			values := make([]string, 0, len(tuple))
+			for _, ve := range tuple {
+				value, ok := ve.(sqlparser.StrVal)
+				if !ok {
+					return nil
+				}
+				values = append(values, string(value))
+			}
+			return map[string][]string{strings.TrimSpace(strings.ToLower(string(col.Name))): values}
+		}
+	}
+	return nil
+}
+
+func pinnedDimAndValue(left sqlparser.Expr, right sqlparser.Expr) (string, string, bool) {
+	col, ok := left.(*sqlparser.ColName)
+	if !ok {
+		return "", "", false
+	}
+	value, ok := right.(sqlparser.StrVal)
+	if !ok {
+		return "", "", false
+	}
+	return strings.TrimSpace(strings.ToLower(string(col.Name))), string(value), true
+}
+
 func (q *Query) applyTimeRange(stmt *sqlparser.Select) error {
 	if stmt.TimeRange.From != "" {
 		t, d, err := stringToTimeOrDuration(stmt.TimeRange.From)
@@ -577,6 +778,10 @@ func (q *Query) applyGroupBy(stmt *sqlparser.Select) error {
 				}
 				groupBy[name] = core.NewGroupBy(name, ex)
 				groupByNames = append(groupByNames, name)
+				if q.GroupBySQL == nil {
+					q.GroupBySQL = make(map[string]string)
+				}
+				q.GroupBySQL[name] = nodeToString(nestedEx)
 			}
 		}
 	}
@@ -655,12 +860,15 @@ func (f *fielded) exprFor(_e sqlparser.Expr, defaultToSum bool) (interface{}, er
 		if fname == "IF" {
 			return f.ifExprFor(e, fname, defaultToSum)
 		}
-		if fname == "BOUNDED" {
+		if fname == "BOUNDED" || fname == "BOUND" || fname == "CLAMP" {
 			return f.boundedExprFor(e, fname, defaultToSum)
 		}
 		if fname == "SHIFT" {
 			return f.shiftExprFor(e, fname, defaultToSum)
 		}
+		if fname == "COALESCE" {
+			return f.coalesceExprFor(e, fname, defaultToSum)
+		}
 		switch len(e.Exprs) {
 		case 1:
 			return f.unaryFuncExprFor(e, fname, defaultToSum)
@@ -687,6 +895,15 @@ func (f *fielded) exprFor(_e sqlparser.Expr, defaultToSum bool) (interface{}, er
 		// TODO: make sure that we don't need to worry about parens in our
 		// expression tree
 		return f.exprFor(e.Expr, defaultToSum)
+	case *sqlparser.NullCheck:
+		wrapped, err := f.exprFor(e.Expr, defaultToSum)
+		if err != nil {
+			return nil, err
+		}
+		if "is not null" == e.Operator {
+			return expr.ISNOTNULL(wrapped), nil
+		}
+		return expr.ISNULL(wrapped), nil
 	case sqlparser.NumVal:
 		fl, _ := strconv.ParseFloat(nodeToString(_e), 64)
 		return expr.CONST(fl), nil
@@ -704,6 +921,11 @@ func (f *fielded) columnExprFor(e *sqlparser.ColName, defaultToSum bool) (interf
 		return expr.GT(core.PointsField.Expr, expr.CONST(0)), nil
 	}
 
+	err := f.checkKnown(name)
+	if err != nil {
+		return nil, err
+	}
+
 	// Default to a sum over the field
 	ex := expr.FIELD(name)
 	if !defaultToSum {
@@ -740,9 +962,15 @@ func (f *fielded) ifExprFor(e *sqlparser.FuncExpr, fname string, defaultToSum bo
 	return expr.IF(boolEx, valueEx), nil
 }
 
+// boundedExprFor handles BOUNDED (also available as BOUND) and CLAMP, which
+// take the same parameters.
 func (f *fielded) boundedExprFor(e *sqlparser.FuncExpr, fname string, defaultToSum bool) (interface{}, error) {
+	ctor, arityErr := expr.BOUNDED, ErrBoundedArity
+	if fname == "CLAMP" {
+		ctor, arityErr = expr.CLAMP, ErrClampArity
+	}
 	if len(e.Exprs) != 3 {
-		return nil, ErrBoundedArity
+		return nil, arityErr
 	}
 	param0, ok := e.Exprs[0].(*sqlparser.NonStarExpr)
 	if !ok {
@@ -762,13 +990,32 @@ func (f *fielded) boundedExprFor(e *sqlparser.FuncExpr, fname string, defaultToS
 	}
 	min, err := strconv.ParseFloat(nodeToString(param1.Expr), 64)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to parse min parameter to BOUNDED: %v", err)
+		return nil, fmt.Errorf("Unable to parse min parameter to %v: %v", fname, err)
 	}
 	max, err := strconv.ParseFloat(nodeToString(param2.Expr), 64)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to parse max parameter to BOUNDED: %v", err)
+		return nil, fmt.Errorf("Unable to parse max parameter to %v: %v", fname, err)
 	}
-	return expr.BOUNDED(wrapped, min, max), nil
+	return ctor(wrapped, min, max), nil
+}
+
+func (f *fielded) coalesceExprFor(e *sqlparser.FuncExpr, fname string, defaultToSum bool) (interface{}, error) {
+	if len(e.Exprs) != 2 {
+		return nil, ErrCoalesceArity
+	}
+	_valueEx, ok := e.Exprs[0].(*sqlparser.NonStarExpr)
+	if !ok {
+		return nil, ErrWildcardNotAllowed
+	}
+	valueEx, err := f.exprFor(_valueEx.Expr, defaultToSum)
+	if err != nil {
+		return nil, err
+	}
+	dflt, err := strconv.ParseFloat(nodeToString(e.Exprs[1]), 64)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse default parameter to COALESCE: %v", err)
+	}
+	return expr.COALESCE(valueEx, dflt), nil
 }
 
 func (f *fielded) shiftExprFor(e *sqlparser.FuncExpr, fname string, defaultToSum bool) (interface{}, error) {
@@ -1084,6 +1331,21 @@ func goFnExprFor(e *sqlparser.FuncExpr, fname string) (goexpr.Expr, error) {
 		}
 		return tfn(p0, p1, p2), nil
 	}
+	nary, found := naryGoExpr[fname]
+	if found {
+		if numParams != nary.params {
+			return nil, fmt.Errorf("Function %v requires %d parameters, not %d", fname, nary.params, numParams)
+		}
+		params := make([]goexpr.Expr, 0, numParams)
+		for i := 0; i < numParams; i++ {
+			param, err := paramGoExpr(e, i)
+			if err != nil {
+				return nil, err
+			}
+			params = append(params, param)
+		}
+		return nary.fn(params...), nil
+	}
 	vfn, found := varGoExpr[fname]
 	if found {
 		params := make([]goexpr.Expr, 0, numParams)
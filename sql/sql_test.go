@@ -374,6 +374,14 @@ FROM Table_A
 	assert.True(t, q.GroupByAll)
 }
 
+func TestQualifiedFrom(t *testing.T) {
+	q, err := Parse(`SELECT * FROM Acme.Table_A`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "acme.table_a", q.From)
+}
+
 func TestParseIt(t *testing.T) {
 	_, err := Parse(`select * from TableA  group by concat('_', ct1, concat('|', ct2)) as _crosstab`)
 	assert.NoError(t, err)
@@ -403,3 +411,95 @@ func (e *testexpr) WalkLists(cb func(goexpr.List)) {
 func (e *testexpr) String() string {
 	return fmt.Sprintf("TEST(%v)", e.val.String())
 }
+
+func TestPinnedDims(t *testing.T) {
+	for where, expected := range map[string]map[string][]string{
+		"dc = 'eu'":                             {"dc": {"eu"}},
+		"'eu' = DC":                             {"dc": {"eu"}},
+		"dc IN ('eu', 'us')":                    {"dc": {"eu", "us"}},
+		"dc IN ('eu', 'us') AND dc = 'us'":      {"dc": {"us"}},
+		"dc = 'eu' AND x = 'y'":                 {"dc": {"eu"}, "x": {"y"}},
+		"(dc = 'eu' AND x > 5) OR dc = 'us'":    {"dc": {"eu", "us"}},
+		"dc = 'eu' OR x = 'y'":                  nil,
+		"dc != 'eu'":                            nil,
+		"NOT dc = 'eu'":                         nil,
+		"dc = 5":                                nil,
+		"dc IN (SELECT dc FROM other)":          nil,
+		"dc LIKE 'eu%' AND server = 'a.eu.com'": {"server": {"a.eu.com"}},
+	} {
+		q, err := Parse("SELECT * FROM table_a WHERE " + where)
+		if assert.NoError(t, err, where) {
+			assert.Equal(t, expected, q.PinnedDims, where)
+		}
+	}
+
+	q, err := Parse("SELECT * FROM table_a")
+	if assert.NoError(t, err) {
+		assert.Nil(t, q.PinnedDims)
+	}
+}
+
+func TestGeoFunctions(t *testing.T) {
+	q, err := Parse(`SELECT * FROM Table_A WHERE GEO_IN_BBOX(lat, lon, 50, '-1', 52, 1) = true AND GEO_DISTANCE(lat, lon, 51.5, 0) < 100 GROUP BY GEOHASH_PREFIX(location, 4) AS cell`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, true, q.Where.Eval(goexpr.MapParams{"lat": 51.4, "lon": 0.1}))
+	assert.Equal(t, false, q.Where.Eval(goexpr.MapParams{"lat": 50.1, "lon": 0.9}), "in box but too far")
+	assert.Equal(t, false, q.Where.Eval(goexpr.MapParams{"lat": 51.4, "lon": 1.1}), "outside of box")
+	if assert.Len(t, q.GroupBy, 1) {
+		assert.Equal(t, "GEOHASH_PREFIX(location, 4)", q.GroupBy[0].Expr.String())
+	}
+
+	_, err = Parse(`SELECT * FROM Table_A WHERE GEO_IN_BBOX(lat, lon, 50, 52, 1) = true`)
+	assert.Error(t, err, "GEO_IN_BBOX requires 6 parameters")
+}
+
+func TestIPFunctions(t *testing.T) {
+	q, err := Parse(`SELECT * FROM Table_A WHERE IN_CIDR(ip, '10.0.0.0/8', '192.168.0.0/16') = true GROUP BY IP_PREFIX(ip, 24, 64) AS network`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, true, q.Where.Eval(goexpr.MapParams{"ip": "192.168.1.1"}))
+	assert.Equal(t, false, q.Where.Eval(goexpr.MapParams{"ip": "8.8.8.8"}))
+	if assert.Len(t, q.GroupBy, 1) {
+		assert.Equal(t, "10.1.2.0/24", q.GroupBy[0].Expr.Eval(goexpr.MapParams{"ip": "10.1.2.3"}))
+	}
+}
+
+func TestBoundAndClamp(t *testing.T) {
+	q, err := Parse(`SELECT SUM(BOUND(a, 0, 100)) AS bounded, MAX(CLAMP(b, 0, 10)) AS clamped FROM Table_A`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	fields, err := q.Fields.Get(nil)
+	if assert.NoError(t, err) && assert.Len(t, fields, 2) {
+		assert.Equal(t, core.NewField("bounded", SUM(BOUNDED("a", 0, 100))).String(), fields[0].String())
+		assert.Equal(t, core.NewField("clamped", MAX(CLAMP("b", 0, 10))).String(), fields[1].String())
+	}
+
+	q, err = Parse(`SELECT MAX(CLAMP(b, 0)) AS clamped FROM Table_A`)
+	if err == nil {
+		_, err = q.Fields.Get(nil)
+	}
+	assert.Equal(t, ErrClampArity, err)
+}
+
+func TestNulls(t *testing.T) {
+	q, err := Parse(`SELECT COALESCE(AVG(a), 0) AS avg_a, SUM(b) IS NULL AS no_b FROM Table_A HAVING AVG(a) IS NOT NULL`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	fields, err := q.Fields.Get(nil)
+	if assert.NoError(t, err) && assert.Len(t, fields, 3) {
+		assert.Equal(t, core.NewField("avg_a", COALESCE(AVG("a"), 0)).String(), fields[0].String())
+		assert.Equal(t, core.NewField("no_b", ISNULL(SUM("b"))).String(), fields[1].String())
+		assert.Equal(t, core.NewField(core.HavingFieldName, ISNOTNULL(AVG("a"))).String(), fields[2].String())
+	}
+
+	q, err = Parse(`SELECT COALESCE(AVG(a)) AS avg_a FROM Table_A`)
+	if err == nil {
+		_, err = q.Fields.Get(nil)
+	}
+	assert.Equal(t, ErrCoalesceArity, err)
+}
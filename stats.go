@@ -0,0 +1,82 @@
+package zenodb
+
+import (
+	"time"
+)
+
+const (
+	// StatsTable is the built-in table into which TableStats are recorded when
+	// DBOpts.RecordStats is enabled.
+	StatsTable = "_zeno_stats"
+
+	statsInterval        = 1 * time.Minute
+	statsRetentionPeriod = 7 * 24 * time.Hour
+)
+
+var statsTableSQL = `
+SELECT
+  MAX(memstore_bytes) AS memstore_bytes,
+  MAX(memstore_keys) AS memstore_keys,
+  MAX(memstore_sequences) AS memstore_sequences,
+  MAX(archive_queue_depth) AS archive_queue_depth,
+  MAX(disk_keys) AS disk_keys,
+  MAX(disk_bytes) AS disk_bytes,
+  MAX(filtered_points) AS filtered_points,
+  MAX(inserted_points) AS inserted_points,
+  MAX(dropped_points) AS dropped_points,
+  MAX(expired_values) AS expired_values,
+  MAX(flushes) AS flushes,
+  MAX(budget_evictions) AS budget_evictions
+FROM _zeno_stats
+GROUP BY table_name, period(1m)`
+
+// recordStats creates the StatsTable (unless the schema already defines it)
+// and starts recording the TableStats of all tables into it every minute.
+func (db *DB) recordStats() error {
+	if db.getTable(StatsTable) == nil {
+		err := db.CreateTable(&TableOpts{
+			Name:            StatsTable,
+			RetentionPeriod: statsRetentionPeriod,
+			MaxFlushLatency: 5 * statsInterval,
+			SQL:             statsTableSQL,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	go func() {
+		tk := db.clock.newTicker(statsInterval)
+		defer tk.Stop()
+		for range tk.C() {
+			db.insertStats(db.clock.Now())
+		}
+	}()
+	return nil
+}
+
+// insertStats inserts the current TableStats of every table into the
+// StatsTable, using the dimension table_name to identify the table.
+func (db *DB) insertStats(ts time.Time) {
+	for name, stats := range db.AllTableStats() {
+		err := db.Insert(StatsTable, ts, map[string]interface{}{
+			"table_name": name,
+		}, map[string]float64{
+			"memstore_bytes":      float64(stats.MemStoreBytes),
+			"memstore_keys":       float64(stats.MemStoreKeys),
+			"memstore_sequences":  float64(stats.MemStoreSequences),
+			"archive_queue_depth": float64(stats.ArchiveQueueDepth),
+			"disk_keys":           float64(stats.DiskKeys),
+			"disk_bytes":          float64(stats.DiskBytes),
+			"filtered_points":     float64(stats.FilteredPoints),
+			"inserted_points":     float64(stats.InsertedPoints),
+			"dropped_points":      float64(stats.DroppedPoints),
+			"expired_values":      float64(stats.ExpiredValues),
+			"flushes":             float64(stats.Flushes),
+			"budget_evictions":    float64(stats.BudgetEvictions),
+		})
+		if err != nil {
+			log.Errorf("Unable to record stats for %v: %v", name, err)
+		}
+	}
+}
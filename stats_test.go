@@ -0,0 +1,76 @@
+package zenodb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTableStatsAndRecordStats(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tmpFile, err := ioutil.TempFile("", "zenodbschema")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.Remove(tmpFile.Name())
+	err = ioutil.WriteFile(tmpFile.Name(), []byte(`
+thetable:
+  maxflushlatency: 1h
+  retentionperiod: 1h
+  sql: >
+    SELECT SUM(a) AS a, SUM(b) AS b
+    FROM inbound
+    GROUP BY x, period(1s)
+`), 0644)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	db, err := NewDB(&DBOpts{
+		Dir:         tmpDir,
+		SchemaFile:  tmpFile.Name(),
+		RecordStats: true,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	now := time.Now()
+	db.Insert("inbound", now, map[string]interface{}{"x": 1}, map[string]float64{"a": 1, "b": 1})
+	db.Insert("inbound", now, map[string]interface{}{"x": 1}, map[string]float64{"a": 1, "b": 1})
+	db.Insert("inbound", now, map[string]interface{}{"x": 2}, map[string]float64{"a": 1})
+	waitFor(func() bool { return db.TableStats("thetable").ArchiveQueueDepth == 3 })
+
+	stats := db.TableStats("thetable")
+	assert.EqualValues(t, 3, stats.InsertedPoints)
+	assert.EqualValues(t, 2, stats.MemStoreKeys)
+	assert.EqualValues(t, 6, stats.MemStoreSequences, "Each key should have sequences for a, b and _points")
+	assert.EqualValues(t, 3, stats.ArchiveQueueDepth)
+	assert.True(t, stats.MemStoreBytes > 0)
+
+	db.getTable("thetable").forceFlush()
+	stats = db.TableStats("thetable")
+	assert.EqualValues(t, 2, stats.DiskKeys)
+	assert.True(t, stats.DiskBytes > 0)
+	assert.EqualValues(t, 0, stats.MemStoreKeys)
+	assert.EqualValues(t, 0, stats.ArchiveQueueDepth)
+
+	db.insertStats(now)
+	waitFor(func() bool { return db.TableStats(StatsTable).MemStoreKeys == 2 })
+	assert.EqualValues(t, 2, db.TableStats(StatsTable).InsertedPoints, "Should have recorded stats for both tables")
+}
+
+func waitFor(condition func() bool) {
+	for i := 0; i < 50 && !condition(); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -5,7 +5,7 @@ import (
 	"fmt"
 	"math"
 	"os"
-	"path/filepath"
+	"runtime/pprof"
 	"strings"
 	"sync"
 	"time"
@@ -15,8 +15,11 @@ import (
 	"github.com/getlantern/goexpr"
 	"github.com/getlantern/golog"
 	"github.com/getlantern/wal"
+	"github.com/getlantern/zenodb/common"
 	"github.com/getlantern/zenodb/core"
 	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/expr"
+	"github.com/getlantern/zenodb/logging"
 	"github.com/getlantern/zenodb/sql"
 )
 
@@ -28,6 +31,48 @@ type TableStats struct {
 	InsertedPoints int64
 	DroppedPoints  int64
 	ExpiredValues  int64
+	// Flushes counts how many times the memstore was flushed to disk
+	Flushes int64
+	// FlushTime is the total time spent flushing
+	FlushTime time.Duration
+	// DiskKeys is the number of keys written to disk by the most recent flush
+	DiskKeys int64
+	// BudgetEvictions counts how many times data was evicted before the end of
+	// the RetentionPeriod to keep the table within its MaxDiskBytes
+	BudgetEvictions int64
+	// EvictedBefore is the time up to which data was evicted by the most recent
+	// budget eviction
+	EvictedBefore time.Time
+	// Queries counts how many times the table was queried. The Query* stats
+	// add up the common.TableQueryStats of those queries.
+	Queries               int64
+	QueryKeysScanned      int64
+	QuerySequencesDecoded int64
+	QueryPeriodsRead      int64
+	QueryBytesRead        int64
+
+	// The remaining stats are a snapshot taken at the time that the stats were
+	// obtained.
+
+	// MemStoreBytes is the estimated size of the data held in memory that hasn't
+	// been flushed to disk yet
+	MemStoreBytes int64
+	// MemStoreKeys is the number of keys in the memstore
+	MemStoreKeys int64
+	// MemStoreSequences is the number of sequences (one per field per key) in the
+	// memstore
+	MemStoreSequences int64
+	// ArchiveQueueDepth is the number of inserts in the memstore waiting to be
+	// archived to disk by the next flush
+	ArchiveQueueDepth int64
+	// DiskBytes is the size of the table's current file on disk, or of its
+	// flushed data in memory for MemoryOnly tables
+	DiskBytes int64
+	// Paused indicates whether ingestion into the table is currently paused
+	Paused bool
+	// Discarding indicates whether points that arrive while ingestion is paused
+	// are being dropped
+	Discarding bool
 }
 
 // TableOpts configures a table.
@@ -42,9 +87,19 @@ type TableOpts struct {
 	// MaxFlushLatency sets an upper bound on how long to wait before flushing the
 	// memstore to disk.
 	MaxFlushLatency time.Duration
+	// FlushJitter, if positive, randomly lengthens each interval between
+	// flushes by up to this much, so that tables with the same flush latencies,
+	// including the same table on different partitions of a cluster, don't all
+	// flush at the same time.
+	FlushJitter time.Duration
 	// RetentionPeriod limits how long data is kept in the table (based on the
 	// timestamp of the data itself).
 	RetentionPeriod time.Duration
+	// MaxDiskBytes, if positive, limits the size of the table's file on disk (or
+	// of its flushed data in memory for MemoryOnly tables). When a flush exceeds
+	// it, the oldest periods are evicted even if they're still within the
+	// RetentionPeriod.
+	MaxDiskBytes int64
 	// Backfill limits how far back to grab data from the WAL when first creating
 	// a table. If 0, backfill is limited only by the RetentionPeriod.
 	Backfill time.Duration
@@ -58,11 +113,49 @@ type TableOpts struct {
 	// Virtual, if true, means that the table's data isn't actually stored or
 	// queryable. Virtual tables are useful for defining a base set of fields
 	// from which other tables can select.
-	Virtual      bool
-	dependencyOf []*TableOpts
+	Virtual bool
+	// MemoryOnly, if true, keeps the table's data in memory instead of flushing
+	// it to disk. Data is still truncated to the RetentionPeriod, which bounds
+	// how much memory the table uses. On restart, the table is repopulated from
+	// whatever remains in the WAL.
+	MemoryOnly bool
+	// Columnar, if true, stores the table's flushed data in compressed blocks
+	// that pack together the values of each field for many keys. This usually
+	// compresses better than storing one row per key and allows queries to skip
+	// decompressing fields that they don't need. It only applies to data
+	// flushed after the table was opened.
+	Columnar bool
+	// Compression is how the table's flushed data is compressed, either snappy
+	// (the default), lz4, zstd or none. zstd compresses with a dictionary
+	// trained on the table's previous flush. Uncompressed data takes more space
+	// but is cheaper to flush and query. It only applies to data flushed after
+	// the table was opened.
+	Compression string
+	// TrackLastSeen, if true, keeps an in-memory index of the most recent period
+	// in which each of the table's keys received data, which is what SHOW LAST
+	// SEEN and DB.LastSeen use. The index costs a copy of every key and some
+	// work on every insert, so it's off by default. Changing it only takes effect
+	// when the table is opened.
+	TrackLastSeen bool
+	// FieldWidths optionally maps field names to the width with which the
+	// field's values are stored, one of float64 (the default), float32, int64
+	// or int32. Narrower widths save space for fields that don't need full
+	// precision. Only aggregate fields like SUM, MIN, MAX and COUNT support
+	// widths other than float64.
+	FieldWidths map[string]string
+	// FieldMetadata optionally maps field names to metadata like the unit in
+	// which the field is measured and how to display it. It's included in
+	// DESCRIBE output and in the metadata of query results.
+	FieldMetadata map[string]*common.FieldMetadata
+	dependencyOf  []*TableOpts
+	// startAt, if set, is the WAL offset from which a newly created table
+	// starts reading instead of backfilling from the start of the WAL
+	startAt wal.Offset
 }
 
 type table struct {
+	// counters comes first so that its int64s are aligned on 32 bit platforms
+	counters tableCounters
 	*TableOpts
 	sql.Query
 	fields              core.Fields
@@ -71,13 +164,34 @@ type table struct {
 	log                 golog.Logger
 	fieldsMutex         sync.RWMutex
 	whereMutex          sync.RWMutex
-	stats               TableStats
-	statsMutex          sync.RWMutex
 	wal                 *wal.Reader
 	readOffset          wal.Offset
+	readOffsetMx        sync.RWMutex
 	highWaterMarkDisk   int64
 	highWaterMarkMemory int64
 	highWaterMarkMx     sync.RWMutex
+	tenant              *tenant
+	pauseMx             sync.Mutex
+	// resumed is non-nil while ingestion is paused and is closed on resume
+	resumed chan struct{}
+	// discarding indicates that points which arrive while ingestion is paused
+	// are dropped rather than held in the WAL
+	discarding bool
+	// insertMx is held while inserting a point read from the WAL, so that
+	// quiesce can wait for the insert in flight when pausing
+	insertMx sync.Mutex
+	// tunablesMx guards the TableOpts that may be changed at runtime with SET
+	tunablesMx sync.RWMutex
+	// counterFields are the names of the fields counted by COUNTER fields,
+	// guarded by fieldsMutex
+	counterFields []string
+	counterDeltas *counterDeltas
+	// fieldMetadata is the current FieldMetadata, guarded by fieldsMutex
+	fieldMetadata map[string]*common.FieldMetadata
+	// lastSeen is nil unless TrackLastSeen is set
+	lastSeen *lastSeenIndex
+	// interner is only used by the goroutine that processes inserts
+	interner *insertInterner
 }
 
 // CreateTable creates a table based on the given opts.
@@ -87,7 +201,13 @@ func (db *DB) CreateTable(opts *TableOpts) error {
 		return err
 	}
 
+	compression, err := compressionFor(opts.Compression)
+	if err != nil {
+		return err
+	}
+
 	if !opts.Virtual {
+		db.applyTableSettings(opts)
 		if opts.RetentionPeriod <= 0 {
 			return errors.New("Please specify a positive RetentionPeriod")
 		}
@@ -102,11 +222,20 @@ func (db *DB) CreateTable(opts *TableOpts) error {
 	opts.Name = strings.ToLower(opts.Name)
 
 	t := &table{
-		TableOpts: opts,
-		Query:     *q,
-		fields:    fields,
-		db:        db,
-		log:       golog.LoggerFor("zenodb." + opts.Name),
+		TableOpts:     opts,
+		Query:         *q,
+		fields:        fields,
+		counterFields: counterFields(fields),
+		counterDeltas: newCounterDeltas(),
+		fieldMetadata: opts.FieldMetadata,
+		interner:      newInsertInterner(),
+		db:            db,
+		log:           logging.LoggerFor("zenodb." + opts.Name),
+		tenant:        db.tenantFor(opts.Name),
+	}
+
+	if opts.TrackLastSeen {
+		t.lastSeen = newLastSeenIndex()
 	}
 
 	t.log.Debugf("Fields will be: %v", fields)
@@ -116,14 +245,26 @@ func (db *DB) CreateTable(opts *TableOpts) error {
 	var walOffset wal.Offset
 	if !t.Virtual {
 		t.rowStore, walOffset, rsErr = t.openRowStore(&rowStoreOptions{
-			dir:             filepath.Join(db.opts.Dir, t.Name),
+			dir:             db.tableDir(t.Name),
 			minFlushLatency: t.MinFlushLatency,
 			maxFlushLatency: t.MaxFlushLatency,
+			flushJitter:     t.FlushJitter,
+			clock:           db.clock,
+			memoryOnly:      t.MemoryOnly,
+			columnar:        t.Columnar,
+			compression:     compression,
+			mmap:            db.opts.MmapReads,
+			readOnly:        db.opts.ReadOnly,
+			initialOffset:   t.startAt,
 		})
 		if rsErr != nil {
 			return rsErr
 		}
 
+		if walOffset == nil && t.startAt != nil {
+			walOffset = t.startAt
+		}
+
 		offsetByRetentionPeriod := wal.NewOffsetForTS(t.truncateBefore())
 		if offsetByRetentionPeriod.After(walOffset) {
 			// Don't bother looking further back than table's retention period
@@ -148,11 +289,8 @@ func (db *DB) CreateTable(opts *TableOpts) error {
 	db.tables[t.Name] = t
 	db.orderedTables = append(db.orderedTables, t)
 
-	if !t.Virtual {
-		if !t.db.opts.Passthrough {
-			go t.logHighWaterMark()
-		}
-
+	if !t.Virtual && !t.db.opts.ReadOnly {
+		t.resumeRemap()
 		if t.db.opts.Follow != nil {
 			t.startFollowing(walOffset)
 			return nil
@@ -170,6 +308,14 @@ func (t *table) Alter(opts *TableOpts) error {
 	}
 	t.applyWhere(q.Where)
 	t.applyFields(fields)
+	t.fieldsMutex.Lock()
+	t.fieldMetadata = opts.FieldMetadata
+	t.fieldsMutex.Unlock()
+	// Remember the new SQL so that it's used when the table is rebuilt, for
+	// example by BackfillView
+	t.tunablesMx.Lock()
+	t.TableOpts.SQL = opts.SQL
+	t.tunablesMx.Unlock()
 	return nil
 }
 
@@ -186,7 +332,7 @@ func (db *DB) queryAndFields(opts *TableOpts) (q *sql.Query, fields core.Fields,
 		// Get existing fields from existing table
 		t := db.getTable(q.From)
 		if t == nil {
-			err = fmt.Errorf("Table '%v' not found", t.Name)
+			err = common.Errorf(common.ErrUnknownTable, "Table '%v' not found", q.From)
 			return
 		}
 
@@ -224,6 +370,12 @@ func (db *DB) queryAndFields(opts *TableOpts) (q *sql.Query, fields core.Fields,
 		fields, err = q.Fields.Get(t.getFields())
 	}
 
+	if err == nil {
+		fields, err = applyFieldWidths(fields, opts.FieldWidths)
+	}
+	if err == nil {
+		err = validateFieldMetadata(fields, opts.FieldMetadata)
+	}
 	if err == nil {
 		fields = addPointsField(fields)
 	}
@@ -231,6 +383,66 @@ func (db *DB) queryAndFields(opts *TableOpts) (q *sql.Query, fields core.Fields,
 	return
 }
 
+// applyFieldWidths sets the storage widths of the given fields, returning a new
+// Fields.
+func applyFieldWidths(fields core.Fields, widths map[string]string) (core.Fields, error) {
+	if len(widths) == 0 {
+		return fields, nil
+	}
+	result := make(core.Fields, 0, len(fields))
+	found := make(map[string]bool, len(widths))
+	for _, field := range fields {
+		width, hasWidth := widths[field.Name]
+		if hasWidth {
+			ex, err := expr.WithStorage(field.Expr, width)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to apply width to field %v: %v", field.Name, err)
+			}
+			field = core.NewField(field.Name, ex)
+			found[field.Name] = true
+		}
+		result = append(result, field)
+	}
+	for name := range widths {
+		if !found[name] {
+			return nil, fmt.Errorf("Width specified for unknown field %v", name)
+		}
+	}
+	return result, nil
+}
+
+// validateFieldMetadata checks that the given metadata is valid and only
+// refers to the given fields.
+func validateFieldMetadata(fields core.Fields, metadata map[string]*common.FieldMetadata) error {
+	if len(metadata) == 0 {
+		return nil
+	}
+	names := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		names[field.Name] = true
+	}
+	for name, md := range metadata {
+		if !names[name] {
+			return fmt.Errorf("Metadata specified for unknown field %v", name)
+		}
+		if md == nil {
+			continue
+		}
+		err := md.Validate()
+		if err != nil {
+			return fmt.Errorf("Invalid metadata for field %v: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// getFieldMetadata returns the metadata of the table's fields, keyed by name.
+func (t *table) getFieldMetadata() map[string]*common.FieldMetadata {
+	t.fieldsMutex.RLock()
+	defer t.fieldsMutex.RUnlock()
+	return t.fieldMetadata
+}
+
 func addPointsField(fields core.Fields) core.Fields {
 	for _, field := range fields {
 		if field.Equals(core.PointsField) {
@@ -260,7 +472,7 @@ func (t *table) startWALProcessing(walOffset wal.Offset) error {
 	var walErr error
 	w := t.db.streams[t.From]
 	if w == nil {
-		walDir := filepath.Join(t.db.opts.Dir, "_wal", t.From)
+		walDir := t.db.walDir(t.From)
 		dirErr := os.MkdirAll(walDir, 0755)
 		if dirErr != nil && !os.IsExist(dirErr) {
 			return dirErr
@@ -269,11 +481,11 @@ func (t *table) startWALProcessing(walOffset wal.Offset) error {
 		if walErr != nil {
 			return walErr
 		}
-		go t.db.capWALAge(w)
+		go t.db.capWALAge(t.From, w)
 		t.db.streams[t.From] = w
 	}
 
-	if t.db.opts.Passthrough {
+	if !t.db.storesData() {
 		t.log.Debugf("Passthrough will not insert data to table %v", t.Name)
 		return nil
 	}
@@ -294,11 +506,12 @@ func (t *table) applyFields(fields core.Fields) {
 	fieldsChanged = !fields.Equals(t.fields)
 	if fieldsChanged {
 		t.fields = fields
+		t.counterFields = counterFields(fields)
 	}
 	t.fieldsMutex.Unlock()
 	if fieldsChanged {
-		if !t.Virtual && !t.db.opts.Passthrough {
-			t.rowStore.fieldUpdates <- fields
+		if !t.Virtual && t.db.storesData() {
+			t.rowStore.updateFields(fields)
 		}
 		t.log.Debugf("Updated fields to %v", fields)
 	} else {
@@ -314,6 +527,13 @@ func (t *table) getFields() core.Fields {
 	return fields
 }
 
+func (t *table) getCounterFields() []string {
+	t.fieldsMutex.RLock()
+	counterFields := t.counterFields
+	t.fieldsMutex.RUnlock()
+	return counterFields
+}
+
 func (t *table) applyWhere(where goexpr.Expr) {
 	var whereChanged bool
 	t.whereMutex.Lock()
@@ -335,7 +555,19 @@ func (t *table) getWhere() goexpr.Expr {
 }
 
 func (t *table) truncateBefore() time.Time {
-	return t.db.clock.Now().Add(-1 * t.RetentionPeriod)
+	truncateBefore := t.db.clock.Now().Add(-1 * t.retentionPeriod())
+	evictedBefore := t.evictedBefore()
+	if evictedBefore.After(truncateBefore) {
+		return evictedBefore
+	}
+	return truncateBefore
+}
+
+func (t *table) retentionPeriod() time.Duration {
+	t.tunablesMx.RLock()
+	retentionPeriod := t.RetentionPeriod
+	t.tunablesMx.RUnlock()
+	return retentionPeriod
 }
 
 func (t *table) backfillTo() time.Time {
@@ -345,8 +577,10 @@ func (t *table) backfillTo() time.Time {
 	return t.db.clock.Now().Add(-1 * t.Backfill)
 }
 
-func (t *table) iterate(ctx context.Context, outFields core.Fields, includeMemStore bool, onValue func(bytemap.ByteMap, []encoding.Sequence) (more bool, err error)) error {
-	return t.rowStore.iterate(ctx, outFields, includeMemStore, onValue)
+// iterate iterates over the table's data, skipping keys that don't match the
+// given filter (which may be nil).
+func (t *table) iterate(ctx context.Context, outFields core.Fields, includeMemStore bool, filter *core.KeyFilter, window *timeWindow, onValue func(bytemap.ByteMap, []encoding.Sequence) (more bool, err error)) error {
+	return t.rowStore.iterate(ctx, outFields, includeMemStore, filter, window, onValue)
 }
 
 // shouldSort determines whether or not a flush should be sorted. The flush will
@@ -380,19 +614,126 @@ func (t *table) memStoreSize() int {
 	return t.rowStore.memStoreSize()
 }
 
+func (t *table) memStoreLength() int {
+	return t.rowStore.memStoreLength()
+}
+
+// snapshotStats returns the table's TableStats, including a snapshot of the
+// current state of its rowStore (if it has one).
+func (t *table) snapshotStats() TableStats {
+	stats := t.counters.stats()
+	if t.rowStore != nil {
+		stats.MemStoreBytes = int64(t.rowStore.memStoreSize())
+		stats.MemStoreKeys, stats.MemStoreSequences, stats.ArchiveQueueDepth = t.rowStore.memStoreStats()
+		stats.DiskBytes = t.rowStore.fileStoreSize()
+	}
+	stats.Paused, stats.Discarding = t.pauseState()
+	return stats
+}
+
+// labelGoroutine labels the current goroutine (and any goroutines it starts)
+// with the table's name so that they can be identified in goroutine dumps.
+func (t *table) labelGoroutine() {
+	pprof.SetGoroutineLabels(pprof.WithLabels(context.Background(), pprof.Labels("table", t.Name)))
+}
+
 func (t *table) forceFlush() {
-	t.rowStore.forceFlush()
+	t.rowStore.forceFlush(context.Background())
+}
+
+// pause stops the table from ingesting new points until resume is called.
+// Points that arrive in the meantime are held in the WAL.
+func (t *table) pause() {
+	t.pauseMx.Lock()
+	if t.resumed == nil {
+		t.resumed = make(chan struct{})
+	}
+	t.pauseMx.Unlock()
+}
+
+// pauseDiscarding is like pause, except that points which arrive in the
+// meantime are dropped.
+func (t *table) pauseDiscarding() {
+	t.pauseMx.Lock()
+	if t.resumed == nil {
+		t.resumed = make(chan struct{})
+	}
+	t.discarding = true
+	t.pauseMx.Unlock()
 }
 
-func (t *table) logHighWaterMark() {
-	for {
-		time.Sleep(15 * time.Second)
-		t.highWaterMarkMx.RLock()
-		disk := t.highWaterMarkDisk
-		memory := t.highWaterMarkMemory
-		t.highWaterMarkMx.RUnlock()
-		t.log.Debugf("High Water Mark    disk: %v    memory: %v", encoding.TimeFromInt(disk).In(time.UTC), encoding.TimeFromInt(memory).In(time.UTC))
+func (t *table) resume() {
+	t.pauseMx.Lock()
+	if t.resumed != nil {
+		close(t.resumed)
+		t.resumed = nil
 	}
+	t.discarding = false
+	t.pauseMx.Unlock()
+}
+
+// quiesce pauses the table and waits for any insert that's already in flight
+// to reach the rowStore, after which the table's read offset won't change until
+// it's resumed.
+func (t *table) quiesce() {
+	t.pause()
+	t.insertMx.Lock()
+	t.insertMx.Unlock()
+}
+
+func (t *table) isPaused() bool {
+	paused, _ := t.pauseState()
+	return paused
+}
+
+// pauseState indicates whether ingestion is paused and, if so, whether points
+// are being discarded.
+func (t *table) pauseState() (paused bool, discarding bool) {
+	t.pauseMx.Lock()
+	paused, discarding = t.resumed != nil, t.discarding
+	t.pauseMx.Unlock()
+	return
+}
+
+// waitIfPaused blocks for as long as ingestion is paused, unless points are
+// being discarded.
+func (t *table) waitIfPaused() {
+	t.pauseMx.Lock()
+	resumed := t.resumed
+	discarding := t.discarding
+	t.pauseMx.Unlock()
+	if resumed != nil && !discarding {
+		t.log.Debug("Ingestion paused")
+		<-resumed
+		t.log.Debug("Ingestion resumed")
+	}
+}
+
+func (t *table) highWaterMarks() (disk int64, memory int64) {
+	t.highWaterMarkMx.RLock()
+	disk = t.highWaterMarkDisk
+	memory = t.highWaterMarkMemory
+	t.highWaterMarkMx.RUnlock()
+	return
+}
+
+// updateReadOffset records the offset up to which the table has read its
+// stream's WAL.
+func (t *table) updateReadOffset(offset wal.Offset) {
+	t.readOffsetMx.Lock()
+	t.readOffset = offset
+	t.readOffsetMx.Unlock()
+}
+
+func (t *table) getReadOffset() wal.Offset {
+	t.readOffsetMx.RLock()
+	offset := t.readOffset
+	t.readOffsetMx.RUnlock()
+	return offset
+}
+
+func (t *table) recordFlush(flushDuration time.Duration) {
+	t.counters.recordFlush(flushDuration)
 }
 
 func (t *table) updateHighWaterMarkDisk(ts int64) {
@@ -0,0 +1,105 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFieldWidths(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	clock := NewVirtualClock(epoch)
+	clock.Freeze()
+	db, err := NewDB(&DBOpts{
+		Dir:   tmpDir,
+		Clock: clock,
+		Schema: Schema{
+			"narrow": &TableOpts{
+				RetentionPeriod: time.Hour,
+				SQL:             "SELECT SUM(a) AS a, SUM(b) AS b, SUM(c) AS c FROM inbound GROUP BY x, period(1s)",
+				FieldWidths:     map[string]string{"a": "float32", "b": "int32"},
+			},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	fields := db.getTable("narrow").getFields()
+	widths := make(map[string]int, len(fields))
+	for _, field := range fields {
+		widths[field.Name] = field.Expr.EncodedWidth()
+	}
+	assert.Equal(t, widths["c"]-4, widths["a"], "float32 field should be narrower")
+	assert.Equal(t, widths["c"]-4, widths["b"], "int32 field should be narrower")
+
+	db.Insert("inbound", epoch, map[string]interface{}{"x": 1}, map[string]float64{"a": 1.5, "b": 2.4, "c": 1.25})
+	db.Insert("inbound", epoch, map[string]interface{}{"x": 1}, map[string]float64{"a": 1.5, "b": 2.4, "c": 1.25})
+	waitFor(func() bool { return db.TableStats("narrow").ArchiveQueueDepth == 2 })
+
+	query := func(includeMemStore bool) map[string]float64 {
+		source, queryErr := db.Query("SELECT a, b, c FROM narrow", false, nil, includeMemStore)
+		if !assert.NoError(t, queryErr) {
+			return nil
+		}
+		result := make(map[string]float64)
+		var outFields core.Fields
+		queryErr = source.Iterate(context.Background(), func(fields core.Fields) error {
+			outFields = fields
+			return nil
+		}, func(row *core.FlatRow) (bool, error) {
+			for i, field := range outFields {
+				result[field.Name] += row.Values[i]
+			}
+			return true, nil
+		})
+		assert.NoError(t, queryErr)
+		return result
+	}
+
+	expected := map[string]float64{"a": 3, "b": 4, "c": 2.5}
+	assert.Equal(t, expected, query(true), "values should be readable from memstore")
+	if !assert.NoError(t, db.ForceFlush("narrow")) {
+		return
+	}
+	assert.Equal(t, expected, query(false), "values should be readable from disk")
+}
+
+func TestFieldWidthsInvalid(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDB(&DBOpts{Dir: tmpDir})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	tableWithWidths := func(widths map[string]string) Schema {
+		return Schema{
+			"narrow": &TableOpts{
+				RetentionPeriod: time.Hour,
+				SQL:             "SELECT SUM(a) AS a, AVG(b) AS b FROM inbound GROUP BY x, period(1s)",
+				FieldWidths:     widths,
+			},
+		}
+	}
+	assert.Error(t, db.ApplySchema(tableWithWidths(map[string]string{"z": "float32"})), "unknown field should fail")
+	assert.Error(t, db.ApplySchema(tableWithWidths(map[string]string{"a": "float16"})), "unknown width should fail")
+	assert.Error(t, db.ApplySchema(tableWithWidths(map[string]string{"b": "int32"})), "non-aggregate field should fail")
+}
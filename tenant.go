@@ -0,0 +1,293 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/yaml"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/spaolacci/murmur3"
+)
+
+// TenantOpts configures the quotas for a tenant. Tables and streams belong to a
+// tenant when their names are qualified with the tenant's name, as in
+// tenant.table. A zero value for any limit means that it's unlimited.
+type TenantOpts struct {
+	// MaxKeys limits the number of distinct keys stored across all of the
+	// tenant's tables.
+	MaxKeys int64
+	// MaxIngestRate limits the number of points per second that may be inserted
+	// into the tenant's streams.
+	MaxIngestRate float64
+	// MaxStorageBytes limits the size on disk of the tenant's tables.
+	MaxStorageBytes int64
+	// MaxConcurrentQueries limits how many queries against the tenant's tables
+	// may run at the same time.
+	MaxConcurrentQueries int
+}
+
+// TenantStats presents usage statistics for a given tenant. Keys and storage
+// are as of the most recent flush of each of the tenant's tables.
+type TenantStats struct {
+	Keys            int64
+	StorageBytes    int64
+	ActiveQueries   int
+	RejectedInserts int64
+	RejectedQueries int64
+	DroppedPoints   int64
+}
+
+// LoadTenants loads TenantOpts keyed by tenant name from the YAML file at the
+// given path, for example:
+//
+//	acme:
+//	  maxkeys: 100000
+//	  maxingestrate: 5000
+//	  maxstoragebytes: 10737418240
+//	  maxconcurrentqueries: 4
+func LoadTenants(filename string) (map[string]*TenantOpts, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read tenants from %v: %v", filename, err)
+	}
+	tenants := make(map[string]*TenantOpts)
+	err = yaml.Unmarshal(b, &tenants)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse tenants from %v: %v", filename, err)
+	}
+	return tenants, nil
+}
+
+// TenantFor returns the name of the tenant to which the named table or stream
+// belongs, or "" if it's not qualified with a tenant.
+func TenantFor(name string) string {
+	idx := strings.Index(name, ".")
+	if idx <= 0 {
+		return ""
+	}
+	return strings.ToLower(name[:idx])
+}
+
+type tenant struct {
+	name       string
+	opts       *TenantOpts
+	mx         sync.Mutex
+	tokens     float64
+	lastRefill time.Time
+	keys       map[string]int64
+	bytes      map[string]int64
+	stats      TenantStats
+	// known and added hold the hashes of the keys in each of the tenant's
+	// tables when MaxKeys is set. known includes keys that haven't been flushed
+	// yet, added only the ones that were added since the table's last flush.
+	known     map[string]map[uint64]bool
+	added     map[string]map[uint64]bool
+	knownKeys int64
+}
+
+func newTenants(opts map[string]*TenantOpts) map[string]*tenant {
+	tenants := make(map[string]*tenant, len(opts))
+	for name, o := range opts {
+		name = strings.ToLower(name)
+		tenants[name] = &tenant{
+			name:   name,
+			opts:   o,
+			tokens: o.MaxIngestRate,
+			keys:   make(map[string]int64),
+			bytes:  make(map[string]int64),
+			known:  make(map[string]map[uint64]bool),
+			added:  make(map[string]map[uint64]bool),
+		}
+	}
+	return tenants
+}
+
+// tenantFor returns the tenant for the named table or stream, or nil if it
+// doesn't belong to a configured tenant.
+func (db *DB) tenantFor(name string) *tenant {
+	return db.tenants[TenantFor(name)]
+}
+
+// TenantStats returns the TenantStats for the named tenant.
+func (db *DB) TenantStats(name string) TenantStats {
+	t := db.tenants[strings.ToLower(name)]
+	if t == nil {
+		return TenantStats{}
+	}
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	stats := t.stats
+	stats.Keys = sum(t.keys)
+	stats.StorageBytes = sum(t.bytes)
+	return stats
+}
+
+// admitInsert enforces MaxIngestRate using a token bucket that holds up to one
+// second's worth of points.
+func (t *tenant) admitInsert(now time.Time) error {
+	if t.opts.MaxIngestRate <= 0 {
+		return nil
+	}
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if !t.lastRefill.IsZero() {
+		t.tokens += now.Sub(t.lastRefill).Seconds() * t.opts.MaxIngestRate
+		if t.tokens > t.opts.MaxIngestRate {
+			t.tokens = t.opts.MaxIngestRate
+		}
+	}
+	t.lastRefill = now
+	if t.tokens < 1 {
+		t.stats.RejectedInserts++
+		return common.Errorf(common.ErrBackpressure, "Tenant %v exceeded its ingest rate of %v points per second", t.name, t.opts.MaxIngestRate)
+	}
+	t.tokens--
+	return nil
+}
+
+// tracksKeys indicates whether the tenant keeps track of the keys in its
+// tables, which it does when it limits the number of keys.
+func (t *tenant) tracksKeys() bool {
+	return t.opts.MaxKeys > 0
+}
+
+// admitPoint checks whether the named table belonging to this tenant may
+// accept a point with the given key. Once the tenant is at MaxKeys, only points
+// for keys that it already has are accepted. Once it's at MaxStorageBytes as of
+// the last flush, no points are accepted.
+func (t *tenant) admitPoint(table string, key []byte) bool {
+	if t.opts.MaxKeys <= 0 && t.opts.MaxStorageBytes <= 0 {
+		return true
+	}
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if t.opts.MaxStorageBytes > 0 && sum(t.bytes) >= t.opts.MaxStorageBytes {
+		t.stats.DroppedPoints++
+		return false
+	}
+	if t.opts.MaxKeys <= 0 {
+		return true
+	}
+	hash := murmur3.Sum64(key)
+	known := t.known[table]
+	if known[hash] {
+		return true
+	}
+	if t.knownKeys >= t.opts.MaxKeys {
+		t.stats.DroppedPoints++
+		return false
+	}
+	if known == nil {
+		known = make(map[uint64]bool)
+		t.known[table] = known
+	}
+	known[hash] = true
+	added := t.added[table]
+	if added == nil {
+		added = make(map[uint64]bool)
+		t.added[table] = added
+	}
+	added[hash] = true
+	t.knownKeys++
+	return true
+}
+
+// recordFlush records the number of keys and bytes stored by the named table
+// as of its latest flush. bytes is negative if the size is unknown. If the
+// tenant tracks keys, flushed contains the hashes of the keys that were
+// flushed, which replace the table's known keys so that expired keys stop
+// counting against MaxKeys.
+func (t *tenant) recordFlush(table string, keys int64, bytes int64, flushed map[uint64]bool) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.keys[table] = keys
+	if bytes >= 0 {
+		t.bytes[table] = bytes
+	}
+	if flushed == nil {
+		return
+	}
+	// Keys that were added while flushing may not have made it into the flush
+	for hash := range t.added[table] {
+		flushed[hash] = true
+	}
+	t.knownKeys += int64(len(flushed) - len(t.known[table]))
+	t.known[table] = flushed
+	delete(t.added, table)
+}
+
+// limitsQueries indicates whether the tenant limits the number of concurrent
+// queries.
+func (t *tenant) limitsQueries() bool {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	return t.opts.MaxConcurrentQueries > 0
+}
+
+func (t *tenant) admitQuery() error {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if t.opts.MaxConcurrentQueries > 0 && t.stats.ActiveQueries >= t.opts.MaxConcurrentQueries {
+		t.stats.RejectedQueries++
+		return common.Errorf(common.ErrBackpressure, "Tenant %v is already running the maximum of %d concurrent queries, please try again later", t.name, t.opts.MaxConcurrentQueries)
+	}
+	t.stats.ActiveQueries++
+	return nil
+}
+
+func (t *tenant) queryFinished() {
+	t.mx.Lock()
+	t.stats.ActiveQueries--
+	t.mx.Unlock()
+}
+
+// admittedSource limits the number of concurrent queries for the tenants whose
+// tables it reads. Queries are admitted when they start iterating rather than
+// when they're planned.
+type admittedSource struct {
+	core.FlatRowSource
+	tenants []*tenant
+}
+
+func (s *admittedSource) Iterate(ctx context.Context, onFields core.OnFields, onRow core.OnFlatRow) error {
+	for i, t := range s.tenants {
+		err := t.admitQuery()
+		if err != nil {
+			for _, admitted := range s.tenants[:i] {
+				admitted.queryFinished()
+			}
+			return err
+		}
+	}
+	defer func() {
+		for _, t := range s.tenants {
+			t.queryFinished()
+		}
+	}()
+	return s.FlatRowSource.Iterate(ctx, onFields, onRow)
+}
+
+func (s *admittedSource) GetSource() core.Source {
+	return s.FlatRowSource
+}
+
+func (s *admittedSource) String() string {
+	names := make([]string, 0, len(s.tenants))
+	for _, t := range s.tenants {
+		names = append(names, t.name)
+	}
+	return fmt.Sprintf("admit for tenants %v", strings.Join(names, ", "))
+}
+
+func sum(values map[string]int64) int64 {
+	total := int64(0)
+	for _, value := range values {
+		total += value
+	}
+	return total
+}
@@ -0,0 +1,131 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/spaolacci/murmur3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTenantFor(t *testing.T) {
+	assert.Equal(t, "acme", TenantFor("Acme.requests"))
+	assert.Equal(t, "", TenantFor("requests"))
+	assert.Equal(t, "", TenantFor(".requests"))
+}
+
+func TestLoadTenants(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	filename := filepath.Join(tmpDir, "tenants.yaml")
+	err = ioutil.WriteFile(filename, []byte(`
+acme:
+  maxkeys: 100
+  maxingestrate: 5.5
+  maxstoragebytes: 1024
+  maxconcurrentqueries: 2
+`), 0644)
+	if !assert.NoError(t, err) {
+		return
+	}
+	tenants, err := LoadTenants(filename)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, map[string]*TenantOpts{
+		"acme": &TenantOpts{MaxKeys: 100, MaxIngestRate: 5.5, MaxStorageBytes: 1024, MaxConcurrentQueries: 2},
+	}, tenants)
+}
+
+func TestTenantQuotas(t *testing.T) {
+	db := &DB{tenants: newTenants(map[string]*TenantOpts{
+		"Acme": &TenantOpts{MaxKeys: 10, MaxIngestRate: 2, MaxStorageBytes: 1000, MaxConcurrentQueries: 1},
+	})}
+	assert.Nil(t, db.tenantFor("other.requests"))
+	acme := db.tenantFor("acme.requests")
+	if !assert.NotNil(t, acme) {
+		return
+	}
+
+	now := time.Now()
+	assert.NoError(t, acme.admitInsert(now))
+	assert.NoError(t, acme.admitInsert(now))
+	assert.Equal(t, ErrBackpressure, common.KindOf(acme.admitInsert(now)), "Third insert in the same instant should exceed the rate")
+	assert.NoError(t, acme.admitInsert(now.Add(500*time.Millisecond)), "Bucket should refill over time")
+
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("key%d", i))
+	}
+	for i := 0; i < 6; i++ {
+		assert.True(t, acme.admitPoint("acme.requests", key(i)))
+	}
+	for i := 0; i < 4; i++ {
+		assert.True(t, acme.admitPoint("acme.errors", key(i)), "Keys should be counted per table")
+	}
+	assert.False(t, acme.admitPoint("acme.errors", key(4)), "Should reject new keys once at MaxKeys, even before flushing")
+	assert.True(t, acme.admitPoint("acme.errors", key(3)), "Should accept points for existing keys once at MaxKeys")
+	assert.EqualValues(t, 1, acme.stats.DroppedPoints)
+
+	// Keys added since the last flush stay known even if the flush missed them
+	acme.recordFlush("acme.requests", 6, 100, map[uint64]bool{murmur3.Sum64(key(0)): true})
+	acme.recordFlush("acme.errors", 1, 100, map[uint64]bool{murmur3.Sum64(key(0)): true})
+	assert.EqualValues(t, 10, acme.knownKeys)
+	assert.False(t, acme.admitPoint("acme.errors", key(4)))
+
+	// Keys that are no longer flushed, e.g. because they expired, free up room
+	// for new ones
+	acme.recordFlush("acme.errors", 1, 100, map[uint64]bool{murmur3.Sum64(key(0)): true})
+	assert.EqualValues(t, 7, acme.knownKeys)
+	assert.True(t, acme.admitPoint("acme.errors", key(4)))
+	assert.EqualValues(t, 8, acme.knownKeys)
+
+	acme.recordFlush("acme.errors", 1, 900, nil)
+	assert.False(t, acme.admitPoint("acme.errors", key(0)), "Should reject points once at MaxStorageBytes")
+	acme.recordFlush("acme.errors", 1, 100, nil)
+	assert.True(t, acme.admitPoint("acme.errors", key(0)))
+
+	first := &admittedSource{&blockingSource{started: make(chan bool), finish: make(chan bool)}, []*tenant{acme}}
+	second := &admittedSource{&blockingSource{}, []*tenant{acme}}
+	firstDone := make(chan error)
+	go func() {
+		firstDone <- first.Iterate(context.Background(), nil, nil)
+	}()
+	<-first.FlatRowSource.(*blockingSource).started
+	assert.Error(t, second.Iterate(context.Background(), nil, nil), "Second concurrent query should be rejected")
+	close(first.FlatRowSource.(*blockingSource).finish)
+	assert.NoError(t, <-firstDone)
+	assert.NoError(t, second.Iterate(context.Background(), nil, nil), "Query should be admitted once first finishes")
+
+	stats := db.TenantStats("acme")
+	assert.EqualValues(t, 7, stats.Keys)
+	assert.EqualValues(t, 200, stats.StorageBytes)
+	assert.Equal(t, 0, stats.ActiveQueries)
+	assert.EqualValues(t, 1, stats.RejectedInserts)
+	assert.EqualValues(t, 1, stats.RejectedQueries)
+	assert.EqualValues(t, 2, stats.DroppedPoints)
+}
+
+type blockingSource struct {
+	core.FlatRowSource
+	started chan bool
+	finish  chan bool
+}
+
+func (s *blockingSource) Iterate(ctx context.Context, onFields core.OnFields, onRow core.OnFlatRow) error {
+	if s.started != nil {
+		close(s.started)
+		<-s.finish
+	}
+	return nil
+}
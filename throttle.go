@@ -0,0 +1,89 @@
+package zenodb
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// flushThrottle limits how fast flushes write to disk so that bursts of
+// flushes, like when many tables flush after a long busy period, don't take
+// the disk bandwidth that queries need. It uses a token bucket that's shared
+// by all of a DB's tables and holds up to one second's worth of bytes.
+//
+// The throttle is lifted while flushing is falling behind, because then
+// throttling would only let memstores keep growing. It always uses real time,
+// even with a VirtualClock, since it's pacing actual disk writes.
+type flushThrottle struct {
+	db     *DB
+	tokens float64
+	last   time.Time
+	mx     sync.Mutex
+}
+
+func newFlushThrottle(db *DB) *flushThrottle {
+	return &flushThrottle{db: db, last: time.Now()}
+}
+
+// writer wraps the given Writer so that writes to it are throttled.
+func (ft *flushThrottle) writer(w io.Writer) io.Writer {
+	return &throttledWriter{w, ft}
+}
+
+// wait blocks until n more bytes may be written.
+func (ft *flushThrottle) wait(n int) {
+	ft.db.tunablesMx.RLock()
+	rate := float64(ft.db.opts.MaxFlushBytesPerSecond)
+	ft.db.tunablesMx.RUnlock()
+	if rate <= 0 || ft.db.flushBacklogged() {
+		return
+	}
+
+	ft.mx.Lock()
+	now := time.Now()
+	ft.tokens += now.Sub(ft.last).Seconds() * rate
+	if ft.tokens > rate {
+		ft.tokens = rate
+	}
+	ft.last = now
+	// Reserve the bytes even if that leaves us in debt. Writers that come along
+	// later then have to wait for this debt to be paid off too.
+	ft.tokens -= float64(n)
+	debt := -ft.tokens
+	ft.mx.Unlock()
+
+	if debt > 0 {
+		time.Sleep(time.Duration(debt / rate * float64(time.Second)))
+	}
+}
+
+// flushBacklogged indicates whether flushing is falling behind, either because
+// the process is using more than its allowed memory or because some table has
+// more than MaxArchiveQueueDepth inserts waiting to be flushed.
+func (db *DB) flushBacklogged() bool {
+	if db.opts.MaxMemoryRatio > 0 && atomic.LoadUint64(&db.memory) > db.maxMemoryBytes() {
+		return true
+	}
+	db.tunablesMx.RLock()
+	maxArchiveQueueDepth := db.opts.MaxArchiveQueueDepth
+	db.tunablesMx.RUnlock()
+	if maxArchiveQueueDepth > 0 {
+		for _, t := range db.allTables() {
+			if t.rowStore != nil && t.rowStore.archiveQueueDepth() > maxArchiveQueueDepth {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type throttledWriter struct {
+	w  io.Writer
+	ft *flushThrottle
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	tw.ft.wait(len(p))
+	return tw.w.Write(p)
+}
@@ -0,0 +1,43 @@
+package zenodb
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlushThrottle(t *testing.T) {
+	db := &DB{opts: &DBOpts{MaxFlushBytesPerSecond: 2000}}
+	ft := newFlushThrottle(db)
+	buf := &bytes.Buffer{}
+	w := ft.writer(buf)
+	chunk := make([]byte, 100)
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		w.Write(chunk)
+	}
+	elapsed := time.Since(start)
+	assert.Equal(t, 1000, buf.Len())
+	assert.True(t, elapsed >= 400*time.Millisecond, "writing 1000 bytes at 2000 bytes per second should take about half a second, took %v", elapsed)
+
+	db.opts.MaxMemoryRatio = 0.000001
+	db.memory = math.MaxUint64
+	start = time.Now()
+	for i := 0; i < 10; i++ {
+		w.Write(chunk)
+	}
+	assert.True(t, time.Since(start) < 100*time.Millisecond, "writes shouldn't be throttled while over memory limit")
+
+	db.opts.MaxMemoryRatio = 0
+	db.opts.MaxFlushBytesPerSecond = 0
+	start = time.Now()
+	for i := 0; i < 10; i++ {
+		w.Write(chunk)
+	}
+	assert.True(t, time.Since(start) < 100*time.Millisecond, "writes shouldn't be throttled without a limit")
+	assert.Equal(t, 3000, buf.Len())
+}
@@ -0,0 +1,183 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/zenodb/logging"
+)
+
+var (
+	log = logging.LoggerFor("zenodb.trace")
+)
+
+// OTLPOpts configures an OTLP exporter.
+type OTLPOpts struct {
+	// Endpoint is the base URL of the OpenTelemetry collector, for example
+	// http://localhost:4318. Spans are POSTed to Endpoint + "/v1/traces".
+	Endpoint string
+	// ServiceName identifies this process in exported spans.
+	ServiceName string
+	// BatchSize is the maximum number of spans sent in a single request,
+	// defaults to 512.
+	BatchSize int
+	// FlushInterval is how frequently to send batches of spans, defaults to 5
+	// seconds.
+	FlushInterval time.Duration
+	// Client is the http.Client used to send spans, defaults to
+	// http.DefaultClient.
+	Client *http.Client
+}
+
+// NewOTLPExporter creates an Exporter that sends spans to an OpenTelemetry
+// collector using OTLP/HTTP with JSON encoding. Spans are buffered and sent in
+// batches. If the buffer fills up because the collector can't keep up, spans
+// are dropped.
+func NewOTLPExporter(opts *OTLPOpts) Exporter {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 512
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 5 * time.Second
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	if opts.ServiceName == "" {
+		opts.ServiceName = "zenodb"
+	}
+	spans := make(chan *Span, opts.BatchSize*10)
+	go exportOTLP(opts, spans)
+	return func(span *Span) {
+		select {
+		case spans <- span:
+			// okay
+		default:
+			log.Debugf("Span buffer full, dropping span %v", span.Name)
+		}
+	}
+}
+
+func exportOTLP(opts *OTLPOpts, spans chan *Span) {
+	url := strings.TrimRight(opts.Endpoint, "/") + "/v1/traces"
+	batch := make([]*Span, 0, opts.BatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		err := postOTLP(opts, url, batch)
+		if err != nil {
+			log.Errorf("Unable to export %d spans to %v: %v", len(batch), url, err)
+		}
+		batch = batch[:0]
+	}
+
+	ticker := time.NewTicker(opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case span := <-spans:
+			batch = append(batch, span)
+			if len(batch) >= opts.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func postOTLP(opts *OTLPOpts, url string, batch []*Span) error {
+	body, err := json.Marshal(otlpRequest(opts.ServiceName, batch))
+	if err != nil {
+		return err
+	}
+	resp, err := opts.Client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Unexpected response status %v", resp.Status)
+	}
+	return nil
+}
+
+// otlpRequest builds an ExportTraceServiceRequest as defined by the OTLP JSON
+// encoding.
+func otlpRequest(serviceName string, batch []*Span) map[string]interface{} {
+	spans := make([]interface{}, 0, len(batch))
+	for _, span := range batch {
+		s := map[string]interface{}{
+			"traceId":           span.TraceID.String(),
+			"spanId":            span.SpanID.String(),
+			"name":              span.Name,
+			"kind":              1, // SPAN_KIND_INTERNAL
+			"startTimeUnixNano": strconv.FormatInt(span.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(span.End.UnixNano(), 10),
+			"attributes":        otlpAttributes(span.Attributes),
+		}
+		if !span.ParentID.IsZero() {
+			s["parentSpanId"] = span.ParentID.String()
+		}
+		if span.Err != nil {
+			s["status"] = map[string]interface{}{"code": 2, "message": span.Err.Error()} // STATUS_CODE_ERROR
+		}
+		spans = append(spans, s)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]interface{}{"service.name": serviceName}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "github.com/getlantern/zenodb"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+}
+
+func otlpAttributes(attributes map[string]interface{}) []interface{} {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, map[string]interface{}{
+			"key":   key,
+			"value": otlpValue(attributes[key]),
+		})
+	}
+	return result
+}
+
+func otlpValue(_value interface{}) map[string]interface{} {
+	switch value := _value.(type) {
+	case bool:
+		return map[string]interface{}{"boolValue": value}
+	case int:
+		return map[string]interface{}{"intValue": strconv.FormatInt(int64(value), 10)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": value}
+	case time.Duration:
+		return map[string]interface{}{"intValue": strconv.FormatInt(int64(value), 10)}
+	default:
+		return map[string]interface{}{"stringValue": fmt.Sprint(value)}
+	}
+}
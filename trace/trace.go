@@ -0,0 +1,182 @@
+// Package trace provides lightweight distributed tracing for zenodb. Spans are
+// identified using W3C trace context, which allows them to be propagated
+// between leaders and followers (and from clients), and can be exported to an
+// OpenTelemetry collector with NewOTLPExporter.
+//
+// Tracing is disabled until an Exporter is configured with SetExporter, in
+// which case Start returns nil Spans, on which all methods are no-ops.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// TraceParentKey is the key under which trace context is propagated, for
+	// example in gRPC metadata.
+	TraceParentKey = "traceparent"
+)
+
+type contextKey int
+
+const spanKey contextKey = 0
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// IsZero indicates whether this SpanID is unset.
+func (id SpanID) IsZero() bool {
+	return id == SpanID{}
+}
+
+// Span records a single timed operation.
+type Span struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	ParentID   SpanID
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+	Err        error
+
+	mx       sync.Mutex
+	exporter Exporter
+	ended    bool
+}
+
+// Exporter receives finished Spans.
+type Exporter func(span *Span)
+
+var exporter atomic.Value
+
+// SetExporter configures the Exporter to which finished Spans are sent. Pass
+// nil to disable tracing.
+func SetExporter(e Exporter) {
+	exporter.Store(e)
+}
+
+func currentExporter() Exporter {
+	e, _ := exporter.Load().(Exporter)
+	return e
+}
+
+// Start starts a new Span with the given name as a child of the Span in ctx,
+// if any, and returns a context containing the new Span. Attributes are
+// specified as alternating keys and values. The returned Span is nil if tracing
+// is disabled.
+func Start(ctx context.Context, name string, attributes ...interface{}) (context.Context, *Span) {
+	e := currentExporter()
+	if e == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		Name:     name,
+		Start:    time.Now(),
+		exporter: e,
+	}
+	parent := FromContext(ctx)
+	if parent != nil {
+		span.TraceID = parent.TraceID
+		span.ParentID = parent.SpanID
+	} else {
+		rand.Read(span.TraceID[:])
+	}
+	rand.Read(span.SpanID[:])
+	for i := 0; i < len(attributes)-1; i += 2 {
+		span.SetAttribute(fmt.Sprint(attributes[i]), attributes[i+1])
+	}
+	return context.WithValue(ctx, spanKey, span), span
+}
+
+// FromContext returns the Span in the given context, or nil if there is none.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey).(*Span)
+	return span
+}
+
+// SetAttribute records an attribute on this span.
+func (span *Span) SetAttribute(key string, value interface{}) {
+	if span == nil {
+		return
+	}
+	span.mx.Lock()
+	if span.Attributes == nil {
+		span.Attributes = make(map[string]interface{})
+	}
+	span.Attributes[key] = value
+	span.mx.Unlock()
+}
+
+// Finish ends this span, recording the given error (if any), and exports it.
+// Only the first call to Finish has any effect.
+func (span *Span) Finish(err error) {
+	if span == nil {
+		return
+	}
+	span.mx.Lock()
+	if span.ended {
+		span.mx.Unlock()
+		return
+	}
+	span.ended = true
+	span.End = time.Now()
+	span.Err = err
+	span.mx.Unlock()
+	span.exporter(span)
+}
+
+// TraceParent returns a W3C traceparent header value for the Span in ctx, or
+// "" if there is none.
+func TraceParent(ctx context.Context) string {
+	span := FromContext(ctx)
+	if span == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%v-%v-01", span.TraceID, span.SpanID)
+}
+
+// WithTraceParent returns a context whose Spans will be children of the remote
+// span identified by the given W3C traceparent header value. If traceparent is
+// empty or invalid, or tracing is disabled, ctx is returned unchanged.
+func WithTraceParent(ctx context.Context, traceparent string) context.Context {
+	if traceparent == "" || currentExporter() == nil {
+		return ctx
+	}
+	parts := strings.Split(traceparent, "-")
+	if len(parts) != 4 {
+		return ctx
+	}
+	remote := &Span{}
+	if !decodeHex(remote.TraceID[:], parts[1]) || !decodeHex(remote.SpanID[:], parts[2]) {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey, remote)
+}
+
+func decodeHex(dst []byte, s string) bool {
+	if hex.DecodedLen(len(s)) != len(dst) {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
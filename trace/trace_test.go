@@ -0,0 +1,96 @@
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDisabled(t *testing.T) {
+	SetExporter(nil)
+	ctx, span := Start(context.Background(), "op")
+	assert.Nil(t, span)
+	span.SetAttribute("a", 1)
+	span.Finish(nil)
+	assert.Equal(t, "", TraceParent(ctx))
+	assert.Equal(t, ctx, WithTraceParent(ctx, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"))
+}
+
+func TestPropagation(t *testing.T) {
+	var mx sync.Mutex
+	var spans []*Span
+	SetExporter(func(span *Span) {
+		mx.Lock()
+		spans = append(spans, span)
+		mx.Unlock()
+	})
+	defer SetExporter(nil)
+
+	ctx, parent := Start(context.Background(), "parent", "a", 1)
+	traceParent := TraceParent(ctx)
+	assert.Equal(t, "00-"+parent.TraceID.String()+"-"+parent.SpanID.String()+"-01", traceParent)
+
+	remoteCtx := WithTraceParent(context.Background(), traceParent)
+	_, child := Start(remoteCtx, "child")
+	assert.Equal(t, parent.TraceID, child.TraceID)
+	assert.Equal(t, parent.SpanID, child.ParentID)
+	child.Finish(errors.New("failed"))
+	child.Finish(nil)
+	parent.Finish(nil)
+
+	assert.Len(t, spans, 2, "Each span should only be exported once")
+	assert.EqualError(t, spans[0].Err, "failed")
+	assert.Equal(t, 1, spans[1].Attributes["a"])
+	assert.True(t, spans[1].ParentID.IsZero())
+
+	invalid := WithTraceParent(context.Background(), "garbage")
+	assert.Nil(t, FromContext(invalid))
+}
+
+func TestOTLPExporter(t *testing.T) {
+	requests := make(chan map[string]interface{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/v1/traces", req.URL.Path)
+		body, _ := ioutil.ReadAll(req.Body)
+		var parsed map[string]interface{}
+		assert.NoError(t, json.Unmarshal(body, &parsed))
+		requests <- parsed
+	}))
+	defer srv.Close()
+
+	SetExporter(NewOTLPExporter(&OTLPOpts{Endpoint: srv.URL, BatchSize: 2, FlushInterval: time.Hour}))
+	defer SetExporter(nil)
+
+	ctx, parent := Start(context.Background(), "parent", "table", "thetable")
+	_, child := Start(ctx, "child", "rows", int64(5))
+	child.Finish(errors.New("failed"))
+	parent.Finish(nil)
+
+	var req map[string]interface{}
+	select {
+	case req = <-requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Spans not exported")
+	}
+	scopeSpans := req["resourceSpans"].([]interface{})[0].(map[string]interface{})["scopeSpans"].([]interface{})
+	spans := scopeSpans[0].(map[string]interface{})["spans"].([]interface{})
+	if !assert.Len(t, spans, 2) {
+		return
+	}
+	exportedChild := spans[0].(map[string]interface{})
+	assert.Equal(t, "child", exportedChild["name"])
+	assert.Equal(t, parent.SpanID.String(), exportedChild["parentSpanId"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"key": "rows", "value": map[string]interface{}{"intValue": "5"}}}, exportedChild["attributes"])
+	assert.EqualValues(t, 2, exportedChild["status"].(map[string]interface{})["code"])
+	exportedParent := spans[1].(map[string]interface{})
+	assert.Nil(t, exportedParent["parentSpanId"])
+	assert.Nil(t, exportedParent["status"])
+}
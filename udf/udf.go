@@ -0,0 +1,83 @@
+// Package udf provides a registry of user-defined functions that can be used
+// in field expressions, SELECTs and dimensional expressions just like the
+// built-in ones. Functions can be registered directly by programs that embed
+// zenodb, or supplied by Go plugins loaded with LoadPlugin.
+//
+// Functions are looked up by name when queries are parsed and when expressions
+// are exchanged between cluster nodes, so every node needs to register the
+// same functions. Registration is not safe to do concurrently with queries and
+// should happen at startup.
+package udf
+
+import (
+	"fmt"
+	"plugin"
+	"sync"
+
+	"github.com/getlantern/goexpr"
+	"github.com/getlantern/zenodb/expr"
+	"github.com/getlantern/zenodb/sql"
+)
+
+// RegisterFunctionsSymbol is the name of the function that plugins export
+// to register their functions. Its signature is func() error.
+const RegisterFunctionsSymbol = "RegisterFunctions"
+
+var (
+	loadedPlugins   = make(map[string]bool)
+	loadedPluginsMx sync.Mutex
+)
+
+// RegisterScalar registers a function of a single value, like the built-in
+// LN. It can be applied to fields and aggregates, as in MYFN(SUM(x)).
+func RegisterScalar(name string, fn func(float64) float64) error {
+	return expr.RegisterUnaryMath(name, fn)
+}
+
+// RegisterAggregate registers an aggregate, like the built-in SUM. update
+// folds each new value into the current one and merge combines two aggregated
+// values, where wasSet indicates whether current holds a value yet.
+func RegisterAggregate(name string, update func(wasSet bool, current float64, next float64) float64, merge func(wasSet bool, current float64, next float64) float64) error {
+	err := expr.RegisterAggregate(name, update, merge)
+	if err != nil {
+		return err
+	}
+	return sql.RegisterAggregateFunction(name)
+}
+
+// RegisterDimFunction registers a function of a single dimensional
+// expression, for use in WHERE and GROUP BY clauses.
+func RegisterDimFunction(name string, fn func(goexpr.Expr) goexpr.Expr) error {
+	return sql.RegisterUnaryDIMFunction(name, fn)
+}
+
+// LoadPlugin opens the Go plugin at the given path and calls its exported
+// RegisterFunctions, which registers its functions using this package.
+// Plugins run with the full privileges of the process, so only load trusted
+// code. Loading the same plugin more than once has no effect.
+func LoadPlugin(path string) error {
+	loadedPluginsMx.Lock()
+	defer loadedPluginsMx.Unlock()
+	if loadedPlugins[path] {
+		return nil
+	}
+
+	p, err := plugin.Open(path)
+	if err != nil {
+		return fmt.Errorf("Unable to open plugin %v: %v", path, err)
+	}
+	sym, err := p.Lookup(RegisterFunctionsSymbol)
+	if err != nil {
+		return fmt.Errorf("Plugin %v doesn't export %v: %v", path, RegisterFunctionsSymbol, err)
+	}
+	register, ok := sym.(func() error)
+	if !ok {
+		return fmt.Errorf("%v in plugin %v should be a func() error, not %T", RegisterFunctionsSymbol, path, sym)
+	}
+	err = register()
+	if err != nil {
+		return fmt.Errorf("Unable to register functions from plugin %v: %v", path, err)
+	}
+	loadedPlugins[path] = true
+	return nil
+}
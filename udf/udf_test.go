@@ -0,0 +1,57 @@
+package udf
+
+import (
+	"testing"
+
+	"github.com/getlantern/goexpr"
+	"github.com/getlantern/zenodb/expr"
+	"github.com/getlantern/zenodb/sql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegister(t *testing.T) {
+	assert.NoError(t, RegisterScalar("double", func(val float64) float64 {
+		return val * 2
+	}))
+	assert.Error(t, RegisterScalar("DOUBLE", nil), "duplicate name")
+	assert.NoError(t, RegisterAggregate("product", func(wasSet bool, current float64, next float64) float64 {
+		if !wasSet {
+			return next
+		}
+		return current * next
+	}, func(wasSet bool, current float64, next float64) float64 {
+		if !wasSet {
+			return next
+		}
+		return current * next
+	}))
+	assert.Error(t, RegisterAggregate("SUM", nil, nil), "built-in name")
+	assert.NoError(t, RegisterDimFunction("shout", func(wrapped goexpr.Expr) goexpr.Expr {
+		return goexpr.Concat(goexpr.Constant(""), wrapped, goexpr.Constant("!"))
+	}))
+
+	q, err := sql.Parse("SELECT DOUBLE(a) AS doubled, PRODUCT(b) AS product FROM t GROUP BY SHOUT(d) AS shouted")
+	if !assert.NoError(t, err) {
+		return
+	}
+	fields, err := q.Fields.Get(nil)
+	if !assert.NoError(t, err) || !assert.Len(t, fields, 2) {
+		return
+	}
+	for i, expected := range []float64{14, 12} {
+		e := fields[i].Expr
+		b := make([]byte, e.EncodedWidth())
+		e.Update(b, expr.Map{"a": 3, "b": 3}, nil)
+		e.Update(b, expr.Map{"a": 4, "b": 4}, nil)
+		val, _, _ := e.Get(b)
+		assert.EqualValues(t, expected, val, fields[i].Name)
+	}
+
+	if assert.Len(t, q.GroupBy, 1) {
+		assert.Equal(t, "d!", q.GroupBy[0].Expr.Eval(goexpr.MapParams{"d": "d"}))
+	}
+}
+
+func TestLoadPluginMissing(t *testing.T) {
+	assert.Error(t, LoadPlugin("/no/such/plugin.so"))
+}
@@ -94,7 +94,8 @@ func (ce cacheEntry) update(status byte, data []byte) cacheEntry {
 }
 
 func (ce cacheEntry) copy() cacheEntry {
-	if ce == nil {
+	if len(ce) < idxData {
+		// Missing or corrupted, treat as not found
 		return nil
 	}
 	result := make(cacheEntry, len(ce))
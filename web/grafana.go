@@ -0,0 +1,358 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/getlantern/zenodb/core"
+)
+
+// The endpoints in this file implement the contract expected by Grafana's
+// JSON datasource (https://github.com/grafana/simple-json-datasource). Configure
+// the datasource with a URL like https://zenohost:17713/grafana and, if using
+// password authentication, a custom header X-Zeno-Auth-Token.
+//
+// Targets and annotation queries are zenodb SQL in which the following macros
+// are expanded:
+//
+//	$__timeFrom - the start of the dashboard's time range, e.g. ASOF $__timeFrom
+//	$__timeTo   - the end of the dashboard's time range, e.g. UNTIL $__timeTo
+//	$__interval - the interval suggested by Grafana, e.g. period($__interval)
+
+const (
+	grafanaTypeTable = "table"
+)
+
+type grafanaRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+type grafanaTarget struct {
+	Target string `json:"target"`
+	RefID  string `json:"refId"`
+	Type   string `json:"type"`
+}
+
+type grafanaQueryRequest struct {
+	Range      grafanaRange    `json:"range"`
+	IntervalMs int64           `json:"intervalMs"`
+	Targets    []grafanaTarget `json:"targets"`
+}
+
+type grafanaTimeSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+type grafanaColumn struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+type grafanaTable struct {
+	Type    string          `json:"type"`
+	Columns []grafanaColumn `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+type grafanaAnnotationRequest struct {
+	Range      grafanaRange           `json:"range"`
+	Annotation map[string]interface{} `json:"annotation"`
+}
+
+type grafanaAnnotation struct {
+	Annotation map[string]interface{} `json:"annotation"`
+	Time       int64                  `json:"time"`
+	Title      string                 `json:"title"`
+	Text       string                 `json:"text"`
+	Tags       []string               `json:"tags"`
+}
+
+// grafanaTest responds to Grafana's "Test connection" request.
+func (h *handler) grafanaTest(resp http.ResponseWriter, req *http.Request) {
+	if !h.authenticate(resp, req) {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+// grafanaSearch lists the tables whose names contain the requested target.
+func (h *handler) grafanaSearch(resp http.ResponseWriter, req *http.Request) {
+	if !h.authenticate(resp, req) {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	target := &grafanaTarget{}
+	err := decodeGrafanaRequest(req, target)
+	if err != nil {
+		badRequest(resp, "Unable to decode search request: %v", err)
+		return
+	}
+
+	search := strings.ToLower(target.Target)
+	tables := make([]string, 0)
+	for table := range h.db.AllTableStats() {
+		if strings.Contains(table, search) {
+			tables = append(tables, table)
+		}
+	}
+	sort.Strings(tables)
+	respondJSON(resp, tables)
+}
+
+// grafanaQuery runs each target and returns it either as time series (one
+// series per field and unique combination of dimensions) or as a table.
+func (h *handler) grafanaQuery(resp http.ResponseWriter, req *http.Request) {
+	if !h.authenticate(resp, req) {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	q := &grafanaQueryRequest{}
+	err := decodeGrafanaRequest(req, q)
+	if err != nil {
+		badRequest(resp, "Unable to decode query request: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), h.QueryTimeout)
+	defer cancel()
+
+	results := make([]interface{}, 0, len(q.Targets))
+	for _, target := range q.Targets {
+		sqlString := expandGrafanaMacros(target.Target, q.Range, time.Duration(q.IntervalMs)*time.Millisecond)
+		fields, rows, err := h.grafanaRows(ctx, sqlString)
+		if err != nil {
+			badRequest(resp, "Unable to run query for %v: %v", target.RefID, err)
+			return
+		}
+		if target.Type == grafanaTypeTable {
+			results = append(results, toGrafanaTable(fields, rows))
+		} else {
+			for _, series := range toGrafanaTimeSeries(fields, rows) {
+				results = append(results, series)
+			}
+		}
+	}
+	respondJSON(resp, results)
+}
+
+// grafanaAnnotations runs the annotation's query and returns an annotation for
+// each resulting row, tagged with the row's dimension values.
+func (h *handler) grafanaAnnotations(resp http.ResponseWriter, req *http.Request) {
+	if !h.authenticate(resp, req) {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	q := &grafanaAnnotationRequest{}
+	err := decodeGrafanaRequest(req, q)
+	if err != nil {
+		badRequest(resp, "Unable to decode annotation request: %v", err)
+		return
+	}
+	query, _ := q.Annotation["query"].(string)
+	if query == "" {
+		badRequest(resp, "Please specify an annotation query")
+		return
+	}
+	name, _ := q.Annotation["name"].(string)
+
+	ctx, cancel := context.WithTimeout(req.Context(), h.QueryTimeout)
+	defer cancel()
+
+	fields, rows, err := h.grafanaRows(ctx, expandGrafanaMacros(query, q.Range, 0))
+	if err != nil {
+		badRequest(resp, "Unable to run annotation query: %v", err)
+		return
+	}
+
+	annotations := make([]*grafanaAnnotation, 0, len(rows))
+	for _, row := range rows {
+		annotations = append(annotations, &grafanaAnnotation{
+			Annotation: q.Annotation,
+			Time:       row.TS / nanosPerMilli,
+			Title:      name,
+			Text:       describeGrafanaRow(fields, row),
+			Tags:       dimValues(row.Key),
+		})
+	}
+	respondJSON(resp, annotations)
+}
+
+func (h *handler) grafanaRows(ctx context.Context, sqlString string) ([]string, []*ResultRow, error) {
+	rs, err := h.db.Query(sqlString, false, nil, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var fields []string
+	var rows []*ResultRow
+	err = rs.Iterate(ctx, func(inFields core.Fields) error {
+		for _, field := range inFields {
+			fields = append(fields, field.Name)
+		}
+		return nil
+	}, func(row *core.FlatRow) (bool, error) {
+		key := make(map[string]interface{}, 10)
+		row.Key.Iterate(true, true, func(dim string, value interface{}, valueBytes []byte) bool {
+			key[dim] = value
+			return true
+		})
+		rows = append(rows, &ResultRow{
+			TS:   row.TS,
+			Key:  key,
+			Vals: row.Values,
+		})
+		return true, nil
+	})
+	return fields, rows, err
+}
+
+func expandGrafanaMacros(sqlString string, r grafanaRange, interval time.Duration) string {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	return strings.NewReplacer(
+		"$__timeFrom", fmt.Sprintf("'%v'", r.From.In(time.UTC).Format(time.RFC3339)),
+		"$__timeTo", fmt.Sprintf("'%v'", r.To.In(time.UTC).Format(time.RFC3339)),
+		"$__interval", fmt.Sprintf("'%v'", interval),
+	).Replace(sqlString)
+}
+
+func toGrafanaTimeSeries(fields []string, rows []*ResultRow) []*grafanaTimeSeries {
+	seriesByName := make(map[string]*grafanaTimeSeries)
+	var names []string
+	for _, row := range rows {
+		dims := describeKey(row.Key)
+		for i, field := range fields {
+			if i >= len(row.Vals) {
+				break
+			}
+			name := field
+			if dims != "" {
+				name = fmt.Sprintf("%v {%v}", field, dims)
+			}
+			series := seriesByName[name]
+			if series == nil {
+				series = &grafanaTimeSeries{Target: name}
+				seriesByName[name] = series
+				names = append(names, name)
+			}
+			series.Datapoints = append(series.Datapoints, [2]float64{row.Vals[i], float64(row.TS / nanosPerMilli)})
+		}
+	}
+
+	sort.Strings(names)
+	result := make([]*grafanaTimeSeries, 0, len(names))
+	for _, name := range names {
+		series := seriesByName[name]
+		// Grafana expects datapoints in ascending time order
+		sort.Slice(series.Datapoints, func(i, j int) bool {
+			return series.Datapoints[i][1] < series.Datapoints[j][1]
+		})
+		result = append(result, series)
+	}
+	return result
+}
+
+func toGrafanaTable(fields []string, rows []*ResultRow) *grafanaTable {
+	dims := sortedDims(rows)
+	table := &grafanaTable{
+		Type:    grafanaTypeTable,
+		Columns: make([]grafanaColumn, 0, 1+len(dims)+len(fields)),
+		Rows:    make([][]interface{}, 0, len(rows)),
+	}
+	table.Columns = append(table.Columns, grafanaColumn{"Time", "time"})
+	for _, dim := range dims {
+		table.Columns = append(table.Columns, grafanaColumn{dim, "string"})
+	}
+	for _, field := range fields {
+		table.Columns = append(table.Columns, grafanaColumn{field, "number"})
+	}
+	for _, row := range rows {
+		values := make([]interface{}, 0, len(table.Columns))
+		values = append(values, row.TS/nanosPerMilli)
+		for _, dim := range dims {
+			values = append(values, row.Key[dim])
+		}
+		for _, val := range row.Vals {
+			values = append(values, val)
+		}
+		table.Rows = append(table.Rows, values)
+	}
+	return table
+}
+
+func sortedDims(rows []*ResultRow) []string {
+	dimsMap := make(map[string]bool)
+	for _, row := range rows {
+		for dim := range row.Key {
+			dimsMap[dim] = true
+		}
+	}
+	dims := make([]string, 0, len(dimsMap))
+	for dim := range dimsMap {
+		dims = append(dims, dim)
+	}
+	sort.Strings(dims)
+	return dims
+}
+
+// describeKey formats the dimensions in the given key like "a=1, b=2".
+func describeKey(key map[string]interface{}) string {
+	dims := make([]string, 0, len(key))
+	for dim, value := range key {
+		dims = append(dims, fmt.Sprintf("%v=%v", dim, value))
+	}
+	sort.Strings(dims)
+	return strings.Join(dims, ", ")
+}
+
+func describeGrafanaRow(fields []string, row *ResultRow) string {
+	parts := make([]string, 0, len(fields)+1)
+	if dims := describeKey(row.Key); dims != "" {
+		parts = append(parts, dims)
+	}
+	for i, field := range fields {
+		if i < len(row.Vals) {
+			parts = append(parts, fmt.Sprintf("%v: %v", field, row.Vals[i]))
+		}
+	}
+	return strings.Join(parts, "<br>")
+}
+
+func dimValues(key map[string]interface{}) []string {
+	values := make([]string, 0, len(key))
+	for _, value := range key {
+		values = append(values, fmt.Sprint(value))
+	}
+	sort.Strings(values)
+	return values
+}
+
+func decodeGrafanaRequest(req *http.Request, v interface{}) error {
+	err := json.NewDecoder(io.LimitReader(req.Body, maxSQLBytes)).Decode(v)
+	if err == io.EOF {
+		// Grafana sometimes sends empty bodies (e.g. search with no target)
+		return nil
+	}
+	return err
+}
+
+func respondJSON(resp http.ResponseWriter, v interface{}) {
+	resp.Header().Set(ContentType, ContentTypeJSON)
+	err := json.NewEncoder(resp).Encode(v)
+	if err != nil {
+		log.Errorf("Unable to write JSON response: %v", err)
+	}
+}
@@ -0,0 +1,54 @@
+package web
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandGrafanaMacros(t *testing.T) {
+	r := grafanaRange{
+		From: time.Date(2017, 4, 1, 10, 0, 0, 0, time.UTC),
+		To:   time.Date(2017, 4, 1, 11, 0, 0, 0, time.UTC),
+	}
+	assert.Equal(t,
+		"SELECT * FROM t ASOF '2017-04-01T10:00:00Z' UNTIL '2017-04-01T11:00:00Z' GROUP BY period('5m0s')",
+		expandGrafanaMacros("SELECT * FROM t ASOF $__timeFrom UNTIL $__timeTo GROUP BY period($__interval)", r, 5*time.Minute))
+	assert.Equal(t, "period('1m0s')", expandGrafanaMacros("period($__interval)", r, 0), "interval should default to 1 minute")
+}
+
+func TestGrafanaTimeSeries(t *testing.T) {
+	fields := []string{"a", "b"}
+	rows := []*ResultRow{
+		{TS: 2 * nanosPerMilli, Key: map[string]interface{}{"x": 1}, Vals: []float64{2, 20}},
+		{TS: 1 * nanosPerMilli, Key: map[string]interface{}{"x": 1}, Vals: []float64{1, 10}},
+		{TS: 1 * nanosPerMilli, Key: map[string]interface{}{}, Vals: []float64{3, 30}},
+	}
+	series := toGrafanaTimeSeries(fields, rows)
+	if !assert.Len(t, series, 4) {
+		return
+	}
+	assert.Equal(t, "a", series[0].Target)
+	assert.Equal(t, [][2]float64{{3, 1}}, series[0].Datapoints)
+	assert.Equal(t, "a {x=1}", series[1].Target)
+	assert.Equal(t, [][2]float64{{1, 1}, {2, 2}}, series[1].Datapoints, "datapoints should be sorted by time")
+	assert.Equal(t, "b", series[2].Target)
+	assert.Equal(t, "b {x=1}", series[3].Target)
+	assert.Equal(t, [][2]float64{{10, 1}, {20, 2}}, series[3].Datapoints)
+}
+
+func TestGrafanaTable(t *testing.T) {
+	fields := []string{"a"}
+	rows := []*ResultRow{
+		{TS: 2 * nanosPerMilli, Key: map[string]interface{}{"y": "b", "x": 1}, Vals: []float64{2}},
+		{TS: 1 * nanosPerMilli, Key: map[string]interface{}{"x": 2}, Vals: []float64{1}},
+	}
+	table := toGrafanaTable(fields, rows)
+	assert.Equal(t, grafanaTypeTable, table.Type)
+	assert.Equal(t, []grafanaColumn{{"Time", "time"}, {"x", "string"}, {"y", "string"}, {"a", "number"}}, table.Columns)
+	assert.Equal(t, [][]interface{}{
+		{int64(2), 1, "b", float64(2)},
+		{int64(1), 2, nil, float64(1)},
+	}, table.Rows)
+}
@@ -4,8 +4,8 @@ import (
 	"crypto/rand"
 	"errors"
 	"fmt"
-	"github.com/getlantern/golog"
 	"github.com/getlantern/zenodb"
+	"github.com/getlantern/zenodb/logging"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/securecookie"
 	"net/http"
@@ -14,7 +14,7 @@ import (
 )
 
 var (
-	log = golog.LoggerFor("zenodb.web")
+	log = logging.LoggerFor("zenodb.web")
 )
 
 type Opts struct {
@@ -100,6 +100,12 @@ func Configure(db *zenodb.DB, router *mux.Router, opts *Opts) error {
 
 	router.StrictSlash(true)
 	router.HandleFunc("/insert/{stream}", h.insert)
+	router.HandleFunc("/query", h.streamQuery)
+	router.HandleFunc("/tables", h.listTables)
+	router.HandleFunc("/grafana", h.grafanaTest)
+	router.HandleFunc("/grafana/search", h.grafanaSearch)
+	router.HandleFunc("/grafana/query", h.grafanaQuery)
+	router.HandleFunc("/grafana/annotations", h.grafanaAnnotations)
 	router.HandleFunc("/oauth/code", h.oauthCode)
 	router.PathPrefix("/async").HandlerFunc(h.asyncQuery)
 	router.PathPrefix("/run").HandlerFunc(h.runQuery)
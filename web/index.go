@@ -99,6 +99,18 @@ var indexHTML = []byte(`
         }
     }
 
+		#tables {
+			margin-top: 10px;
+		}
+
+		#tables td {
+			vertical-align: top;
+		}
+
+		#tables .expr {
+			color: #777;
+		}
+
 		#autoplot-instructions {
 			display: none;
 		}
@@ -240,6 +252,57 @@ var indexHTML = []byte(`
 		<div class="{{#if inIframe}}hide{{/if}}">
 	    <h3>ZenoDB | SQL Query {{#if result.Permalink}}<span><a href="/report/{{ result.Permalink }}">report permalink</a></span>{{/if}}</h3>
 
+			<div style="margin-bottom: 10px;">
+			  <button type="button" class="btn btn-default btn-sm" on-click="toggleTables">
+	        <span class="glyphicon glyphicon-th-list" aria-hidden="true"></span> {{#if showTables}}Hide{{else}}Show{{/if}} Tables
+	      </button>
+			  {{#if tablesError}}<span class="error">Error: {{ tablesError }}</span>{{/if}}
+	    </div>
+
+	    {{#if showTables && tables}}
+	      <table id="tables" class="table table-condensed">
+	        <thead>
+	          <tr>
+	            <th>Table</th>
+	            <th>From</th>
+	            <th>Resolution</th>
+	            <th>Retention</th>
+	            <th>Dimensions</th>
+	            <th>Fields</th>
+	            <th>Inserted</th>
+	            <th>Keys on Disk</th>
+	            <th>Size on Disk</th>
+	            <th>Memstore</th>
+	            <th>Queued</th>
+	          </tr>
+	        </thead>
+	        <tbody>
+	          {{#each tables as table}}
+	          <tr>
+	            <td>
+	              {{#if table.Virtual}}
+	                {{ table.Name }} (virtual)
+	              {{else}}
+	                <a href="#" title="Query this table" on-click="browse:{{ table.Name }}">{{ table.Name }}</a>{{#if table.View}} (view){{/if}}{{#if table.MemoryOnly}} (memory){{/if}}{{#if table.Columnar}} (columnar){{/if}}
+	              {{/if}}
+	              {{#if table.Stats.Paused}}<span class="label label-warning">{{#if table.Stats.Discarding}}discarding{{else}}paused{{/if}}</span>{{/if}}
+	            </td>
+	            <td>{{ table.From }}</td>
+	            <td>{{ formatDuration(table.Resolution) }}</td>
+	            <td>{{ formatDuration(table.RetentionPeriod) }}</td>
+	            <td>{{#if table.GroupByAll}}*{{else}}{{#each table.Dims as dim}}{{ dim }}<br>{{/each}}{{/if}}</td>
+	            <td>{{#each table.Fields as field}}{{ field.Name }} <span class="expr">{{ field.Expr }}</span><br>{{/each}}</td>
+	            <td>{{ table.Stats.InsertedPoints }}</td>
+	            <td>{{ table.Stats.DiskKeys }}</td>
+	            <td>{{ formatBytes(table.Stats.DiskBytes) }}</td>
+	            <td>{{ formatBytes(table.Stats.MemStoreBytes) }}</td>
+	            <td>{{ table.Stats.ArchiveQueueDepth }}</td>
+	          </tr>
+	          {{/each}}
+	        </tbody>
+	      </table>
+	    {{/if}}
+
 			<div id="sql">{{ sql }}</div>
 
 		  <div style="margin-top: 10px;">
@@ -355,6 +418,11 @@ var indexHTML = []byte(`
       "result": null,
 			"error": null,
       "formatTS": formatTS,
+      "formatDuration": formatDuration,
+      "formatBytes": formatBytes,
+      "showTables": false,
+      "tables": null,
+      "tablesError": null,
       "date": null,
       "showTimeSeriesChart": false,
       "showOtherChart": false,
@@ -363,6 +431,18 @@ var indexHTML = []byte(`
     ractive.on("run", function() {
       runQuery(false);
     });
+    ractive.on("toggleTables", function() {
+      var showTables = !ractive.get("showTables");
+      ractive.set("showTables", showTables);
+      if (showTables) {
+        loadTables();
+      }
+    });
+    ractive.on("browse", function(event, table) {
+      editor.setValue("SELECT *\nFROM " + table + "\nORDER BY _time", 1);
+      runQuery(false);
+      return false;
+    });
 
     // Set up ace editor
 	  var editor = ace.edit("sql");
@@ -455,6 +535,23 @@ var indexHTML = []byte(`
 			console.log("Sent xhr");
     }
 
+    function loadTables() {
+      ractive.set("tablesError", null);
+      var xhr = new XMLHttpRequest();
+      xhr.open('GET', '/tables', true);
+      xhr.setRequestHeader("Cache-Control", "no-cache");
+      xhr.onreadystatechange = function(e) {
+        if (this.readyState == 4) {
+          if (this.status == 200) {
+            ractive.set("tables", JSON.parse(this.responseText));
+          } else {
+            ractive.set("tablesError", this.status + " - " + this.responseText);
+          }
+        }
+      };
+      xhr.send();
+    }
+
     function plot(result) {
       // Always seed random number generator with same value so that colors are
       // generated in a repeatable way.
@@ -604,6 +701,31 @@ var indexHTML = []byte(`
       return new Date(ts).toString();
     }
 
+    // Formats a duration in nanoseconds using the largest whole unit
+    function formatDuration(nanos) {
+      if (!nanos) {
+        return "";
+      }
+      var seconds = nanos / 1000000000;
+      var units = [["d", 86400], ["h", 3600], ["m", 60]];
+      for (var i = 0; i < units.length; i++) {
+        if (seconds >= units[i][1] && seconds % units[i][1] == 0) {
+          return (seconds / units[i][1]) + units[i][0];
+        }
+      }
+      return seconds + "s";
+    }
+
+    function formatBytes(bytes) {
+      var units = ["B", "KB", "MB", "GB", "TB"];
+      var i = 0;
+      while (bytes >= 1024 && i < units.length - 1) {
+        bytes /= 1024;
+        i++;
+      }
+      return (i == 0 ? bytes : bytes.toFixed(1)) + " " + units[i];
+    }
+
     // Courtesty of http://stackoverflow.com/questions/25594478/different-color-for-each-bar-in-a-bar-chart-chartjs
     function randomColor() {
       var letters = '0123456789ABCDEF'.split('');
@@ -14,8 +14,11 @@ import (
 	"time"
 
 	"github.com/dustin/go-humanize"
+	"github.com/getlantern/zenodb"
+	"github.com/getlantern/zenodb/common"
 	"github.com/getlantern/zenodb/core"
 	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/sql"
 	"github.com/gorilla/mux"
 	"github.com/retailnext/hllpp"
 )
@@ -34,6 +37,7 @@ type QueryResult struct {
 	TS                 int64
 	TSCardinality      uint64
 	Fields             []string
+	FieldMetadata      map[string]*common.FieldMetadata
 	FieldCardinalities []uint64
 	Dims               []string
 	DimCardinalities   []uint64
@@ -125,7 +129,7 @@ func (h *handler) respondError(resp http.ResponseWriter, req *http.Request, ce c
 }
 
 func (h *handler) query(req *http.Request, sqlString string) (ce cacheEntry, err error) {
-	if req.Header.Get("Cache-control") == "no-cache" {
+	if req.Header.Get("Cache-control") == "no-cache" || hasNoCacheHint(sqlString) {
 		ce, err = h.cache.begin(sqlString)
 		if err != nil {
 			return
@@ -245,6 +249,7 @@ func (h *handler) doQuery(sqlString string, permalink string) (*QueryResult, err
 			result.Fields = append(result.Fields, field.Name)
 			fieldCardinalities = append(fieldCardinalities, hllpp.New())
 		}
+		result.FieldMetadata = zenodb.FieldMetadataFor(rs, fields)
 		return nil
 	}, func(row *core.FlatRow) (bool, error) {
 		mx.Lock()
@@ -314,3 +319,10 @@ func intToBytes(i uint64) []byte {
 	encoding.Binary.PutUint64(b, i)
 	return b
 }
+
+// hasNoCacheHint indicates whether the given query has the NO_CACHE hint.
+// Queries whose hints don't parse fail when they're run.
+func hasNoCacheHint(sqlString string) bool {
+	hints, _, err := sql.ExtractHints(sqlString)
+	return err == nil && hints.NoCache
+}
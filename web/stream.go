@@ -0,0 +1,274 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+)
+
+const (
+	// ContentTypeNDJSON is the content type for newline-delimited JSON
+	ContentTypeNDJSON = "application/x-ndjson"
+
+	// ContentTypeSSE is the content type for server-sent events
+	ContentTypeSSE = "text/event-stream"
+
+	// ContentTypeCSV is the content type for comma-separated values
+	ContentTypeCSV = "text/csv"
+
+	// ContentTypeTSV is the content type for tab-separated values
+	ContentTypeTSV = "text/tab-separated-values"
+
+	maxSQLBytes = 1024 * 1024
+
+	formatNDJSON = "ndjson"
+	formatSSE    = "sse"
+
+	// streamFlushRows is how many rows of CSV or TSV to write between flushes
+	streamFlushRows = 1000
+)
+
+// StreamedFields is the first message sent by the /query endpoint and lists
+// the names of the fields whose values are included in each StreamedRow.
+type StreamedFields struct {
+	Fields []string `json:"fields"`
+}
+
+// StreamedRow is a single row of results sent by the /query endpoint.
+type StreamedRow struct {
+	TS   int64                  `json:"ts"`
+	Key  map[string]interface{} `json:"key"`
+	Vals []float64              `json:"vals"`
+}
+
+// queryRequest is the JSON form of the body of a request to the /query
+// endpoint.
+type queryRequest struct {
+	SQL    string `json:"sql"`
+	Format string `json:"format"`
+}
+
+// StreamedError is sent by the /query endpoint if the query fails after
+// results have started streaming.
+type StreamedError struct {
+	Error string `json:"error"`
+}
+
+// streamQuery executes the SQL query in the request body (either as plain text
+// or as a JSON object like {"sql": "SELECT ..."}) and streams the results as
+// they become available. If the client accepts text/event-stream, results are
+// sent as server-sent events, otherwise they are sent as newline-delimited
+// JSON.
+//
+// Results can instead be rendered as CSV or TSV for loading into spreadsheets,
+// either by specifying the format "csv" or "tsv" in the format query parameter
+// or the JSON request body, or by accepting text/csv or
+// text/tab-separated-values. Header lines can be omitted with the query
+// parameter header=false.
+func (h *handler) streamQuery(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(resp, "Method %v not allowed\n", req.Method)
+		return
+	}
+
+	if !h.authenticate(resp, req) {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	q, err := queryFromBody(req)
+	if err != nil {
+		badRequest(resp, "Unable to read SQL: %v", err)
+		return
+	}
+	if q.SQL == "" {
+		badRequest(resp, "Please specify a query")
+		return
+	}
+	format, err := streamFormat(req, q)
+	if err != nil {
+		badRequest(resp, "%v", err)
+		return
+	}
+
+	rs, err := h.db.Query(q.SQL, false, nil, false)
+	if err != nil {
+		badRequest(resp, "Unable to plan query: %v", err)
+		return
+	}
+
+	if common.IsDelimitedFormat(format) {
+		h.streamDelimited(resp, req, q.SQL, format, rs)
+		return
+	}
+
+	sse := format == formatSSE
+	contentType := ContentTypeNDJSON
+	if sse {
+		contentType = ContentTypeSSE
+	}
+	resp.Header().Set(ContentType, contentType)
+	resp.Header().Set("Cache-control", "no-cache")
+	resp.WriteHeader(http.StatusOK)
+
+	flusher, _ := resp.(http.Flusher)
+	send := func(event string, msg interface{}) error {
+		b, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		if sse {
+			_, err = fmt.Fprintf(resp, "event: %v\ndata: %s\n\n", event, b)
+		} else {
+			_, err = fmt.Fprintf(resp, "%s\n", b)
+		}
+		if err == nil && flusher != nil {
+			flusher.Flush()
+		}
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), h.QueryTimeout)
+	defer cancel()
+
+	err = rs.Iterate(ctx, func(fields core.Fields) error {
+		names := make([]string, 0, len(fields))
+		for _, field := range fields {
+			names = append(names, field.Name)
+		}
+		return send("fields", &StreamedFields{names})
+	}, func(row *core.FlatRow) (bool, error) {
+		key := make(map[string]interface{}, 10)
+		row.Key.Iterate(true, true, func(dim string, value interface{}, valueBytes []byte) bool {
+			key[dim] = value
+			return true
+		})
+		return true, send("row", &StreamedRow{
+			TS:   row.TS / nanosPerMilli,
+			Key:  key,
+			Vals: row.Values,
+		})
+	})
+	if err != nil {
+		log.Errorf("Error streaming results for %v: %v", q.SQL, err)
+		send("error", &StreamedError{err.Error()})
+		return
+	}
+	if sse {
+		send("end", struct{}{})
+	}
+}
+
+// streamDelimited streams the results of the given query as CSV or TSV,
+// flushing every streamFlushRows rows. Since the status has already been sent
+// by the time results stream, errors are only logged and cut the response
+// short.
+func (h *handler) streamDelimited(resp http.ResponseWriter, req *http.Request, sqlString string, format string, rs core.FlatRowSource) {
+	contentType := ContentTypeCSV
+	if format == common.FormatTSV {
+		contentType = ContentTypeTSV
+	}
+	header := req.URL.Query().Get("header") != "false"
+
+	ctx, cancel := context.WithTimeout(req.Context(), h.QueryTimeout)
+	defer cancel()
+
+	flusher, _ := resp.(http.Flusher)
+	flush := func(dw *common.DelimitedWriter) error {
+		err := dw.Flush()
+		if err == nil && flusher != nil {
+			flusher.Flush()
+		}
+		return err
+	}
+
+	var dw *common.DelimitedWriter
+	started := false
+	numRows := 0
+	err := rs.Iterate(ctx, func(fields core.Fields) error {
+		started = true
+		resp.Header().Set(ContentType, contentType+"; charset=utf-8")
+		resp.Header().Set("Cache-control", "no-cache")
+		resp.WriteHeader(http.StatusOK)
+		var writerErr error
+		dw, writerErr = common.NewDelimitedWriter(resp, format, fields.Names(), core.GroupByNames(rs.GetGroupBy()), header)
+		return writerErr
+	}, func(row *core.FlatRow) (bool, error) {
+		writeErr := dw.WriteRow(row.TS, row.Key, row.Values)
+		if writeErr != nil {
+			return false, writeErr
+		}
+		numRows++
+		if numRows%streamFlushRows == 0 {
+			return true, flush(dw)
+		}
+		return true, nil
+	})
+	if err == nil && dw != nil {
+		err = dw.Close()
+	}
+	if err != nil {
+		log.Errorf("Error streaming results for %v: %v", sqlString, err)
+		if !started {
+			badRequest(resp, "Unable to run query: %v", err)
+		}
+	}
+}
+
+// streamFormat determines the format in which to stream results, preferring
+// the format specified in the request body, then the format query parameter
+// and finally the Accept header.
+func streamFormat(req *http.Request, q *queryRequest) (string, error) {
+	format := q.Format
+	if format == "" {
+		format = req.URL.Query().Get("format")
+	}
+	if format == "" {
+		accept := req.Header.Get("Accept")
+		switch {
+		case strings.Contains(accept, ContentTypeSSE):
+			format = formatSSE
+		case strings.Contains(accept, ContentTypeCSV):
+			format = common.FormatCSV
+		case strings.Contains(accept, ContentTypeTSV):
+			format = common.FormatTSV
+		default:
+			format = formatNDJSON
+		}
+	}
+	format = strings.ToLower(format)
+	switch format {
+	case formatNDJSON, formatSSE, common.FormatCSV, common.FormatTSV:
+		return format, nil
+	default:
+		return "", fmt.Errorf("Unknown format %v, expected one of %v, %v, %v or %v", format, formatNDJSON, formatSSE, common.FormatCSV, common.FormatTSV)
+	}
+}
+
+func queryFromBody(req *http.Request) (*queryRequest, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxSQLBytes))
+	if err != nil {
+		return nil, err
+	}
+	q := &queryRequest{}
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get(ContentType))
+	if mediaType == ContentTypeJSON {
+		err = json.Unmarshal(body, q)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		q.SQL = string(body)
+	}
+	q.SQL = strings.TrimSpace(q.SQL)
+	return q, nil
+}
@@ -0,0 +1,69 @@
+package web
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryFromBody(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodPost, "/query", bytes.NewBufferString("  SELECT * FROM table\n"))
+	q, err := queryFromBody(req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "SELECT * FROM table", q.SQL)
+	}
+
+	req, _ = http.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(`{"sql": "SELECT * FROM other"}`))
+	req.Header.Set(ContentType, ContentTypeJSON)
+	q, err = queryFromBody(req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "SELECT * FROM other", q.SQL)
+	}
+
+	req, _ = http.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(`{"sql": "SELECT * FROM other", "format": "tsv"}`))
+	req.Header.Set(ContentType, ContentTypeJSON)
+	q, err = queryFromBody(req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "SELECT * FROM other", q.SQL)
+		assert.Equal(t, common.FormatTSV, q.Format)
+	}
+
+	req, _ = http.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(`{"sql": "SELECT * FROM charset"}`))
+	req.Header.Set(ContentType, ContentTypeJSON+"; charset=utf-8")
+	q, err = queryFromBody(req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "SELECT * FROM charset", q.SQL)
+	}
+
+	req, _ = http.NewRequest(http.MethodPost, "/query", bytes.NewBufferString(`{"sql": `))
+	req.Header.Set(ContentType, ContentTypeJSON)
+	_, err = queryFromBody(req)
+	assert.Error(t, err)
+}
+
+func TestStreamFormat(t *testing.T) {
+	check := func(url string, accept string, q *queryRequest, expected string) {
+		req, _ := http.NewRequest(http.MethodPost, url, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		format, err := streamFormat(req, q)
+		if assert.NoError(t, err, url) {
+			assert.Equal(t, expected, format, url)
+		}
+	}
+
+	check("/query", "", &queryRequest{}, formatNDJSON)
+	check("/query", ContentTypeSSE, &queryRequest{}, formatSSE)
+	check("/query", ContentTypeCSV, &queryRequest{}, common.FormatCSV)
+	check("/query", ContentTypeTSV+", */*", &queryRequest{}, common.FormatTSV)
+	check("/query?format=CSV", ContentTypeSSE, &queryRequest{}, common.FormatCSV)
+	check("/query?format=csv", "", &queryRequest{Format: "tsv"}, common.FormatTSV)
+
+	req, _ := http.NewRequest(http.MethodPost, "/query?format=xlsx", nil)
+	_, err := streamFormat(req, &queryRequest{})
+	assert.Error(t, err, "unknown format should fail")
+}
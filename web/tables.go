@@ -0,0 +1,16 @@
+package web
+
+import (
+	"net/http"
+)
+
+// listTables responds with a JSON description of all tables, including their
+// fields and current stats, for the console's table browser.
+func (h *handler) listTables(resp http.ResponseWriter, req *http.Request) {
+	if !h.authenticate(resp, req) {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	respondJSON(resp, h.db.DescribeTables())
+}
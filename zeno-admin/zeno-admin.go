@@ -0,0 +1,125 @@
+// zeno-admin performs administrative operations on a running zeno server.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/zenodb/rpc"
+)
+
+var (
+	log = golog.LoggerFor("zeno-admin")
+
+	addr     = flag.String("addr", ":17712", "The address to which to connect with gRPC over TLS, defaults to localhost:17712")
+	insecure = flag.Bool("insecure", false, "set to true to disable TLS certificate verification when connecting to the server (don't use this in production!)")
+	timeout  = flag.Duration("timeout", 5*time.Minute, "specify the timeout for operations, defaults to 5 minutes")
+	password = flag.String("password", "", "if specified, will authenticate against server using this password (or admin token)")
+)
+
+var tableOps = map[string]bool{
+	rpc.AdminFlush:         true,
+	rpc.AdminRetention:     true,
+	rpc.AdminPause:         true,
+	rpc.AdminResume:        true,
+	rpc.AdminDiscard:       true,
+	rpc.AdminDrain:         true,
+	rpc.AdminRemap:         true,
+	rpc.AdminRemapStatus:   true,
+	rpc.AdminCanonicalize:  true,
+	rpc.AdminMigrate:       true,
+	rpc.AdminMigrateStatus: true,
+	rpc.AdminBackfill:      true,
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: zeno-admin [flags] <command> [table] [args]
+
+Commands:
+  %-35v flush (archive) the table's memstore to disk now
+  %-35v truncate expired data from the table and its WAL now
+  %-35v send inserts queued for forwarding to the leader now
+  %-35v pause ingestion into the table
+  %-35v resume ingestion into the table
+  %-35v pause ingestion into the table and drop new points
+  %-35v pause ingestion into the table and flush its memstore
+  %-35v print the schema of all tables as YAML
+  %-35v start replacing values of dim in the table's keys
+  %-35v show the progress of the table's last remap
+  %-35v merge keys that weren't stored in canonical form
+  %-35v start migrating the table to new SQL
+  %-35v show the progress of the table's last migration
+  %-35v start recomputing the view from its source table
+
+Flags:
+`, rpc.AdminFlush+" <table>", rpc.AdminRetention+" <table>", rpc.AdminFlushForwarded, rpc.AdminPause+" <table>", rpc.AdminResume+" <table>", rpc.AdminDiscard+" <table>", rpc.AdminDrain+" <table>", rpc.AdminSchema, rpc.AdminRemap+" <table> <dim> <old>=<new> ...", rpc.AdminRemapStatus+" <table>", rpc.AdminCanonicalize+" <table>", rpc.AdminMigrate+" <table> <sql>", rpc.AdminMigrateStatus+" <table>", rpc.AdminBackfill+" <view> <from> <until>")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+	op := flag.Arg(0)
+	table := flag.Arg(1)
+	if tableOps[op] && table == "" {
+		fmt.Fprintf(os.Stderr, "%v requires a table\n", op)
+		os.Exit(2)
+	}
+	var args []string
+	if flag.NArg() > 2 {
+		args = flag.Args()[2:]
+	}
+	if op == rpc.AdminRemap && len(args) < 2 {
+		fmt.Fprintf(os.Stderr, "%v requires a dimension and at least one mapping like old=new\n", op)
+		os.Exit(2)
+	}
+	if op == rpc.AdminMigrate && len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "%v requires the table's new SQL\n", op)
+		os.Exit(2)
+	}
+	if op == rpc.AdminBackfill && len(args) != 2 {
+		fmt.Fprintf(os.Stderr, "%v requires the start and end of the time range, like 2006-01-02T15:04:05Z\n", op)
+		os.Exit(2)
+	}
+
+	host, _, _ := net.SplitHostPort(*addr)
+	tlsConfig := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: *insecure,
+	}
+
+	client, err := rpc.Dial(*addr, &rpc.ClientOpts{
+		Password: *password,
+		Dialer: func(addr string, timeout time.Duration) (net.Conn, error) {
+			conn, dialErr := net.DialTimeout("tcp", addr, timeout)
+			if dialErr != nil {
+				return nil, dialErr
+			}
+			tlsConn := tls.Client(conn, tlsConfig)
+			return tlsConn, tlsConn.Handshake()
+		},
+	})
+	if err != nil {
+		log.Fatalf("Unable to dial server at %v: %v", *addr, err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	result, err := client.AdminWithArgs(ctx, op, table, args)
+	if err != nil {
+		log.Fatalf("Unable to %v: %v", op, err)
+	}
+	fmt.Println(result)
+}
@@ -0,0 +1,336 @@
+// zeno-bench generates synthetic load against a running zeno server and
+// reports insert and query latencies, so that performance can be compared
+// between releases.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/rpc"
+)
+
+var (
+	log = golog.LoggerFor("zeno-bench")
+
+	addr     = flag.String("addr", ":17712", "The address to which to connect with gRPC over TLS, defaults to localhost:17712")
+	insecure = flag.Bool("insecure", false, "set to true to disable TLS certificate verification when connecting to the server (don't use this in production!)")
+	password = flag.String("password", "", "if specified, will authenticate against server using this password (or token)")
+	timeout  = flag.Duration("timeout", 1*time.Minute, "specify the timeout for each insert batch and query, defaults to 1 minute")
+
+	stream      = flag.String("stream", "bench", "the stream into which to insert points")
+	points      = flag.Int("points", 100000, "the total number of points to insert, 0 to skip inserting")
+	batchSize   = flag.Int("batchsize", 1000, "the number of points to insert per batch")
+	concurrency = flag.Int("concurrency", 4, "the number of batches to insert in parallel")
+	numDims     = flag.Int("dims", 3, "the number of dimensions per point, named d0, d1, etc.")
+	cardinality = flag.Int("cardinality", 100, "the number of distinct values for each dimension")
+	numFields   = flag.Int("fields", 2, "the number of fields per point, named f0, f1, etc.")
+
+	queryFile        = flag.String("queries", "", "if specified, replay the semicolon-separated SQL queries in this file after inserting. Queries may be repeated to weight the mix")
+	queryRounds      = flag.Int("queryrounds", 10, "how many times to replay the query mix")
+	queryConcurrency = flag.Int("queryconcurrency", 1, "the number of queries to run in parallel")
+	fresh            = flag.Bool("fresh", false, "Set this flag to include data not yet flushed from memstore in query results")
+)
+
+func main() {
+	flag.Parse()
+
+	var queries []string
+	if *queryFile != "" {
+		var err error
+		queries, err = loadQueries(*queryFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	host, _, _ := net.SplitHostPort(*addr)
+	tlsConfig := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: *insecure,
+		ClientSessionCache: tls.NewLRUClientSessionCache(100),
+	}
+
+	client, err := rpc.Dial(*addr, &rpc.ClientOpts{
+		Password: *password,
+		Dialer: func(addr string, timeout time.Duration) (net.Conn, error) {
+			conn, dialErr := net.DialTimeout("tcp", addr, timeout)
+			if dialErr != nil {
+				return nil, dialErr
+			}
+			tlsConn := tls.Client(conn, tlsConfig)
+			return tlsConn, tlsConn.Handshake()
+		},
+	})
+	if err != nil {
+		log.Fatalf("Unable to dial server at %v: %v", *addr, err)
+	}
+	defer client.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 4, ' ', 0)
+	fmt.Fprintln(w, "# operation\tcount\terrors\tthroughput/s\tp50\tp99\tmax")
+	if *points > 0 {
+		insertLatencies, insertErrors, elapsed := insertPoints(client)
+		report(w, fmt.Sprintf("insert %d-point batch", *batchSize), insertLatencies, insertErrors, float64(*points-insertErrors**batchSize)/elapsed.Seconds())
+	}
+	if len(queries) > 0 {
+		for i, q := range queries {
+			fmt.Printf("# q%d: %v\n", i, strings.Join(strings.Fields(q), " "))
+		}
+		queryLatencies, queryErrors, elapsed := runQueries(client, queries)
+		total := &latencies{}
+		totalErrors := 0
+		for i := range queries {
+			total.durations = append(total.durations, queryLatencies[i].durations...)
+			totalErrors += queryErrors[i]
+		}
+		for i := range queries {
+			report(w, fmt.Sprintf("q%d", i), queryLatencies[i], queryErrors[i], 0)
+		}
+		report(w, "all queries", total, totalErrors, float64(len(total.durations))/elapsed.Seconds())
+	}
+	w.Flush()
+}
+
+// insertPoints inserts the requested number of synthetic points and returns
+// the latency of each batch, the number of failed batches and the total time
+// taken.
+func insertPoints(client rpc.Client) (*latencies, int, time.Duration) {
+	batches := make(chan int)
+	go func() {
+		for remaining := *points; remaining > 0; remaining -= *batchSize {
+			n := *batchSize
+			if n > remaining {
+				n = remaining
+			}
+			batches <- n
+		}
+		close(batches)
+	}()
+
+	result := &latencies{}
+	var errorsMx sync.Mutex
+	numErrors := 0
+	start := time.Now()
+	var wg sync.WaitGroup
+	wg.Add(*concurrency)
+	for i := 0; i < *concurrency; i++ {
+		go func(seed int64) {
+			defer wg.Done()
+			gen := newGenerator(seed)
+			for n := range batches {
+				batchStart := time.Now()
+				err := insertBatch(client, gen, n)
+				if err != nil {
+					log.Errorf("Unable to insert batch: %v", err)
+					errorsMx.Lock()
+					numErrors++
+					errorsMx.Unlock()
+					continue
+				}
+				result.add(time.Since(batchStart))
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+	return result, numErrors, time.Since(start)
+}
+
+func insertBatch(client rpc.Client, gen *generator, n int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	inserter, err := client.NewInserter(ctx, *stream)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		err = inserter.Insert(time.Now(), gen.dims(), gen.vals)
+		if err != nil {
+			inserter.Close()
+			return err
+		}
+	}
+	report, err := inserter.Close()
+	if err != nil {
+		return err
+	}
+	if report.Succeeded != n {
+		return fmt.Errorf("only %d of %d points inserted: %v", report.Succeeded, n, report.Errors)
+	}
+	return nil
+}
+
+// runQueries replays the query mix the requested number of rounds and returns
+// the latencies and number of errors for each query, as well as the total
+// time taken.
+func runQueries(client rpc.Client, queries []string) ([]*latencies, []int, time.Duration) {
+	work := make(chan int)
+	go func() {
+		for round := 0; round < *queryRounds; round++ {
+			for i := range queries {
+				work <- i
+			}
+		}
+		close(work)
+	}()
+
+	results := make([]*latencies, len(queries))
+	for i := range results {
+		results[i] = &latencies{}
+	}
+	numErrors := make([]int, len(queries))
+	var errorsMx sync.Mutex
+	start := time.Now()
+	var wg sync.WaitGroup
+	wg.Add(*queryConcurrency)
+	for i := 0; i < *queryConcurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for idx := range work {
+				queryStart := time.Now()
+				err := runQuery(client, queries[idx])
+				if err != nil {
+					log.Errorf("Unable to run q%d: %v", idx, err)
+					errorsMx.Lock()
+					numErrors[idx]++
+					errorsMx.Unlock()
+					continue
+				}
+				results[idx].add(time.Since(queryStart))
+			}
+		}()
+	}
+	wg.Wait()
+	return results, numErrors, time.Since(start)
+}
+
+func runQuery(client rpc.Client, sql string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	_, iterate, err := client.Query(ctx, sql, *fresh)
+	if err != nil {
+		return err
+	}
+	return iterate(func(row *core.FlatRow) (bool, error) {
+		return true, nil
+	})
+}
+
+// loadQueries reads semicolon-separated queries from the given file, ignoring
+// lines that start with --.
+func loadQueries(filename string) ([]string, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read queries from %v: %v", filename, err)
+	}
+	lines := strings.Split(string(b), "\n")
+	kept := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			kept = append(kept, line)
+		}
+	}
+	var queries []string
+	for _, q := range strings.Split(strings.Join(kept, "\n"), ";") {
+		q = strings.TrimSpace(q)
+		if q != "" {
+			queries = append(queries, q)
+		}
+	}
+	if len(queries) == 0 {
+		return nil, fmt.Errorf("No queries found in %v", filename)
+	}
+	return queries, nil
+}
+
+// generator generates synthetic dimensions and values.
+type generator struct {
+	rnd      *rand.Rand
+	dimNames []string
+	values   []string
+	fields   []string
+}
+
+func newGenerator(seed int64) *generator {
+	gen := &generator{
+		rnd:      rand.New(rand.NewSource(seed)),
+		dimNames: make([]string, *numDims),
+		values:   make([]string, *cardinality),
+		fields:   make([]string, *numFields),
+	}
+	for i := range gen.dimNames {
+		gen.dimNames[i] = fmt.Sprintf("d%d", i)
+	}
+	for i := range gen.values {
+		gen.values[i] = fmt.Sprintf("v%d", i)
+	}
+	for i := range gen.fields {
+		gen.fields[i] = fmt.Sprintf("f%d", i)
+	}
+	return gen
+}
+
+func (gen *generator) dims() map[string]interface{} {
+	dims := make(map[string]interface{}, len(gen.dimNames))
+	for _, name := range gen.dimNames {
+		dims[name] = gen.values[gen.rnd.Intn(len(gen.values))]
+	}
+	return dims
+}
+
+func (gen *generator) vals(cb func(string, interface{})) {
+	for _, field := range gen.fields {
+		cb(field, gen.rnd.Float64()*100)
+	}
+}
+
+// latencies collects durations from multiple goroutines.
+type latencies struct {
+	durations []time.Duration
+	mx        sync.Mutex
+}
+
+func (l *latencies) add(d time.Duration) {
+	l.mx.Lock()
+	l.durations = append(l.durations, d)
+	l.mx.Unlock()
+}
+
+// percentile returns the duration below which the given percentage of
+// durations fall, using the nearest-rank method.
+func (l *latencies) percentile(p float64) time.Duration {
+	if len(l.durations) == 0 {
+		return 0
+	}
+	sorted := make([]time.Duration, len(l.durations))
+	copy(sorted, l.durations)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := int(p/100*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	} else if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+func report(w *tabwriter.Writer, operation string, l *latencies, numErrors int, throughput float64) {
+	throughputString := "-"
+	if throughput > 0 {
+		throughputString = fmt.Sprintf("%.1f", throughput)
+	}
+	fmt.Fprintf(w, "%v\t%d\t%d\t%v\t%v\t%v\t%v\n", operation, len(l.durations), numErrors, throughputString, l.percentile(50), l.percentile(99), l.percentile(100))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/getlantern/zenodb/rpc"
+	"golang.org/x/net/context"
+)
+
+const (
+	clusterCmd = "cluster"
+)
+
+func isClusterCmd(cmd string) bool {
+	return strings.EqualFold(strings.TrimSpace(cmd), clusterCmd)
+}
+
+// clusterStatus prints the status of each follower of the cluster led by the
+// server to which we're connected.
+func clusterStatus(stdout io.Writer, client rpc.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	status, err := client.ClusterStatus(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !*porcelain {
+		fmt.Fprintf(stdout, "# Leader version: %v    Partitions: %d    Followers: %d\n", status.Version, status.NumPartitions, len(status.Followers))
+		if status.PlacementRejections > 0 {
+			fmt.Fprintf(stdout, "# Followers rejected by placement constraints: %d\n", status.PlacementRejections)
+		}
+		if status.CacheHits > 0 || status.CacheMisses > 0 {
+			fmt.Fprintf(stdout, "# Cached partition results: %d hits, %d misses\n", status.CacheHits, status.CacheMisses)
+		}
+	}
+	w := tabwriter.NewWriter(stdout, 0, 0, 4, ' ', 0)
+	if !*porcelain {
+		fmt.Fprintln(w, "# partition\tid\taddr\tversion\tstream\tjoined\tlag\tqueued\tlast query\tp99 query\tstatus\tlabels")
+	}
+	for _, f := range status.Followers {
+		state := "ok"
+		if f.Failed {
+			state = "failed"
+		}
+		fmt.Fprintf(w, "%d\t%d\t%v\t%v\t%v\t%v\t%v\t%d\t%v\t%v\t%v\t%v\n",
+			f.Partition,
+			f.ID,
+			f.Addr,
+			f.Version,
+			f.Stream,
+			f.Joined.In(time.UTC).Format(time.RFC3339),
+			f.Lag,
+			f.Queued,
+			f.LastQueryLatency,
+			f.QueryLatencyP99,
+			state,
+			formatLabels(f.Labels))
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	if len(status.Owners) > 0 {
+		w = tabwriter.NewWriter(stdout, 0, 0, 4, ' ', 0)
+		if !*porcelain {
+			fmt.Fprintln(w, "\n# dimension\tvalue\towning partitions")
+		}
+		for _, owner := range status.Owners {
+			fmt.Fprintf(w, "%v\t%v\t%v\n", owner.Dim, owner.Value, owner.Partitions)
+		}
+		err = w.Flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(status.Gaps) > 0 || status.ResyncsRequired > 0 {
+		w = tabwriter.NewWriter(stdout, 0, 0, 4, ' ', 0)
+		if !*porcelain {
+			fmt.Fprintf(w, "\n# Resyncs required: %d\n", status.ResyncsRequired)
+			fmt.Fprintln(w, "# partition\tstream\trequested\toldest available\tsince")
+		}
+		for _, gap := range status.Gaps {
+			fmt.Fprintf(w, "%d\t%v\t%v\t%v\t%v\n",
+				gap.Partition,
+				gap.Stream,
+				gap.Requested,
+				gap.Oldest,
+				gap.Time.In(time.UTC).Format(time.RFC3339))
+		}
+		err = w.Flush()
+	}
+	return err
+}
+
+// formatLabels formats labels like rack=r1,zone=a, sorted by key.
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return "-"
+	}
+	parts := make([]string, 0, len(labels))
+	for key, value := range labels {
+		parts = append(parts, fmt.Sprintf("%v=%v", key, value))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
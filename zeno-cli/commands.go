@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/getlantern/zenodb/sql"
+)
+
+const (
+	formatTable = "table"
+	formatCSV   = "csv"
+	formatTSV   = "tsv"
+	formatJSON  = "json"
+)
+
+const metaHelp = `Statements end with a semicolon and may span multiple lines. Ctrl+C
+discards a partially entered statement.
+
+Commands:
+  \timing [on|off]         show the number of rows and time taken by each query
+  \format [table|csv|tsv|json]
+                           set the output format, or show it if omitted
+  \fresh [on|off]          include data not yet flushed from memstore
+  \querystats [on|off]     show the plan of each query and how much data it read
+                           from each table
+  \q                       quit
+  \?                       show this help
+
+EXPLAIN followed by a query runs the query without showing its results and
+shows its plan and how much data it read from each table instead.
+
+Statements between BEGIN; and COMMIT; are sent together as a script, which
+is applied all or nothing.
+`
+
+// awaitingCommit indicates whether the given lines begin a script that hasn't
+// been committed yet.
+func awaitingCommit(lines []string) bool {
+	statements := sql.SplitStatements(strings.Join(lines, "\n"))
+	if len(statements) == 0 || !sql.IsBegin(statements[0]) {
+		return false
+	}
+	return !strings.EqualFold(statements[len(statements)-1], "commit")
+}
+
+func isMetaCmd(line string) bool {
+	return strings.HasPrefix(line, `\`)
+}
+
+// metaCmd processes a backslash command, returning true if the user asked to
+// quit.
+func metaCmd(stdout io.Writer, line string) (bool, error) {
+	fields := strings.Fields(strings.TrimRight(line, ";"))
+	cmd := fields[0]
+	var arg string
+	if len(fields) > 1 {
+		arg = strings.ToLower(fields[1])
+	}
+
+	switch cmd {
+	case `\q`, `\quit`:
+		return true, nil
+	case `\?`, `\h`, `\help`:
+		fmt.Fprint(stdout, metaHelp)
+	case `\timing`:
+		err := toggle(timing, arg)
+		if err != nil {
+			return false, err
+		}
+		fmt.Fprintf(stdout, "Timing is %v.\n", onOff(*timing))
+	case `\fresh`:
+		err := toggle(fresh, arg)
+		if err != nil {
+			return false, err
+		}
+		fmt.Fprintf(stdout, "Including memstore is %v.\n", onOff(*fresh))
+	case `\querystats`:
+		err := toggle(queryStats, arg)
+		if err != nil {
+			return false, err
+		}
+		fmt.Fprintf(stdout, "Query stats are %v.\n", onOff(*queryStats))
+	case `\format`:
+		if arg != "" {
+			err := validateFormat(arg)
+			if err != nil {
+				return false, err
+			}
+			*format = arg
+		}
+		fmt.Fprintf(stdout, "Output format is %v.\n", *format)
+	default:
+		return false, fmt.Errorf("Unknown command %v, try \\?", cmd)
+	}
+	return false, nil
+}
+
+// toggle flips the given setting if arg is empty and otherwise sets it to arg,
+// which must be on or off.
+func toggle(setting *bool, arg string) error {
+	switch arg {
+	case "":
+		*setting = !*setting
+	case "on":
+		*setting = true
+	case "off":
+		*setting = false
+	default:
+		return fmt.Errorf("Expected on or off, not %v", arg)
+	}
+	return nil
+}
+
+func onOff(setting bool) string {
+	if setting {
+		return "on"
+	}
+	return "off"
+}
+
+func validateFormat(f string) error {
+	switch f {
+	case formatTable, formatCSV, formatTSV, formatJSON:
+		return nil
+	default:
+		return fmt.Errorf("Unknown format %v, expected one of %v, %v, %v or %v", f, formatTable, formatCSV, formatTSV, formatJSON)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dustin/go-humanize"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/rpc"
+	"golang.org/x/net/context"
+)
+
+const (
+	explainCmd = "explain"
+)
+
+// explainQuery returns the query following EXPLAIN if cmd is an EXPLAIN
+// command.
+func explainQuery(cmd string) (string, bool) {
+	cmd = strings.TrimSpace(cmd)
+	if len(cmd) <= len(explainCmd) || !strings.EqualFold(cmd[:len(explainCmd)], explainCmd) {
+		return "", false
+	}
+	rest := cmd[len(explainCmd):]
+	if rest[0] != ' ' && rest[0] != '\t' && rest[0] != '\n' {
+		return "", false
+	}
+	return strings.TrimSpace(rest), true
+}
+
+// explain runs the given query without printing its results and then prints
+// its plan and how much data it read from each table.
+func explain(stdout io.Writer, client rpc.Client, sql string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	md, iterate, err := client.Query(ctx, sql, *fresh)
+	if err != nil {
+		return err
+	}
+	numRows := 0
+	err = iterate(func(row *core.FlatRow) (bool, error) {
+		numRows++
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprint(stdout, md.Plan)
+	fmt.Fprintf(stdout, "\n# Rows: %d\n\n", numRows)
+	printTableQueryStats(stdout, md.Stats)
+	return nil
+}
+
+// printTableQueryStats prints how much data a query read from each table.
+func printTableQueryStats(stdout io.Writer, stats []*common.TableQueryStats) {
+	w := tabwriter.NewWriter(stdout, 0, 0, 4, ' ', 0)
+	if !*porcelain {
+		fmt.Fprintln(w, "# table\tkeys scanned\tsequences decoded\tperiods read\tbytes read")
+	}
+	for _, s := range stats {
+		fmt.Fprintf(w, "%v\t%d\t%d\t%d\t%v\n", s.Table, s.KeysScanned, s.SequencesDecoded, s.PeriodsRead, humanize.Bytes(uint64(s.BytesRead)))
+	}
+	w.Flush()
+}
@@ -2,10 +2,11 @@ package main
 
 import (
 	"crypto/tls"
-	"encoding/csv"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"os"
 	"path/filepath"
@@ -38,13 +39,26 @@ var (
 	timeout    = flag.Duration("timeout", 1*time.Minute, "specify the timeout for queries, defaults to 1 minute")
 	fresh      = flag.Bool("fresh", false, "Set this flag to include data not yet flushed from memstore in query results")
 	porcelain  = flag.Bool("porcelain", false, "Set this flag to display results in a more machine-readable format (e.g. no headers)")
-	queryStats = flag.Bool("querystats", false, "Set this to show query stats on each query")
+	queryStats = flag.Bool("querystats", false, "Set this to show query stats, including the plan and how much data was read from each table, on each query")
 	password   = flag.String("password", "", "if specified, will authenticate against server using this password")
+	format     = flag.String("format", "", "output format, one of table, csv, tsv or json (one object per row). CSV and TSV are rendered by the server. Defaults to table when interactive and csv when running a single query from the command-line")
+	timing     = flag.Bool("timing", false, "Set this to show the number of rows returned and how long each query took")
+	rawUnits   = flag.Bool("rawunits", false, "Set this to display values as plain numbers instead of converting them based on the units of their fields")
 )
 
 func main() {
 	flag.Parse()
 
+	if *format == "" {
+		*format = formatTable
+		if flag.NArg() == 1 {
+			*format = formatCSV
+		}
+	}
+	if err := validateFormat(*format); err != nil {
+		log.Fatal(err)
+	}
+
 	clidir := appdir.General("zeno-cli")
 	err := os.MkdirAll(clidir, 0700)
 	if err != nil {
@@ -79,7 +93,14 @@ func main() {
 	if flag.NArg() == 1 {
 		// Process single command from command-line and then exit
 		sql := strings.Trim(flag.Arg(0), ";")
-		queryErr := query(os.Stdout, os.Stderr, client, sql, true)
+		if isClusterCmd(sql) {
+			clusterErr := clusterStatus(os.Stdout, client)
+			if clusterErr != nil {
+				log.Fatal(clusterErr)
+			}
+			return
+		}
+		queryErr := query(os.Stdout, os.Stderr, client, sql)
 		if queryErr != nil {
 			log.Fatal(queryErr)
 		}
@@ -95,26 +116,45 @@ func main() {
 		log.Fatal(err)
 	}
 	defer rl.Close()
+	fmt.Fprintln(os.Stderr, `Type \? for help`)
 
 	var cmds []string
 	for {
 		line, err := rl.Readline()
+		if err == readline.ErrInterrupt && len(cmds) > 0 {
+			// Discard partially entered statement
+			cmds = cmds[:0]
+			rl.SetPrompt(basePrompt + " ")
+			continue
+		}
 		if err != nil {
 			return
 		}
-		cmds = processLine(rl, client, cmds, line)
+		var quit bool
+		cmds, quit = processLine(rl, client, cmds, line)
+		if quit {
+			return
+		}
 	}
 }
 
-func processLine(rl *readline.Instance, client rpc.Client, cmds []string, line string) []string {
+func processLine(rl *readline.Instance, client rpc.Client, cmds []string, line string) ([]string, bool) {
 	line = strings.TrimSpace(line)
 	if len(line) == 0 {
-		return cmds
+		return cmds, false
+	}
+	if len(cmds) == 0 && isMetaCmd(line) {
+		rl.SaveHistory(line)
+		quit, err := metaCmd(rl.Stdout(), line)
+		if err != nil {
+			fmt.Fprintln(rl.Stderr(), err)
+		}
+		return cmds, quit
 	}
 	cmds = append(cmds, line)
-	if !strings.HasSuffix(line, ";") {
+	if !strings.HasSuffix(line, ";") || awaitingCommit(cmds) {
 		rl.SetPrompt(emptyPrompt)
-		return cmds
+		return cmds, false
 	}
 	cmd := strings.Join(cmds, "\n")
 	rl.SaveHistory(cmd)
@@ -123,26 +163,64 @@ func processLine(rl *readline.Instance, client rpc.Client, cmds []string, line s
 	cmds = cmds[:0]
 	rl.SetPrompt(basePrompt + " ")
 
-	err := query(rl.Stdout(), rl.Stderr(), client, cmd, false)
+	var err error
+	if isClusterCmd(cmd) {
+		err = clusterStatus(rl.Stdout(), client)
+	} else {
+		err = query(rl.Stdout(), rl.Stderr(), client, cmd)
+	}
 	if err != nil {
 		fmt.Fprintln(rl.Stderr(), err)
 	}
 
-	return cmds
+	return cmds, false
 }
 
-func query(stdout io.Writer, stderr io.Writer, client rpc.Client, sql string, csv bool) error {
+func query(stdout io.Writer, stderr io.Writer, client rpc.Client, sql string) error {
+	if explained, ok := explainQuery(sql); ok {
+		return explain(stdout, client, explained)
+	}
+	start := time.Now()
+	if common.IsDelimitedFormat(*format) {
+		return dumpDelimited(stdout, stderr, client, sql, start)
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
 	defer cancel()
-	md, iterate, err := client.Query(ctx, sql, *fresh)
+	md, _iterate, err := client.Query(ctx, sql, *fresh)
+	if err != nil {
+		return err
+	}
+
+	numRows := 0
+	iterate := func(onRow core.OnFlatRow) error {
+		return _iterate(func(row *core.FlatRow) (bool, error) {
+			numRows++
+			return onRow(row)
+		})
+	}
+
+	switch *format {
+	case formatJSON:
+		err = dumpJSON(stdout, md, iterate)
+	default:
+		err = dumpPlainText(stdout, sql, md, iterate)
+	}
 	if err != nil {
 		return err
 	}
 
-	if csv {
-		return dumpCSV(stdout, md, iterate)
+	printTruncation(stderr, md)
+	if *queryStats {
+		printTableQueryStats(stderr, md.Stats)
 	}
-	return dumpPlainText(stdout, sql, md, iterate)
+	if *timing {
+		rowsLabel := "rows"
+		if numRows == 1 {
+			rowsLabel = "row"
+		}
+		fmt.Fprintf(stderr, "(%d %v in %v)\n", numRows, rowsLabel, time.Since(start))
+	}
+	return nil
 }
 
 func dumpPlainText(stdout io.Writer, sql string, md *common.QueryMetaData, iterate func(onRow core.OnFlatRow) error) error {
@@ -207,6 +285,9 @@ func dumpPlainText(stdout io.Writer, sql string, md *common.QueryMetaData, itera
 			val = row.Values[i]
 			// }
 			width := len(fmt.Sprintf("%.4f", val))
+			if fmd := fieldMetadataAt(md, i); fmd != nil {
+				width = len(fmd.Format(val))
+			}
 			if width > fieldWidths[i] {
 				fieldWidths[i] = width
 			}
@@ -316,7 +397,13 @@ func dumpPlainText(stdout io.Writer, sql string, md *common.QueryMetaData, itera
 			// } else {
 			val = row.Values[i]
 			// }
-			fmt.Fprintf(stdout, fieldFormats[outIdx], val)
+			if row.IsNull(i) {
+				fmt.Fprintf(stdout, fieldLabelFormats[outIdx], nilToDash(nil))
+			} else if fmd := fieldMetadataAt(md, i); fmd != nil {
+				fmt.Fprintf(stdout, fieldLabelFormats[outIdx], fmd.Format(val))
+			} else {
+				fmt.Fprintf(stdout, fieldFormats[outIdx], val)
+			}
 			outIdx++
 		}
 
@@ -336,132 +423,67 @@ func dumpPlainText(stdout io.Writer, sql string, md *common.QueryMetaData, itera
 	return nil
 }
 
-func dumpCSV(stdout io.Writer, md *common.QueryMetaData, iterate func(onRow core.OnFlatRow) error) error {
-	printQueryStats(os.Stderr, md)
-
-	w := csv.NewWriter(stdout)
-	defer w.Flush()
-
-	numFields := numFieldsFor(md)
-
-	i := 0
-	var knownDims []string
-	err := iterate(func(row *core.FlatRow) (bool, error) {
-		dims := row.Key.AsMap()
-		rowStrings := make([]string, 0, 1+len(dims)+len(md.FieldNames))
-		rowStrings = append(rowStrings, encoding.TimeFromInt(row.TS).In(time.UTC).Format(time.RFC3339))
-		for i := range md.FieldNames {
-			var value float64
-			// if result.IsCrosstab {
-			// 	value = row.Totals[i]
-			// } else {
-			value = row.Values[i]
-			// }
-			rowStrings = append(rowStrings, fmt.Sprintf("%f", value))
-		}
-		// First add known dims
-		for _, dim := range knownDims {
-			val := dims[dim]
-			rowStrings = append(rowStrings, fmt.Sprint(nilToBlank(val)))
-			delete(dims, dim)
-		}
-		// Then add new dims
-		if len(dims) > 0 {
-			// Alphabetize remaining dims
-			dimNames := make([]string, 0, len(dims))
-			for dim := range dims {
-				dimNames = append(dimNames, dim)
-			}
-			sort.Strings(dimNames)
-			for _, dim := range dimNames {
-				val := dims[dim]
-				rowStrings = append(rowStrings, fmt.Sprint(nilToBlank(val)))
-				knownDims = append(knownDims, dim)
-			}
-		}
-		// if result.IsCrosstab {
-		// 	for i := range result.CrosstabDims {
-		// 		for j := range result.FieldNames {
-		// 			idx := i*len(result.FieldNames) + j
-		// 			if result.PopulatedColumns[idx] {
-		// 				rowStrings = append(rowStrings, fmt.Sprintf("%f", row.Values[idx]))
-		// 			}
-		// 		}
-		// 	}
-		// }
-		w.Write(rowStrings)
-		i++
-		if i%100 == 0 {
-			w.Flush()
-		}
-		return true, nil
-	})
-
+// dumpDelimited has the server render the results of the query as CSV or TSV
+// and copies them to stdout as they arrive.
+func dumpDelimited(stdout io.Writer, stderr io.Writer, client rpc.Client, sql string, start time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	md, write, err := client.QueryDelimited(ctx, sql, *fresh, *format, *porcelain)
 	if err != nil {
 		return err
 	}
-
-	if *porcelain {
-		// Skip writing header for now
-		return nil
+	printQueryStats(os.Stderr, md)
+	err = write(stdout)
+	if err != nil {
+		return err
 	}
-
-	// Write header
-	rowStrings := make([]string, 0, 1+numFields)
-	rowStrings = append(rowStrings, "time")
-	for _, fieldName := range md.FieldNames {
-		rowStrings = append(rowStrings, fieldName)
+	printTruncation(stderr, md)
+	if *queryStats {
+		printTableQueryStats(stderr, md.Stats)
 	}
-	for _, dim := range knownDims {
-		rowStrings = append(rowStrings, dim)
+	if *timing {
+		fmt.Fprintf(stderr, "(in %v)\n", time.Since(start))
 	}
-	// if result.IsCrosstab {
-	// 	for i := range result.CrosstabDims {
-	// 		for j, fieldName := range result.FieldNames {
-	// 			idx := i*len(result.FieldNames) + j
-	// 			if result.PopulatedColumns[idx] {
-	// 				rowStrings = append(rowStrings, fieldName)
-	// 			}
-	// 		}
-	// 	}
-	// }
+	return nil
+}
 
-	// if result.IsCrosstab {
-	// 	// Write crosstab dimensions
-	// 	rowStrings := make([]string, 0, 1+len(result.GroupBy)+numFields)
-	// 	rowStrings = append(rowStrings, "")
-	// 	for range result.GroupBy {
-	// 		rowStrings = append(rowStrings, "")
-	// 	}
-	// 	// Totals
-	// 	for range result.FieldNames {
-	// 		rowStrings = append(rowStrings, totalLabel)
-	// 	}
-	// 	if result.IsCrosstab {
-	// 		// Per crosstab dimension
-	// 		for i, crosstabDim := range result.CrosstabDims {
-	// 			for j := range result.FieldNames {
-	// 				idx := i*len(result.FieldNames) + j
-	// 				if result.PopulatedColumns[idx] {
-	// 					rowStrings = append(rowStrings, fmt.Sprint(nilToBlank(crosstabDim)))
-	// 				}
-	// 			}
-	// 		}
-	// 	}
-	// 	w.Write(rowStrings)
-	// 	w.Flush()
-	// }
+type jsonRow struct {
+	Time time.Time              `json:"time"`
+	Dims map[string]interface{} `json:"dims"`
+	Vals map[string]interface{} `json:"vals"`
+}
 
-	w.Write(rowStrings)
-	w.Flush()
-	return nil
+// dumpJSON writes each row as a separate JSON object. Missing values and values
+// that can't be represented in JSON (NaN and infinities) are written as null.
+func dumpJSON(stdout io.Writer, md *common.QueryMetaData, iterate func(onRow core.OnFlatRow) error) error {
+	printQueryStats(os.Stderr, md)
+
+	enc := json.NewEncoder(stdout)
+	return iterate(func(row *core.FlatRow) (bool, error) {
+		vals := make(map[string]interface{}, len(md.FieldNames))
+		for i, fieldName := range md.FieldNames {
+			val := row.Values[i]
+			if row.IsNull(i) || math.IsNaN(val) || math.IsInf(val, 0) {
+				vals[fieldName] = nil
+			} else {
+				vals[fieldName] = val
+			}
+		}
+		return true, enc.Encode(&jsonRow{
+			Time: encoding.TimeFromInt(row.TS).In(time.UTC),
+			Dims: row.Key.AsMap(),
+			Vals: vals,
+		})
+	})
 }
 
-func nilToBlank(val interface{}) interface{} {
-	if val == nil {
-		return ""
+// fieldMetadataAt returns the metadata of the field at idx, if it has any and
+// units aren't supposed to be displayed raw.
+func fieldMetadataAt(md *common.QueryMetaData, idx int) *common.FieldMetadata {
+	if *rawUnits || idx >= len(md.FieldNames) {
+		return nil
 	}
-	return val
+	return md.FieldMetadata[md.FieldNames[idx]]
 }
 
 func nilToDash(val interface{}) interface{} {
@@ -483,6 +505,15 @@ func numFieldsFor(md *common.QueryMetaData) int {
 	return numFields
 }
 
+// printTruncation warns if the server truncated the results of a query because
+// they exceeded its limits.
+func printTruncation(stderr io.Writer, md *common.QueryMetaData) {
+	if !md.Truncated {
+		return
+	}
+	fmt.Fprintf(stderr, "Warning: results truncated by server, omitted %d rows\n", md.OmittedRows)
+}
+
 func printQueryStats(stderr io.Writer, md *common.QueryMetaData) {
 	// TODO: maybe restore additional stats?
 	if !*queryStats {
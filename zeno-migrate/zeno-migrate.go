@@ -0,0 +1,32 @@
+// zeno-migrate migrates the data files of a zeno database to the current file
+// format and encoding. Stop zeno before running it.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/zenodb"
+)
+
+var (
+	log = golog.LoggerFor("zeno-migrate")
+
+	dbdir = flag.String("dbdir", "zenodata", "The directory in which the database's data is stored")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: zeno-migrate [flags]\n\nMigrates data files to file version %d. Stop zeno before running this.\n\nFlags:\n", zenodb.CurrentFileVersion)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	migrated, err := zenodb.MigrateFiles(*dbdir)
+	if err != nil {
+		log.Fatalf("Unable to migrate files in %v after migrating %d: %v", *dbdir, migrated, err)
+	}
+	fmt.Printf("Migrated %d files\n", migrated)
+}
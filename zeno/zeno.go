@@ -1,41 +1,48 @@
 package main
 
 import (
-	"crypto/tls"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
-	_ "net/http/pprof"
+	"net/http/pprof"
 	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/getlantern/bytemap"
 	"github.com/getlantern/goexpr/isp"
 	"github.com/getlantern/goexpr/isp/ip2location"
 	"github.com/getlantern/goexpr/isp/maxmind"
-	"github.com/getlantern/golog"
 	lredis "github.com/getlantern/redis"
 	"github.com/getlantern/tlsdefaults"
 	"github.com/getlantern/wal"
 	"github.com/getlantern/zenodb"
+	zenoclient "github.com/getlantern/zenodb/client"
 	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/config"
+	"github.com/getlantern/zenodb/logging"
+	"github.com/getlantern/zenodb/pgwire"
 	"github.com/getlantern/zenodb/planner"
 	"github.com/getlantern/zenodb/rpc"
 	"github.com/getlantern/zenodb/rpc/server"
+	"github.com/getlantern/zenodb/trace"
 	"github.com/getlantern/zenodb/web"
 	"github.com/gorilla/mux"
 	"github.com/vharitonsky/iniflags"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc"
 	"gopkg.in/redis.v5"
 )
 
 var (
-	log = golog.LoggerFor("zeno")
+	log = logging.LoggerFor("zeno")
 
+	configFile         = flag.String("configfile", "", "if specified, path to a YAML or TOML (if named *.toml) file that configures the server, including its tables. settings in the file correspond to flags, which take precedence. settings can also be overridden with environment variables like ZENO_RPC_ADDR, even without a file")
 	dbdir              = flag.String("dbdir", "zenodata", "The directory in which to store the database files, defaults to ./zenodata")
 	schema             = flag.String("schema", "schema.yaml", "Location of schema file, defaults to ./schema.yaml")
 	aliasesFile        = flag.String("aliases", "", "Optionally specify the path to a file containing expression aliases in the form alias=template(%v,%v) with one alias per line")
+	plugins            = flag.String("plugins", "", "Optionally specify comma,delimited paths to Go plugins that register user-defined functions by exporting RegisterFunctions. every node of a cluster needs the same plugins")
 	enablegeo          = flag.Bool("enablegeo", false, "enable geolocation functions")
 	ispformat          = flag.String("ispformat", "ip2location", "ip2location or maxmind")
 	ispdb              = flag.String("ispdb", "", "In order to enable ISP functions, point this to a ISP database file, either in IP2Location Lite format or MaxMind GeoIP2 ISP format")
@@ -43,13 +50,38 @@ var (
 	walSync            = flag.Duration("walsync", 5*time.Second, "How frequently to sync the WAL to disk. Set to 0 to sync after every write. Defaults to 5 seconds.")
 	maxWALSize         = flag.Int("maxwalsize", 1024*1024*1024, "Maximum size of WAL segments on disk. Defaults to 1 GB.")
 	walCompressionSize = flag.Int("walcompressionsize", 30*1024*1024, "Size above which to start compressing WAL segments with snappy. Defaults to 30 MB.")
+	maxWALAge          = flag.Duration("maxwalage", 0, "If positive, also removes WAL segments older than this. Defaults to 0 (no age limit).")
+	walCompressionAge  = flag.Duration("walcompressionage", 0, "If positive, also compresses WAL segments older than this with snappy. Defaults to 0 (no age limit).")
 	maxMemory          = flag.Float64("maxmemory", 0.7, "Set to a non-zero value to cap the total size of the process as a percentage of total system memory. Defaults to 0.7 = 70%.")
 	addr               = flag.String("addr", "localhost:17712", "The address at which to listen for gRPC over TLS connections, defaults to localhost:17712")
 	httpsAddr          = flag.String("httpsaddr", "localhost:17713", "The address at which to listen for JSON over HTTPS connections, defaults to localhost:17713")
-	pprofAddr          = flag.String("pprofaddr", "localhost:4000", "if specified, will listen for pprof connections at the specified tcp address")
+	rpcKeepalive       = flag.Duration("rpckeepalive", 1*time.Minute, "how frequently to ping idle gRPC connections between zeno servers to detect broken connections, defaults to 1 minute")
+	rpcKeepaliveWait   = flag.Duration("rpckeepalivetimeout", 20*time.Second, "how long to wait for a response to a gRPC keepalive ping before closing the connection, defaults to 20 seconds")
+	rpcMaxMsgSize      = flag.Int("rpcmaxmsgsize", 100*1024*1024, "maximum size of gRPC messages sent and received, defaults to 100 MB")
+	rpcIdleTimeout     = flag.Duration("rpcidletimeout", 0, "if specified, abort gRPC query and insert streams that have been idle for this long")
+	rpcQueryPing       = flag.Duration("rpcqueryping", 30*time.Second, "how frequently to ping followers that wait to handle remote queries, defaults to 30 seconds")
+	rpcQueryPingWait   = flag.Duration("rpcquerypingtimeout", 10*time.Second, "how long to wait for a follower to answer a remote query ping before evicting its query handler, defaults to 10 seconds")
+	rpcMaxStreams      = flag.Int("rpcmaxstreams", 0, "if specified, limits how many gRPC streams each client may have open at the same time, including the follow and remote query streams of followers")
+	rpcMaxQPS          = flag.Float64("rpcmaxqps", 0, "if specified, limits how many queries per second each client may run")
+	rpcMaxFollowRate   = flag.Int64("rpcmaxfollowrate", 0, "if specified, limits how many bytes per second of WAL data are sent to each follower")
+	rpcMaxResultRows   = flag.Int("rpcmaxresultrows", 0, "if specified, truncates gRPC query results to this many rows, reporting how many rows were omitted")
+	rpcMaxResultBytes  = flag.Int("rpcmaxresultbytes", 0, "if specified, truncates gRPC query results to roughly this many bytes, reporting how many rows were omitted")
+	rpcLogRequests     = flag.Bool("rpclogrequests", false, "set to true to log every gRPC request along with its duration and status at debug level")
+	pgAddr             = flag.String("pgaddr", "", "if specified, listen for read-only PostgreSQL wire protocol connections (e.g. from psql) at the specified tcp address, authenticating with -password. Note - these connections are not encrypted.")
+	opsAddr            = flag.String("opsaddr", "localhost:4000", "if specified, listen for operational HTTP requests at the specified tcp address, serving pprof at /debug/pprof, Prometheus metrics at /metrics, memstore sizes by table and a goroutine dump at /debug/zenodb/dump and per-subsystem trace logging toggles at /debug/zenodb/trace")
+	pprofAddr          = flag.String("pprofaddr", "", "deprecated, use -opsaddr")
+	recordStats        = flag.Bool("recordstats", false, "set to true to record table stats into the built-in _zeno_stats table once a minute. not supported with -passthrough or -capture")
+	otlpEndpoint       = flag.String("otlpendpoint", "", "if specified, export tracing spans for inserts, flushes, retention and queries to the OpenTelemetry collector at this base url using OTLP/HTTP, e.g. http://localhost:4318")
 	password           = flag.String("password", "", "if specified, will authenticate clients using this password")
+	credentialsFile    = flag.String("credentials", "", "if specified, path to a YAML file of tokens with roles (read, insert, follow, admin) and optional table restrictions used to authorize gRPC clients instead of -password")
+	tenantsFile        = flag.String("tenants", "", "if specified, path to a YAML file of per-tenant quotas (maxkeys, maxingestrate, maxstoragebytes, maxconcurrentqueries) keyed by tenant name. tables and streams belong to a tenant when named tenant.table")
+	schedulesFile      = flag.String("schedules", "", "if specified, path to a YAML file of queries keyed by name that run on a schedule and write their results to a sink (table, webhook, file or kafka). not supported on followers")
+	rulesFile          = flag.String("rules", "", "if specified, path to a YAML file of alerting rules keyed by name whose queries are evaluated periodically and that post alerts to webhooks or PagerDuty when they fire. not supported on followers")
+	savedQueriesFile   = flag.String("savedqueries", "", "if specified, path to a YAML file of queries keyed by name that clients can run with EXECUTE name WITH param = 'value'. the file is reloaded when it changes")
 	pkfile             = flag.String("pkfile", "pk.pem", "path to the private key PEM file")
 	certfile           = flag.String("certfile", "cert.pem", "path to the certificate PEM file")
+	cafile             = flag.String("cafile", "", "if specified, path to a PEM file containing the CA certificates used for mutual TLS between zeno servers. the gRPC server will require client certificates signed by this CA and clients will present -certfile and verify servers against this CA.")
+	tlsReload          = flag.Duration("tlsreload", 1*time.Minute, "how frequently to check -pkfile, -certfile and -cafile for changes, defaults to 1 minute")
 	cookieHashKey      = flag.String("cookiehashkey", "", "key to use for HMAC authentication of web auth cookies, should be 64 bytes, defaults to random 64 bytes if not specified")
 	cookieBlockKey     = flag.String("cookieblockkey", "", "key to use for encrypting web auth cookies, should be 32 bytes, defaults to random 32 bytes if not specified")
 	oauthClientID      = flag.String("oauthclientid", "", "id to use for oauth client to connect to GitHub")
@@ -58,11 +90,27 @@ var (
 	insecure           = flag.Bool("insecure", false, "set to true to disable TLS certificate verification when connecting to other zeno servers (don't use this in production!)")
 	passthrough        = flag.Bool("passthrough", false, "set to true to make this node a passthrough that doesn't capture data in table but is capable of feeding and querying other nodes. requires that -partitions to be specified.")
 	capture            = flag.String("capture", "", "if specified, connect to the node at the given address to receive updates, authenticating with value of -password.  requires that you specify which -partition this node handles.")
+	forwardInserts     = flag.Bool("forwardinserts", false, "use with -capture, accept inserts and forward them to the leader so that producers can insert into any node")
 	captureOverride    = flag.String("captureoverride", "", "if specified, dial network connection for -capture using this address, but verify TLS connection using the address from -capture")
 	feed               = flag.String("feed", "", "if specified, connect to the nodes at the given comma,delimited addresses to handle queries for them, authenticating with value of -password. requires that you specify which -partition this node handles.")
 	feedOverride       = flag.String("feedoverride", "", "if specified, dial network connection for -feed using this address, but verify TLS connection using the address from -feed")
+	replicateTo        = flag.String("replicateto", "", "if specified, asynchronously replicate the streams listed in -replicatestreams to the leader of another cluster at this address, for example for disaster recovery, authenticating with value of -password. not supported with -capture")
+	replicateStreams   = flag.String("replicatestreams", "", "use with -replicateto, the comma,delimited streams to replicate")
 	numPartitions      = flag.Int("numpartitions", 1, "The number of partitions available to distribute amongst followers")
-	partition          = flag.Int("partition", 0, "use with -follow, the partition number assigned to this follower")
+	partition          = flag.Int("partition", 0, "use with -follow, the partition number assigned to this follower. use with -localpartition, the partition that the passthrough stores itself")
+	placementFile      = flag.String("placement", "", "use with -passthrough, path to a YAML file of placement constraints (per-partition required labels and anti-affinity labels like rack) that followers must satisfy to follow this node")
+	labels             = flag.String("labels", "", "use with -capture, comma,delimited labels like rack=r1,zone=eu-west-1a describing where this follower runs, used by the leader's -placement constraints")
+	dimOwnersFile      = flag.String("dimowners", "", "use with -passthrough, path to a YAML file mapping dimensions to values to the partitions that exclusively own them (e.g. dc: {eu: [0, 1]}), so that queries filtered on those values only go to the owning partitions")
+	localPartition     = flag.Bool("localpartition", false, "use with -passthrough, store the data for -partition in this node's own tables and include it in cluster queries instead of having a follower capture it")
+	clusterQueryBuffer = flag.Int("clusterquerybuffer", 1000, "use with -passthrough, limits how many rows from each partition to buffer while processing a query, defaults to 1000")
+	clusterQueryCache  = flag.Int("clusterquerycache", 0, "use with -passthrough, how many rows of follower results to cache for queries that exclude the memstore, so that repeated queries only query partitions that archived new data since. 0 disables the cache")
+	clusterCacheTTL    = flag.Duration("clusterquerycachettl", 1*time.Hour, "use with -clusterquerycache, how long to use cached follower results")
+	clusterTimeout     = flag.Duration("clusterquerytimeoutmargin", 0, "use with -passthrough, if specified, each partition of a query only gets the 99th percentile of its recent query latencies plus this margin to return results before the query returns partial results without it")
+	maxArchiveQueue    = flag.Int64("maxarchivequeuedepth", 0, "if specified, /readyz fails while any table has more than this many inserts waiting to be flushed to disk")
+	maxFollowLag       = flag.Duration("maxfollowlag", 0, "use with -capture, if specified, /readyz fails while data arrives from the leader more than this long after its timestamp")
+	maxFlushRate       = flag.Int64("maxflushbytespersecond", 0, "if specified, limits how many bytes per second flushes write to disk across all tables, unless memstores are backing up")
+	readOnly           = flag.Bool("readonly", false, "set to true to serve queries from an existing db dir that another process writes to, without inserting or modifying anything")
+	mmapReads          = flag.Bool("mmapreads", false, "set to true to read table data files through memory mappings instead of regular file reads, keeping large scans from buffering file contents on the heap")
 	maxFollowAge       = flag.Duration("maxfollowage", 0, "user with -follow, limits how far to go back when pulling data from leader")
 	redisAddr          = flag.String("redis", "", "Redis address in \"redis[s]://host:port\" format")
 	redisCA            = flag.String("redisca", "", "Certificate for redislabs's CA")
@@ -74,25 +122,58 @@ var (
 func main() {
 	iniflags.Parse()
 
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = cfg.ApplyFlags(flag.CommandLine)
+	if err != nil {
+		log.Fatal(err)
+	}
+	schemaFile := *schema
+	if len(cfg.Tables) > 0 && !flagSpecified("schema") {
+		// tables come from the config file
+		schemaFile = ""
+	}
+
 	if *pprofAddr != "" {
+		*opsAddr = *pprofAddr
+	}
+	opsMux := http.NewServeMux()
+	if *opsAddr != "" {
+		opsMux.HandleFunc("/debug/pprof/", pprof.Index)
+		opsMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		opsMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		opsMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		opsMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 		go func() {
-			log.Debugf("Starting pprof page at http://%s/debug/pprof", *pprofAddr)
-			if err := http.ListenAndServe(*pprofAddr, nil); err != nil {
+			log.Debugf("Starting ops page at http://%s/debug/pprof", *opsAddr)
+			if err := http.ListenAndServe(*opsAddr, opsMux); err != nil {
 				log.Error(err)
 			}
 		}()
 	}
 
-	l, err := tlsdefaults.Listen(*addr, *pkfile, *certfile)
-	if err != nil {
-		log.Fatalf("Unable to listen for gRPC over TLS connections at %v: %v", *addr, err)
+	if *otlpEndpoint != "" {
+		log.Debugf("Exporting traces to %v", *otlpEndpoint)
+		trace.SetExporter(trace.NewOTLPExporter(&trace.OTLPOpts{
+			Endpoint:    *otlpEndpoint,
+			ServiceName: "zeno",
+		}))
 	}
 
+	// Note - listening with tlsdefaults first makes sure that the pk and cert
+	// files exist before the gRPC listener loads them.
 	hl, err := tlsdefaults.Listen(*httpsAddr, *pkfile, *certfile)
 	if err != nil {
 		log.Fatalf("Unable to listen for HTTPS connections at %v: %v", *httpsAddr, err)
 	}
 
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatalf("Unable to listen for gRPC over TLS connections at %v: %v", *addr, err)
+	}
+
 	var ispProvider isp.Provider
 	var providerErr error
 	if *ispformat != "" && *ispdb != "" {
@@ -112,39 +193,51 @@ func main() {
 		}
 	}
 
-	clientSessionCache := tls.NewLRUClientSessionCache(10000)
 	var follow func(f func() *common.Follow, cb func(data []byte, newOffset wal.Offset) error)
-	var registerQueryHandler func(partition int, query planner.QueryClusterFN)
+	var registerQueryHandler func(partition int, caps func() *common.QueryHandlerCapabilities, query planner.QueryClusterFN)
+	var forwardInsert func(stream string, ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap) error
+	var flushForwardedInserts func()
+	var closeForwardedInserts func()
 	if *capture != "" {
-		host, _, _ := net.SplitHostPort(*capture)
-		clientTLSConfig := &tls.Config{
-			ServerName:         host,
-			InsecureSkipVerify: *insecure,
-			ClientSessionCache: clientSessionCache,
-		}
-
 		dest := *capture
 		if *captureOverride != "" {
 			dest = *captureOverride
 		}
 
-		clientOpts := &rpc.ClientOpts{
-			Password: *password,
-			Dialer: func(addr string, timeout time.Duration) (net.Conn, error) {
-				conn, dialErr := net.DialTimeout("tcp", dest, timeout)
-				if dialErr != nil {
-					return nil, dialErr
-				}
-				tlsConn := tls.Client(conn, clientTLSConfig)
-				return tlsConn, tlsConn.Handshake()
-			},
+		clientOpts := func() *rpc.ClientOpts {
+			return &rpc.ClientOpts{
+				Password:          *password,
+				TLS:               clientTLSOpts(),
+				KeepaliveInterval: *rpcKeepalive,
+				KeepaliveTimeout:  *rpcKeepaliveWait,
+				MaxRecvMsgSize:    *rpcMaxMsgSize,
+				MaxSendMsgSize:    *rpcMaxMsgSize,
+				Dialer: func(addr string, timeout time.Duration) (net.Conn, error) {
+					return net.DialTimeout("tcp", dest, timeout)
+				},
+			}
 		}
 
-		client, dialErr := rpc.Dial(*capture, clientOpts)
+		client, dialErr := rpc.Dial(*capture, clientOpts())
 		if dialErr != nil {
 			log.Fatalf("Unable to connect to passthrough at %v: %v", *capture, dialErr)
 		}
 
+		if *forwardInserts {
+			forwardClient, forwardErr := zenoclient.Dial(*capture, &zenoclient.Opts{ClientOpts: *clientOpts()})
+			if forwardErr != nil {
+				log.Fatalf("Unable to connect to passthrough at %v for forwarding inserts: %v", *capture, forwardErr)
+			}
+			log.Debugf("Forwarding inserts to %v", *capture)
+			forwarder := forwardClient.NewForwarder(&zenoclient.ForwarderOpts{})
+			forwardInsert = forwarder.Forward
+			flushForwardedInserts = forwarder.Flush
+			closeForwardedInserts = func() {
+				forwarder.Close()
+				forwardClient.Close()
+			}
+		}
+
 		log.Debugf("Capturing data from %v", *capture)
 		follow = func(ff func() *common.Follow, insert func(data []byte, newOffset wal.Offset) error) {
 			minWait := 1 * time.Second
@@ -161,7 +254,13 @@ func main() {
 					for {
 						data, newOffset, followErr := followFunc()
 						if followErr != nil {
-							log.Errorf("Error reading from stream %v: %v", f.Stream, followErr)
+							if rpc.IsResyncRequired(followErr) {
+								log.Errorf("Leader no longer has the data needed to follow stream %v, this follower needs to be resynced: %v", f.Stream, followErr)
+							} else if rpc.IsPlacementRejected(followErr) {
+								log.Errorf("Leader rejected this follower for stream %v because of its placement constraints, check -labels: %v", f.Stream, followErr)
+							} else {
+								log.Errorf("Error reading from stream %v: %v", f.Stream, followErr)
+							}
 							break
 						}
 						insertErr := insert(data, newOffset)
@@ -192,38 +291,31 @@ func main() {
 		}
 		clients := make([]rpc.Client, 0, len(leaders))
 		for i, leader := range leaders {
-			host, _, _ := net.SplitHostPort(leader)
-			clientTLSConfig := &tls.Config{
-				ServerName:         host,
-				InsecureSkipVerify: *insecure,
-				ClientSessionCache: clientSessionCache,
-			}
-
 			dest := leader
 			if *feedOverride != "" {
 				dest = leaderOverrides[i]
 			}
 
 			clientOpts := &rpc.ClientOpts{
-				Password: *password,
+				Password:          *password,
+				TLS:               clientTLSOpts(),
+				KeepaliveInterval: *rpcKeepalive,
+				KeepaliveTimeout:  *rpcKeepaliveWait,
+				MaxRecvMsgSize:    *rpcMaxMsgSize,
+				MaxSendMsgSize:    *rpcMaxMsgSize,
 				Dialer: func(addr string, timeout time.Duration) (net.Conn, error) {
-					conn, dialErr := net.DialTimeout("tcp", dest, timeout)
-					if dialErr != nil {
-						return nil, dialErr
-					}
-					tlsConn := tls.Client(conn, clientTLSConfig)
-					return tlsConn, tlsConn.Handshake()
+					return net.DialTimeout("tcp", dest, timeout)
 				},
 			}
 
-			client, dialErr := rpc.Dial(*capture, clientOpts)
+			client, dialErr := rpc.Dial(leader, clientOpts)
 			if dialErr != nil {
 				log.Fatalf("Unable to connect to query leader at %v: %v", leader, dialErr)
 			}
 			clients = append(clients, client)
 			log.Debugf("Handling queries for: %v", leader)
 		}
-		registerQueryHandler = func(partition int, query planner.QueryClusterFN) {
+		registerQueryHandler = func(partition int, caps func() *common.QueryHandlerCapabilities, query planner.QueryClusterFN) {
 			minWaitTime := 50 * time.Millisecond
 			maxWaitTime := 5 * time.Second
 
@@ -234,7 +326,7 @@ func main() {
 						// Continually handle queries and then reconnect for next query
 						waitTime := minWaitTime
 						for {
-							handleErr := client.ProcessRemoteQuery(context.Background(), partition, query)
+							handleErr := client.ProcessRemoteQuery(context.Background(), partition, caps, query)
 							if handleErr == nil {
 								waitTime = minWaitTime
 							} else {
@@ -269,25 +361,136 @@ func main() {
 		}
 	}
 
+	var tenants map[string]*zenodb.TenantOpts
+	if *tenantsFile != "" {
+		tenants, err = zenodb.LoadTenants(*tenantsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var schedules map[string]*zenodb.ScheduleOpts
+	if *schedulesFile != "" {
+		schedules, err = zenodb.LoadSchedules(*schedulesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var rules map[string]*zenodb.RuleOpts
+	if *rulesFile != "" {
+		rules, err = zenodb.LoadRules(*rulesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var placement *zenodb.PlacementOpts
+	if *placementFile != "" {
+		placement, err = zenodb.LoadPlacement(*placementFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var followerLabels map[string]string
+	if *labels != "" {
+		followerLabels, err = zenodb.ParseLabels(*labels)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var dimOwners zenodb.DimensionOwners
+	if *dimOwnersFile != "" {
+		dimOwners, err = zenodb.LoadDimensionOwners(*dimOwnersFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var replicate *zenodb.ReplicateOpts
+	if *replicateTo != "" {
+		if *replicateStreams == "" {
+			log.Fatal("-replicateto requires -replicatestreams")
+		}
+		replicateClient, replicateErr := zenoclient.Dial(*replicateTo, &zenoclient.Opts{ClientOpts: rpc.ClientOpts{
+			Password:          *password,
+			TLS:               clientTLSOpts(),
+			KeepaliveInterval: *rpcKeepalive,
+			KeepaliveTimeout:  *rpcKeepaliveWait,
+			MaxRecvMsgSize:    *rpcMaxMsgSize,
+			MaxSendMsgSize:    *rpcMaxMsgSize,
+		}})
+		if replicateErr != nil {
+			log.Fatalf("Unable to connect to %v for replication: %v", *replicateTo, replicateErr)
+		}
+		log.Debugf("Replicating %v to %v", *replicateStreams, *replicateTo)
+		replicate = &zenodb.ReplicateOpts{
+			Streams: strings.Split(*replicateStreams, ","),
+			Insert: func(stream string, points []*zenodb.ReplicatedPoint) error {
+				rawPoints := make([]*zenoclient.RawPoint, 0, len(points))
+				for _, point := range points {
+					rawPoints = append(rawPoints, &zenoclient.RawPoint{TS: point.TS, Dims: point.Dims, Vals: point.Vals})
+				}
+				report, insertErr := replicateClient.InsertRaw(context.Background(), stream, rawPoints)
+				if insertErr != nil {
+					return insertErr
+				}
+				if len(report.Errors) > 0 {
+					// Rejected points would be rejected again, so don't retry them
+					log.Errorf("%d of %d points replicated to %v were rejected", len(report.Errors), len(points), stream)
+				}
+				return nil
+			},
+		}
+	}
+
 	db, err := zenodb.NewDB(&zenodb.DBOpts{
 		Dir:                        *dbdir,
-		SchemaFile:                 *schema,
+		SchemaFile:                 schemaFile,
+		Schema:                     cfg.Tables,
 		EnableGeo:                  *enablegeo,
 		ISPProvider:                ispProvider,
 		AliasesFile:                *aliasesFile,
+		Plugins:                    pluginPaths(*plugins),
 		RedisClient:                redisClient,
 		RedisCacheSize:             *redisCacheSize,
 		VirtualTime:                *vtime,
 		WALSyncInterval:            *walSync,
 		MaxWALSize:                 *maxWALSize,
 		WALCompressionSize:         *walCompressionSize,
+		MaxWALAge:                  *maxWALAge,
+		WALCompressionAge:          *walCompressionAge,
 		MaxMemoryRatio:             *maxMemory,
 		Passthrough:                *passthrough,
 		NumPartitions:              *numPartitions,
 		Partition:                  *partition,
+		LocalPartition:             *localPartition,
+		DimensionOwners:            dimOwners,
 		Follow:                     follow,
+		Labels:                     followerLabels,
+		Placement:                  placement,
 		MaxFollowAge:               *maxFollowAge,
+		ClusterQueryBufferSize:     *clusterQueryBuffer,
+		ClusterQueryCacheSize:      *clusterQueryCache,
+		ClusterQueryCacheTTL:       *clusterCacheTTL,
+		ClusterQueryTimeoutMargin:  *clusterTimeout,
 		RegisterRemoteQueryHandler: registerQueryHandler,
+		ForwardInsert:              forwardInsert,
+		FlushForwardedInserts:      flushForwardedInserts,
+		CloseForwardedInserts:      closeForwardedInserts,
+		Tenants:                    tenants,
+		RecordStats:                *recordStats,
+		MaxArchiveQueueDepth:       *maxArchiveQueue,
+		MaxFollowLag:               *maxFollowLag,
+		MmapReads:                  *mmapReads,
+		MaxFlushBytesPerSecond:     *maxFlushRate,
+		ReadOnly:                   *readOnly,
+		Schedules:                  schedules,
+		Rules:                      rules,
+		SavedQueriesFile:           *savedQueriesFile,
+		Replicate:                  replicate,
 	})
 	db.HandleShutdownSignal()
 
@@ -295,23 +498,134 @@ func main() {
 		log.Fatalf("Unable to open database at %v: %v", *dbdir, err)
 	}
 	fmt.Printf("Opened database at %v\n", *dbdir)
+	if *opsAddr != "" {
+		db.RegisterOpsHandlers(opsMux)
+	}
 
 	fmt.Printf("Listening for gRPC connections at %v\n", l.Addr())
 	fmt.Printf("Listening for HTTP connections at %v\n", hl.Addr())
 
+	if *pgAddr != "" {
+		pl, err := net.Listen("tcp", *pgAddr)
+		if err != nil {
+			log.Fatalf("Unable to listen for PostgreSQL connections at %v: %v", *pgAddr, err)
+		}
+		fmt.Printf("Listening for PostgreSQL connections at %v\n", pl.Addr())
+		go servePG(db, pl)
+	}
+
 	go serveHTTP(db, hl)
 	serveRPC(db, l)
 }
 
+// flagSpecified indicates whether the named flag was set on the command line
+// or from the config.
+func flagSpecified(name string) bool {
+	specified := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			specified = true
+		}
+	})
+	return specified
+}
+
+// pluginPaths splits the value of -plugins into paths.
+func pluginPaths(plugins string) []string {
+	var result []string
+	for _, path := range strings.Split(plugins, ",") {
+		path = strings.TrimSpace(path)
+		if path != "" {
+			result = append(result, path)
+		}
+	}
+	return result
+}
+
 func serveRPC(db *zenodb.DB, l net.Listener) {
+	var credentials map[string]*rpcserver.Credential
+	if *credentialsFile != "" {
+		var err error
+		credentials, err = rpcserver.LoadCredentials(*credentialsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Recover from panics closest to the handlers so that metrics and logs see
+	// them as Internal errors
+	methodMetrics := rpc.NewMethodMetrics()
+	db.AddMetrics(methodMetrics.WriteMetrics)
+	streamInterceptors := []grpc.StreamServerInterceptor{methodMetrics.StreamInterceptor()}
+	unaryInterceptors := []grpc.UnaryServerInterceptor{methodMetrics.UnaryInterceptor()}
+	if *rpcLogRequests {
+		streamInterceptors = append(streamInterceptors, rpc.LoggingStreamInterceptor())
+		unaryInterceptors = append(unaryInterceptors, rpc.LoggingUnaryInterceptor())
+	}
+	streamInterceptors = append(streamInterceptors, rpc.RecoveryStreamInterceptor())
+	unaryInterceptors = append(unaryInterceptors, rpc.RecoveryUnaryInterceptor())
+
+	var limits *rpcserver.Limits
+	if *rpcMaxStreams > 0 || *rpcMaxQPS > 0 || *rpcMaxFollowRate > 0 {
+		limits = &rpcserver.Limits{
+			MaxConcurrentStreams:    *rpcMaxStreams,
+			MaxQueriesPerSecond:     *rpcMaxQPS,
+			MaxFollowBytesPerSecond: *rpcMaxFollowRate,
+		}
+	}
+
 	err := rpcserver.Serve(db, l, &rpcserver.Opts{
-		Password: *password,
+		Password:    *password,
+		Credentials: credentials,
+		TLS: &rpc.TLSOpts{
+			CertFile:          *certfile,
+			KeyFile:           *pkfile,
+			CAFile:            *cafile,
+			RequireClientCert: *cafile != "",
+			ReloadInterval:    *tlsReload,
+		},
+		KeepaliveInterval:          *rpcKeepalive,
+		KeepaliveTimeout:           *rpcKeepaliveWait,
+		MinClientKeepaliveInterval: *rpcKeepalive / 2,
+		MaxRecvMsgSize:             *rpcMaxMsgSize,
+		MaxSendMsgSize:             *rpcMaxMsgSize,
+		IdleTimeout:                *rpcIdleTimeout,
+		RemoteQueryPingInterval:    *rpcQueryPing,
+		RemoteQueryPingTimeout:     *rpcQueryPingWait,
+		StreamInterceptors:         streamInterceptors,
+		UnaryInterceptors:          unaryInterceptors,
+		Limits:                     limits,
+		MaxResultRows:              *rpcMaxResultRows,
+		MaxResultBytes:             *rpcMaxResultBytes,
 	})
 	if err != nil {
 		log.Fatalf("Error serving gRPC: %v", err)
 	}
 }
 
+func clientTLSOpts() *rpc.TLSOpts {
+	opts := &rpc.TLSOpts{
+		InsecureSkipVerify: *insecure,
+		ReloadInterval:     *tlsReload,
+	}
+	if *cafile != "" {
+		// Use mutual TLS
+		opts.CAFile = *cafile
+		opts.CertFile = *certfile
+		opts.KeyFile = *pkfile
+	}
+	return opts
+}
+
+func servePG(db *zenodb.DB, l net.Listener) {
+	err := pgwire.Serve(db, l, &pgwire.Opts{
+		Password: *password,
+	})
+	if err != nil {
+		log.Errorf("Error serving PostgreSQL: %v", err)
+	}
+}
+
 func serveHTTP(db *zenodb.DB, hl net.Listener) {
 	router := mux.NewRouter()
 	err := web.Configure(db, router, &web.Opts{
@@ -1,7 +1,9 @@
 package zenodb
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -14,15 +16,17 @@ import (
 
 	"github.com/cloudfoundry/gosigar"
 	"github.com/dustin/go-humanize"
+	"github.com/getlantern/bytemap"
 	"github.com/getlantern/goexpr/geo"
 	"github.com/getlantern/goexpr/isp"
 	geredis "github.com/getlantern/goexpr/redis"
-	"github.com/getlantern/golog"
-	"github.com/getlantern/vtime"
 	"github.com/getlantern/wal"
 	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/logging"
 	"github.com/getlantern/zenodb/planner"
 	"github.com/getlantern/zenodb/sql"
+	"github.com/getlantern/zenodb/trace"
+	"github.com/getlantern/zenodb/udf"
 	"github.com/rickar/props"
 	"github.com/shirou/gopsutil/process"
 	"gopkg.in/redis.v5"
@@ -30,10 +34,17 @@ import (
 
 const (
 	defaultMaxBackupWait = 1 * time.Hour
+
+	defaultClusterQueryBufferSize = 1000
+	defaultClusterQueryCacheTTL   = 1 * time.Hour
 )
 
 var (
-	log = golog.LoggerFor("zenodb")
+	log = logging.LoggerFor("zenodb")
+
+	// Version is the version of zenodb, which can be set at build time with
+	// -ldflags "-X github.com/getlantern/zenodb.Version=x.y.z"
+	Version = "development"
 
 	systemRAM float64
 )
@@ -54,9 +65,15 @@ type DBOpts struct {
 	// SchemaFile points at a YAML schema file that configures the tables and
 	// views in the database.
 	SchemaFile string
+	// Schema, if specified, configures tables and views in the database when it
+	// opens. It's applied before the SchemaFile (if any).
+	Schema Schema
 	// AliasesFile points at a file that contains expression aliases in the form
 	// name=template(%v, %v), with one alias per line.
 	AliasesFile string
+	// Plugins are paths to Go plugins that register user-defined functions, see
+	// package udf.
+	Plugins []string
 	// EnableGeo enables geolocation functions
 	EnableGeo bool
 	// ISPProvider configures a provider of ISP lookups. Specify this to allow the
@@ -72,6 +89,9 @@ type DBOpts struct {
 	// VirtualTime, if true, tells zenodb to use a virtual clock that advances
 	// based on the timestamps of Points received via inserts.
 	VirtualTime bool
+	// Clock, if specified, is the virtual clock to use. It implies VirtualTime
+	// and allows tests to start the clock at a known time and drive it.
+	Clock *VirtualClock
 	// WALSyncInterval governs how frequently to sync the WAL to disk. 0 means
 	// it syncs after every write (which is not great for performance).
 	WALSyncInterval time.Duration
@@ -79,6 +99,14 @@ type DBOpts struct {
 	MaxWALSize int
 	// WALCompressionSize specifies the size beyond which to compress WAL segments
 	WALCompressionSize int
+	// MaxWALAge, if positive, additionally limits how long to keep WAL segments
+	// (based on when they were written), so that streams that see little
+	// traffic don't hold on to old data until they reach MaxWALSize.
+	MaxWALAge time.Duration
+	// WALCompressionAge, if positive, additionally compresses WAL segments once
+	// they're older than this, even if the WAL is smaller than
+	// WALCompressionSize.
+	WALCompressionAge time.Duration
 	// MaxMemoryRatio caps the maximum memory of this process. When the system
 	// comes under memory pressure, it will start flushing table memstores.
 	MaxMemoryRatio float64
@@ -92,21 +120,119 @@ type DBOpts struct {
 	// NumPartitions identifies how many partitions to split data from
 	// passthrough nodes.
 	NumPartitions int
-	// Partition identies the partition owned by this follower
+	// Partition identies the partition owned by this follower, or by this
+	// passthrough node if LocalPartition is true
 	Partition int
+	// LocalPartition, if true, makes a passthrough node also store the data for
+	// its Partition in its own tables, like a follower would, so that the leader
+	// can ingest data too in hybrid deployments. Cluster queries read that
+	// partition from the local tables instead of from a follower and merge it
+	// with the results from the followers of the other partitions.
+	LocalPartition bool
+	// DimensionOwners, if specified, tells a passthrough node which partitions
+	// exclusively own specific dimension values, so that queries filtered on
+	// those values are only sent to the partitions that own them.
+	DimensionOwners DimensionOwners
 	// MaxFollowAge limits how far back to go when follower pulls data from
 	// leader
 	MaxFollowAge time.Duration
+	// ClusterQueryBufferSize limits how many rows from each partition a
+	// passthrough node buffers while processing a query. Defaults to 1000.
+	ClusterQueryBufferSize int
+	// ClusterQueryTimeoutMargin enables adaptive timeouts for the partitions of
+	// clustered queries. If positive, each partition only gets the 99th
+	// percentile of its recent latencies for the same query plus this margin to
+	// return its results, rather than the query's whole deadline. The query then
+	// returns ErrPartialResults along with the results of the other partitions,
+	// leaving out any rows the straggler already sent. Queries always wait for
+	// at least one partition, and partitions that haven't answered the query
+	// often enough yet get the whole deadline.
+	ClusterQueryTimeoutMargin time.Duration
+	// ClusterQueryCacheSize limits how many rows of follower results a
+	// passthrough node caches for queries that exclude the memstore, so that
+	// repeated queries (e.g. from dashboards) only query the partitions whose
+	// followers archived new data since. If 0, nothing is cached.
+	ClusterQueryCacheSize int
+	// ClusterQueryCacheTTL limits how long cached follower results are used.
+	// Defaults to 1 hour.
+	ClusterQueryCacheTTL time.Duration
 	// Follow is a function that allows a follower to request following a stream
 	// from a passthrough node.
 	Follow                     func(f func() *common.Follow, cb func(data []byte, newOffset wal.Offset) error)
-	RegisterRemoteQueryHandler func(partition int, query planner.QueryClusterFN)
+	RegisterRemoteQueryHandler func(partition int, caps func() *common.QueryHandlerCapabilities, query planner.QueryClusterFN)
+	// Labels describe where a follower runs, like rack=r1 or zone=eu-west-1a.
+	// They're sent to the leader when following so that it can enforce its
+	// Placement.
+	Labels map[string]string
+	// Placement, if specified, makes a passthrough node only allow followers
+	// whose Labels satisfy the given constraints. See PlacementOpts.
+	Placement *PlacementOpts
+	// ForwardInsert, if specified, allows followers to accept inserts by
+	// forwarding them to the leader.
+	ForwardInsert func(stream string, ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap) error
+	// FlushForwardedInserts, if specified, immediately sends any inserts queued
+	// for forwarding to the leader.
+	FlushForwardedInserts func()
+	// CloseForwardedInserts, if specified, is called by Close to stop accepting
+	// forwarded inserts and to wait for queued ones to be sent to the leader.
+	CloseForwardedInserts func()
+	// Tenants configures quotas for tenants, keyed by tenant name. See
+	// TenantOpts.
+	Tenants map[string]*TenantOpts
+	// RecordStats, if true, records the TableStats of every table into the
+	// built-in _zeno_stats table once a minute so that the database can monitor
+	// itself. Not supported on passthrough nodes or followers.
+	RecordStats bool
+	// MaxArchiveQueueDepth, if specified, makes the database not Ready while any
+	// table has more than this many inserts waiting to be flushed to disk.
+	MaxArchiveQueueDepth int64
+	// MaxFollowLag, if specified, makes a follower not Ready while data arrives
+	// from the leader more than this long after its timestamp.
+	MaxFollowLag time.Duration
+	// MmapReads, if true, reads table data files through memory mappings
+	// instead of regular file reads, which keeps large scans from buffering the
+	// files' contents on the Go heap. Not supported on Windows, where data files
+	// are always read normally.
+	MmapReads bool
+	// MaxFlushBytesPerSecond, if specified, limits how fast flushes write to
+	// disk across all tables, so that bursts of flushes don't hurt query
+	// latency. The limit is lifted while the process exceeds MaxMemoryRatio or a
+	// table exceeds MaxArchiveQueueDepth. Forced flushes aren't limited.
+	MaxFlushBytesPerSecond int64
+	// ReadOnly opens an existing database directory without modifying it, so
+	// that queries can run against the data of a database that's being written
+	// by another process, for example for ad-hoc analysis or to verify backups.
+	// Tables only contain data that the writing process has flushed to disk, and
+	// pick up newer flushes as they appear. Inserts, SET and administrative
+	// operations like flushing are rejected. Not supported on passthrough nodes,
+	// followers or with RecordStats.
+	ReadOnly bool
+	// Schedules configures queries, keyed by name, that run on a schedule and
+	// write their results to a sink like another table or a webhook. See
+	// ScheduleOpts. Not supported on followers, since they only hold part of
+	// the data. Run them on the leader instead.
+	Schedules map[string]*ScheduleOpts
+	// Rules configures alerting rules, keyed by name, that are evaluated
+	// periodically and post alerts to webhooks or PagerDuty when they fire. See
+	// RuleOpts. Like Schedules, not supported on followers.
+	Rules map[string]*RuleOpts
+	// SavedQueries configures queries, keyed by name, that clients can run by
+	// name with EXECUTE. See SavedQueryOpts.
+	SavedQueries map[string]*SavedQueryOpts
+	// SavedQueriesFile points at a YAML file of saved queries (see
+	// LoadSavedQueries) that's reapplied whenever it changes. It replaces
+	// SavedQueries.
+	SavedQueriesFile string
+	// Replicate, if specified, asynchronously replicates streams to another
+	// cluster. See ReplicateOpts. Not supported on followers, which don't
+	// have a WAL of their own.
+	Replicate *ReplicateOpts
 }
 
 // DB is a zenodb database.
 type DB struct {
 	opts                 *DBOpts
-	clock                vtime.Clock
+	clock                timeSource
 	tables               map[string]*table
 	orderedTables        []*table
 	streams              map[string]*wal.WAL
@@ -115,11 +241,52 @@ type DB struct {
 	isSorting            bool
 	nextTableToSort      int
 	memory               uint64
+	rss                  uint64
 	flushMutex           sync.Mutex
 	followerJoined       chan *follower
 	processFollowersOnce sync.Once
-	remoteQueryHandlers  map[int]chan planner.QueryClusterFN
+	remoteQueryHandlers  map[int]chan *queryHandler
 	closed               bool
+	clusterStatusMx      sync.RWMutex
+	activeFollowers      map[int]*follower
+	queryLatencies       map[int]time.Duration
+	latencyHistories     map[int]*latencyHistory
+	fingerprintLatencies map[string]*queryLatencies
+	followGaps           map[string]*common.FollowGap
+	resyncsRequired      int64
+	placedFollowers      map[*follower]bool
+	placementRejections  int64
+	tenants              map[string]*tenant
+	followLagsMx         sync.RWMutex
+	followLags           map[string]time.Duration
+	tunablesMx           sync.RWMutex
+	settingsMx           sync.Mutex
+	settings             map[string]string
+	tombstonesMx         sync.RWMutex
+	tombstones           []*tombstone
+	remapsMx             sync.Mutex
+	remaps               map[string]*remapJob
+	migrationsMx         sync.Mutex
+	migrations           map[string]*migrationJob
+	replaysMx            sync.Mutex
+	replays              map[string]*ReplayStatus
+	scheduledQueries     []*scheduledQuery
+	rules                []*rule
+	savedQueriesMx       sync.RWMutex
+	savedQueries         map[string]*SavedQueryOpts
+	changes              changeCaptures
+	replicator           *replicator
+	flushThrottle        *flushThrottle
+	extraMetrics         []func(w io.Writer) error
+	extraMetricsMx       sync.Mutex
+	// heldSince is the earliest time (in unix nanos) for which a follower holds
+	// complete data, if it skipped data when it started following. It's
+	// accessed atomically.
+	heldSince int64
+	// lastArchived is the last time (in unix nanos) at which any table archived
+	// new data to disk. It's accessed atomically.
+	lastArchived int64
+	clusterCache *clusterCache
 }
 
 // NewDB creates a database using the given options.
@@ -127,15 +294,25 @@ func NewDB(opts *DBOpts) (*DB, error) {
 	var err error
 	db := &DB{
 		opts:                opts,
-		clock:               vtime.RealClock,
+		clock:               realTime,
 		tables:              make(map[string]*table),
 		streams:             make(map[string]*wal.WAL),
 		newStreamSubscriber: make(map[string]chan *tableWithOffset),
 		followerJoined:      make(chan *follower, opts.NumPartitions),
-		remoteQueryHandlers: make(map[int]chan planner.QueryClusterFN),
+		remoteQueryHandlers: make(map[int]chan *queryHandler),
+		activeFollowers:     make(map[int]*follower),
+		clusterCache:        newClusterCache(),
+		queryLatencies:      make(map[int]time.Duration),
+		followGaps:          make(map[string]*common.FollowGap),
+		placedFollowers:     make(map[*follower]bool),
+		tenants:             newTenants(opts.Tenants),
+		followLags:          make(map[string]time.Duration),
 	}
-	if opts.VirtualTime {
-		db.clock = vtime.NewVirtualClock(time.Time{})
+	db.flushThrottle = newFlushThrottle(db)
+	if opts.Clock != nil {
+		db.clock = opts.Clock
+	} else if opts.VirtualTime {
+		db.clock = NewVirtualClock(time.Time{})
 	}
 	if opts.MaxWALSize <= 0 {
 		opts.MaxWALSize = 10 * 1024768 // 10 MB
@@ -146,11 +323,68 @@ func NewDB(opts *DBOpts) (*DB, error) {
 	if opts.MaxBackupWait <= 0 {
 		opts.MaxBackupWait = defaultMaxBackupWait
 	}
+	if opts.ClusterQueryBufferSize <= 0 {
+		opts.ClusterQueryBufferSize = defaultClusterQueryBufferSize
+	}
+	if opts.ClusterQueryCacheTTL <= 0 {
+		opts.ClusterQueryCacheTTL = defaultClusterQueryCacheTTL
+	}
 
-	// Create db dir
-	err = os.MkdirAll(opts.Dir, 0755)
-	if err != nil && !os.IsExist(err) {
-		return nil, fmt.Errorf("Unable to create db dir at %v: %v", opts.Dir, err)
+	if opts.LocalPartition && (!opts.Passthrough || opts.Partition < 0 || opts.Partition >= opts.NumPartitions) {
+		return nil, fmt.Errorf("LocalPartition requires Passthrough and a Partition less than NumPartitions")
+	}
+	if opts.Placement != nil {
+		if !opts.Passthrough {
+			return nil, fmt.Errorf("Placement requires Passthrough")
+		}
+		err = opts.Placement.validate(opts.NumPartitions)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(opts.DimensionOwners) > 0 {
+		if !opts.Passthrough {
+			return nil, fmt.Errorf("DimensionOwners requires Passthrough")
+		}
+		opts.DimensionOwners, err = opts.DimensionOwners.normalized(opts.NumPartitions)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.ReadOnly {
+		if opts.Passthrough || opts.Follow != nil || opts.RecordStats {
+			return nil, fmt.Errorf("ReadOnly is not supported on passthrough nodes, followers or with RecordStats")
+		}
+		_, err = os.Stat(opts.Dir)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to open db dir at %v for reading: %v", opts.Dir, err)
+		}
+	} else {
+		// Create db dir
+		err = os.MkdirAll(opts.Dir, 0755)
+		if err != nil && !os.IsExist(err) {
+			return nil, fmt.Errorf("Unable to create db dir at %v: %v", opts.Dir, err)
+		}
+	}
+
+	err = db.loadSettings()
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.loadTombstones()
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.loadRemaps()
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.loadMigrations()
+	if err != nil {
+		return nil, err
 	}
 
 	if opts.EnableGeo {
@@ -170,11 +404,25 @@ func NewDB(opts *DBOpts) (*DB, error) {
 		registerAliases(opts.AliasesFile)
 	}
 
+	for _, path := range opts.Plugins {
+		log.Debugf("Loading functions from plugin %v", path)
+		err = udf.LoadPlugin(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if opts.RedisClient != nil && opts.RedisCacheSize > 0 {
 		log.Debug("Enabling redis expressions")
 		geredis.Configure(opts.RedisClient, opts.RedisCacheSize)
 	}
 
+	if len(opts.Schema) > 0 {
+		err = db.ApplySchema(opts.Schema)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to apply schema: %v", err)
+		}
+	}
 	if opts.SchemaFile != "" {
 		err = db.pollForSchema(opts.SchemaFile)
 		if err != nil {
@@ -183,8 +431,63 @@ func NewDB(opts *DBOpts) (*DB, error) {
 	}
 	log.Debugf("Dir: %v    SchemaFile: %v", opts.Dir, opts.SchemaFile)
 
+	if len(opts.SavedQueries) > 0 {
+		err = db.ApplySavedQueries(opts.SavedQueries)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.SavedQueriesFile != "" {
+		err = db.pollForSavedQueries(opts.SavedQueriesFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.RecordStats {
+		if opts.Passthrough || opts.Follow != nil {
+			return nil, fmt.Errorf("RecordStats is not supported on passthrough nodes or followers")
+		}
+		err = db.recordStats()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to record stats: %v", err)
+		}
+	}
+
+	if len(opts.Schedules) > 0 {
+		if opts.Follow != nil {
+			return nil, fmt.Errorf("Schedules are not supported on followers")
+		}
+		db.scheduledQueries, err = db.newScheduledQueries(opts.Schedules)
+		if err != nil {
+			return nil, err
+		}
+		db.startScheduler()
+	}
+
+	if len(opts.Rules) > 0 {
+		if opts.Follow != nil {
+			return nil, fmt.Errorf("Rules are not supported on followers")
+		}
+		db.rules, err = newRules(opts.Rules)
+		if err != nil {
+			return nil, err
+		}
+		db.startRules()
+	}
+
+	if opts.Replicate != nil {
+		if opts.Follow != nil || opts.ReadOnly {
+			return nil, fmt.Errorf("Replicate is not supported on followers or in ReadOnly mode")
+		}
+		db.replicator, err = db.startReplication(opts.Replicate)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if db.opts.RegisterRemoteQueryHandler != nil {
-		go db.opts.RegisterRemoteQueryHandler(db.opts.Partition, db.queryForRemote)
+		go db.opts.RegisterRemoteQueryHandler(db.opts.Partition, db.queryHandlerCapabilities, db.queryForRemote)
 	}
 
 	if db.opts.MaxMemoryRatio > 0 {
@@ -197,6 +500,15 @@ func NewDB(opts *DBOpts) (*DB, error) {
 
 func (db *DB) Close() {
 	log.Debug("Closing")
+	if db.opts.CloseForwardedInserts != nil {
+		// Forwarded inserts have already been acknowledged, send them before
+		// exiting
+		log.Debug("Closing forwarded inserts")
+		db.opts.CloseForwardedInserts()
+	}
+	if db.replicator != nil {
+		db.replicator.stop()
+	}
 	db.tablesMutex.Lock()
 	for name, stream := range db.streams {
 		log.Debugf("Closing stream %v", name)
@@ -236,9 +548,7 @@ func (db *DB) TableStats(table string) TableStats {
 	if t == nil {
 		return TableStats{}
 	}
-	t.statsMutex.RLock()
-	defer t.statsMutex.RUnlock()
-	return t.stats
+	return t.snapshotStats()
 }
 
 // AllTableStats returns all TableStats for all tables, keyed to the table
@@ -252,9 +562,7 @@ func (db *DB) AllTableStats() map[string]TableStats {
 	}
 	db.tablesMutex.RUnlock()
 	for name, t := range tables {
-		t.statsMutex.RLock()
-		m[name] = t.stats
-		t.statsMutex.RUnlock()
+		m[name] = t.snapshotStats()
 	}
 	return m
 }
@@ -273,6 +581,12 @@ func (db *DB) PrintTableStats(table string) string {
 		humanize.Comma(stats.ExpiredValues))
 }
 
+// storesData indicates whether this node stores data in its tables, which
+// passthrough nodes only do for their LocalPartition.
+func (db *DB) storesData() bool {
+	return !db.opts.Passthrough || db.opts.LocalPartition
+}
+
 func (db *DB) getTable(table string) *table {
 	db.tablesMutex.RLock()
 	t := db.tables[strings.ToLower(table)]
@@ -280,23 +594,54 @@ func (db *DB) getTable(table string) *table {
 	return t
 }
 
-func (db *DB) now(table string) time.Time {
+// Now returns the current time according to the database's clock, which is the
+// virtual time if it's using a VirtualClock.
+func (db *DB) Now() time.Time {
 	return db.clock.Now()
 }
 
-func (db *DB) capWALAge(wal *wal.WAL) {
-	for {
-		time.Sleep(1 * time.Minute)
-		db.waitForBackupToFinish()
-		err := wal.TruncateToSize(int64(db.opts.MaxWALSize))
-		if err != nil {
-			log.Errorf("Error truncating WAL: %v", err)
-		}
-		err = wal.CompressBeforeSize(int64(db.opts.WALCompressionSize))
-		if err != nil {
-			log.Errorf("Error compressing WAL: %v", err)
-		}
+// VirtualClock returns the database's virtual clock, or nil if it's using
+// real time.
+func (db *DB) VirtualClock() *VirtualClock {
+	vc, _ := db.clock.(*VirtualClock)
+	return vc
+}
+
+func (db *DB) capWALAge(stream string, wal *wal.WAL) {
+	tk := db.clock.newTicker(1 * time.Minute)
+	defer tk.Stop()
+	for range tk.C() {
+		db.truncateWAL(stream, wal)
+	}
+}
+
+// truncateWAL applies the WAL retention and compression settings to the given
+// stream's WAL. How segments are compressed (snappy) and when they're rotated
+// are up to the wal package and not configurable here.
+func (db *DB) truncateWAL(stream string, wal *wal.WAL) error {
+	_, span := trace.Start(context.Background(), "wal.retention", "stream", stream)
+	db.waitForBackupToFinish()
+	truncateErr := wal.TruncateToSize(int64(db.opts.MaxWALSize))
+	if truncateErr == nil && db.opts.MaxWALAge > 0 {
+		// Segments are named by the real time at which they were written
+		truncateErr = wal.TruncateBeforeTime(time.Now().Add(-1 * db.opts.MaxWALAge))
+	}
+	if truncateErr != nil {
+		log.Errorf("Error truncating WAL: %v", truncateErr)
+	}
+	compressErr := wal.CompressBeforeSize(int64(db.opts.WALCompressionSize))
+	if compressErr == nil && db.opts.WALCompressionAge > 0 {
+		compressErr = wal.CompressBeforeTime(time.Now().Add(-1 * db.opts.WALCompressionAge))
+	}
+	if compressErr != nil {
+		log.Errorf("Error compressing WAL: %v", compressErr)
+	}
+	if truncateErr != nil {
+		span.Finish(truncateErr)
+		return truncateErr
 	}
+	span.Finish(compressErr)
+	return compressErr
 }
 
 func (db *DB) trackMemStats() {
@@ -320,7 +665,7 @@ func (db *DB) updateMemStats() {
 	memstats := &runtime.MemStats{}
 	runtime.ReadMemStats(memstats)
 	atomic.StoreUint64(&db.memory, memstats.Alloc)
-	log.Debugf("Memory InUse: %v    Alloc: %v    Sys: %v     RSS: %v", humanize.Bytes(memstats.HeapInuse), humanize.Bytes(memstats.Alloc), humanize.Bytes(memstats.Sys), humanize.Bytes(mi.RSS))
+	atomic.StoreUint64(&db.rss, mi.RSS)
 }
 
 func (db *DB) capMemStoreSize() {
@@ -93,10 +93,10 @@ func doTestCluster(t *testing.T, numPartitions int, partitionBy []string) {
 				Follow: func(f func() *common.Follow, cb func(data []byte, newOffset wal.Offset) error) {
 					leader.Follow(f(), cb)
 				},
-				RegisterRemoteQueryHandler: func(partition int, query planner.QueryClusterFN) {
+				RegisterRemoteQueryHandler: func(partition int, caps func() *common.QueryHandlerCapabilities, query planner.QueryClusterFN) {
 					var register func()
 					register = func() {
-						leader.RegisterQueryHandler(partition, func(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) error {
+						leader.RegisterQueryHandlerWithCapabilities(partition, caps(), func(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) error {
 							// Re-register when finished
 							defer register()
 							return query(ctx, sqlString, isSubQuery, subQueryResults, unflat, onFields, onRow, onFlatRow)
@@ -353,7 +353,7 @@ view_a:
 
 	table := db.getTable("test_a")
 	fields := table.getFields()
-	table.iterate(context.Background(), fields, true, func(dims bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+	table.iterate(context.Background(), fields, true, nil, nil, func(dims bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
 		log.Debugf("Dims: %v")
 		for i, val := range vals {
 			field := fields[i]